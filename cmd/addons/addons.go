@@ -0,0 +1,196 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package addons
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/charmbracelet/huh"
+	"github.com/charmbracelet/log"
+	"github.com/mightymoud/sidekick/render"
+	"github.com/mightymoud/sidekick/utils"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+)
+
+var AddonsCmd = &cobra.Command{
+	Use:   "addons",
+	Short: "Run services like a database next to your app",
+	Long: `Addons are services sidekick adds to the compose file of your app, like a Postgres database.
+They run on your VPS next to the app, on the sidekick network only, with their data in a named volume.`,
+}
+
+// connect logs into the server of the app and loads its state, sidekick.yml is saved without it
+func connect(cmd *cobra.Command, appConfig utils.SidekickAppConfig, guard bool) (*ssh.Client, utils.SidekickAppConfig, error) {
+	config, err := utils.GetSidekickConfigFromCmdContext(cmd)
+	if err != nil {
+		return nil, appConfig, utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Run sidekick init to set up a VPS first", err)
+	}
+	target, err := utils.ResolveTarget(cmd, config, appConfig.Server, utils.MetadataEnvProduction)
+	if err != nil {
+		return nil, appConfig, utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+	}
+	if guard {
+		if err := utils.GuardTarget(cmd, config, target, appConfig.Name); err != nil {
+			return nil, appConfig, err
+		}
+	}
+	sshClient, err := utils.Login(target.Server.Address, "sidekick")
+	if err != nil {
+		return nil, appConfig, utils.NewStageError("Login", utils.ExitCodeRemote, "Check that the VPS is up and your SSH key is loaded in ssh-agent", err)
+	}
+	if appConfig, err = utils.LoadAppState(utils.SSHExecutor{Client: sshClient}, appConfig); err != nil {
+		sshClient.Close()
+		return nil, appConfig, utils.NewStageError("App State", utils.ExitCodeRemote, "", err)
+	}
+	return sshClient, appConfig, nil
+}
+
+var addCmd = &cobra.Command{
+	Use:   "add <addon>",
+	Short: "Add an addon to your app, it starts on the next deploy",
+	Long: `This command adds the addon to sidekick.yml and its credentials to your env file, DATABASE_URL for postgres and REDIS_URL for redis.
+The next sidekick deploy starts it. Previews get a redis of their own that goes away with them, unless it is added with --shared.`,
+	Example: `  sidekick addons add postgres
+  sidekick addons add redis --persist`,
+	Args:      cobra.ExactArgs(1),
+	ValidArgs: utils.AddonTypes,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		addonType := args[0]
+		if err := utils.ValidateAddonType(addonType); err != nil {
+			return utils.NewStageError("Addons", utils.ExitCodeConfig, "", err)
+		}
+		appConfig, err := utils.LoadAppConfig()
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Run sidekick launch first", err)
+		}
+		if utils.IsSwarm(appConfig) {
+			return utils.NewStageError("Addons", utils.ExitCodeConfig, "", errors.New("addons need the compose orchestrator"))
+		}
+		addon := utils.NewAddon(addonType)
+		addon.Persist, _ = cmd.Flags().GetBool("persist")
+		addon.Shared, _ = cmd.Flags().GetBool("shared")
+		if addonType != utils.AddonRedis && (addon.Persist || addon.Shared) {
+			return utils.NewStageError("Addons", utils.ExitCodeConfig, "", fmt.Errorf("--persist and --shared are only for redis, %s always keeps its data and is shared with previews", addonType))
+		}
+		if utils.FindAddon(appConfig, addonType) >= 0 {
+			return utils.NewStageError("Addons", utils.ExitCodeConfig, "", fmt.Errorf("%s has %s already", appConfig.Name, addonType))
+		}
+		sshClient, appConfig, err := connect(cmd, appConfig, false)
+		if err != nil {
+			return err
+		}
+		sshClient.Close()
+
+		if appConfig.Env.File == "" {
+			appConfig.Env.File = utils.DefaultAddonEnvFile
+		}
+		password := utils.ExistingAddonPassword(appConfig.Env.File, addonType)
+		if password == "" {
+			if password, err = utils.GenerateAddonPassword(); err != nil {
+				return utils.NewStageError("Addons", utils.ExitCodeError, "", err)
+			}
+		}
+		if err := utils.SetEnvVars(appConfig.Env.File, utils.GetAddonEnv(appConfig.Name, addon, password)); err != nil {
+			return utils.NewStageError("Addons", utils.ExitCodeConfig, "", fmt.Errorf("unable to write %s: %w", appConfig.Env.File, err))
+		}
+		appConfig.Addons = append(appConfig.Addons, addon)
+		if err := utils.SaveAppConfig(appConfig); err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
+
+		logger := render.GetLogger(log.Options{Prefix: "Addons"})
+		logger.Infof("Added %s %s as %s, %s is in %s", addonType, addon.Version, utils.AddonService(appConfig.Name, addonType), utils.AddonURLVar(addonType), appConfig.Env.File)
+		logger.Info("Run sidekick deploy to start it")
+		return nil
+	},
+}
+
+var removeCmd = &cobra.Command{
+	Use:   "remove <addon>",
+	Short: "Stop an addon and take it out of your app, its data is kept unless you pass --destroy-data",
+	Example: `  sidekick addons remove postgres
+  sidekick addons remove postgres --destroy-data`,
+	Args:      cobra.ExactArgs(1),
+	ValidArgs: utils.AddonTypes,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		addonType := args[0]
+		appConfig, err := utils.LoadAppConfig()
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Run sidekick launch first", err)
+		}
+		index := utils.FindAddon(appConfig, addonType)
+		if index < 0 {
+			return utils.NewStageError("Addons", utils.ExitCodeConfig, "", fmt.Errorf("%s has no %s addon", appConfig.Name, addonType))
+		}
+		destroyData, _ := cmd.Flags().GetBool("destroy-data")
+		sshClient, appConfig, err := connect(cmd, appConfig, true)
+		if err != nil {
+			return err
+		}
+		defer sshClient.Close()
+
+		if destroyData {
+			confirm := utils.AssumeYes(cmd)
+			if !confirm {
+				if err := utils.RequireInteractive("yes", "confirming the removal of the data"); err != nil {
+					return err
+				}
+				huh.NewConfirm().
+					Title(fmt.Sprintf("This deletes the volume %s with all the data of %s. Are you sure?", utils.AddonVolume(appConfig.Name, addonType), addonType)).
+					Affirmative("Yes!").
+					Negative("No.").
+					Value(&confirm).
+					Run()
+			}
+			if !confirm {
+				return nil
+			}
+		}
+
+		if _, err := utils.RunCommandOutput(sshClient, utils.GetRemoveAddonCommand(appConfig.Name, addonType, destroyData)); err != nil {
+			return utils.NewStageError("Addons", utils.ExitCodeRemote, "", fmt.Errorf("unable to remove %s: %w", addonType, err))
+		}
+		keptData := utils.AddonKeepsData(appConfig.Addons[index]) && !destroyData
+		appConfig.Addons = slices.Delete(appConfig.Addons, index, index+1)
+		// the credentials stay with the data, an addon added back on the old volume needs the same password
+		if destroyData {
+			if err := utils.RemoveEnvVars(appConfig.Env.File, utils.AddonEnvKeys(addonType)); err != nil {
+				return utils.NewStageError("Addons", utils.ExitCodeConfig, "", fmt.Errorf("unable to update %s: %w", appConfig.Env.File, err))
+			}
+		}
+		if err := utils.SaveAppConfig(appConfig); err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
+
+		logger := render.GetLogger(log.Options{Prefix: "Addons"})
+		if !keptData {
+			logger.Infof("Removed %s and its data", addonType)
+		} else {
+			logger.Infof("Removed %s, its data is kept in the volume %s", addonType, utils.AddonVolume(appConfig.Name, addonType))
+		}
+		return nil
+	},
+}
+
+func init() {
+	addCmd.Flags().Bool("persist", false, "Keep the data of redis in a volume across restarts")
+	addCmd.Flags().Bool("shared", false, "Have previews use the redis of production instead of their own")
+	removeCmd.Flags().Bool("destroy-data", false, "Also delete the volume with the data of the addon")
+	AddonsCmd.AddCommand(addCmd)
+	AddonsCmd.AddCommand(removeCmd)
+}
@@ -0,0 +1,85 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package apps
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/mightymoud/sidekick/utils"
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+)
+
+var AppsCmd = &cobra.Command{
+	Use:   "apps",
+	Short: "List every app sidekick manages on your VPS",
+	Long: `This command lists the apps deployed to your VPS with their domain, image, container status, last deploy and number of previews.
+It reads the app folders on the VPS, so it works without a checkout of the apps. Use --context to look at another server.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, err := utils.GetSidekickConfigFromCmdContext(cmd)
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Run sidekick init to set up a VPS first", err)
+		}
+		pinnedServer := ""
+		if utils.FileExists(utils.AppConfigFile) {
+			if appConfig, err := utils.LoadAppConfig(); err == nil {
+				pinnedServer = appConfig.Server
+			}
+		}
+		target, err := utils.ResolveTarget(cmd, config, pinnedServer, utils.MetadataEnvProduction)
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Pass --context to pick a server", err)
+		}
+
+		sshClient, err := utils.Login(target.Server.Address, "sidekick")
+		if err != nil {
+			return utils.NewStageError("Login", utils.ExitCodeRemote, "Check that the VPS is up and your SSH key is loaded in ssh-agent", err)
+		}
+		defer sshClient.Close()
+
+		apps, err := utils.ListRemoteApps(utils.SSHExecutor{Client: sshClient})
+		if err != nil {
+			return utils.NewStageError("Apps", utils.ExitCodeRemote, "", err)
+		}
+
+		if asJSON, _ := cmd.Flags().GetBool("json"); asJSON {
+			out, err := json.MarshalIndent(apps, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(out))
+			return nil
+		}
+		if len(apps) == 0 {
+			pterm.Info.Printfln("No apps found on %s", target.Server.Name)
+			return nil
+		}
+		rows := [][]string{{"App", "Domain", "Image", "Status", "Last deployed", "Previews"}}
+		for _, app := range apps {
+			status := app.Status
+			if status != "running" {
+				status = pterm.Yellow(status)
+			}
+			rows = append(rows, []string{app.Name, app.Domain, app.Image, status, app.LastDeployedAt, strconv.Itoa(app.Previews)})
+		}
+		return pterm.DefaultTable.WithHasHeader().WithBoxed().WithData(rows).Render()
+	},
+}
+
+func init() {
+	AppsCmd.Flags().Bool("json", false, "Print the apps as JSON")
+}
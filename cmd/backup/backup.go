@@ -0,0 +1,238 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package backup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mightymoud/sidekick/utils"
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+)
+
+// resolve loads the app in the current folder and the server it runs on like deploy does
+func resolve(cmd *cobra.Command) (*utils.SidekickConfig, utils.SidekickAppConfig, utils.Target, error) {
+	config, err := utils.GetSidekickConfigFromCmdContext(cmd)
+	if err != nil {
+		return nil, utils.SidekickAppConfig{}, utils.Target{}, utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Run sidekick init to set up a VPS first", err)
+	}
+	appConfig, err := utils.LoadAppConfig()
+	if err != nil {
+		return config, appConfig, utils.Target{}, utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Run sidekick launch first", err)
+	}
+	target, err := utils.ResolveTarget(cmd, config, appConfig.Server, utils.MetadataEnvProduction)
+	if err != nil {
+		return config, appConfig, target, utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+	}
+	return config, appConfig, target, nil
+}
+
+func login(target utils.Target) (*ssh.Client, error) {
+	sshClient, err := utils.Login(target.Server.Address, "sidekick")
+	if err != nil {
+		return nil, utils.NewStageError("Login", utils.ExitCodeRemote, "Check that the VPS is up and your SSH key is loaded in ssh-agent", err)
+	}
+	return sshClient, nil
+}
+
+// useBackupEndpoint points the aws cli at the S3 compatible store of the global config, an AWS_ENDPOINT_URL set by the user wins
+func useBackupEndpoint(config *utils.SidekickConfig) {
+	if config.Backup.Endpoint != "" && os.Getenv("AWS_ENDPOINT_URL") == "" {
+		os.Setenv("AWS_ENDPOINT_URL", config.Backup.Endpoint)
+	}
+}
+
+func runCreate(cmd *cobra.Command, args []string) error {
+	config, appConfig, target, err := resolve(cmd)
+	if err != nil {
+		return err
+	}
+	useBackupEndpoint(config)
+	dest, _ := cmd.Flags().GetString("dest")
+	if !cmd.Flags().Changed("dest") && config.Backup.Dest != "" {
+		dest = config.Backup.Dest
+	}
+	keep, _ := cmd.Flags().GetInt("keep")
+	if !cmd.Flags().Changed("keep") {
+		keep = config.Backup.Keep
+	}
+	if keep < 0 {
+		return utils.NewStageError("Backup", utils.ExitCodeConfig, "", errors.New("--keep can't be negative"))
+	}
+	database, _ := cmd.Flags().GetBool("database")
+	if database && utils.FindAddon(appConfig, utils.AddonPostgres) < 0 {
+		return utils.NewStageError("Backup", utils.ExitCodeConfig, "Add one with sidekick addons add postgres", errors.New("the app has no postgres addon"))
+	}
+
+	sshClient, err := login(target)
+	if err != nil {
+		return err
+	}
+	defer sshClient.Close()
+	remote := utils.SSHExecutor{Client: sshClient}
+
+	var volume utils.AppVolume
+	source := utils.AddonPostgres
+	if !database {
+		volumes, err := utils.ListAppVolumes(remote, appConfig.Name)
+		if err != nil {
+			return utils.NewStageError("Backup", utils.ExitCodeRemote, "", err)
+		}
+		name, _ := cmd.Flags().GetString("volume")
+		volume, err = utils.FindAppVolume(volumes, name)
+		if err != nil {
+			return utils.NewStageError("Backup", utils.ExitCodeConfig, "Declare named volumes for the app in sidekick.override.yaml", err)
+		}
+		source = volume.Name
+	}
+
+	spinner := utils.StartTask(fmt.Sprintf("Backing up %s", source))
+	progress := func(n int64) {
+		spinner.UpdateText(fmt.Sprintf("Backing up %s, %s so far", source, utils.FormatBytes(n)))
+	}
+	var entry utils.BackupEntry
+	if database {
+		entry, err = utils.BackupDatabase(sshClient, appConfig.Name, dest, time.Now(), progress)
+	} else {
+		entry, err = utils.BackupVolume(sshClient, volume, dest, time.Now(), progress)
+	}
+	if err != nil {
+		spinner.Fail()
+		return utils.NewStageError("Backup", utils.ExitCodeTransfer, "Check there is enough free disk space where the backup goes", err)
+	}
+	spinner.Success(fmt.Sprintf("Backed up %s to %s (%s)", source, entry.Dest, utils.FormatBytes(entry.Size)))
+	if err := utils.AppendBackup(remote, appConfig.Name, entry); err != nil {
+		pterm.Warning.Printfln("The backup is complete but could not be recorded: %s", err)
+		return nil
+	}
+	if keep == 0 {
+		return nil
+	}
+
+	entries, err := utils.LoadBackups(remote, appConfig.Name)
+	if err != nil {
+		pterm.Warning.Printfln("The backup is complete but older ones were not pruned: %s", err)
+		return nil
+	}
+	kept, pruned := utils.PruneBackups(entries, source, dest, keep)
+	if len(pruned) == 0 {
+		return nil
+	}
+	// a backup that fails to go stays in the index so the next run tries again
+	deleted := 0
+	for _, old := range pruned {
+		if err := utils.DeleteBackup(old); err != nil {
+			pterm.Warning.Printfln("Could not delete %s: %s", old.Dest, err)
+			kept = append(kept, old)
+			continue
+		}
+		deleted++
+	}
+	if deleted == 0 {
+		return nil
+	}
+	slices.SortStableFunc(kept, func(a, b utils.BackupEntry) int { return strings.Compare(a.Time, b.Time) })
+	if err := utils.SaveBackups(remote, appConfig.Name, kept); err != nil {
+		pterm.Warning.Printfln("Older backups were deleted but could not be unrecorded: %s", err)
+		return nil
+	}
+	pterm.Info.Printfln("Deleted %d older backup(s) of %s, keeping the last %d", deleted, source, keep)
+	return nil
+}
+
+func addCreateFlags(cmd *cobra.Command) {
+	cmd.Flags().String("volume", "", "Named volume to back up, as declared for the app. Optional when the app has only one")
+	cmd.Flags().Bool("database", false, "Back up the postgres addon with pg_dump instead of a volume")
+	cmd.Flags().String("dest", "backups", "Local folder or s3://bucket/prefix to write the backup to, backup.dest in the sidekick config when not passed")
+	cmd.Flags().Int("keep", 0, "Keep only this many backups of the volume or database in --dest and delete older ones, 0 keeps them all")
+	cmd.MarkFlagsMutuallyExclusive("volume", "database")
+}
+
+const backupLong = `This command copies the content of a named volume of your app, like uploaded files, as a gzipped tar.
+With --database it dumps the postgres addon of the app with pg_dump instead, as a gzipped SQL file.
+The backup is made on your VPS and streamed straight to --dest, a local folder or an s3:// prefix.
+Uploads to S3 go through the aws cli on this machine, set backup.endpoint in the sidekick config or AWS_ENDPOINT_URL for other S3 compatible stores.
+Every backup is recorded on your VPS, sidekick backup list shows them.`
+
+var BackupCmd = &cobra.Command{
+	Use:   "backup",
+	Short: "Back up a named volume or the database of your app to this machine or S3",
+	Long:  backupLong + "\nsidekick backup is the same as sidekick backup create.",
+	RunE:  runCreate,
+}
+
+var createCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Back up a named volume or the database of your app to this machine or S3",
+	Long:  backupLong,
+	Args:  cobra.NoArgs,
+	RunE:  runCreate,
+}
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the backups of your app, newest first",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		_, appConfig, target, err := resolve(cmd)
+		if err != nil {
+			return err
+		}
+		sshClient, err := login(target)
+		if err != nil {
+			return err
+		}
+		defer sshClient.Close()
+
+		entries, err := utils.LoadBackups(utils.SSHExecutor{Client: sshClient}, appConfig.Name)
+		if err != nil {
+			return utils.NewStageError("Backup", utils.ExitCodeRemote, "", err)
+		}
+		slices.Reverse(entries)
+
+		if asJSON, _ := cmd.Flags().GetBool("json"); asJSON {
+			out, err := json.MarshalIndent(entries, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(out))
+			return nil
+		}
+		if len(entries) == 0 {
+			pterm.Info.Printfln("No backups of %s yet", appConfig.Name)
+			return nil
+		}
+		rows := [][]string{{"Time", "Source", "Size", "Destination"}}
+		for _, entry := range entries {
+			rows = append(rows, []string{entry.Time, entry.Source(), utils.FormatBytes(entry.Size), entry.Dest})
+		}
+		return pterm.DefaultTable.WithHasHeader().WithBoxed().WithData(rows).Render()
+	},
+}
+
+func init() {
+	addCreateFlags(BackupCmd)
+	addCreateFlags(createCmd)
+	listCmd.Flags().Bool("json", false, "Print the backups as JSON")
+	BackupCmd.AddCommand(createCmd)
+	BackupCmd.AddCommand(listCmd)
+	BackupCmd.AddCommand(newRestoreCmd())
+}
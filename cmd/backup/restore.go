@@ -0,0 +1,181 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/charmbracelet/huh"
+	"github.com/mightymoud/sidekick/utils"
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+)
+
+// RestoreCmd is sidekick restore, sidekick backup restore is the same command
+var RestoreCmd = newRestoreCmd()
+
+func newRestoreCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "restore <backup>",
+		Short: "Replace the content of a named volume or the database of your app with a backup",
+		Long: `This command restores a backup made with sidekick backup, from a local file or an s3:// url.
+The archive is checked against the checksum recorded when it was made before anything changes on your VPS.
+For a volume the app is stopped, the volume is emptied and filled from the backup, and the app is started again.
+For a database dump the app is stopped while the dump is loaded into the postgres addon in one transaction.`,
+		Args: cobra.ExactArgs(1),
+		RunE: runRestore,
+	}
+	cmd.Flags().String("volume", "", "Named volume to restore, defaults to the one the backup was made of")
+	return cmd
+}
+
+func runRestore(cmd *cobra.Command, args []string) error {
+	ref := args[0]
+	config, appConfig, target, err := resolve(cmd)
+	if err != nil {
+		return err
+	}
+	if utils.IsSwarm(appConfig) {
+		return utils.NewStageError("Restore", utils.ExitCodeConfig, "", errors.New("restoring volumes of a swarm stack is not supported"))
+	}
+	if err := utils.GuardTarget(cmd, config, target, appConfig.Name); err != nil {
+		return err
+	}
+	useBackupEndpoint(config)
+	sshClient, err := login(target)
+	if err != nil {
+		return err
+	}
+	defer sshClient.Close()
+	remote := utils.SSHExecutor{Client: sshClient}
+
+	entries, err := utils.LoadBackups(remote, appConfig.Name)
+	if err != nil {
+		return utils.NewStageError("Restore", utils.ExitCodeRemote, "", err)
+	}
+	entry, recorded := utils.FindBackup(entries, ref)
+	database := entry.Addon == utils.AddonPostgres || (!recorded && utils.IsDatabaseBackup(ref))
+	var volume utils.AppVolume
+	source := utils.AddonPostgres
+	if database {
+		if utils.FindAddon(appConfig, utils.AddonPostgres) < 0 {
+			return utils.NewStageError("Restore", utils.ExitCodeConfig, "Add one with sidekick addons add postgres", fmt.Errorf("%s is a database dump and the app has no postgres addon", ref))
+		}
+	} else {
+		name, _ := cmd.Flags().GetString("volume")
+		if name == "" {
+			name = entry.Volume
+		}
+		volumes, err := utils.ListAppVolumes(remote, appConfig.Name)
+		if err != nil {
+			return utils.NewStageError("Restore", utils.ExitCodeRemote, "", err)
+		}
+		volume, err = utils.FindAppVolume(volumes, name)
+		if err != nil {
+			return utils.NewStageError("Restore", utils.ExitCodeConfig, "Pass the volume to restore with --volume", err)
+		}
+		source = volume.Name
+	}
+
+	file, cleanup, err := utils.FetchBackup(ref)
+	if err != nil {
+		return utils.NewStageError("Restore", utils.ExitCodeTransfer, "", err)
+	}
+	defer cleanup()
+	if !recorded {
+		pterm.Warning.Printfln("%s is not in sidekick backup list, only the archive itself can be checked", ref)
+	}
+	sum, err := utils.VerifyBackupArchive(file, entry.Sha256)
+	if err != nil {
+		return utils.NewStageError("Restore", utils.ExitCodeConfig, "Nothing was changed, restore another backup", err)
+	}
+
+	confirm := utils.AssumeYes(cmd)
+	if !confirm {
+		if err := utils.RequireInteractive("yes", "confirming the restore"); err != nil {
+			return err
+		}
+		title := fmt.Sprintf("This stops %s and replaces everything in its volume %s with %s. Are you sure?", appConfig.Name, volume.Name, ref)
+		if database {
+			title = fmt.Sprintf("This stops %s and replaces its database with %s. Are you sure?", appConfig.Name, ref)
+		}
+		huh.NewConfirm().
+			Title(title).
+			Affirmative("Yes!").
+			Negative("No.").
+			Value(&confirm).
+			Run()
+	}
+	if !confirm {
+		return nil
+	}
+
+	archive, err := os.Open(file)
+	if err != nil {
+		return utils.NewStageError("Restore", utils.ExitCodeConfig, "", err)
+	}
+	defer archive.Close()
+	info, err := archive.Stat()
+	if err != nil {
+		return utils.NewStageError("Restore", utils.ExitCodeConfig, "", err)
+	}
+	remoteFile := utils.RemoteRestoreFile(appConfig.Name)
+	defer utils.RunCommandOutput(sshClient, "rm -f "+remoteFile)
+
+	spinner := utils.StartTask(fmt.Sprintf("Uploading %s", ref))
+	progress := &utils.ProgressWriter{Progress: func(n int64) {
+		spinner.UpdateText(fmt.Sprintf("Uploading %s, %s of %s", ref, utils.FormatBytes(n), utils.FormatBytes(info.Size())))
+	}}
+	if err := utils.StreamCommandInput(sshClient, fmt.Sprintf("mkdir -p %s && cat > %s", utils.RemoteBackupsDir(appConfig.Name), remoteFile), io.TeeReader(archive, progress)); err != nil {
+		spinner.Fail()
+		return utils.NewStageError("Restore", utils.ExitCodeTransfer, "Nothing was changed, check the VPS has enough free disk space", err)
+	}
+	if _, err := utils.RunCommandOutput(sshClient, utils.GetVerifyRemoteArchiveCommand(remoteFile, sum)); err != nil {
+		spinner.Fail()
+		return utils.NewStageError("Restore", utils.ExitCodeTransfer, "Nothing was changed, run restore again", errors.New("the backup was damaged on its way to your VPS"))
+	}
+
+	spinner.UpdateText(fmt.Sprintf("Restoring %s", source))
+	// the database has to keep running to load the dump, only the app stops
+	stop, start, restore := "stop", "start", utils.GetRestoreVolumeCommand(volume.Volume, remoteFile)
+	if database {
+		stop, start, restore = "stop "+appConfig.Name, "start "+appConfig.Name, utils.GetRestoreDatabaseCommand(appConfig.Name, remoteFile)
+	}
+	if _, err := utils.RunCommandOutput(sshClient, utils.GetComposeProjectCommand(appConfig.Name, stop)); err != nil {
+		spinner.Fail()
+		return utils.NewStageError("Restore", utils.ExitCodeRemote, "Nothing was changed", err)
+	}
+	_, restoreErr := utils.RunCommandOutput(sshClient, restore)
+	// the app comes back up whatever happened to the volume
+	if _, err := utils.RunCommandOutput(sshClient, utils.GetComposeProjectCommand(appConfig.Name, start)); err != nil && restoreErr == nil {
+		spinner.Fail()
+		if database {
+			return utils.NewStageError("Restore", utils.ExitCodeRemote, "The database is restored, start the app with sidekick start", err)
+		}
+		return utils.NewStageError("Restore", utils.ExitCodeRemote, "The volume is restored, start the app with sidekick start", err)
+	}
+	if restoreErr != nil {
+		spinner.Fail()
+		if database {
+			return utils.NewStageError("Restore", utils.ExitCodeRemote, "The dump is loaded in one transaction, the database was left as it was", restoreErr)
+		}
+		return utils.NewStageError("Restore", utils.ExitCodeRemote, "The volume may be partly restored, run restore again", restoreErr)
+	}
+	spinner.Success(fmt.Sprintf("Restored %s from %s", source, ref))
+	return nil
+}
@@ -0,0 +1,156 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package badge
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	"github.com/mightymoud/sidekick/render"
+	"github.com/mightymoud/sidekick/utils"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+var BadgeCmd = &cobra.Command{
+	Use:   "badge",
+	Short: "Serve a shields.io status badge for your deployed app",
+	Long: `Sidekick can serve a small shields.io compatible JSON endpoint on your app domain.
+The badge shows the deployed version, commit and how long ago it was deployed, like 3h ago.`,
+}
+
+var enableCmd = &cobra.Command{
+	Use:   "enable",
+	Short: "Start serving the status badge endpoint on your app domain",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, err := utils.GetSidekickConfigFromCmdContext(cmd)
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
+		appConfig, err := utils.LoadAppConfig()
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
+		server, err := config.FindServer(appConfig.Server)
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
+		appConfig.Network = server.NetworkName()
+
+		badgePath, _ := cmd.Flags().GetString("path")
+		if !strings.HasPrefix(badgePath, "/") {
+			badgePath = "/" + badgePath
+		}
+		appConfig.Badge = utils.SidekickAppBadgeConfig{Enabled: true, Path: badgePath}
+
+		sshClient, err := utils.Login(server.Address, "sidekick")
+		if err != nil {
+			return utils.NewStageError("Badge", utils.ExitCodeRemote, "", fmt.Errorf("unable to login to your VPS: %w", err))
+		}
+		// sidekick.yml is saved without the state, it has to be on the server first
+		if appConfig, err = utils.LoadAppState(utils.SSHExecutor{Client: sshClient}, appConfig); err != nil {
+			return utils.NewStageError("App State", utils.ExitCodeRemote, "", err)
+		}
+
+		sha, _ := utils.GetGitShortHash()
+		if err := utils.UpdateRemoteBadge(sshClient, appConfig, sha); err != nil {
+			return utils.NewStageError("Badge", utils.ExitCodeRemote, "", fmt.Errorf("unable to write the badge file: %w", err))
+		}
+
+		composeFile, err := yaml.Marshal(utils.GetBadgeComposeFile(appConfig))
+		if err != nil {
+			return utils.NewStageError("Badge", utils.ExitCodeRemote, "", err)
+		}
+		if err := utils.WriteRemoteFile(sshClient, fmt.Sprintf("%s/badge/docker-compose.yaml", appConfig.Name), composeFile); err != nil {
+			return utils.NewStageError("Badge", utils.ExitCodeRemote, "", fmt.Errorf("unable to write the badge compose file: %w", err))
+		}
+		if _, _, err := utils.RunCommand(sshClient, fmt.Sprintf("cd %s/badge && docker compose -p %s-badge up -d", appConfig.Name, appConfig.Name)); err != nil {
+			return utils.NewStageError("Badge", utils.ExitCodeRemote, "", fmt.Errorf("unable to start the badge service: %w", err))
+		}
+
+		if err := utils.SaveAppConfig(appConfig); err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
+
+		render.GetLogger(log.Options{Prefix: "Badge"}).Infof("Serving badge at %s://%s%s", utils.URLScheme(appConfig), appConfig.Url, badgePath)
+		fmt.Println(utils.GetBadgeMarkdown(appConfig))
+		return nil
+	},
+}
+
+var disableCmd = &cobra.Command{
+	Use:   "disable",
+	Short: "Stop serving the status badge endpoint and remove its route",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, err := utils.GetSidekickConfigFromCmdContext(cmd)
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
+		appConfig, err := utils.LoadAppConfig()
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
+		server, err := config.FindServer(appConfig.Server)
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
+
+		sshClient, err := utils.Login(server.Address, "sidekick")
+		if err != nil {
+			return utils.NewStageError("Badge", utils.ExitCodeRemote, "", fmt.Errorf("unable to login to your VPS: %w", err))
+		}
+		// sidekick.yml is saved without the state, it has to be on the server first
+		if appConfig, err = utils.LoadAppState(utils.SSHExecutor{Client: sshClient}, appConfig); err != nil {
+			return utils.NewStageError("App State", utils.ExitCodeRemote, "", err)
+		}
+		if _, _, err := utils.RunCommand(sshClient, fmt.Sprintf("docker compose -p %s-badge down && rm -rf %s/badge", appConfig.Name, appConfig.Name)); err != nil {
+			return utils.NewStageError("Badge", utils.ExitCodeRemote, "", fmt.Errorf("unable to remove the badge service: %w", err))
+		}
+
+		appConfig.Badge = utils.SidekickAppBadgeConfig{}
+		if err := utils.SaveAppConfig(appConfig); err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
+
+		render.GetLogger(log.Options{Prefix: "Badge"}).Info("Badge endpoint removed")
+		return nil
+	},
+}
+
+var urlCmd = &cobra.Command{
+	Use:   "url",
+	Short: "Print the markdown snippet for your README",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		appConfig, err := utils.LoadAppConfig()
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
+		if !appConfig.Badge.Enabled {
+			return utils.NewStageError("Badge", utils.ExitCodeConfig, "Run sidekick badge enable first", errors.New("badge is not enabled for this app"))
+		}
+		fmt.Println(utils.GetBadgeMarkdown(appConfig))
+		return nil
+	},
+}
+
+func init() {
+	enableCmd.Flags().String("path", utils.DefaultBadgePath, "Path on your app domain to serve the badge JSON at")
+
+	BadgeCmd.AddCommand(enableCmd)
+	BadgeCmd.AddCommand(disableCmd)
+	BadgeCmd.AddCommand(urlCmd)
+}
@@ -0,0 +1,45 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"github.com/mightymoud/sidekick/utils"
+	"github.com/spf13/cobra"
+)
+
+var CacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Manage the local docker build cache used by deploy and preview",
+}
+
+var seedCmd = &cobra.Command{
+	Use:   "seed [image]",
+	Short: "Pull an image so the next build can reuse its layers",
+	Long: `This command pulls an image, usually the one production runs, so a fresh CI runner starts with its layers.
+Pass the same image to deploy or preview with --cache-from-image. A failed pull is only a warning, the build just starts cold.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		spinner := utils.StartTask("Pulling " + args[0])
+		if err := utils.SeedBuildCache(args[0]); err != nil {
+			spinner.Warning(err.Error() + " - the next build starts without cache")
+			return
+		}
+		spinner.Success("Build cache seeded from " + args[0])
+	},
+}
+
+func init() {
+	CacheCmd.AddCommand(seedCmd)
+}
@@ -0,0 +1,80 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ci
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/mightymoud/sidekick/utils"
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+)
+
+var CiCmd = &cobra.Command{
+	Use:   "ci",
+	Short: "Set up deploys from a CI pipeline",
+}
+
+var initCmd = &cobra.Command{
+	Use:   "init [provider]",
+	Short: "Write a CI workflow that deploys on every push",
+	Long: `This command writes a workflow that runs sidekick deploy --ci --yes on every push to your main branch.
+The runner needs no sidekick config file, the server and the keys come from SIDEKICK_* repo secrets.`,
+	Args:      cobra.MatchAll(cobra.ExactArgs(1), cobra.OnlyValidArgs),
+	ValidArgs: []string{"github"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		branch, _ := cmd.Flags().GetString("branch")
+		force, _ := cmd.Flags().GetBool("force")
+		if utils.FileExists(utils.GitHubWorkflowPath) && !force {
+			return utils.NewStageError("CI Workflow", utils.ExitCodeConfig, "Pass --force to overwrite it", fmt.Errorf("%s already exists", utils.GitHubWorkflowPath))
+		}
+		if !utils.FileExists(utils.AppConfigFile) {
+			return utils.NewStageError("CI Workflow", utils.ExitCodeConfig, "Run sidekick launch first and commit sidekick.yml", errors.New("no sidekick.yml in this directory"))
+		}
+
+		if err := os.MkdirAll(filepath.Dir(utils.GitHubWorkflowPath), 0755); err != nil {
+			return utils.NewStageError("CI Workflow", utils.ExitCodeError, "", err)
+		}
+		if err := os.WriteFile(utils.GitHubWorkflowPath, []byte(utils.GetGitHubWorkflow(branch, utils.Version)), 0644); err != nil {
+			return utils.NewStageError("CI Workflow", utils.ExitCodeError, "", err)
+		}
+		pterm.Success.Printfln("Wrote %s", utils.GitHubWorkflowPath)
+
+		address := "<your server address>"
+		if config, err := utils.GetSidekickConfigFromCmdContext(cmd); err == nil {
+			if appConfig, err := utils.LoadAppConfig(); err == nil {
+				if server, err := config.FindServer(appConfig.Server); err == nil {
+					address = server.Address
+				}
+			}
+		}
+		pterm.Println("Add these secrets to your GitHub repo (Settings > Secrets and variables > Actions):")
+		pterm.Println(fmt.Sprintf("  SIDEKICK_SERVER_ADDRESS  %s", address))
+		pterm.Println("  SIDEKICK_PUBLIC_KEY      publickey of the server in your sidekick config")
+		pterm.Println("  SIDEKICK_SECRET_KEY      secretkey of the server in your sidekick config")
+		pterm.Println("  SIDEKICK_SSH_KEY         a private key allowed to log in as sidekick on the server, PEM or base64")
+		pterm.Println(fmt.Sprintf("  SIDEKICK_KNOWN_HOSTS     the output of ssh-keyscan -H %s", address))
+		return nil
+	},
+}
+
+func init() {
+	initCmd.Flags().String("branch", "main", "Branch whose pushes get deployed")
+	initCmd.Flags().Bool("force", false, "Overwrite an existing workflow")
+	CiCmd.AddCommand(initCmd)
+}
@@ -0,0 +1,57 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package completion
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var CompletionCmd = &cobra.Command{
+	Use:   "completion [bash|zsh|fish|powershell]",
+	Short: "Print the shell completion script for sidekick",
+	Long: `This command prints a script that adds tab completion for sidekick commands, flags, contexts, servers, apps and preview hashes to your shell.
+
+Bash:
+  source <(sidekick completion bash)
+  # or for every session on Linux
+  sidekick completion bash > /etc/bash_completion.d/sidekick
+
+Zsh:
+  sidekick completion zsh > "${fpath[1]}/_sidekick"
+
+Fish:
+  sidekick completion fish > ~/.config/fish/completions/sidekick.fish
+
+PowerShell:
+  sidekick completion powershell | Out-String | Invoke-Expression`,
+	ValidArgs:             []string{"bash", "zsh", "fish", "powershell"},
+	Args:                  cobra.MatchAll(cobra.ExactArgs(1), cobra.OnlyValidArgs),
+	DisableFlagsInUseLine: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		root := cmd.Root()
+		switch args[0] {
+		case "bash":
+			return root.GenBashCompletionV2(os.Stdout, true)
+		case "zsh":
+			return root.GenZshCompletion(os.Stdout)
+		case "fish":
+			return root.GenFishCompletion(os.Stdout, true)
+		default:
+			return root.GenPowerShellCompletionWithDesc(os.Stdout)
+		}
+	},
+}
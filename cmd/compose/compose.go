@@ -0,0 +1,67 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package compose
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mightymoud/sidekick/utils"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+var ComposeCmd = &cobra.Command{
+	Use:   "compose",
+	Short: "Inspect the docker compose file sidekick generates for your app",
+}
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Print the compose file the next deploy would run on your VPS",
+	Long: `This command prints the compose file sidekick generates for the app in the current folder, labels and environment included.
+Entries like KEY=${KEY} are filled in from your encrypted env file when the container starts.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		appConfig, err := utils.LoadAppConfig()
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
+		// the network is the one of the server the app is pinned to, the default one without a sidekick config
+		if config, err := utils.GetSidekickConfigFromCmdContext(cmd); err == nil {
+			if server, err := config.FindServer(appConfig.Server); err == nil {
+				appConfig.Network = server.NetworkName()
+			}
+		}
+
+		dockerEnvProperty := []string{}
+		if appConfig.Env.File != "" {
+			dockerEnvProperty, err = utils.GetDockerEnvProperty(appConfig.Env.File)
+			if err != nil {
+				return utils.NewStageError("Env File", utils.ExitCodeConfig, "", fmt.Errorf("failed to read environment file: %w", err))
+			}
+		}
+		metadata := utils.GetDeployMetadata(appConfig.Name, utils.MetadataEnvProduction, "")
+		composeFile, err := yaml.Marshal(utils.GetAppComposeFile(appConfig, appConfig.Name, appConfig.Name, appConfig.Url, utils.WithMetadataEnv(dockerEnvProperty, metadata)))
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(composeFile)
+		return err
+	},
+}
+
+func init() {
+	ComposeCmd.AddCommand(exportCmd)
+}
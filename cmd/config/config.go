@@ -16,6 +16,7 @@ limitations under the License.
 package config
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 
@@ -34,12 +35,13 @@ var ConfigCmd = &cobra.Command{
 var currentContextCmd = &cobra.Command{
 	Use:   "current",
 	Short: "Get the current context from sidekick config",
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		config, err := utils.GetSidekickConfigFromCmdContext(cmd)
 		if err != nil {
-			pterm.Fatal.Println(err)
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
 		}
 		fmt.Println(config.CurrentContext)
+		return nil
 	},
 }
 
@@ -47,30 +49,32 @@ var useContextCmd = &cobra.Command{
 	Use:   "use [context-name]",
 	Short: "Switch the current context in sidekick config",
 	Args:  cobra.ExactArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
+	// completion reads the sidekick config only so it stays instant
+	ValidArgsFunction: utils.CompleteContexts,
+	RunE: func(cmd *cobra.Command, args []string) error {
 		config, err := utils.GetSidekickConfigFromCmdContext(cmd)
 		if err != nil {
-			pterm.Fatal.Println(err)
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
 		}
 
 		contextName := args[0]
 		config.CurrentContext = contextName
-		config.Save(viper.GetString("config"))
+		return config.Save(viper.GetString("config"))
 	},
 }
 
 var migrateCmd = &cobra.Command{
 	Use:   "migrate",
 	Short: "Migrate the old sidekick config to the new config",
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		var serverConfig utils.SidekickServer
 		content, err := os.ReadFile(viper.GetString("config"))
 		if err != nil {
-			pterm.Fatal.Println(err)
+			return utils.NewStageError("Migrate", utils.ExitCodeConfig, "", err)
 		}
 		err = yaml.Unmarshal(content, &serverConfig)
 		if err != nil {
-			pterm.Fatal.Println(err)
+			return utils.NewStageError("Migrate", utils.ExitCodeConfig, "", fmt.Errorf("error unmarshaling the config yaml file: %w", err))
 		}
 
 		serverConfig.Name = "default"
@@ -84,10 +88,106 @@ var migrateCmd = &cobra.Command{
 			Contexts:       []utils.SidekickContext{defaultContext},
 			CurrentContext: defaultContext.Name,
 		}
-		err = newConfig.Print()
+		return newConfig.Print()
+	},
+}
+
+var getCmd = &cobra.Command{
+	Use:               "get [key]",
+	Short:             "Print a value of the sidekick config, like servers.prod.serveraddress",
+	Args:              cobra.ExactArgs(1),
+	ValidArgsFunction: utils.CompleteConfigKeys,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, err := utils.GetSidekickConfigFromCmdContext(cmd)
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
+		value, err := utils.GetConfigValue(config, args[0])
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
+		fmt.Println(value)
+		return nil
+	},
+}
+
+var setCmd = &cobra.Command{
+	Use:   "set [key] [value]",
+	Short: "Change a value of the sidekick config, it is checked before the file is written",
+	Example: `  sidekick config set current-context staging
+  sidekick config set servers.prod.address 203.0.113.10
+  sidekick config set deployPolicy.confirmContexts prod,eu-prod`,
+	Args:              cobra.ExactArgs(2),
+	ValidArgsFunction: utils.CompleteConfigKeys,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, err := utils.GetSidekickConfigFromCmdContext(cmd)
 		if err != nil {
-			pterm.Fatal.Println(err)
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
+		if err := utils.SetConfigValue(config, args[0], args[1]); err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
+		if err := config.Save(viper.GetString("config")); err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
 		}
+		pterm.Success.Printfln("Set %s", args[0])
+		return nil
+	},
+}
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Print every value set in the sidekick config, secrets are masked",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, err := utils.GetSidekickConfigFromCmdContext(cmd)
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
+		reveal, _ := cmd.Flags().GetBool("reveal")
+		for _, entry := range utils.ListConfigValues(config, reveal) {
+			fmt.Printf("%s=%s\n", entry.Key, entry.Value)
+		}
+		return nil
+	},
+}
+
+var validateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Check sidekick.yml in the current folder and print every problem found",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		content, err := os.ReadFile(utils.AppConfigFile)
+		if err != nil {
+			return utils.NewStageError("Validate", utils.ExitCodeConfig, "Run sidekick launch first", err)
+		}
+		content, _, err = utils.MigrateAppConfig(content)
+		if err != nil {
+			return utils.NewStageError("Validate", utils.ExitCodeConfig, "", err)
+		}
+		problems, err := utils.ValidateAppConfigFile(content, true)
+		if err != nil {
+			return utils.NewStageError("Validate", utils.ExitCodeConfig, "", err)
+		}
+
+		asJSON, _ := cmd.Flags().GetBool("json")
+		if asJSON {
+			out, err := json.MarshalIndent(map[string]any{"valid": len(problems) == 0, "problems": problems}, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(out))
+		} else if len(problems) == 0 {
+			pterm.Success.Printfln("%s is valid", utils.AppConfigFile)
+		} else {
+			for _, problem := range problems {
+				pterm.Error.Println(problem)
+			}
+		}
+		if len(problems) > 0 {
+			return utils.NewStageError("Validate", utils.ExitCodeConfig, "", fmt.Errorf("%s has %d problem(s)", utils.AppConfigFile, len(problems)))
+		}
+		return nil
 	},
 }
 
@@ -95,4 +195,12 @@ func init() {
 	ConfigCmd.AddCommand(currentContextCmd)
 	ConfigCmd.AddCommand(useContextCmd)
 	ConfigCmd.AddCommand(migrateCmd)
+	ConfigCmd.AddCommand(validateCmd)
+	ConfigCmd.AddCommand(getCmd)
+	ConfigCmd.AddCommand(setCmd)
+	ConfigCmd.AddCommand(listCmd)
+
+	listCmd.Flags().Bool("reveal", false, "Print secret keys and passwords as they are")
+
+	validateCmd.Flags().Bool("json", false, "Print the problems as JSON, for pre-commit hooks")
 }
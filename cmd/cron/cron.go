@@ -0,0 +1,130 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cron
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mightymoud/sidekick/utils"
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+)
+
+var CronCmd = &cobra.Command{
+	Use:   "cron",
+	Short: "List and run the cron jobs of your app",
+	Long: `Cron jobs are declared under cron in sidekick.yml with a name, a schedule and a command.
+Every deploy installs them in the crontab of your VPS, where they run in a one-off container of your app with its env.`,
+}
+
+// login resolves the server of the app in the current folder like deploy does and logs in to it
+func login(cmd *cobra.Command, guard bool) (utils.SidekickAppConfig, *ssh.Client, error) {
+	config, err := utils.GetSidekickConfigFromCmdContext(cmd)
+	if err != nil {
+		return utils.SidekickAppConfig{}, nil, utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Run sidekick init to set up a VPS first", err)
+	}
+	appConfig, err := utils.LoadAppConfig()
+	if err != nil {
+		return appConfig, nil, utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Run sidekick launch first", err)
+	}
+	target, err := utils.ResolveTarget(cmd, config, appConfig.Server, utils.MetadataEnvProduction)
+	if err != nil {
+		return appConfig, nil, utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+	}
+	if guard {
+		if err := utils.GuardTarget(cmd, config, target, appConfig.Name); err != nil {
+			return appConfig, nil, err
+		}
+	}
+	sshClient, err := utils.Login(target.Server.Address, "sidekick")
+	if err != nil {
+		return appConfig, nil, utils.NewStageError("Login", utils.ExitCodeRemote, "Check that the VPS is up and your SSH key is loaded in ssh-agent", err)
+	}
+	return appConfig, sshClient, nil
+}
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the cron jobs of your app and when they last ran",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		appConfig, sshClient, err := login(cmd, false)
+		if err != nil {
+			return err
+		}
+		defer sshClient.Close()
+
+		status, err := utils.LoadCronStatus(utils.SSHExecutor{Client: sshClient}, appConfig.Name)
+		if err != nil {
+			return utils.NewStageError("Cron", utils.ExitCodeRemote, "", err)
+		}
+		if len(appConfig.Cron) == 0 && len(status) == 0 {
+			pterm.Info.Printfln("%s has no cron jobs, add them under cron in sidekick.yml", appConfig.Name)
+			return nil
+		}
+		rows := [][]string{{"Name", "Schedule", "Command", "Last run"}}
+		for _, job := range appConfig.Cron {
+			lastRun, installed := status[job.Name]
+			switch {
+			case !installed:
+				rows = append(rows, []string{job.Name, job.Schedule, job.Command, pterm.Yellow("installed at the next deploy")})
+			case lastRun.IsZero():
+				rows = append(rows, []string{job.Name, job.Schedule, job.Command, "never"})
+			default:
+				rows = append(rows, []string{job.Name, job.Schedule, job.Command, lastRun.Format(time.DateTime)})
+			}
+			delete(status, job.Name)
+		}
+		for name := range status {
+			rows = append(rows, []string{name, "", "", pterm.Yellow("removed at the next deploy")})
+		}
+		return pterm.DefaultTable.WithHasHeader().WithBoxed().WithData(rows).Render()
+	},
+}
+
+var runCmd = &cobra.Command{
+	Use:   "run <name>",
+	Short: "Run a cron job of your app now",
+	Long:  `This command runs the deployed cron job right away on your VPS and prints its output. The schedule is left as it is.`,
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		appConfig, sshClient, err := login(cmd, true)
+		if err != nil {
+			return err
+		}
+		defer sshClient.Close()
+
+		job, err := utils.FindCronJob(appConfig, args[0])
+		if err != nil {
+			return utils.NewStageError("Cron", utils.ExitCodeConfig, "Run sidekick cron list to see them", err)
+		}
+		if _, err := utils.RunCommandOutput(sshClient, utils.GetCronJobInstalledCommand(appConfig.Name, job.Name)); err != nil {
+			return utils.NewStageError("Cron", utils.ExitCodeConfig, "Run sidekick deploy to install it", fmt.Errorf("cron job %s is not on your VPS yet", job.Name))
+		}
+		pterm.Info.Printfln("Running %s: %s", job.Name, job.Command)
+		if err := utils.StreamCommandOutput(sshClient, utils.GetRunCronJobCommand(appConfig.Name, job.Name), os.Stdout); err != nil {
+			return utils.NewStageError("Cron", utils.ExitCodeRemote, "", err)
+		}
+		pterm.Success.Printfln("%s finished", job.Name)
+		return nil
+	},
+}
+
+func init() {
+	CronCmd.AddCommand(listCmd)
+	CronCmd.AddCommand(runCmd)
+}
@@ -15,13 +15,13 @@ limitations under the License.
 package deploy
 
 import (
-	"crypto/md5"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"os/exec"
+	"path"
 	"slices"
-	"strconv"
 	"strings"
 	"time"
 
@@ -30,21 +30,19 @@ import (
 	teaLog "github.com/charmbracelet/log"
 	"github.com/mightymoud/sidekick/render"
 	"github.com/mightymoud/sidekick/utils"
-	"github.com/pterm/pterm"
 	"github.com/spf13/cobra"
 	"golang.org/x/crypto/ssh"
 	"gopkg.in/yaml.v3"
 )
 
-func prelude(config *utils.SidekickConfig) (utils.SidekickAppConfig, utils.SidekickServer) {
-	if !utils.FileExists("./sidekick.yml") {
-		pterm.Error.Println(`Sidekick config not found in current directory Run sidekick launch`)
-		os.Exit(1)
+func prelude(config *utils.SidekickConfig) (utils.SidekickAppConfig, utils.SidekickServer, error) {
+	if !utils.FileExists(utils.AppConfigFile) {
+		return utils.SidekickAppConfig{}, utils.SidekickServer{}, utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Run sidekick launch first", fmt.Errorf("%s not found", utils.AppConfigFile))
 	}
 
 	appConfig, loadError := utils.LoadAppConfig()
 	if loadError != nil {
-		panic(loadError)
+		return appConfig, utils.SidekickServer{}, utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", loadError)
 	}
 
 	// Older version of app config does not have server name
@@ -53,7 +51,7 @@ func prelude(config *utils.SidekickConfig) (utils.SidekickAppConfig, utils.Sidek
 		render.GetLogger(teaLog.Options{Prefix: "Backward Compat"}).Info("An older version of sidekick.yml is found. Attempting to match a server from url...")
 		ips, err := net.LookupIP(appConfig.Url)
 		if err != nil {
-			render.GetLogger(teaLog.Options{Prefix: "Backward Compat"}).Fatal(err)
+			return appConfig, utils.SidekickServer{}, utils.NewStageError("Backward Compat", utils.ExitCodeConfig, "Add the name of the server to sidekick.yml as server", err)
 		}
 		for _, server := range config.Servers {
 			if slices.ContainsFunc(ips, func(ip net.IP) bool {
@@ -67,27 +65,301 @@ func prelude(config *utils.SidekickConfig) (utils.SidekickAppConfig, utils.Sidek
 	}
 
 	if appConfig.Server == "" {
-		render.GetLogger(teaLog.Options{Prefix: "Backward Compat"}).Fatal("Unable to find a server that this app was deployed.")
+		return appConfig, utils.SidekickServer{}, utils.NewStageError("Backward Compat", utils.ExitCodeConfig, "Add the name of the server to sidekick.yml as server", fmt.Errorf("unable to find a server that this app was deployed to"))
 	}
 
 	server, err := config.FindServer(appConfig.Server)
 	if err != nil {
-		render.GetLogger(teaLog.Options{Prefix: "Sidekick Config"}).Fatal(err)
+		return appConfig, server, utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
 	}
 
 	if server.SecretKey == "" {
-		render.GetLogger(teaLog.Options{Prefix: "Backward Compat"}).Error("Recent changes to how Sidekick handles secrets prevents you from launcing a new application.")
-		render.GetLogger(teaLog.Options{Prefix: "Backward Compat"}).Info("To fix this, run `Sidekick init` with the same server address you have now.")
-		render.GetLogger(teaLog.Options{Prefix: "Backward Compat"}).Info("Learn more at www.sidekickdeploy.com/docs/design/encryption")
-		os.Exit(1)
+		return appConfig, server, utils.NewStageError("Backward Compat", utils.ExitCodeConfig,
+			"Run sidekick init with the same server address you have now, learn more at www.sidekickdeploy.com/docs/design/encryption",
+			fmt.Errorf("recent changes to how Sidekick handles secrets prevent you from deploying to %s", server.Name))
 	}
 
-	return appConfig, server
+	return appConfig, server, nil
 }
 
-func stage1Login(server *utils.SidekickServer) (*ssh.Client, error) {
+const (
+	imageSourceBuild    = ""
+	imageSourceLocal    = "local"
+	imageSourceServer   = "server"
+	imageSourceRegistry = "registry"
+	// imageSourceRemoteBuild builds on the VPS so no image leaves this machine
+	imageSourceRemoteBuild = "remote-build"
+	// imageSourceStatic builds the nginx image of a static site on the VPS
+	imageSourceStatic = "static"
+)
+
+// deployOptions are the flags that change where the deployed image comes from
+type deployOptions struct {
+	// ref is nil when deploying the checked out tree
+	ref *utils.GitRef
+	// cache is where the build reuses layers from, buildDuration is how long it took once it ran
+	cache         utils.BuildCache
+	buildDuration time.Duration
+	// image is a prebuilt image deployed as is, imageSource says where it was found
+	image       string
+	imageSource string
+	// buildTag is what a local or remote build tags, the app repository at latest
+	buildTag string
+	// push sends the local build through the registry instead of as a tar
+	push bool
+	// registryPassword is set when sidekick.yml has a registry to log in to
+	registryPassword string
+	// scanSeverity is set when the image is scanned with trivy before it ships
+	scanSeverity string
+	// sbomFormat is set when an sbom is generated, sbom is filled in once it is written
+	sbomFormat string
+	sbomUpload bool
+	sbom       utils.SidekickSbom
+	// skipPreflight leaves out the free disk space checks before the image is built and shipped
+	skipPreflight bool
+	// skipDNSCheck deploys without checking the domain points at the server
+	skipDNSCheck bool
+	// verifyTimeout is how long the app gets to answer on its URL once deployed, 0 skips the check
+	verifyTimeout time.Duration
+	// version and hash name the build besides its V tag, version is empty without a VERSION file or git tag
+	version string
+	hash    string
+	// noGit builds the folder as it is, named after its content, without asking git anything
+	noGit bool
+	// buildHash is the content hash of the build context, the build is skipped when the live image was built from
+	// the same content unless forceBuild is set. skipBuild is set once that is decided.
+	buildHash  string
+	forceBuild bool
+	skipBuild  bool
+}
+
+// releaseTags are the version and commit tags of a build, a prebuilt image keeps the tags it came with
+func (o deployOptions) releaseTags(appConfig utils.SidekickAppConfig) []string {
+	if o.image != "" && !o.push {
+		return nil
+	}
+	return utils.ReleaseImageTags(appConfig, o.version, o.hash)
+}
+
+func (o deployOptions) imageName(appConfig utils.SidekickAppConfig) string {
+	if o.image != "" {
+		return o.image
+	}
+	return o.buildTag
+}
+
+// shipsTar is true when the image goes to the VPS as a docker save tar
+func (o deployOptions) shipsTar() bool {
+	return (o.imageSource == imageSourceBuild || o.imageSource == imageSourceLocal) && !o.push && !o.skipBuild
+}
+
+// builds is true when sidekick builds the image from the build context, here or on the VPS
+func (o deployOptions) builds() bool {
+	return o.imageSource == imageSourceBuild || o.imageSource == imageSourceRemoteBuild || o.imageSource == imageSourceStatic
+}
+
+// localImage is the image on this machine that --scan and --sbom look at, the build tag for a fresh build
+func (o deployOptions) localImage() string {
+	if o.imageSource == imageSourceLocal {
+		return o.image
+	}
+	return o.buildTag
+}
+
+func localImageExists(image string) bool {
+	return exec.Command("docker", "image", "inspect", image).Run() == nil
+}
+
+func getComposeFile(appConfig utils.SidekickAppConfig, opts deployOptions) (utils.DockerComposeFile, error) {
+	dockerEnvProperty := []string{}
+	if appConfig.Env.File != "" {
+		envProperty, err := utils.GetDockerEnvProperty(appConfig.Env.File)
+		if err != nil {
+			return utils.DockerComposeFile{}, fmt.Errorf("failed to read environment file: %w", err)
+		}
+		dockerEnvProperty = envProperty
+	}
+	metadata := utils.NewDeployMetadata(appConfig.Name, utils.MetadataEnvProduction, "")
+	switch {
+	case opts.ref != nil:
+		metadata.GitSha, metadata.GitBranch = opts.ref.ShortSha, opts.ref.Branch
+	case !opts.noGit:
+		metadata = utils.GetDeployMetadata(appConfig.Name, utils.MetadataEnvProduction, "")
+	}
+	return utils.GetAppComposeFile(appConfig, appConfig.Name, opts.imageName(appConfig), appConfig.Url, utils.WithMetadataEnv(dockerEnvProperty, metadata)), nil
+}
+
+// getDeployPlan lists what a deploy would do, in the order the stages below do it
+func getDeployPlan(appConfig utils.SidekickAppConfig, target utils.Target, opts deployOptions) (utils.DryRunPlan, error) {
+	server := target.Server
+	remoteDir := fmt.Sprintf("%s@%s:./%s", "sidekick", server.Address, appConfig.Name)
+	imgFileName := fmt.Sprintf("%s-latest.tar", appConfig.Name)
+	image := opts.imageName(appConfig)
+	plan := utils.DryRunPlan{Target: target, Image: image, EnvFile: appConfig.Env.File}
+
+	envFileChanged, err := utils.EnvFileChanged(appConfig)
+	if err != nil {
+		return plan, err
+	}
+	plan.EnvChanged = envFileChanged
+	if utils.HasCustomCert(appConfig) && (!utils.FileExists(appConfig.TLS.Cert) || !utils.FileExists(appConfig.TLS.Key)) {
+		return plan, fmt.Errorf("custom certificate %s or its key %s is missing", appConfig.TLS.Cert, appConfig.TLS.Key)
+	}
+	plan.ComposeFile, err = getComposeFile(appConfig, opts)
+	if err != nil {
+		return plan, err
+	}
+
+	// scan and sbom run against the local image once it is built
+	imageChecks := []string{}
+	if opts.scanSeverity != "" {
+		imageChecks = append(imageChecks, utils.GetTrivyCommand(opts.localImage()).String()+" - fail on "+opts.scanSeverity+" or above")
+	}
+	if opts.sbomFormat != "" {
+		imageChecks = append(imageChecks, fmt.Sprintf("%s > %s", utils.GetSyftCommand(opts.localImage(), opts.sbomFormat).String(), utils.SbomFileName(utils.NextDeployVersion(appConfig.Version), opts.sbomFormat)))
+	}
+	if !opts.skipDNSCheck && !utils.IsSslipDomain(appConfig.Url) {
+		plan.Local(utils.DNSCheckStep(appConfig.Url, server.Address))
+	}
+	plan.Remote(utils.RemoteLayoutStep(appConfig.Name))
+	plan.Remote("take the deploy lock " + utils.DeployLockFile(appConfig.Name))
+	plan.Remote(utils.RouteConflictsStep(appConfig.Name, appConfig.Url))
+	plan.Remote(utils.NetworksStep(appConfig))
+	if envFileChanged {
+		plan.Local(fmt.Sprintf("sops encrypt --output-type dotenv --age %s ./%s > encrypted.env", server.PublicKey, appConfig.Env.File))
+		plan.Local(fmt.Sprintf("rsync -v encrypted.env %s", remoteDir))
+	}
+	switch opts.imageSource {
+	case imageSourceBuild:
+		buildContext := "."
+		if opts.ref != nil {
+			buildContext = "<tmp>"
+			plan.Local(fmt.Sprintf("git archive %s | tar -x -C %s", opts.ref.Sha, buildContext))
+		}
+		plan.Local("docker " + strings.Join(utils.GetDockerBuildArgs(opts.buildTag, server.PlatformId, opts.cache, buildContext), " "))
+		for _, step := range imageChecks {
+			plan.Local(step)
+		}
+		if opts.push {
+			plan.Local(fmt.Sprintf("docker login %s --username %s --password-stdin", appConfig.Registry.Url, appConfig.Registry.Username))
+			plan.Local(fmt.Sprintf("docker tag %s %s", opts.buildTag, image))
+			plan.Local(fmt.Sprintf("docker push %s", image))
+			if cacheImage, err := utils.AppImage(appConfig, utils.BuildCacheTag); err == nil {
+				plan.Local(fmt.Sprintf("docker tag %s %s", opts.buildTag, cacheImage))
+				plan.Local(fmt.Sprintf("docker push %s", cacheImage))
+			}
+			if opts.version != "" {
+				versionImage := utils.DeployImageTag(utils.AppRepository(appConfig), opts.version)
+				plan.Local(fmt.Sprintf("docker tag %s %s", opts.buildTag, versionImage))
+				plan.Local(fmt.Sprintf("docker push %s", versionImage))
+			}
+			if opts.registryPassword != "" {
+				plan.Remote(fmt.Sprintf("docker login %s --username %s --password-stdin", appConfig.Registry.Url, appConfig.Registry.Username))
+			}
+			plan.Remote(fmt.Sprintf("docker pull %s", image))
+		}
+	case imageSourceRemoteBuild:
+		buildContext := "."
+		if opts.ref != nil {
+			buildContext = "<tmp>"
+			plan.Local(fmt.Sprintf("git archive %s | tar -x -C %s", opts.ref.Sha, buildContext))
+		}
+		plan.Remote("mktemp -d /tmp/sidekick-build-XXXXXX")
+		rsyncArgs, err := utils.GetSyncBuildContextArgs(server, buildContext, "<remote tmp>")
+		if err != nil {
+			return plan, err
+		}
+		plan.Local("rsync " + strings.Join(rsyncArgs, " "))
+		plan.Remote(utils.GetRemoteBuildCommand(image, server, opts.cache, "<remote tmp>"))
+		plan.Remote("rm -rf <remote tmp>")
+	case imageSourceStatic:
+		buildContext := "."
+		if opts.ref != nil {
+			buildContext = "<tmp>"
+			plan.Local(fmt.Sprintf("git archive %s | tar -x -C %s", opts.ref.Sha, buildContext))
+		}
+		plan.Remote("mktemp -d /tmp/sidekick-build-XXXXXX")
+		rsyncArgs, err := utils.GetSyncBuildContextArgs(server, utils.StaticBuildContext(appConfig, buildContext), "<remote tmp>")
+		if err != nil {
+			return plan, err
+		}
+		plan.Local("rsync " + strings.Join(rsyncArgs, " "))
+		plan.Remote(utils.GetStaticRemoteBuildCommand(image, server, "<remote tmp>"))
+		plan.Remote("rm -rf <remote tmp>")
+	case imageSourceLocal:
+		for _, step := range imageChecks {
+			plan.Local(step)
+		}
+	case imageSourceServer:
+		plan.Remote(fmt.Sprintf("docker image inspect %s", image))
+	case imageSourceRegistry:
+		if opts.registryPassword != "" {
+			plan.Remote(fmt.Sprintf("docker login %s --username %s --password-stdin", appConfig.Registry.Url, appConfig.Registry.Username))
+		}
+		plan.Remote(fmt.Sprintf("docker pull %s", image))
+	}
+	if opts.shipsTar() {
+		plan.Local(fmt.Sprintf("docker save -o %s %s", imgFileName, image))
+		plan.Local(fmt.Sprintf("send %s to %s in gzipped chunks of %s over ssh", imgFileName, remoteDir, utils.FormatBytes(utils.ImageChunkSize)))
+		plan.Remote(fmt.Sprintf("cd %s && docker load -i %s", appConfig.Name, imgFileName))
+	}
+	if utils.HasCustomCert(appConfig) {
+		plan.Local(fmt.Sprintf("rsync --chmod=F600 %s %s %s@%s:%s/", appConfig.TLS.Cert, appConfig.TLS.Key, "sidekick", server.Address, utils.RemoteCertsDir))
+		plan.Remote(fmt.Sprintf("write %s/%s.yml", utils.RemoteDynamicDir, appConfig.Name))
+	}
+	plan.Remote(fmt.Sprintf("write %s/docker-compose.yaml", appConfig.Name))
+	if opts.sbomUpload {
+		plan.Remote("write " + utils.RemoteSbomFile(appConfig.Name, opts.sbomFormat))
+	}
+	if utils.IsSwarm(appConfig) {
+		plan.Remote(utils.GetStackDeployCommand(appConfig.Name, appConfig.Env.File != "", server.SecretKey))
+		plan.Remote(fmt.Sprintf("docker stack ps %s - wait for every service to be healthy", utils.ComposeProject(appConfig.Name, "")))
+	} else {
+		if len(appConfig.Addons) > 0 {
+			plan.Remote(utils.GetStartAddonsCommand(appConfig, server.SecretKey))
+		}
+		plan.Remote(utils.GetDeployAppScript(appConfig))
+		plan.Remote(fmt.Sprintf("cd %s && docker compose -p %s ps - wait for every service to be healthy", appConfig.Name, utils.ComposeProject(appConfig.Name, "")))
+	}
+	plan.Remote(utils.GetTagImageCommand(image, append([]string{utils.DeployImageTag(utils.AppRepository(appConfig), utils.NextDeployVersion(appConfig.Version))}, opts.releaseTags(appConfig)...)))
+	plan.Remote(utils.CronJobsStep(appConfig))
+	if opts.shipsTar() {
+		plan.Remote(fmt.Sprintf("cd %s && rm %s", appConfig.Name, imgFileName))
+	}
+	plan.Remote(fmt.Sprintf("write %s and %s", utils.RemoteStateFile(appConfig.Name), utils.RemoteAppInfoFile(appConfig.Name)))
+	if appConfig.Badge.Enabled {
+		plan.Remote(fmt.Sprintf("write the status badge of %s", appConfig.Name))
+	}
+	if opts.verifyTimeout > 0 {
+		plan.Local(utils.VerifyStep(utils.VerifyURL(appConfig, appConfig.Url), opts.verifyTimeout))
+	}
+	plan.Remote("release the deploy lock " + utils.DeployLockFile(appConfig.Name))
+	return plan, nil
+}
+
+func stage1Login(server *utils.SidekickServer, appConfig *utils.SidekickAppConfig, p *tea.Program, lock *utils.DeployLock) (*ssh.Client, error) {
 	sshClient, err := utils.Login(server.Address, "sidekick")
-	return sshClient, err
+	if err != nil {
+		return nil, err
+	}
+	// the app folders are checked on every deploy and whatever drifted since launch gets repaired
+	repairs, err := utils.BootstrapRemoteLayout(utils.SSHExecutor{Client: sshClient}, appConfig.Name)
+	if err != nil {
+		return nil, err
+	}
+	for _, repair := range repairs {
+		p.Send(render.LogMsg{LogLine: repair + "\n"})
+	}
+	// taken before the state is read so a deploy that got in first is not overwritten halfway
+	if err := lock.Acquire(utils.SSHExecutor{Client: sshClient}, utils.GetLockTimeout(*appConfig)); err != nil {
+		sshClient.Close()
+		return nil, err
+	}
+	// the deployed version and env hash are whatever the server says, not the local sidekick.yml
+	if *appConfig, err = utils.LoadAppState(utils.SSHExecutor{Client: sshClient}, *appConfig); err != nil {
+		return nil, err
+	}
+	return sshClient, nil
 }
 
 func stage2EnvFile(appConfig utils.SidekickAppConfig, p *tea.Program, server *utils.SidekickServer) (bool, string, error) {
@@ -95,22 +367,24 @@ func stage2EnvFile(appConfig utils.SidekickAppConfig, p *tea.Program, server *ut
 	envFileChanged := false
 	currentEnvFileHash := ""
 	if appConfig.Env.File != "" {
-		envFileContent, envFileErr := os.ReadFile(fmt.Sprintf("./%s", appConfig.Env.File))
+		envFileHash, envFileErr := utils.EnvFileHash(appConfig.Env.File)
 		if envFileErr != nil {
 			return false, "", fmt.Errorf("failed to read environment file: %w", envFileErr)
 		}
-		currentEnvFileHash = fmt.Sprintf("%x", md5.Sum(envFileContent))
+		currentEnvFileHash = envFileHash
 		envFileChanged = appConfig.Env.Hash != currentEnvFileHash
 		if envFileChanged {
 			// encrypt new env file
-			envCmd := exec.Command("sh", "-s", "-", server.PublicKey, fmt.Sprintf("./%s", appConfig.Env.File))
+			envCmd := utils.OperationCommand("sh", "-s", "-", server.PublicKey, fmt.Sprintf("./%s", appConfig.Env.File))
 			envCmd.Stdin = strings.NewReader(utils.EnvEncryptionScript)
+			utils.TraceScript(utils.EnvEncryptionScript, envCmd.Args[3:]...)
 			envCmdErrPipe, _ := envCmd.StderrPipe()
 			go render.SendLogsToTUI(envCmdErrPipe, p)
 			if envCmdErr := envCmd.Run(); envCmdErr != nil {
 				return false, "", fmt.Errorf("failed to encrypt environment file: %w", envCmdErr)
 			}
-			encryptSyncCmd := exec.Command("rsync", "-v", "encrypted.env", fmt.Sprintf("%s@%s:%s", "sidekick", server.Address, fmt.Sprintf("./%s", appConfig.Name)))
+			encryptSyncCmd := utils.OperationCommand("rsync", "-v", "encrypted.env", fmt.Sprintf("%s@%s:%s", "sidekick", server.Address, fmt.Sprintf("./%s", appConfig.Name)))
+			utils.TraceExec(encryptSyncCmd)
 			encryptSyncCmdErrPipe, _ := encryptSyncCmd.StderrPipe()
 			go render.SendLogsToTUI(encryptSyncCmdErrPipe, p)
 			if encryptSyncCmdErr := encryptSyncCmd.Run(); encryptSyncCmdErr != nil {
@@ -121,22 +395,97 @@ func stage2EnvFile(appConfig utils.SidekickAppConfig, p *tea.Program, server *ut
 	return envFileChanged, currentEnvFileHash, nil
 }
 
-func stage3BuildDockerImage(appConfig utils.SidekickAppConfig, p *tea.Program, server *utils.SidekickServer) error {
-	cwd, _ := os.Getwd()
-	dockerPlatformId := server.PlatformId
-	dockerBuildCmd := exec.Command("docker", "build", "--tag", appConfig.Name, "--progress=plain", fmt.Sprintf("--platform=%s", dockerPlatformId), cwd)
-	dockerBuildCmdErrPipe, _ := dockerBuildCmd.StderrPipe()
-	go render.SendLogsToTUI(dockerBuildCmdErrPipe, p)
+func stage3BuildDockerImage(tag string, p *tea.Program, server *utils.SidekickServer, cache utils.BuildCache, buildContext string) (*utils.BuildCacheStats, error) {
+	dockerBuildCmd := utils.OperationCommand("docker", utils.GetDockerBuildArgs(tag, server.PlatformId, cache, buildContext)...)
+	stats, dockerBuildErr := utils.RunDockerBuildWithTUIHook(dockerBuildCmd, p)
+	if dockerBuildErr != nil {
+		return stats, fmt.Errorf("failed to build Docker image: %w", dockerBuildErr)
+	}
+	return stats, nil
+}
+
+// stage3LocateRemoteImage makes sure a prebuilt image that is not on this machine is on the VPS
+func stage3LocateRemoteImage(sshClient *ssh.Client, appConfig utils.SidekickAppConfig, image string, opts deployOptions, p *tea.Program, report *utils.RetryReport) error {
+	if opts.imageSource == imageSourceServer {
+		if _, err := utils.RunCommandOutput(sshClient, fmt.Sprintf("docker image inspect %s", image)); err != nil {
+			return fmt.Errorf("image %s is neither on this machine nor on the server - pass --image-from-registry to pull it", image)
+		}
+		p.Send(render.LogMsg{LogLine: fmt.Sprintf("Found %s on the server\n", image)})
+		return nil
+	}
+	if opts.registryPassword != "" {
+		if err := utils.RemoteDockerLogin(sshClient, appConfig.Registry, opts.registryPassword); err != nil {
+			return err
+		}
+	}
+	attempts, err := utils.DefaultRetryPolicy.Do(func() error {
+		return utils.RunCommandWithTUIHook(sshClient, fmt.Sprintf("docker pull %s", image), p)
+	}, func(attempt int, attempts int, err error) {
+		p.Send(render.LogMsg{LogLine: fmt.Sprintf("docker pull failed: %s - attempt %d/%d\n", err, attempt, attempts)})
+	})
+	report.Record("image pull", attempts)
+	if err != nil {
+		return fmt.Errorf("failed to pull %s on the server, check it was pushed and the server is logged in to the registry: %w", image, err)
+	}
+	return nil
+}
+
+// stagePushDockerImage sends the local build through the registry, the server pulls it right after
+func stagePushDockerImage(appConfig utils.SidekickAppConfig, image string, opts deployOptions, p *tea.Program) error {
+	if err := utils.DockerLogin(appConfig.Registry, opts.registryPassword); err != nil {
+		return err
+	}
+	if err := utils.PushImageWithTUIHook(opts.buildTag, image, p); err != nil {
+		return err
+	}
+	// the next build pulls its cache from here, wherever it runs
+	cacheImage, err := utils.AppImage(appConfig, utils.BuildCacheTag)
+	if err != nil {
+		return err
+	}
+	if err := utils.PushImageWithTUIHook(opts.buildTag, cacheImage, p); err != nil {
+		return err
+	}
+	// the registry gets the version tag too, so a version can be pulled by name later
+	if opts.version == "" {
+		return nil
+	}
+	versionImage, err := utils.AppImage(appConfig, opts.version)
+	if err != nil {
+		return err
+	}
+	return utils.PushImageWithTUIHook(opts.buildTag, versionImage, p)
+}
 
-	if dockerBuildErr := dockerBuildCmd.Run(); dockerBuildErr != nil {
-		return fmt.Errorf("failed to build Docker image: %w", dockerBuildErr)
+func stagePreflightRemote(sshClient *ssh.Client, appConfig utils.SidekickAppConfig, opts deployOptions) error {
+	remote := utils.SSHExecutor{Client: sshClient}
+	size, err := utils.RemoteImageSize(remote, appConfig.Image)
+	if err != nil {
+		return err
+	}
+	return utils.CheckRemoteDiskSpace(remote, appConfig.Name, size, opts.shipsTar())
+}
+
+// stagePreflightTar checks both ends have room for the tar now that the real size of the image is known
+func stagePreflightTar(sshClient *ssh.Client, appConfig utils.SidekickAppConfig, image string) *utils.StageError {
+	size, err := utils.LocalImageSize(image)
+	if err != nil {
+		return utils.NewStageError("Disk space", utils.ExitCodeBuild, "Pass --skip-preflight to save the image without checking", err)
+	}
+	cwd, _ := os.Getwd()
+	if err := utils.CheckLocalDiskSpace(cwd, size); err != nil {
+		return utils.NewStageError("Disk space", utils.ExitCodeBuild, utils.PreflightLocalHint, err)
+	}
+	if err := utils.CheckRemoteDiskSpace(utils.SSHExecutor{Client: sshClient}, appConfig.Name, size, true); err != nil {
+		return utils.NewStageError("Disk space", utils.ExitCodeRemote, utils.PreflightRemoteHint, err)
 	}
 	return nil
 }
 
-func stage4SaveDockerImage(appConfig utils.SidekickAppConfig, p *tea.Program) error {
+func stage4SaveDockerImage(appConfig utils.SidekickAppConfig, image string, p *tea.Program) error {
 	imgFileName := fmt.Sprintf("%s-latest.tar", appConfig.Name)
-	imgSaveCmd := exec.Command("docker", "save", "-o", imgFileName, appConfig.Name)
+	imgSaveCmd := utils.OperationCommand("docker", "save", "-o", imgFileName, image)
+	utils.TraceExec(imgSaveCmd)
 	imgSaveCmdErrPipe, _ := imgSaveCmd.StderrPipe()
 	go render.SendLogsToTUI(imgSaveCmdErrPipe, p)
 
@@ -146,22 +495,37 @@ func stage4SaveDockerImage(appConfig utils.SidekickAppConfig, p *tea.Program) er
 	return nil
 }
 
-func stage5MoveDockerImage(appConfig utils.SidekickAppConfig, p *tea.Program, server *utils.SidekickServer) error {
+func stage5MoveDockerImage(sshClient *ssh.Client, appConfig utils.SidekickAppConfig, p *tea.Program, report *utils.RetryReport) error {
 	imgFileName := fmt.Sprintf("%s-latest.tar", appConfig.Name)
-	remoteDist := fmt.Sprintf("%s@%s:./%s", "sidekick", server.Address, appConfig.Name)
-	imgMoveCmd := exec.Command("scp", "-C", imgFileName, remoteDist)
-	imgMoveCmdErrorPipe, _ := imgMoveCmd.StderrPipe()
-	go render.SendLogsToTUI(imgMoveCmdErrorPipe, p)
-
-	if imgMovCmdErr := imgMoveCmd.Run(); imgMovCmdErr != nil {
+	var result utils.TransferResult
+	// chunks already on the server are kept, so another go only sends what is missing
+	progress := utils.TransferProgressToTUI(p)
+	attempts, imgMovCmdErr := utils.DefaultRetryPolicy.Do(func() error {
+		var err error
+		result, err = utils.MoveImageTar(sshClient, imgFileName, path.Join(appConfig.Name, imgFileName), progress)
+		return err
+	}, func(attempt int, attempts int, err error) {
+		p.Send(render.LogMsg{LogLine: fmt.Sprintf("Image transfer failed: %s - attempt %d/%d\n", err, attempt, attempts)})
+	})
+	report.Record("image transfer", attempts)
+	if imgMovCmdErr != nil {
 		return fmt.Errorf("failed to move Docker image to server: %w", imgMovCmdErr)
 	}
+	p.Send(render.LogMsg{LogLine: result.String() + "\n"})
 	os.Remove(imgFileName)
 	return nil
 }
 
-func stage6Deploy(sshClient *ssh.Client, appConfig utils.SidekickAppConfig, envFileChanged bool, currentEnvFileHash string, p *tea.Program, server *utils.SidekickServer) error {
-	dockerLoadOutChan, _, sessionErr := utils.RunCommand(sshClient, fmt.Sprintf("cd %s && docker load -i %s-latest.tar", appConfig.Name, appConfig.Name))
+func loadDockerImage(sshClient *ssh.Client, appConfig utils.SidekickAppConfig, p *tea.Program, report *utils.RetryReport) error {
+	var dockerLoadOutChan chan string
+	attempts, sessionErr := utils.DefaultRetryPolicy.Do(func() error {
+		var err error
+		dockerLoadOutChan, _, err = utils.RunCommand(sshClient, fmt.Sprintf("cd %s && docker load -i %s-latest.tar", appConfig.Name, appConfig.Name))
+		return err
+	}, func(attempt int, attempts int, err error) {
+		p.Send(render.LogMsg{LogLine: fmt.Sprintf("docker load failed: %s - attempt %d/%d\n", err, attempt, attempts)})
+	})
+	report.Record("docker load", attempts)
 	if sessionErr != nil {
 		return fmt.Errorf("failed to load docker image on server: %w", sessionErr)
 	}
@@ -170,37 +534,143 @@ func stage6Deploy(sshClient *ssh.Client, appConfig utils.SidekickAppConfig, envF
 		p.Send(render.LogMsg{LogLine: <-dockerLoadOutChan + "\n"})
 		time.Sleep(time.Millisecond * 100)
 	}()
+	return nil
+}
 
-	replacer := strings.NewReplacer(
-		"$service_name", appConfig.Name,
-		"$app_port", fmt.Sprint(appConfig.Port),
-		"$has_env", appConfig.Env.File,
-	)
+func stage6Deploy(sshClient *ssh.Client, appConfig utils.SidekickAppConfig, envFileChanged bool, currentEnvFileHash string, p *tea.Program, server *utils.SidekickServer, report *utils.RetryReport, opts deployOptions) (utils.PruneResult, error) {
+	pruned := utils.PruneResult{}
+	if opts.shipsTar() {
+		if err := loadDockerImage(sshClient, appConfig, p, report); err != nil {
+			return pruned, err
+		}
+	}
 
-	deployScript := replacer.Replace(utils.DeployAppScript)
-	utils.RunCommandWithTUIHook(sshClient, deployScript, p, utils.EnvVar{"SOPS_AGE_KEY": server.SecretKey})
+	// re-uploading the custom cert on every deploy is how a renewed cert reaches the VPS
+	if utils.HasCustomCert(appConfig) {
+		if !utils.FileExists(appConfig.TLS.Cert) || !utils.FileExists(appConfig.TLS.Key) {
+			return pruned, fmt.Errorf("custom certificate %s or its key %s is missing", appConfig.TLS.Cert, appConfig.TLS.Key)
+		}
+		if err := utils.UploadCustomCert(sshClient, *server, appConfig); err != nil {
+			return pruned, fmt.Errorf("failed to upload custom certificate: %w", err)
+		}
+	}
+
+	// regenerate the compose file so label changes (like the cert resolver) land on this deploy
+	composeFile, err := getComposeFile(appConfig, opts)
+	if err != nil {
+		return pruned, err
+	}
+	composeFileContent, err := yaml.Marshal(composeFile)
+	if err != nil {
+		return pruned, fmt.Errorf("failed to generate compose file: %w", err)
+	}
+	if err := utils.WriteRemoteFile(sshClient, fmt.Sprintf("%s/docker-compose.yaml", appConfig.Name), composeFileContent); err != nil {
+		return pruned, fmt.Errorf("failed to upload compose file: %w", err)
+	}
+	if opts.sbomUpload && !opts.skipBuild {
+		sbomContent, err := os.ReadFile(opts.sbom.Path)
+		if err != nil {
+			return pruned, fmt.Errorf("failed to read sbom: %w", err)
+		}
+		opts.sbom.Remote = utils.RemoteSbomFile(appConfig.Name, opts.sbom.Format)
+		if err := utils.WriteRemoteFile(sshClient, opts.sbom.Remote, sbomContent); err != nil {
+			return pruned, fmt.Errorf("failed to upload sbom: %w", err)
+		}
+	}
+
+	// the deploy script only swaps the app container, addons added since the last deploy are started first
+	if len(appConfig.Addons) > 0 && !utils.IsSwarm(appConfig) {
+		if err := utils.RunCommandWithTUIHook(sshClient, utils.GetStartAddonsCommand(appConfig, server.SecretKey), p); err != nil {
+			return pruned, fmt.Errorf("failed to start the addons: %w", err)
+		}
+	}
+
+	// the deploy script swaps containers so it is never retried
+	deployCmd := utils.GetDeployAppScript(appConfig)
+	if utils.IsSwarm(appConfig) {
+		// swarm does the swap itself, starting the new task before it stops the old one
+		deployCmd = utils.GetStackDeployCommand(appConfig.Name, appConfig.Env.File != "", server.SecretKey)
+	}
+	if err := utils.RunCommandWithTUIHook(sshClient, deployCmd, p, utils.EnvVar{"SOPS_AGE_KEY": server.SecretKey}); err != nil {
+		var dropped *utils.ConnectionDroppedError
+		if !errors.As(err, &dropped) || utils.IsSwarm(appConfig) {
+			return pruned, err
+		}
+		p.Send(render.LogMsg{LogLine: "The connection dropped during the deploy, checking whether it went through\n"})
+		if err := utils.WaitForDeployedImage(utils.SSHExecutor{Client: sshClient}, appConfig.Name, opts.imageName(appConfig)); err != nil {
+			return pruned, err
+		}
+	}
 	time.Sleep(time.Second * 2)
 
-	cleanOutChan, _, sessionErr := utils.RunCommand(sshClient, fmt.Sprintf("cd %s && rm %s", appConfig.Name, fmt.Sprintf("%s-latest.tar", appConfig.Name)))
-	if sessionErr != nil {
-		return fmt.Errorf("failed to clean up image file on server: %w", sessionErr)
+	if err := utils.VerifyServicesHealthWithTUIHook(sshClient, appConfig.Name, appConfig, p); err != nil {
+		return pruned, err
 	}
-	go func() {
-		p.Send(render.LogMsg{LogLine: <-cleanOutChan + "\n"})
-		time.Sleep(time.Millisecond * 100)
-	}()
 
-	latestVersion := strings.Split(appConfig.Version, "")[1]
-	latestVersionInt, _ := strconv.ParseInt(latestVersion, 0, 64)
-	appConfig.Version = fmt.Sprintf("V%d", latestVersionInt+1)
+	// jobs removed from sidekick.yml are taken out of the crontab here too, so this runs on every deploy
+	if _, err := utils.RunCommandOutput(sshClient, utils.GetInstallCronCommand(appConfig, *server)); err != nil {
+		return pruned, fmt.Errorf("failed to install the cron jobs: %w", err)
+	}
+
+	if opts.shipsTar() {
+		cleanOutChan, _, sessionErr := utils.RunCommand(sshClient, fmt.Sprintf("cd %s && rm %s", appConfig.Name, fmt.Sprintf("%s-latest.tar", appConfig.Name)))
+		if sessionErr != nil {
+			return pruned, fmt.Errorf("failed to clean up image file on server: %w", sessionErr)
+		}
+		go func() {
+			p.Send(render.LogMsg{LogLine: <-cleanOutChan + "\n"})
+			time.Sleep(time.Millisecond * 100)
+		}()
+	}
+
+	// what ran until now is where sidekick rollback goes back to
+	appConfig.ImageHistory = utils.RecordRollbackImage(appConfig.ImageHistory, utils.LiveImageTag(appConfig), utils.GetKeepImages(appConfig))
+	appConfig.Version = utils.NextDeployVersion(appConfig.Version)
+
+	// every deploy keeps a versioned tag so older images can be pruned while the newest few stay around for rollbacks
+	remote := utils.SSHExecutor{Client: sshClient}
+	tags := append([]string{utils.DeployImageTag(utils.AppRepository(appConfig), appConfig.Version)}, opts.releaseTags(appConfig)...)
+	if _, err := remote.Output(utils.GetTagImageCommand(opts.imageName(appConfig), tags)); err != nil {
+		p.Send(render.LogMsg{LogLine: fmt.Sprintf("Could not tag the image for cleanup: %s\n", err)})
+	} else if pruned, err = utils.PruneAppImages(remote, utils.AppRepository(appConfig), utils.GetKeepImages(appConfig), utils.ProtectedImages(appConfig)...); err != nil {
+		p.Send(render.LogMsg{LogLine: fmt.Sprintf("Could not prune old images: %s\n", err)})
+	}
+
+	appConfig.Image = opts.imageName(appConfig)
+	appConfig.LastDeployedAt = time.Now().Format(time.UnixDate)
+	sha := ""
+	if opts.ref != nil {
+		sha = opts.ref.ShortSha
+	} else if !opts.noGit {
+		sha, _ = utils.GetGitShortHash()
+	}
+	appConfig.LastDeployedCommit = sha
+	appConfig.BuildHash = opts.buildHash
+	if opts.buildDuration > 0 {
+		appConfig.BuildDuration = opts.buildDuration.Round(time.Second).String()
+	}
+	appConfig.DeployedVersion = opts.version
+	if opts.sbomFormat != "" && !opts.skipBuild {
+		appConfig.Sbom = opts.sbom
+	}
 	// env file changed ? -> update hash
 	if envFileChanged {
 		appConfig.Env.Hash = currentEnvFileHash
 	}
-	ymlData, _ := yaml.Marshal(&appConfig)
-	os.WriteFile("./sidekick.yml", ymlData, 0644)
+	if err := utils.SaveAppState(remote, &appConfig); err != nil {
+		return pruned, fmt.Errorf("the new version is live but its state was not saved: %w", err)
+	}
+	if err := utils.SaveAppInfo(remote, appConfig); err != nil {
+		return pruned, fmt.Errorf("the new version is live but app.yml was not saved: %w", err)
+	}
 
-	return nil
+	if appConfig.Badge.Enabled {
+		if err := utils.UpdateRemoteBadge(sshClient, appConfig, sha); err != nil {
+			return pruned, fmt.Errorf("failed to update status badge: %w", err)
+		}
+	}
+
+	return pruned, nil
 }
 
 var DeployCmd = &cobra.Command{
@@ -208,24 +678,276 @@ var DeployCmd = &cobra.Command{
 	Short: "Deploy a new version of your application to your VPS using Sidekick",
 	Long: `This command deploys a new version of your application to your VPS.
 It assumes that your VPS is already configured and that your application is ready for deployment`,
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		start := time.Now()
 
 		config, err := utils.GetSidekickConfigFromCmdContext(cmd)
 		if err != nil {
-			render.GetLogger(log.Options{Prefix: "Sidekick Config"}).Fatalf("%s", err)
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
+		appConfig, _, err := prelude(config)
+		if err != nil {
+			return err
+		}
+		target, err := utils.ResolveTarget(cmd, config, appConfig.Server, utils.MetadataEnvProduction)
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Pass --context to pick a server", err)
+		}
+		sidekickServer := target.Server
+		appConfig.Network = sidekickServer.NetworkName()
+		if utils.IsSwarm(appConfig) && sidekickServer.Runtime == utils.RuntimePodman {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Set orchestrator to compose in sidekick.yml", fmt.Errorf("server %s runs podman, which has no swarm mode", sidekickServer.Name))
+		}
+
+		if cmd.Flags().Changed("staging-tls") {
+			appConfig.StagingTLS, _ = cmd.Flags().GetBool("staging-tls")
+		}
+		if noTLS, _ := cmd.Flags().GetBool("no-tls"); noTLS {
+			if utils.HasCustomCert(appConfig) {
+				return utils.NewStageError("TLS", utils.ExitCodeConfig, "Remove tls.cert and tls.key from sidekick.yml first", errors.New("--no-tls can't be used with a custom certificate"))
+			}
+			appConfig.TLS.Disabled = true
+		}
+		if appConfig.StagingTLS && utils.GetCertResolver(appConfig) != "" {
+			render.GetLogger(log.Options{Prefix: "TLS"}).Warn("Using the Let's Encrypt staging resolver - browsers will not trust the certificate for this app")
+		}
+
+		opts := deployOptions{}
+		if opts.buildTag, err = utils.AppImage(appConfig, "latest"); err != nil {
+			return utils.NewStageError("Image", utils.ExitCodeConfig, "", err)
+		}
+		cacheFrom, _ := cmd.Flags().GetString("cache-from-image")
+		opts.image, _ = cmd.Flags().GetString("image")
+		fromRegistry, _ := cmd.Flags().GetBool("image-from-registry")
+		if fromRegistry && opts.image == "" {
+			return utils.NewStageError("Image", utils.ExitCodeConfig, "Pass the image to pull with --image", fmt.Errorf("--image-from-registry needs --image"))
+		}
+		remoteBuild, _ := cmd.Flags().GetBool("remote-build")
+		if utils.IsStatic(appConfig) && opts.image != "" {
+			return utils.NewStageError("Image", utils.ExitCodeConfig, "Remove static from sidekick.yml to deploy a prebuilt image", errors.New("--image can't be used with a static site"))
+		}
+		switch {
+		case utils.IsStatic(appConfig):
+			opts.imageSource = imageSourceStatic
+		case remoteBuild:
+			opts.imageSource = imageSourceRemoteBuild
+		case opts.image == "":
+			opts.imageSource = imageSourceBuild
+		case fromRegistry:
+			opts.imageSource = imageSourceRegistry
+		case localImageExists(opts.image):
+			opts.imageSource = imageSourceLocal
+		default:
+			opts.imageSource = imageSourceServer
+		}
+
+		cwd, _ := os.Getwd()
+		opts.noGit, _ = cmd.Flags().GetBool("no-git")
+		buildID, fromGit := "", false
+		if opts.noGit {
+			buildID, err = utils.ContentHash(cwd)
+		} else {
+			buildID, fromGit, err = utils.BuildID(cwd)
+		}
+		if err != nil {
+			return utils.NewStageError("Build context", utils.ExitCodeConfig, "", err)
+		}
+		if opts.noGit {
+			render.GetLogger(log.Options{Prefix: "Git"}).Infof("Skipping git, this build is tagged %s after its content", buildID)
+		} else if !fromGit {
+			render.GetLogger(log.Options{Prefix: "Git"}).Warnf("Not a git repository, this build is tagged %s after its content. --ref and the commit in the deploy history are not available", buildID)
+		}
+		if refName, _ := cmd.Flags().GetString("ref"); refName != "" {
+			if !fromGit {
+				return utils.NewStageError("Git Ref", utils.ExitCodeConfig, "Deploy the folder as it is without --ref", errors.New("--ref needs a git repository"))
+			}
+			resolved, err := utils.ResolveGitRef(refName)
+			if err != nil {
+				return utils.NewStageError("Git Ref", utils.ExitCodeConfig, "Deploy a tag, branch or sha that builds on what is live now", err)
+			}
+			opts.ref = &resolved
+		}
+
+		opts.hash = buildID
+		if opts.ref != nil {
+			opts.hash = opts.ref.ShortSha
+		}
+		if opts.image == "" && opts.noGit {
+			if opts.version, err = utils.ReadVersionFile(); err != nil {
+				return utils.NewStageError("Version", utils.ExitCodeConfig, "Fix the version in "+utils.VersionFile, err)
+			}
+		} else if opts.image == "" {
+			if opts.version, err = utils.ResolveAppVersion(opts.ref); err != nil {
+				return utils.NewStageError("Version", utils.ExitCodeConfig, "Fix the version in "+utils.VersionFile+" or the git tag", err)
+			}
+		}
+
+		opts.push, _ = cmd.Flags().GetBool("push")
+		if opts.push && opts.imageSource == imageSourceStatic {
+			return utils.NewStageError("Registry", utils.ExitCodeConfig, "", errors.New("--push can't be used with a static site, it is built on your VPS"))
+		}
+		opts.skipPreflight, _ = cmd.Flags().GetBool("skip-preflight")
+		opts.skipDNSCheck, _ = cmd.Flags().GetBool("skip-dns-check")
+		if opts.push || (utils.HasRegistry(appConfig) && opts.imageSource == imageSourceRegistry) {
+			if !utils.HasRegistry(appConfig) {
+				return utils.NewStageError("Registry", utils.ExitCodeConfig, "Add registry.url and registry.username to sidekick.yml", fmt.Errorf("--push needs a registry"))
+			}
+			if err := utils.ValidateRegistryConfig(appConfig.Registry); err != nil {
+				return utils.NewStageError("Registry", utils.ExitCodeConfig, "", err)
+			}
+			password, err := utils.ResolveRegistryPassword(appConfig)
+			if err != nil {
+				return utils.NewStageError("Registry", utils.ExitCodeConfig, "", err)
+			}
+			opts.registryPassword = password
+		}
+		if opts.push {
+			tag := opts.hash
+			if tag == "" {
+				tag = "latest"
+			}
+			if opts.image, err = utils.AppImage(appConfig, tag); err != nil {
+				return utils.NewStageError("Image", utils.ExitCodeConfig, "", err)
+			}
+		}
+
+		noCache, _ := cmd.Flags().GetBool("no-cache")
+		if opts.cache, err = utils.GetBuildCache(appConfig, cacheFrom, opts.push, noCache); err != nil {
+			return utils.NewStageError("Image", utils.ExitCodeConfig, "", err)
+		}
+
+		if scan, _ := cmd.Flags().GetBool("scan"); scan || cmd.Flags().Changed("scan-severity") {
+			opts.scanSeverity, _ = cmd.Flags().GetString("scan-severity")
+			opts.scanSeverity = strings.ToUpper(opts.scanSeverity)
+			if err := utils.ValidateScanSeverity(opts.scanSeverity); err != nil {
+				return utils.NewStageError("Scan", utils.ExitCodeConfig, "", err)
+			}
+			if opts.imageSource != imageSourceBuild && opts.imageSource != imageSourceLocal {
+				return utils.NewStageError("Scan", utils.ExitCodeConfig, "Build the image locally or pass an --image that is on this machine", fmt.Errorf("--scan needs the image on this machine"))
+			}
+		}
+
+		if sbom, _ := cmd.Flags().GetBool("sbom"); sbom || cmd.Flags().Changed("sbom-format") {
+			opts.sbomFormat, _ = cmd.Flags().GetString("sbom-format")
+			opts.sbomUpload, _ = cmd.Flags().GetBool("sbom-upload")
+			if err := utils.ValidateSbomFormat(opts.sbomFormat); err != nil {
+				return utils.NewStageError("SBOM", utils.ExitCodeConfig, "", err)
+			}
+			if opts.imageSource != imageSourceBuild && opts.imageSource != imageSourceLocal {
+				return utils.NewStageError("SBOM", utils.ExitCodeConfig, "Build the image locally or pass an --image that is on this machine", fmt.Errorf("--sbom needs the image on this machine"))
+			}
+		} else if upload, _ := cmd.Flags().GetBool("sbom-upload"); upload {
+			return utils.NewStageError("SBOM", utils.ExitCodeConfig, "Add --sbom", fmt.Errorf("--sbom-upload needs --sbom"))
+		}
+
+		timeout, err := utils.GetOperationTimeout(cmd, appConfig)
+		if err != nil {
+			return utils.NewStageError("Timeout", utils.ExitCodeConfig, "", err)
+		}
+		if opts.verifyTimeout, err = utils.GetVerifyTimeout(cmd, appConfig); err != nil {
+			return utils.NewStageError("Timeout", utils.ExitCodeConfig, "", err)
 		}
-		appConfig, sidekickServer := prelude(config)
 
+		if dryRun, _ := cmd.Flags().GetBool("dry-run"); dryRun {
+			plan, err := getDeployPlan(appConfig, target, opts)
+			if err == nil {
+				err = plan.Print()
+			}
+			if err != nil {
+				return err
+			}
+			return nil
+		}
+		if err := utils.GuardTarget(cmd, config, target, appConfig.Name); err != nil {
+			return err
+		}
+		if forceUnlock, _ := cmd.Flags().GetBool("force-unlock"); forceUnlock {
+			return utils.RunForceUnlock(sidekickServer.Address, utils.DeployLockFile(appConfig.Name))
+		}
+		if err := utils.CheckDomainDNSStage(cmd, appConfig.Url, sidekickServer.Address); err != nil {
+			return err
+		}
+
+		image := opts.imageName(appConfig)
 		cmdStages := []render.Stage{
 			render.MakeStage("Validating connection with VPS", "VPS is reachable", false),
 			render.MakeStage("Updating secrets if needed", "Env file check complete", false),
-			render.MakeStage("Building latest docker image of your app", "Latest docker image built", true),
-			render.MakeStage("Saving docker image locally", "Image saved successfully", false),
-			render.MakeStage("Moving image to your server", "Image moved and loaded successfully", false),
-			render.MakeStage("Deploying a new version of your application", "Deployed new version successfully", true),
 		}
-		p := tea.NewProgram(render.TuiModel{
+		switch opts.imageSource {
+		case imageSourceBuild:
+			cmdStages = append(cmdStages, render.MakeStage("Building latest docker image of your app", "Latest docker image built", true))
+		case imageSourceRemoteBuild:
+			cmdStages = append(cmdStages, render.MakeStage("Building latest docker image of your app on your server", "Latest docker image built on your server", true))
+		case imageSourceStatic:
+			cmdStages = append(cmdStages, render.MakeStage("Building your static site on your server", "Static site image built on your server", true))
+		case imageSourceServer:
+			cmdStages = append(cmdStages, render.MakeStage("Checking "+image+" is on your server", "Image found on your server", false))
+		case imageSourceRegistry:
+			cmdStages = append(cmdStages, render.MakeStage("Pulling "+image+" on your server", "Image pulled successfully", true))
+		}
+		if opts.scanSeverity != "" {
+			cmdStages = append(cmdStages, render.MakeStage("Scanning image for vulnerabilities", "No vulnerabilities at or above "+opts.scanSeverity, true))
+		}
+		if opts.sbomFormat != "" {
+			cmdStages = append(cmdStages, render.MakeStage("Generating SBOM", "SBOM written", false))
+		}
+		if opts.push {
+			cmdStages = append(cmdStages,
+				render.MakeStage("Pushing image to your registry", "Image pushed successfully", true),
+				render.MakeStage("Pulling image on your server", "Image pulled successfully", true),
+			)
+		}
+		if opts.shipsTar() {
+			cmdStages = append(cmdStages,
+				render.MakeStage("Saving docker image locally", "Image saved successfully", false),
+				render.MakeStage("Moving image to your server", "Image moved and loaded successfully", false),
+			)
+		}
+		// the build and everything that ships its image are left out together when nothing changed since the last build
+		buildStages := len(cmdStages) - 2
+		cmdStages = append(cmdStages, render.MakeStage("Deploying a new version of your application", "Deployed new version successfully", true))
+		if opts.verifyTimeout > 0 {
+			cmdStages = append(cmdStages, render.MakeStage("Waiting for your app to answer at "+appConfig.Url, "Your app answers at "+appConfig.Url, true))
+		}
+
+		// a ref is built from an exported copy so the working tree stays as it is
+		buildContext, deployHash := cwd, buildID
+		cleanupRef := func() {}
+		if opts.ref != nil {
+			exportDir, cleanup, err := utils.ExportGitRef(*opts.ref)
+			if err != nil {
+				return utils.NewStageError("Git Ref", utils.ExitCodeError, "", err)
+			}
+			buildContext, deployHash, cleanupRef = exportDir, opts.ref.ShortSha, cleanup
+		}
+		defer cleanupRef()
+		if ok, err := utils.ConfirmProduction(cmd, config, target, fmt.Sprintf("Deploy %s %s → %s", appConfig.Name, deployHash, appConfig.Url)); !ok {
+			return err
+		}
+		opts.forceBuild, _ = cmd.Flags().GetBool("force-build")
+		if opts.builds() {
+			if opts.buildHash, err = utils.ContentHash(buildContext); err != nil {
+				return utils.NewStageError("Build context", utils.ExitCodeConfig, "", err)
+			}
+		}
+		notifications := []utils.SidekickNotification{}
+		if noNotify, _ := cmd.Flags().GetBool("no-notify"); !noNotify {
+			notifications = utils.GetNotifications(config, appConfig)
+		}
+		appURL := utils.URLScheme(appConfig) + "://" + appConfig.Url
+		deployEvent := func(status string, err error) utils.DeployEvent {
+			if !opts.noGit {
+				return utils.NewDeployEvent(status, appConfig.Name, utils.MetadataEnvProduction, deployHash, appURL, start, err)
+			}
+			// the hash is not a commit, git isn't asked for its subject
+			event := utils.NewDeployEvent(status, appConfig.Name, utils.MetadataEnvProduction, "", appURL, start, err)
+			event.Hash = deployHash
+			return event
+		}
+		utils.Notify(notifications, deployEvent(utils.DeployStarted, nil))
+		p := render.NewProgram(render.TuiModel{
+			App:         appConfig.Name,
+			Hash:        deployHash,
 			Stages:      cmdStages,
 			BannerMsg:   fmt.Sprintf("Deploying a new env of your app to server %s (%s) 😎", sidekickServer.Name, sidekickServer.Address),
 			ActiveIndex: 0,
@@ -233,54 +955,285 @@ It assumes that your VPS is already configured and that your application is read
 			AllDone:     false,
 		})
 
+		retryReport := &utils.RetryReport{}
+
+		// set before the error is sent to the TUI so it is visible once p.Run returns
+		var pipelineErr error
+		fail := func(err *utils.StageError) {
+			pipelineErr = err
+			p.Send(render.ErrorMsg{ErrorStr: err.Error()})
+		}
+
+		imgFileName := fmt.Sprintf("%s-latest.tar", appConfig.Name)
+		deadline := utils.StartOperationDeadline("deploy", timeout, func(err *utils.StageError) {
+			p.Send(render.ErrorMsg{ErrorStr: err.Error()})
+		})
+		defer deadline.Stop()
+		deadline.OnExpire(func() { utils.RemoveLocalFiles(imgFileName, "encrypted.env") })
+
+		// failed deploys go into the history too, it is written once the TUI is done whatever the outcome
+		lock := utils.NewDeployLock(utils.DeployLockFile(appConfig.Name))
+		var lockClient *ssh.Client
+		// closed once the stages below return, after Ctrl-C they still run until the cleanup cuts them off
+		pipelineDone := make(chan struct{})
+		defer func() {
+			// the stages set lockClient and pipelineErr, they are only read once the stages are over
+			<-pipelineDone
+			// an expired deadline already removed the lock along with the rest
+			if lockClient != nil && !deadline.Expired() {
+				if err := lock.Release(utils.SSHExecutor{Client: lockClient}); err != nil {
+					render.GetLogger(log.Options{Prefix: "Deploy"}).Warnf("%s, remove it with sidekick deploy --force-unlock", err)
+				}
+			}
+			if lockClient != nil {
+				utils.RecordHistory(sidekickServer.Address, appConfig.Name, utils.NewHistoryEntry(utils.HistoryDeploy, deployHash, image, start, pipelineErr))
+			}
+			status := utils.DeploySucceeded
+			if pipelineErr != nil {
+				status = utils.DeployFailed
+			}
+			utils.Notify(notifications, deployEvent(status, pipelineErr))
+		}()
+
 		go func() {
-			sshClient, err := stage1Login(&sidekickServer)
+			defer close(pipelineDone)
+			sshClient, err := stage1Login(&sidekickServer, &appConfig, p, lock)
+			var lockedErr *utils.LockedError
+			if errors.As(err, &lockedErr) {
+				fail(utils.NewStageError("Deploy lock", utils.ExitCodeRemote, "", err))
+				return
+			}
 			if err != nil {
-				p.Send(render.ErrorMsg{ErrorStr: "Failed to connect to VPS: " + err.Error()})
+				fail(utils.NewStageError("Validating connection with VPS", utils.ExitCodeRemote, "Check that the VPS is up and your SSH key is loaded in ssh-agent", err))
+				return
+			}
+			lockClient = sshClient
+			deadline.OnExpire(func() {
+				sshClient.Close()
+				utils.AbortRemote(sidekickServer.Address, fmt.Sprintf("rm -f %s/%s; %s; rm -f %s", appConfig.Name, imgFileName, utils.GetAbortDeployScript(appConfig.Name), lock.Path))
+			})
+			// what is live comes from the state on the server, so the ref is checked against it once logged in
+			if opts.ref != nil {
+				if err := utils.CheckGitRefAncestry(*opts.ref, appConfig.LastDeployedCommit); err != nil {
+					fail(utils.NewStageError("Git Ref", utils.ExitCodeConfig, "Deploy a tag, branch or sha that builds on what is live now", err))
+					return
+				}
+			}
+			// Traefik would pick one of two apps on the same host without a word, so that fails before anything is built
+			if stageErr := utils.CheckRouteConflictsStage(utils.SSHExecutor{Client: sshClient}, appConfig.Name, appConfig.Name, appConfig.Url); stageErr != nil {
+				fail(stageErr)
+				return
+			}
+			if stageErr := utils.CheckNetworksStage(utils.SSHExecutor{Client: sshClient}, appConfig); stageErr != nil {
+				fail(stageErr)
 				return
 			}
+			// nothing is built yet, the image running now is the best guess at how big the new one is
+			if !opts.skipPreflight && opts.imageSource != imageSourceServer {
+				if err := stagePreflightRemote(sshClient, appConfig, opts); err != nil {
+					fail(utils.NewStageError("Disk space", utils.ExitCodeRemote, utils.PreflightRemoteHint, err))
+					return
+				}
+			}
 			p.Send(render.NextStageMsg{})
 
 			envFileChanged, currentEnvFileHash, err := stage2EnvFile(appConfig, p, &sidekickServer)
 			if err != nil {
-				p.Send(render.ErrorMsg{ErrorStr: err.Error()})
+				fail(utils.NewStageError("Env File", utils.ExitCodeConfig, "Make sure sops is installed and the env file is valid dotenv", err))
 				return
 			}
 			p.Send(render.NextStageMsg{})
 
-			if err := stage3BuildDockerImage(appConfig, p, &sidekickServer); err != nil {
-				p.Send(render.ErrorMsg{ErrorStr: err.Error()})
-				return
+			// the same content as the live image builds the same image, so only the deploy runs again
+			var cacheStats *utils.BuildCacheStats
+			if !opts.forceBuild && opts.builds() && utils.BuildUnchanged(utils.SSHExecutor{Client: sshClient}, appConfig, opts.buildHash, image) {
+				opts.skipBuild = true
+				p.Send(render.LogMsg{LogLine: fmt.Sprintf("No changes since the last deploy (%s), skipping build. Pass --force-build to build anyway\n", opts.buildHash)})
+				for i := 0; i < buildStages; i++ {
+					time.Sleep(time.Millisecond * 100)
+					p.Send(render.NextStageMsg{})
+				}
 			}
-			time.Sleep(time.Millisecond * 100)
-			p.Send(render.NextStageMsg{})
+			if !opts.skipBuild {
+				buildStart := time.Now()
+				switch opts.imageSource {
+				case imageSourceBuild:
+					if cacheStats, err = stage3BuildDockerImage(opts.buildTag, p, &sidekickServer, opts.cache, buildContext); err != nil {
+						fail(utils.NewStageError("Building docker image", utils.ExitCodeBuild, "Make sure docker is running and your Dockerfile builds locally", err))
+						return
+					}
+				case imageSourceRemoteBuild:
+					if err = utils.RemoteBuildWithTUIHook(sshClient, sidekickServer, opts.buildTag, opts.cache, buildContext, p); err != nil {
+						fail(utils.NewStageError("Building docker image on your server", utils.ExitCodeBuild, "Make sure your Dockerfile builds and the VPS has enough free disk space", err))
+						return
+					}
+				case imageSourceStatic:
+					if err = utils.StaticBuildWithTUIHook(sshClient, sidekickServer, opts.buildTag, utils.StaticBuildContext(appConfig, buildContext), p); err != nil {
+						fail(utils.NewStageError("Building your static site on your server", utils.ExitCodeBuild, "Check the VPS can pull nginx:alpine and has enough free disk space", err))
+						return
+					}
+				case imageSourceServer, imageSourceRegistry:
+					if err = stage3LocateRemoteImage(sshClient, appConfig, image, opts, p, retryReport); err != nil {
+						fail(utils.NewStageError("Getting the image to your server", utils.ExitCodeTransfer, "", err))
+						return
+					}
+				}
+				if opts.builds() {
+					opts.buildDuration = time.Since(buildStart)
+					utils.TraceBuildTime(opts.buildDuration, appConfig.BuildDuration)
+				}
+				if opts.imageSource != imageSourceLocal {
+					time.Sleep(time.Millisecond * 100)
+					p.Send(render.NextStageMsg{})
+				}
 
-			if err := stage4SaveDockerImage(appConfig, p); err != nil {
-				p.Send(render.ErrorMsg{ErrorStr: err.Error()})
-				return
-			}
-			time.Sleep(time.Millisecond * 200)
-			p.Send(render.NextStageMsg{})
+				if opts.scanSeverity != "" {
+					if err := utils.ScanImageWithTUIHook(opts.localImage(), opts.scanSeverity, p); err != nil {
+						fail(utils.NewStageError("Scanning image for vulnerabilities", utils.ExitCodeBuild, "Upgrade the affected packages or raise --scan-severity", err))
+						return
+					}
+					time.Sleep(time.Millisecond * 100)
+					p.Send(render.NextStageMsg{})
+				}
 
-			if err := stage5MoveDockerImage(appConfig, p, &sidekickServer); err != nil {
-				p.Send(render.ErrorMsg{ErrorStr: err.Error()})
-				return
+				if opts.sbomFormat != "" {
+					opts.sbom = utils.SidekickSbom{Version: utils.NextDeployVersion(appConfig.Version), Format: opts.sbomFormat}
+					opts.sbom.Path = utils.SbomFileName(opts.sbom.Version, opts.sbomFormat)
+					if opts.sbom.Digest, err = utils.GenerateSbom(opts.localImage(), opts.sbomFormat, opts.sbom.Path); err != nil {
+						fail(utils.NewStageError("Generating SBOM", utils.ExitCodeBuild, "Install syft or make sure docker can run the anchore/syft image", err))
+						return
+					}
+					p.Send(render.LogMsg{LogLine: fmt.Sprintf("Wrote %s (%s)\n", opts.sbom.Path, opts.sbom.Digest)})
+					time.Sleep(time.Millisecond * 100)
+					p.Send(render.NextStageMsg{})
+				}
+
+				if opts.push {
+					if err := stagePushDockerImage(appConfig, image, opts, p); err != nil {
+						fail(utils.NewStageError("Pushing image to your registry", utils.ExitCodeTransfer, "Check the registry credentials can push to "+image, err))
+						return
+					}
+					time.Sleep(time.Millisecond * 100)
+					p.Send(render.NextStageMsg{})
+
+					pullOpts := opts
+					pullOpts.imageSource = imageSourceRegistry
+					if err := stage3LocateRemoteImage(sshClient, appConfig, image, pullOpts, p, retryReport); err != nil {
+						fail(utils.NewStageError("Pulling image on your server", utils.ExitCodeTransfer, "", err))
+						return
+					}
+					time.Sleep(time.Millisecond * 100)
+					p.Send(render.NextStageMsg{})
+				}
+
+				if opts.shipsTar() {
+					if !opts.skipPreflight {
+						if err := stagePreflightTar(sshClient, appConfig, image); err != nil {
+							fail(err)
+							return
+						}
+					}
+					if err := stage4SaveDockerImage(appConfig, image, p); err != nil {
+						fail(utils.NewStageError("Saving docker image", utils.ExitCodeBuild, "Check you have enough free disk space", err))
+						return
+					}
+					time.Sleep(time.Millisecond * 200)
+					p.Send(render.NextStageMsg{})
+
+					if err := stage5MoveDockerImage(sshClient, appConfig, p, retryReport); err != nil {
+						fail(utils.NewStageError("Moving image to your server", utils.ExitCodeTransfer, "Check the VPS has enough free disk space and run deploy again", err))
+						return
+					}
+					time.Sleep(time.Millisecond * 200)
+					p.Send(render.NextStageMsg{})
+				}
 			}
-			time.Sleep(time.Millisecond * 200)
-			p.Send(render.NextStageMsg{})
 
-			if err := stage6Deploy(sshClient, appConfig, envFileChanged, currentEnvFileHash, p, &sidekickServer); err != nil {
-				p.Send(render.ErrorMsg{ErrorStr: err.Error()})
+			pruned, err := stage6Deploy(sshClient, appConfig, envFileChanged, currentEnvFileHash, p, &sidekickServer, retryReport, opts)
+			if err != nil {
+				fail(utils.NewStageError("Deploying a new version", utils.ExitCodeRemote, "Check the app logs on your VPS with docker logs", err))
 				return
 			}
+			if opts.verifyTimeout > 0 {
+				time.Sleep(time.Millisecond * 100)
+				p.Send(render.NextStageMsg{})
+				if err := utils.VerifyDeployWithTUIHook(sshClient, appConfig.Name, appConfig.Name, appConfig.Url, appConfig, opts.verifyTimeout, p); err != nil {
+					fail(utils.NewStageError("Waiting for your app to answer", utils.ExitCodeRemote, utils.VerifyHint, err))
+					return
+				}
+			}
 
 			time.Sleep(time.Millisecond * 500)
-			p.Send(render.AllDoneMsg{Message: "🚀 Deployed successfully in " + time.Since(start).Round(time.Second).String() + ".\n" + "😎 View your app at https://" + appConfig.Url})
+			doneMessage := "🚀 Deployed successfully in " + time.Since(start).Round(time.Second).String() + ".\n" + "😎 View your app at " + utils.URLScheme(appConfig) + "://" + appConfig.Url
+			if opts.version != "" {
+				doneMessage += "\n" + "🏷️ Version " + opts.version
+			}
+			if opts.skipBuild {
+				doneMessage += "\n" + "♻️ No changes, skipped the build"
+			}
+			if cacheReport := cacheStats.String(); cacheReport != "" {
+				doneMessage += "\n" + cacheReport
+			}
+			retryReport.RecordReconnects()
+			if retries := retryReport.String(); retries != "" {
+				doneMessage += "\n" + retries
+			}
+			if prunedReport := pruned.String(); prunedReport != "" {
+				doneMessage += "\n" + prunedReport
+			}
+			deadline.Stop()
+			p.Send(render.AllDoneMsg{Message: doneMessage})
 		}()
 
-		if _, err := p.Run(); err != nil {
-			fmt.Println("Error running program:", err)
-			os.Exit(1)
+		_, runErr := p.Run()
+		if errors.Is(runErr, tea.ErrInterrupted) {
+			deadline.Cancel()
+			runErr = nil
 		}
+		// closing the connection lets a stage still waiting on the server return
+		if deadline.Expired() {
+			deadline.Cleanup()
+		}
+		<-pipelineDone
+		// a stage cut off by the deadline or Ctrl-C fails with its own error too, the timeout or Ctrl-C is what happened
+		if runErr != nil {
+			pipelineErr = utils.NewStageError("Deploy", utils.ExitCodeError, "", runErr)
+		} else if deadline.Expired() {
+			pipelineErr = deadline.Err()
+		}
+		return pipelineErr
 	},
 }
+
+func init() {
+	DeployCmd.Flags().String("image", "", "Deploy an image that is already built, like one your CI pushed, instead of building")
+	DeployCmd.Flags().Bool("image-from-registry", false, "Pull the --image on the server from its registry")
+	DeployCmd.Flags().String("ref", "", "Deploy a tag, branch or commit sha instead of the checked out tree")
+	DeployCmd.Flags().Bool("no-git", false, "Build the folder as it is without any git checks, the image is tagged after a hash of its content")
+	DeployCmd.Flags().Bool("push", false, "Push the image to the registry in sidekick.yml and pull it on your VPS instead of copying it over")
+	DeployCmd.Flags().Bool("remote-build", false, "Build the image on your VPS instead of locally, only the build context is sent over")
+	DeployCmd.Flags().Bool("scan", false, "Scan the image with trivy before it ships and stop the deploy on vulnerabilities")
+	DeployCmd.Flags().String("scan-severity", utils.DefaultScanSeverity, "Lowest severity that fails --scan: UNKNOWN, LOW, MEDIUM, HIGH or CRITICAL")
+	DeployCmd.Flags().Bool("sbom", false, "Write an SBOM of the image next to sidekick.yml with syft")
+	DeployCmd.Flags().String("sbom-format", utils.SbomFormatCycloneDX, "SBOM format: cyclonedx or spdx")
+	DeployCmd.Flags().Bool("sbom-upload", false, "Also upload the SBOM to your VPS next to the compose file")
+	DeployCmd.Flags().Bool("no-cache", false, "Build every step of the Dockerfile again instead of reusing the layers of the last build")
+	DeployCmd.Flags().String("cache-from-image", "", "Image to reuse build cache from, like the last image your CI pushed")
+	DeployCmd.Flags().String("timeout", "", "Stop the deploy and clean up when it takes longer than this, like 15m (default timeout in sidekick.yml, none)")
+	DeployCmd.Flags().Bool("force-unlock", false, "Remove the deploy lock left behind by a deploy that crashed, then exit")
+	DeployCmd.Flags().Bool("skip-preflight", false, "Skip checking there is enough free disk space here and on your VPS for the image")
+	DeployCmd.Flags().Bool("dry-run", false, "Print the compose file and the commands a deploy would run without building or touching your VPS")
+	DeployCmd.Flags().String("verify-timeout", "", "How long the app gets to answer on its URL once deployed before the deploy fails, like 5m. 0 skips the check")
+	DeployCmd.Flags().Bool("force-build", false, "Build and ship the image even when nothing changed since the last deploy")
+	DeployCmd.Flags().Bool("no-notify", false, "Deploy without telling the notification webhooks of your sidekick config and sidekick.yml")
+	DeployCmd.Flags().Bool("skip-dns-check", false, "Deploy without checking the domain points at your VPS, like when it is behind a CDN or proxy")
+	DeployCmd.Flags().Bool("no-tls", false, "Serve the app over plain HTTP for this deploy, set tls: false in sidekick.yml to keep it that way")
+	DeployCmd.Flags().Bool("staging-tls", false, "Use the Let's Encrypt staging environment for certs to avoid rate limits (certs are untrusted)")
+	DeployCmd.MarkFlagsMutuallyExclusive("image", "ref")
+	DeployCmd.MarkFlagsMutuallyExclusive("no-git", "ref")
+	DeployCmd.MarkFlagsMutuallyExclusive("image", "cache-from-image")
+	DeployCmd.MarkFlagsMutuallyExclusive("image", "no-cache")
+	DeployCmd.MarkFlagsMutuallyExclusive("no-cache", "cache-from-image")
+	DeployCmd.MarkFlagsMutuallyExclusive("image", "remote-build")
+	DeployCmd.MarkFlagsMutuallyExclusive("push", "image", "remote-build")
+}
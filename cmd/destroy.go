@@ -17,6 +17,7 @@ package cmd
 import (
 	"fmt"
 
+	"github.com/mightymoud/sidekick/utils"
 	"github.com/spf13/cobra"
 )
 
@@ -25,8 +26,8 @@ var destroyCmd = &cobra.Command{
 	Use:   "destroy",
 	Short: "A command to destroy your app on the VPS and remove the container and the images",
 	Long:  `This command is destructive and will remove everything related to your application from the VPS. Please use it with care`,
-	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("destroy called")
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return utils.NewStageError("Destroy", utils.ExitCodeError, "Run docker compose down in the app folder on the VPS to stop it for now", fmt.Errorf("destroy is not implemented yet"))
 	},
 }
 
@@ -0,0 +1,115 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package doctor
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/mightymoud/sidekick/utils"
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+)
+
+var DoctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Check what launch and deploy need on this machine and on your VPS",
+	Long: `This command checks the local tools sidekick runs, then logs in to your VPS and checks the server state
+sidekick init set up. Every check that doesn't pass comes with a suggested fix.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, err := utils.GetSidekickConfigFromCmdContext(cmd)
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Run sidekick init to set up a VPS first", err)
+		}
+		minFreeGB, _ := cmd.Flags().GetInt("min-free-disk")
+
+		checks := utils.CheckLocalPrerequisites()
+
+		// outside an app folder the current context is checked, so is the app of a sidekick.yml with problems
+		appConfig := utils.SidekickAppConfig{}
+		if content, err := os.ReadFile(utils.AppConfigFile); err == nil {
+			check := utils.CheckAppConfigFile(content)
+			checks = append(checks, check)
+			if check.Status == utils.DoctorPass {
+				appConfig, _ = utils.LoadAppConfig()
+			}
+		}
+		target, err := utils.ResolveTarget(cmd, config, appConfig.Server, utils.MetadataEnvProduction)
+		if err != nil {
+			checks = append(checks, utils.DoctorCheck{Name: "Server", Status: utils.DoctorFail, Detail: err.Error(), Fix: "Run sidekick init or pass --context"})
+			return report(cmd, checks)
+		}
+		checks = append(checks, utils.CheckServerConfig(target.Server))
+
+		sshClient, err := utils.Login(target.Server.Address, "sidekick")
+		if err != nil {
+			checks = append(checks, utils.DoctorCheck{Name: "SSH", Status: utils.DoctorFail, Detail: err.Error(), Fix: fmt.Sprintf("Check ssh sidekick@%s works and your key is loaded in ssh-agent", target.Server.Address)})
+		} else {
+			defer sshClient.Close()
+			checks = append(checks, utils.DoctorCheck{Name: "SSH", Status: utils.DoctorPass, Detail: "logged in as sidekick@" + target.Server.Address})
+			checks = append(checks, utils.CheckRemotePrerequisites(utils.SSHExecutor{Client: sshClient}, target.Server.Runtime, target.Server.NetworkName(), minFreeGB)...)
+			if appConfig.Name != "" {
+				checks = append(checks, utils.CheckAppLayout(utils.SSHExecutor{Client: sshClient}, appConfig.Name))
+			}
+		}
+		if appConfig.Url != "" {
+			checks = append(checks, utils.CheckDomainDNS(appConfig.Url, target.Server.Address))
+		}
+		return report(cmd, checks)
+	},
+}
+
+func report(cmd *cobra.Command, checks []utils.DoctorCheck) error {
+	failed := 0
+	for _, check := range checks {
+		if check.Status == utils.DoctorFail {
+			failed++
+		}
+	}
+
+	if asJSON, _ := cmd.Flags().GetBool("json"); asJSON {
+		out, err := json.MarshalIndent(checks, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+	} else {
+		for _, check := range checks {
+			line := fmt.Sprintf("%s %s", pterm.Bold.Sprint(check.Name), check.Detail)
+			switch check.Status {
+			case utils.DoctorPass:
+				pterm.Println(pterm.Green("✓ ") + line)
+			case utils.DoctorWarn:
+				pterm.Println(pterm.Yellow("! ") + line)
+			default:
+				pterm.Println(pterm.Red("✗ ") + line)
+			}
+			if check.Fix != "" {
+				pterm.Println(pterm.Gray("  " + check.Fix))
+			}
+		}
+	}
+
+	if failed > 0 {
+		return utils.NewStageError("Doctor", utils.ExitCodeError, "", fmt.Errorf("%d of %d checks failed", failed, len(checks)))
+	}
+	return nil
+}
+
+func init() {
+	DoctorCmd.Flags().Bool("json", false, "Print the checks as JSON")
+	DoctorCmd.Flags().Int("min-free-disk", utils.DefaultMinFreeDiskGB, "Free disk space in GB on the VPS below which the disk check fails")
+}
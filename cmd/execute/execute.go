@@ -0,0 +1,147 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package execute
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mightymoud/sidekick/utils"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// prefer bash when the image has it, plenty of slim images only ship sh
+const defaultShell = `sh -c 'if command -v bash > /dev/null; then exec bash; else exec sh; fi'`
+
+var ExecCmd = &cobra.Command{
+	Use:   "exec [-- command...]",
+	Short: "Open a shell or run a command inside your running app container",
+	Long: `This command runs a command inside the running container of your app through docker compose exec on your VPS.
+Without a command it opens an interactive shell. The exit code of the command becomes the exit code of sidekick, so it works in CI too.`,
+	Example: `  sidekick exec
+  sidekick exec -- bin/rails db:migrate:status
+  sidekick exec --preview a1b2c3d -- env`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, err := utils.GetSidekickConfigFromCmdContext(cmd)
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Run sidekick init to set up a VPS first", err)
+		}
+		appConfig, err := utils.LoadAppConfig()
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
+
+		dir, service, environment := appConfig.Name, appConfig.Name, utils.MetadataEnvProduction
+		previewHash, _ := cmd.Flags().GetString("preview")
+		if previewHash != "" {
+			dir, service, environment = utils.RemotePreviewDir(appConfig.Name, previewHash), fmt.Sprintf("%s-%s", appConfig.Name, previewHash), utils.MetadataEnvPreview
+		}
+		if serviceFlag, _ := cmd.Flags().GetString("service"); serviceFlag != "" {
+			service = serviceFlag
+		}
+
+		target, err := utils.ResolveTarget(cmd, config, appConfig.Server, environment)
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Check the server in sidekick.yml exists in your sidekick config", err)
+		}
+		sshClient, err := utils.Login(target.Server.Address, "sidekick")
+		if err != nil {
+			return utils.NewStageError("Exec", utils.ExitCodeRemote, "Check that the VPS is up and your SSH key is loaded in ssh-agent", err)
+		}
+		defer sshClient.Close()
+		// previews are only recorded on the server, their folder is there as long as they are
+		if previewHash != "" {
+			if _, err := utils.RunCommandOutput(sshClient, fmt.Sprintf("test -d %s", dir)); err != nil {
+				return utils.NewStageError("Preview Envs", utils.ExitCodeConfig, "Run sidekick preview list to see them", fmt.Errorf("no preview env found for %s", previewHash))
+			}
+		}
+
+		command := defaultShell
+		if len(args) > 0 {
+			command = shellJoin(args)
+		}
+		interactive := term.IsTerminal(int(os.Stdin.Fd())) && term.IsTerminal(int(os.Stdout.Fd()))
+		return runExec(sshClient, dir, service, command, interactive)
+	},
+}
+
+func runExec(sshClient *ssh.Client, dir string, service string, command string, interactive bool) error {
+	session, err := sshClient.NewSession()
+	if err != nil {
+		return utils.NewStageError("Exec", utils.ExitCodeRemote, "", err)
+	}
+	defer session.Close()
+	session.Stdin = os.Stdin
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+
+	execFlags := "-T"
+	if interactive {
+		execFlags = ""
+		fd := int(os.Stdin.Fd())
+		width, height, err := term.GetSize(fd)
+		if err != nil {
+			width, height = 80, 24
+		}
+		termType := os.Getenv("TERM")
+		if termType == "" {
+			termType = "xterm-256color"
+		}
+		modes := ssh.TerminalModes{ssh.ECHO: 1, ssh.TTY_OP_ISPEED: 14400, ssh.TTY_OP_OSPEED: 14400}
+		if err := session.RequestPty(termType, height, width, modes); err != nil {
+			return utils.NewStageError("Exec", utils.ExitCodeRemote, "", fmt.Errorf("unable to get a terminal on your VPS: %w", err))
+		}
+
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return err
+		}
+		defer term.Restore(fd, state)
+
+		stopResize := watchResize(session, fd)
+		defer stopResize()
+	}
+
+	remoteCmd := utils.RuntimeCommand(sshClient, fmt.Sprintf("cd %s && docker compose -p %s exec %s %s %s", dir, utils.ComposeProjectForDir(dir), execFlags, service, command))
+	utils.TraceCommand(remoteCmd)
+	err = session.Run(remoteCmd)
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return &utils.ExitStatusError{Code: exitErr.ExitStatus()}
+	}
+	if err != nil {
+		return utils.NewStageError("Exec", utils.ExitCodeRemote, "", err)
+	}
+	return nil
+}
+
+// shellJoin quotes every argument so it reaches the container as is
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
+
+func init() {
+	ExecCmd.Flags().String("preview", "", "Commit hash of the preview env to run in instead of production")
+	ExecCmd.Flags().String("service", "", "Compose service to run in, defaults to your app")
+	ExecCmd.RegisterFlagCompletionFunc("preview", utils.CompletePreviewHashes)
+}
@@ -0,0 +1,43 @@
+//go:build !windows
+
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package execute
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// watchResize forwards terminal size changes to the remote pty until the returned func is called
+func watchResize(session *ssh.Session, fd int) func() {
+	resize := make(chan os.Signal, 1)
+	signal.Notify(resize, syscall.SIGWINCH)
+	go func() {
+		for range resize {
+			if width, height, err := term.GetSize(fd); err == nil {
+				session.WindowChange(height, width)
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(resize)
+		close(resize)
+	}
+}
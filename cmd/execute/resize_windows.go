@@ -0,0 +1,26 @@
+//go:build windows
+
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package execute
+
+import (
+	"golang.org/x/crypto/ssh"
+)
+
+// windows has no SIGWINCH, the remote pty keeps the size it started with
+func watchResize(session *ssh.Session, fd int) func() {
+	return func() {}
+}
@@ -0,0 +1,135 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package execute
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"time"
+
+	"github.com/mightymoud/sidekick/utils"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+)
+
+var RunCmd = &cobra.Command{
+	Use:   "run -- command...",
+	Short: "Run a one-off command like a migration in a fresh container of your app",
+	Long: `This command starts a temporary container of your app with docker compose run on your VPS, with the same env as your app.
+Output streams back and the exit code of the command becomes the exit code of sidekick.
+The container is removed when the command is done, when you hit Ctrl-C or when the connection drops.`,
+	Example: `  sidekick run -- bin/rails db:migrate
+  sidekick run --image V3 -- bin/rails db:rollback
+  sidekick run --detach -- bin/rake reindex`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, err := utils.GetSidekickConfigFromCmdContext(cmd)
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Run sidekick init to set up a VPS first", err)
+		}
+		appConfig, err := utils.LoadAppConfig()
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
+		if utils.IsSwarm(appConfig) {
+			return utils.NewStageError("Run", utils.ExitCodeConfig, "", errors.New("one-off containers of a swarm stack are not supported"))
+		}
+		imageFlag, _ := cmd.Flags().GetString("image")
+		image, err := utils.RunImage(appConfig, imageFlag)
+		if err != nil {
+			return utils.NewStageError("Run", utils.ExitCodeConfig, "", err)
+		}
+		detach, _ := cmd.Flags().GetBool("detach")
+
+		target, err := utils.ResolveTarget(cmd, config, appConfig.Server, utils.MetadataEnvProduction)
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Check the server in sidekick.yml exists in your sidekick config", err)
+		}
+		if err := utils.GuardTarget(cmd, config, target, appConfig.Name); err != nil {
+			return err
+		}
+		sshClient, err := utils.Login(target.Server.Address, "sidekick")
+		if err != nil {
+			return utils.NewStageError("Run", utils.ExitCodeRemote, "Check that the VPS is up and your SSH key is loaded in ssh-agent", err)
+		}
+		defer sshClient.Close()
+
+		task := utils.RunTask{
+			Name:    utils.RunContainerName(appConfig.Name, time.Now()),
+			Image:   image,
+			Command: shellJoin(args),
+			Detach:  detach,
+		}
+		if detach {
+			if _, err := utils.RunCommandOutput(sshClient, utils.GetRunTaskCommand(appConfig, task, target.Server.SecretKey)); err != nil {
+				return utils.NewStageError("Run", utils.ExitCodeRemote, "", err)
+			}
+			fmt.Printf("Started %s in the background, it is removed once the command exits\n", task.Name)
+			fmt.Printf("Follow it with: ssh sidekick@%s docker logs -f %s\n", target.Server.Address, task.Name)
+			return nil
+		}
+		return runTask(sshClient, appConfig, task, target.Server.SecretKey)
+	},
+}
+
+func runTask(sshClient *ssh.Client, appConfig utils.SidekickAppConfig, task utils.RunTask, secretKey string) error {
+	session, err := sshClient.NewSession()
+	if err != nil {
+		return utils.NewStageError("Run", utils.ExitCodeRemote, "", err)
+	}
+	defer session.Close()
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+	// the remote side removes the container once this is closed
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return utils.NewStageError("Run", utils.ExitCodeRemote, "", err)
+	}
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+	var interrupted atomic.Bool
+	go func() {
+		if _, ok := <-interrupts; ok {
+			interrupted.Store(true)
+			fmt.Fprintf(os.Stderr, "\nStopping %s...\n", task.Name)
+			stdin.Close()
+		}
+	}()
+
+	remoteCmd := utils.RuntimeCommand(sshClient, utils.GetRunTaskCommand(appConfig, task, secretKey))
+	utils.TraceCommand(remoteCmd)
+	err = session.Run(remoteCmd)
+	if interrupted.Load() {
+		return &utils.ExitStatusError{Code: 130}
+	}
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return &utils.ExitStatusError{Code: exitErr.ExitStatus()}
+	}
+	if err != nil {
+		return utils.NewStageError("Run", utils.ExitCodeRemote, "", err)
+	}
+	return nil
+}
+
+func init() {
+	RunCmd.Flags().String("image", "", "Image to run instead of the deployed one, a tag like V3 or a full reference")
+	RunCmd.Flags().Bool("detach", false, "Start the command in the background and return right away")
+}
@@ -0,0 +1,97 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	"github.com/mightymoud/sidekick/utils"
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+)
+
+var HistoryCmd = &cobra.Command{
+	Use:   "history",
+	Short: "Show who deployed what and when",
+	Long: `This command lists the latest deploys, previews and rollbacks of the app in the current folder, newest first.
+Every run is recorded on your VPS with the commit, image, who ran it from which machine, how long it took and how it ended.
+Failed runs show the stage they stopped at.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, err := utils.GetSidekickConfigFromCmdContext(cmd)
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Run sidekick init to set up a VPS first", err)
+		}
+		appConfig, err := utils.LoadAppConfig()
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Run sidekick launch first", err)
+		}
+		target, err := utils.ResolveTarget(cmd, config, appConfig.Server, utils.MetadataEnvProduction)
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
+		limit, _ := cmd.Flags().GetInt("limit")
+		if limit < 1 {
+			return utils.NewStageError("History", utils.ExitCodeConfig, "", fmt.Errorf("--limit must be at least 1"))
+		}
+
+		sshClient, err := utils.Login(target.Server.Address, "sidekick")
+		if err != nil {
+			return utils.NewStageError("Login", utils.ExitCodeRemote, "Check that the VPS is up and your SSH key is loaded in ssh-agent", err)
+		}
+		defer sshClient.Close()
+
+		entries, err := utils.LoadHistory(utils.SSHExecutor{Client: sshClient}, appConfig.Name, limit)
+		if err != nil {
+			return utils.NewStageError("History", utils.ExitCodeRemote, "", err)
+		}
+		slices.Reverse(entries)
+
+		if asJSON, _ := cmd.Flags().GetBool("json"); asJSON {
+			out, err := json.MarshalIndent(entries, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(out))
+			return nil
+		}
+		if len(entries) == 0 {
+			pterm.Info.Printfln("Nothing deployed for %s yet", appConfig.Name)
+			return nil
+		}
+		rows := [][]string{{"Time", "Action", "Commit", "Image", "By", "Duration", "Result"}}
+		for _, entry := range entries {
+			result := entry.Result
+			if result != utils.HistoryResultSuccess {
+				result = pterm.Red(result)
+				if entry.Stage != "" {
+					result += " at " + entry.Stage
+				}
+			}
+			by := entry.User
+			if entry.Host != "" {
+				by += "@" + entry.Host
+			}
+			rows = append(rows, []string{entry.Time, entry.Action, entry.Hash, entry.Image, by, entry.Duration, result})
+		}
+		return pterm.DefaultTable.WithHasHeader().WithBoxed().WithData(rows).Render()
+	},
+}
+
+func init() {
+	HistoryCmd.Flags().IntP("limit", "n", 20, "How many of the latest entries to show")
+	HistoryCmd.Flags().Bool("json", false, "Print the history as JSON")
+}
@@ -0,0 +1,119 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package images
+
+import (
+	"fmt"
+
+	"github.com/mightymoud/sidekick/utils"
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+)
+
+var ImagesCmd = &cobra.Command{
+	Use:   "images",
+	Short: "Manage the images of your app on the VPS",
+}
+
+var pruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Remove old images of your app and dangling images from the VPS",
+	Long: `This command removes the deploy images of your app older than the newest few, like deploy does after every release, plus dangling images.
+The image production runs and the images of preview envs are never removed. Use --dry-run to see what would go.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, err := utils.GetSidekickConfigFromCmdContext(cmd)
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Run sidekick init to set up a VPS first", err)
+		}
+		appConfig, err := utils.LoadAppConfig()
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
+		target, err := utils.ResolveTarget(cmd, config, appConfig.Server, utils.MetadataEnvProduction)
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Pass --context to pick a server", err)
+		}
+		keep := utils.GetKeepImages(appConfig)
+		if cmd.Flags().Changed("keep") {
+			keep, _ = cmd.Flags().GetInt("keep")
+		}
+		if keep < 1 {
+			return utils.NewStageError("Images", utils.ExitCodeConfig, "Keep at least one image to roll back to", fmt.Errorf("--keep must be 1 or more, not %d", keep))
+		}
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		if !dryRun {
+			if err := utils.GuardTarget(cmd, config, target, appConfig.Name); err != nil {
+				return err
+			}
+			if ok, err := utils.ConfirmProduction(cmd, config, target, fmt.Sprintf("Prune the images of %s older than the newest %d → %s", appConfig.Name, keep, target.Server.Name)); !ok {
+				return err
+			}
+		}
+
+		sshClient, err := utils.Login(target.Server.Address, "sidekick")
+		if err != nil {
+			return utils.NewStageError("Login", utils.ExitCodeRemote, "Check that the VPS is up and your SSH key is loaded in ssh-agent", err)
+		}
+		defer sshClient.Close()
+		remote := utils.SSHExecutor{Client: sshClient}
+		if appConfig, err = utils.LoadAppState(remote, appConfig); err != nil {
+			return utils.NewStageError("App State", utils.ExitCodeRemote, "", err)
+		}
+		repository := utils.AppRepository(appConfig)
+
+		if dryRun {
+			remove, err := utils.ImagesToPrune(remote, repository, keep, utils.ProtectedImages(appConfig)...)
+			if err != nil {
+				return utils.NewStageError("Images", utils.ExitCodeRemote, "", err)
+			}
+			dangling, err := utils.CountDanglingImages(remote)
+			if err != nil {
+				return utils.NewStageError("Images", utils.ExitCodeRemote, "", err)
+			}
+			for _, image := range remove {
+				pterm.Println("Would remove " + image)
+			}
+			pterm.Info.Printfln("Would remove %d old images of %s, keeping the newest %d, and %d dangling images", len(remove), repository, keep, dangling)
+			return nil
+		}
+
+		result, err := utils.PruneAppImages(remote, repository, keep, utils.ProtectedImages(appConfig)...)
+		if err != nil {
+			return utils.NewStageError("Images", utils.ExitCodeRemote, "", err)
+		}
+		// PruneAppImages only cleans dangling images when it removed something
+		if len(result.Removed) == 0 {
+			if _, err := remote.Output("docker image prune -f"); err != nil {
+				return utils.NewStageError("Images", utils.ExitCodeRemote, "", fmt.Errorf("failed to remove dangling images: %w", err))
+			}
+		}
+		for _, image := range result.Removed {
+			pterm.Println("Removed " + image)
+		}
+		if summary := result.String(); summary != "" {
+			pterm.Success.Println(summary)
+		} else {
+			pterm.Success.Printfln("No old images of %s to remove, dangling images cleaned up", repository)
+		}
+		return nil
+	},
+}
+
+func init() {
+	ImagesCmd.AddCommand(pruneCmd)
+	pruneCmd.Flags().Int("keep", utils.DefaultKeepImages, "How many of the newest deploy images to keep, defaults to keepImages in sidekick.yml")
+	pruneCmd.Flags().Bool("dry-run", false, "Print what would be removed without removing anything")
+}
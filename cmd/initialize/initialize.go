@@ -15,9 +15,8 @@ limitations under the License.
 package initialize
 
 import (
+	"bytes"
 	"fmt"
-	"log"
-	"os"
 	"os/exec"
 	"strings"
 	"time"
@@ -29,6 +28,7 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v3"
 )
 
 func stage1LocalReqs() error {
@@ -58,7 +58,8 @@ func stage2Login(server string) (*ssh.Client, string, error) {
 	return nil, "", fmt.Errorf("unable to establish SSH connection")
 }
 
-func stage3UserSetup(client *ssh.Client, loggedInUser string) error {
+// stage3UserSetup adds the sidekick user, as root it also tops up the sudoers file and keys of a user there already
+func stage3UserSetup(client *ssh.Client, loggedInUser string, converge *utils.ConvergeReport) error {
 	hasSidekickUser := true
 	outChan, _, err := utils.RunCommand(client, "id -u sidekick")
 	if err != nil {
@@ -70,15 +71,20 @@ func stage3UserSetup(client *ssh.Client, loggedInUser string) error {
 		}
 	}
 
-	if !hasSidekickUser && loggedInUser == "root" {
+	if loggedInUser == "root" {
 		if err := utils.RunStage(client, utils.UsersetupStage); err != nil {
 			return err
 		}
 	}
+	if hasSidekickUser {
+		converge.InPlace("sidekick user")
+	} else {
+		converge.Changed("sidekick user created")
+	}
 	return nil
 }
 
-func stage4VPSSetup(client *ssh.Client, p *tea.Program, server *utils.SidekickServer) error {
+func stage4VPSSetup(client *ssh.Client, p *tea.Program, server *utils.SidekickServer, report *utils.RetryReport, converge *utils.ConvergeReport) error {
 	// get the linux distro
 	outChan, _, _ := utils.RunCommand(client, "grep '^ID=' /etc/os-release | awk -F'=' '{print $2}'")
 	linuxDistro := <-outChan
@@ -94,11 +100,14 @@ func stage4VPSSetup(client *ssh.Client, p *tea.Program, server *utils.SidekickSe
 		server.PlatformId = "linux/arm64"
 	}
 
-	if err := utils.RunCommandsWithTUIHook(client, utils.SetupStage.Commands, p); err != nil {
+	if err := utils.RunStageWithTUIHook(client, utils.SetupStage, p, report); err != nil {
 		return err
 	}
 
-	if server.PublicKey == "" || server.SecretKey == "" {
+	if server.PublicKey != "" && server.SecretKey != "" {
+		converge.InPlace("age keys")
+	} else {
+		converge.Changed("age keys generated")
 		cmd := exec.Command("age-keygen")
 		output, err := cmd.Output()
 		if err != nil {
@@ -117,78 +126,141 @@ func stage4VPSSetup(client *ssh.Client, p *tea.Program, server *utils.SidekickSe
 	return nil
 }
 
-func stage5Docker(client *ssh.Client, p *tea.Program) error {
-	dockerReady := false
-	outChan, _, err := utils.RunCommand(client, `command -v docker &> /dev/null && command -v docker compose &> /dev/null && echo "1" || echo "0"`)
-	if err == nil {
-		output := <-outChan
-		if output == "1" {
-			dockerReady = true
-		}
-	}
+// stage5Docker installs docker unless the server already has docker or podman, the one found is recorded on the server
+func stage5Docker(client *ssh.Client, p *tea.Program, config *utils.SidekickConfig, server *utils.SidekickServer, report *utils.RetryReport, converge *utils.ConvergeReport) error {
+	// a server set up again is looked at as it is, not through the runtime recorded last time
+	server.Runtime, server.Compose = "", ""
+	config.AddOrReplaceServer(*server)
 
-	if !dockerReady {
-		if err := utils.RunCommandsWithTUIHook(client, utils.DockerStage.Commands, p); err != nil {
+	runtime, compose, err := utils.DetectRuntime(utils.SSHExecutor{Client: client})
+	if err != nil {
+		return err
+	}
+	switch runtime {
+	case utils.RuntimePodman:
+		if err := utils.RunStageWithTUIHook(client, utils.PodmanStage, p, report); err != nil {
 			return err
 		}
+		converge.InPlace("Podman")
+	case "":
+		if err := utils.RunStageWithTUIHook(client, utils.DockerStage, p, report); err != nil {
+			return err
+		}
+		runtime = utils.RuntimeDocker
+		converge.Changed("Docker installed")
+	default:
+		converge.InPlace("Docker")
 	}
+
+	server.Runtime, server.Compose = runtime, compose
+	config.AddOrReplaceServer(*server)
 	return nil
 }
 
-func stage6Traefik(client *ssh.Client, email string, p *tea.Program) error {
-	traefikSetup := false
-	outChan, _, err := utils.RunCommand(client, `[ -d "traefik" ] && echo "1" || echo "0"`)
-	if err == nil {
-		output := <-outChan
-		if output == "1" {
-			traefikSetup = true
-		}
+// stage6Traefik creates the network and sets up Traefik unless they are there already, a stopped Traefik is started again
+func stage6Traefik(client *ssh.Client, server utils.SidekickServer, p *tea.Program, report *utils.RetryReport, converge *utils.ConvergeReport) error {
+	remote := utils.SSHExecutor{Client: client}
+	network := server.NetworkName()
+	created, err := utils.EnsureNetwork(remote, network)
+	if err != nil {
+		return err
+	}
+	if created {
+		converge.Changed("docker network " + network + " created")
+	} else {
+		converge.InPlace("docker network " + network)
 	}
 
-	if !traefikSetup {
-		traefikStage := utils.GetTraefikStage(email)
-		if err := utils.RunCommandsWithTUIHook(client, traefikStage.Commands, p); err != nil {
+	state, err := utils.TraefikState(remote)
+	if err != nil {
+		return err
+	}
+	switch state {
+	case "running":
+		converge.InPlace("Traefik")
+	case "":
+		traefikStage := utils.GetTraefikStage(server)
+		if err := utils.RunStageWithTUIHook(client, traefikStage, p, report); err != nil {
+			return err
+		}
+		converge.Changed("Traefik set up")
+	default:
+		// its config and certs are still in the traefik folder
+		if _, err := remote.Output("cd traefik && sudo docker compose -p sidekick up -d"); err != nil {
 			return err
 		}
+		converge.Changed("Traefik started, it was " + state)
 	}
 	return nil
 }
 
+func stage7Firewall(client *ssh.Client, server *utils.SidekickServer, report *utils.RetryReport) (string, error) {
+	skipped, err := utils.SetupFirewall(utils.SSHExecutor{Client: client}, utils.SSHPort, report)
+	if err != nil {
+		return "", err
+	}
+	if skipped == "" {
+		server.Firewall = utils.FirewallUfw
+	}
+	return skipped, nil
+}
+
 var InitCmd = &cobra.Command{
 	Use:   "init",
 	Short: "Init sidekick CLI and configure your VPS to host your apps",
 	Long: `This command will run you through the setup steps to get sidekick loaded on your VPS.
 		You wil need to provide your VPS IPv4 address and a registry to host your docker images.
 		`,
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		start := time.Now()
 
 		config, err := utils.GetSidekickConfigFromCmdContext(cmd)
 		if err != nil {
-			log.Fatalf("%s", err)
+			return err
 		}
 
-		skipPromptsFlag, _ := cmd.Flags().GetBool("yes")
-		server, _ := cmd.Flags().GetString("server")
+		skipPromptsFlag := utils.AssumeYes(cmd)
+		server, _ := cmd.Flags().GetString("server-address")
+		if server == "" {
+			server, _ = cmd.Flags().GetString("server")
+		}
+		sshKey, _ := cmd.Flags().GetString("ssh-key")
 		certEmail, _ := cmd.Flags().GetString("email")
 		name, _ := cmd.Flags().GetString("name")
+		secure, _ := cmd.Flags().GetBool("secure")
+		network, _ := cmd.Flags().GetString("network")
+
+		if sshKey != "" {
+			if err := utils.UseSSHKeyFile(sshKey); err != nil {
+				return utils.NewStageError("SSH key", utils.ExitCodeConfig, "Pass the path of a private key without a passphrase to --ssh-key", err)
+			}
+		}
+
+		// running init again on a server is all flags or none, its name and email are already in the config
+		if name == "" && server != "" {
+			for _, known := range config.Servers {
+				if known.Address == server {
+					name = known.Name
+					break
+				}
+			}
+		}
 
 		if name == "" {
 			randomName := namesgenerator.GetRandomName(0)
-			name = render.GenerateTextQuestion("Please enter a name for your VPS", randomName, "")
+			if skipPromptsFlag {
+				name = randomName
+			} else if name, err = utils.AskText(cmd, "name", "Please enter a name for your VPS", randomName, ""); err != nil {
+				return err
+			}
 		}
 
 		if server == "" {
-			server = render.GenerateTextQuestion("Please enter the IPv4 Address of your VPS", "", "")
-			if !utils.IsValidIPAddress(server) {
-				log.Fatalf("You entered an incorrect IP Address - %s", server)
+			if server, err = utils.AskText(cmd, "server-address", "Please enter the IPv4 Address of your VPS", "", ""); err != nil {
+				return err
 			}
-		}
-
-		if certEmail == "" {
-			certEmail = render.GenerateTextQuestion("Please enter an email for use with TLS certs", "", "")
-			if certEmail == "" {
-				log.Fatalf("An email is needed before you proceed")
+			if !utils.IsValidIPAddress(server) {
+				return utils.NewStageError("Server", utils.ExitCodeConfig, "", fmt.Errorf("you entered an incorrect IP Address - %s", server))
 			}
 		}
 
@@ -201,16 +273,44 @@ var InitCmd = &cobra.Command{
 			}
 		}
 
+		if certEmail == "" {
+			certEmail = sidekickServer.CertEmail
+		}
+		if certEmail == "" {
+			if certEmail, err = utils.AskText(cmd, "email", "Please enter an email for use with TLS certs", "", ""); err != nil {
+				return err
+			}
+			if certEmail == "" {
+				return utils.NewStageError("Email", utils.ExitCodeConfig, "", fmt.Errorf("an email is needed before you proceed"))
+			}
+		}
+
+		// what the config held before, to tell whether this run changed it
+		configBefore, _ := yaml.Marshal(config)
+
 		if sidekickServer.Name == name && sidekickServer.Address != server && sidekickServer.PublicKey != "" && !skipPromptsFlag {
-			confirm := render.GenerateTextQuestion(fmt.Sprintf("The server '%s' was previously setup with Sidekick using a different address. Would you like to overwrite the settings? (y/n)", sidekickServer.Name), "n", "")
+			if err := utils.RequireInteractive("yes", fmt.Sprintf("confirming the new address of server %s", sidekickServer.Name)); err != nil {
+				return err
+			}
+			confirm, err := render.GenerateTextQuestion(fmt.Sprintf("The server '%s' was previously setup with Sidekick using a different address. Would you like to overwrite the settings? (y/n)", sidekickServer.Name), "n", "")
+			if err != nil {
+				return err
+			}
 			if strings.ToLower(confirm) != "y" {
 				fmt.Println("\nYou can use a different server name to complete the setup")
-				os.Exit(0)
+				return nil
 			}
 		}
 
 		sidekickServer.Address = server
 		sidekickServer.CertEmail = certEmail
+		// a server set up before keeps its network unless another one is asked for
+		if network != "" {
+			if err := utils.ValidateNetworkName(network); err != nil {
+				return utils.NewStageError("Network", utils.ExitCodeConfig, "", err)
+			}
+			sidekickServer.Network = network
+		}
 
 		cmdStages := []render.Stage{
 			render.MakeStage("Setting up your local env", "Installed local requirements successfully", false),
@@ -220,8 +320,11 @@ var InitCmd = &cobra.Command{
 			render.MakeStage("Setting up Docker", "Docker setup successfully", true),
 			render.MakeStage("Setting up Traefik", "Traefik setup successfully", true),
 		}
+		if secure {
+			cmdStages = append(cmdStages, render.MakeStage("Securing VPS with a firewall", "Firewall setup successfully", false))
+		}
 
-		p := tea.NewProgram(render.TuiModel{
+		p := render.NewProgram(render.TuiModel{
 			Stages:      cmdStages,
 			BannerMsg:   "Sidekick booting up! 🚀",
 			ActiveIndex: 0,
@@ -231,9 +334,19 @@ var InitCmd = &cobra.Command{
 
 		utils.Login(server, "root")
 
+		retryReport := &utils.RetryReport{}
+		converge := &utils.ConvergeReport{}
+
+		// set before the error is sent to the TUI so it is visible once p.Run returns
+		var pipelineErr error
+		fail := func(err *utils.StageError) {
+			pipelineErr = err
+			p.Send(render.ErrorMsg{ErrorStr: err.Error()})
+		}
+
 		go func() {
 			if err := stage1LocalReqs(); err != nil {
-				p.Send(render.ErrorMsg{ErrorStr: fmt.Sprintf("Local requirements check failed: %s", err)})
+				fail(utils.NewStageError("Local requirements", utils.ExitCodeConfig, "", err))
 				return
 			}
 			time.Sleep(time.Millisecond * 100)
@@ -241,67 +354,108 @@ var InitCmd = &cobra.Command{
 
 			sshClient, loggedInUser, err := stage2Login(server)
 			if err != nil {
-				p.Send(render.ErrorMsg{ErrorStr: fmt.Sprintf("Login failed: %s", err)})
+				fail(utils.NewStageError("Logging in to VPS", utils.ExitCodeRemote, "Check that the VPS is up and your SSH key is loaded in ssh-agent", err))
 				return
 			}
 			time.Sleep(time.Millisecond * 100)
 			p.Send(render.NextStageMsg{})
 
-			if err := stage3UserSetup(sshClient, loggedInUser); err != nil {
-				p.Send(render.ErrorMsg{ErrorStr: fmt.Sprintf("User setup failed: %s", err)})
+			if err := stage3UserSetup(sshClient, loggedInUser, converge); err != nil {
+				fail(utils.NewStageError("Adding user Sidekick", utils.ExitCodeRemote, "", err))
 				return
 			}
 
 			sidekickClient, err := utils.Login(server, "sidekick")
 			if err != nil {
-				p.Send(render.ErrorMsg{ErrorStr: fmt.Sprintf("Failed to login as sidekick: %s", err)})
+				fail(utils.NewStageError("Logging in as sidekick", utils.ExitCodeRemote, "", err))
 				return
 			}
 			time.Sleep(time.Millisecond * 100)
 			p.Send(render.NextStageMsg{})
 
-			if err := stage4VPSSetup(sidekickClient, p, &sidekickServer); err != nil {
-				p.Send(render.ErrorMsg{ErrorStr: fmt.Sprintf("VPS setup failed: %s", err)})
+			if err := stage4VPSSetup(sidekickClient, p, &sidekickServer, retryReport, converge); err != nil {
+				fail(utils.NewStageError("Setting up VPS", utils.ExitCodeRemote, "", err))
 				return
 			}
 			time.Sleep(time.Millisecond * 100)
 			p.Send(render.NextStageMsg{})
 
-			if err := stage5Docker(sidekickClient, p); err != nil {
-				p.Send(render.ErrorMsg{ErrorStr: fmt.Sprintf("Docker setup failed: %s", err)})
+			if err := stage5Docker(sidekickClient, p, config, &sidekickServer, retryReport, converge); err != nil {
+				fail(utils.NewStageError("Setting up Docker", utils.ExitCodeRemote, "", err))
 				return
 			}
 			time.Sleep(time.Millisecond * 100)
 			p.Send(render.NextStageMsg{})
 
-			if err := stage6Traefik(sidekickClient, certEmail, p); err != nil {
-				p.Send(render.ErrorMsg{ErrorStr: fmt.Sprintf("Traefik setup failed: %s", err)})
+			if err := stage6Traefik(sidekickClient, sidekickServer, p, retryReport, converge); err != nil {
+				fail(utils.NewStageError("Setting up Traefik", utils.ExitCodeRemote, "", err))
 				return
 			}
 
+			firewallSkipped := ""
+			if secure {
+				time.Sleep(time.Millisecond * 100)
+				p.Send(render.NextStageMsg{})
+				firewallSkipped, err = stage7Firewall(sidekickClient, &sidekickServer, retryReport)
+				if err != nil {
+					fail(utils.NewStageError("Securing VPS with a firewall", utils.ExitCodeRemote, "Check the rules with `sidekick server firewall status` before retrying", err))
+					return
+				}
+				if firewallSkipped == "" {
+					converge.Changed("ufw firewall enabled")
+				}
+			}
+
+			if hostKey := utils.SeenHostKey(server); hostKey != "" {
+				sidekickServer.HostKey = hostKey
+			}
 			config.AddOrReplaceServer(sidekickServer)
 			newContext := utils.SidekickContext{Name: sidekickServer.Name, Server: sidekickServer.Name}
 			config.AddOrReplaceContext(newContext)
 			config.CurrentContext = newContext.Name
 
-			if err := config.Save(viper.GetString("config")); err != nil {
-				p.Send(render.ErrorMsg{ErrorStr: fmt.Sprintf("Failed to write config: %s", err)})
-				return
+			if configAfter, _ := yaml.Marshal(config); bytes.Equal(configBefore, configAfter) {
+				converge.InPlace("sidekick config")
+			} else {
+				if err := config.Save(viper.GetString("config")); err != nil {
+					fail(utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err))
+					return
+				}
+				converge.Changed("sidekick config updated")
 			}
 
-			p.Send(render.AllDoneMsg{Message: "VPS Setup Done in " + time.Since(start).Round(time.Second).String() + "," + "\n" + "Your VPS is ready! You can now run Sidekick launch in your app folder"})
+			doneMessage := "VPS Setup Done in " + time.Since(start).Round(time.Second).String() + "," + "\n" + "Your VPS is ready! You can now run Sidekick launch in your app folder"
+			doneMessage += "\n" + converge.String()
+			retryReport.RecordReconnects()
+			if retries := retryReport.String(); retries != "" {
+				doneMessage += "\n" + retries
+			}
+			if sidekickServer.Runtime == utils.RuntimePodman {
+				doneMessage += "\n" + "Found Podman, your apps will run with it"
+			}
+			if firewallSkipped != "" {
+				doneMessage += "\n" + "Firewall left untouched: " + firewallSkipped
+			}
+			p.Send(render.AllDoneMsg{Message: doneMessage})
 		}()
 
 		if _, err := p.Run(); err != nil {
-			fmt.Println("Error running program:", err)
-			os.Exit(1)
+			return fmt.Errorf("error running program: %w", err)
 		}
+		return pipelineErr
 	},
 }
 
 func init() {
-	InitCmd.Flags().StringP("server", "s", "", "Set the IP address of your Server")
+	InitCmd.Flags().StringP("server-address", "s", "", "Set the IP address of your Server")
+	InitCmd.Flags().String("ssh-key", "", "Path of the private key to log in with, instead of ssh-agent or ~/.ssh")
 	InitCmd.Flags().StringP("email", "e", "", "An email address to be used for SSL certs")
 	InitCmd.Flags().StringP("name", "n", "", "Set the name of your Server")
-	InitCmd.Flags().BoolP("yes", "y", false, "Skip all validation prompts")
+	InitCmd.Flags().BoolP("yes", "y", false, "Skip all validation prompts, a server without --name gets a random one")
+	InitCmd.Flags().Bool("secure", false, "Enable a ufw firewall that only allows SSH, HTTP and HTTPS")
+	InitCmd.Flags().String("network", "", "Docker network Traefik and your apps share, for a server that already has a network named sidekick (default sidekick)")
+	InitCmd.Flags().String("server", "", "Set the IP address of your Server")
+	InitCmd.Flags().MarkDeprecated("server", "use --server-address instead")
+	InitCmd.RegisterFlagCompletionFunc("server-address", utils.CompleteServerAddresses)
+	InitCmd.RegisterFlagCompletionFunc("name", utils.CompleteServers)
 }
@@ -15,11 +15,12 @@ limitations under the License.
 package launch
 
 import (
-	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
+	"path"
 	"strconv"
 	"strings"
 	"time"
@@ -53,29 +54,30 @@ func getDockerClient() (*client.Client, error) {
 	return cli, nil
 }
 
-func prelude(server *utils.SidekickServer) string {
+func prelude(server *utils.SidekickServer, staticDir string) (string, error) {
 	if server.SecretKey == "" {
-		render.GetLogger(log.Options{Prefix: "Backward Compat"}).Error("Recent changes to how Sidekick handles secrets prevents you from launcing a new application.")
-		render.GetLogger(log.Options{Prefix: "Backward Compat"}).Info("To fix this, run `Sidekick init` with the same server address you have now.")
-		render.GetLogger(log.Options{Prefix: "Backward Compat"}).Info("Learn more at www.sidekickdeploy.com/docs/design/encryption")
-		os.Exit(1)
+		return "", utils.NewStageError("Backward Compat", utils.ExitCodeConfig,
+			"Run `Sidekick init` with the same server address you have now. Learn more at www.sidekickdeploy.com/docs/design/encryption",
+			errors.New("recent changes to how Sidekick handles secrets prevents you from launching a new application"))
 	}
 
-	if utils.FileExists("./sidekick.yml") {
-		render.GetLogger(log.Options{Prefix: "Sidekick Setup"}).Error("Sidekick config exists in this project.")
-		render.GetLogger(log.Options{Prefix: "Sidekick Setup"}).Info("You can deploy a new version of your application with Sidekick deploy.")
-		os.Exit(1)
+	// a static site gets its Dockerfile from sidekick and nginx always listens on the same port
+	if staticDir != "" {
+		if err := utils.ValidateStaticDir(staticDir); err != nil {
+			return "", utils.NewStageError("Static Site", utils.ExitCodeConfig, "Pass the folder with your built site, like --static dist", err)
+		}
+		render.GetLogger(log.Options{Prefix: "Static Site"}).Infof("Serving %s with nginx", staticDir)
+		return fmt.Sprint(utils.StaticPort), nil
 	}
 
-	if utils.FileExists("./Dockerfile") {
-		render.GetLogger(log.Options{Prefix: "Dockerfile"}).Info("Detected - scanning file for details")
-	} else {
-		render.GetLogger(log.Options{Prefix: "Dockerfile"}).Fatal("No dockerfile found in current directory.")
+	if !utils.FileExists("./Dockerfile") {
+		return "", utils.NewStageError("Dockerfile", utils.ExitCodeConfig, "Add a Dockerfile that builds and runs your app, then run launch again", errors.New("no dockerfile found in current directory"))
 	}
+	render.GetLogger(log.Options{Prefix: "Dockerfile"}).Info("Detected - scanning file for details")
 
 	res, err := os.ReadFile("./Dockerfile")
 	if err != nil {
-		render.GetLogger(log.Options{Prefix: "Dockerfile"}).Fatal("Unable to process your dockerfile")
+		return "", utils.NewStageError("Dockerfile", utils.ExitCodeConfig, "", fmt.Errorf("unable to process your dockerfile: %w", err))
 	}
 
 	appPort := ""
@@ -84,7 +86,7 @@ func prelude(server *utils.SidekickServer) string {
 			appPort = strings.TrimPrefix(line, "EXPOSE ")
 		}
 	}
-	return appPort
+	return appPort, nil
 }
 
 func stage1(server *utils.SidekickServer) (*ssh.Client, error) {
@@ -92,7 +94,7 @@ func stage1(server *utils.SidekickServer) (*ssh.Client, error) {
 	return sshClient, err
 }
 
-func stage2(appName string, p *tea.Program, server *utils.SidekickServer) error {
+func stage2(image string, p *tea.Program, server *utils.SidekickServer) error {
 	cwd, _ := os.Getwd()
 	cwdTar, err := utils.TarDirectoryToReader(cwd)
 	if err != nil {
@@ -104,9 +106,9 @@ func stage2(appName string, p *tea.Program, server *utils.SidekickServer) error
 		return err
 	}
 
-	ctx := context.Background()
+	ctx := utils.OperationContext()
 	resp, err := dockerClient.ImageBuild(ctx, cwdTar, build.ImageBuildOptions{
-		Tags:     []string{fmt.Sprintf("%s:latest", appName)},
+		Tags:     []string{image},
 		Platform: server.PlatformId,
 	})
 	if err != nil {
@@ -118,9 +120,34 @@ func stage2(appName string, p *tea.Program, server *utils.SidekickServer) error
 	return nil
 }
 
-func stage3(appName string, p *tea.Program) error {
-	ctx := context.Background()
-	imageReader, err := dockerClient.ImageSave(ctx, []string{fmt.Sprintf("%s:latest", appName)})
+// stage2Remote replaces the local build, save and move stages when building on the VPS
+func stage2Remote(sshClient *ssh.Client, appName string, image string, p *tea.Program, server *utils.SidekickServer) *utils.StageError {
+	stage := "Building docker image on your server"
+	if _, err := utils.BootstrapRemoteLayout(utils.SSHExecutor{Client: sshClient}, appName); err != nil {
+		return utils.NewStageError(stage, utils.ExitCodeRemote, "", err)
+	}
+	cwd, _ := os.Getwd()
+	if err := utils.RemoteBuildWithTUIHook(sshClient, *server, image, utils.BuildCache{}, cwd, p); err != nil {
+		return utils.NewStageError(stage, utils.ExitCodeBuild, "Make sure your Dockerfile builds and the VPS has enough free disk space", err)
+	}
+	return nil
+}
+
+// stage2Static sends the static site to the VPS and builds its nginx image there, there is nothing to build locally
+func stage2Static(sshClient *ssh.Client, appConfig utils.SidekickAppConfig, image string, p *tea.Program, server *utils.SidekickServer) *utils.StageError {
+	stage := "Building your static site on your server"
+	if _, err := utils.BootstrapRemoteLayout(utils.SSHExecutor{Client: sshClient}, appConfig.Name); err != nil {
+		return utils.NewStageError(stage, utils.ExitCodeRemote, "", err)
+	}
+	if err := utils.StaticBuildWithTUIHook(sshClient, *server, image, appConfig.Static, p); err != nil {
+		return utils.NewStageError(stage, utils.ExitCodeBuild, "Check the VPS can pull nginx:alpine and has enough free disk space", err)
+	}
+	return nil
+}
+
+func stage3(appName string, image string, p *tea.Program) error {
+	ctx := utils.OperationContext()
+	imageReader, err := dockerClient.ImageSave(ctx, []string{image})
 	if err != nil {
 		return err
 	}
@@ -140,48 +167,52 @@ func stage3(appName string, p *tea.Program) error {
 	return nil
 }
 
-func stage4(sshClient *ssh.Client, appName string, p *tea.Program, server *utils.SidekickServer) error {
-	_, _, sessionErr := utils.RunCommand(sshClient, fmt.Sprintf("mkdir %s", appName))
-	if sessionErr != nil {
-		p.Send(render.ErrorMsg{ErrorStr: sessionErr.Error()})
+// stage4 tells a failed transfer apart from the VPS failing, CI pipelines retry on the first
+func stage4(sshClient *ssh.Client, appName string, p *tea.Program) *utils.StageError {
+	stage := "Moving image to your server"
+	if _, err := utils.BootstrapRemoteLayout(utils.SSHExecutor{Client: sshClient}, appName); err != nil {
+		return utils.NewStageError(stage, utils.ExitCodeRemote, "", err)
 	}
 	imgFileName := fmt.Sprintf("%s-latest.tar", appName)
-	remoteDist := fmt.Sprintf("%s@%s:./%s", "sidekick", server.Address, appName)
-	imgMoveCmd := exec.Command("scp", "-C", imgFileName, remoteDist)
-	imgMoveCmdErrorPipe, _ := imgMoveCmd.StderrPipe()
-	go render.SendLogsToTUI(imgMoveCmdErrorPipe, p)
-
-	if imgMovCmdErr := imgMoveCmd.Run(); imgMovCmdErr != nil {
-		return imgMovCmdErr
+	transfer, imgMovCmdErr := utils.MoveImageTar(sshClient, imgFileName, path.Join(appName, imgFileName), utils.TransferProgressToTUI(p))
+	if imgMovCmdErr != nil {
+		return utils.NewStageError(stage, utils.ExitCodeTransfer, "Check the VPS has enough free disk space and run launch again", imgMovCmdErr)
 	}
-	defer os.Remove(imgFileName)
+	p.Send(render.LogMsg{LogLine: transfer.String() + "\n"})
 	dockerLoadOutChan, _, sessionErr := utils.RunCommand(sshClient, fmt.Sprintf("cd %s && docker load -i %s && rm %s", appName, imgFileName, imgFileName))
+	if sessionErr != nil {
+		return utils.NewStageError(stage, utils.ExitCodeRemote, "", sessionErr)
+	}
 	go func() {
 		p.Send(render.LogMsg{LogLine: <-dockerLoadOutChan + "\n"})
 		time.Sleep(time.Millisecond * 50)
 	}()
-	if sessionErr != nil {
-		time.Sleep(time.Millisecond * 100)
-		p.Send(render.ErrorMsg{ErrorStr: sessionErr.Error()})
-	}
 	return nil
 }
 
-func stage5(sshClient *ssh.Client, appName string, appPort string, appDomain string, hasEnvFile bool, envFileName string, envFileChecksum string, p *tea.Program, server *utils.SidekickServer) error {
-	rsyncCmd := exec.Command("rsync", "docker-compose.yaml", fmt.Sprintf("%s@%s:%s", "sidekick", server.Address, fmt.Sprintf("./%s", appName)))
+func stage5(sshClient *ssh.Client, appConfig utils.SidekickAppConfig, hasEnvFile bool, p *tea.Program, server *utils.SidekickServer) error {
+	appName := appConfig.Name
+	if utils.HasCustomCert(appConfig) {
+		if err := utils.UploadCustomCert(sshClient, *server, appConfig); err != nil {
+			return err
+		}
+	}
+	rsyncCmd := utils.OperationCommand("rsync", "docker-compose.yaml", fmt.Sprintf("%s@%s:%s", "sidekick", server.Address, fmt.Sprintf("./%s", appName)))
+	utils.TraceExec(rsyncCmd)
 	rsyncCmErr := rsyncCmd.Run()
 	if rsyncCmErr != nil {
 		return rsyncCmErr
 	}
 
 	if hasEnvFile {
-		encryptSync := exec.Command("rsync", "encrypted.env", fmt.Sprintf("%s@%s:%s", "sidekick", server.Address, fmt.Sprintf("./%s", appName)))
+		encryptSync := utils.OperationCommand("rsync", "encrypted.env", fmt.Sprintf("%s@%s:%s", "sidekick", server.Address, fmt.Sprintf("./%s", appName)))
+		utils.TraceExec(encryptSync)
 		encryptSyncErr := encryptSync.Run()
 		if encryptSyncErr != nil {
 			return encryptSyncErr
 		}
 
-		runAppCmdOutChan, _, sessionErr1 := utils.RunCommand(sshClient, fmt.Sprintf(`cd %s && export SOPS_AGE_KEY=%s && sops exec-env encrypted.env 'docker compose -p sidekick up -d'`, appName, server.SecretKey))
+		runAppCmdOutChan, _, sessionErr1 := utils.RunCommand(sshClient, utils.GetUpCommand(appConfig, appName, true, server.SecretKey))
 		go func() {
 			p.Send(render.LogMsg{LogLine: <-runAppCmdOutChan + "\n"})
 			time.Sleep(time.Millisecond * 50)
@@ -190,7 +221,7 @@ func stage5(sshClient *ssh.Client, appName string, appPort string, appDomain str
 			return sessionErr1
 		}
 	} else {
-		runAppCmdOutChan, _, sessionErr1 := utils.RunCommand(sshClient, fmt.Sprintf(`cd %s && docker compose -p sidekick up -d`, appName))
+		runAppCmdOutChan, _, sessionErr1 := utils.RunCommand(sshClient, utils.GetUpCommand(appConfig, appName, false, server.SecretKey))
 		go func() {
 			p.Send(render.LogMsg{LogLine: <-runAppCmdOutChan + "\n"})
 			time.Sleep(time.Millisecond * 50)
@@ -200,139 +231,420 @@ func stage5(sshClient *ssh.Client, appName string, appPort string, appDomain str
 		}
 	}
 
-	portNumber, err := strconv.ParseUint(appPort, 0, 64)
+	// save app config in same folder
+	if appConfig.CreatedAt == "" {
+		appConfig.CreatedAt = time.Now().Format(time.UnixDate)
+	}
+	// a relaunch keeps the version and previews the server knows about
+	remote := utils.SSHExecutor{Client: sshClient}
+	deployed, err := utils.LoadAppState(remote, appConfig)
 	if err != nil {
 		return err
 	}
-	envConfig := utils.SidekickAppEnvConfig{}
+	appConfig.PreviewEnvs, appConfig.StateRevision = deployed.PreviewEnvs, deployed.StateRevision
+	if deployed.Version != "" {
+		appConfig.Version = deployed.Version
+	}
+	appConfig.LastDeployedAt = time.Now().Format(time.UnixDate)
+	appConfig.LastDeployedCommit, _ = utils.GetGitShortHash()
+	appConfig.DeployedVersion, _ = utils.ResolveAppVersion(nil)
+	if err := utils.SaveAppState(remote, &appConfig); err != nil {
+		return err
+	}
+	if err := utils.SaveAppInfo(remote, appConfig); err != nil {
+		return err
+	}
+	if err := utils.SaveAppConfig(appConfig); err != nil {
+		return err
+	}
+
+	return utils.VerifyServicesHealthWithTUIHook(sshClient, appName, appConfig, p)
+}
+
+// getLaunchPlan lists what a launch would do, in the order the stages do it
+func getLaunchPlan(appConfig utils.SidekickAppConfig, target utils.Target, composeFile utils.DockerComposeFile, hasEnvFile bool, remoteBuild bool, checkDNS bool, verifyTimeout time.Duration) (utils.DryRunPlan, error) {
+	server := target.Server
+	appName := appConfig.Name
+	remoteDir := fmt.Sprintf("%s@%s:./%s", "sidekick", server.Address, appName)
+	imgFileName := fmt.Sprintf("%s-latest.tar", appName)
+	image := composeFile.Services[appName].Image
+	plan := utils.DryRunPlan{Target: target, Image: image, EnvFile: appConfig.Env.File, EnvChanged: hasEnvFile, ComposeFile: composeFile}
+
+	if checkDNS {
+		plan.Local(utils.DNSCheckStep(appConfig.Url, server.Address))
+	}
+	plan.Remote(utils.RouteConflictsStep(appName, appConfig.Url))
 	if hasEnvFile {
-		envConfig.File = envFileName
-		envConfig.Hash = envFileChecksum
+		plan.Local(fmt.Sprintf("sops encrypt --output-type dotenv --age %s ./%s > encrypted.env", server.PublicKey, appConfig.Env.File))
+	}
+	if utils.IsStatic(appConfig) {
+		plan.Remote(utils.RemoteLayoutStep(appName))
+		plan.Remote("mktemp -d /tmp/sidekick-build-XXXXXX")
+		rsyncArgs, err := utils.GetSyncBuildContextArgs(server, appConfig.Static, "<remote tmp>")
+		if err != nil {
+			return plan, err
+		}
+		plan.Local("rsync " + strings.Join(rsyncArgs, " "))
+		plan.Remote(utils.GetStaticRemoteBuildCommand(image, server, "<remote tmp>"))
+		plan.Remote("rm -rf <remote tmp>")
+	} else if remoteBuild {
+		plan.Remote(utils.RemoteLayoutStep(appName))
+		plan.Remote("mktemp -d /tmp/sidekick-build-XXXXXX")
+		rsyncArgs, err := utils.GetSyncBuildContextArgs(server, ".", "<remote tmp>")
+		if err != nil {
+			return plan, err
+		}
+		plan.Local("rsync " + strings.Join(rsyncArgs, " "))
+		plan.Remote(utils.GetRemoteBuildCommand(appName, server, utils.BuildCache{}, "<remote tmp>"))
+		plan.Remote("rm -rf <remote tmp>")
+	} else {
+		plan.Local(fmt.Sprintf("docker build --tag %s --platform %s .", image, server.PlatformId))
+		plan.Local(fmt.Sprintf("docker save %s > %s", image, imgFileName))
+		plan.Remote(utils.RemoteLayoutStep(appName))
+		plan.Local(fmt.Sprintf("send %s to %s in gzipped chunks of %s over ssh", imgFileName, remoteDir, utils.FormatBytes(utils.ImageChunkSize)))
+		plan.Remote(fmt.Sprintf("cd %s && docker load -i %s && rm %s", appName, imgFileName, imgFileName))
+	}
+	if utils.HasCustomCert(appConfig) {
+		plan.Local(fmt.Sprintf("rsync --chmod=F600 %s %s %s@%s:%s/", appConfig.TLS.Cert, appConfig.TLS.Key, "sidekick", server.Address, utils.RemoteCertsDir))
+		plan.Remote(fmt.Sprintf("write %s/%s.yml", utils.RemoteDynamicDir, appName))
+	}
+	plan.Local(fmt.Sprintf("rsync docker-compose.yaml %s", remoteDir))
+	if hasEnvFile {
+		plan.Local(fmt.Sprintf("rsync encrypted.env %s", remoteDir))
+	}
+	plan.Remote(utils.GetUpCommand(appConfig, appName, hasEnvFile, server.SecretKey))
+	plan.Remote(fmt.Sprintf("write %s and %s", utils.RemoteStateFile(appName), utils.RemoteAppInfoFile(appName)))
+	plan.Remote(fmt.Sprintf("cd %s && docker compose -p %s ps - wait for every service to be healthy", appName, utils.ComposeProject(appName, "")))
+	if verifyTimeout > 0 {
+		plan.Local(utils.VerifyStep(utils.VerifyURL(appConfig, appConfig.Url), verifyTimeout))
+	}
+	return plan, nil
+}
+
+// selectTarget asks for the VPS unless --context names one, launch can move an app so the pin is only the default answer
+func selectTarget(cmd *cobra.Command, config *utils.SidekickConfig, pinnedServer string) (utils.Target, error) {
+	if flagContext, _ := cmd.Flags().GetString("context"); flagContext != "" {
+		target, err := utils.ResolveTarget(cmd, config, "", utils.MetadataEnvProduction)
+		if err != nil {
+			return target, utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Check the servers and contexts in your sidekick config", err)
+		}
+		return target, nil
+	}
+
+	if err := utils.RequireInteractive("context", "the VPS to launch on"); err != nil {
+		return utils.Target{}, err
+	}
+	var selectedCtx utils.SidekickContext
+	options := make([]huh.Option[utils.SidekickContext], 0, len(config.Contexts))
+	for _, c := range config.Contexts {
+		server, err := config.FindServer(c.Server)
+		if err != nil {
+			return utils.Target{}, utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Check the servers and contexts in your sidekick config", err)
+		}
+		if pinnedServer != "" && c.Server == pinnedServer {
+			selectedCtx = c
+		}
+		options = append(options, huh.NewOption(fmt.Sprintf("%s (%s)", server.Name, server.Address), c))
+	}
+	form := huh.NewForm(
+		huh.NewGroup(
+			huh.NewSelect[utils.SidekickContext]().
+				Title("Select a VPS").
+				Options(options...).
+				Value(&selectedCtx),
+		),
+	)
+	if err := form.Run(); err != nil {
+		return utils.Target{}, utils.NewStageError("Context Selection", utils.ExitCodeError, "", err)
+	}
+
+	server, err := config.FindServerByContext(selectedCtx.Name)
+	if err != nil {
+		return utils.Target{}, utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Check the servers and contexts in your sidekick config", err)
+	}
+	return utils.Target{Context: selectedCtx.Name, Server: server, Environment: utils.MetadataEnvProduction, SelectedBy: utils.TargetSelectedByPrompt}, nil
+}
+
+// checkAppName makes sure launch does not clobber another app on the VPS, it runs before anything is built
+func checkAppName(cmd *cobra.Command, server utils.SidekickServer, appName string, existingConfig utils.SidekickAppConfig) (string, error) {
+	force, _ := cmd.Flags().GetBool("force")
+	// reconfiguring an app launched from this folder is expected to find it
+	if force || (appName == existingConfig.Name && server.Name == existingConfig.Server) {
+		return appName, nil
+	}
+	sshClient, err := utils.Login(server.Address, "sidekick")
+	if err != nil {
+		return "", utils.NewStageError("App Name", utils.ExitCodeRemote, "Check that the VPS is up and your SSH key is loaded in ssh-agent", err)
+	}
+	defer sshClient.Close()
+
+	for {
+		exists, err := utils.RemoteAppExists(utils.SSHExecutor{Client: sshClient}, appName)
+		if err != nil {
+			return "", utils.NewStageError("App Name", utils.ExitCodeRemote, "", err)
+		}
+		if !exists {
+			return appName, nil
+		}
+		if !render.IsInteractive() {
+			return "", utils.NewStageError("App Name", utils.ExitCodeConfig, "Pick another --name, or pass --force to overwrite it",
+				fmt.Errorf("an app named %s already exists on %s", appName, server.Name))
+		}
+		render.GetLogger(log.Options{Prefix: "App Name"}).Warnf("An app named %s already exists on %s - pick another name or run launch again with --force to overwrite it", appName, server.Name)
+		appName, err = render.GenerateTextQuestion("Please enter a different app name", "", "will identify your app containers")
+		if err != nil {
+			return "", err
+		}
+		if appName == "" {
+			return "", utils.NewStageError("App Name", utils.ExitCodeConfig, "", errors.New("the app name can't be empty"))
+		}
 	}
-	// save app config in same folder
-	sidekickAppConfig := utils.SidekickAppConfig{
-		Name:      appName,
-		Version:   "V1",
-		Port:      portNumber,
-		Url:       appDomain,
-		CreatedAt: time.Now().Format(time.UnixDate),
-		Env:       envConfig,
-		Server:    server.Name,
-	}
-	ymlData, _ := yaml.Marshal(&sidekickAppConfig)
-	os.WriteFile("./sidekick.yml", ymlData, 0644)
-	return nil
 }
 
 var LaunchCmd = &cobra.Command{
 	Use:   "launch",
 	Short: "Launch a new application to host on your VPS with Sidekick",
 	Long:  `This command will run you through the basic setup to add a new application to your VPS.`,
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		start := time.Now()
 
 		config, err := utils.GetSidekickConfigFromCmdContext(cmd)
 		if err != nil {
-			render.GetLogger(log.Options{Prefix: "Sidekick Config"}).Fatalf("%s", err)
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Run sidekick init to set up a VPS first", err)
 		}
-		var selectedCtx utils.SidekickContext
-		options := make([]huh.Option[utils.SidekickContext], 0, len(config.Contexts))
-		for _, c := range config.Contexts {
-			server, err := config.FindServer(c.Server)
-			if err != nil {
-				render.GetLogger(log.Options{Prefix: "Sidekick Config"}).Fatalf("%s", err)
+
+		// launching in a configured project turns into a reconfigure - current values become the defaults
+		existingConfig := utils.SidekickAppConfig{}
+		if utils.FileExists(utils.AppConfigFile) {
+			existingConfig, err = utils.LoadAppConfig()
+			if errors.Is(err, utils.ErrAppNotInConfig) {
+				// a new app for the apps map, named after its key unless the answer says otherwise
+				existingConfig = utils.SidekickAppConfig{Name: utils.AppConfigApp}
+			} else {
+				noOverwrite, _ := cmd.Flags().GetBool("no-overwrite")
+				if noOverwrite {
+					return utils.NewStageError("Sidekick Setup", utils.ExitCodeConfig,
+						"Edit sidekick.yml directly or deploy a new version of your application with Sidekick deploy.",
+						errors.New("sidekick config exists in this project"))
+				}
+				if err != nil {
+					return utils.NewStageError("Sidekick Setup", utils.ExitCodeConfig, "Fix or remove sidekick.yml and run launch again", err)
+				}
+				render.GetLogger(log.Options{Prefix: "Sidekick Setup"}).Info("Existing sidekick.yml found - reconfiguring, anything you don't change is kept")
 			}
-			options = append(options, huh.NewOption(fmt.Sprintf("%s (%s)", server.Name, server.Address), c))
-		}
-		form := huh.NewForm(
-			huh.NewGroup(
-				huh.NewSelect[utils.SidekickContext]().
-					Title("Select a VPS").
-					Options(options...).
-					Value(&selectedCtx),
-			),
-		)
-		err = form.Run()
+		}
 
+		target, err := selectTarget(cmd, config, existingConfig.Server)
 		if err != nil {
-			render.GetLogger(log.Options{Prefix: "Context Selection"}).Fatalf("%s", err)
+			return err
 		}
+		utils.PrintTarget(target)
+		sidekickServer := target.Server
 
-		sidekickServer, err := config.FindServerByContext(selectedCtx.Name)
+		staticDir, _ := cmd.Flags().GetString("static")
+		if staticDir == "" {
+			staticDir = existingConfig.Static
+		}
+		appPort, err := prelude(&sidekickServer, staticDir)
 		if err != nil {
-			render.GetLogger(log.Options{Prefix: "Sidekick Config"}).Fatalf("%s", err)
+			return err
+		}
+		if existingConfig.Port != 0 && staticDir == "" {
+			appPort = fmt.Sprint(existingConfig.Port)
+		}
+		defaultEnvFile := ".env"
+		if existingConfig.Env.File != "" {
+			defaultEnvFile = existingConfig.Env.File
 		}
 
-		appPort := prelude(&sidekickServer)
-
-		appName := render.GenerateTextQuestion("Please enter your app url friendly app name", "", "will identify your app containers")
-		appPort = render.GenerateTextQuestion("Please enter the port at which the app receives request", appPort, "")
-		appDomain := render.GenerateTextQuestion("Please enter the domain to point the app to", fmt.Sprintf("%s.%s.sslip.io", appName, sidekickServer.Address), "must point to your VPS address")
-		envFileName := render.GenerateTextQuestion("Please enter which env file you would like to load", ".env", "")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		remoteBuild, _ := cmd.Flags().GetBool("remote-build")
+		appName, err := utils.AskText(cmd, "name", "Please enter your app url friendly app name", existingConfig.Name, "will identify your app containers")
+		if err != nil {
+			return err
+		}
+		// a bad name only breaks later, in an image tag, a router or a subdomain
+		if err := utils.ValidateAppName(appName); err != nil {
+			if appName, err = utils.ConfirmNormalized(cmd, "name", utils.NormalizeAppName(appName), err); err != nil {
+				return err
+			}
+		}
+		if !dryRun {
+			appName, err = checkAppName(cmd, sidekickServer, appName, existingConfig)
+			if err != nil {
+				return err
+			}
+			if err := utils.ConfirmTarget(cmd, config, target, appName); err != nil {
+				return err
+			}
+			if err := utils.RecordAudit(cmd, target, appName); err != nil {
+				render.GetLogger(log.Options{Prefix: "Audit Log"}).Warnf("Unable to write the audit log: %s", err)
+			}
+		}
+		if staticDir == "" {
+			appPort, err = utils.AskText(cmd, "port", "Please enter the port at which the app receives request", appPort, "")
+			if err != nil {
+				return err
+			}
+		}
+		defaultDomain := existingConfig.Url
+		if defaultDomain == "" {
+			defaultDomain = fmt.Sprintf("%s.%s.sslip.io", appName, sidekickServer.Address)
+		}
+		appDomain, err := utils.AskText(cmd, "domain", "Please enter the domain to point the app to", defaultDomain, "must point to your VPS address")
+		if err != nil {
+			return err
+		}
+		if normalized := utils.NormalizeDomain(appDomain); normalized != appDomain {
+			render.GetLogger(log.Options{Prefix: "Domain"}).Infof("Using %s for %s", normalized, appDomain)
+			appDomain = normalized
+		}
+		if err := utils.ValidateDomain(appDomain); err != nil {
+			return utils.NewStageError("Domain", utils.ExitCodeConfig, "Pass a domain like app.example.com", err)
+		}
+		envFileName, err := utils.AskText(cmd, "env-file", "Please enter which env file you would like to load", defaultEnvFile, "")
+		if err != nil {
+			return err
+		}
 
 		hasEnvFile := false
 		dockerEnvProperty := []string{}
 		envFileChecksum := ""
-		if utils.FileExists(fmt.Sprintf("./%s", envFileName)) {
+		if utils.FileExists(fmt.Sprintf("./%s", envFileName)) && dryRun {
+			hasEnvFile = true
+			envProperty, err := utils.GetDockerEnvProperty(envFileName)
+			if err != nil {
+				return utils.NewStageError("Env File", utils.ExitCodeConfig, "Make sure the env file is valid dotenv", err)
+			}
+			dockerEnvProperty = envProperty
+		} else if utils.FileExists(fmt.Sprintf("./%s", envFileName)) {
 			hasEnvFile = true
 			render.GetLogger(log.Options{Prefix: "Env File"}).Infof("Detected - Loading env vars from %s", envFileName)
+			defer os.Remove("encrypted.env")
 			envHandleErr := utils.HandleEnvFile(envFileName, &dockerEnvProperty, &envFileChecksum, sidekickServer.PublicKey)
 			if envHandleErr != nil {
-				render.GetLogger(log.Options{Prefix: "Env File"}).Fatalf("Something went wrong %s", envHandleErr)
+				return utils.NewStageError("Env File", utils.ExitCodeConfig, "Make sure sops is installed and the env file is valid dotenv", envHandleErr)
 			}
-			defer os.Remove("encrypted.env")
 		} else {
 			render.GetLogger(log.Options{Prefix: "Env File"}).Info("Not Detected - Skipping env parsing")
 		}
 
+		portNumber, err := strconv.ParseUint(appPort, 0, 64)
+		if err != nil {
+			return utils.NewStageError("App Port", utils.ExitCodeConfig, "The port must be a number like 3000", fmt.Errorf("invalid port %s: %w", appPort, err))
+		}
+		envConfig := utils.SidekickAppEnvConfig{}
+		if hasEnvFile {
+			envConfig.File = envFileName
+			envConfig.Hash = envFileChecksum
+		}
+		appConfig := existingConfig
+		appConfig.Name = appName
+		appConfig.Port = portNumber
+		appConfig.Url = appDomain
+		appConfig.Env = envConfig
+		appConfig.Server = sidekickServer.Name
+		appConfig.Network = sidekickServer.NetworkName()
+		appConfig.Static = staticDir
+		// a fresh launch has no sidekick.yml to load the override along with
+		if appConfig.ComposeOverride, err = utils.LoadComposeOverride(); err != nil {
+			return utils.NewStageError("Compose Override", utils.ExitCodeConfig, "", err)
+		}
+		if appConfig.Version == "" {
+			appConfig.Version = "V1"
+		}
+		if cmd.Flags().Changed("staging-tls") {
+			appConfig.StagingTLS, _ = cmd.Flags().GetBool("staging-tls")
+		}
+		tlsCert, _ := cmd.Flags().GetString("tls-cert")
+		tlsKey, _ := cmd.Flags().GetString("tls-key")
+		if tlsCert != "" || tlsKey != "" {
+			if tlsCert == "" || tlsKey == "" {
+				return utils.NewStageError("TLS", utils.ExitCodeConfig, "", errors.New("--tls-cert and --tls-key must be used together"))
+			}
+			if _, err := tls.LoadX509KeyPair(tlsCert, tlsKey); err != nil {
+				return utils.NewStageError("TLS", utils.ExitCodeConfig, "Both files must be PEM encoded and the key must match the certificate", fmt.Errorf("unable to load the custom certificate: %w", err))
+			}
+			appConfig.TLS = utils.SidekickAppTLSConfig{Cert: tlsCert, Key: tlsKey}
+		}
+		if noTLS, _ := cmd.Flags().GetBool("no-tls"); noTLS {
+			appConfig.TLS.Disabled = true
+		}
+		labels, _ := cmd.Flags().GetStringArray("label")
+		appConfig.Labels = append(appConfig.Labels, labels...)
+		if utils.HasCustomCert(appConfig) {
+			render.GetLogger(log.Options{Prefix: "TLS"}).Infof("Using the custom certificate %s - renewing it is up to you", appConfig.TLS.Cert)
+		}
+		if !utils.TLSEnabled(appConfig) {
+			render.GetLogger(log.Options{Prefix: "TLS"}).Warnf("Serving the app over plain HTTP on the %s entrypoint", utils.GetEntrypoint(appConfig))
+		}
+		// a sidekick.yml that fails to load later is caught before anything is built
+		if problems := utils.ValidateAppConfig(appConfig, false); len(problems) > 0 {
+			return utils.NewStageError("Sidekick Setup", utils.ExitCodeConfig, "Run launch again with valid answers", &utils.ConfigProblemsError{Problems: problems})
+		}
+		stagingTLS := appConfig.StagingTLS && utils.GetCertResolver(appConfig) != ""
+		if stagingTLS {
+			render.GetLogger(log.Options{Prefix: "TLS"}).Warn("Using the Let's Encrypt staging resolver - browsers will not trust the certificate for this app")
+		}
+
 		// make a docker service
-		imageName := appName
-		newService := utils.DockerService{
-			Image:   imageName,
-			Restart: "unless-stopped",
-			Labels: []string{
-				"traefik.enable=true",
-				fmt.Sprintf("traefik.http.routers.%s.rule=Host(`%s`)", appName, appDomain),
-				fmt.Sprintf("traefik.http.services.%s.loadbalancer.server.port=%s", appName, appPort),
-				fmt.Sprintf("traefik.http.routers.%s.tls=true", appName),
-				fmt.Sprintf("traefik.http.routers.%s.tls.certresolver=default", appName),
-				"traefik.docker.network=sidekick",
-			},
-			Environment: dockerEnvProperty,
-			Networks: []string{
-				"sidekick",
-			},
-		}
-		newDockerCompose := utils.DockerComposeFile{
-			Services: map[string]utils.DockerService{
-				appName: newService,
-			},
-			Networks: map[string]utils.DockerNetwork{
-				"sidekick": {
-					External: true,
-				},
-			},
+		metadata := utils.GetDeployMetadata(appName, utils.MetadataEnvProduction, "")
+		image, err := utils.AppImage(appConfig, "latest")
+		if err != nil {
+			return utils.NewStageError("Image", utils.ExitCodeConfig, "", err)
 		}
-		dockerComposeFile, err := yaml.Marshal(&newDockerCompose)
+		newDockerCompose := utils.GetAppComposeFile(appConfig, appName, image, appDomain, utils.WithMetadataEnv(dockerEnvProperty, metadata))
+		timeout, err := utils.GetOperationTimeout(cmd, appConfig)
 		if err != nil {
-			fmt.Printf("Error marshalling YAML: %v\n", err)
-			return
+			return utils.NewStageError("Timeout", utils.ExitCodeConfig, "", err)
 		}
-		err = os.WriteFile("docker-compose.yaml", dockerComposeFile, 0644)
+		verifyTimeout, err := utils.GetVerifyTimeout(cmd, appConfig)
 		if err != nil {
-			fmt.Printf("Error writing file: %v\n", err)
-			return
+			return utils.NewStageError("Timeout", utils.ExitCodeConfig, "", err)
+		}
+		if dryRun {
+			skipDNSCheck, _ := cmd.Flags().GetBool("skip-dns-check")
+			plan, err := getLaunchPlan(appConfig, target, newDockerCompose, hasEnvFile, remoteBuild, !skipDNSCheck && !utils.IsSslipDomain(appDomain), verifyTimeout)
+			if err != nil {
+				return utils.NewStageError("Dry Run", utils.ExitCodeConfig, "", err)
+			}
+			return plan.Print()
+		}
+		if err := utils.CheckDomainDNSStage(cmd, appDomain, sidekickServer.Address); err != nil {
+			return err
+		}
+		dockerComposeFile, err := yaml.Marshal(&newDockerCompose)
+		if err != nil {
+			return utils.NewStageError("Compose File", utils.ExitCodeError, "", err)
 		}
 		defer os.Remove("docker-compose.yaml")
+		if err := os.WriteFile("docker-compose.yaml", dockerComposeFile, 0644); err != nil {
+			return utils.NewStageError("Compose File", utils.ExitCodeError, "", err)
+		}
+		defer os.Remove(fmt.Sprintf("%s-latest.tar", appName))
 
 		cmdStages := []render.Stage{
 			render.MakeStage("Validating connection with VPS", "VPS is reachable", false),
-			render.MakeStage("Building latest docker image of your app", "Latest docker image built", true),
-			render.MakeStage("Saving docker image locally", "Image saved successfully", false),
-			render.MakeStage("Moving image to your server", "Image moved and loaded successfully", false),
-			render.MakeStage("Setting up your application", "Application setup successfully", false),
 		}
-		p := tea.NewProgram(render.TuiModel{
+		if utils.IsStatic(appConfig) {
+			cmdStages = append(cmdStages, render.MakeStage("Building your static site on your server", "Static site image built on your server", true))
+		} else if remoteBuild {
+			cmdStages = append(cmdStages, render.MakeStage("Building latest docker image of your app on your server", "Latest docker image built on your server", true))
+		} else {
+			cmdStages = append(cmdStages,
+				render.MakeStage("Building latest docker image of your app", "Latest docker image built", true),
+				render.MakeStage("Saving docker image locally", "Image saved successfully", false),
+				render.MakeStage("Moving image to your server", "Image moved and loaded successfully", false),
+			)
+		}
+		cmdStages = append(cmdStages, render.MakeStage("Setting up your application", "Application setup successfully", true))
+		if verifyTimeout > 0 {
+			cmdStages = append(cmdStages, render.MakeStage("Waiting for your app to answer at "+appDomain, "Your app answers at "+appDomain, true))
+		}
+		launchHash, _ := utils.GetGitShortHash()
+		p := render.NewProgram(render.TuiModel{
+			App:         appName,
+			Hash:        launchHash,
 			Stages:      cmdStages,
 			BannerMsg:   "Launching your application on your VPS 🚀",
 			ActiveIndex: 0,
@@ -340,46 +652,123 @@ var LaunchCmd = &cobra.Command{
 			AllDone:     false,
 		})
 
+		// set before the error is sent to the TUI so it is visible once p.Run returns
+		var pipelineErr error
+		fail := func(err *utils.StageError) {
+			pipelineErr = err
+			p.Send(render.ErrorMsg{ErrorStr: err.Error()})
+		}
+
+		deadline := utils.StartOperationDeadline("launch", timeout, func(err *utils.StageError) {
+			p.Send(render.ErrorMsg{ErrorStr: err.Error()})
+		})
+		defer deadline.Stop()
+
 		go func() {
 			sshClient, err := stage1(&sidekickServer)
 			if err != nil {
-				p.Send(render.ErrorMsg{ErrorStr: "Something went wrong logging in to your VPS"})
+				fail(utils.NewStageError("Validating connection with VPS", utils.ExitCodeRemote, "Check that the VPS is up and your SSH key is loaded in ssh-agent", err))
+				return
 			}
-
-			time.Sleep(time.Millisecond * 100)
-			p.Send(render.NextStageMsg{})
-
-			if err = stage2(appName, p, &sidekickServer); err != nil {
-				p.Send(render.ErrorMsg{ErrorStr: fmt.Sprintf("Something went wrong building your docker image: %s", err)})
+			deadline.OnExpire(func() {
+				sshClient.Close()
+				utils.AbortRemote(sidekickServer.Address, utils.GetAbortStartScript(appName, fmt.Sprintf("%s-latest.tar", appName)))
+			})
+			if stageErr := utils.CheckRouteConflictsStage(utils.SSHExecutor{Client: sshClient}, appName, appName, appDomain); stageErr != nil {
+				fail(stageErr)
+				return
 			}
 
 			time.Sleep(time.Millisecond * 100)
 			p.Send(render.NextStageMsg{})
 
-			if err = stage3(appName, p); err != nil {
-				p.Send(render.ErrorMsg{ErrorStr: fmt.Sprintf("Something went wrong saving docker image to a file: %s", err)})
+			if utils.IsStatic(appConfig) {
+				if stageErr := stage2Static(sshClient, appConfig, image, p, &sidekickServer); stageErr != nil {
+					fail(stageErr)
+					return
+				}
+			} else if remoteBuild {
+				if stageErr := stage2Remote(sshClient, appName, image, p, &sidekickServer); stageErr != nil {
+					fail(stageErr)
+					return
+				}
+			} else {
+				if err = stage2(image, p, &sidekickServer); err != nil {
+					fail(utils.NewStageError("Building docker image", utils.ExitCodeBuild, "Make sure docker is running and your Dockerfile builds locally", err))
+					return
+				}
+
+				time.Sleep(time.Millisecond * 100)
+				p.Send(render.NextStageMsg{})
+
+				if err = stage3(appName, image, p); err != nil {
+					fail(utils.NewStageError("Saving docker image", utils.ExitCodeBuild, "Check you have enough free disk space", err))
+					return
+				}
+
+				time.Sleep(time.Millisecond * 100)
+				p.Send(render.NextStageMsg{})
+
+				if stageErr := stage4(sshClient, appName, p); stageErr != nil {
+					fail(stageErr)
+					return
+				}
 			}
 
 			time.Sleep(time.Millisecond * 100)
 			p.Send(render.NextStageMsg{})
 
-			if err = stage4(sshClient, appName, p, &sidekickServer); err != nil {
-				p.Send(render.ErrorMsg{ErrorStr: fmt.Sprintf("Something went wrong moving the image to your VPS: %s", err)})
+			if err = stage5(sshClient, appConfig, hasEnvFile, p, &sidekickServer); err != nil {
+				fail(utils.NewStageError("Setting up your application", utils.ExitCodeRemote, "Check the app logs on your VPS with docker logs", err))
+				return
 			}
-
-			time.Sleep(time.Millisecond * 100)
-			p.Send(render.NextStageMsg{})
-
-			if err = stage5(sshClient, appName, appPort, appDomain, hasEnvFile, envFileName, envFileChecksum, p, &sidekickServer); err != nil {
-				p.Send(render.ErrorMsg{ErrorStr: fmt.Sprintf("Something went wrong booting up your app: %s", err)})
+			if verifyTimeout > 0 {
+				time.Sleep(time.Millisecond * 100)
+				p.Send(render.NextStageMsg{})
+				if err := utils.VerifyDeployWithTUIHook(sshClient, appName, appName, appDomain, appConfig, verifyTimeout, p); err != nil {
+					fail(utils.NewStageError("Waiting for your app to answer", utils.ExitCodeRemote, utils.VerifyHint, err))
+					return
+				}
 			}
 
-			p.Send(render.AllDoneMsg{Message: "🚀 Deployed successfully in " + time.Since(start).Round(time.Second).String() + ".\n" + "😎 View your app at https://" + appDomain})
+			doneMessage := "🚀 Deployed successfully in " + time.Since(start).Round(time.Second).String() + ".\n" + "😎 View your app at " + utils.URLScheme(appConfig) + "://" + appDomain
+			if stagingTLS {
+				doneMessage += "\n" + "⚠️ The certificate comes from Let's Encrypt staging and is untrusted. Run sidekick deploy --staging-tls=false to switch to a real one"
+			}
+			deadline.Stop()
+			p.Send(render.AllDoneMsg{Message: doneMessage})
 		}()
 
-		if _, err := p.Run(); err != nil {
-			fmt.Println("Error running program:", err)
-			os.Exit(1)
+		if _, err := p.Run(); errors.Is(err, tea.ErrInterrupted) {
+			deadline.Cancel()
+		} else if err != nil {
+			return fmt.Errorf("error running program: %w", err)
+		}
+		// a stage cut off by the deadline or Ctrl-C fails with its own error too, the timeout or Ctrl-C is what happened
+		if deadline.Expired() {
+			deadline.Cleanup()
+			return deadline.Err()
 		}
+		return pipelineErr
 	},
 }
+
+func init() {
+	LaunchCmd.Flags().String("name", "", "Url friendly name of the app, skips the question")
+	LaunchCmd.Flags().String("port", "", "Port the app receives requests on, skips the question")
+	LaunchCmd.Flags().String("domain", "", "Domain pointing to your VPS to serve the app on, skips the question")
+	LaunchCmd.Flags().String("env-file", "", "Env file to load, skips the question")
+	LaunchCmd.Flags().Bool("force", false, "Launch even when an app with the same name already exists on the VPS, overwriting it")
+	LaunchCmd.Flags().Bool("no-overwrite", false, "Abort instead of reconfiguring when sidekick.yml already exists")
+	LaunchCmd.Flags().String("tls-cert", "", "Path to a custom TLS certificate (PEM) to serve instead of a Let's Encrypt one")
+	LaunchCmd.Flags().String("tls-key", "", "Path to the private key (PEM) of the custom TLS certificate")
+	LaunchCmd.Flags().String("static", "", "Serve the files in this folder with nginx instead of building a Dockerfile, they are built into an image on your VPS. Saved in sidekick.yml")
+	LaunchCmd.Flags().Bool("remote-build", false, "Build the image on your VPS instead of locally, only the build context is sent over")
+	LaunchCmd.Flags().String("timeout", "", "Stop the launch and clean up when it takes longer than this, like 15m")
+	LaunchCmd.Flags().Bool("dry-run", false, "Ask the usual questions, then print the compose file and the commands a launch would run without building or touching your VPS")
+	LaunchCmd.Flags().String("verify-timeout", "", "How long the app gets to answer on its URL once launched before the launch fails, like 5m. 0 skips the check")
+	LaunchCmd.Flags().Bool("skip-dns-check", false, "Launch without checking the domain points at your VPS, like when it is behind a CDN or proxy")
+	LaunchCmd.Flags().Bool("no-tls", false, "Serve the app over plain HTTP, like behind a proxy that terminates TLS. Saved as tls: false in sidekick.yml")
+	LaunchCmd.Flags().StringArray("label", []string{}, "Add a label like a Traefik middleware to the app container as key=value (repeatable). Saved in sidekick.yml")
+	LaunchCmd.Flags().Bool("staging-tls", false, "Use the Let's Encrypt staging environment for certs to avoid rate limits (certs are untrusted)")
+}
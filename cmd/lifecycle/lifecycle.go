@@ -0,0 +1,155 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lifecycle
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mightymoud/sidekick/utils"
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	stateTimeout      = 30 * time.Second
+	statePollInterval = time.Second
+)
+
+type lifecycleAction struct {
+	// compose subcommand, these work on the existing containers so no image or env file is needed locally
+	compose     string
+	doing       string
+	done        string
+	targetState string
+}
+
+var (
+	restartAction = lifecycleAction{compose: "restart", doing: "Restarting", done: "restarted", targetState: "running"}
+	stopAction    = lifecycleAction{compose: "stop", doing: "Stopping", done: "stopped", targetState: "exited"}
+	startAction   = lifecycleAction{compose: "start", doing: "Starting", done: "started", targetState: "running"}
+)
+
+var RestartCmd = &cobra.Command{
+	Use:   "restart",
+	Short: "Restart your app on the VPS without deploying",
+	Long:  `This command restarts the running container of your app, or of a preview env with --preview, as is.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runLifecycleAction(cmd, restartAction)
+	},
+}
+
+var StopCmd = &cobra.Command{
+	Use:   "stop",
+	Short: "Stop your app on the VPS",
+	Long:  `This command stops the container of your app, or of a preview env with --preview. Run sidekick start to bring it back.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runLifecycleAction(cmd, stopAction)
+	},
+}
+
+var StartCmd = &cobra.Command{
+	Use:   "start",
+	Short: "Start your stopped app on the VPS",
+	Long:  `This command starts the stopped container of your app, or of a preview env with --preview.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runLifecycleAction(cmd, startAction)
+	},
+}
+
+func runLifecycleAction(cmd *cobra.Command, action lifecycleAction) error {
+	config, err := utils.GetSidekickConfigFromCmdContext(cmd)
+	if err != nil {
+		return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Run sidekick init to set up a VPS first", err)
+	}
+	appConfig, err := utils.LoadAppConfig()
+	if err != nil {
+		return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+	}
+
+	dir, service, url, environment := appConfig.Name, appConfig.Name, appConfig.Url, utils.MetadataEnvProduction
+	previewHash, _ := cmd.Flags().GetString("preview")
+	if previewHash != "" {
+		dir, service, url = utils.RemotePreviewDir(appConfig.Name, previewHash), fmt.Sprintf("%s-%s", appConfig.Name, previewHash), utils.PreviewHost(appConfig, previewHash)
+		environment = utils.MetadataEnvPreview
+	}
+
+	target, err := utils.ResolveTarget(cmd, config, appConfig.Server, environment)
+	if err != nil {
+		return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Check the server in sidekick.yml exists in your sidekick config", err)
+	}
+	if err := utils.GuardTarget(cmd, config, target, appConfig.Name); err != nil {
+		return err
+	}
+	server := target.Server
+
+	if action == stopAction {
+		pterm.Warning.Printfln("%s://%s will return 404 from Traefik until you run sidekick start", utils.URLScheme(appConfig), url)
+	}
+
+	sshClient, err := utils.Login(server.Address, "sidekick")
+	if err != nil {
+		return utils.NewStageError(action.doing, utils.ExitCodeRemote, "Check that the VPS is up and your SSH key is loaded in ssh-agent", err)
+	}
+	defer sshClient.Close()
+	// previews are only recorded on the server, their folder is there as long as they are
+	if previewHash != "" {
+		if _, err := utils.RunCommandOutput(sshClient, fmt.Sprintf("test -d %s", dir)); err != nil {
+			return utils.NewStageError("Preview Envs", utils.ExitCodeConfig, "Run sidekick preview list to see them", fmt.Errorf("no preview env found for %s", previewHash))
+		}
+	}
+
+	pterm.Info.Printfln("%s %s on %s", action.doing, service, server.Name)
+	if _, err := utils.RunCommandOutput(sshClient, fmt.Sprintf("cd %s && docker compose -p %s %s %s", dir, utils.ComposeProjectForDir(dir), action.compose, service)); err != nil {
+		return utils.NewStageError(action.doing, utils.ExitCodeRemote, "The container may be gone, run sidekick deploy to recreate it", err)
+	}
+
+	state, err := waitForState(sshClient, dir, service, action.targetState)
+	if err != nil {
+		return utils.NewStageError(action.doing, utils.ExitCodeRemote, "", err)
+	}
+	if state != action.targetState {
+		return utils.NewStageError(action.doing, utils.ExitCodeRemote, "Check the app logs on your VPS with docker logs",
+			fmt.Errorf("%s is %s after %s, expected %s", service, state, stateTimeout, action.targetState))
+	}
+	pterm.Success.Printfln("%s %s - container is %s", service, action.done, state)
+	return nil
+}
+
+// waitForState returns the last state seen, which is the target state unless it timed out
+func waitForState(sshClient *ssh.Client, dir string, service string, target string) (string, error) {
+	probe := fmt.Sprintf(`cd %s && docker compose -p %s ps -a -q %s | head -n1 | xargs -r docker inspect -f '{{.State.Status}}'`, dir, utils.ComposeProjectForDir(dir), service)
+	deadline := time.Now().Add(stateTimeout)
+	for {
+		output, err := utils.RunCommandOutput(sshClient, probe)
+		if err != nil {
+			return "", err
+		}
+		state := strings.TrimSpace(output)
+		if state == target || time.Now().After(deadline) {
+			return state, nil
+		}
+		time.Sleep(statePollInterval)
+	}
+}
+
+func init() {
+	for _, cmd := range []*cobra.Command{RestartCmd, StopCmd, StartCmd} {
+		cmd.Flags().String("preview", "", "Commit hash of the preview env to act on instead of production")
+		cmd.RegisterFlagCompletionFunc("preview", utils.CompletePreviewHashes)
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package logs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mightymoud/sidekick/utils"
+	"github.com/spf13/cobra"
+)
+
+const (
+	sourceDocker = "docker"
+	sourceLoki   = "loki"
+)
+
+var LogsCmd = &cobra.Command{
+	Use:   "logs",
+	Short: "Show the logs of your app or one of its previews",
+	Long: `This command prints the logs of your app on the VPS.
+With --source docker, the default, they come from docker and only go back as far as the containers that run now.
+With --source loki they come from the logs stack of sidekick observability enable logs, so they survive restarts and deploys.`,
+	Example: `  sidekick logs --tail 200 -f
+  sidekick logs --preview a1b2c3d --since 30m
+  sidekick logs --source loki --since 72h --service myapp-postgres`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, err := utils.GetSidekickConfigFromCmdContext(cmd)
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Run sidekick init to set up a VPS first", err)
+		}
+		appConfig, err := utils.LoadAppConfig()
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
+		source, _ := cmd.Flags().GetString("source")
+		since, _ := cmd.Flags().GetDuration("since")
+		tail, _ := cmd.Flags().GetInt("tail")
+		follow, _ := cmd.Flags().GetBool("follow")
+		service, _ := cmd.Flags().GetString("service")
+		if source != sourceDocker && source != sourceLoki {
+			return utils.NewStageError("Logs", utils.ExitCodeConfig, "Pass --source docker or --source loki", fmt.Errorf("unknown log source %q", source))
+		}
+		if source == sourceLoki && follow {
+			return utils.NewStageError("Logs", utils.ExitCodeConfig, "Follow the logs with --source docker", errors.New("--follow only works with docker"))
+		}
+
+		dir, project, environment := appConfig.Name, appConfig.Name, utils.MetadataEnvProduction
+		previewHash, _ := cmd.Flags().GetString("preview")
+		if previewHash != "" {
+			dir, project, environment = utils.RemotePreviewDir(appConfig.Name, previewHash), utils.ComposeProject(appConfig.Name, previewHash), utils.MetadataEnvPreview
+		}
+		target, err := utils.ResolveTarget(cmd, config, appConfig.Server, environment)
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Check the server in sidekick.yml exists in your sidekick config", err)
+		}
+
+		if source == sourceLoki {
+			entries, err := utils.QueryLoki(target.Server.Observability.Logs, utils.LokiSelector(appConfig.Name, previewHash, service), time.Now().Add(-since), tail)
+			if err != nil {
+				return utils.NewStageError("Logs", utils.ExitCodeRemote, "Run sidekick observability enable logs on the server first, then deploy again", err)
+			}
+			for _, entry := range entries {
+				fmt.Printf("%s %s | %s\n", entry.Time.Format(time.RFC3339), entry.Labels["container"], entry.Line)
+			}
+			return nil
+		}
+
+		sshClient, err := utils.Login(target.Server.Address, "sidekick")
+		if err != nil {
+			return utils.NewStageError("Logs", utils.ExitCodeRemote, "Check that the VPS is up and your SSH key is loaded in ssh-agent", err)
+		}
+		defer sshClient.Close()
+		// previews are only recorded on the server, their folder is there as long as they are
+		if previewHash != "" {
+			if _, err := utils.RunCommandOutput(sshClient, fmt.Sprintf("test -d %s", dir)); err != nil {
+				return utils.NewStageError("Preview Envs", utils.ExitCodeConfig, "Run sidekick preview list to see them", fmt.Errorf("no preview env found for %s", previewHash))
+			}
+		}
+		if err := utils.StreamCommandOutput(sshClient, getDockerLogsCommand(appConfig, project, service, since, tail, follow), os.Stdout); err != nil {
+			return utils.NewStageError("Logs", utils.ExitCodeRemote, "", err)
+		}
+		return nil
+	},
+}
+
+// getDockerLogsCommand reads the logs of the compose project, or of one service of the stack of a swarm app
+func getDockerLogsCommand(appConfig utils.SidekickAppConfig, project string, service string, since time.Duration, tail int, follow bool) string {
+	flags := fmt.Sprintf("--timestamps --since %s --tail %d", since, tail)
+	if follow {
+		flags += " --follow"
+	}
+	if utils.IsSwarm(appConfig) {
+		if service == "" {
+			service = project
+		}
+		return fmt.Sprintf("docker service logs %s %s_%s", flags, project, service)
+	}
+	return fmt.Sprintf("docker compose -p %s logs --no-color %s %s", project, flags, service)
+}
+
+func init() {
+	LogsCmd.Flags().String("source", sourceDocker, "Where the logs come from, docker or loki")
+	LogsCmd.Flags().String("preview", "", "Commit hash of the preview env to show the logs of instead of production")
+	LogsCmd.Flags().String("service", "", "Compose service to show the logs of, defaults to all of them")
+	LogsCmd.Flags().Duration("since", time.Hour, "How far back the logs go")
+	LogsCmd.Flags().Int("tail", 100, "Most lines to show")
+	LogsCmd.Flags().BoolP("follow", "f", false, "Keep printing new lines, only with --source docker")
+	LogsCmd.RegisterFlagCompletionFunc("preview", utils.CompletePreviewHashes)
+}
@@ -0,0 +1,345 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package observability
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mightymoud/sidekick/utils"
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+var ObservabilityCmd = &cobra.Command{
+	Use:   "observability",
+	Short: "Run a logs or metrics stack next to your apps on the VPS",
+	Long: `Sidekick can run Loki and Promtail on your VPS so the logs of your apps and their previews outlive their containers.
+Promtail ships the logs of every container sidekick deploys to Loki, which answers behind Traefik with basic auth.
+Read them with sidekick logs --source loki.
+
+It can also run Prometheus with cAdvisor and node-exporter, scraping Traefik, every container and the server itself,
+with Grafana behind Traefik to look at it all.`,
+}
+
+func resolveTarget(cmd *cobra.Command) (*utils.SidekickConfig, utils.Target, error) {
+	config, err := utils.GetSidekickConfigFromCmdContext(cmd)
+	if err != nil {
+		return nil, utils.Target{}, utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Run sidekick init to set up a VPS first", err)
+	}
+	pinnedServer := ""
+	if utils.FileExists(utils.AppConfigFile) {
+		appConfig, err := utils.LoadAppConfig()
+		if err != nil {
+			return nil, utils.Target{}, utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
+		pinnedServer = appConfig.Server
+	}
+	target, err := utils.ResolveTarget(cmd, config, pinnedServer, utils.MetadataEnvProduction)
+	if err != nil {
+		return nil, utils.Target{}, utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Pass --context to pick a server", err)
+	}
+	return config, target, nil
+}
+
+const (
+	stackLogs    = "logs"
+	stackMetrics = "metrics"
+)
+
+// checkStack fails for anything but the stacks sidekick knows how to run
+func checkStack(args []string) error {
+	if args[0] != stackLogs && args[0] != stackMetrics {
+		return utils.NewStageError("Observability", utils.ExitCodeConfig, "Pass logs or metrics", fmt.Errorf("unknown stack %q", args[0]))
+	}
+	return nil
+}
+
+// durationFlag is the flag when it was passed, then what the config kept from the last run, then fallback
+func durationFlag(cmd *cobra.Command, flag string, kept string, fallback time.Duration) (time.Duration, error) {
+	if cmd.Flags().Changed(flag) {
+		return cmd.Flags().GetDuration(flag)
+	}
+	if kept != "" {
+		return time.ParseDuration(kept)
+	}
+	return fallback, nil
+}
+
+// generatePassword keeps the password of an earlier run so the credentials people saved keep working
+func generatePassword(kept string) (string, error) {
+	if kept != "" {
+		return kept, nil
+	}
+	return utils.GenerateAddonPassword()
+}
+
+// startStack writes files to dir on the server and runs up there
+func startStack(server utils.SidekickServer, dir string, files map[string][]byte, up string, title string) error {
+	sshClient, err := utils.Login(server.Address, "sidekick")
+	if err != nil {
+		return utils.NewStageError("Login", utils.ExitCodeRemote, "Check that the VPS is up and your SSH key is loaded in ssh-agent", err)
+	}
+	defer sshClient.Close()
+
+	spinner := utils.StartTask(title)
+	if _, err := utils.RunCommandOutput(sshClient, fmt.Sprintf("mkdir -p %s", dir)); err != nil {
+		spinner.Fail()
+		return utils.NewStageError("Observability", utils.ExitCodeRemote, "", err)
+	}
+	for name, content := range files {
+		if err := utils.WriteRemoteFile(sshClient, fmt.Sprintf("%s/%s", dir, name), content); err != nil {
+			spinner.Fail()
+			return utils.NewStageError("Observability", utils.ExitCodeRemote, "", fmt.Errorf("unable to write %s: %w", name, err))
+		}
+	}
+	if _, err := utils.RunCommandOutput(sshClient, up); err != nil {
+		spinner.Fail()
+		return utils.NewStageError("Observability", utils.ExitCodeRemote, "Check the logs of its containers with docker compose logs on the server", err)
+	}
+	spinner.Success()
+	return nil
+}
+
+var enableCmd = &cobra.Command{
+	Use:   "enable <logs|metrics>",
+	Short: "Run the logs or the metrics stack on your VPS",
+	Long: `This command runs a stack of its own on your VPS, in a compose project apart from Traefik and your apps.
+
+logs runs Loki and Promtail. Loki answers on --domain behind Traefik with basic auth, the credentials are generated once and kept in your sidekick config.
+Apps deployed before the logs stack have to be deployed again, only then do their containers carry the labels Promtail looks for.
+
+metrics runs Prometheus, cAdvisor and node-exporter, and Grafana on --domain unless you pass --no-grafana.
+Prometheus scrapes Traefik on the sidekick network, nothing of the stack is published on the server but Grafana.
+The server has to be on the latest stack for Traefik to serve its metrics, run sidekick server upgrade first.
+
+Running it again updates the stack, like a new --retention, and keeps what it collected.`,
+	Example: `  sidekick observability enable logs --domain logs.example.com
+  sidekick observability enable logs --retention 720h
+  sidekick observability enable metrics --domain grafana.example.com
+  sidekick observability enable metrics --no-grafana --retention 72h --interval 1m`,
+	Args:      cobra.ExactArgs(1),
+	ValidArgs: []string{stackLogs, stackMetrics},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := checkStack(args); err != nil {
+			return err
+		}
+		config, target, err := resolveTarget(cmd)
+		if err != nil {
+			return err
+		}
+		if args[0] == stackMetrics {
+			return enableMetrics(cmd, config, target)
+		}
+		return enableLogs(cmd, config, target)
+	},
+}
+
+func enableLogs(cmd *cobra.Command, config *utils.SidekickConfig, target utils.Target) error {
+	server := target.Server
+	stack := server.Observability.Logs
+	if domain, _ := cmd.Flags().GetString("domain"); domain != "" {
+		stack.Domain = domain
+	}
+	if stack.Domain == "" {
+		return utils.NewStageError("Observability", utils.ExitCodeConfig, "Pass --domain with a domain that points at your VPS, like logs.example.com", errors.New("loki needs a domain to answer on"))
+	}
+	retention, err := durationFlag(cmd, "retention", stack.Retention, utils.DefaultLogRetention)
+	if err != nil {
+		return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+	}
+	if err := utils.ValidateLogRetention(retention); err != nil {
+		return utils.NewStageError("Observability", utils.ExitCodeConfig, "Pass --retention in whole days, like 168h for a week", err)
+	}
+	stack.Retention = utils.FormatLogRetention(retention)
+	if stack.User == "" {
+		stack.User = utils.DefaultLogsUser
+	}
+	if stack.Password, err = generatePassword(stack.Password); err != nil {
+		return utils.NewStageError("Observability", utils.ExitCodeError, "", err)
+	}
+	users, err := utils.GetBasicAuthUsers(stack.User, stack.Password)
+	if err != nil {
+		return utils.NewStageError("Observability", utils.ExitCodeError, "", err)
+	}
+	composeFile, err := yaml.Marshal(utils.GetLogsComposeFile(stack, users, server.NetworkName()))
+	if err != nil {
+		return utils.NewStageError("Observability", utils.ExitCodeError, "", err)
+	}
+	if err := utils.GuardTarget(cmd, config, target, server.Name); err != nil {
+		return err
+	}
+
+	files := map[string][]byte{
+		"docker-compose.yaml": composeFile,
+		"loki.yaml":           []byte(utils.GetLokiConfig(retention)),
+		"promtail.yaml":       []byte(utils.GetPromtailConfig()),
+	}
+	if err := startStack(server, utils.RemoteLogsDir(), files, utils.GetLogsUpCommand(), "Starting Loki and Promtail"); err != nil {
+		return err
+	}
+
+	if err := utils.SaveServer(viper.GetString("config"), server.Name, func(saved *utils.SidekickServer) {
+		saved.Observability.Logs = stack
+	}); err != nil {
+		return utils.NewStageError("Sidekick Config", utils.ExitCodeError, "", err)
+	}
+	pterm.Success.Printfln("Loki answers on https://%s for %s, keeping logs for %s", stack.Domain, server.Name, stack.Retention)
+	pterm.Info.Printfln("Log in as %s with the password in your sidekick config, or read the logs with sidekick logs --source loki", stack.User)
+	return nil
+}
+
+func enableMetrics(cmd *cobra.Command, config *utils.SidekickConfig, target utils.Target) error {
+	server := target.Server
+	stack := server.Observability.Metrics
+	if domain, _ := cmd.Flags().GetString("domain"); domain != "" {
+		stack.Domain = domain
+	}
+	if noGrafana, _ := cmd.Flags().GetBool("no-grafana"); noGrafana {
+		stack.Domain, stack.User, stack.Password = "", "", ""
+	} else if stack.Domain == "" {
+		return utils.NewStageError("Observability", utils.ExitCodeConfig, "Pass --domain with a domain that points at your VPS, like grafana.example.com, or --no-grafana", errors.New("grafana needs a domain to answer on"))
+	}
+	retention, err := durationFlag(cmd, "retention", stack.Retention, utils.DefaultMetricsRetention)
+	if err != nil {
+		return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+	}
+	if retention < time.Hour {
+		return utils.NewStageError("Observability", utils.ExitCodeConfig, "Pass --retention of an hour or more, like 360h", fmt.Errorf("metrics retention %s is too short", retention))
+	}
+	interval, err := durationFlag(cmd, "interval", stack.Interval, utils.DefaultScrapeInterval)
+	if err != nil {
+		return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+	}
+	if interval < 5*time.Second {
+		return utils.NewStageError("Observability", utils.ExitCodeConfig, "Pass --interval of 5s or more, like 30s", fmt.Errorf("scrape interval %s is too short", interval))
+	}
+	stack.Enabled, stack.Retention, stack.Interval = true, utils.FormatLogRetention(retention), interval.String()
+	if stack.Domain != "" {
+		if stack.User == "" {
+			stack.User = utils.DefaultGrafanaUser
+		}
+		if stack.Password, err = generatePassword(stack.Password); err != nil {
+			return utils.NewStageError("Observability", utils.ExitCodeError, "", err)
+		}
+	}
+	composeFile, err := yaml.Marshal(utils.GetMetricsComposeFile(stack, retention, interval, server.NetworkName()))
+	if err != nil {
+		return utils.NewStageError("Observability", utils.ExitCodeError, "", err)
+	}
+	if err := utils.GuardTarget(cmd, config, target, server.Name); err != nil {
+		return err
+	}
+
+	sshClient, err := utils.Login(server.Address, "sidekick")
+	if err != nil {
+		return utils.NewStageError("Login", utils.ExitCodeRemote, "Check that the VPS is up and your SSH key is loaded in ssh-agent", err)
+	}
+	version, err := utils.GetRemoteStackVersion(utils.SSHExecutor{Client: sshClient})
+	sshClient.Close()
+	if err != nil {
+		return utils.NewStageError("Stack Version", utils.ExitCodeRemote, "", err)
+	}
+	if version < utils.StackVersion {
+		return utils.NewStageError("Stack Version", utils.ExitCodeConfig, "Run sidekick server upgrade first", fmt.Errorf("the server is on stack version %d, Traefik serves its metrics from %d", version, utils.StackVersion))
+	}
+
+	files := map[string][]byte{
+		"docker-compose.yaml":      composeFile,
+		"prometheus.yml":           []byte(utils.GetPrometheusConfig(interval)),
+		"grafana-datasources.yaml": []byte(utils.GetGrafanaDatasources()),
+	}
+	if err := startStack(server, utils.RemoteMetricsDir(), files, utils.GetMetricsUpCommand(), "Starting Prometheus and its exporters"); err != nil {
+		return err
+	}
+
+	if err := utils.SaveServer(viper.GetString("config"), server.Name, func(saved *utils.SidekickServer) {
+		saved.Observability.Metrics = stack
+	}); err != nil {
+		return utils.NewStageError("Sidekick Config", utils.ExitCodeError, "", err)
+	}
+	pterm.Success.Printfln("Prometheus scrapes %s every %s, keeping metrics for %s", server.Name, stack.Interval, stack.Retention)
+	if stack.Domain != "" {
+		pterm.Info.Printfln("Grafana: https://%s - log in as %s with the password in your sidekick config", stack.Domain, stack.User)
+	}
+	return nil
+}
+
+var disableCmd = &cobra.Command{
+	Use:       "disable <logs|metrics>",
+	Short:     "Remove the logs or the metrics stack from your VPS",
+	Long:      `This command removes the stack from your VPS. What it collected stays in its volumes so enabling it again brings it back, unless you pass --purge.`,
+	Args:      cobra.ExactArgs(1),
+	ValidArgs: []string{stackLogs, stackMetrics},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := checkStack(args); err != nil {
+			return err
+		}
+		config, target, err := resolveTarget(cmd)
+		if err != nil {
+			return err
+		}
+		server := target.Server
+		purge, _ := cmd.Flags().GetBool("purge")
+		enabled, down := server.Observability.Logs.Domain != "", utils.GetLogsDownCommand(purge)
+		if args[0] == stackMetrics {
+			enabled, down = server.Observability.Metrics.Enabled, utils.GetMetricsDownCommand(purge)
+		}
+		if !enabled {
+			return utils.NewStageError("Observability", utils.ExitCodeConfig, fmt.Sprintf("Run sidekick observability enable %s first", args[0]), fmt.Errorf("the %s stack is not enabled on %s", args[0], server.Name))
+		}
+		if err := utils.GuardTarget(cmd, config, target, server.Name); err != nil {
+			return err
+		}
+
+		sshClient, err := utils.Login(server.Address, "sidekick")
+		if err != nil {
+			return utils.NewStageError("Login", utils.ExitCodeRemote, "Check that the VPS is up and your SSH key is loaded in ssh-agent", err)
+		}
+		defer sshClient.Close()
+
+		spinner := utils.StartTask(fmt.Sprintf("Removing the %s stack", args[0]))
+		if _, err := utils.RunCommandOutput(sshClient, down); err != nil {
+			spinner.Fail()
+			return utils.NewStageError("Observability", utils.ExitCodeRemote, "", err)
+		}
+		spinner.Success()
+
+		if err := utils.SaveServer(viper.GetString("config"), server.Name, func(saved *utils.SidekickServer) {
+			if args[0] == stackMetrics {
+				saved.Observability.Metrics = utils.SidekickMetricsStack{}
+			} else {
+				saved.Observability.Logs = utils.SidekickLogsStack{}
+			}
+		}); err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeError, "", err)
+		}
+		pterm.Success.Printfln("The %s stack is gone from %s", args[0], server.Name)
+		return nil
+	},
+}
+
+func init() {
+	enableCmd.Flags().String("domain", "", "Domain Loki or Grafana answers on behind Traefik, like logs.example.com")
+	enableCmd.Flags().Duration("retention", 0, "How long the stack keeps what it collects, in whole days for logs (default 168h for logs, 360h for metrics)")
+	enableCmd.Flags().Duration("interval", utils.DefaultScrapeInterval, "How often Prometheus scrapes, metrics only")
+	enableCmd.Flags().Bool("no-grafana", false, "Run the metrics stack without Grafana, metrics only")
+	disableCmd.Flags().Bool("purge", false, "Delete what the stack collected too")
+	ObservabilityCmd.AddCommand(enableCmd)
+	ObservabilityCmd.AddCommand(disableCmd)
+}
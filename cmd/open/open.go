@@ -0,0 +1,75 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package open
+
+import (
+	"fmt"
+
+	"github.com/mightymoud/sidekick/utils"
+	"github.com/spf13/cobra"
+)
+
+var OpenCmd = &cobra.Command{
+	Use:   "open",
+	Short: "Open the URL of your app or a preview env in your browser",
+	Long:  "This command opens the app URL from sidekick.yml in your default browser. Without a display it prints the URL instead.",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		appConfig, err := utils.LoadAppConfig()
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Run sidekick launch first", err)
+		}
+		hash, _ := cmd.Flags().GetString("preview")
+		if hash != "" {
+			// previews are recorded in the app state on the server
+			config, err := utils.GetSidekickConfigFromCmdContext(cmd)
+			if err != nil {
+				return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+			}
+			target, err := utils.ResolveTarget(cmd, config, appConfig.Server, utils.MetadataEnvPreview)
+			if err != nil {
+				return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+			}
+			if appConfig, err = utils.FetchAppState(target.Server, appConfig); err != nil {
+				return utils.NewStageError("App State", utils.ExitCodeRemote, "", err)
+			}
+		}
+		url, err := utils.AppURL(appConfig, hash)
+		if err != nil {
+			hint := "Run sidekick launch to deploy your app first"
+			if hash != "" {
+				hint = "Run sidekick preview list to see your preview envs"
+			}
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, hint, err)
+		}
+
+		if !utils.HasDisplay() {
+			fmt.Println(url)
+			return nil
+		}
+		if err := utils.OpenBrowser(url); err != nil {
+			// the url is still useful when no opener is installed
+			fmt.Println(url)
+			return nil
+		}
+		fmt.Printf("Opening %s\n", url)
+		return nil
+	},
+}
+
+func init() {
+	OpenCmd.Flags().String("preview", "", "Commit hash of the preview env to open instead of production")
+	OpenCmd.RegisterFlagCompletionFunc("preview", utils.CompletePreviewHashes)
+}
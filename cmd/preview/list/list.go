@@ -16,7 +16,7 @@ package previewList
 
 import (
 	"fmt"
-	"os"
+	"strings"
 
 	"github.com/charmbracelet/huh"
 	"github.com/charmbracelet/lipgloss"
@@ -33,14 +33,26 @@ var ListCmd = &cobra.Command{
 	Aliases: []string{"ls"},
 	Short:   "This command lists all the preview environments",
 	Long:    `This command lists all the preview environments that are currently running on your VPS.`,
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, err := utils.GetSidekickConfigFromCmdContext(cmd)
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
 		appConfig, appConfigErr := utils.LoadAppConfig()
 		if appConfigErr != nil {
-			log.Fatalf("Unable to load your config file. Might be corrupted")
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", appConfigErr)
+		}
+		target, err := utils.ResolveTarget(cmd, config, appConfig.Server, utils.MetadataEnvPreview)
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
+		// previews are recorded in the app state on the server
+		if appConfig, err = utils.FetchAppState(target.Server, appConfig); err != nil {
+			return utils.NewStageError("App State", utils.ExitCodeRemote, "", err)
 		}
 		if len(appConfig.PreviewEnvs) == 0 {
 			render.GetLogger(log.Options{Prefix: "Preview Envs"}).Info("Not Found in current project")
-			os.Exit(0)
+			return nil
 		}
 		header := lipgloss.NewStyle().Foreground(lipgloss.Color("77")).MarginTop(1).MarginLeft(1).Render("Currently running preview envs:")
 		tableString := table.New().
@@ -54,14 +66,19 @@ var ListCmd = &cobra.Command{
 					return lipgloss.NewStyle().Foreground(lipgloss.Color("78")).PaddingLeft(1).PaddingRight(1)
 				}
 			}).
-			Headers("Commit", "Image", "Deployed At", "URL")
+			Headers("Commit", "Image", "Deployed At", "URL", "Env Overrides")
 
 		hashSlice := []huh.Option[string]{}
 		for v := range appConfig.PreviewEnvs {
 			hashSlice = append(hashSlice, huh.NewOption(v, v))
-			tableString.Row(v, appConfig.PreviewEnvs[v].Image, appConfig.PreviewEnvs[v].CreatedAt, appConfig.PreviewEnvs[v].Url)
+			commit := v
+			if appConfig.PreviewEnvs[v].Dirty {
+				commit += " (dirty)"
+			}
+			tableString.Row(commit, appConfig.PreviewEnvs[v].Image, appConfig.PreviewEnvs[v].CreatedAt, appConfig.PreviewEnvs[v].Url, strings.Join(appConfig.PreviewEnvs[v].EnvOverrides, ", "))
 		}
 		fmt.Println(header)
 		fmt.Println(tableString)
+		return nil
 	},
 }
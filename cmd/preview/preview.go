@@ -15,69 +15,242 @@ limitations under the License.
 package preview
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"path"
+	"slices"
+	"sort"
 	"strings"
 	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/log"
 	previewList "github.com/mightymoud/sidekick/cmd/preview/list"
+	previewPromote "github.com/mightymoud/sidekick/cmd/preview/promote"
 	previewRemove "github.com/mightymoud/sidekick/cmd/preview/remove"
+	previewRollback "github.com/mightymoud/sidekick/cmd/preview/rollback"
 	"github.com/mightymoud/sidekick/render"
 	"github.com/mightymoud/sidekick/utils"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
 	"gopkg.in/yaml.v3"
 )
 
+// getPreviewPlan lists what a preview would do, in the order the pipeline below does it
+func getPreviewPlan(appConfig utils.SidekickAppConfig, target utils.Target, deployHash string, imageName string, envOverrides map[string]string, cache utils.BuildCache, verifyTimeout time.Duration, ref *utils.GitRef) (utils.DryRunPlan, error) {
+	server := target.Server
+	imgFileName := fmt.Sprintf("%s-%s.tar", appConfig.Name, deployHash)
+	previewFolder := fmt.Sprintf("./%s", utils.RemotePreviewDir(appConfig.Name, deployHash))
+	hasEnvFile := appConfig.Env.File != "" || len(envOverrides) > 0
+	plan := utils.DryRunPlan{Target: target, Image: imageName, EnvFile: appConfig.Env.File, EnvChanged: hasEnvFile}
+
+	dockerEnvProperty := []string{}
+	if appConfig.Env.File != "" {
+		envProperty, err := utils.GetDockerEnvProperty(appConfig.Env.File)
+		if err != nil {
+			return plan, fmt.Errorf("failed to read environment file: %w", err)
+		}
+		dockerEnvProperty = envProperty
+	}
+	overrideKeys := make([]string, 0, len(envOverrides))
+	for key := range envOverrides {
+		overrideKeys = append(overrideKeys, key)
+	}
+	sort.Strings(overrideKeys)
+	for _, key := range overrideKeys {
+		entry := fmt.Sprintf("%s=${%s}", key, key)
+		if !slices.Contains(dockerEnvProperty, entry) {
+			dockerEnvProperty = append(dockerEnvProperty, entry)
+		}
+	}
+	plan.ComposeFile = utils.GetPreviewComposeFile(appConfig, server, deployHash, imageName, dockerEnvProperty)
+
+	plan.Remote("take the preview lock " + utils.PreviewLockFile(appConfig.Name, deployHash))
+	plan.Remote(utils.RouteConflictsStep(fmt.Sprintf("%s-%s", appConfig.Name, deployHash), utils.PreviewHost(appConfig, deployHash)))
+	plan.Remote(utils.NetworksStep(appConfig))
+	if hasEnvFile {
+		plan.Local(fmt.Sprintf("sops encrypt --output-type dotenv --age %s ./%s > encrypted.env", server.PublicKey, appConfig.Env.File))
+	}
+	buildContext := "."
+	if ref != nil {
+		buildContext = "<tmp dir>"
+		plan.Local(fmt.Sprintf("git archive %s | tar -x -C %s", ref.Sha, buildContext))
+	}
+	if utils.IsStatic(appConfig) {
+		plan.Local(utils.GetStaticBuildCommand(imageName, "linux/amd64", cache, utils.StaticBuildContext(appConfig, buildContext)).String() + " < Dockerfile of the static site")
+	} else {
+		plan.Local("docker " + strings.Join(utils.GetDockerBuildArgs(imageName, "linux/amd64", cache, buildContext), " "))
+	}
+	plan.Local(fmt.Sprintf("docker save -o %s %s", imgFileName, imageName))
+	plan.Remote(utils.RemoteLayoutStep(appConfig.Name))
+	plan.Remote(fmt.Sprintf("mkdir -p -m 700 %s", utils.RemotePreviewDir(appConfig.Name, deployHash)))
+	plan.Local(fmt.Sprintf("send %s to %s@%s:./%s in gzipped chunks of %s over ssh", imgFileName, "sidekick", server.Address, appConfig.Name, utils.FormatBytes(utils.ImageChunkSize)))
+	plan.Remote(fmt.Sprintf("cd %s && docker load -i %s && rm %s", appConfig.Name, imgFileName, imgFileName))
+	plan.Local(fmt.Sprintf("rsync docker-compose.yaml %s@%s:%s", "sidekick", server.Address, previewFolder))
+	if hasEnvFile {
+		plan.Local(fmt.Sprintf("rsync encrypted.env %s@%s:%s", "sidekick", server.Address, previewFolder))
+	}
+	plan.Remote(utils.GetUpCommand(appConfig, previewFolder, hasEnvFile, server.SecretKey))
+	if verifyTimeout > 0 {
+		plan.Local(utils.VerifyStep(utils.VerifyURL(appConfig, utils.PreviewHost(appConfig, deployHash)), verifyTimeout))
+	}
+	plan.Remote("release the preview lock " + utils.PreviewLockFile(appConfig.Name, deployHash))
+	return plan, nil
+}
+
 var PreviewCmd = &cobra.Command{
 	Use:   "preview",
 	Short: "Deploy a preview environment for your application",
 	Long:  `Sidekick allows you to deploy preview environment based on commit hash`,
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		start := time.Now()
 
 		config, err := utils.GetSidekickConfigFromCmdContext(cmd)
 		if err != nil {
-			render.GetLogger(log.Options{Prefix: "Sidekick Config"}).Fatalf("%s", err)
-		}
-		sidekickServer, err := config.FindServerByContext(config.CurrentContext)
-		if err != nil {
-			render.GetLogger(log.Options{Prefix: "Sidekick Config"}).Fatalf("%s", err)
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Run sidekick init to set up a VPS first", err)
 		}
-
 		appConfig, appConfigErr := utils.LoadAppConfig()
 		if appConfigErr != nil {
-			render.GetLogger(log.Options{Prefix: "Sidekick Setup"}).Error("Sidekick config exits in this project.")
-			render.GetLogger(log.Options{Prefix: "Sidekick Setup"}).Info("You can deploy a new version of your application with Sidekick deploy.")
-			os.Exit(1)
+			return utils.NewStageError("Sidekick Setup", utils.ExitCodeConfig, "Launch your application with sidekick launch before deploying previews", appConfigErr)
 		}
 
+		target, err := utils.ResolveTarget(cmd, config, appConfig.Server, utils.MetadataEnvPreview)
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Check the contexts in your sidekick config", err)
+		}
+		sidekickServer := target.Server
+		appConfig.Network = sidekickServer.NetworkName()
+
 		if sidekickServer.SecretKey == "" {
-			render.GetLogger(log.Options{Prefix: "Backward Compat"}).Error("Recent changes to how Sidekick handles secrets prevents you from launcing a new application.")
-			render.GetLogger(log.Options{Prefix: "Backward Compat"}).Info("To fix this, run `Sidekick init` with the same server address you have now.")
-			render.GetLogger(log.Options{Prefix: "Backward Compat"}).Info("Learn more at www.sidekickdeploy.com/docs/design/encryption")
-			os.Exit(1)
+			return utils.NewStageError("Backward Compat", utils.ExitCodeConfig,
+				"Run `Sidekick init` with the same server address you have now. Learn more at www.sidekickdeploy.com/docs/design/encryption",
+				errors.New("recent changes to how Sidekick handles secrets prevents you from deploying a preview"))
+		}
+
+		// outside a git repository the preview is named after the content of the folder, there is no tree to keep clean
+		dirtyFiles := []string{}
+		deployHash := ""
+		// ref is nil when previewing the checked out tree
+		var ref *utils.GitRef
+		if commit, _ := cmd.Flags().GetString("commit"); commit != "" {
+			if !utils.IsGitRepo() {
+				return utils.NewStageError("Git Ref", utils.ExitCodeConfig, "Preview the folder as it is without --commit", errors.New("--commit needs a git repository"))
+			}
+			resolved, err := utils.ResolveGitRef(commit)
+			if err != nil {
+				return utils.NewStageError("Git Ref", utils.ExitCodeConfig, "Check the commit with git log", err)
+			}
+			ref = &resolved
+			deployHash = resolved.ShortSha
+		} else if utils.IsGitRepo() {
+			if dirtyFiles, err = utils.DirtyFiles(); err != nil {
+				return utils.NewStageError("Preview Cmd", utils.ExitCodeConfig, "", err)
+			}
+			allowDirty, _ := cmd.Flags().GetBool("allow-dirty")
+			if len(dirtyFiles) > 0 && !allowDirty {
+				return utils.NewStageError("Preview Cmd", utils.ExitCodeConfig, "Commit or stash your changes, or pass --allow-dirty to preview them as they are", &utils.DirtyTreeError{Files: dirtyFiles})
+			}
+
+			gitShortHashCmd := exec.Command("sh", "-s", "-")
+			gitShortHashCmd.Stdin = strings.NewReader("git rev-parse --short HEAD")
+			utils.TraceScript("git rev-parse --short HEAD", gitShortHashCmd.Args[3:]...)
+			hashOutput, hashErr := gitShortHashCmd.Output()
+			if hashErr != nil {
+				return utils.NewStageError("Preview Cmd", utils.ExitCodeConfig, "Make a first commit, previews are named after the current commit", fmt.Errorf("issue occurred getting git commit hash: %w", hashErr))
+			}
+			deployHash = strings.TrimSuffix(string(hashOutput), "\n")
+		} else {
+			cwd, _ := os.Getwd()
+			if deployHash, err = utils.ContentHash(cwd); err != nil {
+				return utils.NewStageError("Build context", utils.ExitCodeConfig, "", err)
+			}
+			render.GetLogger(log.Options{Prefix: "Git"}).Warnf("Not a git repository, this preview is named %s after its content. --allow-dirty and the commit in the deploy history are not available", deployHash)
+		}
+
+		envOverridePairs, _ := cmd.Flags().GetStringArray("env")
+		envOverrides, err := utils.ParseEnvOverrides(envOverridePairs)
+		if err != nil {
+			return utils.NewStageError("Env File", utils.ExitCodeConfig, "Pass overrides as --env KEY=VALUE", err)
+		}
+		hasEnvFile := appConfig.Env.File != "" || len(envOverrides) > 0
+
+		if cmd.Flags().Changed("staging-tls") {
+			appConfig.StagingTLS, _ = cmd.Flags().GetBool("staging-tls")
+		}
+		if noTLS, _ := cmd.Flags().GetBool("no-tls"); noTLS {
+			appConfig.TLS.Disabled = true
+		}
+		labels, _ := cmd.Flags().GetStringArray("label")
+		for _, label := range labels {
+			if err := utils.ValidateLabel(label); err != nil {
+				return utils.NewStageError("Labels", utils.ExitCodeConfig, "Pass labels as --label key=value", err)
+			}
+		}
+		appConfig.Labels = append(appConfig.Labels, labels...)
+		if appConfig.StagingTLS && utils.TLSEnabled(appConfig) {
+			render.GetLogger(log.Options{Prefix: "TLS"}).Warn("Using the Let's Encrypt staging resolver - browsers will not trust the certificate for this preview")
 		}
 
-		gitTreeCheck := exec.Command("sh", "-s", "-")
-		gitTreeCheck.Stdin = strings.NewReader(utils.CheckGitTreeScript)
-		output, _ := gitTreeCheck.Output()
-		if string(output) != "all good\n" {
-			render.GetLogger(log.Options{Prefix: "Preview Cmd"}).Error("Please commit any changes to git before deploying a preview environment")
-			os.Exit(1)
+		// a preview of uncommitted changes gets a tag of its own so it isn't mistaken for the commit
+		imageTag := deployHash
+		if len(dirtyFiles) > 0 {
+			dirtySum, err := utils.DirtyDiffSum()
+			if err != nil {
+				return utils.NewStageError("Preview Cmd", utils.ExitCodeConfig, "", err)
+			}
+			imageTag = fmt.Sprintf("%s-dirty-%s", deployHash, dirtySum)
+			render.GetLogger(log.Options{Prefix: "Preview"}).Warnf("Previewing uncommitted changes as %s", imageTag)
 		}
+		imageName, err := utils.AppImage(appConfig, imageTag)
+		if err != nil {
+			return utils.NewStageError("Image", utils.ExitCodeConfig, "", err)
+		}
+		previewURL := utils.PreviewHost(appConfig, deployHash)
+		imgFileName := fmt.Sprintf("%s-%s.tar", appConfig.Name, deployHash)
 
-		gitShortHashCmd := exec.Command("sh", "-s", "-")
-		gitShortHashCmd.Stdin = strings.NewReader("git rev-parse --short HEAD")
-		hashOutput, hashErr := gitShortHashCmd.Output()
-		if hashErr != nil {
-			render.GetLogger(log.Options{Prefix: "Preview Cmd"}).Error("Issue occurred getting git commit hash: %s", hashErr)
-			os.Exit(1)
+		cacheFrom, _ := cmd.Flags().GetString("cache-from-image")
+		noCache, _ := cmd.Flags().GetBool("no-cache")
+		cache, err := utils.GetBuildCache(appConfig, cacheFrom, false, noCache)
+		if err != nil {
+			return utils.NewStageError("Image", utils.ExitCodeConfig, "", err)
+		}
+		timeout, err := utils.GetOperationTimeout(cmd, appConfig)
+		if err != nil {
+			return utils.NewStageError("Timeout", utils.ExitCodeConfig, "", err)
+		}
+		verifyTimeout, err := utils.GetVerifyTimeout(cmd, appConfig)
+		if err != nil {
+			return utils.NewStageError("Timeout", utils.ExitCodeConfig, "", err)
+		}
+		if dryRun, _ := cmd.Flags().GetBool("dry-run"); dryRun {
+			plan, err := getPreviewPlan(appConfig, target, deployHash, imageName, envOverrides, cache, verifyTimeout, ref)
+			if err != nil {
+				return utils.NewStageError("Dry Run", utils.ExitCodeConfig, "", err)
+			}
+			return plan.Print()
+		}
+		if err := utils.GuardTarget(cmd, config, target, appConfig.Name); err != nil {
+			return err
+		}
+		if forceUnlock, _ := cmd.Flags().GetBool("force-unlock"); forceUnlock {
+			return utils.RunForceUnlock(sidekickServer.Address, utils.PreviewLockFile(appConfig.Name, deployHash))
+		}
+		defer os.Remove("docker-compose.yaml")
+		defer os.Remove("encrypted.env")
+		defer os.Remove(imgFileName)
+
+		// a commit is built from an exported copy so the working tree stays as it is
+		buildContext, _ := os.Getwd()
+		if ref != nil {
+			exportDir, cleanup, err := utils.ExportGitRef(*ref)
+			if err != nil {
+				return utils.NewStageError("Git Ref", utils.ExitCodeError, "", err)
+			}
+			defer cleanup()
+			buildContext = exportDir
 		}
-		deployHash := strings.TrimSuffix(string(hashOutput), "\n")
 
 		cmdStages := []render.Stage{
 			render.MakeStage("Validating connection with VPS", "VPS is reachable", false),
@@ -86,7 +259,18 @@ var PreviewCmd = &cobra.Command{
 			render.MakeStage("Moving image to your server", "Image moved and loaded successfully", false),
 			render.MakeStage("Deploying a preview env of your application", "Preview env setup successfully", false),
 		}
-		p := tea.NewProgram(render.TuiModel{
+		if verifyTimeout > 0 {
+			cmdStages = append(cmdStages, render.MakeStage("Waiting for your preview to answer at "+previewURL, "Your preview answers at "+previewURL, true))
+		}
+		notifications := []utils.SidekickNotification{}
+		if noNotify, _ := cmd.Flags().GetBool("no-notify"); !noNotify {
+			notifications = utils.GetNotifications(config, appConfig)
+		}
+		appURL := utils.URLScheme(appConfig) + "://" + previewURL
+		utils.Notify(notifications, utils.NewDeployEvent(utils.DeployStarted, appConfig.Name, utils.MetadataEnvPreview, deployHash, appURL, start, nil))
+		p := render.NewProgram(render.TuiModel{
+			App:         appConfig.Name,
+			Hash:        deployHash,
 			Stages:      cmdStages,
 			BannerMsg:   "Deploying a preview env of your app 😎",
 			ActiveIndex: 0,
@@ -94,178 +278,295 @@ var PreviewCmd = &cobra.Command{
 			AllDone:     false,
 		})
 
+		// set before the error is sent to the TUI so it is visible once p.Run returns
+		var pipelineErr error
+		fail := func(err *utils.StageError) {
+			pipelineErr = err
+			p.Send(render.ErrorMsg{ErrorStr: err.Error()})
+		}
+
+		deadline := utils.StartOperationDeadline("preview", timeout, func(err *utils.StageError) {
+			p.Send(render.ErrorMsg{ErrorStr: err.Error()})
+		})
+		defer deadline.Stop()
+
+		// failed previews go into the history too, it is written once the TUI is done whatever the outcome
+		lock := utils.NewDeployLock(utils.PreviewLockFile(appConfig.Name, deployHash))
+		var lockClient *ssh.Client
+		// closed once the stages below return, after Ctrl-C they still run until the cleanup cuts them off
+		pipelineDone := make(chan struct{})
+		defer func() {
+			// the stages set lockClient and pipelineErr, they are only read once the stages are over
+			<-pipelineDone
+			// an expired deadline already removed the lock along with the rest
+			if lockClient != nil && !deadline.Expired() {
+				if err := lock.Release(utils.SSHExecutor{Client: lockClient}); err != nil {
+					render.GetLogger(log.Options{Prefix: "Preview"}).Warnf("%s, remove it with sidekick preview --force-unlock", err)
+				}
+			}
+			if lockClient != nil {
+				utils.RecordHistory(sidekickServer.Address, appConfig.Name, utils.NewHistoryEntry(utils.HistoryPreview, deployHash, imageName, start, pipelineErr))
+			}
+			status := utils.DeploySucceeded
+			if pipelineErr != nil {
+				status = utils.DeployFailed
+			}
+			utils.Notify(notifications, utils.NewDeployEvent(status, appConfig.Name, utils.MetadataEnvPreview, deployHash, appURL, start, pipelineErr))
+		}()
+
 		go func() {
-			sshClient, err := utils.Login(viper.GetString("serverAddress"), "sidekick")
+			defer close(pipelineDone)
+			sshClient, err := utils.Login(sidekickServer.Address, "sidekick")
 			if err != nil {
-				p.Send(render.ErrorMsg{})
+				fail(utils.NewStageError("Validating connection with VPS", utils.ExitCodeRemote, "Check that the VPS is up and your SSH key is loaded in ssh-agent", err))
+				return
+			}
+			remote := utils.SSHExecutor{Client: sshClient}
+			if err := lock.Acquire(remote, utils.GetLockTimeout(appConfig)); err != nil {
+				sshClient.Close()
+				fail(utils.NewStageError("Preview lock", utils.ExitCodeRemote, "", err))
+				return
+			}
+			lockClient = sshClient
+			deadline.OnExpire(func() {
+				sshClient.Close()
+				utils.AbortRemote(sidekickServer.Address, "rm -f "+lock.Path+"; "+utils.GetAbortStartScript(utils.RemotePreviewDir(appConfig.Name, deployHash), imgFileName))
+			})
+			if appConfig, err = utils.LoadAppState(remote, appConfig); err != nil {
+				fail(utils.NewStageError("Validating connection with VPS", utils.ExitCodeRemote, "", err))
+				return
+			}
+			if stageErr := utils.CheckRouteConflictsStage(remote, utils.RemotePreviewDir(appConfig.Name, deployHash), fmt.Sprintf("%s-%s", appConfig.Name, deployHash), previewURL); stageErr != nil {
+				fail(stageErr)
+				return
+			}
+			if stageErr := utils.CheckNetworksStage(remote, appConfig); stageErr != nil {
+				fail(stageErr)
+				return
 			}
 			p.Send(render.NextStageMsg{})
 
 			dockerEnvProperty := []string{}
 			envFileChecksum := ""
-			if appConfig.Env.File != "" {
-				envErr := utils.HandleEnvFile(appConfig.Env.File, &dockerEnvProperty, &envFileChecksum, sidekickServer.PublicKey)
-				if envErr != nil {
-					panic(envErr)
+			if hasEnvFile {
+				envFileName := appConfig.Env.File
+				if len(envOverrides) > 0 {
+					// overrides go into a throwaway copy so the shared env file stays as is
+					envFileName = ".sidekick.preview.env"
+					defer os.Remove(envFileName)
+					if err := utils.MergeEnvFile(appConfig.Env.File, envOverrides, envFileName); err != nil {
+						fail(utils.NewStageError("Env File", utils.ExitCodeConfig, "", err))
+						return
+					}
+				}
+				if err := utils.HandleEnvFile(envFileName, &dockerEnvProperty, &envFileChecksum, sidekickServer.PublicKey); err != nil {
+					fail(utils.NewStageError("Env File", utils.ExitCodeConfig, "Make sure sops is installed and the env file is valid dotenv", err))
+					return
 				}
 			}
 
-			imageName := fmt.Sprintf("%s:%s", appConfig.Name, deployHash)
-			serviceName := fmt.Sprintf("%s-%s", appConfig.Name, deployHash)
-			previewURL := fmt.Sprintf("%s.%s", deployHash, appConfig.Url)
-			newService := utils.DockerService{
-				Image: imageName,
-				Labels: []string{
-					"traefik.enable=true",
-					fmt.Sprintf("traefik.http.routers.%s.rule=Host(`%s`)", serviceName, previewURL),
-					fmt.Sprintf("traefik.http.services.%s.loadbalancer.server.port=%s", serviceName, fmt.Sprint(appConfig.Port)),
-					fmt.Sprintf("traefik.http.routers.%s.tls=true", serviceName),
-					fmt.Sprintf("traefik.http.routers.%s.tls.certresolver=default", serviceName),
-					"traefik.docker.network=sidekick",
-				},
-				Environment: dockerEnvProperty,
-				Networks: []string{
-					"sidekick",
-				},
-			}
-			newDockerCompose := utils.DockerComposeFile{
-				Services: map[string]utils.DockerService{
-					serviceName: newService,
-				},
-				Networks: map[string]utils.DockerNetwork{
-					"sidekick": {
-						External: true,
-					},
-				},
-			}
+			newDockerCompose := utils.GetPreviewComposeFile(appConfig, sidekickServer, deployHash, imageName, dockerEnvProperty)
 			dockerComposeFile, err := yaml.Marshal(&newDockerCompose)
 			if err != nil {
-				fmt.Printf("Error marshalling YAML: %v\n", err)
+				fail(utils.NewStageError("Compose File", utils.ExitCodeError, "", err))
 				return
 			}
-			err = os.WriteFile("docker-compose.yaml", dockerComposeFile, 0644)
-			if err != nil {
-				fmt.Printf("Error writing file: %v\n", err)
+			if err := os.WriteFile("docker-compose.yaml", dockerComposeFile, 0644); err != nil {
+				fail(utils.NewStageError("Compose File", utils.ExitCodeError, "", err))
 				return
 			}
 
 			cwd, _ := os.Getwd()
-			dockerImage := fmt.Sprintf("%s:%s", appConfig.Name, deployHash)
-			dockerBuildCmd := exec.Command("docker", "build", "--tag", dockerImage, "--progress=plain", "--platform=linux/amd64", cwd)
-			dockerBuildCmdErrPipe, _ := dockerBuildCmd.StderrPipe()
-			go render.SendLogsToTUI(dockerBuildCmdErrPipe, p)
-
-			if dockerBuildErr := dockerBuildCmd.Run(); dockerBuildErr != nil {
-				p.Send(render.ErrorMsg{})
+			dockerBuildCmd := utils.OperationCommand("docker", utils.GetDockerBuildArgs(imageName, "linux/amd64", cache, buildContext)...)
+			if utils.IsStatic(appConfig) {
+				dockerBuildCmd = utils.GetStaticBuildCommand(imageName, "linux/amd64", cache, utils.StaticBuildContext(appConfig, buildContext))
+			}
+			cacheStats, dockerBuildErr := utils.RunDockerBuildWithTUIHook(dockerBuildCmd, p)
+			if dockerBuildErr != nil {
+				fail(utils.NewStageError("Building docker image", utils.ExitCodeBuild, "Make sure docker is running and your Dockerfile builds locally", dockerBuildErr))
+				return
 			}
 
 			time.Sleep(time.Millisecond * 100)
 
 			p.Send(render.NextStageMsg{})
 
-			imgFileName := fmt.Sprintf("%s-%s.tar", appConfig.Name, deployHash)
-			imgSaveCmd := exec.Command("docker", "save", "-o", imgFileName, dockerImage)
+			if skipPreflight, _ := cmd.Flags().GetBool("skip-preflight"); !skipPreflight {
+				size, err := utils.LocalImageSize(imageName)
+				if err != nil {
+					fail(utils.NewStageError("Disk space", utils.ExitCodeBuild, "Pass --skip-preflight to save the image without checking", err))
+					return
+				}
+				if err := utils.CheckLocalDiskSpace(cwd, size); err != nil {
+					fail(utils.NewStageError("Disk space", utils.ExitCodeBuild, utils.PreflightLocalHint, err))
+					return
+				}
+				if err := utils.CheckRemoteDiskSpace(remote, appConfig.Name, size, true); err != nil {
+					fail(utils.NewStageError("Disk space", utils.ExitCodeRemote, utils.PreflightRemoteHint, err))
+					return
+				}
+			}
+
+			imgSaveCmd := utils.OperationCommand("docker", "save", "-o", imgFileName, imageName)
+			utils.TraceExec(imgSaveCmd)
 			imgSaveCmdErrPipe, _ := imgSaveCmd.StderrPipe()
 			go render.SendLogsToTUI(imgSaveCmdErrPipe, p)
 
 			if imgSaveCmdErr := imgSaveCmd.Run(); imgSaveCmdErr != nil {
-				p.Send(render.ErrorMsg{})
+				fail(utils.NewStageError("Saving docker image", utils.ExitCodeBuild, "Check you have enough free disk space", imgSaveCmdErr))
+				return
 			}
 
 			time.Sleep(time.Millisecond * 100)
 
 			p.Send(render.NextStageMsg{})
 
-			_, _, sessionErr0 := utils.RunCommand(sshClient, fmt.Sprintf(`mkdir -p %s/preview/%s`, appConfig.Name, deployHash))
-			if sessionErr0 != nil {
-				p.Send(render.ErrorMsg{ErrorStr: sessionErr0.Error()})
+			if _, err := utils.BootstrapRemoteLayout(utils.SSHExecutor{Client: sshClient}, appConfig.Name); err != nil {
+				fail(utils.NewStageError("Moving image to your server", utils.ExitCodeRemote, "", err))
+				return
+			}
+			if _, _, err := utils.RunCommand(sshClient, fmt.Sprintf("mkdir -p -m 700 %s", utils.RemotePreviewDir(appConfig.Name, deployHash))); err != nil {
+				fail(utils.NewStageError("Moving image to your server", utils.ExitCodeRemote, "", err))
+				return
+			}
+			// loading the new image moves the tag, the one running now is kept for preview rollback
+			history := []string{}
+			if previous, ok := appConfig.PreviewEnvs[deployHash]; ok {
+				history, err = utils.KeepPreviewImage(utils.SSHExecutor{Client: sshClient}, previous, imageName, time.Now())
+				if err != nil {
+					fail(utils.NewStageError("Moving image to your server", utils.ExitCodeRemote, "", err))
+					return
+				}
 			}
 
-			remoteDist := fmt.Sprintf("%s@%s:./%s", "sidekick", viper.GetString("serverAddress"), appConfig.Name)
-			imgMoveCmd := exec.Command("scp", "-C", imgFileName, remoteDist)
-			imgMoveCmdErrorPipe, _ := imgMoveCmd.StderrPipe()
-			go render.SendLogsToTUI(imgMoveCmdErrorPipe, p)
-
-			if imgMovCmdErr := imgMoveCmd.Run(); imgMovCmdErr != nil {
-				p.Send(render.ErrorMsg{})
+			transfer, imgMovCmdErr := utils.MoveImageTar(sshClient, imgFileName, path.Join(appConfig.Name, imgFileName), utils.TransferProgressToTUI(p))
+			if imgMovCmdErr != nil {
+				fail(utils.NewStageError("Moving image to your server", utils.ExitCodeTransfer, "Check the VPS has enough free disk space and run preview again, the chunks already sent are kept", imgMovCmdErr))
+				return
 			}
+			p.Send(render.LogMsg{LogLine: transfer.String() + "\n"})
 
 			time.Sleep(time.Millisecond * 200)
 
 			dockerLoadOutChan, _, sessionErr := utils.RunCommand(sshClient, fmt.Sprintf("cd %s && docker load -i %s && rm %s", appConfig.Name, imgFileName, imgFileName))
+			if sessionErr != nil {
+				fail(utils.NewStageError("Moving image to your server", utils.ExitCodeRemote, "", sessionErr))
+				return
+			}
 			go func() {
 				p.Send(render.LogMsg{LogLine: <-dockerLoadOutChan + "\n"})
 				time.Sleep(time.Millisecond * 50)
 			}()
-			if sessionErr != nil {
-				time.Sleep(time.Millisecond * 100)
-				p.Send(render.ErrorMsg{ErrorStr: sessionErr.Error()})
-			}
 
 			time.Sleep(time.Millisecond * 100)
 			p.Send(render.NextStageMsg{})
 
-			previewFolder := fmt.Sprintf("./%s/preview/%s", appConfig.Name, deployHash)
-			rsyncCmd := exec.Command("rsync", "docker-compose.yaml", fmt.Sprintf("%s@%s:%s", "sidekick", viper.GetString("serverAddress"), previewFolder))
-			rsyncCmErr := rsyncCmd.Run()
-			if rsyncCmErr != nil {
-				p.Send(render.ErrorMsg{ErrorStr: rsyncCmErr.Error()})
+			previewFolder := fmt.Sprintf("./%s", utils.RemotePreviewDir(appConfig.Name, deployHash))
+			rsyncCmd := utils.OperationCommand("rsync", "docker-compose.yaml", fmt.Sprintf("%s@%s:%s", "sidekick", sidekickServer.Address, previewFolder))
+			utils.TraceExec(rsyncCmd)
+			if rsyncCmErr := rsyncCmd.Run(); rsyncCmErr != nil {
+				fail(utils.NewStageError("Deploying preview env", utils.ExitCodeTransfer, "", rsyncCmErr))
+				return
 			}
 
-			if appConfig.Env.File != "" {
-				encryptSync := exec.Command("rsync", "encrypted.env", fmt.Sprintf("%s@%s:%s", "sidekick", viper.GetString("serverAddress"), previewFolder))
-				encryptSyncErrr := encryptSync.Run()
-				if encryptSyncErrr != nil {
-					p.Send(render.ErrorMsg{ErrorStr: encryptSyncErrr.Error()})
+			if hasEnvFile {
+				encryptSync := utils.OperationCommand("rsync", "encrypted.env", fmt.Sprintf("%s@%s:%s", "sidekick", sidekickServer.Address, previewFolder))
+				utils.TraceExec(encryptSync)
+				if encryptSyncErr := encryptSync.Run(); encryptSyncErr != nil {
+					fail(utils.NewStageError("Deploying preview env", utils.ExitCodeTransfer, "", encryptSyncErr))
+					return
 				}
+			}
 
-				runAppCmdOutChan, _, sessionErr1 := utils.RunCommand(sshClient, fmt.Sprintf(`cd %s && export SOPS_AGE_KEY=%s && sops exec-env encrypted.env 'docker compose -p sidekick up -d'`, previewFolder, viper.GetString("secretKey")))
-				go func() {
-					p.Send(render.LogMsg{LogLine: <-runAppCmdOutChan + "\n"})
-					time.Sleep(time.Millisecond * 50)
-				}()
-				if sessionErr1 != nil {
-					p.Send(render.ErrorMsg{ErrorStr: sessionErr1.Error()})
-				}
-			} else {
-				runAppCmdOutChan, _, sessionErr1 := utils.RunCommand(sshClient, fmt.Sprintf(`cd %s && docker compose -p sidekick up -d`, previewFolder))
-				go func() {
-					p.Send(render.LogMsg{LogLine: <-runAppCmdOutChan + "\n"})
-					time.Sleep(time.Millisecond * 50)
-				}()
-				if sessionErr1 != nil {
-					p.Send(render.ErrorMsg{ErrorStr: sessionErr1.Error()})
-				}
+			runAppCmdOutChan, _, sessionErr1 := utils.RunCommand(sshClient, utils.GetUpCommand(appConfig, previewFolder, hasEnvFile, sidekickServer.SecretKey))
+			if sessionErr1 != nil {
+				fail(utils.NewStageError("Deploying preview env", utils.ExitCodeRemote, "Check the preview logs on your VPS with docker logs", sessionErr1))
+				return
 			}
+			go func() {
+				p.Send(render.LogMsg{LogLine: <-runAppCmdOutChan + "\n"})
+				time.Sleep(time.Millisecond * 50)
+			}()
+
 			previewEnvConfig := utils.SidekickPreview{
-				Url:       fmt.Sprintf("https://%s", previewURL),
+				Url:       fmt.Sprintf("%s://%s", utils.URLScheme(appConfig), previewURL),
 				Image:     imageName,
 				CreatedAt: time.Now().Format(time.UnixDate),
+				Dirty:     len(dirtyFiles) > 0,
+				History:   history,
 			}
-			if len(appConfig.PreviewEnvs) == 0 {
-				appConfig.PreviewEnvs = map[string]utils.SidekickPreview{}
+			// only the key names are recorded, values stay in the encrypted file
+			for key := range envOverrides {
+				previewEnvConfig.EnvOverrides = append(previewEnvConfig.EnvOverrides, key)
+			}
+			sort.Strings(previewEnvConfig.EnvOverrides)
+			err = utils.UpdateAppState(remote, &appConfig, func(latest *utils.SidekickAppConfig) {
+				if len(latest.PreviewEnvs) == 0 {
+					latest.PreviewEnvs = map[string]utils.SidekickPreview{}
+				}
+				latest.PreviewEnvs[deployHash] = previewEnvConfig
+			})
+			if err != nil {
+				fail(utils.NewStageError("App State", utils.ExitCodeRemote, "The preview is running but the app state on the server could not be updated", err))
+				return
+			}
+			if verifyTimeout > 0 {
+				time.Sleep(time.Millisecond * 100)
+				p.Send(render.NextStageMsg{})
+				if err := utils.VerifyDeployWithTUIHook(sshClient, previewFolder, fmt.Sprintf("%s-%s", appConfig.Name, deployHash), previewURL, appConfig, verifyTimeout, p); err != nil {
+					fail(utils.NewStageError("Waiting for your preview to answer", utils.ExitCodeRemote, utils.VerifyHint, err))
+					return
+				}
 			}
-			appConfig.PreviewEnvs[deployHash] = previewEnvConfig
-
-			ymlData, _ := yaml.Marshal(&appConfig)
-			os.WriteFile("./sidekick.yml", ymlData, 0644)
-
-			os.Remove("docker-compose.yaml")
-			os.Remove("encrypted.env")
-			os.Remove(imgFileName)
-
-			p.Send(render.AllDoneMsg{Message: "🚀 Deployed successfully in " + time.Since(start).Round(time.Second).String() + ".\n" + "😎 View your app at https://" + previewURL})
 
+			doneMessage := "🚀 Deployed successfully in " + time.Since(start).Round(time.Second).String() + ".\n" + "😎 View your app at " + utils.URLScheme(appConfig) + "://" + previewURL
+			if cacheReport := cacheStats.String(); cacheReport != "" {
+				doneMessage += "\n" + cacheReport
+			}
+			deadline.Stop()
+			p.Send(render.AllDoneMsg{Message: doneMessage})
 		}()
 
-		if _, err := p.Run(); err != nil {
-			fmt.Println("Error running program:", err)
-			os.Exit(1)
+		_, runErr := p.Run()
+		if errors.Is(runErr, tea.ErrInterrupted) {
+			deadline.Cancel()
+			runErr = nil
 		}
+		// closing the connection lets a stage still waiting on the server return
+		if deadline.Expired() {
+			deadline.Cleanup()
+		}
+		<-pipelineDone
+		// a stage cut off by the deadline or Ctrl-C fails with its own error too, the timeout or Ctrl-C is what happened
+		if runErr != nil {
+			pipelineErr = fmt.Errorf("error running program: %w", runErr)
+		} else if deadline.Expired() {
+			pipelineErr = deadline.Err()
+		}
+		return pipelineErr
 	},
 }
 
 func init() {
+	PreviewCmd.Flags().String("verify-timeout", "", "How long the preview gets to answer on its URL before the preview fails, like 5m. 0 skips the check")
+	PreviewCmd.Flags().StringArray("env", []string{}, "Override an env var for this preview only as KEY=VALUE (repeatable)")
+	PreviewCmd.Flags().Bool("no-cache", false, "Build every step of the Dockerfile again instead of reusing the layers of the last build")
+	PreviewCmd.Flags().String("cache-from-image", "", "Image to reuse build cache from, seeding CI runners with the production image speeds up cold builds")
+	PreviewCmd.Flags().String("timeout", "", "Stop the preview and clean up when it takes longer than this, like 15m (default timeout in sidekick.yml, none)")
+	PreviewCmd.Flags().String("commit", "", "Preview a commit, tag or branch instead of the checked out tree, the working tree is left as it is")
+	PreviewCmd.Flags().Bool("allow-dirty", false, "Preview uncommitted changes, the image is tagged <hash>-dirty-<sum of the changes>")
+	PreviewCmd.Flags().Bool("force-unlock", false, "Remove the lock left behind by a preview of this commit that crashed, then exit")
+	PreviewCmd.Flags().Bool("skip-preflight", false, "Skip checking there is enough free disk space here and on your VPS for the image")
+	PreviewCmd.Flags().Bool("no-notify", false, "Preview without telling the notification webhooks of your sidekick config and sidekick.yml")
+	PreviewCmd.Flags().Bool("dry-run", false, "Print the compose file and the commands a preview would run without building or touching your VPS")
+	PreviewCmd.Flags().Bool("no-tls", false, "Serve the preview over plain HTTP")
+	PreviewCmd.Flags().StringArray("label", []string{}, "Add a label to the preview container as key=value for this preview only (repeatable)")
+	PreviewCmd.Flags().Bool("staging-tls", false, "Use the Let's Encrypt staging environment for certs to avoid rate limits (certs are untrusted)")
+	PreviewCmd.MarkFlagsMutuallyExclusive("commit", "allow-dirty")
+	PreviewCmd.MarkFlagsMutuallyExclusive("no-cache", "cache-from-image")
+
 	PreviewCmd.AddCommand(previewList.ListCmd)
 	PreviewCmd.AddCommand(previewRemove.RemoveCmd)
+	PreviewCmd.AddCommand(previewPromote.PromoteCmd)
+	PreviewCmd.AddCommand(previewRollback.RollbackCmd)
 }
@@ -0,0 +1,132 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package previewPromote
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/mightymoud/sidekick/render"
+	"github.com/mightymoud/sidekick/utils"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+var PromoteCmd = &cobra.Command{
+	Use:   "promote [hash]",
+	Short: "Ship the image of a tested preview env to production",
+	Long: `This command reuses the image already loaded on your VPS for a preview env and deploys it to production.
+Nothing is rebuilt so production runs the exact artifact you tested.`,
+	Args:              cobra.ExactArgs(1),
+	ValidArgsFunction: utils.CompletePreviewHashes,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		hash := args[0]
+		config, err := utils.GetSidekickConfigFromCmdContext(cmd)
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
+		appConfig, err := utils.LoadAppConfig()
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
+		target, err := utils.ResolveTarget(cmd, config, appConfig.Server, utils.MetadataEnvProduction)
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
+		server := target.Server
+		appConfig.Network = server.NetworkName()
+		if err := utils.GuardTarget(cmd, config, target, appConfig.Name); err != nil {
+			return err
+		}
+
+		sshClient, err := utils.Login(server.Address, "sidekick")
+		if err != nil {
+			return utils.NewStageError("Promote", utils.ExitCodeRemote, "", fmt.Errorf("unable to login to your VPS: %w", err))
+		}
+		remote := utils.SSHExecutor{Client: sshClient}
+		if appConfig, err = utils.LoadAppState(remote, appConfig); err != nil {
+			return utils.NewStageError("App State", utils.ExitCodeRemote, "", err)
+		}
+		preview, ok := appConfig.PreviewEnvs[hash]
+		if !ok {
+			return utils.NewStageError("Preview Envs", utils.ExitCodeConfig, "", fmt.Errorf("no preview env found for %s - run sidekick preview list to see them", hash))
+		}
+
+		if _, _, err := utils.RunCommand(sshClient, fmt.Sprintf("docker image inspect %s > /dev/null", preview.Image)); err != nil {
+			return utils.NewStageError("Promote", utils.ExitCodeRemote, "", fmt.Errorf("image %s no longer exists on your VPS - deploy a new preview first", preview.Image))
+		}
+
+		dockerEnvProperty := []string{}
+		if appConfig.Env.File != "" {
+			dockerEnvProperty, err = utils.GetDockerEnvProperty(appConfig.Env.File)
+			if err != nil {
+				return utils.NewStageError("Env File", utils.ExitCodeConfig, "", fmt.Errorf("unable to read env file: %w", err))
+			}
+		}
+		// production now runs the preview build, the branch it came from is not recorded
+		metadata := utils.GetDeployMetadata(appConfig.Name, utils.MetadataEnvProduction, "")
+		metadata.GitSha, metadata.GitBranch = hash, ""
+		composeFile, err := yaml.Marshal(utils.GetAppComposeFile(appConfig, appConfig.Name, preview.Image, appConfig.Url, utils.WithMetadataEnv(dockerEnvProperty, metadata)))
+		if err != nil {
+			return utils.NewStageError("Promote", utils.ExitCodeRemote, "", err)
+		}
+		if err := utils.WriteRemoteFile(sshClient, fmt.Sprintf("%s/docker-compose.yaml", appConfig.Name), composeFile); err != nil {
+			return utils.NewStageError("Promote", utils.ExitCodeRemote, "", fmt.Errorf("unable to upload compose file: %w", err))
+		}
+
+		render.GetLogger(log.Options{Prefix: "Promote"}).Infof("Deploying %s to %s", preview.Image, appConfig.Url)
+		if _, _, err := utils.RunCommand(sshClient, utils.GetUpCommand(appConfig, appConfig.Name, appConfig.Env.File != "", server.SecretKey)); err != nil {
+			return utils.NewStageError("Promote", utils.ExitCodeRemote, "", fmt.Errorf("unable to start production with the preview image: %w", err))
+		}
+
+		deployedAt := time.Now().Format(time.UnixDate)
+		cleanedUp := false
+		cleanup, _ := cmd.Flags().GetBool("cleanup")
+		if cleanup {
+			// the image now backs production so only the preview container and folder go
+			cleanupCmd := fmt.Sprintf("%s && rm -rf %s", utils.GetRemoveAppCommand(appConfig, utils.ComposeProject(appConfig.Name, hash)), utils.RemotePreviewDir(appConfig.Name, hash))
+			if len(preview.History) > 0 {
+				cleanupCmd += fmt.Sprintf(" && (docker image rm %s || true)", strings.Join(preview.History, " "))
+			}
+			_, _, err := utils.RunCommand(sshClient, cleanupCmd)
+			if err != nil {
+				render.GetLogger(log.Options{Prefix: "Promote"}).Errorf("Promoted but unable to remove the preview env: %s", err)
+			} else {
+				cleanedUp = true
+			}
+		}
+
+		err = utils.UpdateAppState(remote, &appConfig, func(latest *utils.SidekickAppConfig) {
+			latest.Image = preview.Image
+			latest.LastDeployedAt = deployedAt
+			latest.LastDeployedCommit = hash
+			if cleanedUp {
+				delete(latest.PreviewEnvs, hash)
+			}
+		})
+		if err != nil {
+			return utils.NewStageError("App State", utils.ExitCodeRemote, "The preview is live but the app state on the server could not be updated", err)
+		}
+
+		render.GetLogger(log.Options{Prefix: "Promote"}).Infof("😎 Preview %s is live at %s://%s", hash, utils.URLScheme(appConfig), appConfig.Url)
+		return nil
+	},
+}
+
+func init() {
+	PromoteCmd.Flags().Bool("cleanup", false, "Remove the preview env after promoting it")
+}
@@ -15,117 +15,142 @@ limitations under the License.
 package previewRemove
 
 import (
+	"errors"
 	"fmt"
-	"os"
+	"strings"
 
 	"github.com/charmbracelet/huh"
-	"github.com/charmbracelet/huh/spinner"
 	"github.com/charmbracelet/lipgloss"
 	"github.com/charmbracelet/lipgloss/table"
 	"github.com/charmbracelet/log"
 	"github.com/mightymoud/sidekick/render"
 	"github.com/mightymoud/sidekick/utils"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
-	"gopkg.in/yaml.v3"
 )
 
 var RemoveCmd = &cobra.Command{
-	Use:     "remove",
+	Use:     "remove [hash]",
 	Aliases: []string{"rm"},
 	Short:   "This command removes a preview environment",
 	Long:    "This command removes a preview environment by the git hash associated with them",
-	Run: func(cmd *cobra.Command, args []string) {
-		if configErr := utils.ViperInit(); configErr != nil {
-			render.GetLogger(log.Options{Prefix: "Sidekick Config"}).Fatal("Not found - Run Sidekick init first")
+	Args:    cobra.MaximumNArgs(1),
+	// completion reads sidekick.yml only so it stays instant
+	ValidArgsFunction: utils.CompletePreviewHashes,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, err := utils.GetSidekickConfigFromCmdContext(cmd)
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
 		}
-		if !utils.FileExists("./sidekick.yml") {
-			render.GetLogger(log.Options{Prefix: "Project Config"}).Fatal("Not found in current directory Run sidekick launch")
+		if !utils.FileExists(utils.AppConfigFile) {
+			return utils.NewStageError("Project Config", utils.ExitCodeConfig, "Run sidekick launch", fmt.Errorf("%s not found", utils.AppConfigFile))
 		}
 
 		appConfig, appConfigErr := utils.LoadAppConfig()
 		if appConfigErr != nil {
-			log.Fatalf("Unable to load your config file. Might be corrupted")
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", appConfigErr)
+		}
+
+		target, err := utils.ResolveTarget(cmd, config, appConfig.Server, utils.MetadataEnvPreview)
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
+		if err := utils.GuardTarget(cmd, config, target, appConfig.Name); err != nil {
+			return err
+		}
+		sshClient, err := utils.Login(target.Server.Address, "sidekick")
+		if err != nil {
+			return utils.NewStageError("Login", utils.ExitCodeRemote, "", fmt.Errorf("unable to login to your VPS: %w", err))
+		}
+		remote := utils.SSHExecutor{Client: sshClient}
+		if appConfig, err = utils.LoadAppState(remote, appConfig); err != nil {
+			return utils.NewStageError("App State", utils.ExitCodeRemote, "", err)
 		}
 
 		var selected string
-		var confirm bool
 
 		if len(appConfig.PreviewEnvs) == 0 {
 			render.GetLogger(log.Options{Prefix: "Preview Envs"}).Info("Not Found in current project")
-			os.Exit(0)
+			return nil
 		}
 
-		header := lipgloss.NewStyle().Foreground(lipgloss.Color("77")).MarginTop(1).MarginLeft(1).Render("Currently running preview envs:")
-		tableString := table.New().
-			Border(lipgloss.RoundedBorder()).
-			BorderStyle(lipgloss.NewStyle().Foreground(lipgloss.Color("99"))).
-			StyleFunc(func(row, col int) lipgloss.Style {
-				switch {
-				case row == 0:
-					return lipgloss.NewStyle().Foreground(lipgloss.Color("60")).Align(lipgloss.Center)
-				default:
-					return lipgloss.NewStyle().Foreground(lipgloss.Color("78")).PaddingLeft(1).PaddingRight(1)
-				}
-			}).
-			Headers("Commit", "Image", "Deployed At", "URL")
-
-		hashSlice := []huh.Option[string]{}
-		for v := range appConfig.PreviewEnvs {
-			hashSlice = append(hashSlice, huh.NewOption(v, v))
-			tableString.Row(v, appConfig.PreviewEnvs[v].Image, appConfig.PreviewEnvs[v].CreatedAt, appConfig.PreviewEnvs[v].Url)
-		}
-		fmt.Println(header)
-		fmt.Println(tableString)
-		huh.NewSelect[string]().
-			Title("Which preview env would you like to delete?").
-			Options(hashSlice...).
-			Value(&selected).
-			Run()
-		huh.NewConfirm().
-			Title("Are you sure?").
-			Affirmative("Yes!").
-			Negative("No.").
-			Value(&confirm).
-			Run()
-		if !confirm {
-			os.Exit(0)
+		if len(args) == 1 {
+			selected = args[0]
+			if _, ok := appConfig.PreviewEnvs[selected]; !ok {
+				return utils.NewStageError("Preview Envs", utils.ExitCodeConfig, "", fmt.Errorf("no preview env found for %s - run sidekick preview list to see them", selected))
+			}
 		} else {
-			action := func() {
-				deletePreviewEnv(selected)
+			if !render.IsInteractive() {
+				return utils.NewStageError("Input", utils.ExitCodeConfig, "Pass the hash, like sidekick preview remove <hash> --yes", errors.New("the preview to remove can't be picked in CI mode"))
+			}
+			header := lipgloss.NewStyle().Foreground(lipgloss.Color("77")).MarginTop(1).MarginLeft(1).Render("Currently running preview envs:")
+			tableString := table.New().
+				Border(lipgloss.RoundedBorder()).
+				BorderStyle(lipgloss.NewStyle().Foreground(lipgloss.Color("99"))).
+				StyleFunc(func(row, col int) lipgloss.Style {
+					switch {
+					case row == 0:
+						return lipgloss.NewStyle().Foreground(lipgloss.Color("60")).Align(lipgloss.Center)
+					default:
+						return lipgloss.NewStyle().Foreground(lipgloss.Color("78")).PaddingLeft(1).PaddingRight(1)
+					}
+				}).
+				Headers("Commit", "Image", "Deployed At", "URL")
+
+			hashSlice := []huh.Option[string]{}
+			for v := range appConfig.PreviewEnvs {
+				hashSlice = append(hashSlice, huh.NewOption(v, v))
+				tableString.Row(v, appConfig.PreviewEnvs[v].Image, appConfig.PreviewEnvs[v].CreatedAt, appConfig.PreviewEnvs[v].Url)
 			}
-			spinner.New().
-				Title("Deleting your selected preview environment...").
-				Action(action).
+			fmt.Println(header)
+			fmt.Println(tableString)
+			huh.NewSelect[string]().
+				Title("Which preview env would you like to delete?").
+				Options(hashSlice...).
+				Value(&selected).
 				Run()
-
-			fmt.Println("Preview env deleted successfully!")
 		}
-
+		if ok, err := utils.Confirm(cmd, fmt.Sprintf("Remove preview %s of %s → %s", selected, appConfig.Name, appConfig.PreviewEnvs[selected].Url)); !ok {
+			return err
+		}
+		task := utils.StartTask("Deleting your selected preview environment")
+		if err := deletePreviewEnv(remote, appConfig, selected); err != nil {
+			task.Fail()
+			return err
+		}
+		task.Success("Preview env deleted successfully!")
+		return nil
 	},
 }
 
-func deletePreviewEnv(hash string) {
+func deletePreviewEnv(remote utils.SSHExecutor, appConfig utils.SidekickAppConfig, hash string) error {
+	sshClient := remote.Client
 
-	appConfig, appConfigErr := utils.LoadAppConfig()
-	if appConfigErr != nil {
-		log.Fatalf("Unable to load your config file. Might be corrupted")
+	// previews keep the image they were deployed with, older ones predate registry names
+	image := appConfig.PreviewEnvs[hash].Image
+	if image == "" {
+		image = fmt.Sprintf("%s:%s", utils.AppRepository(appConfig), hash)
 	}
-	sshClient, err := utils.Login(viper.GetString("serverAddress"), "sidekick")
-	if err != nil {
-		log.Fatal("Unable to login to your VPS")
+	removeCmd := fmt.Sprintf("cd %s && %s && docker image rm %s", utils.RemotePreviewDir(appConfig.Name, hash), utils.GetRemoveAppCommand(appConfig, utils.ComposeProject(appConfig.Name, hash)), image)
+	if removeAddons := utils.GetRemovePreviewAddonsCommand(appConfig, hash); removeAddons != "" {
+		removeCmd += " && " + removeAddons
 	}
-
-	_, _, dockerDwnErr := utils.RunCommand(sshClient, fmt.Sprintf("cd %s/preview/%s && docker rm -f sidekick-%s-%s-1 && docker image rm %s:%s", appConfig.Name, hash, appConfig.Name, hash, appConfig.Name, hash))
+	if history := appConfig.PreviewEnvs[hash].History; len(history) > 0 {
+		removeCmd += fmt.Sprintf(" && (docker image rm %s || true)", strings.Join(history, " "))
+	}
+	_, _, dockerDwnErr := utils.RunCommand(sshClient, removeCmd)
 	if dockerDwnErr != nil {
-		log.Fatalf("Issue happened stopping your service: %s", dockerDwnErr)
+		return utils.NewStageError("Preview Envs", utils.ExitCodeRemote, "", fmt.Errorf("issue happened stopping your service: %w", dockerDwnErr))
 	}
-	_, _, folderRmErr := utils.RunCommand(sshClient, fmt.Sprintf("rm -rf %s/preview/%s", appConfig.Name, hash))
+	_, _, folderRmErr := utils.RunCommand(sshClient, fmt.Sprintf("rm -rf %s", utils.RemotePreviewDir(appConfig.Name, hash)))
 	if folderRmErr != nil {
-		log.Fatalf("Issue happened deleting the preview folder: %s", folderRmErr)
+		return utils.NewStageError("Preview Envs", utils.ExitCodeRemote, "", fmt.Errorf("issue happened deleting the preview folder: %w", folderRmErr))
 	}
 
-	delete(appConfig.PreviewEnvs, hash)
-	ymlData, _ := yaml.Marshal(&appConfig)
-	os.WriteFile("./sidekick.yml", ymlData, 0644)
+	err := utils.UpdateAppState(remote, &appConfig, func(latest *utils.SidekickAppConfig) {
+		delete(latest.PreviewEnvs, hash)
+	})
+	if err != nil {
+		return utils.NewStageError("App State", utils.ExitCodeRemote, "The preview is gone but the app state on the server could not be updated", err)
+	}
+	return nil
 }
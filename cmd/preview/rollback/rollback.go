@@ -0,0 +1,125 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package previewRollback
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/mightymoud/sidekick/render"
+	"github.com/mightymoud/sidekick/utils"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+var RollbackCmd = &cobra.Command{
+	Use:   "rollback [hash]",
+	Short: "Put a preview env back on the image it ran before its last deploy",
+	Long: `This command redeploys the previous image of a preview env, it is still on your VPS so nothing is rebuilt.
+The preview keeps its URL and the env file of its last deploy.`,
+	Args:              cobra.ExactArgs(1),
+	ValidArgsFunction: utils.CompletePreviewHashes,
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		start := time.Now()
+		hash := args[0]
+		config, err := utils.GetSidekickConfigFromCmdContext(cmd)
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
+		appConfig, err := utils.LoadAppConfig()
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
+		target, err := utils.ResolveTarget(cmd, config, appConfig.Server, utils.MetadataEnvPreview)
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
+		if err := utils.GuardTarget(cmd, config, target, appConfig.Name); err != nil {
+			return err
+		}
+
+		sshClient, err := utils.Login(target.Server.Address, "sidekick")
+		if err != nil {
+			return utils.NewStageError("Rollback", utils.ExitCodeRemote, "", fmt.Errorf("unable to login to your VPS: %w", err))
+		}
+		remote := utils.SSHExecutor{Client: sshClient}
+		// failed rollbacks go into the history too
+		previousImage := ""
+		defer func() {
+			entry := utils.NewHistoryEntry(utils.HistoryRollback, hash, previousImage, start, err)
+			if historyErr := utils.AppendHistory(remote, appConfig.Name, entry); historyErr != nil {
+				render.GetLogger(log.Options{Prefix: "Rollback"}).Warnf("Could not record the deploy history: %s", historyErr)
+			}
+		}()
+		if appConfig, err = utils.LoadAppState(remote, appConfig); err != nil {
+			return utils.NewStageError("App State", utils.ExitCodeRemote, "", err)
+		}
+		preview, ok := appConfig.PreviewEnvs[hash]
+		if !ok {
+			return utils.NewStageError("Preview Envs", utils.ExitCodeConfig, "Run sidekick preview list to see them", fmt.Errorf("no preview env found for %s", hash))
+		}
+		if len(preview.History) == 0 {
+			return utils.NewStageError("Rollback", utils.ExitCodeConfig, "Only images deployed since this preview env was last redeployed can be rolled back to",
+				fmt.Errorf("no previous image recorded for preview %s", hash))
+		}
+		previousImage = preview.History[len(preview.History)-1]
+
+		if _, _, err := utils.RunCommand(sshClient, fmt.Sprintf("docker image inspect %s > /dev/null", previousImage)); err != nil {
+			return utils.NewStageError("Rollback", utils.ExitCodeRemote, "", fmt.Errorf("image %s no longer exists on your VPS", previousImage))
+		}
+
+		dockerEnvProperty := []string{}
+		if appConfig.Env.File != "" {
+			dockerEnvProperty, err = utils.GetDockerEnvProperty(appConfig.Env.File)
+			if err != nil {
+				return utils.NewStageError("Env File", utils.ExitCodeConfig, "", fmt.Errorf("unable to read env file: %w", err))
+			}
+		}
+		// overrides only live in the encrypted file on the VPS, the compose file still has to name them
+		for _, key := range preview.EnvOverrides {
+			if entry := fmt.Sprintf("%s=${%s}", key, key); !slices.Contains(dockerEnvProperty, entry) {
+				dockerEnvProperty = append(dockerEnvProperty, entry)
+			}
+		}
+		hasEnvFile := appConfig.Env.File != "" || len(preview.EnvOverrides) > 0
+
+		composeFile, err := yaml.Marshal(utils.GetPreviewComposeFile(appConfig, target.Server, hash, previousImage, dockerEnvProperty))
+		if err != nil {
+			return utils.NewStageError("Rollback", utils.ExitCodeError, "", err)
+		}
+		previewFolder := utils.RemotePreviewDir(appConfig.Name, hash)
+		if err := utils.WriteRemoteFile(sshClient, fmt.Sprintf("%s/docker-compose.yaml", previewFolder), composeFile); err != nil {
+			return utils.NewStageError("Rollback", utils.ExitCodeRemote, "", fmt.Errorf("unable to upload compose file: %w", err))
+		}
+		render.GetLogger(log.Options{Prefix: "Rollback"}).Infof("Deploying %s to %s", previousImage, preview.Url)
+		if _, _, err := utils.RunCommand(sshClient, utils.GetUpCommand(appConfig, previewFolder, hasEnvFile, target.Server.SecretKey)); err != nil {
+			return utils.NewStageError("Rollback", utils.ExitCodeRemote, "Check the preview logs on your VPS with docker logs", err)
+		}
+
+		preview.Image = previousImage
+		preview.History = preview.History[:len(preview.History)-1]
+		err = utils.UpdateAppState(remote, &appConfig, func(latest *utils.SidekickAppConfig) {
+			latest.PreviewEnvs[hash] = preview
+		})
+		if err != nil {
+			return utils.NewStageError("App State", utils.ExitCodeRemote, "The preview is rolled back but the app state on the server could not be updated", err)
+		}
+
+		render.GetLogger(log.Options{Prefix: "Rollback"}).Infof("😎 Preview %s is back on %s at %s", hash, previousImage, preview.Url)
+		return nil
+	},
+}
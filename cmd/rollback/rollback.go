@@ -0,0 +1,125 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package rollback
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/mightymoud/sidekick/render"
+	"github.com/mightymoud/sidekick/utils"
+	"github.com/spf13/cobra"
+)
+
+var RollbackCmd = &cobra.Command{
+	Use:   "rollback",
+	Short: "Put your app back on an image it ran before",
+	Long: `This command redeploys an earlier image of your app, it is still on your VPS so nothing is rebuilt.
+Without --to it goes back to the image that ran before the last deploy. Deploys keep the last keepImages images on your VPS to roll back to.`,
+	Example: `  sidekick rollback
+  sidekick rollback --to V3
+  sidekick rollback --to 3f2a1c`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		start := time.Now()
+		config, err := utils.GetSidekickConfigFromCmdContext(cmd)
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
+		appConfig, err := utils.LoadAppConfig()
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
+		target, err := utils.ResolveTarget(cmd, config, appConfig.Server, utils.MetadataEnvProduction)
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
+		if err := utils.GuardTarget(cmd, config, target, appConfig.Name); err != nil {
+			return err
+		}
+
+		sshClient, err := utils.Login(target.Server.Address, "sidekick")
+		if err != nil {
+			return utils.NewStageError("Rollback", utils.ExitCodeRemote, "", fmt.Errorf("unable to login to your VPS: %w", err))
+		}
+		defer sshClient.Close()
+		remote := utils.SSHExecutor{Client: sshClient}
+		// failed rollbacks go into the history too, one that was not confirmed does not
+		image := ""
+		declined := false
+		defer func() {
+			if declined {
+				return
+			}
+			entry := utils.NewHistoryEntry(utils.HistoryRollback, "", image, start, err)
+			if historyErr := utils.AppendHistory(remote, appConfig.Name, entry); historyErr != nil {
+				render.GetLogger(log.Options{Prefix: "Rollback"}).Warnf("Could not record the deploy history: %s", historyErr)
+			}
+		}()
+		if appConfig, err = utils.LoadAppState(remote, appConfig); err != nil {
+			return utils.NewStageError("App State", utils.ExitCodeRemote, "", err)
+		}
+		to, _ := cmd.Flags().GetString("to")
+		if image, err = utils.RollbackImage(appConfig, to); err != nil {
+			return utils.NewStageError("Rollback", utils.ExitCodeConfig, "Only images of deploys since rollback history was added can be rolled back to, pass --to to pick one", err)
+		}
+		if _, _, err := utils.RunCommand(sshClient, fmt.Sprintf("docker image inspect %s > /dev/null", image)); err != nil {
+			return utils.NewStageError("Rollback", utils.ExitCodeRemote, "Raise keepImages in sidekick.yml to keep more images around", fmt.Errorf("image %s no longer exists on your VPS", image))
+		}
+		ok, err := utils.ConfirmProduction(cmd, config, target, fmt.Sprintf("Roll back %s from %s to %s → %s", appConfig.Name, appConfig.Image, image, appConfig.Url))
+		if !ok {
+			declined = true
+			return err
+		}
+
+		composePath := fmt.Sprintf("%s/docker-compose.yaml", appConfig.Name)
+		content, err := utils.RunCommandOutput(sshClient, "cat "+composePath)
+		if err != nil {
+			return utils.NewStageError("Rollback", utils.ExitCodeRemote, "", fmt.Errorf("unable to read the compose file: %w", err))
+		}
+		composeFile, err := utils.SetComposeImage([]byte(content), appConfig.Name, image)
+		if err != nil {
+			return utils.NewStageError("Rollback", utils.ExitCodeRemote, "", err)
+		}
+		if err := utils.WriteRemoteFile(sshClient, composePath, composeFile); err != nil {
+			return utils.NewStageError("Rollback", utils.ExitCodeRemote, "", fmt.Errorf("unable to upload compose file: %w", err))
+		}
+		render.GetLogger(log.Options{Prefix: "Rollback"}).Infof("Deploying %s to %s", image, appConfig.Url)
+		if _, _, err := utils.RunCommand(sshClient, utils.GetUpCommand(appConfig, appConfig.Name, appConfig.Env.File != "", target.Server.SecretKey)); err != nil {
+			return utils.NewStageError("Rollback", utils.ExitCodeRemote, "Check the app logs on your VPS with docker logs", err)
+		}
+
+		err = utils.UpdateAppState(remote, &appConfig, func(latest *utils.SidekickAppConfig) {
+			// the images newer than the one rolled back to leave the history, a second rollback goes further back
+			if i := slices.Index(latest.ImageHistory, image); i >= 0 {
+				latest.ImageHistory = latest.ImageHistory[:i]
+			}
+			latest.Image = image
+			latest.LastDeployedAt = time.Now().Format(time.UnixDate)
+		})
+		if err != nil {
+			return utils.NewStageError("App State", utils.ExitCodeRemote, "The app is rolled back but the app state on the server could not be updated", err)
+		}
+
+		render.GetLogger(log.Options{Prefix: "Rollback"}).Infof("😎 %s is back on %s at %s", appConfig.Name, image, appConfig.Url)
+		return nil
+	},
+}
+
+func init() {
+	RollbackCmd.Flags().String("to", "", "Tag, version or commit of the image to go back to, defaults to the one before the last deploy")
+}
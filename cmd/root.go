@@ -16,14 +16,41 @@ package cmd
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"runtime/debug"
+	"time"
 
+	"github.com/mightymoud/sidekick/cmd/addons"
+	"github.com/mightymoud/sidekick/cmd/apps"
+	"github.com/mightymoud/sidekick/cmd/backup"
+	"github.com/mightymoud/sidekick/cmd/badge"
+	"github.com/mightymoud/sidekick/cmd/cache"
+	"github.com/mightymoud/sidekick/cmd/ci"
+	"github.com/mightymoud/sidekick/cmd/completion"
+	"github.com/mightymoud/sidekick/cmd/compose"
 	"github.com/mightymoud/sidekick/cmd/config"
+	"github.com/mightymoud/sidekick/cmd/cron"
 	"github.com/mightymoud/sidekick/cmd/deploy"
+	"github.com/mightymoud/sidekick/cmd/doctor"
+	"github.com/mightymoud/sidekick/cmd/execute"
+	"github.com/mightymoud/sidekick/cmd/history"
+	"github.com/mightymoud/sidekick/cmd/images"
 	"github.com/mightymoud/sidekick/cmd/initialize"
 	"github.com/mightymoud/sidekick/cmd/launch"
+	"github.com/mightymoud/sidekick/cmd/lifecycle"
+	"github.com/mightymoud/sidekick/cmd/logs"
+	"github.com/mightymoud/sidekick/cmd/observability"
+	"github.com/mightymoud/sidekick/cmd/open"
 	"github.com/mightymoud/sidekick/cmd/preview"
+	"github.com/mightymoud/sidekick/cmd/rollback"
+	"github.com/mightymoud/sidekick/cmd/server"
+	"github.com/mightymoud/sidekick/cmd/stats"
+	"github.com/mightymoud/sidekick/cmd/status"
+	"github.com/mightymoud/sidekick/cmd/version"
+	"github.com/mightymoud/sidekick/render"
 	"github.com/mightymoud/sidekick/utils"
 	"github.com/pterm/pterm"
 	"github.com/spf13/cobra"
@@ -31,25 +58,106 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
-var version = "dev"
+// updateNotice gets the newer release, if any, from the check started before the command
+var updateNotice chan string
 
 var rootCmd = &cobra.Command{
 	Use:     "sidekick",
-	Version: version,
+	Version: utils.Version,
 	Short:   "CLI to self-host all your apps on a single VPS without vendor locking",
 	Long:    `With sidekick you can deploy any number of applications to a single VPS, connect multiple domains and much more.`,
-	PersistentPreRun: func(cmd *cobra.Command, args []string) {
-		initConfig(cmd)
+	// errors are printed by Execute with their hints, usage only shows up for bad flags and args
+	SilenceErrors: true,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+		verbose, _ := cmd.Flags().GetBool("verbose")
+		debug, _ := cmd.Flags().GetBool("debug")
+		utils.SetTraceLevel(verbose, debug)
+		sshRetries, _ := cmd.Flags().GetInt("ssh-retries")
+		utils.SetSSHRetries(sshRetries)
+		insecureHostKey, _ := cmd.Flags().GetBool("insecure-host-key")
+		utils.SetInsecureHostKey(insecureHostKey)
+		quiet, _ := cmd.Flags().GetBool("quiet")
+		plain, _ := cmd.Flags().GetBool("plain")
+		ci := os.Getenv("CI") == "true" || !render.IsTerminal()
+		if cmd.Flags().Changed("ci") {
+			ci, _ = cmd.Flags().GetBool("ci")
+		}
+		render.SetPlain(plain)
+		render.SetQuiet(quiet)
+		render.SetCI(ci)
+		render.DisableColorFromEnv()
+		logFormat, _ := cmd.Flags().GetString("log-format")
+		if err := render.SetLogFormat(logFormat); err != nil {
+			return err
+		}
+		if err := initConfig(cmd); err != nil {
+			return err
+		}
+		// after initConfig, a relative --config is still read from where sidekick was started
+		appConfigFile, _ := cmd.Flags().GetString("app-config")
+		app, _ := cmd.Flags().GetString("app")
+		// badge enable has a --path of its own, it shadows this one
+		if appPath, _ := cmd.InheritedFlags().GetString("path"); appPath != "" {
+			if appConfigFile != "" {
+				return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Pass the folder with --path or the file with --app-config", errors.New("--path and --app-config can't be used together"))
+			}
+			if err := utils.UseAppPath(appPath); err != nil {
+				return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+			}
+		}
+		if err := utils.UseAppConfig(appConfigFile, app); err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
+		if utils.UpdateCheckEnabled() && !render.IsPlain() && !isCompletionCmd(cmd) {
+			updateNotice = make(chan string, 1)
+			go func() { updateNotice <- utils.CheckForUpdate() }()
+		}
+		return nil
+	},
+	PersistentPostRun: func(cmd *cobra.Command, args []string) {
+		if updateNotice == nil {
+			return
+		}
+		// a slow network only costs the notice, the next run picks it up from the cache
+		select {
+		case latest := <-updateNotice:
+			if latest != "" {
+				pterm.Println(pterm.Gray(fmt.Sprintf("A new version of sidekick is available: %s -> %s", utils.Version, latest)))
+			}
+		case <-time.After(200 * time.Millisecond):
+		}
 	},
 }
 
 func Execute() {
-	err := rootCmd.Execute()
-	if err != nil {
-		os.Exit(1)
+	if code := run(); code != 0 {
+		os.Exit(code)
 	}
 }
 
+// run returns the exit code instead of exiting so deferred cleanup runs first
+func run() (code int) {
+	defer utils.StopEnvSSHAgent()
+	defer func() {
+		if r := recover(); r != nil {
+			pterm.Error.Printfln("sidekick crashed: %v", r)
+			if utils.TraceVerbose() {
+				fmt.Fprintln(os.Stderr, string(debug.Stack()))
+			} else {
+				pterm.Info.Println("Run again with --verbose to see the stack trace")
+			}
+			code = utils.ExitCodeError
+		}
+	}()
+
+	if err := rootCmd.Execute(); err != nil {
+		utils.PrintError(err)
+		return utils.ExitCode(err)
+	}
+	return 0
+}
+
 func init() {
 	rootCmd.SetVersionTemplate(`{{println .Version}}`)
 
@@ -61,27 +169,68 @@ func init() {
 	defaultConfigPath := filepath.Join(home, ".config", "sidekick", "default.yaml")
 
 	rootCmd.PersistentFlags().String("config", defaultConfigPath, "Path to sidekick config file")
+	rootCmd.PersistentFlags().String("app-config", "", "Path to the sidekick.yml of the app, relative paths in it resolve from its folder (default ./sidekick.yml)")
+	rootCmd.PersistentFlags().String("path", "", "Folder of the app in a monorepo, with its Dockerfile and sidekick.yml (default the current folder)")
+	rootCmd.PersistentFlags().String("app", "", "App to use when sidekick.yml holds several apps under apps")
+	rootCmd.PersistentFlags().String("context", "", "Sidekick context to target instead of the server pinned in sidekick.yml or the current context")
+	rootCmd.PersistentFlags().BoolP("yes", "y", false, "Skip confirmations, like SIDEKICK_ASSUME_YES=1, protected contexts also need --context")
+	rootCmd.PersistentFlags().Bool("verbose", false, "Log every command sidekick runs locally and on your VPS")
+	rootCmd.PersistentFlags().Bool("ci", false, "No prompts, spinners or colors and timestamped lines, on by default when CI=true or output is not a terminal")
+	rootCmd.PersistentFlags().Bool("plain", false, "Print one line per stage with a timestamp instead of spinners and colors, the default when output is not a terminal")
+	rootCmd.PersistentFlags().Bool("quiet", false, "Only print warnings, errors and the summary at the end")
+	rootCmd.PersistentFlags().String("log-format", render.LogFormatText, "Stage output format: text or json, json prints one event per line on stdout")
+	rootCmd.PersistentFlags().Int("ssh-retries", utils.DefaultSSHRetries, "How many times to reconnect when the SSH connection drops or the server can't be reached")
+	rootCmd.PersistentFlags().Bool("accept-new-hostkey", false, "Trust a new SSH host key for a server that was rebuilt, and pin it instead of the old one")
+	rootCmd.PersistentFlags().Bool("insecure-host-key", false, "Skip checking the SSH host key of the server, anyone in between can pretend to be it")
+	rootCmd.PersistentFlags().Bool("debug", false, "Like --verbose and also log the output of remote commands")
 
 	rootCmd.AddCommand(initialize.InitCmd)
 	rootCmd.AddCommand(preview.PreviewCmd)
 	rootCmd.AddCommand(deploy.DeployCmd)
 	rootCmd.AddCommand(launch.LaunchCmd)
 	rootCmd.AddCommand(config.ConfigCmd)
+	rootCmd.AddCommand(badge.BadgeCmd)
+	rootCmd.AddCommand(status.StatusCmd)
+	rootCmd.AddCommand(apps.AppsCmd)
+	rootCmd.AddCommand(history.HistoryCmd)
+	rootCmd.AddCommand(backup.BackupCmd)
+	rootCmd.AddCommand(backup.RestoreCmd)
+	rootCmd.AddCommand(addons.AddonsCmd)
+	rootCmd.AddCommand(rollback.RollbackCmd)
+	rootCmd.AddCommand(cron.CronCmd)
+	rootCmd.AddCommand(stats.StatsCmd)
+	rootCmd.AddCommand(logs.LogsCmd)
+	rootCmd.AddCommand(compose.ComposeCmd)
+	rootCmd.AddCommand(lifecycle.RestartCmd)
+	rootCmd.AddCommand(lifecycle.StopCmd)
+	rootCmd.AddCommand(lifecycle.StartCmd)
+	rootCmd.AddCommand(execute.ExecCmd)
+	rootCmd.AddCommand(execute.RunCmd)
+	rootCmd.AddCommand(open.OpenCmd)
+	rootCmd.AddCommand(completion.CompletionCmd)
+	rootCmd.AddCommand(cache.CacheCmd)
+	rootCmd.AddCommand(images.ImagesCmd)
+	rootCmd.AddCommand(ci.CiCmd)
+	rootCmd.AddCommand(doctor.DoctorCmd)
+	rootCmd.AddCommand(server.ServerCmd)
+	rootCmd.AddCommand(observability.ObservabilityCmd)
+	rootCmd.AddCommand(version.VersionCmd)
+	rootCmd.RegisterFlagCompletionFunc("context", utils.CompleteContexts)
+	rootCmd.RegisterFlagCompletionFunc("app", utils.CompleteApps)
 }
 
-func initConfig(cmd *cobra.Command) {
+func initConfig(cmd *cobra.Command) error {
 	var config utils.SidekickConfig
 
-	viper.BindEnv("config", "SIDEKICK_CONFIG")
+	if err := utils.ViperInit(); err != nil {
+		return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+	}
 	viper.BindPFlag("config", cmd.Flags().Lookup("config"))
 
 	configPath := viper.GetString("config")
-	content, err := os.ReadFile(configPath)
+	content, fileErr := os.ReadFile(configPath)
 
-	if err != nil {
-		if requireConfigFile(cmd) {
-			pterm.Fatal.Println("Sidekick config not found - Run sidekick init")
-		}
+	if fileErr != nil {
 		config = utils.SidekickConfig{
 			Version:        "1",
 			CurrentContext: "",
@@ -91,27 +240,57 @@ func initConfig(cmd *cobra.Command) {
 	} else {
 		err := yaml.Unmarshal(content, &config)
 		if err != nil {
-			pterm.Fatal.Sprintf("Error unmarshaling the config yaml file: %s", err)
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", fmt.Errorf("error unmarshaling the config yaml file: %w", err))
 		}
 	}
 
 	if config.Version != "1" && !shouldSkipConfigVersionCheck(cmd) {
-		pterm.Fatal.Println("An older version of the config file found. Please run 'sidekick config migrate'.")
+		return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Run sidekick config migrate", errors.New("an older version of the config file found"))
 	}
+	// env values must never end up in a config file that gets saved
+	hostKeySavePath := configPath
+	if !writesConfigFile(cmd) {
+		if envServer, hasEnvServer := utils.ServerFromEnv(config); hasEnvServer {
+			config.ApplyEnvServer(envServer)
+			hostKeySavePath = ""
+		}
+		if err := config.ApplyEnvGlobals(); err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
+	}
+	// without a file the env vars have to give everything a command needs
+	if fileErr != nil && requireConfigFile(cmd) {
+		if missing := utils.MissingConfigValues(config); len(missing) > 0 {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Run sidekick init to create the config, or set the env vars", &utils.MissingConfigError{Path: configPath, Missing: missing})
+		}
+	}
+	if keyPath := viper.GetString("ssh_key_path"); keyPath != "" && os.Getenv(utils.SSHKeyEnv) == "" {
+		if err := utils.UseSSHKeyFile(keyPath); err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Point "+utils.SSHKeyPathEnv+" at a private key without a passphrase", err)
+		}
+	}
+	for _, server := range config.Servers {
+		if err := utils.ValidateRuntime(server.Runtime); err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", fmt.Errorf("server %s: %w", server.Name, err))
+		}
+	}
+	acceptNewHostKey, _ := cmd.Flags().GetBool("accept-new-hostkey")
+	utils.SetHostKeyConfig(&config, hostKeySavePath, acceptNewHostKey)
 
 	ctx := context.WithValue(cmd.Context(), "config", &config)
 	cmd.SetContext(ctx)
+	return nil
 }
 
 func requireConfigFile(cmd *cobra.Command) bool {
 	cmdName := cmd.Name()
 
-	if cmdName == "init" || cmdName == "help" {
+	if cmdName == "init" || cmdName == "help" || cmdName == "version" || isCompletionCmd(cmd) {
 		return false
 	}
 
 	if parentCmd := cmd.Parent(); parentCmd != nil {
-		if parentCmd.Name() == "config" && cmdName == "migrate" {
+		if parentCmd.Name() == "config" && (cmdName == "migrate" || cmdName == "validate") {
 			return false
 		}
 	}
@@ -119,10 +298,29 @@ func requireConfigFile(cmd *cobra.Command) bool {
 	return true
 }
 
+func writesConfigFile(cmd *cobra.Command) bool {
+	if cmd.Name() == "init" {
+		return true
+	}
+	if parentCmd := cmd.Parent(); parentCmd != nil && parentCmd.Name() == "config" {
+		return true
+	}
+	return false
+}
+
+// isCompletionCmd covers printing the scripts and the hidden commands shells call on every tab
+func isCompletionCmd(cmd *cobra.Command) bool {
+	switch cmd.Name() {
+	case "completion", cobra.ShellCompRequestCmd, cobra.ShellCompNoDescRequestCmd:
+		return true
+	}
+	return false
+}
+
 func shouldSkipConfigVersionCheck(cmd *cobra.Command) bool {
 	cmdName := cmd.Name()
 
-	if cmdName == "help" {
+	if cmdName == "help" || cmdName == "version" || isCompletionCmd(cmd) {
 		return true
 	}
 
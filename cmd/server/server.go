@@ -0,0 +1,350 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/huh"
+	"github.com/joho/godotenv"
+	"github.com/mightymoud/sidekick/utils"
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+)
+
+// Traefik needs a moment after a restart to pick up the routers from the docker labels again
+const (
+	routerCheckAttempts = 6
+	routerCheckInterval = 5 * time.Second
+)
+
+var ServerCmd = &cobra.Command{
+	Use:   "server",
+	Short: "Manage the stack sidekick installed on your VPS",
+}
+
+// resolveTarget picks the server like deploy does, honouring the server pinned in sidekick.yml when run in an app folder
+func resolveTarget(cmd *cobra.Command) (*utils.SidekickConfig, utils.Target, error) {
+	config, err := utils.GetSidekickConfigFromCmdContext(cmd)
+	if err != nil {
+		return nil, utils.Target{}, utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Run sidekick init to set up a VPS first", err)
+	}
+	pinnedServer := ""
+	if utils.FileExists(utils.AppConfigFile) {
+		appConfig, err := utils.LoadAppConfig()
+		if err != nil {
+			return nil, utils.Target{}, utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
+		pinnedServer = appConfig.Server
+	}
+	target, err := utils.ResolveTarget(cmd, config, pinnedServer, utils.MetadataEnvProduction)
+	if err != nil {
+		return nil, utils.Target{}, utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Pass --context to pick a server", err)
+	}
+	return config, target, nil
+}
+
+var upgradeCmd = &cobra.Command{
+	Use:   "upgrade",
+	Short: "Upgrade Traefik and the rest of the stack sidekick init set up",
+	Long: `This command brings the Traefik stack on your VPS up to what this version of sidekick sets up, without touching your apps.
+Migrations run in order and the stack version on the VPS moves forward after each one, so an upgrade that was cut off resumes where it stopped.
+Afterwards every app router is checked to still answer like it did before the upgrade.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, target, err := resolveTarget(cmd)
+		if err != nil {
+			return err
+		}
+		if target.Server.CertEmail == "" {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Run sidekick init again to store the Let's Encrypt email", fmt.Errorf("server %s has no certemail", target.Server.Name))
+		}
+
+		sshClient, err := utils.Login(target.Server.Address, "sidekick")
+		if err != nil {
+			return utils.NewStageError("Login", utils.ExitCodeRemote, "Check that the VPS is up and your SSH key is loaded in ssh-agent", err)
+		}
+		defer sshClient.Close()
+		remote := utils.SSHExecutor{Client: sshClient}
+
+		version, err := utils.GetRemoteStackVersion(remote)
+		if err != nil {
+			return utils.NewStageError("Stack Version", utils.ExitCodeRemote, "", err)
+		}
+		if version == 0 {
+			return utils.NewStageError("Stack Version", utils.ExitCodeConfig, "Run sidekick init to set up the server", fmt.Errorf("sidekick is not set up on %s", target.Server.Address))
+		}
+		if version > utils.StackVersion {
+			return utils.NewStageError("Stack Version", utils.ExitCodeConfig, "Update sidekick to upgrade this server", fmt.Errorf("the server is on stack version %d, newer than the %d this sidekick knows", version, utils.StackVersion))
+		}
+		pending := utils.PendingStackMigrations(version, utils.GetStackMigrations(target.Server))
+		if len(pending) == 0 {
+			pterm.Success.Printfln("%s is up to date on stack version %d", target.Server.Name, version)
+			return nil
+		}
+
+		pterm.Info.Printfln("%s is on stack version %d, %d migrations to run:", target.Server.Name, version, len(pending))
+		for _, migration := range pending {
+			pterm.Println(fmt.Sprintf("  %d. %s", migration.Version, migration.Name))
+		}
+		if dryRun, _ := cmd.Flags().GetBool("dry-run"); dryRun {
+			return nil
+		}
+		if err := utils.GuardTarget(cmd, config, target, target.Server.Name); err != nil {
+			return err
+		}
+
+		hosts, err := utils.GetRouterHosts(remote)
+		if err != nil {
+			return utils.NewStageError("App Routers", utils.ExitCodeRemote, "", err)
+		}
+		before := utils.ProbeRouterHosts(remote, hosts)
+
+		for _, migration := range pending {
+			spinner := utils.StartTask(fmt.Sprintf("%d. %s", migration.Version, migration.Name))
+			if _, err := remote.Output(migration.Script); err != nil {
+				spinner.Fail()
+				return utils.NewStageError("Stack Migration", utils.ExitCodeRemote, "Run sidekick server upgrade again to resume", fmt.Errorf("migration %d failed: %w", migration.Version, err))
+			}
+			if err := utils.SetRemoteStackVersion(remote, migration.Version); err != nil {
+				spinner.Fail()
+				return utils.NewStageError("Stack Migration", utils.ExitCodeRemote, "Run sidekick server upgrade again to resume", err)
+			}
+			spinner.Success()
+		}
+
+		spinner := utils.StartTask(fmt.Sprintf("Checking %d app routers", len(hosts)))
+		broken := []string{}
+		for attempt := 1; attempt <= routerCheckAttempts; attempt++ {
+			broken = utils.BrokenRouters(before, utils.ProbeRouterHosts(remote, hosts))
+			if len(broken) == 0 {
+				break
+			}
+			if attempt < routerCheckAttempts {
+				time.Sleep(routerCheckInterval)
+			}
+		}
+		if len(broken) > 0 {
+			spinner.Fail()
+			return utils.NewStageError("App Routers", utils.ExitCodeRemote, "Check docker logs of the traefik container on the server", fmt.Errorf("these hosts stopped answering after the upgrade: %s", strings.Join(broken, ", ")))
+		}
+		spinner.Success(fmt.Sprintf("All %d app routers answer like before", len(hosts)))
+		pterm.Success.Printfln("%s is on stack version %d", target.Server.Name, utils.StackVersion)
+		return nil
+	},
+}
+
+var firewallCmd = &cobra.Command{
+	Use:   "firewall",
+	Short: "Inspect the firewall sidekick init --secure set up",
+}
+
+var firewallStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the active firewall rules on your VPS",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		_, target, err := resolveTarget(cmd)
+		if err != nil {
+			return err
+		}
+		sshClient, err := utils.Login(target.Server.Address, "sidekick")
+		if err != nil {
+			return utils.NewStageError("Login", utils.ExitCodeRemote, "Check that the VPS is up and your SSH key is loaded in ssh-agent", err)
+		}
+		defer sshClient.Close()
+
+		status, err := utils.GetFirewallStatus(utils.SSHExecutor{Client: sshClient})
+		if err != nil {
+			return utils.NewStageError("Firewall", utils.ExitCodeRemote, "", err)
+		}
+		if target.Server.Firewall == "" {
+			pterm.Info.Printfln("The firewall on %s is not managed by sidekick, run sidekick init --secure to set one up", target.Server.Name)
+		}
+		pterm.Println(status)
+		return nil
+	},
+}
+
+var dnsChallengeCmd = &cobra.Command{
+	Use:   "dns-challenge",
+	Short: "Let Traefik get wildcard certs for the preview domain of your apps",
+	Long: `This command adds a certificate resolver to Traefik on your VPS that proves you own a domain through your DNS provider.
+Previews of apps with a previewDomain in sidekick.yml then share one wildcard cert instead of getting a cert each.
+The provider is one of the lego DNS providers Traefik supports, like cloudflare, and the env file holds the credentials it needs.
+The credentials are only stored on the VPS, readable by the sidekick user.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, target, err := resolveTarget(cmd)
+		if err != nil {
+			return err
+		}
+		server := target.Server
+		provider, _ := cmd.Flags().GetString("provider")
+		envFile, _ := cmd.Flags().GetString("env-file")
+		remove, _ := cmd.Flags().GetBool("remove")
+
+		var credentials []byte
+		if remove {
+			server.DNSChallenge = utils.SidekickDNSChallenge{}
+		} else {
+			if provider == "" || envFile == "" {
+				return utils.NewStageError("DNS Challenge", utils.ExitCodeConfig, "Pass --provider and --env-file, like --provider cloudflare --env-file dns.env", errors.New("the DNS provider and its credentials are needed"))
+			}
+			envMap, err := godotenv.Read(envFile)
+			if err != nil {
+				return utils.NewStageError("DNS Challenge", utils.ExitCodeConfig, "Make sure the env file is valid dotenv", err)
+			}
+			content, err := godotenv.Marshal(envMap)
+			if err != nil {
+				return utils.NewStageError("DNS Challenge", utils.ExitCodeConfig, "", err)
+			}
+			credentials = []byte(content + "\n")
+			server.DNSChallenge = utils.SidekickDNSChallenge{Provider: provider}
+		}
+		if server.CertEmail == "" {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Run sidekick init again to store the Let's Encrypt email", fmt.Errorf("server %s has no certemail", server.Name))
+		}
+		if err := utils.GuardTarget(cmd, config, target, server.Name); err != nil {
+			return err
+		}
+
+		sshClient, err := utils.Login(server.Address, "sidekick")
+		if err != nil {
+			return utils.NewStageError("Login", utils.ExitCodeRemote, "Check that the VPS is up and your SSH key is loaded in ssh-agent", err)
+		}
+		defer sshClient.Close()
+		remote := utils.SSHExecutor{Client: sshClient}
+
+		// the compose file is rewritten whole, an older stack would lose its pending migrations
+		version, err := utils.GetRemoteStackVersion(remote)
+		if err != nil {
+			return utils.NewStageError("Stack Version", utils.ExitCodeRemote, "", err)
+		}
+		if version != utils.StackVersion {
+			return utils.NewStageError("Stack Version", utils.ExitCodeConfig, "Run sidekick server upgrade first", fmt.Errorf("the server is on stack version %d, this needs %d", version, utils.StackVersion))
+		}
+
+		spinner := utils.StartTask("Restarting Traefik with the new resolver")
+		if credentials != nil {
+			if _, err := remote.Output(utils.GetDNSChallengeEnvCommand(credentials)); err != nil {
+				spinner.Fail()
+				return utils.NewStageError("DNS Challenge", utils.ExitCodeRemote, "", err)
+			}
+		}
+		if _, err := remote.Output(utils.GetTraefikRestartCommand(server)); err != nil {
+			spinner.Fail()
+			return utils.NewStageError("DNS Challenge", utils.ExitCodeRemote, "Check docker logs of the traefik container on the server", err)
+		}
+		if remove {
+			if _, err := remote.Output("rm -f " + utils.RemoteDNSChallengeEnvFile); err != nil {
+				spinner.Fail()
+				return utils.NewStageError("DNS Challenge", utils.ExitCodeRemote, "", err)
+			}
+		}
+		spinner.Success()
+
+		if err := utils.SaveServer(viper.GetString("config"), server.Name, func(saved *utils.SidekickServer) {
+			saved.DNSChallenge = server.DNSChallenge
+		}); err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeError, "", err)
+		}
+		if remove {
+			pterm.Success.Printfln("Previews on %s get a cert each again, deploy them again to switch", server.Name)
+		} else {
+			pterm.Success.Printfln("Previews of apps with a previewDomain on %s now share a wildcard cert from %s", server.Name, provider)
+		}
+		return nil
+	},
+}
+
+var trustCmd = &cobra.Command{
+	Use:   "trust",
+	Short: "Check the SSH host key of your VPS and pin it after a rebuild",
+	Long: `This command shows the fingerprint of the host key your VPS presents now next to the one sidekick pinned.
+When they differ and you confirm, the new key is pinned in your sidekick config and replaces the old one in ~/.ssh/known_hosts.
+Compare the fingerprint with the one your provider shows in its console, or with ssh-keygen -lf /etc/ssh/ssh_host_ed25519_key.pub on the server.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		_, target, err := resolveTarget(cmd)
+		if err != nil {
+			return err
+		}
+		server := target.Server
+		key, remote, err := utils.FetchHostKey(server.Address)
+		if err != nil {
+			return utils.NewStageError("Host Key", utils.ExitCodeRemote, "Check that the VPS is up and SSH answers on port "+utils.SSHPort, err)
+		}
+
+		rows := pterm.TableData{{"Server", server.Name}, {"Presented", ssh.FingerprintSHA256(key)}}
+		if server.HostKey != "" {
+			pinned, _, _, _, err := ssh.ParseAuthorizedKey([]byte(server.HostKey))
+			if err != nil {
+				return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", fmt.Errorf("the pinned host key of %s is not valid: %w", server.Name, err))
+			}
+			rows = append(rows, []string{"Pinned", ssh.FingerprintSHA256(pinned)})
+			if utils.VerifyPinnedHostKey(server.Address, server.HostKey, key) == nil {
+				pterm.DefaultTable.WithData(rows).Render()
+				pterm.Success.Printfln("%s presents the host key sidekick pinned, nothing to do", server.Name)
+				return nil
+			}
+		}
+		pterm.DefaultTable.WithData(rows).Render()
+
+		confirm := utils.AssumeYes(cmd)
+		if !confirm {
+			if err := utils.RequireInteractive("yes", "confirming the host key"); err != nil {
+				return err
+			}
+			title := fmt.Sprintf("Trust %s as the host key of %s?", ssh.FingerprintSHA256(key), server.Name)
+			if server.HostKey != "" {
+				title = fmt.Sprintf("The host key of %s changed. Only trust it if you rebuilt or reinstalled the server. Trust %s?", server.Name, ssh.FingerprintSHA256(key))
+			}
+			huh.NewConfirm().
+				Title(title).
+				Affirmative("Yes!").
+				Negative("No.").
+				Value(&confirm).
+				Run()
+		}
+		if !confirm {
+			return nil
+		}
+
+		if err := utils.TrustKnownHost(server.Address, remote, key); err != nil {
+			return utils.NewStageError("Host Key", utils.ExitCodeError, "", err)
+		}
+		if err := utils.SaveServer(viper.GetString("config"), server.Name, func(saved *utils.SidekickServer) {
+			saved.HostKey = utils.MarshalHostKey(key)
+		}); err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeError, "", err)
+		}
+		pterm.Success.Printfln("Pinned %s for %s", ssh.FingerprintSHA256(key), server.Name)
+		return nil
+	},
+}
+
+func init() {
+	upgradeCmd.Flags().Bool("dry-run", false, "List the migrations an upgrade would run without changing anything")
+	ServerCmd.AddCommand(upgradeCmd)
+	firewallCmd.AddCommand(firewallStatusCmd)
+	ServerCmd.AddCommand(firewallCmd)
+	dnsChallengeCmd.Flags().String("provider", "", "The lego DNS provider of your domain, like cloudflare or route53")
+	dnsChallengeCmd.Flags().String("env-file", "", "Env file with the credentials of the DNS provider, like CF_DNS_API_TOKEN")
+	dnsChallengeCmd.Flags().Bool("remove", false, "Remove the resolver and the credentials, previews get a cert each again")
+	ServerCmd.AddCommand(dnsChallengeCmd)
+	ServerCmd.AddCommand(trustCmd)
+}
@@ -0,0 +1,165 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package stats
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/mightymoud/sidekick/utils"
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+)
+
+type containerStats struct {
+	Name     string `json:"Name"`
+	CPUPerc  string `json:"CPUPerc"`
+	MemUsage string `json:"MemUsage"`
+	MemPerc  string `json:"MemPerc"`
+	NetIO    string `json:"NetIO"`
+}
+
+var StatsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Show CPU, memory, network and disk usage of your app on the VPS",
+	Long: `This command shows a snapshot of the resources used by the containers of your app and the free disk space
+for docker on your VPS. Use --watch to keep it refreshing while you look into an incident.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, err := utils.GetSidekickConfigFromCmdContext(cmd)
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Run sidekick init to set up a VPS first", err)
+		}
+		appConfig, err := utils.LoadAppConfig()
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
+		server, err := config.FindServer(appConfig.Server)
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Check the server in sidekick.yml exists in your sidekick config", err)
+		}
+
+		sshClient, err := utils.Login(server.Address, "sidekick")
+		if err != nil {
+			return utils.NewStageError("Stats", utils.ExitCodeRemote, "Check that the VPS is up and your SSH key is loaded in ssh-agent", err)
+		}
+		defer sshClient.Close()
+
+		all, _ := cmd.Flags().GetBool("all")
+		watch, _ := cmd.Flags().GetBool("watch")
+		interval, _ := cmd.Flags().GetDuration("interval")
+
+		if !watch {
+			out, err := renderStats(sshClient, appConfig.Name, all)
+			if err != nil {
+				return utils.NewStageError("Stats", utils.ExitCodeRemote, "", err)
+			}
+			fmt.Println(out)
+			return nil
+		}
+
+		area, err := pterm.DefaultArea.Start()
+		if err != nil {
+			return err
+		}
+		defer area.Stop()
+
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt)
+		defer signal.Stop(interrupt)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			out, err := renderStats(sshClient, appConfig.Name, all)
+			if err != nil {
+				out = pterm.Error.Sprintln(err)
+			}
+			area.Update(fmt.Sprintf("%s\n%s", out, pterm.Gray(fmt.Sprintf("Refreshing every %s - press Ctrl+C to stop", interval))))
+
+			select {
+			case <-interrupt:
+				return nil
+			case <-ticker.C:
+			}
+		}
+	},
+}
+
+// memoryWarnPercent is where the memory use of a container is highlighted, it gets OOM killed at its limit
+const memoryWarnPercent = 90
+
+// highlightMemory colors the memory of a container that is close to its limit
+func highlightMemory(stats containerStats) []string {
+	row := []string{stats.Name, stats.CPUPerc, stats.MemUsage, stats.MemPerc, stats.NetIO}
+	var percent float64
+	if _, err := fmt.Sscanf(strings.TrimSuffix(stats.MemPerc, "%"), "%g", &percent); err == nil && percent >= memoryWarnPercent {
+		row[2], row[3] = pterm.Red(stats.MemUsage), pterm.Red(stats.MemPerc)
+	}
+	return row
+}
+
+func renderStats(sshClient *ssh.Client, appName string, all bool) (string, error) {
+	containers, err := utils.AppContainers(utils.SSHExecutor{Client: sshClient}, appName, all)
+	if err != nil {
+		return "", err
+	}
+
+	rows := pterm.TableData{{"Container", "CPU", "Memory", "Memory %", "Net I/O"}}
+	if len(containers) > 0 {
+		output, err := utils.RunCommandOutput(sshClient, fmt.Sprintf("docker stats --no-stream --format '{{json .}}' %s", strings.Join(containers, " ")))
+		if err != nil {
+			return "", err
+		}
+		for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+			var stats containerStats
+			if err := json.Unmarshal([]byte(line), &stats); err != nil {
+				continue
+			}
+			rows = append(rows, highlightMemory(stats))
+		}
+	}
+
+	disk, err := utils.RunCommandOutput(sshClient, `df -h --output=size,used,avail,pcent "$(docker info -f '{{.DockerRootDir}}')" | tail -n1`)
+	if err != nil {
+		return "", err
+	}
+	diskFields := strings.Fields(disk)
+
+	var out strings.Builder
+	if len(rows) == 1 {
+		out.WriteString(pterm.Warning.Sprintln("No running containers found for", appName))
+	} else {
+		table, err := pterm.DefaultTable.WithHasHeader().WithBoxed().WithData(rows).Srender()
+		if err != nil {
+			return "", err
+		}
+		out.WriteString(table + "\n")
+	}
+	if len(diskFields) == 4 {
+		fmt.Fprintf(&out, "Docker disk: %s free of %s (%s used)", diskFields[2], diskFields[0], diskFields[3])
+	}
+	return out.String(), nil
+}
+
+func init() {
+	StatsCmd.Flags().Bool("all", false, "Include the preview envs of the app")
+	StatsCmd.Flags().Bool("watch", false, "Keep refreshing the stats until Ctrl+C")
+	StatsCmd.Flags().Duration("interval", 3*time.Second, "How often --watch refreshes")
+}
@@ -0,0 +1,290 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package status
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/mightymoud/sidekick/utils"
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+)
+
+// remote calls get a short leash so status stays snappy on a struggling VPS
+const (
+	remoteTimeout = 8 * time.Second
+	tlsTimeout    = 3 * time.Second
+)
+
+type ContainerStatus struct {
+	Image     string `json:"image"`
+	State     string `json:"state"`
+	StartedAt string `json:"startedAt,omitempty"`
+	Uptime    string `json:"uptime,omitempty"`
+}
+
+type CertStatus struct {
+	Issuer   string `json:"issuer"`
+	NotAfter string `json:"notAfter"`
+	DaysLeft int    `json:"daysLeft"`
+	Trusted  bool   `json:"trusted"`
+}
+
+type AppStatus struct {
+	Name           string           `json:"name"`
+	Server         string           `json:"server"`
+	Url            string           `json:"url"`
+	Version        string           `json:"version"`
+	Release        string           `json:"release,omitempty"`
+	Commit         string           `json:"commit,omitempty"`
+	LastDeployedAt string           `json:"lastDeployedAt,omitempty"`
+	Container      *ContainerStatus `json:"container,omitempty"`
+	ContainerError string           `json:"containerError,omitempty"`
+	Cert           *CertStatus      `json:"cert,omitempty"`
+	CertError      string           `json:"certError,omitempty"`
+	EnvFile        string           `json:"envFile,omitempty"`
+	EnvInSync      *bool            `json:"envInSync,omitempty"`
+	PreviewEnvs    int              `json:"previewEnvs"`
+}
+
+type containerStatusResult struct {
+	container *ContainerStatus
+	appConfig utils.SidekickAppConfig
+	err       error
+}
+
+var StatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show what is running for the app in the current folder",
+	Long: `This command summarizes the deployed app: the running image and container state on your VPS,
+the TLS certificate served for your domain, whether your local env file matches the deployed one and the preview envs.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, err := utils.GetSidekickConfigFromCmdContext(cmd)
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Run sidekick init to set up a VPS first", err)
+		}
+		appConfig, err := utils.LoadAppConfig()
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "", err)
+		}
+		server, err := config.FindServer(appConfig.Server)
+		if err != nil {
+			return utils.NewStageError("Sidekick Config", utils.ExitCodeConfig, "Check the server in sidekick.yml exists in your sidekick config", err)
+		}
+
+		status := AppStatus{
+			Name:   appConfig.Name,
+			Server: fmt.Sprintf("%s (%s)", server.Name, server.Address),
+			Url:    fmt.Sprintf("%s://%s", utils.URLScheme(appConfig), appConfig.Url),
+		}
+
+		// the VPS and the TLS endpoint are checked at the same time
+		containerResult := make(chan containerStatusResult, 1)
+		go func() {
+			deployed, container, err := getContainerStatus(server, appConfig)
+			containerResult <- containerStatusResult{container, deployed, err}
+		}()
+
+		if !utils.TLSEnabled(appConfig) {
+			status.CertError = "off, the app is served over plain HTTP"
+		} else if cert, err := getCertStatus(appConfig.Url); err != nil {
+			status.CertError = err.Error()
+		} else {
+			status.Cert = cert
+		}
+
+		select {
+		case result := <-containerResult:
+			if result.err != nil {
+				status.ContainerError = result.err.Error()
+			} else {
+				status.Container = result.container
+			}
+			// what is deployed is only known from the state on the server
+			appConfig = result.appConfig
+			status.Version = appConfig.Version
+			status.Release = appConfig.DeployedVersion
+			status.Commit = appConfig.LastDeployedCommit
+			status.LastDeployedAt = appConfig.LastDeployedAt
+			status.PreviewEnvs = len(appConfig.PreviewEnvs)
+		case <-time.After(remoteTimeout):
+			status.ContainerError = fmt.Sprintf("no answer from the VPS after %s", remoteTimeout)
+		}
+
+		if appConfig.Env.File != "" {
+			status.EnvFile = appConfig.Env.File
+			if hash, err := utils.EnvFileHash(appConfig.Env.File); err == nil {
+				inSync := hash == appConfig.Env.Hash
+				status.EnvInSync = &inSync
+			}
+		}
+
+		asJSON, _ := cmd.Flags().GetBool("json")
+		if asJSON {
+			out, err := json.MarshalIndent(status, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(out))
+			return nil
+		}
+		printStatus(status)
+		return nil
+	},
+}
+
+// getContainerStatus also returns appConfig with the state of the app on the server filled in
+func getContainerStatus(server utils.SidekickServer, appConfig utils.SidekickAppConfig) (utils.SidekickAppConfig, *ContainerStatus, error) {
+	sshClient, err := utils.Login(server.Address, "sidekick")
+	if err != nil {
+		return appConfig, nil, err
+	}
+	defer sshClient.Close()
+	if appConfig, err = utils.LoadAppState(utils.SSHExecutor{Client: sshClient}, appConfig); err != nil {
+		return appConfig, nil, err
+	}
+
+	output, err := utils.RunCommandOutput(sshClient, fmt.Sprintf(
+		`timeout 5 docker ps -a --filter label=com.docker.compose.service=%s --format '{{.ID}}' | head -n1 | xargs -r timeout 5 docker inspect -f '{{.Config.Image}}|{{.State.Status}}|{{.State.StartedAt}}'`,
+		appConfig.Name,
+	))
+	if err != nil {
+		return appConfig, nil, err
+	}
+	fields := strings.Split(strings.TrimSpace(output), "|")
+	if len(fields) != 3 {
+		return appConfig, nil, errors.New("no container found for this app")
+	}
+
+	container := &ContainerStatus{
+		Image: fields[0],
+		State: fields[1],
+	}
+	if startedAt, err := time.Parse(time.RFC3339Nano, fields[2]); err == nil {
+		container.StartedAt = startedAt.Format(time.UnixDate)
+		if container.State == "running" {
+			container.Uptime = time.Since(startedAt).Round(time.Second).String()
+		}
+	}
+	return appConfig, container, nil
+}
+
+func getCertStatus(host string) (*CertStatus, error) {
+	dialer := &net.Dialer{Timeout: tlsTimeout}
+	address := net.JoinHostPort(host, "443")
+	trusted := true
+	conn, err := tls.DialWithDialer(dialer, "tcp", address, &tls.Config{ServerName: host})
+	if err != nil {
+		// staging and self signed certs fail verification but their expiry is still worth showing
+		var verifyErr *tls.CertificateVerificationError
+		if !errors.As(err, &verifyErr) {
+			return nil, err
+		}
+		trusted = false
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, &tls.Config{ServerName: host, InsecureSkipVerify: true})
+		if err != nil {
+			return nil, err
+		}
+	}
+	defer conn.Close()
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, errors.New("no certificate served")
+	}
+	return &CertStatus{
+		Issuer:   certs[0].Issuer.CommonName,
+		NotAfter: certs[0].NotAfter.Format(time.UnixDate),
+		DaysLeft: int(time.Until(certs[0].NotAfter).Hours() / 24),
+		Trusted:  trusted,
+	}, nil
+}
+
+func printStatus(status AppStatus) {
+	version := status.Version
+	if status.Release != "" {
+		version = fmt.Sprintf("%s (%s)", status.Release, status.Version)
+	}
+	lines := []string{
+		fmt.Sprintf("URL:           %s", status.Url),
+		fmt.Sprintf("Server:        %s", status.Server),
+		fmt.Sprintf("Version:       %s", version),
+	}
+	if status.Commit != "" {
+		lines = append(lines, fmt.Sprintf("Commit:        %s", status.Commit))
+	}
+	if status.LastDeployedAt != "" {
+		deployedAt := status.LastDeployedAt
+		if parsed, err := time.Parse(time.UnixDate, deployedAt); err == nil {
+			deployedAt = fmt.Sprintf("%s (%s)", deployedAt, utils.FormatDeployAge(parsed, time.Now()))
+		}
+		lines = append(lines, fmt.Sprintf("Deployed at:   %s", deployedAt))
+	}
+
+	if status.Container != nil {
+		state := status.Container.State
+		if status.Container.Uptime != "" {
+			state = fmt.Sprintf("%s for %s", state, status.Container.Uptime)
+		}
+		if status.Container.State == "running" {
+			state = pterm.Green(state)
+		} else {
+			state = pterm.Red(state)
+		}
+		lines = append(lines,
+			fmt.Sprintf("Image:         %s", status.Container.Image),
+			fmt.Sprintf("Container:     %s", state),
+		)
+	} else {
+		lines = append(lines, fmt.Sprintf("Container:     %s", pterm.Red(status.ContainerError)))
+	}
+
+	if status.Cert != nil {
+		cert := fmt.Sprintf("expires %s (%d days) - issued by %s", status.Cert.NotAfter, status.Cert.DaysLeft, status.Cert.Issuer)
+		switch {
+		case !status.Cert.Trusted:
+			cert = pterm.Yellow(cert + " - untrusted")
+		case status.Cert.DaysLeft < 14:
+			cert = pterm.Yellow(cert)
+		}
+		lines = append(lines, fmt.Sprintf("TLS:           %s", cert))
+	} else {
+		lines = append(lines, fmt.Sprintf("TLS:           %s", pterm.Red(status.CertError)))
+	}
+
+	switch {
+	case status.EnvFile == "":
+		lines = append(lines, "Env file:      none")
+	case status.EnvInSync == nil:
+		lines = append(lines, fmt.Sprintf("Env file:      %s", pterm.Yellow(status.EnvFile+" not found locally")))
+	case *status.EnvInSync:
+		lines = append(lines, fmt.Sprintf("Env file:      %s matches the deployed one", status.EnvFile))
+	default:
+		lines = append(lines, fmt.Sprintf("Env file:      %s", pterm.Yellow(status.EnvFile+" changed since the last deploy")))
+	}
+	lines = append(lines, fmt.Sprintf("Preview envs:  %d", status.PreviewEnvs))
+
+	pterm.DefaultBox.WithTitle(status.Name).Println(strings.Join(lines, "\n"))
+}
+
+func init() {
+	StatusCmd.Flags().Bool("json", false, "Print the status as JSON")
+}
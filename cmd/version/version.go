@@ -0,0 +1,30 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package version
+
+import (
+	"fmt"
+
+	"github.com/mightymoud/sidekick/utils"
+	"github.com/spf13/cobra"
+)
+
+var VersionCmd = &cobra.Command{
+	Use:   "version",
+	Short: "Print the version of sidekick and the commit it was built from",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("sidekick %s\ncommit: %s\nbuilt:  %s\n", utils.Version, utils.Commit, utils.BuildDate)
+	},
+}
@@ -0,0 +1,142 @@
+//go:build integration
+
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package integration_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/mightymoud/sidekick/internal/remotetest"
+	"github.com/mightymoud/sidekick/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+var testApp = utils.SidekickAppConfig{
+	Name:    "whoami",
+	Version: "V1",
+	Image:   "whoami",
+	Port:    80,
+	Url:     "whoami.sidekick.test",
+}
+
+// provisionedTarget returns a target set up like sidekick init leaves a VPS
+func provisionedTarget(t *testing.T) (*remotetest.Target, utils.RemoteExecutor) {
+	target := remotetest.StartTarget(t)
+	target.Provision(t, "test@sidekick.test")
+	return target, target.Executor(t, "sidekick")
+}
+
+func writeComposeFile(t *testing.T, remote utils.RemoteExecutor, dir string, composeFile utils.DockerComposeFile) {
+	t.Helper()
+	content, err := yaml.Marshal(composeFile)
+	require.NoError(t, err)
+	require.NoError(t, remote.WriteFile(dir+"/docker-compose.yaml", content))
+}
+
+func containerLabels(t *testing.T, remote utils.RemoteExecutor, service string) string {
+	t.Helper()
+	output, err := remote.Output(fmt.Sprintf(`docker ps --filter label=com.docker.compose.service=%s --format '{{.Labels}}'`, service))
+	require.NoError(t, err)
+	require.NotEmpty(t, strings.TrimSpace(output), "no running container for %s", service)
+	return output
+}
+
+func containerIDs(t *testing.T, remote utils.RemoteExecutor, service string) []string {
+	t.Helper()
+	output, err := remote.Output(fmt.Sprintf("docker ps -q --filter label=com.docker.compose.service=%s", service))
+	require.NoError(t, err)
+	return strings.Fields(output)
+}
+
+func TestRemoteLayout(t *testing.T) {
+	_, remote := provisionedTarget(t)
+
+	created, err := utils.BootstrapRemoteLayout(remote, testApp.Name)
+	require.NoError(t, err)
+	assert.Contains(t, created, "created "+utils.RemoteBackupsDir(testApp.Name))
+
+	problems, err := utils.CheckRemoteLayout(remote, testApp.Name)
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+
+	_, err = remote.Output("chmod 755 " + utils.RemoteSecretsDir(testApp.Name))
+	require.NoError(t, err)
+	problems, _ = utils.CheckRemoteLayout(remote, testApp.Name)
+	assert.Len(t, problems, 1)
+
+	repairs, err := utils.BootstrapRemoteLayout(remote, testApp.Name)
+	require.NoError(t, err)
+	assert.Equal(t, []string{fmt.Sprintf("fixed mode of %s to 700", utils.RemoteSecretsDir(testApp.Name))}, repairs)
+}
+
+// TestLaunchDeployPreview runs the remote half of launch, deploy and preview. The image is pulled on the
+// target instead of built and copied over, the local half needs a port 22 server and ssh-agent.
+func TestLaunchDeployPreview(t *testing.T) {
+	_, remote := provisionedTarget(t)
+	_, err := remote.Output(fmt.Sprintf("docker pull -q traefik/whoami && docker tag traefik/whoami %s", testApp.Name))
+	require.NoError(t, err)
+
+	// launch
+	_, err = utils.BootstrapRemoteLayout(remote, testApp.Name)
+	require.NoError(t, err)
+	metadata := utils.GetDeployMetadata(testApp.Name, utils.MetadataEnvProduction, "")
+	writeComposeFile(t, remote, testApp.Name, utils.GetAppComposeFile(testApp, testApp.Name, testApp.Name, testApp.Url, utils.WithMetadataEnv(nil, metadata)))
+	_, err = remote.Output(utils.GetComposeUpCommand(testApp.Name, false, ""))
+	require.NoError(t, err)
+
+	labels := containerLabels(t, remote, testApp.Name)
+	assert.Contains(t, labels, fmt.Sprintf("traefik.http.routers.%s.rule=Host(`%s`)", testApp.Name, testApp.Url))
+	assert.Contains(t, labels, fmt.Sprintf("traefik.http.routers.%s.tls.certresolver=%s", testApp.Name, utils.DefaultCertResolver))
+	launched := containerIDs(t, remote, testApp.Name)
+	require.Len(t, launched, 1)
+
+	// deploy swaps the container for a new one
+	_, err = remote.Output(utils.GetDeployAppScript(testApp))
+	require.NoError(t, err)
+	deployed := containerIDs(t, remote, testApp.Name)
+	require.Len(t, deployed, 1)
+	assert.NotEqual(t, launched[0], deployed[0])
+	env, err := remote.Output(fmt.Sprintf("docker inspect -f '{{range .Config.Env}}{{println .}}{{end}}' %s", deployed[0]))
+	require.NoError(t, err)
+	assert.Contains(t, env, "SIDEKICK_ENV=production")
+	assert.Contains(t, env, "SIDEKICK_APP="+testApp.Name)
+
+	// preview
+	hash := "abc1234"
+	previewDir := utils.RemotePreviewDir(testApp.Name, hash)
+	previewService := fmt.Sprintf("%s-%s", testApp.Name, hash)
+	previewURL := fmt.Sprintf("%s.%s", hash, testApp.Url)
+	_, err = remote.Output(fmt.Sprintf("mkdir -p %s && docker tag %s %s:%s", previewDir, testApp.Name, testApp.Name, hash))
+	require.NoError(t, err)
+	previewMetadata := utils.GetDeployMetadata(testApp.Name, utils.MetadataEnvPreview, hash)
+	writeComposeFile(t, remote, previewDir, utils.GetAppComposeFile(testApp, previewService, fmt.Sprintf("%s:%s", testApp.Name, hash), previewURL, utils.WithMetadataEnv(nil, previewMetadata)))
+	_, err = remote.Output(utils.GetComposeUpCommand(previewDir, false, ""))
+	require.NoError(t, err)
+
+	labels = containerLabels(t, remote, previewService)
+	assert.Contains(t, labels, fmt.Sprintf("traefik.http.routers.%s.rule=Host(`%s`)", previewService, previewURL))
+	// the preview must not take over the production container
+	assert.Equal(t, deployed, containerIDs(t, remote, testApp.Name))
+
+	problems, err := utils.CheckRemoteLayout(remote, testApp.Name)
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+}
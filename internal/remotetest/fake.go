@@ -0,0 +1,83 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package remotetest has the fakes and the disposable VPS the tests run against.
+// The VPS needs docker on the machine running the tests:
+//
+//	go test -tags integration ./internal/...
+package remotetest
+
+import (
+	"strings"
+	"sync"
+)
+
+type fakeResponse struct {
+	match  string
+	output string
+	err    error
+}
+
+// FakeExecutor is an in memory utils.RemoteExecutor. It records every command and file
+// and answers commands with the first response whose match is part of the command.
+type FakeExecutor struct {
+	mu        sync.Mutex
+	responses []fakeResponse
+	Commands  []string
+	Files     map[string][]byte
+}
+
+func NewFakeExecutor() *FakeExecutor {
+	return &FakeExecutor{Files: map[string][]byte{}}
+}
+
+// On makes commands containing match return output and err, unmatched commands succeed with no output
+func (f *FakeExecutor) On(match string, output string, err error) *FakeExecutor {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses = append(f.responses, fakeResponse{match: match, output: output, err: err})
+	return f
+}
+
+func (f *FakeExecutor) Output(cmd string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Commands = append(f.Commands, cmd)
+	for _, response := range f.responses {
+		if strings.Contains(cmd, response.match) {
+			return response.output, response.err
+		}
+	}
+	return "", nil
+}
+
+func (f *FakeExecutor) WriteFile(path string, content []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Files[path] = append([]byte{}, content...)
+	return nil
+}
+
+// Ran reports whether any command so far contains match
+func (f *FakeExecutor) Ran(match string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, cmd := range f.Commands {
+		if strings.Contains(cmd, match) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,161 @@
+//go:build integration
+
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package remotetest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mightymoud/sidekick/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+const targetImage = "sidekick-test-target"
+
+// Target is a container running sshd and docker-in-docker, removed when the test ends
+type Target struct {
+	Container string
+	// Address is the host:port sshd is published on
+	Address string
+	signer  ssh.Signer
+}
+
+// StartTarget builds and starts a fresh target, the test is skipped when docker is not available
+func StartTarget(t *testing.T) *Target {
+	t.Helper()
+	if err := exec.Command("docker", "info").Run(); err != nil {
+		t.Skip("docker is not available:", err)
+	}
+
+	_, file, _, _ := runtime.Caller(0)
+	contextDir := filepath.Join(filepath.Dir(file), "testdata", "target")
+	if output, err := exec.Command("docker", "build", "--tag", targetImage, contextDir).CombinedOutput(); err != nil {
+		t.Fatalf("failed to build the target image: %s\n%s", err, output)
+	}
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := exec.Command("docker", "run", "--detach", "--privileged",
+		"--env", "DOCKER_TLS_CERTDIR=",
+		"--env", "AUTHORIZED_KEY="+strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))),
+		"--publish", "127.0.0.1::22",
+		targetImage).CombinedOutput()
+	if err != nil {
+		t.Fatalf("failed to start the target: %s\n%s", err, output)
+	}
+	target := &Target{Container: strings.TrimSpace(string(output)), signer: signer}
+	t.Cleanup(func() {
+		exec.Command("docker", "rm", "--force", "--volumes", target.Container).Run()
+	})
+
+	portOutput, err := exec.Command("docker", "port", target.Container, "22/tcp").Output()
+	if err != nil {
+		t.Fatalf("failed to find the ssh port of the target: %s", err)
+	}
+	target.Address = strings.TrimSpace(strings.Split(string(portOutput), "\n")[0])
+
+	root := target.Executor(t, "root")
+	if err := waitFor(60*time.Second, func() error {
+		_, err := root.Output("docker info")
+		return err
+	}); err != nil {
+		t.Fatalf("docker never came up on the target: %s", err)
+	}
+	return target
+}
+
+// Dial logs in as user, retrying while sshd is starting
+func (target *Target) Dial(user string) (*ssh.Client, error) {
+	config := &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(target.signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	}
+	var client *ssh.Client
+	err := waitFor(30*time.Second, func() error {
+		var err error
+		client, err = ssh.Dial("tcp", target.Address, config)
+		return err
+	})
+	return client, err
+}
+
+// Client is Dial that fails the test and closes the connection when the test ends
+func (target *Target) Client(t *testing.T, user string) *ssh.Client {
+	t.Helper()
+	client, err := target.Dial(user)
+	if err != nil {
+		t.Fatalf("failed to log in to the target as %s: %s", user, err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func (target *Target) Executor(t *testing.T, user string) utils.RemoteExecutor {
+	t.Helper()
+	return utils.SSHExecutor{Client: target.Client(t, user)}
+}
+
+// Provision runs the init stages that make sense on the target: the sidekick user and Traefik.
+// Packages and docker come with the image since the apt stages only run on ubuntu.
+func (target *Target) Provision(t *testing.T, email string) {
+	t.Helper()
+	root := target.Executor(t, "root")
+	runStage(t, root, utils.UsersetupStage)
+	// useradd leaves the password locked and alpine's sshd refuses locked users even with a key
+	runStage(t, root, utils.CommandsStage{Name: "Finish user", Commands: []string{"usermod -p '*' sidekick", "usermod -aG docker sidekick"}})
+	runStage(t, target.Executor(t, "sidekick"), utils.GetTraefikStage(email))
+}
+
+func runStage(t *testing.T, remote utils.RemoteExecutor, stage utils.CommandsStage) {
+	t.Helper()
+	for _, cmd := range stage.Commands {
+		if _, err := remote.Output(cmd); err != nil {
+			t.Fatalf("%s failed on %q: %s", stage.Name, cmd, err)
+		}
+	}
+}
+
+func waitFor(timeout time.Duration, check func() error) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := check()
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("gave up after %s: %w", timeout, err)
+		}
+		time.Sleep(time.Second)
+	}
+}
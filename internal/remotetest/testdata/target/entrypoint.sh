@@ -0,0 +1,12 @@
+#!/bin/sh
+set -e
+
+mkdir -p /root/.ssh
+echo "$AUTHORIZED_KEY" > /root/.ssh/authorized_keys
+chmod 700 /root/.ssh
+chmod 600 /root/.ssh/authorized_keys
+
+ssh-keygen -A
+/usr/sbin/sshd
+
+exec dockerd-entrypoint.sh
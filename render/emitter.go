@@ -0,0 +1,259 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package render
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/pterm/pterm"
+	"golang.org/x/term"
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+var (
+	plain     bool
+	quiet     bool
+	ci        bool
+	logFormat = LogFormatText
+)
+
+// SetCI turns off everything that needs a person at a terminal: spinners, styling and prompts
+func SetCI(c bool) {
+	ci = c
+	if ci {
+		SetPlain(true)
+	}
+}
+
+func IsCI() bool {
+	return ci
+}
+
+// IsInteractive is false when nobody can answer a prompt
+func IsInteractive() bool {
+	return !ci && term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// SetPlain swaps the spinners for one line per stage with a timestamp and drops every escape code,
+// for output that goes to a file, watch or a CI log
+func SetPlain(p bool) {
+	plain = p
+	if plain {
+		pterm.DisableStyling()
+	} else {
+		pterm.EnableStyling()
+	}
+}
+
+// SetQuiet only keeps warnings, errors and the message a command ends with.
+// Info and success lines of pterm are dropped, errors and warnings still go through.
+func SetQuiet(q bool) {
+	quiet = q
+	// a nil writer is the default output of pterm
+	var writer io.Writer
+	if quiet {
+		writer = io.Discard
+	}
+	pterm.Info.Writer, pterm.Success.Writer = writer, writer
+}
+
+// DisableColorFromEnv honours NO_COLOR, see https://no-color.org
+func DisableColorFromEnv() {
+	if os.Getenv("NO_COLOR") != "" {
+		pterm.DisableColor()
+	}
+}
+
+// SetLogFormat switches stage output to JSON lines on stdout, everything else pterm prints moves to stderr
+func SetLogFormat(format string) error {
+	switch format {
+	case LogFormatText:
+	case LogFormatJSON:
+		pterm.SetDefaultOutput(os.Stderr)
+	default:
+		return fmt.Errorf("unknown log format %s, use %s or %s", format, LogFormatText, LogFormatJSON)
+	}
+	logFormat = format
+	return nil
+}
+
+// IsPlain is true whenever the interactive UI is off, quiet and JSON output included
+func IsPlain() bool {
+	return plain || quiet || logFormat == LogFormatJSON
+}
+
+func IsQuiet() bool {
+	return quiet
+}
+
+// PrintPlain prints one line of plain output, with a timestamp since these lines are read after the fact
+func PrintPlain(line string) {
+	fmt.Println(time.Now().UTC().Format(time.RFC3339) + " " + line)
+}
+
+func IsJSON() bool {
+	return logFormat == LogFormatJSON
+}
+
+func IsTerminal() bool {
+	return term.IsTerminal(int(os.Stdout.Fd()))
+}
+
+// NewProgram starts the stage TUI. Without it the program runs headless and stage transitions go to an emitter.
+// Signals are left to the command, launch, deploy and preview clean up before they exit.
+func NewProgram(model TuiModel) *tea.Program {
+	switch {
+	case IsJSON():
+		model.emitter = &jsonEmitter{app: model.App, hash: model.Hash}
+	case quiet:
+		model.emitter = &quietEmitter{}
+	case plain:
+		model.emitter = &plainEmitter{}
+	default:
+		return tea.NewProgram(model, tea.WithoutSignalHandler())
+	}
+	return tea.NewProgram(model, tea.WithoutRenderer(), tea.WithInput(nil), tea.WithoutSignalHandler())
+}
+
+// stageEmitter gets every stage transition of a headless TuiModel
+type stageEmitter interface {
+	Begin(banner string)
+	Start(stage Stage)
+	Succeed(stage Stage)
+	Fail(stage Stage, errorStr string)
+	// Progress gets every ProgressMsg of the active stage, emitters only print it every progressStep percent
+	Progress(stage Stage, progress ProgressMsg)
+	Finish(message string)
+}
+
+// progressStep keeps a long transfer to ten lines in a log
+const progressStep = 10
+
+// crossedProgressStep is true when progress is the first message of the stage past another multiple of progressStep
+func crossedProgressStep(stage Stage, progress ProgressMsg) bool {
+	last := -1
+	if stage.Progress != nil {
+		last = stage.Progress.Percent()
+	}
+	return progress.Percent()/progressStep != last/progressStep || last < 0
+}
+
+type plainEmitter struct{}
+
+func (e *plainEmitter) Begin(banner string) {
+	PrintPlain(banner)
+}
+
+func (e *plainEmitter) Start(stage Stage) {
+	PrintPlain("... " + stage.Title)
+}
+
+func (e *plainEmitter) Succeed(stage Stage) {
+	PrintPlain("✔ " + stage.Success)
+}
+
+// Fail also prints the stage logs, sidekick.logs.txt is usually gone with the CI runner
+func (e *plainEmitter) Fail(stage Stage, errorStr string) {
+	PrintPlain("✖ " + stage.Title)
+	for _, line := range stage.Logs {
+		fmt.Println("  " + strings.TrimRight(line, "\n"))
+	}
+}
+
+func (e *plainEmitter) Progress(stage Stage, progress ProgressMsg) {
+	if crossedProgressStep(stage, progress) {
+		PrintPlain(fmt.Sprintf("... %s: %s", stage.Title, progress.Text))
+	}
+}
+
+func (e *plainEmitter) Finish(message string) {
+	PrintPlain(message)
+}
+
+// quietEmitter only prints a failed stage and the summary at the end
+type quietEmitter struct {
+	plainEmitter
+}
+
+func (e *quietEmitter) Begin(banner string) {}
+
+func (e *quietEmitter) Start(stage Stage) {}
+
+func (e *quietEmitter) Succeed(stage Stage) {}
+
+func (e *quietEmitter) Progress(stage Stage, progress ProgressMsg) {}
+
+type StageEvent struct {
+	Time       string `json:"time"`
+	App        string `json:"app,omitempty"`
+	Hash       string `json:"hash,omitempty"`
+	Stage      string `json:"stage,omitempty"`
+	Status     string `json:"status"`
+	DurationMs int64  `json:"durationMs,omitempty"`
+	Percent    int    `json:"percent,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Message    string `json:"message,omitempty"`
+}
+
+type jsonEmitter struct {
+	app          string
+	hash         string
+	started      time.Time
+	stageStarted time.Time
+}
+
+func (e *jsonEmitter) emit(event StageEvent) {
+	event.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	event.App, event.Hash = e.app, e.hash
+	line, _ := json.Marshal(event)
+	fmt.Println(string(line))
+}
+
+func (e *jsonEmitter) Begin(banner string) {
+	e.started = time.Now()
+}
+
+func (e *jsonEmitter) Start(stage Stage) {
+	e.stageStarted = time.Now()
+	e.emit(StageEvent{Stage: stage.Title, Status: "started"})
+}
+
+func (e *jsonEmitter) Succeed(stage Stage) {
+	e.emit(StageEvent{Stage: stage.Title, Status: "succeeded", DurationMs: time.Since(e.stageStarted).Milliseconds()})
+}
+
+func (e *jsonEmitter) Fail(stage Stage, errorStr string) {
+	e.emit(StageEvent{Stage: stage.Title, Status: "failed", DurationMs: time.Since(e.stageStarted).Milliseconds(), Error: strings.TrimSpace(errorStr)})
+}
+
+func (e *jsonEmitter) Progress(stage Stage, progress ProgressMsg) {
+	if crossedProgressStep(stage, progress) {
+		e.emit(StageEvent{Stage: stage.Title, Status: "progress", Percent: progress.Percent(), Message: progress.Text})
+	}
+}
+
+func (e *jsonEmitter) Finish(message string) {
+	e.emit(StageEvent{Status: "done", DurationMs: time.Since(e.started).Milliseconds(), Message: message})
+}
@@ -37,9 +37,21 @@ var (
 	pendingStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("240")).MarginLeft(1)
 	allDoneStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("69")).MarginTop(1).MarginLeft(1).MarginBottom(1)
 	appStyle     = lipgloss.NewStyle()
+	// progressStyle lines the bar up with the stage title after the spinner
+	progressStyle     = lipgloss.NewStyle().MarginLeft(4)
+	progressDoneStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("63"))
+	progressTodoStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("240"))
 )
 
+// progressBarWidth is the number of cells of the bar, each one is 2.5%
+const progressBarWidth = 40
+
 func (m TuiModel) Init() tea.Cmd {
+	if m.emitter != nil {
+		m.emitter.Begin(m.BannerMsg)
+		m.emitter.Start(m.Stages[m.ActiveIndex])
+		return nil
+	}
 	return m.Stages[m.ActiveIndex].Spinner.Tick
 }
 
@@ -48,6 +60,10 @@ func (m TuiModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 	case tea.KeyMsg:
 		m.Quitting = true
+		// Run returns tea.ErrInterrupted so the command cancels what is still running
+		if msg.Type == tea.KeyCtrlC {
+			return m, tea.Interrupt
+		}
 
 		return m, tea.Quit
 
@@ -72,17 +88,43 @@ func (m TuiModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.Stages[m.ActiveIndex] = logStage
 
 		WriteStageLogs(logStage, m.ActiveIndex)
+		if m.emitter != nil {
+			m.emitter.Fail(logStage, msg.ErrorStr)
+		}
 
 		return m, tea.Quit
 
 	case NextStageMsg:
+		if m.emitter != nil {
+			m.emitter.Succeed(m.Stages[m.ActiveIndex])
+			m.ActiveIndex = m.ActiveIndex + 1
+			m.emitter.Start(m.Stages[m.ActiveIndex])
+			return m, nil
+		}
 		m.ActiveIndex = m.ActiveIndex + 1
 
 		return m, m.Stages[m.ActiveIndex].Spinner.Tick
 
+	case ProgressMsg:
+		if msg.Total <= 0 {
+			return m, nil
+		}
+		stage := m.Stages[m.ActiveIndex]
+		if m.emitter != nil {
+			m.emitter.Progress(stage, msg)
+		}
+		stage.Progress = &msg
+		m.Stages[m.ActiveIndex] = stage
+
+		return m, nil
+
 	case AllDoneMsg:
 		m.AllDone = true
 		m.FinalMessage = msg.Message
+		if m.emitter != nil {
+			m.emitter.Succeed(m.Stages[m.ActiveIndex])
+			m.emitter.Finish(m.FinalMessage)
+		}
 
 		return m, tea.Quit
 
@@ -113,6 +155,9 @@ func (m TuiModel) View() string {
 			} else if index == m.ActiveIndex {
 				if !stage.HasError {
 					printSlice = append(printSlice, stage.Spinner.View()+stage.Title)
+					if stage.Progress != nil {
+						printSlice = append(printSlice, progressStyle.Render(renderProgressBar(*stage.Progress)+" "+stage.Progress.Text))
+					}
 				} else {
 					u := tree.Root("⚠ " + stage.Title).Child(stage.Logs)
 					printSlice = append(printSlice, errorStyle.Render(u.String()))
@@ -161,6 +206,11 @@ func (m TuiModel) View() string {
 	return appStyle.Render(s)
 }
 
+func renderProgressBar(progress ProgressMsg) string {
+	done := progress.Percent() * progressBarWidth / 100
+	return progressDoneStyle.Render(strings.Repeat("█", done)) + progressTodoStyle.Render(strings.Repeat("░", progressBarWidth-done))
+}
+
 func getLogContainerStyle(m TuiModel) lipgloss.Style {
 	return lipgloss.
 		NewStyle().
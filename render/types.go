@@ -32,6 +32,21 @@ type ErrorMsg struct {
 }
 type NextStageMsg struct{}
 
+// ProgressMsg turns the spinner of the active stage into a progress bar, Text goes next to it
+type ProgressMsg struct {
+	Done  int64
+	Total int64
+	Text  string
+}
+
+// Percent is 0 to 100, a total that is not known yet is 0
+func (m ProgressMsg) Percent() int {
+	if m.Total <= 0 {
+		return 0
+	}
+	return int(min(m.Done, m.Total) * 100 / m.Total)
+}
+
 type Stage struct {
 	Title    string
 	Success  string
@@ -39,6 +54,8 @@ type Stage struct {
 	Logs     []string
 	HasLogs  bool
 	HasError bool
+	// Progress is set once the stage knows how far along it is
+	Progress *ProgressMsg
 }
 
 type TuiModel struct {
@@ -51,6 +68,10 @@ type TuiModel struct {
 	AllDone        bool
 	BannerMsg      string
 	FinalMessage   string
+	// App and Hash tag the JSON stage events
+	App     string
+	Hash    string
+	emitter stageEmitter
 }
 
 type buildMsg struct {
@@ -22,6 +22,7 @@ import (
 	"github.com/charmbracelet/lipgloss"
 	"github.com/charmbracelet/log"
 	"github.com/erikgeiser/promptkit/textinput"
+	"github.com/muesli/termenv"
 	"github.com/pterm/pterm"
 	"github.com/pterm/pterm/putils"
 )
@@ -46,27 +47,37 @@ func getDefaultTextInput(prompt string, defaultValue string, placeholder string)
 	return input
 }
 
-func GenerateTextQuestion(question string, defaultAnswer string, placeholder string) string {
+func GenerateTextQuestion(question string, defaultAnswer string, placeholder string) (string, error) {
 	input := getDefaultTextInput(question, defaultAnswer, placeholder)
 	userAnswer, err := input.RunPrompt()
 
 	if err != nil {
-		GetLogger(log.Options{Prefix: "Input"}).Fatalf(" %s", err)
+		return "", err
 	}
 
 	if defaultAnswer != "" && userAnswer == "" {
-		return defaultAnswer
+		return defaultAnswer, nil
 	}
 
-	return userAnswer
+	return userAnswer, nil
 }
 
 func GetLogger(options log.Options) *log.Logger {
 	options.ReportCaller = false
 	options.ReportTimestamp = true
 	options.TimeFormat = time.Kitchen
+	if plain {
+		options.TimeFormat = time.RFC3339
+	}
+	if quiet && options.Level < log.WarnLevel {
+		options.Level = log.WarnLevel
+	}
 
-	return log.NewWithOptions(os.Stderr, options)
+	logger := log.NewWithOptions(os.Stderr, options)
+	if plain {
+		logger.SetColorProfile(termenv.Ascii)
+	}
+	return logger
 }
 
 func RenderSidekickBig() {
@@ -79,7 +90,8 @@ func RenderSidekickBig() {
 
 }
 
-func RenderKeyValidation(resultLines []string, keyHash string, hostname string) {
+// RenderKeyValidation shows the fingerprint of a server key and returns whether the user trusts it
+func RenderKeyValidation(resultLines []string, keyHash string, hostname string) bool {
 	startColor := pterm.NewRGB(0, 255, 255)
 	endColor := pterm.NewRGB(255, 0, 255)
 
@@ -91,15 +103,13 @@ func RenderKeyValidation(resultLines []string, keyHash string, hostname string)
 	}
 	prompt := pterm.DefaultInteractiveContinue
 
-	pterm.DefaultCenter.Printf(pterm.FgYellow.Sprintf("This is the ASCII art and fingerprint of your VPS's public key at %s", hostname))
-	pterm.DefaultCenter.Printf(pterm.FgYellow.Sprint("Please confirm you want to continue with the connection"))
-	pterm.DefaultCenter.Printf(pterm.FgYellow.Sprint("Sidekick will add this host/key pair to known_hosts"))
+	pterm.DefaultCenter.Print(pterm.FgYellow.Sprintf("This is the ASCII art and fingerprint of your VPS's public key at %s", hostname))
+	pterm.DefaultCenter.Print(pterm.FgYellow.Sprint("Please confirm you want to continue with the connection"))
+	pterm.DefaultCenter.Print(pterm.FgYellow.Sprint("Sidekick will pin this key and add it to known_hosts"))
 	pterm.Println()
 
 	prompt.DefaultText = "Would you like to proceed?"
 	prompt.Options = []string{"yes", "no"}
-	if result, _ := prompt.Show(); result != "yes" {
-		pterm.Error.Println("In order to continue, you need to accept this.")
-		os.Exit(0)
-	}
+	result, _ := prompt.Show()
+	return result == "yes"
 }
@@ -0,0 +1,312 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/joho/godotenv"
+)
+
+const (
+	AddonPostgres = "postgres"
+	AddonRedis    = "redis"
+	// DefaultPostgresVersion is pinned so a deploy never moves the database to another major on its own
+	DefaultPostgresVersion = "16.4"
+	DefaultRedisVersion    = "7.2"
+	// DefaultAddonEnvFile is created for addons of an app that has no env file yet
+	DefaultAddonEnvFile = ".env"
+	// AddonsNetwork is private to the compose project of the app, addons on it are out of reach of Traefik and other apps
+	AddonsNetwork = "addons"
+)
+
+// AddonTypes are the addons sidekick addons add knows
+var AddonTypes = []string{AddonPostgres, AddonRedis}
+
+// AddonService is the compose service of addon, named after the app as it shares the sidekick network with other apps
+func AddonService(appName string, addonType string) string {
+	return fmt.Sprintf("%s-%s", appName, addonType)
+}
+
+func addonVolume(addonType string) string {
+	return addonType + "-data"
+}
+
+// AddonVolume is the docker volume holding the data of addon, compose prefixes it with the project
+func AddonVolume(appName string, addonType string) string {
+	return fmt.Sprintf("%s_%s", ComposeProject(appName, ""), addonVolume(addonType))
+}
+
+// addonsNetworkName is the addons network of production as docker names it, shared addons are reached on it from previews
+func addonsNetworkName(appName string) string {
+	return fmt.Sprintf("%s_%s", ComposeProject(appName, ""), AddonsNetwork)
+}
+
+// FindAddon returns the index of the addon of addonType in appConfig, -1 when the app doesn't have it
+func FindAddon(appConfig SidekickAppConfig, addonType string) int {
+	for i, addon := range appConfig.Addons {
+		if addon.Type == addonType {
+			return i
+		}
+	}
+	return -1
+}
+
+// ValidateAddonType checks sidekick knows how to run addonType
+func ValidateAddonType(addonType string) error {
+	for _, known := range AddonTypes {
+		if addonType == known {
+			return nil
+		}
+	}
+	return fmt.Errorf("%q is not an addon sidekick knows, use one of %s", addonType, strings.Join(AddonTypes, ", "))
+}
+
+// NewAddon is addonType at the version sidekick pins it to
+func NewAddon(addonType string) SidekickAddon {
+	if addonType == AddonRedis {
+		return SidekickAddon{Type: addonType, Version: DefaultRedisVersion}
+	}
+	return SidekickAddon{Type: addonType, Version: DefaultPostgresVersion}
+}
+
+// passwordVar starts with _ so it is not passed on to the app container, the app gets the URL of the addon
+func passwordVar(addonType string) string {
+	return fmt.Sprintf("_%s_PASSWORD", strings.ToUpper(addonType))
+}
+
+// AddonURLVar is the env var the app finds the addon at
+func AddonURLVar(addonType string) string {
+	if addonType == AddonRedis {
+		return "REDIS_URL"
+	}
+	return "DATABASE_URL"
+}
+
+// AddonKeepsData is true when addon has a volume that outlives its container
+func AddonKeepsData(addon SidekickAddon) bool {
+	return addon.Type != AddonRedis || addon.Persist
+}
+
+// hasPreviewInstance is true when previews run an addon of their own instead of reaching the one of production
+func hasPreviewInstance(addon SidekickAddon) bool {
+	return addon.Type == AddonRedis && !addon.Shared
+}
+
+func getAddonService(appName string, addon SidekickAddon, preview bool, network string) DockerService {
+	password := fmt.Sprintf("${%s}", passwordVar(addon.Type))
+	if addon.Type == AddonRedis {
+		command := "redis-server --requirepass " + password
+		service := DockerService{
+			Image:    fmt.Sprintf("redis:%s-alpine", addon.Version),
+			Restart:  "unless-stopped",
+			Networks: []string{AddonsNetwork},
+			HealthCheck: Healthcheck{
+				Test:     []string{"CMD-SHELL", fmt.Sprintf("redis-cli --no-auth-warning -a %s ping | grep -q PONG", password)},
+				Interval: "5s",
+				Timeout:  "5s",
+				Retries:  10,
+			},
+		}
+		// the redis of a preview goes away with it
+		if AddonKeepsData(addon) && !preview {
+			command += " --appendonly yes"
+			service.Volumes = []string{addonVolume(addon.Type) + ":/data"}
+		}
+		service.Command = command
+		return service
+	}
+	return DockerService{
+		Image:   fmt.Sprintf("postgres:%s-alpine", addon.Version),
+		Restart: "unless-stopped",
+		Volumes: []string{addonVolume(addon.Type) + ":/var/lib/postgresql/data"},
+		// no ports, the app reaches it by its service name on the network it shares with Traefik
+		Networks: []string{network},
+		Environment: []string{
+			"POSTGRES_USER=" + appName,
+			"POSTGRES_DB=" + appName,
+			"POSTGRES_PASSWORD=" + password,
+		},
+		HealthCheck: Healthcheck{
+			Test:     []string{"CMD-SHELL", fmt.Sprintf("pg_isready -U %s -d %s", appName, appName)},
+			Interval: "5s",
+			Timeout:  "5s",
+			Retries:  10,
+		},
+	}
+}
+
+// addAddonServices puts the addons of the app next to serviceName, which waits for them to be healthy.
+// Previews get a redis of their own unless it is shared, every other addon is the one of production.
+func addAddonServices(composeFile *DockerComposeFile, appConfig SidekickAppConfig, serviceName string) {
+	preview := serviceName != appConfig.Name
+	app := composeFile.Services[serviceName]
+	for _, addon := range appConfig.Addons {
+		if addon.Type == AddonRedis {
+			network := DockerNetwork{}
+			if preview && addon.Shared {
+				network = DockerNetwork{External: true, Extra: map[string]any{"name": addonsNetworkName(appConfig.Name)}}
+			}
+			if composeFile.Networks == nil {
+				composeFile.Networks = map[string]DockerNetwork{}
+			}
+			composeFile.Networks[AddonsNetwork] = network
+			if !slices.Contains(app.Networks, AddonsNetwork) {
+				app.Networks = append(app.Networks, AddonsNetwork)
+			}
+		}
+		if preview && !hasPreviewInstance(addon) {
+			continue
+		}
+		name := AddonService(appConfig.Name, addon.Type)
+		service := getAddonService(appConfig.Name, addon, preview, AppNetwork(appConfig))
+		composeFile.Services[name] = service
+		if len(service.Volumes) > 0 {
+			if composeFile.Volumes == nil {
+				composeFile.Volumes = map[string]DockerVolume{}
+			}
+			composeFile.Volumes[addonVolume(addon.Type)] = DockerVolume{}
+		}
+		if app.DependsOn == nil {
+			app.DependsOn = map[string]DependsOn{}
+		}
+		app.DependsOn[name] = DependsOn{Condition: "service_healthy"}
+	}
+	composeFile.Services[serviceName] = app
+}
+
+// GetAddonEnv is what the app and the addon need in the env file, password is generated once and kept there
+func GetAddonEnv(appName string, addon SidekickAddon, password string) [][2]string {
+	host := AddonService(appName, addon.Type)
+	url := fmt.Sprintf("postgres://%s:%s@%s:5432/%s", appName, password, host, appName)
+	if addon.Type == AddonRedis {
+		url = fmt.Sprintf("redis://:%s@%s:6379", password, host)
+	}
+	return [][2]string{
+		{AddonURLVar(addon.Type), url},
+		{passwordVar(addon.Type), password},
+	}
+}
+
+// AddonEnvKeys are the keys GetAddonEnv writes
+func AddonEnvKeys(addonType string) []string {
+	return []string{AddonURLVar(addonType), passwordVar(addonType)}
+}
+
+// GenerateAddonPassword is url safe so it can go into DATABASE_URL as is
+func GenerateAddonPassword() (string, error) {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// ExistingAddonPassword is the password an earlier addons add left in envFile.
+// The data volume outlives addons remove, reusing it keeps the database reachable when the addon comes back.
+func ExistingAddonPassword(envFile string, addonType string) string {
+	env, err := godotenv.Read(envFile)
+	if err != nil {
+		return ""
+	}
+	return env[passwordVar(addonType)]
+}
+
+// SetEnvVars replaces or adds vars in envFile, creating it when it doesn't exist. Other lines are kept as they are.
+func SetEnvVars(envFile string, vars [][2]string) error {
+	keys := make([]string, len(vars))
+	for i, v := range vars {
+		keys[i] = v[0]
+	}
+	lines, err := envLinesWithout(envFile, keys)
+	if err != nil {
+		return err
+	}
+	for _, v := range vars {
+		lines = append(lines, fmt.Sprintf("%s=%s", v[0], v[1]))
+	}
+	return os.WriteFile(envFile, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+}
+
+// RemoveEnvVars drops keys from envFile, a missing file has nothing to remove
+func RemoveEnvVars(envFile string, keys []string) error {
+	if !FileExists(envFile) {
+		return nil
+	}
+	lines, err := envLinesWithout(envFile, keys)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(envFile, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+}
+
+func envLinesWithout(envFile string, keys []string) ([]string, error) {
+	file, err := os.Open(envFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	lines := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		key, _, _ := strings.Cut(strings.TrimPrefix(strings.TrimSpace(line), "export "), "=")
+		if !slices.Contains(keys, strings.TrimSpace(key)) {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// GetStartAddonsCommand starts the addons of the app in dir and waits until they are healthy.
+// The deploy script only swaps the app container, so new addons are started here first.
+func GetStartAddonsCommand(appConfig SidekickAppConfig, secretKey string) string {
+	services := []string{}
+	for _, addon := range appConfig.Addons {
+		services = append(services, AddonService(appConfig.Name, addon.Type))
+	}
+	up := fmt.Sprintf("docker compose -p %s up -d --wait --no-deps %s", ComposeProject(appConfig.Name, ""), strings.Join(services, " "))
+	if appConfig.Env.File != "" {
+		return fmt.Sprintf("cd %s && export SOPS_AGE_KEY=%s && sops exec-env encrypted.env '%s'", appConfig.Name, secretKey, up)
+	}
+	return fmt.Sprintf("cd %s && %s", appConfig.Name, up)
+}
+
+// GetRemovePreviewAddonsCommand removes the addons a preview env ran of its own and their network, empty when it has none
+func GetRemovePreviewAddonsCommand(appConfig SidekickAppConfig, hash string) string {
+	if !slices.ContainsFunc(appConfig.Addons, hasPreviewInstance) {
+		return ""
+	}
+	project := ComposeProject(appConfig.Name, hash)
+	return fmt.Sprintf("docker ps -aq --filter label=com.docker.compose.project=%[1]s | xargs -r docker rm -f && (docker network rm %[1]s_%[2]s > /dev/null 2>&1 || true)", project, AddonsNetwork)
+}
+
+// GetRemoveAddonCommand stops and removes the container of the addon, its volume only goes with destroyData
+func GetRemoveAddonCommand(appName string, addonType string, destroyData bool) string {
+	remove := GetRemoveServiceCommand(AddonService(appName, addonType))
+	if destroyData {
+		remove += fmt.Sprintf(" && docker volume ls -q --filter name=^%s$ | xargs -r docker volume rm", AddonVolume(appName, addonType))
+	}
+	return remove
+}
@@ -0,0 +1,305 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// AppConfigFile is the sidekick.yml commands read and write, --app-config points it elsewhere
+var AppConfigFile = "./sidekick.yml"
+
+// AppConfigApp picks one entry of the apps map of a sidekick.yml that holds several apps
+var AppConfigApp string
+
+const appConfigAppsKey = "apps"
+
+// UseAppConfig makes commands use another sidekick.yml and/or one app of its apps map.
+// Sidekick moves into the folder of the file, so build contexts and env files resolve relative to it like they do next to ./sidekick.yml.
+func UseAppConfig(file string, app string) error {
+	AppConfigApp = app
+	if file == "" {
+		return nil
+	}
+	if err := os.Chdir(filepath.Dir(file)); err != nil {
+		return fmt.Errorf("unable to use %s: %w", file, err)
+	}
+	AppConfigFile = "./" + filepath.Base(file)
+	return nil
+}
+
+// UseAppPath is --path, it makes commands work from dir of a monorepo, with the Dockerfile and the sidekick.yml found there.
+// Git still sees the whole repository, so a preview checks every folder for uncommitted changes.
+func UseAppPath(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("unable to use %s: %w", dir, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a folder, --path takes the folder of the app", dir)
+	}
+	if err := os.Chdir(dir); err != nil {
+		return fmt.Errorf("unable to use %s: %w", dir, err)
+	}
+	AppConfigFile = "./" + filepath.Base(AppConfigFile)
+	return nil
+}
+
+// ErrAppNotInConfig is returned when the app picked with --app is not in the apps map yet, launch adds it
+var ErrAppNotInConfig = errors.New("app not found in the apps map")
+
+// SelectAppConfig returns the config of the app picked with --app when content has an apps map, and content itself otherwise
+func SelectAppConfig(content []byte) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(content, &doc); err != nil || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		// the strict decode reports what is wrong with it
+		return content, nil
+	}
+	apps := mappingValue(doc.Content[0], appConfigAppsKey)
+	if apps == nil {
+		if name := mappingValue(doc.Content[0], "name"); AppConfigApp != "" && (name == nil || name.Value != AppConfigApp) {
+			return nil, fmt.Errorf("%s has no apps map and isn't the config of %s", AppConfigFile, AppConfigApp)
+		}
+		return content, nil
+	}
+	names := AppConfigNames(apps)
+	if AppConfigApp == "" {
+		return nil, fmt.Errorf("%s holds several apps (%s), pick one with --app", AppConfigFile, strings.Join(names, ", "))
+	}
+	app := mappingValue(apps, AppConfigApp)
+	if app == nil {
+		return nil, fmt.Errorf("%s has no app named %s (%s): %w", AppConfigFile, AppConfigApp, strings.Join(names, ", "), ErrAppNotInConfig)
+	}
+	return encodeYamlNode(app)
+}
+
+// ValidateAppConfigFile checks sidekick.yml like ParseAppConfig, every app of its apps map unless --app picked one
+func ValidateAppConfigFile(content []byte, checkFiles bool) ([]ConfigProblem, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(content, &doc); err != nil || len(doc.Content) == 0 || AppConfigApp != "" {
+		_, problems, err := parseSelectedAppConfig(content, checkFiles)
+		return problems, err
+	}
+	apps := mappingValue(doc.Content[0], appConfigAppsKey)
+	if apps == nil {
+		_, problems := ParseAppConfig(content, checkFiles)
+		return problems, nil
+	}
+	problems := []ConfigProblem{}
+	for _, name := range AppConfigNames(apps) {
+		app, err := encodeYamlNode(mappingValue(apps, name))
+		if err != nil {
+			return nil, err
+		}
+		_, appProblems := ParseAppConfig(app, checkFiles)
+		problems = append(problems, locateAppProblems(&doc, name, appProblems)...)
+	}
+	return problems, nil
+}
+
+// parseSelectedAppConfig is ParseAppConfig of the app picked with --app, with problems pointing into the whole file
+func parseSelectedAppConfig(content []byte, checkFiles bool) (SidekickAppConfig, []ConfigProblem, error) {
+	app, err := SelectAppConfig(content)
+	if err != nil {
+		return SidekickAppConfig{}, nil, err
+	}
+	appConfig, problems := ParseAppConfig(app, checkFiles)
+	var doc yaml.Node
+	if yaml.Unmarshal(content, &doc) == nil && len(doc.Content) > 0 && mappingValue(doc.Content[0], appConfigAppsKey) != nil {
+		problems = locateAppProblems(&doc, AppConfigApp, problems)
+	}
+	return appConfig, problems, nil
+}
+
+// locateAppProblems moves the problems of one app to its place in the apps map
+func locateAppProblems(doc *yaml.Node, app string, problems []ConfigProblem) []ConfigProblem {
+	for i, problem := range problems {
+		if problem.Field == "" {
+			problems[i].Line = nodeLine(doc, appConfigAppsKey, app)
+			problems[i].Message = app + ": " + problem.Message
+			continue
+		}
+		problems[i].Line = nodeLine(doc, append([]string{appConfigAppsKey, app}, strings.Split(problem.Field, ".")...)...)
+		problems[i].Field = fmt.Sprintf("%s.%s.%s", appConfigAppsKey, app, problem.Field)
+	}
+	return problems
+}
+
+// AppConfigNames lists the apps of an apps map in file order
+func AppConfigNames(apps *yaml.Node) []string {
+	names := []string{}
+	for i := 0; i+1 < len(apps.Content); i += 2 {
+		names = append(names, apps.Content[i].Value)
+	}
+	return names
+}
+
+// appConfigNodes are the app configs of a sidekick.yml, every entry of its apps map or the file itself
+func appConfigNodes(root *yaml.Node) []*yaml.Node {
+	apps := mappingValue(root, appConfigAppsKey)
+	if apps == nil || apps.Kind != yaml.MappingNode {
+		return []*yaml.Node{root}
+	}
+	nodes := []*yaml.Node{}
+	for i := 0; i+1 < len(apps.Content); i += 2 {
+		if apps.Content[i+1].Kind == yaml.MappingNode {
+			nodes = append(nodes, apps.Content[i+1])
+		}
+	}
+	return nodes
+}
+
+// SaveAppConfig writes the app config back to sidekick.yml, without the state fields LoadAppState fills in.
+// Comments and keys sidekick doesn't know about are kept as they are in the existing file.
+// A file of an older schema is migrated on the way and the original is kept as sidekick.yml.bak.
+func SaveAppConfig(appConfig SidekickAppConfig) error {
+	// the state of the app is kept on the server by SaveAppState
+	appConfig = withAppState(appConfig, SidekickAppState{})
+	appConfig.Schema = AppConfigSchema
+	var newDoc yaml.Node
+	if err := newDoc.Encode(&appConfig); err != nil {
+		return err
+	}
+
+	content, err := os.ReadFile(AppConfigFile)
+	if err == nil {
+		var existingDoc yaml.Node
+		if err := yaml.Unmarshal(content, &existingDoc); err == nil && len(existingDoc.Content) > 0 {
+			existing := existingDoc.Content[0]
+			if existing.Kind == yaml.MappingNode {
+				migrated, err := migrateAppConfigNode(&existingDoc)
+				if err != nil {
+					return err
+				}
+				if migrated {
+					if err := os.WriteFile(AppConfigFile+".bak", content, 0644); err != nil {
+						return err
+					}
+				}
+				// in an apps map the schema is set once for the whole file
+				if apps := mappingValue(existing, appConfigAppsKey); apps != nil {
+					if AppConfigApp == "" {
+						return fmt.Errorf("%s holds several apps, pick one with --app", AppConfigFile)
+					}
+					appConfig.Schema = 0
+					newDoc = yaml.Node{}
+					if err := newDoc.Encode(&appConfig); err != nil {
+						return err
+					}
+					existing = mappingValue(apps, AppConfigApp)
+					if existing == nil {
+						existing = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+						setMappingValue(apps, AppConfigApp, existing)
+					}
+				}
+				mergeYamlNode(existing, &newDoc, reflect.TypeOf(appConfig))
+				return writeYamlNode(&existingDoc)
+			}
+		}
+	}
+
+	return writeYamlNode(&newDoc)
+}
+
+func writeYamlNode(node *yaml.Node) error {
+	content, err := encodeYamlNode(node)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(AppConfigFile, content, 0644)
+}
+
+func encodeYamlNode(node *yaml.Node) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(4)
+	if err := encoder.Encode(node); err != nil {
+		return nil, err
+	}
+	encoder.Close()
+	return buf.Bytes(), nil
+}
+
+// mergeYamlNode updates existing in place with the values of updated.
+// For structs, keys that are not fields of the struct are left alone; known keys missing from updated were zeroed and get dropped.
+// Everything else (maps, lists, scalars) is replaced wholesale while keeping the comments of the old node.
+func mergeYamlNode(existing *yaml.Node, updated *yaml.Node, t reflect.Type) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || existing.Kind != yaml.MappingNode || updated.Kind != yaml.MappingNode {
+		headComment, lineComment, footComment := existing.HeadComment, existing.LineComment, existing.FootComment
+		*existing = *updated
+		existing.HeadComment, existing.LineComment, existing.FootComment = headComment, lineComment, footComment
+		return
+	}
+
+	fields := yamlFieldTypes(t)
+	updatedValues := map[string]*yaml.Node{}
+	updatedOrder := []string{}
+	for i := 0; i+1 < len(updated.Content); i += 2 {
+		updatedValues[updated.Content[i].Value] = updated.Content[i+1]
+		updatedOrder = append(updatedOrder, updated.Content[i].Value)
+	}
+
+	merged := []*yaml.Node{}
+	seen := map[string]bool{}
+	for i := 0; i+1 < len(existing.Content); i += 2 {
+		key, value := existing.Content[i], existing.Content[i+1]
+		fieldType, known := fields[key.Value]
+		if !known {
+			merged = append(merged, key, value)
+			continue
+		}
+		newValue, stillSet := updatedValues[key.Value]
+		if !stillSet {
+			continue
+		}
+		mergeYamlNode(value, newValue, fieldType)
+		merged = append(merged, key, value)
+		seen[key.Value] = true
+	}
+	for _, key := range updatedOrder {
+		if seen[key] {
+			continue
+		}
+		merged = append(merged, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, updatedValues[key])
+	}
+	existing.Content = merged
+}
+
+func yamlFieldTypes(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
@@ -0,0 +1,168 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"encoding/base64"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SidekickAppInfo is app.yml in the app folder on the VPS. It marks the folder as a sidekick app
+// and says where it is served, so the server can be inventoried without a checkout of every app.
+type SidekickAppInfo struct {
+	Name         string `yaml:"name"`
+	Url          string `yaml:"url"`
+	Port         uint64 `yaml:"port"`
+	Orchestrator string `yaml:"orchestrator,omitempty"`
+}
+
+// AppSummary is one row of sidekick apps
+type AppSummary struct {
+	Name           string `json:"name"`
+	Domain         string `json:"domain"`
+	Image          string `json:"image"`
+	Status         string `json:"status"`
+	LastDeployedAt string `json:"lastDeployedAt"`
+	Previews       int    `json:"previews"`
+}
+
+func RemoteAppInfoFile(appName string) string {
+	return path.Join(appName, "app.yml")
+}
+
+// SaveAppInfo writes app.yml, launch and deploy refresh it every time
+func SaveAppInfo(remote RemoteExecutor, appConfig SidekickAppConfig) error {
+	content, err := yaml.Marshal(SidekickAppInfo{
+		Name:         appConfig.Name,
+		Url:          appConfig.Url,
+		Port:         appConfig.Port,
+		Orchestrator: appConfig.Orchestrator,
+	})
+	if err != nil {
+		return err
+	}
+	return remote.WriteFile(RemoteAppInfoFile(appConfig.Name), content)
+}
+
+// listAppsScript prints a line per app folder with its files, then a line per container and per Traefik router.
+// Folders of apps deployed before app.yml existed are recognised by their compose file.
+var listAppsScript = `for dir in */; do
+  app=${dir%/}
+  [ "$app" = traefik ] && continue
+  [ -f "$app/app.yml" ] || [ -f "$app/state.yml" ] || [ -f "$app/docker-compose.yaml" ] || continue
+  echo "app $app $(ls -d "$app"/preview/*/ 2>/dev/null | wc -l)"
+  if [ -f "$app/app.yml" ]; then echo "info $app $(base64 -w0 "$app/app.yml")"; fi
+  if [ -f "$app/state.yml" ]; then echo "state $app $(base64 -w0 "$app/state.yml")"; fi
+done
+docker ps -a --format 'container {{.Label "com.docker.compose.project"}}{{.Label "com.docker.stack.namespace"}}/{{.Label "com.docker.compose.service"}} {{.State}} {{.Image}}'
+docker ps --filter label=traefik.enable=true --format 'router {{.Label "com.docker.compose.project"}}{{.Label "com.docker.stack.namespace"}}/{{.Label "com.docker.compose.service"}} {{.Labels}}'`
+
+// ListRemoteApps inventories every app sidekick manages on the server, sorted by name
+func ListRemoteApps(remote RemoteExecutor) ([]AppSummary, error) {
+	output, err := remote.Output(listAppsScript)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the apps: %w", err)
+	}
+
+	apps := map[string]*AppSummary{}
+	images := map[string]string{}
+	running, total := map[string]int{}, map[string]int{}
+	routerHosts := map[string]string{}
+	for _, line := range outputLines(output) {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		switch fields[0] {
+		case "app":
+			summary := &AppSummary{Name: fields[1]}
+			fmt.Sscanf(fields[2], "%d", &summary.Previews)
+			apps[fields[1]] = summary
+		case "info", "state":
+			summary, ok := apps[fields[1]]
+			content, err := base64.StdEncoding.DecodeString(fields[2])
+			if !ok || err != nil {
+				continue
+			}
+			if fields[0] == "info" {
+				var info SidekickAppInfo
+				if yaml.Unmarshal(content, &info) == nil {
+					summary.Domain = info.Url
+				}
+			} else {
+				var state SidekickAppState
+				if yaml.Unmarshal(content, &state) == nil {
+					summary.Image, summary.LastDeployedAt = state.Image, state.LastDeployedAt
+				}
+			}
+		case "container":
+			project := containerProject(fields[1])
+			total[project]++
+			if fields[2] == "running" {
+				running[project]++
+				if len(fields) > 3 {
+					images[project] = fields[3]
+				}
+			}
+		case "router":
+			project := containerProject(fields[1])
+			if match := routerHostPattern.FindStringSubmatch(line); match != nil && routerHosts[project] == "" {
+				routerHosts[project] = match[1]
+			}
+		}
+	}
+
+	summaries := []AppSummary{}
+	for name, summary := range apps {
+		project := ComposeProject(name, "")
+		if summary.Domain == "" {
+			summary.Domain = routerHosts[project]
+		}
+		if summary.Image == "" {
+			summary.Image = images[project]
+		}
+		summary.Status = appContainersStatus(running[project], total[project])
+		summaries = append(summaries, *summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Name < summaries[j].Name })
+	return summaries, nil
+}
+
+// containerProject takes project/service, containers of apps deployed before every app had its own project
+// are still in the shared one and count for the app named like their service
+func containerProject(labels string) string {
+	project, service, _ := strings.Cut(labels, "/")
+	if project == SharedComposeProject {
+		return service
+	}
+	return project
+}
+
+func appContainersStatus(running int, total int) string {
+	switch {
+	case total == 0:
+		return "no containers"
+	case running == 0:
+		return "stopped"
+	case running < total:
+		return fmt.Sprintf("degraded (%d/%d running)", running, total)
+	}
+	return "running"
+}
@@ -0,0 +1,121 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"fmt"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// AppConfigSchema is the sidekick.yml schema this build writes.
+// Bump it along with a new entry in appConfigMigrations whenever a field changes shape.
+const AppConfigSchema = 1
+
+const appConfigSchemaKey = "schema"
+
+// appConfigMigrations[i] moves an app config from schema i to i+1, files written before the schema key existed are schema 0.
+// Each one runs on every app of a file with an apps map.
+var appConfigMigrations = []func(root *yaml.Node) error{
+	migrateUntaggedPreviews,
+}
+
+// MigrateAppConfig brings the content of sidekick.yml up to AppConfigSchema, migrated is false when it already was.
+// A file from a newer sidekick fails instead of losing the fields this build doesn't know.
+func MigrateAppConfig(content []byte) ([]byte, bool, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(content, &doc); err != nil || len(doc.Content) == 0 {
+		// the strict decode reports what is wrong with it
+		return content, false, nil
+	}
+	migrated, err := migrateAppConfigNode(&doc)
+	if err != nil || !migrated {
+		return content, false, err
+	}
+	migratedContent, err := encodeYamlNode(&doc)
+	if err != nil {
+		return content, false, err
+	}
+	return migratedContent, true, nil
+}
+
+func migrateAppConfigNode(doc *yaml.Node) (bool, error) {
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return false, nil
+	}
+	schema := 0
+	if value := mappingValue(root, appConfigSchemaKey); value != nil {
+		parsed, err := strconv.Atoi(value.Value)
+		if err != nil {
+			return false, fmt.Errorf("%s has an invalid %s %q", AppConfigFile, appConfigSchemaKey, value.Value)
+		}
+		schema = parsed
+	}
+	if schema > AppConfigSchema {
+		return false, fmt.Errorf("%s was written by a newer sidekick (schema %d, this one knows up to %d), please upgrade sidekick", AppConfigFile, schema, AppConfigSchema)
+	}
+	if schema == AppConfigSchema {
+		return false, nil
+	}
+	for _, migrate := range appConfigMigrations[schema:] {
+		for _, app := range appConfigNodes(root) {
+			if err := migrate(app); err != nil {
+				return false, fmt.Errorf("failed to migrate %s from schema %d: %w", AppConfigFile, schema, err)
+			}
+		}
+	}
+	setMappingValue(root, appConfigSchemaKey, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.Itoa(AppConfigSchema)})
+	return true, nil
+}
+
+// migrateUntaggedPreviews fills in the image of previews deployed before it was recorded, they were tagged with the app name and hash
+func migrateUntaggedPreviews(root *yaml.Node) error {
+	name := mappingValue(root, "name")
+	previews := mappingValue(root, "previewEnvs")
+	if name == nil || previews == nil || previews.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(previews.Content); i += 2 {
+		hash, preview := previews.Content[i].Value, previews.Content[i+1]
+		if preview.Kind != yaml.MappingNode {
+			continue
+		}
+		if image := mappingValue(preview, "image"); image == nil || image.Value == "" {
+			setMappingValue(preview, "image", &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: fmt.Sprintf("%s:%s", name.Value, hash)})
+		}
+	}
+	return nil
+}
+
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func setMappingValue(node *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			node.Content[i+1] = value
+			return
+		}
+	}
+	node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+}
@@ -0,0 +1,162 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ErrStateConflict means the state on the server changed between loading and saving it, someone else deployed meanwhile
+var ErrStateConflict = errors.New("the app state on the server changed while this command ran")
+
+// SidekickAppState is what changes with every deploy. It lives in state.yml in the app folder on the VPS instead of
+// sidekick.yml, so teammates don't fight over it in git and a fresh clone still knows what is deployed.
+type SidekickAppState struct {
+	// Revision goes up with every save, a save only goes through when nobody else saved since the state was loaded
+	Revision           int                        `yaml:"revision"`
+	Version            string                     `yaml:"version,omitempty"`
+	Image              string                     `yaml:"image,omitempty"`
+	LastDeployedAt     string                     `yaml:"lastDeployedAt,omitempty"`
+	LastDeployedCommit string                     `yaml:"lastDeployedCommit,omitempty"`
+	BuildHash          string                     `yaml:"buildHash,omitempty"`
+	BuildDuration      string                     `yaml:"buildDuration,omitempty"`
+	DeployedVersion    string                     `yaml:"deployedVersion,omitempty"`
+	ImageHistory       []string                   `yaml:"imageHistory,omitempty"`
+	EnvHash            string                     `yaml:"envHash,omitempty"`
+	PreviewEnvs        map[string]SidekickPreview `yaml:"previewEnvs,omitempty"`
+	Sbom               SidekickSbom               `yaml:"sbom,omitempty"`
+}
+
+func RemoteStateFile(appName string) string {
+	return path.Join(appName, "state.yml")
+}
+
+func appStateOf(appConfig SidekickAppConfig) SidekickAppState {
+	return SidekickAppState{
+		Revision:           appConfig.StateRevision,
+		Version:            appConfig.Version,
+		Image:              appConfig.Image,
+		LastDeployedAt:     appConfig.LastDeployedAt,
+		LastDeployedCommit: appConfig.LastDeployedCommit,
+		BuildHash:          appConfig.BuildHash,
+		BuildDuration:      appConfig.BuildDuration,
+		DeployedVersion:    appConfig.DeployedVersion,
+		ImageHistory:       appConfig.ImageHistory,
+		EnvHash:            appConfig.Env.Hash,
+		PreviewEnvs:        appConfig.PreviewEnvs,
+		Sbom:               appConfig.Sbom,
+	}
+}
+
+func withAppState(appConfig SidekickAppConfig, state SidekickAppState) SidekickAppConfig {
+	appConfig.StateRevision = state.Revision
+	appConfig.Version = state.Version
+	appConfig.Image = state.Image
+	appConfig.LastDeployedAt = state.LastDeployedAt
+	appConfig.LastDeployedCommit = state.LastDeployedCommit
+	appConfig.BuildHash = state.BuildHash
+	appConfig.BuildDuration = state.BuildDuration
+	appConfig.DeployedVersion = state.DeployedVersion
+	appConfig.ImageHistory = state.ImageHistory
+	appConfig.Env.Hash = state.EnvHash
+	appConfig.PreviewEnvs = state.PreviewEnvs
+	appConfig.Sbom = state.Sbom
+	return appConfig
+}
+
+// LoadAppState fills in the state of the app from state.yml on the server.
+// Apps deployed before state.yml existed have their state in sidekick.yml, it is copied to the server the first time.
+func LoadAppState(remote RemoteExecutor, appConfig SidekickAppConfig) (SidekickAppConfig, error) {
+	output, err := remote.Output(fmt.Sprintf("cat %s 2>/dev/null || true", RemoteStateFile(appConfig.Name)))
+	if err != nil {
+		return appConfig, fmt.Errorf("unable to read the app state: %w", err)
+	}
+	if strings.TrimSpace(output) == "" {
+		appConfig.StateRevision = 0
+		if appConfig.Version == "" && len(appConfig.PreviewEnvs) == 0 {
+			return appConfig, nil
+		}
+		return appConfig, SaveAppState(remote, &appConfig)
+	}
+	state := SidekickAppState{}
+	if err := yaml.Unmarshal([]byte(output), &state); err != nil {
+		return appConfig, fmt.Errorf("unable to parse %s on the server: %w", RemoteStateFile(appConfig.Name), err)
+	}
+	return withAppState(appConfig, state), nil
+}
+
+// SaveAppState writes the state of appConfig to the server and bumps its revision.
+// It fails with ErrStateConflict instead of overwriting a state saved by someone else since it was loaded.
+func SaveAppState(remote RemoteExecutor, appConfig *SidekickAppConfig) error {
+	state := appStateOf(*appConfig)
+	state.Revision++
+	content, err := yaml.Marshal(state)
+	if err != nil {
+		return err
+	}
+	stateFile := RemoteStateFile(appConfig.Name)
+	newStateFile := fmt.Sprintf("%s.%d", stateFile, time.Now().UnixNano())
+	if err := remote.WriteFile(newStateFile, content); err != nil {
+		return fmt.Errorf("unable to write the app state: %w", err)
+	}
+	// the revision check and the move happen under one lock so two saves can't both pass it
+	script := fmt.Sprintf(`flock %[1]s.lock sh -c 'current=$(sed -n "s/^revision: //p" %[1]s 2>/dev/null); if [ "${current:-0}" = "%[3]d" ]; then mv %[2]s %[1]s; else rm -f %[2]s; echo conflict; fi'`, stateFile, newStateFile, appConfig.StateRevision)
+	output, err := remote.Output(script)
+	if err != nil {
+		return fmt.Errorf("unable to save the app state: %w", err)
+	}
+	if strings.TrimSpace(output) == "conflict" {
+		return ErrStateConflict
+	}
+	appConfig.StateRevision = state.Revision
+	return nil
+}
+
+// UpdateAppState applies update to the latest state on the server and saves it.
+// Changes that don't overlap, like two teammates adding previews, are retried on a conflict instead of failing.
+func UpdateAppState(remote RemoteExecutor, appConfig *SidekickAppConfig, update func(*SidekickAppConfig)) error {
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		latest, loadErr := LoadAppState(remote, *appConfig)
+		if loadErr != nil {
+			return loadErr
+		}
+		update(&latest)
+		if err = SaveAppState(remote, &latest); err == nil {
+			*appConfig = latest
+			return nil
+		}
+		if !errors.Is(err, ErrStateConflict) {
+			return err
+		}
+	}
+	return err
+}
+
+// FetchAppState logs in to server only to load the state of the app, for commands that just read it
+func FetchAppState(server SidekickServer, appConfig SidekickAppConfig) (SidekickAppConfig, error) {
+	sshClient, err := Login(server.Address, "sidekick")
+	if err != nil {
+		return appConfig, fmt.Errorf("unable to login to your VPS: %w", err)
+	}
+	defer sshClient.Close()
+	return LoadAppState(SSHExecutor{Client: sshClient}, appConfig)
+}
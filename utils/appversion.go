@@ -0,0 +1,103 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// VersionFile holds the version of the app, it takes precedence over a git tag on the deployed commit
+const VersionFile = "VERSION"
+
+var imageTagPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+
+// ReadVersionFile is the version in VERSION of the working tree, empty when there is no such file
+func ReadVersionFile() (string, error) {
+	content, err := os.ReadFile(VersionFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	version, _, _ := strings.Cut(strings.TrimSpace(string(content)), "\n")
+	return ValidateAppVersion(strings.TrimSpace(version))
+}
+
+// ResolveAppVersion reads the version of the app from VERSION, or else from a git tag pointing at the deployed commit.
+// With a ref both come from that commit instead of the working tree. It is empty when there is neither.
+func ResolveAppVersion(ref *GitRef) (string, error) {
+	rev := "HEAD"
+	var content []byte
+	var err error
+	if ref != nil {
+		rev = ref.Sha
+		content, err = exec.Command("git", "show", rev+":"+VersionFile).Output()
+	} else {
+		content, err = os.ReadFile(VersionFile)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+	}
+	if err == nil {
+		version, _, _ := strings.Cut(strings.TrimSpace(string(content)), "\n")
+		return ValidateAppVersion(strings.TrimSpace(version))
+	}
+	output, err := exec.Command("git", "describe", "--tags", "--exact-match", rev).Output()
+	if err != nil {
+		return "", nil
+	}
+	return ValidateAppVersion(strings.TrimSpace(string(output)))
+}
+
+// ValidateAppVersion turns version into an image tag, build metadata like 1.2.0+42 can't be in a tag so + becomes -
+func ValidateAppVersion(version string) (string, error) {
+	if version == "" {
+		return "", nil
+	}
+	tag := strings.ReplaceAll(version, "+", "-")
+	if !imageTagPattern.MatchString(tag) {
+		return "", fmt.Errorf("version %q can't be an image tag, use letters, numbers, dots and dashes like 1.2.0", version)
+	}
+	if tag == "latest" || deployTagPattern.MatchString(tag) {
+		return "", fmt.Errorf("version %q is taken by the tags sidekick gives every deploy, use one like 1.2.0", version)
+	}
+	return tag, nil
+}
+
+// ReleaseImageTags are the tags of a deploy besides its V tag, the version when it has one and the commit
+func ReleaseImageTags(appConfig SidekickAppConfig, version string, hash string) []string {
+	tags := []string{}
+	for _, tag := range []string{version, hash} {
+		if tag != "" {
+			tags = append(tags, DeployImageTag(AppRepository(appConfig), tag))
+		}
+	}
+	return tags
+}
+
+// GetTagImageCommand gives image all of tags
+func GetTagImageCommand(image string, tags []string) string {
+	commands := []string{}
+	for _, tag := range tags {
+		commands = append(commands, fmt.Sprintf("docker tag %s %s", image, tag))
+	}
+	return strings.Join(commands, " && ")
+}
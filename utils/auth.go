@@ -3,7 +3,6 @@ package utils
 import (
 	"errors"
 	"fmt"
-	"log"
 	"net"
 	"os"
 	"os/exec"
@@ -13,7 +12,6 @@ import (
 	"time"
 
 	"github.com/mightymoud/sidekick/render"
-	"github.com/skeema/knownhosts"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 )
@@ -54,66 +52,45 @@ func getKeyFilesAuth() ([]ssh.AuthMethod, error) {
 	return authMethods, nil
 }
 
-func inspectServerPublicKey(key ssh.PublicKey, hostname string) {
+// inspectServerPublicKey asks the user to confirm a host key seen for the first time
+func inspectServerPublicKey(key ssh.PublicKey, hostname string) error {
 	sshKeyCmd := exec.Command("sh", "-s", "-", string(ssh.MarshalAuthorizedKey(key)))
 	sshKeyCmd.Stdin = strings.NewReader(sshKeyScript)
+	TraceScript(sshKeyScript, sshKeyCmd.Args[3:]...)
 	result, sshKeyCmdErr := sshKeyCmd.Output()
 	if sshKeyCmdErr != nil {
-		panic(sshKeyCmdErr)
+		return fmt.Errorf("failed to show the host key fingerprint: %w", sshKeyCmdErr)
 	}
 	resultLines := strings.Split(string(result), "\n")
 	keyHash := resultLines[0]
 
-	render.RenderKeyValidation(resultLines, keyHash, hostname)
-
+	if !render.RenderKeyValidation(resultLines, keyHash, hostname) {
+		return fmt.Errorf("the host key of %s was not accepted", hostname)
+	}
+	return nil
 }
 
 func GetSshClient(server string, sshUser string) (*ssh.Client, error) {
-	sshPort := "22"
-	sshAgentSock := os.Getenv("SSH_AUTH_SOCK")
-	if sshAgentSock == "" {
-		log.Fatal("No SSH SOCK AVAILABLE")
-		return nil, errors.New("Error happened connecting to ssh-agent")
-	}
-
-	conn, err := net.Dial("unix", sshAgentSock)
-	if err != nil {
+	sshPort := SSHPort
+	// a key in SIDEKICK_SSH_KEY takes over SSH_AUTH_SOCK so it is all a runner needs
+	if err := StartEnvSSHAgent(); err != nil {
 		return nil, err
 	}
-	defer conn.Close()
-
-	agentClient := agent.NewClient(conn)
 
 	// Get auth of standard keys not in agent
 	authMethods, _ := getKeyFilesAuth()
 
-	authMethods = append(authMethods, ssh.PublicKeysCallback(agentClient.Signers))
-
-	cb := ssh.HostKeyCallback(func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-		currentUser, _ := user.Current()
-		khPath := fmt.Sprintf("%s/.ssh/known_hosts", currentUser.HomeDir)
-		kh, knErr := knownhosts.NewDB(khPath)
-		if knErr != nil {
-			return knErr
-		}
-
-		innerCallback := kh.HostKeyCallback()
-		err := innerCallback(hostname, remote, key)
-		if knownhosts.IsHostKeyChanged(err) {
-			return fmt.Errorf("REMOTE HOST IDENTIFICATION HAS CHANGED for host %s! This may indicate a MitM attack.", hostname)
-		} else if knownhosts.IsHostUnknown(err) {
-			inspectServerPublicKey(key, hostname)
-			f, ferr := os.OpenFile(khPath, os.O_APPEND|os.O_WRONLY, 0600)
-			if ferr == nil {
-				defer f.Close()
-				ferr = knownhosts.WriteKnownHost(f, hostname, remote, key)
-			} else {
-				log.Printf("Failed to add host %s to known_hosts: %v\n", hostname, ferr)
-			}
-			return nil
+	if sshAgentSock := os.Getenv("SSH_AUTH_SOCK"); sshAgentSock != "" {
+		conn, err := net.Dial("unix", sshAgentSock)
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect to ssh-agent: %w", err)
 		}
-		return err
-	})
+		defer conn.Close()
+		authMethods = append(authMethods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+	}
+	if len(authMethods) == 0 {
+		return nil, fmt.Errorf("no SSH key found - load one in ssh-agent, add one to ~/.ssh or set %s", SSHKeyEnv)
+	}
 
 	var client *ssh.Client
 
@@ -123,14 +100,14 @@ func GetSshClient(server string, sshUser string) (*ssh.Client, error) {
 		config := &ssh.ClientConfig{
 			User:            sshUser,
 			Auth:            []ssh.AuthMethod{method},
-			HostKeyCallback: cb,
+			HostKeyCallback: checkHostKey,
 			Timeout:         1 * time.Second,
 		}
 
 		workingClient, sshClientErr := ssh.Dial("tcp", fmt.Sprintf("%s:%s", server, sshPort), config)
 		if sshClientErr != nil {
 			if sshClientErr.Error() != expectedClientErr.Error() {
-				log.Fatalf("Failed to create ssh client to the server: %v", sshClientErr)
+				return nil, fmt.Errorf("failed to create ssh client to the server: %w", sshClientErr)
 			}
 			continue
 		}
@@ -138,15 +115,28 @@ func GetSshClient(server string, sshUser string) (*ssh.Client, error) {
 		break
 	}
 	if client == nil {
-		return nil, errors.New("Logging in failed with all available keys for the said user")
+		return nil, fmt.Errorf("logging in to %s as %s: %w", server, sshUser, ErrSSHAuth)
 	}
 	return client, nil
 }
 
+// Login retries when the server can't be reached, a rejected key or host key fails right away
 func Login(server string, user string) (*ssh.Client, error) {
-	sshClient, err := GetSshClient(server, user)
+	var sshClient *ssh.Client
+	_, err := ConnectionRetryPolicy.Do(func() error {
+		client, err := GetSshClient(server, user)
+		if err != nil && !IsConnectionError(err) {
+			return StopRetrying(err)
+		}
+		sshClient = client
+		return err
+	}, func(attempt int, attempts int, err error) {
+		TraceOutput("stderr", fmt.Sprintf("could not reach %s: %s - attempt %d/%d", server, err, attempt, attempts))
+	})
 	if err != nil {
 		return nil, err
 	}
+	trackConnection(sshClient, server, user)
+	go keepAlive(sshClient)
 	return sshClient, nil
 }
@@ -0,0 +1,456 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// BackupImage is the helper container that reads the volume, it only needs tar
+const BackupImage = "alpine:3.20"
+
+// AppVolume is a named volume of the app on the server, Name is how the compose file declares it
+type AppVolume struct {
+	Name   string
+	Volume string
+}
+
+// BackupEntry is one backup in backups/index.jsonl of the app folder on the VPS.
+// A dump of a database addon has the type of the addon in Addon and no Volume.
+type BackupEntry struct {
+	Time   string `json:"time"`
+	Volume string `json:"volume"`
+	Addon  string `json:"addon,omitempty"`
+	Dest   string `json:"dest"`
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+// Source is what the backup was made of, the volume or the addon
+func (e BackupEntry) Source() string {
+	if e.Addon != "" {
+		return e.Addon
+	}
+	return e.Volume
+}
+
+func RemoteBackupIndexFile(appName string) string {
+	return path.Join(RemoteBackupsDir(appName), "index.jsonl")
+}
+
+// ListAppVolumes finds the named volumes of the compose project or swarm stack of the app
+func ListAppVolumes(remote RemoteExecutor, appName string) ([]AppVolume, error) {
+	output, err := remote.Output(`docker volume ls --format '{{.Name}} {{.Label "com.docker.compose.project"}}{{.Label "com.docker.stack.namespace"}} {{.Label "com.docker.compose.volume"}}'`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the volumes: %w", err)
+	}
+	project := ComposeProject(appName, "")
+	volumes := []AppVolume{}
+	for _, line := range outputLines(output) {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[1] != project {
+			continue
+		}
+		volume := AppVolume{Volume: fields[0], Name: strings.TrimPrefix(fields[0], project+"_")}
+		if len(fields) > 2 {
+			volume.Name = fields[2]
+		}
+		volumes = append(volumes, volume)
+	}
+	return volumes, nil
+}
+
+// FindAppVolume picks name out of volumes, by its declared or its full name. With no name the app must have exactly one.
+func FindAppVolume(volumes []AppVolume, name string) (AppVolume, error) {
+	names := []string{}
+	for _, volume := range volumes {
+		if name != "" && (volume.Name == name || volume.Volume == name) {
+			return volume, nil
+		}
+		names = append(names, volume.Name)
+	}
+	switch {
+	case len(volumes) == 0:
+		return AppVolume{}, fmt.Errorf("the app has no named volumes")
+	case name == "" && len(volumes) == 1:
+		return volumes[0], nil
+	case name == "":
+		return AppVolume{}, fmt.Errorf("the app has several volumes, pick one of %s with --volume", strings.Join(names, ", "))
+	}
+	return AppVolume{}, fmt.Errorf("the app has no volume %s, it has %s", name, strings.Join(names, ", "))
+}
+
+// GetVolumeBackupCommand writes a gzipped tar of the volume to stdout, mounted read only so the backup can't change it
+func GetVolumeBackupCommand(volume string) string {
+	return fmt.Sprintf("docker run --rm -v %s:/volume:ro %s tar -czf - -C /volume .", volume, BackupImage)
+}
+
+// BackupFileName is named after the volume and the time of the backup, so backups sort by time
+func BackupFileName(volume AppVolume, t time.Time) string {
+	return fmt.Sprintf("%s-%s.tar.gz", volume.Name, t.UTC().Format("20060102T150405Z"))
+}
+
+// DatabaseBackupFileName is the name of a dump of the postgres addon, a gzipped SQL file and not a tar
+func DatabaseBackupFileName(t time.Time) string {
+	return fmt.Sprintf("%s-%s.sql.gz", AddonPostgres, t.UTC().Format("20060102T150405Z"))
+}
+
+// IsDatabaseBackup is true for the file or url of a dump of the postgres addon
+func IsDatabaseBackup(ref string) bool {
+	return strings.HasSuffix(ref, ".sql.gz")
+}
+
+// addonContainer finds the running container of the addon by its compose labels
+func addonContainer(appName string, addonType string) string {
+	return fmt.Sprintf("$(docker ps -q --filter label=com.docker.compose.project=%s --filter label=com.docker.compose.service=%s)", ComposeProject(appName, ""), AddonService(appName, addonType))
+}
+
+// GetDatabaseBackupCommand writes a gzipped SQL dump of the postgres addon to stdout.
+// pg_dump compresses it itself so a failing dump fails the command, --clean has the restore replace what is there.
+func GetDatabaseBackupCommand(appName string) string {
+	return fmt.Sprintf("docker exec %s pg_dump -U %s -d %s --clean --if-exists -Z 6", addonContainer(appName, AddonPostgres), appName, appName)
+}
+
+// GetRestoreDatabaseCommand feeds the dump in file to the postgres addon in one transaction, file is relative to the home of the sidekick user
+func GetRestoreDatabaseCommand(appName string, file string) string {
+	return fmt.Sprintf(`gunzip -c "$HOME/%s" | docker exec -i %s psql -q -v ON_ERROR_STOP=1 --single-transaction -U %s -d %s`, file, addonContainer(appName, AddonPostgres), appName, appName)
+}
+
+func IsS3Dest(dest string) bool {
+	return strings.HasPrefix(dest, "s3://")
+}
+
+// BackupDest is where the backup named fileName goes in dest, a local folder or an s3:// prefix
+func BackupDest(dest string, fileName string) string {
+	if IsS3Dest(dest) {
+		return strings.TrimSuffix(dest, "/") + "/" + fileName
+	}
+	return filepath.Join(dest, fileName)
+}
+
+// GetS3UploadCommand uploads stdin to url with the aws cli, AWS_ENDPOINT_URL points it at other S3 compatible stores
+func GetS3UploadCommand(url string) *exec.Cmd {
+	return OperationCommand("aws", "s3", "cp", "-", url)
+}
+
+// StreamCommandOutput runs cmd on the server and copies its stdout to w as it comes
+func StreamCommandOutput(client *ssh.Client, cmd string, w io.Writer) error {
+	cmd = RuntimeCommand(client, cmd)
+	TraceCommand(cmd)
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to create session: %w", err)
+	}
+	defer session.Close()
+	var stderr strings.Builder
+	session.Stdout, session.Stderr = w, &stderr
+	if err := session.Run(cmd); err != nil {
+		return &RemoteCommandError{Cmd: cmd, Stderr: strings.TrimSpace(stderr.String()), Err: err}
+	}
+	return nil
+}
+
+// BackupVolume streams a tar of volume from the server to dest, progress gets the bytes received so far
+func BackupVolume(client *ssh.Client, volume AppVolume, dest string, now time.Time, progress func(int64)) (BackupEntry, error) {
+	entry := BackupEntry{Time: now.UTC().Format(time.RFC3339), Volume: volume.Name, Dest: BackupDest(dest, BackupFileName(volume, now))}
+	return backupStream(client, GetVolumeBackupCommand(volume.Volume), dest, entry, progress)
+}
+
+// BackupDatabase streams a dump of the postgres addon of the app from the server to dest
+func BackupDatabase(client *ssh.Client, appName string, dest string, now time.Time, progress func(int64)) (BackupEntry, error) {
+	entry := BackupEntry{Time: now.UTC().Format(time.RFC3339), Addon: AddonPostgres, Dest: BackupDest(dest, DatabaseBackupFileName(now))}
+	return backupStream(client, GetDatabaseBackupCommand(appName), dest, entry, progress)
+}
+
+// backupStream copies the output of cmd on the server to entry.Dest. A local file only gets its name once it is complete.
+func backupStream(client *ssh.Client, cmd string, dest string, entry BackupEntry, progress func(int64)) (BackupEntry, error) {
+	hash := sha256.New()
+	counter := &ProgressWriter{Progress: progress}
+
+	if IsS3Dest(dest) {
+		upload := GetS3UploadCommand(entry.Dest)
+		stdin, err := upload.StdinPipe()
+		if err != nil {
+			return entry, err
+		}
+		var uploadOutput strings.Builder
+		upload.Stdout, upload.Stderr = &uploadOutput, &uploadOutput
+		TraceExec(upload)
+		if err := upload.Start(); err != nil {
+			return entry, fmt.Errorf("failed to start the upload, is the aws cli installed? %w", err)
+		}
+		streamErr := StreamCommandOutput(client, cmd, io.MultiWriter(stdin, hash, counter))
+		stdin.Close()
+		if err := upload.Wait(); err != nil && streamErr == nil {
+			streamErr = fmt.Errorf("failed to upload to %s: %s", entry.Dest, strings.TrimSpace(uploadOutput.String()))
+		}
+		if streamErr != nil {
+			return entry, streamErr
+		}
+	} else {
+		if err := os.MkdirAll(dest, 0700); err != nil {
+			return entry, err
+		}
+		partial := entry.Dest + ".partial"
+		file, err := os.OpenFile(partial, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			return entry, err
+		}
+		streamErr := StreamCommandOutput(client, cmd, io.MultiWriter(file, hash, counter))
+		if err := file.Close(); err != nil && streamErr == nil {
+			streamErr = err
+		}
+		if streamErr != nil {
+			os.Remove(partial)
+			return entry, streamErr
+		}
+		if err := os.Rename(partial, entry.Dest); err != nil {
+			return entry, err
+		}
+	}
+	entry.Size, entry.Sha256 = counter.N, hex.EncodeToString(hash.Sum(nil))
+	return entry, nil
+}
+
+// ProgressWriter counts the bytes written through it and reports the total so far to Progress when it is set
+type ProgressWriter struct {
+	N        int64
+	Progress func(n int64)
+}
+
+func (w *ProgressWriter) Write(p []byte) (int, error) {
+	w.N += int64(len(p))
+	if w.Progress != nil {
+		w.Progress(w.N)
+	}
+	return len(p), nil
+}
+
+// AppendBackup records entry in the backup index of the app
+func AppendBackup(remote RemoteExecutor, appName string, entry BackupEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	encoded := base64.StdEncoding.EncodeToString(append(line, '\n'))
+	if _, err := remote.Output(fmt.Sprintf("echo %s | base64 -d >> %s", encoded, RemoteBackupIndexFile(appName))); err != nil {
+		return fmt.Errorf("failed to record the backup: %w", err)
+	}
+	return nil
+}
+
+// SaveBackups replaces the backup index of the app with entries, after older backups were pruned
+func SaveBackups(remote RemoteExecutor, appName string, entries []BackupEntry) error {
+	var content []byte
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		content = append(append(content, line...), '\n')
+	}
+	encoded := base64.StdEncoding.EncodeToString(content)
+	index := RemoteBackupIndexFile(appName)
+	if _, err := remote.Output(fmt.Sprintf("echo '%s' | base64 -d > %s.tmp && mv %s.tmp %s", encoded, index, index, index)); err != nil {
+		return fmt.Errorf("failed to record the backups: %w", err)
+	}
+	return nil
+}
+
+// PruneBackups picks the backups of source in dest beyond the newest keep, entries are oldest first.
+// Backups of other volumes or in other places are never pruned.
+func PruneBackups(entries []BackupEntry, source string, dest string, keep int) (kept []BackupEntry, pruned []BackupEntry) {
+	matching := 0
+	for _, entry := range entries {
+		if entry.Source() == source && BackupDest(dest, filepath.Base(filepath.FromSlash(entry.Dest))) == entry.Dest {
+			matching++
+		}
+	}
+	for _, entry := range entries {
+		if matching > keep && entry.Source() == source && BackupDest(dest, filepath.Base(filepath.FromSlash(entry.Dest))) == entry.Dest {
+			pruned = append(pruned, entry)
+			matching--
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	return kept, pruned
+}
+
+// DeleteBackup removes the archive of entry, one that is already gone is not an error
+func DeleteBackup(entry BackupEntry) error {
+	if IsS3Dest(entry.Dest) {
+		rm := OperationCommand("aws", "s3", "rm", entry.Dest)
+		TraceExec(rm)
+		if output, err := rm.CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to delete %s: %s", entry.Dest, strings.TrimSpace(string(output)))
+		}
+		return nil
+	}
+	if err := os.Remove(entry.Dest); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// LoadBackups returns every recorded backup of the app, oldest first
+func LoadBackups(remote RemoteExecutor, appName string) ([]BackupEntry, error) {
+	output, err := remote.Output(fmt.Sprintf("cat %s 2>/dev/null || true", RemoteBackupIndexFile(appName)))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the backups: %w", err)
+	}
+	entries := []BackupEntry{}
+	for _, line := range outputLines(output) {
+		var entry BackupEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// FindBackup is the newest recorded backup written to ref, or with the same file name when it was moved since
+func FindBackup(entries []BackupEntry, ref string) (BackupEntry, bool) {
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].Dest == ref {
+			return entries[i], true
+		}
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if path.Base(entries[i].Dest) == path.Base(filepath.ToSlash(ref)) {
+			return entries[i], true
+		}
+	}
+	return BackupEntry{}, false
+}
+
+// GetS3DownloadCommand downloads url to file with the aws cli
+func GetS3DownloadCommand(url string, file string) *exec.Cmd {
+	return OperationCommand("aws", "s3", "cp", url, file)
+}
+
+// FetchBackup returns a local path to the backup in ref, an s3:// one is downloaded to a temporary file first
+func FetchBackup(ref string) (string, func(), error) {
+	if !IsS3Dest(ref) {
+		return ref, func() {}, nil
+	}
+	dir, err := os.MkdirTemp("", "sidekick-restore-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	file := filepath.Join(dir, path.Base(ref))
+	download := GetS3DownloadCommand(ref, file)
+	TraceExec(download)
+	if output, err := download.CombinedOutput(); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to download %s, is the aws cli installed? %s", ref, strings.TrimSpace(string(output)))
+	}
+	return file, cleanup, nil
+}
+
+// VerifyBackupArchive reads the whole archive so a truncated or corrupt one fails here and not halfway through a restore.
+// The sha256 must match expected unless it is empty, the backup was not recorded then.
+func VerifyBackupArchive(file string, expected string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	gz, err := gzip.NewReader(io.TeeReader(f, hash))
+	if err != nil {
+		return "", fmt.Errorf("%s is not gzipped: %w", file, err)
+	}
+	// a database dump is a gzipped SQL file, reading it to the end below checks it
+	if !IsDatabaseBackup(file) {
+		archive := tar.NewReader(gz)
+		for {
+			_, err := archive.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return "", fmt.Errorf("%s is corrupt: %w", file, err)
+			}
+			if _, err := io.Copy(io.Discard, archive); err != nil {
+				return "", fmt.Errorf("%s is corrupt: %w", file, err)
+			}
+		}
+	}
+	// the rest of the gzip stream holds its checksum
+	if _, err := io.Copy(io.Discard, gz); err != nil {
+		return "", fmt.Errorf("%s is corrupt: %w", file, err)
+	}
+	io.Copy(hash, f)
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if expected != "" && sum != expected {
+		return sum, fmt.Errorf("%s does not match the checksum recorded when it was backed up", file)
+	}
+	return sum, nil
+}
+
+// StreamCommandInput runs cmd on the server with r as its stdin
+func StreamCommandInput(client *ssh.Client, cmd string, r io.Reader) error {
+	cmd = RuntimeCommand(client, cmd)
+	TraceCommand(cmd)
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to create session: %w", err)
+	}
+	defer session.Close()
+	var stderr strings.Builder
+	session.Stdin, session.Stderr = r, &stderr
+	if err := session.Run(cmd); err != nil {
+		return &RemoteCommandError{Cmd: cmd, Stderr: strings.TrimSpace(stderr.String()), Err: err}
+	}
+	return nil
+}
+
+// RemoteRestoreFile is where the archive waits on the server until the volume is restored from it
+func RemoteRestoreFile(appName string) string {
+	return path.Join(RemoteBackupsDir(appName), "restore.tar.gz")
+}
+
+// GetVerifyRemoteArchiveCommand fails when the uploaded archive is not the one checked here
+func GetVerifyRemoteArchiveCommand(file string, sum string) string {
+	return fmt.Sprintf("echo '%s  %s' | sha256sum -c --status", sum, file)
+}
+
+// GetRestoreVolumeCommand empties the volume and unpacks file into it, file is relative to the home of the sidekick user
+func GetRestoreVolumeCommand(volume string, file string) string {
+	return fmt.Sprintf(`docker run --rm -v %s:/volume -v "$HOME/%s":/backup.tar.gz:ro %s sh -c 'find /volume -mindepth 1 -delete && tar -xzf /backup.tar.gz -C /volume'`, volume, file, BackupImage)
+}
+
+// GetComposeProjectCommand runs a compose subcommand like stop or start on every service of the app or preview in dir
+func GetComposeProjectCommand(dir string, action string) string {
+	return fmt.Sprintf("cd %s && docker compose -p %s %s", dir, ComposeProjectForDir(dir), action)
+}
@@ -0,0 +1,171 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const DefaultBadgePath = "/.sidekick/badge.json"
+
+// badgeRefreshSeconds is how often the age in the badge is brought up to date, shields.io caches it as long
+const badgeRefreshSeconds = 300
+
+// BadgeEndpoint is the shields.io endpoint schema - https://shields.io/badges/endpoint-badge
+// Only deploy facts go in here, never hostnames or anything from the server config.
+type BadgeEndpoint struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	Label         string `json:"label"`
+	Message       string `json:"message"`
+	Color         string `json:"color"`
+	CacheSeconds  int    `json:"cacheSeconds"`
+}
+
+func GetBadgePath(appConfig SidekickAppConfig) string {
+	if appConfig.Badge.Path == "" {
+		return DefaultBadgePath
+	}
+	return appConfig.Badge.Path
+}
+
+// FormatDeployAge is how long ago deployedAt was, like "3h ago", rounded down to minutes, hours or days
+func FormatDeployAge(deployedAt time.Time, now time.Time) string {
+	age := now.Sub(deployedAt)
+	switch {
+	case age < time.Minute:
+		return "just now"
+	case age < time.Hour:
+		return fmt.Sprintf("%dm ago", int(age/time.Minute))
+	case age < 24*time.Hour:
+		return fmt.Sprintf("%dh ago", int(age/time.Hour))
+	default:
+		return fmt.Sprintf("%dd ago", int(age/(24*time.Hour)))
+	}
+}
+
+// badgeMessagePrefix is the part of the message that only changes on a deploy, the age goes after it
+func badgeMessagePrefix(version string, sha string) string {
+	parts := []string{version}
+	if sha != "" {
+		parts = append(parts, sha)
+	}
+	return strings.Join(parts, " · ")
+}
+
+func GetBadgeJSON(version string, sha string, deployedAt time.Time, now time.Time) ([]byte, error) {
+	return json.Marshal(BadgeEndpoint{
+		SchemaVersion: 1,
+		Label:         "deployed",
+		Message:       badgeMessagePrefix(version, sha) + " · " + FormatDeployAge(deployedAt, now),
+		Color:         "blue",
+		CacheSeconds:  badgeRefreshSeconds,
+	})
+}
+
+// GetBadgeRefreshScript rewrites badge.json every few minutes so the age keeps up, the same way FormatDeployAge words it.
+// It reads the message and the deploy time from the deployed file next to it, a deploy only has to replace that file.
+func GetBadgeRefreshScript() string {
+	return fmt.Sprintf(`while true; do
+  . /badge/deployed
+  age=$(( $(date +%%s) - DEPLOYED_AT ))
+  if [ "$age" -lt 60 ]; then ago="just now"
+  elif [ "$age" -lt 3600 ]; then ago="$((age / 60))m ago"
+  elif [ "$age" -lt 86400 ]; then ago="$((age / 3600))h ago"
+  else ago="$((age / 86400))d ago"; fi
+  printf '{"schemaVersion":1,"label":"deployed","message":"%%s · %%s","color":"blue","cacheSeconds":%d}' "$MESSAGE" "$ago" > /badge/www/badge.json.partial
+  mv /badge/www/badge.json.partial /badge/www/badge.json
+  sleep %d
+done
+`, badgeRefreshSeconds, badgeRefreshSeconds)
+}
+
+// GetBadgeDeployedFile is what the refresh script sources, the message is only the version and the commit
+func GetBadgeDeployedFile(version string, sha string, deployedAt time.Time) string {
+	return fmt.Sprintf("MESSAGE='%s'\nDEPLOYED_AT=%d\n", badgeMessagePrefix(version, sha), deployedAt.Unix())
+}
+
+func GetBadgeMarkdown(appConfig SidekickAppConfig) string {
+	endpoint := fmt.Sprintf("%s://%s%s", URLScheme(appConfig), appConfig.Url, GetBadgePath(appConfig))
+	return fmt.Sprintf("![deployed](https://img.shields.io/endpoint?url=%s)", endpoint)
+}
+
+// The badge is served by a tiny nginx container in its own compose project.
+// Whatever path is requested gets rewritten to /badge.json so nothing else in the folder is reachable.
+// A busybox container next to it keeps the age in the badge current between deploys.
+func GetBadgeComposeFile(appConfig SidekickAppConfig) DockerComposeFile {
+	routerName := fmt.Sprintf("%s-badge", appConfig.Name)
+	labels := []string{
+		"traefik.enable=true",
+		fmt.Sprintf("traefik.http.routers.%s.rule=Host(`%s`) && Path(`%s`)", routerName, appConfig.Url, GetBadgePath(appConfig)),
+		fmt.Sprintf("traefik.http.routers.%s.priority=1000", routerName),
+		fmt.Sprintf("traefik.http.routers.%s.middlewares=%s-path,%s-headers", routerName, routerName, routerName),
+		fmt.Sprintf("traefik.http.middlewares.%s-path.replacepath.path=/badge.json", routerName),
+		fmt.Sprintf("traefik.http.middlewares.%s-headers.headers.customresponseheaders.Server=", routerName),
+		fmt.Sprintf("traefik.http.middlewares.%s-headers.headers.accesscontrolalloworiginlist=*", routerName),
+		fmt.Sprintf("traefik.http.services.%s.loadbalancer.server.port=80", routerName),
+	}
+	labels = append(labels, GetRouterLabels(appConfig, routerName)...)
+	labels = append(labels, "traefik.docker.network="+AppNetwork(appConfig))
+	badgeService := DockerService{
+		Image:   "nginx:alpine",
+		Restart: "unless-stopped",
+		Volumes: []string{"./www:/usr/share/nginx/html:ro"},
+		Labels:  labels,
+		Networks: []string{
+			AppNetwork(appConfig),
+		},
+	}
+	refreshService := DockerService{
+		Image:   "busybox:stable",
+		Restart: "unless-stopped",
+		Command: "sh /badge/refresh.sh",
+		Volumes: []string{"./:/badge"},
+	}
+	return DockerComposeFile{
+		Services: map[string]DockerService{
+			routerName:              badgeService,
+			routerName + "-refresh": refreshService,
+		},
+		Networks: map[string]DockerNetwork{
+			AppNetwork(appConfig): {
+				External: true,
+			},
+		},
+	}
+}
+
+func UpdateRemoteBadge(client *ssh.Client, appConfig SidekickAppConfig, sha string) error {
+	deployedAt := time.Now()
+	badgeJSON, err := GetBadgeJSON(appConfig.Version, sha, deployedAt, deployedAt)
+	if err != nil {
+		return err
+	}
+	// the refresh container writes badge.json as root, the folder is ours so it can still be removed
+	if _, _, err := RunCommand(client, fmt.Sprintf("mkdir -p %s/badge/www && rm -f %s/badge/www/badge.json", appConfig.Name, appConfig.Name)); err != nil {
+		return err
+	}
+	if err := WriteRemoteFile(client, fmt.Sprintf("%s/badge/refresh.sh", appConfig.Name), []byte(GetBadgeRefreshScript())); err != nil {
+		return err
+	}
+	if err := WriteRemoteFile(client, fmt.Sprintf("%s/badge/deployed", appConfig.Name), []byte(GetBadgeDeployedFile(appConfig.Version, sha, deployedAt))); err != nil {
+		return err
+	}
+	return WriteRemoteFile(client, fmt.Sprintf("%s/badge/www/badge.json", appConfig.Name), badgeJSON)
+}
@@ -0,0 +1,66 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// AppURL is the URL of the app in sidekick.yml, or of one of its preview envs when hash is set
+func AppURL(appConfig SidekickAppConfig, hash string) (string, error) {
+	url := appConfig.Url
+	if hash != "" {
+		preview, ok := appConfig.PreviewEnvs[hash]
+		if !ok {
+			return "", fmt.Errorf("no preview env found for %s", hash)
+		}
+		url = preview.Url
+	}
+	if url == "" {
+		return "", fmt.Errorf("no url found in %s", AppConfigFile)
+	}
+	// previews are saved with the scheme, the app domain is not
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		url = URLScheme(appConfig) + "://" + url
+	}
+	return url, nil
+}
+
+// HasDisplay reports whether there is a desktop to open a browser on
+func HasDisplay() bool {
+	if runtime.GOOS == "linux" || runtime.GOOS == "freebsd" {
+		return os.Getenv("DISPLAY") != "" || os.Getenv("WAYLAND_DISPLAY") != ""
+	}
+	return os.Getenv("SSH_CONNECTION") == ""
+}
+
+// OpenBrowser opens url in the default browser with the opener of the OS
+func OpenBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		// the empty title keeps start from reading the url as the window title
+		cmd = exec.Command("cmd", "/c", "start", "", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	return cmd.Start()
+}
@@ -0,0 +1,177 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/mightymoud/sidekick/render"
+)
+
+var (
+	buildStepPattern   = regexp.MustCompile(`^#(\d+) \[(?:[\w.-]+ )?\d+/\d+\]`)
+	buildCachedPattern = regexp.MustCompile(`^#(\d+) CACHED`)
+)
+
+// BuildCacheStats counts the Dockerfile steps of a --progress=plain build that came from cache
+type BuildCacheStats struct {
+	steps  map[string]bool
+	cached map[string]bool
+}
+
+func (s *BuildCacheStats) Observe(line string) {
+	if s.steps == nil {
+		s.steps, s.cached = map[string]bool{}, map[string]bool{}
+	}
+	if match := buildStepPattern.FindStringSubmatch(line); match != nil {
+		s.steps[match[1]] = true
+	}
+	if match := buildCachedPattern.FindStringSubmatch(line); match != nil {
+		s.cached[match[1]] = true
+	}
+}
+
+// Steps is 0 on a nil BuildCacheStats, which is what stages that don't build locally return
+func (s *BuildCacheStats) Steps() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.steps)
+}
+
+func (s *BuildCacheStats) Cached() int {
+	cached := 0
+	for id := range s.cached {
+		if s.steps[id] {
+			cached++
+		}
+	}
+	return cached
+}
+
+func (s *BuildCacheStats) String() string {
+	if s.Steps() == 0 {
+		return ""
+	}
+	return fmt.Sprintf("Build cache: %d/%d steps cached (%d%%)", s.Cached(), s.Steps(), s.Cached()*100/s.Steps())
+}
+
+// BuildCacheTag is the image --push sends along with every build so the next one reuses its layers, wherever it runs
+const BuildCacheTag = "buildcache"
+
+// BuildCache is where a build reuses layers from, NoCache runs every step again
+type BuildCache struct {
+	From    []string
+	NoCache bool
+}
+
+// GetBuildCache keys the cache by the app. The last image built for it carries inline cache metadata, on this machine
+// and on the server, and with a registry so does the buildcache image pushed with it. cacheFrom is --cache-from-image.
+func GetBuildCache(appConfig SidekickAppConfig, cacheFrom string, registry bool, noCache bool) (BuildCache, error) {
+	if noCache {
+		return BuildCache{NoCache: true}, nil
+	}
+	cache := BuildCache{}
+	if cacheFrom != "" {
+		cache.From = append(cache.From, cacheFrom)
+	}
+	latest, err := AppImage(appConfig, "latest")
+	if err != nil {
+		return cache, err
+	}
+	cache.From = append(cache.From, latest)
+	if registry {
+		image, err := AppImage(appConfig, BuildCacheTag)
+		if err != nil {
+			return cache, err
+		}
+		cache.From = append(cache.From, image)
+	}
+	return cache, nil
+}
+
+// GetDockerBuildArgs adds the flags every docker build of sidekick shares.
+// Inline cache metadata is what lets a pulled image seed the cache of a later build.
+func GetDockerBuildArgs(tag string, platform string, cache BuildCache, context string) []string {
+	args := []string{"build", "--tag", tag, "--progress=plain", fmt.Sprintf("--platform=%s", platform), "--build-arg", "BUILDKIT_INLINE_CACHE=1"}
+	if cache.NoCache {
+		args = append(args, "--no-cache")
+	}
+	for _, from := range cache.From {
+		args = append(args, "--cache-from", from)
+	}
+	return append(args, context)
+}
+
+// BuildTimeReport compares how long a build took with the last one, which is empty before the first build
+func BuildTimeReport(took time.Duration, last string) string {
+	took = took.Round(time.Second)
+	report := fmt.Sprintf("Build took %s", took)
+	lastTook, err := time.ParseDuration(last)
+	if err != nil || lastTook <= 0 {
+		return report
+	}
+	switch {
+	case took < lastTook:
+		return fmt.Sprintf("%s, %s faster than the last build (%d%%)", report, lastTook-took, (lastTook-took)*100/lastTook)
+	case took > lastTook:
+		return fmt.Sprintf("%s, %s slower than the last build", report, took-lastTook)
+	}
+	return report + ", as long as the last build"
+}
+
+// TraceBuildTime reports the build time against the last build with --verbose
+func TraceBuildTime(took time.Duration, last string) {
+	tracer.Info(BuildTimeReport(took, last))
+}
+
+// RunDockerBuildWithTUIHook streams the build logs to the TUI and counts cache hits on the way.
+// The output is read to the end before waiting on the build so no log line gets lost.
+func RunDockerBuildWithTUIHook(buildCmd *exec.Cmd, p *tea.Program) (*BuildCacheStats, error) {
+	stats := &BuildCacheStats{}
+	TraceExec(buildCmd)
+	stderr, err := buildCmd.StderrPipe()
+	if err != nil {
+		return stats, err
+	}
+	if err := buildCmd.Start(); err != nil {
+		return stats, err
+	}
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		line := scanner.Text()
+		stats.Observe(line)
+		if strings.TrimSpace(line) != "" {
+			p.Send(render.LogMsg{LogLine: line + "\n"})
+		}
+	}
+	return stats, buildCmd.Wait()
+}
+
+// SeedBuildCache pulls the image so its layers can be reused, callers treat a failure as a warning
+func SeedBuildCache(ref string) error {
+	pullCmd := OperationCommand("docker", "pull", ref)
+	TraceExec(pullCmd)
+	if output, err := pullCmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("unable to pull %s: %s", ref, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
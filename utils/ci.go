@@ -0,0 +1,75 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+const GitHubWorkflowPath = ".github/workflows/sidekick.yml"
+
+// CISecrets are the repo secrets the generated workflow reads, in the order they are documented
+var CISecrets = []string{"SIDEKICK_SERVER_ADDRESS", "SIDEKICK_PUBLIC_KEY", "SIDEKICK_SECRET_KEY", "SIDEKICK_SSH_KEY", "SIDEKICK_KNOWN_HOSTS"}
+
+const gitHubWorkflowTemplate = `# Generated by sidekick ci init github
+name: Deploy with Sidekick
+
+on:
+  push:
+    branches: [%s]
+
+# one deploy at a time, a newer push waits for the running one to finish
+concurrency:
+  group: sidekick-deploy
+  cancel-in-progress: false
+
+jobs:
+  deploy:
+    runs-on: ubuntu-latest
+    steps:
+      - uses: actions/checkout@v4
+        with:
+          fetch-depth: 0
+      - uses: actions/setup-go@v5
+        with:
+          go-version: stable
+      - name: Install sidekick
+        run: go install github.com/mightymoud/sidekick@%s
+      - name: Trust the server host key
+        run: |
+          mkdir -p ~/.ssh
+          echo "$SIDEKICK_KNOWN_HOSTS" >> ~/.ssh/known_hosts
+        env:
+          SIDEKICK_KNOWN_HOSTS: ${{ secrets.SIDEKICK_KNOWN_HOSTS }}
+      - name: Deploy
+        run: sidekick deploy --ci --yes
+        env:
+%s`
+
+// GetGitHubWorkflow renders a workflow that deploys every push to branch, version is the sidekick release it installs
+func GetGitHubWorkflow(branch string, version string) string {
+	if version == "" || version == "dev" {
+		version = "latest"
+	}
+	env := strings.Builder{}
+	for _, secret := range CISecrets {
+		if secret == "SIDEKICK_KNOWN_HOSTS" {
+			continue
+		}
+		env.WriteString(fmt.Sprintf("          %s: ${{ secrets.%s }}\n", secret, secret))
+	}
+	return fmt.Sprintf(gitHubWorkflowTemplate, branch, version, env.String())
+}
@@ -0,0 +1,132 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// CompletePreviewHashes completes a single hash argument or flag, it offers the preview envs of sidekick.yml in the current folder, it never connects to the VPS
+func CompletePreviewHashes(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	appConfig, err := LoadAppConfig()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	hashes := make([]string, 0, len(appConfig.PreviewEnvs))
+	for hash, preview := range appConfig.PreviewEnvs {
+		hashes = append(hashes, fmt.Sprintf("%s\t%s", hash, preview.Url))
+	}
+	sort.Strings(hashes)
+	return hashes, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completionConfig reads the sidekick config for completion. Root pre-runs are skipped for completion so the file is read here.
+func completionConfig(cmd *cobra.Command) (SidekickConfig, bool) {
+	configPath, _ := cmd.Flags().GetString("config")
+	if envPath := os.Getenv("SIDEKICK_CONFIG"); envPath != "" && !cmd.Flags().Changed("config") {
+		configPath = envPath
+	}
+	var config SidekickConfig
+	content, err := os.ReadFile(configPath)
+	if err != nil {
+		return config, false
+	}
+	return config, yaml.Unmarshal(content, &config) == nil
+}
+
+// CompleteContexts offers the contexts of the sidekick config
+func CompleteContexts(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	config, ok := completionConfig(cmd)
+	if !ok {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	contexts := make([]string, 0, len(config.Contexts))
+	for _, ctx := range config.Contexts {
+		contexts = append(contexts, fmt.Sprintf("%s\tserver %s", ctx.Name, ctx.Server))
+	}
+	return contexts, cobra.ShellCompDirectiveNoFileComp
+}
+
+// CompleteConfigKeys offers the keys of sidekick config get and set, only for the first argument
+func CompleteConfigKeys(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	config, ok := completionConfig(cmd)
+	if !ok || len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	keys := []string{}
+	for _, entry := range ListConfigValues(&config, false) {
+		keys = append(keys, entry.Key)
+	}
+	return keys, cobra.ShellCompDirectiveNoFileComp
+}
+
+// CompleteServers offers the names of the servers in the sidekick config
+func CompleteServers(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	config, ok := completionConfig(cmd)
+	if !ok {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	servers := make([]string, 0, len(config.Servers))
+	for _, server := range config.Servers {
+		servers = append(servers, fmt.Sprintf("%s\t%s", server.Name, server.Address))
+	}
+	return servers, cobra.ShellCompDirectiveNoFileComp
+}
+
+// CompleteServerAddresses offers the addresses of the servers in the sidekick config, for flags that take an IP
+func CompleteServerAddresses(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	config, ok := completionConfig(cmd)
+	if !ok {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	addresses := make([]string, 0, len(config.Servers))
+	for _, server := range config.Servers {
+		addresses = append(addresses, fmt.Sprintf("%s\t%s", server.Address, server.Name))
+	}
+	return addresses, cobra.ShellCompDirectiveNoFileComp
+}
+
+// CompleteApps offers the apps of the apps map of sidekick.yml, --app-config and --path are read here too since
+// completion skips the root pre-runs
+func CompleteApps(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	file := AppConfigFile
+	if appConfigFile, _ := cmd.Flags().GetString("app-config"); appConfigFile != "" {
+		file = appConfigFile
+	} else if appPath, _ := cmd.Flags().GetString("path"); appPath != "" {
+		file = filepath.Join(appPath, filepath.Base(AppConfigFile))
+	}
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(content, &doc); err != nil || len(doc.Content) == 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	apps := mappingValue(doc.Content[0], appConfigAppsKey)
+	if apps == nil || apps.Kind != yaml.MappingNode {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	return AppConfigNames(apps), cobra.ShellCompDirectiveNoFileComp
+}
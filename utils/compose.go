@@ -0,0 +1,310 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const (
+	DefaultCertResolver = "default"
+	StagingCertResolver = "staging"
+	OrchestratorCompose = "compose"
+	OrchestratorSwarm   = "swarm"
+	// StackComposeVersion is the compose file version docker stack deploy is given
+	StackComposeVersion = "3.8"
+	// SharedComposeProject is where Traefik runs. Every app and preview used to run in it too, before each got a project of its own.
+	SharedComposeProject = "sidekick"
+	// DefaultNetwork is the docker network Traefik and the apps share when the server doesn't name another one
+	DefaultNetwork = "sidekick"
+)
+
+var networkNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// NetworkName is the docker network of the server
+func (s SidekickServer) NetworkName() string {
+	if s.Network == "" {
+		return DefaultNetwork
+	}
+	return s.Network
+}
+
+// ValidateNetworkName checks name is a docker network name that is safe to put in a command
+func ValidateNetworkName(name string) error {
+	if !networkNamePattern.MatchString(name) {
+		return fmt.Errorf("%q is not a docker network name, use letters, numbers, dots, dashes and underscores", name)
+	}
+	return nil
+}
+
+// AppNetwork is the docker network the app shares with Traefik
+func AppNetwork(appConfig SidekickAppConfig) string {
+	if appConfig.Network == "" {
+		return DefaultNetwork
+	}
+	return appConfig.Network
+}
+
+// AppNetworks are the docker networks the app joins, the one it shares with Traefik first then those in networks
+func AppNetworks(appConfig SidekickAppConfig) []string {
+	networks := []string{AppNetwork(appConfig)}
+	for _, network := range appConfig.Networks {
+		if !slices.Contains(networks, network) {
+			networks = append(networks, network)
+		}
+	}
+	return networks
+}
+
+// MissingNetworks are the networks of the app the server doesn't have.
+// Compose would only fail on them once the new containers are created.
+func MissingNetworks(remote RemoteExecutor, appConfig SidekickAppConfig) ([]string, error) {
+	output, err := remote.Output("docker network ls --format '{{.Name}}'")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the docker networks: %w", err)
+	}
+	existing := strings.Fields(output)
+	missing := []string{}
+	for _, network := range AppNetworks(appConfig) {
+		if !slices.Contains(existing, network) {
+			missing = append(missing, network)
+		}
+	}
+	return missing, nil
+}
+
+// CheckNetworksStage runs MissingNetworks as a stage of deploy or preview, before anything is built
+func CheckNetworksStage(remote RemoteExecutor, appConfig SidekickAppConfig) *StageError {
+	missing, err := MissingNetworks(remote, appConfig)
+	if err != nil {
+		return NewStageError("Networks", ExitCodeRemote, "", err)
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	hint := fmt.Sprintf("Create it on the server with docker network create %s, or remove it from networks in sidekick.yml", missing[0])
+	if missing[0] == AppNetwork(appConfig) {
+		hint = "Run sidekick init again to create the network Traefik reaches your apps on"
+	}
+	return NewStageError("Networks", ExitCodeConfig, hint, fmt.Errorf("the server has no %s network", strings.Join(missing, ", ")))
+}
+
+// NetworksStep is the dry run line of the network check
+func NetworksStep(appConfig SidekickAppConfig) string {
+	return "check the server has the networks " + strings.Join(AppNetworks(appConfig), ", ")
+}
+
+// ComposeProject is the compose project of an app, or of its preview env when hash is set.
+// It is named like the main service of the project, so the containers of an older deploy in the shared project are easy to find.
+func ComposeProject(appName string, hash string) string {
+	if hash == "" {
+		return appName
+	}
+	return fmt.Sprintf("%s-%s", appName, hash)
+}
+
+// GetRemoveServiceCommand removes every container of service, whichever compose project it runs in
+func GetRemoveServiceCommand(service string) string {
+	return fmt.Sprintf("docker ps -aq --filter label=com.docker.compose.service=%s | xargs -r docker rm -f", service)
+}
+
+// IsSwarm is true when the app runs as a Docker Swarm stack instead of a compose project
+func IsSwarm(appConfig SidekickAppConfig) bool {
+	return appConfig.Orchestrator == OrchestratorSwarm
+}
+
+// GetCertResolver returns an empty resolver when the app brings its own cert or has no TLS
+func GetCertResolver(appConfig SidekickAppConfig) string {
+	if HasCustomCert(appConfig) || !TLSEnabled(appConfig) {
+		return ""
+	}
+	if appConfig.StagingTLS {
+		return StagingCertResolver
+	}
+	return DefaultCertResolver
+}
+
+// GetRouterLabels puts the router on the entrypoint of the app and, unless TLS is off, on its cert
+func GetRouterLabels(appConfig SidekickAppConfig, routerName string) []string {
+	labels := []string{fmt.Sprintf("traefik.http.routers.%s.entrypoints=%s", routerName, GetEntrypoint(appConfig))}
+	if !TLSEnabled(appConfig) {
+		return labels
+	}
+	labels = append(labels, fmt.Sprintf("traefik.http.routers.%s.tls=true", routerName))
+	if certResolver := GetCertResolver(appConfig); certResolver != "" {
+		labels = append(labels, fmt.Sprintf("traefik.http.routers.%s.tls.certresolver=%s", routerName, certResolver))
+	}
+	return labels
+}
+
+func GetTraefikLabels(appConfig SidekickAppConfig, routerName string, host string, port string) []string {
+	labels := []string{
+		"traefik.enable=true",
+		fmt.Sprintf("traefik.http.routers.%s.rule=Host(`%s`)", routerName, host),
+		fmt.Sprintf("traefik.http.services.%s.loadbalancer.server.port=%s", routerName, port),
+	}
+	labels = append(labels, GetRouterLabels(appConfig, routerName)...)
+	return append(labels, "traefik.docker.network="+AppNetwork(appConfig))
+}
+
+// ValidateLabel checks label is key=value, the value may be empty
+func ValidateLabel(label string) error {
+	key, _, found := strings.Cut(label, "=")
+	if !found || key == "" || strings.ContainsAny(key, " \t\n") {
+		return fmt.Errorf("%q is not a label, use key=value", label)
+	}
+	return nil
+}
+
+// MergeLabels adds custom after generated, dropping the generated labels whose key custom sets again
+func MergeLabels(generated []string, custom []string) []string {
+	if len(custom) == 0 {
+		return generated
+	}
+	overridden := map[string]bool{}
+	for _, label := range custom {
+		key, _, _ := strings.Cut(label, "=")
+		overridden[key] = true
+	}
+	labels := []string{}
+	for _, label := range generated {
+		if key, _, _ := strings.Cut(label, "="); !overridden[key] {
+			labels = append(labels, label)
+		}
+	}
+	return append(labels, custom...)
+}
+
+// GetAppComposeFile generates the compose file for the app or one of its previews.
+// Launch, deploy and preview all go through here so the labels stay consistent.
+func GetAppComposeFile(appConfig SidekickAppConfig, serviceName string, image string, host string, environment []string) DockerComposeFile {
+	service := DockerService{
+		Image:       image,
+		Restart:     "unless-stopped",
+		Labels:      MergeLabels(GetTraefikLabels(appConfig, serviceName, host, fmt.Sprint(appConfig.Port)), appConfig.Labels),
+		Environment: environment,
+		Networks:    AppNetworks(appConfig),
+	}
+	composeFile := DockerComposeFile{
+		Services: map[string]DockerService{
+			serviceName: service,
+		},
+		Networks: map[string]DockerNetwork{},
+	}
+	// every network is made outside the app, by init or by hand, and outlives it
+	for _, network := range service.Networks {
+		composeFile.Networks[network] = DockerNetwork{External: true}
+	}
+	addAddonServices(&composeFile, appConfig, serviceName)
+	if appConfig.ComposeOverride != nil {
+		composeFile = MergeComposeFile(composeFile, *appConfig.ComposeOverride, appConfig.Name, serviceName)
+	}
+	applyLogging(&composeFile, appConfig)
+	applyLogLabels(&composeFile, appConfig, serviceName)
+	if IsSwarm(appConfig) {
+		return toStackComposeFile(composeFile)
+	}
+	return composeFile
+}
+
+// toStackComposeFile moves the labels under deploy where swarm reads them, and rolls updates out by starting the new task first.
+// The sidekick labels stay on the containers too, that is where Promtail looks for them.
+func toStackComposeFile(composeFile DockerComposeFile) DockerComposeFile {
+	composeFile.Version = StackComposeVersion
+	for name, service := range composeFile.Services {
+		service.Deploy = &DockerDeploy{
+			Replicas:      1,
+			Labels:        service.Labels,
+			UpdateConfig:  DockerUpdateConfig{Order: "start-first", FailureAction: "rollback"},
+			RestartPolicy: DockerRestartPolicy{Condition: "any"},
+		}
+		service.Labels = nil
+		for _, label := range service.Deploy.Labels {
+			if strings.HasPrefix(label, AppLabel+"=") || strings.HasPrefix(label, PreviewLabel+"=") {
+				service.Labels = append(service.Labels, label)
+			}
+		}
+		service.Restart = ""
+		composeFile.Services[name] = service
+	}
+	return composeFile
+}
+
+// GetPreviewComposeFile is the compose file of the preview env for deployHash
+// The previews share a wildcard cert when they have a previewDomain and the server can get one.
+func GetPreviewComposeFile(appConfig SidekickAppConfig, server SidekickServer, deployHash string, imageName string, dockerEnvProperty []string) DockerComposeFile {
+	// a custom cert is issued for the app domain, previews get theirs from Let's Encrypt
+	previewConfig := appConfig
+	previewConfig.TLS = SidekickAppTLSConfig{Disabled: appConfig.TLS.Disabled}
+	previewConfig.Network = server.NetworkName()
+	metadata := GetDeployMetadata(appConfig.Name, MetadataEnvPreview, deployHash)
+	serviceName := fmt.Sprintf("%s-%s", appConfig.Name, deployHash)
+	previewURL := PreviewHost(appConfig, deployHash)
+	if UsesWildcardCert(appConfig, server) {
+		previewConfig.Labels = append(GetWildcardLabels(appConfig, serviceName), appConfig.Labels...)
+	}
+	return GetAppComposeFile(previewConfig, serviceName, imageName, previewURL, WithMetadataEnv(dockerEnvProperty, metadata))
+}
+
+// GetComposeUpCommand brings up the compose project in dir, decrypting the env file with sops when there is one.
+// A container left in the shared project by an older sidekick would serve the same route, so it goes first.
+func GetComposeUpCommand(dir string, hasEnvFile bool, secretKey string) string {
+	project := ComposeProjectForDir(dir)
+	legacy := fmt.Sprintf("docker ps -aq --filter label=com.docker.compose.project=%s --filter label=com.docker.compose.service=%s | xargs -r docker rm -f", SharedComposeProject, project)
+	if hasEnvFile {
+		return fmt.Sprintf(`cd %s && %s && export SOPS_AGE_KEY=%s && sops exec-env encrypted.env 'docker compose -p %s up -d'`, dir, legacy, secretKey, project)
+	}
+	return fmt.Sprintf(`cd %s && %s && docker compose -p %s up -d`, dir, legacy, project)
+}
+
+// GetStackDeployCommand deploys the compose file in dir as a swarm stack named like the compose project would be
+func GetStackDeployCommand(dir string, hasEnvFile bool, secretKey string) string {
+	deploy := fmt.Sprintf("docker stack deploy --with-registry-auth -c docker-compose.yaml %s", ComposeProjectForDir(dir))
+	if hasEnvFile {
+		return fmt.Sprintf(`cd %s && export SOPS_AGE_KEY=%s && sops exec-env encrypted.env '%s'`, dir, secretKey, deploy)
+	}
+	return fmt.Sprintf(`cd %s && %s`, dir, deploy)
+}
+
+// GetUpCommand starts the app or preview in dir with the orchestrator of the app
+func GetUpCommand(appConfig SidekickAppConfig, dir string, hasEnvFile bool, secretKey string) string {
+	if IsSwarm(appConfig) {
+		return GetStackDeployCommand(dir, hasEnvFile, secretKey)
+	}
+	return GetComposeUpCommand(dir, hasEnvFile, secretKey)
+}
+
+// GetRemoveAppCommand removes the containers of the app or preview service.
+// A stack goes as a whole and stack rm returns before its containers are gone, so it waits for them to free the image.
+func GetRemoveAppCommand(appConfig SidekickAppConfig, service string) string {
+	if IsSwarm(appConfig) {
+		return fmt.Sprintf("docker stack rm %[1]s && while docker ps -q -f label=com.docker.stack.namespace=%[1]s | grep -q .; do sleep 1; done", service)
+	}
+	return GetRemoveServiceCommand(service)
+}
+
+// GetDeployAppScript fills in DeployAppScript, the zero downtime swap deploy runs in the app folder
+func GetDeployAppScript(appConfig SidekickAppConfig) string {
+	replacer := strings.NewReplacer(
+		"$compose_project", ComposeProject(appConfig.Name, ""),
+		"$service_name", appConfig.Name,
+		"$app_port", fmt.Sprint(appConfig.Port),
+		"$has_env", appConfig.Env.File,
+	)
+	return replacer.Replace(DeployAppScript)
+}
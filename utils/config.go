@@ -17,7 +17,10 @@ package utils
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 
+	"github.com/charmbracelet/log"
+	"github.com/mightymoud/sidekick/render"
 	"github.com/spf13/cobra"
 	"gopkg.in/yaml.v3"
 )
@@ -37,7 +40,55 @@ func (c *SidekickConfig) Save(path string) error {
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(path, data, os.ModePerm)
+	return writeFileAtomic(path, data)
+}
+
+// SaveServer applies change to the server named name as the config file at path has it, then writes the file.
+// The loaded config isn't saved since it may hold SIDEKICK_* env values, those must never end up in the file.
+// A server that only comes from the env vars has nothing to change in the file, that is only a warning.
+func SaveServer(path string, name string, change func(server *SidekickServer)) error {
+	var config SidekickConfig
+	content, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := yaml.Unmarshal(content, &config); err != nil {
+		return fmt.Errorf("error unmarshaling the config yaml file: %w", err)
+	}
+	server, err := config.FindServer(name)
+	if err != nil {
+		render.GetLogger(log.Options{Prefix: "Sidekick Config"}).Warnf("Server %s only comes from the SIDEKICK_* env vars, so this change is not saved", name)
+		return nil
+	}
+	change(&server)
+	config.AddOrReplaceServer(server)
+	return config.Save(path)
+}
+
+// writeFileAtomic writes next to path then renames over it, a crash or a full disk halfway never leaves half a config
+func writeFileAtomic(path string, data []byte) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.partial")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	// the config holds the age secret keys of the servers
+	if err := file.Chmod(0600); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
 }
 
 func (c *SidekickConfig) Print() error {
@@ -0,0 +1,190 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// listContainerLabelsCommand prints a line per label of every running container, prefixed with the container name
+const listContainerLabelsCommand = `docker ps -q | xargs -r docker inspect -f '{{$c := .Name}}{{range $k, $v := .Config.Labels}}{{$c}} {{$k}}={{$v}}{{"\n"}}{{end}}'`
+
+// RouteConflict is another app or preview on the VPS that would fight with the one being deployed
+type RouteConflict struct {
+	Owner  string
+	Reason string
+}
+
+// RouteConflictError lists every conflict found, Traefik would otherwise pick one of the apps without saying so
+type RouteConflictError struct {
+	Conflicts []RouteConflict
+}
+
+func (e *RouteConflictError) Error() string {
+	lines := []string{}
+	for _, conflict := range e.Conflicts {
+		lines = append(lines, fmt.Sprintf("%s %s", conflict.Owner, conflict.Reason))
+	}
+	return "conflicts with other apps on the server:\n  " + strings.Join(lines, "\n  ")
+}
+
+// runningContainer is what the conflict check needs from the labels of a container
+type runningContainer struct {
+	name       string
+	project    string
+	service    string
+	workingDir string
+	hosts      []string
+}
+
+// owner names the app or preview a container belongs to, from the folder compose ran in
+func (c runningContainer) owner() string {
+	if c.workingDir == "" {
+		return "app " + c.project
+	}
+	previews := "/" + path.Base(RemotePreviewsDir("")) + "/"
+	if dir, hash, found := strings.Cut(c.workingDir, previews); found {
+		return fmt.Sprintf("preview %s of app %s", hash, path.Base(dir))
+	}
+	return "app " + path.Base(c.workingDir)
+}
+
+// ownedBy is true for the containers of the app or preview deployed from dir, older ones included
+func (c runningContainer) ownedBy(dir string) bool {
+	if c.workingDir == "" {
+		// swarm services have no working dir, their stack is named after the app
+		return c.project == ComposeProjectForDir(dir)
+	}
+	return strings.HasSuffix(c.workingDir, "/"+dir)
+}
+
+// previewOf is true for the containers of any preview env of appName
+func (c runningContainer) previewOf(appName string) bool {
+	return strings.Contains(c.workingDir, "/"+RemotePreviewsDir(appName)+"/")
+}
+
+func listRunningContainers(remote RemoteExecutor) ([]runningContainer, error) {
+	output, err := remote.Output(listContainerLabelsCommand)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the containers on the server: %w", err)
+	}
+	containers := map[string]*runningContainer{}
+	names := []string{}
+	for _, line := range outputLines(output) {
+		name, label, found := strings.Cut(line, " ")
+		if !found {
+			continue
+		}
+		container, ok := containers[name]
+		if !ok {
+			container = &runningContainer{name: strings.TrimPrefix(name, "/")}
+			containers[name] = container
+			names = append(names, name)
+		}
+		key, value, _ := strings.Cut(label, "=")
+		switch {
+		case key == "com.docker.compose.project" || key == "com.docker.stack.namespace":
+			container.project = value
+		case key == "com.docker.compose.service":
+			container.service = value
+		case key == "com.docker.compose.project.working_dir":
+			container.workingDir = value
+		case strings.HasPrefix(key, "traefik.http.routers.") && strings.HasSuffix(key, ".rule"):
+			for _, match := range routerHostPattern.FindAllStringSubmatch(value, -1) {
+				container.hosts = append(container.hosts, match[1])
+			}
+		}
+	}
+	sort.Strings(names)
+	running := []runningContainer{}
+	for _, name := range names {
+		running = append(running, *containers[name])
+	}
+	return running, nil
+}
+
+// CheckRouteConflicts fails when another app on the server serves host, or runs a compose service named service.
+// dir is the folder of the app or preview on the server, its own containers and the ones it replaces are fine.
+func CheckRouteConflicts(remote RemoteExecutor, dir string, service string, host string) error {
+	containers, err := listRunningContainers(remote)
+	if err != nil {
+		return err
+	}
+	conflicts := []RouteConflict{}
+	seen := map[RouteConflict]bool{}
+	add := func(conflict RouteConflict) {
+		if !seen[conflict] {
+			seen[conflict] = true
+			conflicts = append(conflicts, conflict)
+		}
+	}
+	for _, container := range containers {
+		if container.ownedBy(dir) {
+			continue
+		}
+		for _, routed := range container.hosts {
+			if strings.EqualFold(routed, host) {
+				add(RouteConflict{Owner: container.owner(), Reason: "already serves " + host})
+			}
+		}
+		// sidekick finds the containers of an app by service name, whichever project they are in
+		if container.service == service {
+			add(RouteConflict{Owner: container.owner(), Reason: "already runs a service named " + service})
+		}
+	}
+	if len(conflicts) > 0 {
+		return &RouteConflictError{Conflicts: conflicts}
+	}
+	return nil
+}
+
+// CheckRouteConflictsStage runs CheckRouteConflicts as a stage of launch, deploy or preview
+func CheckRouteConflictsStage(remote RemoteExecutor, dir string, service string, host string) *StageError {
+	err := CheckRouteConflicts(remote, dir, service, host)
+	if err == nil {
+		return nil
+	}
+	code := ExitCodeRemote
+	var conflictErr *RouteConflictError
+	if errors.As(err, &conflictErr) {
+		code = ExitCodeConfig
+	}
+	return NewStageError("Route conflicts", code, "", err)
+}
+
+// RouteConflictsStep is the dry run line of the conflict check
+func RouteConflictsStep(service string, host string) string {
+	return fmt.Sprintf("check no other app serves %s or runs a service named %s", host, service)
+}
+
+// AppContainers names the running containers of the app, and of its preview envs when previews is set.
+// They are found by the folder their compose project runs in, another app with a similar name never shows up.
+func AppContainers(remote RemoteExecutor, appName string, previews bool) ([]string, error) {
+	containers, err := listRunningContainers(remote)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, container := range containers {
+		if container.ownedBy(appName) || (previews && container.previewOf(appName)) {
+			names = append(names, container.name)
+		}
+	}
+	return names, nil
+}
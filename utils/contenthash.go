@@ -0,0 +1,150 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// IsGitRepo is false for a project outside any git repository, like a generated site
+func IsGitRepo() bool {
+	return exec.Command("git", "rev-parse", "--is-inside-work-tree").Run() == nil
+}
+
+// BuildID names a build after the current commit, or after the content of buildContext outside a git repository
+func BuildID(buildContext string) (id string, fromGit bool, err error) {
+	if IsGitRepo() {
+		id, err = GetGitShortHash()
+		return id, true, err
+	}
+	id, err = ContentHash(buildContext)
+	return id, false, err
+}
+
+type dockerignoreRule struct {
+	pattern *regexp.Regexp
+	include bool
+}
+
+// parseDockerignore turns the patterns of a .dockerignore into rules, the last rule matching a path decides
+func parseDockerignore(content string) []dockerignoreRule {
+	rules := []dockerignoreRule{}
+	for _, line := range strings.Split(content, "\n") {
+		pattern := strings.TrimSpace(line)
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+		include := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(filepath.ToSlash(filepath.Clean(strings.TrimPrefix(pattern, "!"))), "/")
+		var expr strings.Builder
+		for i := 0; i < len(pattern); i++ {
+			switch {
+			case strings.HasPrefix(pattern[i:], "**"):
+				expr.WriteString(".*")
+				i++
+			case pattern[i] == '*':
+				expr.WriteString("[^/]*")
+			case pattern[i] == '?':
+				expr.WriteString("[^/]")
+			default:
+				expr.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+			}
+		}
+		// a pattern matching a folder covers everything in it
+		rules = append(rules, dockerignoreRule{pattern: regexp.MustCompile("^" + expr.String() + "(/.*)?$"), include: include})
+	}
+	return rules
+}
+
+func dockerignored(rules []dockerignoreRule, path string) bool {
+	ignored := false
+	for _, rule := range rules {
+		if rule.pattern.MatchString(path) {
+			ignored = !rule.include
+		}
+	}
+	return ignored
+}
+
+// ContentHash identifies a build context by the files docker would send, .dockerignore is respected.
+// The same content gives the same 7 character id on every run and every machine.
+func ContentHash(buildContext string) (string, error) {
+	dockerignore, err := os.ReadFile(filepath.Join(buildContext, ".dockerignore"))
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	rules := parseDockerignore(string(dockerignore))
+	hasIncludes := false
+	for _, rule := range rules {
+		hasIncludes = hasIncludes || rule.include
+	}
+
+	hash := sha256.New()
+	// WalkDir goes in lexical order so the files are always hashed in the same order
+	err = filepath.WalkDir(buildContext, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(buildContext, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if dockerignored(rules, rel) {
+			// an exception further down could bring a file of an ignored folder back
+			if entry.IsDir() && !hasIncludes {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		switch {
+		case entry.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(hash, "link\x00%s\x00%s\x00", rel, target)
+		case entry.Type().IsRegular():
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(hash, "file\x00%s\x00%d\x00", rel, len(content))
+			hash.Write(content)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to hash the build context: %w", err)
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil))[:7], nil
+}
+
+// BuildUnchanged is true when buildHash is the content hash the live image was built from and that image is still on
+// the server, so building and shipping it again would give the same image
+func BuildUnchanged(remote RemoteExecutor, appConfig SidekickAppConfig, buildHash string, image string) bool {
+	if buildHash == "" || buildHash != appConfig.BuildHash {
+		return false
+	}
+	_, err := remote.Output(fmt.Sprintf("docker image inspect --format '{{.Id}}' %s", image))
+	return err == nil
+}
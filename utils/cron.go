@@ -0,0 +1,195 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"encoding/base64"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RemoteAgeKeyFile lets cron jobs decrypt the env file of their app while nobody is deploying, only the sidekick user reads it
+const RemoteAgeKeyFile = ".config/sidekick/age.key"
+
+var cronMacros = []string{"@yearly", "@annually", "@monthly", "@weekly", "@daily", "@midnight", "@hourly"}
+
+// cronFieldRanges are the bounds of minute, hour, day of month, month and day of week
+var cronFieldRanges = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+// ValidateCronSchedule accepts five crontab fields of numbers, ranges, lists and steps, or a macro like @daily
+func ValidateCronSchedule(schedule string) error {
+	if strings.HasPrefix(schedule, "@") {
+		for _, macro := range cronMacros {
+			if schedule == macro {
+				return nil
+			}
+		}
+		return fmt.Errorf("%q is not a schedule, use one like @daily", schedule)
+	}
+	fields := strings.Fields(schedule)
+	if len(fields) != 5 {
+		return fmt.Errorf("%q must have 5 fields like 0 3 * * *", schedule)
+	}
+	for i, field := range fields {
+		for _, part := range strings.Split(field, ",") {
+			if !validCronPart(part, cronFieldRanges[i][0], cronFieldRanges[i][1]) {
+				return fmt.Errorf("%q is not a valid schedule, %q is out of place", schedule, field)
+			}
+		}
+	}
+	return nil
+}
+
+func validCronPart(part string, min int, max int) bool {
+	base, step, hasStep := strings.Cut(part, "/")
+	if hasStep {
+		if n, err := strconv.Atoi(step); err != nil || n < 1 {
+			return false
+		}
+	}
+	if base == "*" {
+		return true
+	}
+	from, to, isRange := strings.Cut(base, "-")
+	if !isRange {
+		to = from
+	}
+	start, err1 := strconv.Atoi(from)
+	end, err2 := strconv.Atoi(to)
+	return err1 == nil && err2 == nil && min <= start && start <= end && end <= max
+}
+
+// shellQuote wraps s in single quotes for sh
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func cronScriptFile(appName string, job string) string {
+	return path.Join(RemoteCronDir(appName), job+".sh")
+}
+
+func cronLogFile(appName string, job string) string {
+	return path.Join(RemoteCronDir(appName), job+".log")
+}
+
+// GetCronScript runs the job in a one-off container of the app service, with the env file decrypted like deploy does.
+// The script is shipped base64 encoded, so it is written for the runtime of the server here.
+func GetCronScript(appConfig SidekickAppConfig, server SidekickServer, job SidekickCronJob) string {
+	run := RewriteForRuntime(server.Runtime, server.Compose, fmt.Sprintf("docker compose -p %s run --rm -T %s %s", ComposeProject(appConfig.Name, ""), appConfig.Name, job.Command))
+	if appConfig.Env.File != "" {
+		run = fmt.Sprintf("SOPS_AGE_KEY_FILE=\"$HOME/%s\" sops exec-env encrypted.env %s", RemoteAgeKeyFile, shellQuote(run))
+	}
+	return fmt.Sprintf("#!/bin/sh\n# written by sidekick deploy, edit cron in sidekick.yml instead\ncd \"$HOME/%s\" || exit 1\nexec %s\n", appConfig.Name, run)
+}
+
+func cronBlockMarkers(appName string) (string, string) {
+	return "# begin sidekick " + appName, "# end sidekick " + appName
+}
+
+// GetCrontabBlock is the part of the crontab of the sidekick user that belongs to the app, empty without jobs
+func GetCrontabBlock(appConfig SidekickAppConfig) string {
+	if len(appConfig.Cron) == 0 {
+		return ""
+	}
+	begin, end := cronBlockMarkers(appConfig.Name)
+	lines := []string{begin}
+	for _, job := range appConfig.Cron {
+		lines = append(lines, fmt.Sprintf(`%s sh "$HOME/%s" >> "$HOME/%s" 2>&1`, job.Schedule, cronScriptFile(appConfig.Name, job.Name), cronLogFile(appConfig.Name, job.Name)))
+	}
+	return strings.Join(append(lines, end), "\n") + "\n"
+}
+
+// GetInstallCronCommand replaces the cron jobs of the app on the server with the ones in appConfig.
+// Jobs that are gone from sidekick.yml go away with their script, an app without jobs on a server without cron is left alone.
+func GetInstallCronCommand(appConfig SidekickAppConfig, server SidekickServer) string {
+	begin, end := cronBlockMarkers(appConfig.Name)
+	var script strings.Builder
+	if len(appConfig.Cron) == 0 {
+		script.WriteString("command -v crontab >/dev/null || exit 0\n")
+	}
+	script.WriteString("set -e\n")
+	fmt.Fprintf(&script, "mkdir -p -m 700 %[1]s && rm -f %[1]s/*.sh\n", RemoteCronDir(appConfig.Name))
+	for _, job := range appConfig.Cron {
+		fmt.Fprintf(&script, "echo '%s' | base64 -d > %s\n", base64.StdEncoding.EncodeToString([]byte(GetCronScript(appConfig, server, job))), cronScriptFile(appConfig.Name, job.Name))
+	}
+	if len(appConfig.Cron) > 0 && appConfig.Env.File != "" {
+		fmt.Fprintf(&script, "(umask 077 && mkdir -p %s && echo '%s' | base64 -d > %s)\n", path.Dir(RemoteAgeKeyFile), base64.StdEncoding.EncodeToString([]byte(server.SecretKey)), RemoteAgeKeyFile)
+	}
+	fmt.Fprintf(&script, "{ crontab -l 2>/dev/null | sed '\\|^%s$|,\\|^%s$|d'; echo '%s' | base64 -d; } | crontab -", begin, end, base64.StdEncoding.EncodeToString([]byte(GetCrontabBlock(appConfig))))
+	return script.String()
+}
+
+// CronJobsStep is the line of a dry run plan for the cron jobs
+func CronJobsStep(appConfig SidekickAppConfig) string {
+	if len(appConfig.Cron) == 0 {
+		return fmt.Sprintf("remove the cron jobs of %s from the crontab", appConfig.Name)
+	}
+	names := []string{}
+	for _, job := range appConfig.Cron {
+		names = append(names, job.Name)
+	}
+	return fmt.Sprintf("install the cron jobs %s in the crontab and %s", strings.Join(names, ", "), RemoteCronDir(appConfig.Name))
+}
+
+// FindCronJob returns the job of the app called name
+func FindCronJob(appConfig SidekickAppConfig, name string) (SidekickCronJob, error) {
+	names := []string{}
+	for _, job := range appConfig.Cron {
+		if job.Name == name {
+			return job, nil
+		}
+		names = append(names, job.Name)
+	}
+	if len(names) == 0 {
+		return SidekickCronJob{}, fmt.Errorf("%s has no cron jobs", appConfig.Name)
+	}
+	return SidekickCronJob{}, fmt.Errorf("%s has no cron job %s, it has %s", appConfig.Name, name, strings.Join(names, ", "))
+}
+
+// GetRunCronJobCommand runs the installed script of the job right away, with its output on stdout
+func GetRunCronJobCommand(appName string, job string) string {
+	return fmt.Sprintf(`sh "$HOME/%s" 2>&1`, cronScriptFile(appName, job))
+}
+
+// GetCronJobInstalledCommand fails when the job was not deployed yet
+func GetCronJobInstalledCommand(appName string, job string) string {
+	return fmt.Sprintf("test -f %s", cronScriptFile(appName, job))
+}
+
+// GetCronStatusCommand prints every installed job of the app with the unix time its log was last written, 0 when it never ran
+func GetCronStatusCommand(appName string) string {
+	return fmt.Sprintf(`cd %s 2>/dev/null || exit 0; for f in *.sh; do [ -f "$f" ] || continue; j=${f%%.sh}; echo "$j $(stat -c %%Y "$j.log" 2>/dev/null || echo 0)"; done`, RemoteCronDir(appName))
+}
+
+// LoadCronStatus maps every job installed for the app to when it last ran, the zero time when it never did
+func LoadCronStatus(remote RemoteExecutor, appName string) (map[string]time.Time, error) {
+	output, err := remote.Output(GetCronStatusCommand(appName))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the cron jobs: %w", err)
+	}
+	status := map[string]time.Time{}
+	for _, line := range outputLines(output) {
+		job, modified, _ := strings.Cut(line, " ")
+		lastRun := time.Time{}
+		if seconds, err := strconv.ParseInt(modified, 10, 64); err == nil && seconds > 0 {
+			lastRun = time.Unix(seconds, 0)
+		}
+		status[job] = lastRun
+	}
+	return status, nil
+}
@@ -0,0 +1,218 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+)
+
+var operation = struct {
+	sync.Mutex
+	ctx context.Context
+}{ctx: context.Background()}
+
+// OperationContext is cancelled when the deadline of the running launch, deploy or preview expires or it is cancelled
+func OperationContext() context.Context {
+	operation.Lock()
+	defer operation.Unlock()
+	return operation.ctx
+}
+
+// OperationCommand is exec.Command for the steps of a launch, deploy or preview, it is killed when the deadline expires
+// or the operation is cancelled
+func OperationCommand(name string, args ...string) *exec.Cmd {
+	return exec.CommandContext(OperationContext(), name, args...)
+}
+
+// GetOperationTimeout is --timeout when it is set and the timeout in sidekick.yml otherwise, 0 means no limit
+func GetOperationTimeout(cmd *cobra.Command, appConfig SidekickAppConfig) (time.Duration, error) {
+	value := appConfig.Timeout
+	if cmd.Flags().Changed("timeout") {
+		value, _ = cmd.Flags().GetString("timeout")
+	}
+	if value == "" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout < 0 {
+		return 0, fmt.Errorf("invalid timeout %q, use a duration like 15m", value)
+	}
+	return timeout, nil
+}
+
+// OperationDeadline bounds a whole launch, deploy or preview, and cancels it on Ctrl-C, SIGINT or SIGTERM.
+// When it expires local commands are killed and the active stage fails, cleanups then run from the main goroutine once the TUI has quit.
+type OperationDeadline struct {
+	name      string
+	timeout   time.Duration
+	timer     *time.Timer
+	cancel    context.CancelFunc
+	onExpire  func(*StageError)
+	signals   chan os.Signal
+	mu        sync.Mutex
+	expired   bool
+	cancelled bool
+	stopped   bool
+	cleanups  []func()
+}
+
+// StartOperationDeadline calls onExpire with the timeout error, a timeout of 0 never expires.
+// A signal cancels the operation the same way, name is what the user is told was cancelled.
+func StartOperationDeadline(name string, timeout time.Duration, onExpire func(*StageError)) *OperationDeadline {
+	ctx, cancel := context.WithCancel(context.Background())
+	operation.Lock()
+	operation.ctx = ctx
+	operation.Unlock()
+	d := &OperationDeadline{name: name, timeout: timeout, cancel: cancel, onExpire: onExpire, signals: make(chan os.Signal, 1)}
+	if timeout > 0 {
+		d.timer = time.AfterFunc(timeout, func() { d.abort(false) })
+	}
+	signal.Notify(d.signals, os.Interrupt, syscall.SIGTERM)
+	// stopSignals sends nil to end this goroutine
+	go func() {
+		if sig := <-d.signals; sig != nil {
+			d.Cancel()
+		}
+	}()
+	return d
+}
+
+// Cancel stops the operation like an expired deadline, the TUI calls it for Ctrl-C since it reads the key itself
+func (d *OperationDeadline) Cancel() {
+	d.abort(true)
+}
+
+func (d *OperationDeadline) abort(cancelled bool) {
+	d.mu.Lock()
+	if d.stopped || d.expired {
+		d.mu.Unlock()
+		return
+	}
+	d.expired = true
+	d.cancelled = cancelled
+	d.mu.Unlock()
+	// a second Ctrl-C while cleaning up kills sidekick right away
+	d.stopSignals()
+	d.cancel()
+	d.onExpire(d.Err())
+}
+
+func (d *OperationDeadline) stopSignals() {
+	signal.Stop(d.signals)
+	select {
+	case d.signals <- nil:
+	default:
+	}
+}
+
+// Expired is true once the deadline expired or the operation was cancelled
+func (d *OperationDeadline) Expired() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.expired
+}
+
+func (d *OperationDeadline) Err() *StageError {
+	d.mu.Lock()
+	cancelled := d.cancelled
+	d.mu.Unlock()
+	if cancelled {
+		return NewStageError("Cancelled", ExitCodeCancelled, "", fmt.Errorf("%s cancelled, everything still running was stopped", d.name))
+	}
+	return NewStageError("Timeout", ExitCodeTimeout, "Raise --timeout or timeout in sidekick.yml if the operation needs longer",
+		fmt.Errorf("gave up after %s, everything still running was stopped", d.timeout))
+}
+
+// OnExpire registers a cleanup for an expired deadline, they run in reverse order like defers
+func (d *OperationDeadline) OnExpire(cleanup func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.cleanups = append(d.cleanups, cleanup)
+}
+
+// Cleanup runs the cleanups when the deadline expired or the operation was cancelled
+func (d *OperationDeadline) Cleanup() {
+	d.mu.Lock()
+	cleanups := d.cleanups
+	d.cleanups = nil
+	expired := d.expired
+	d.mu.Unlock()
+	if !expired {
+		return
+	}
+	for i := len(cleanups) - 1; i >= 0; i-- {
+		cleanups[i]()
+	}
+}
+
+// Stop ends the deadline once the operation is over, call it before reporting success so a late expiry can't undo it
+func (d *OperationDeadline) Stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stopped {
+		return
+	}
+	d.stopped = true
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	d.stopSignals()
+	d.cancel()
+	operation.Lock()
+	operation.ctx = context.Background()
+	operation.Unlock()
+}
+
+// GetAbortDeployScript removes the containers a cut off deploy started, the oldest container of the app is the live one and stays
+func GetAbortDeployScript(service string) string {
+	return fmt.Sprintf(`ids=$(docker ps -q -f label=com.docker.compose.service=%[1]s); count=$(echo "$ids" | grep -c . || true)
+if [ "$count" -gt 1 ]; then docker rm -f $(echo "$ids" | head -n $((count - 1))); fi`, service)
+}
+
+// GetAbortStartScript removes what a cut off launch or preview started from its compose file, none of it was live yet
+func GetAbortStartScript(dir string, imgFileName string) string {
+	return fmt.Sprintf("cd %s 2>/dev/null || exit 0; rm -f %s; docker compose -p %s rm -sf", dir, imgFileName, ComposeProjectForDir(dir))
+}
+
+// AbortRemote runs a cleanup script over a fresh connection, the one of the cut off operation is closed by then
+func AbortRemote(address string, script string) {
+	pterm.Info.Printfln("Cleaning up on %s", address)
+	client, err := Login(address, "sidekick")
+	if err != nil {
+		pterm.Warning.Printfln("Could not clean up on your VPS: %s", err)
+		return
+	}
+	defer client.Close()
+	if _, err := RunCommandOutput(client, script); err != nil {
+		pterm.Warning.Printfln("Could not clean up on your VPS: %s", err)
+	}
+}
+
+// RemoveLocalFiles deletes the temp files of a cut off operation
+func RemoveLocalFiles(paths ...string) {
+	for _, path := range paths {
+		os.Remove(path)
+	}
+}
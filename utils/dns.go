@@ -0,0 +1,110 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/charmbracelet/huh"
+	"github.com/charmbracelet/log"
+	"github.com/mightymoud/sidekick/render"
+	"github.com/spf13/cobra"
+)
+
+// DNSMismatchError is a domain that doesn't resolve to the server, Resolved is empty when it doesn't resolve at all
+type DNSMismatchError struct {
+	Domain   string
+	Server   string
+	Resolved []string
+}
+
+func (e *DNSMismatchError) Error() string {
+	if len(e.Resolved) == 0 {
+		return fmt.Sprintf("%s does not resolve", e.Domain)
+	}
+	return fmt.Sprintf("%s resolves to %s, not to your VPS %s", e.Domain, strings.Join(e.Resolved, ", "), e.Server)
+}
+
+// Fix is the DNS record to add for the domain
+func (e *DNSMismatchError) Fix() string {
+	if len(e.Resolved) == 0 {
+		return fmt.Sprintf("Add an A record for %s pointing to %s", e.Domain, e.Server)
+	}
+	return fmt.Sprintf("Point the A record of %s to %s", e.Domain, e.Server)
+}
+
+// IsSslipDomain is true for the sslip.io domains launch offers, they always resolve to the address in them
+func IsSslipDomain(domain string) bool {
+	return strings.HasSuffix(strings.TrimSuffix(domain, "."), ".sslip.io")
+}
+
+// VerifyDomainDNS checks the A and AAAA records of domain include an address of the server
+func VerifyDomainDNS(domain string, serverAddress string) ([]string, error) {
+	domainIPs, err := net.LookupHost(domain)
+	if err != nil {
+		return nil, &DNSMismatchError{Domain: domain, Server: serverAddress}
+	}
+	serverIPs, err := net.LookupHost(serverAddress)
+	if err != nil {
+		serverIPs = []string{serverAddress}
+	}
+	for _, ip := range domainIPs {
+		for _, serverIP := range serverIPs {
+			if ip == serverIP {
+				return domainIPs, nil
+			}
+		}
+	}
+	return domainIPs, &DNSMismatchError{Domain: domain, Server: serverAddress, Resolved: domainIPs}
+}
+
+// DNSCheckStep is the line of a dry run plan for the DNS check
+func DNSCheckStep(domain string, serverAddress string) string {
+	return fmt.Sprintf("check %s resolves to %s", domain, serverAddress)
+}
+
+// CheckDomainDNSStage stops launch and deploy when the domain doesn't point at the server, unless the user goes on anyway.
+// Apps behind a CDN or proxy resolve elsewhere on purpose, --skip-dns-check is for them
+func CheckDomainDNSStage(cmd *cobra.Command, domain string, serverAddress string) error {
+	if skip, _ := cmd.Flags().GetBool("skip-dns-check"); skip || IsSslipDomain(domain) {
+		return nil
+	}
+	_, err := VerifyDomainDNS(domain, serverAddress)
+	var mismatch *DNSMismatchError
+	if !errors.As(err, &mismatch) {
+		return nil
+	}
+	hint := mismatch.Fix() + ", or pass --skip-dns-check if the app is behind a CDN or proxy"
+	if !render.IsInteractive() {
+		return NewStageError("DNS", ExitCodeConfig, hint, err)
+	}
+	render.GetLogger(log.Options{Prefix: "DNS"}).Warnf("%s. Let's Encrypt can't issue a certificate and the app won't be reachable until it does. %s", err, mismatch.Fix())
+	proceed := false
+	if err := huh.NewConfirm().
+		Title("Continue anyway?").
+		Affirmative("Yes").
+		Negative("No").
+		Value(&proceed).
+		Run(); err != nil {
+		return NewStageError("Input", ExitCodeError, "", err)
+	}
+	if !proceed {
+		return NewStageError("DNS", ExitCodeConfig, hint, err)
+	}
+	return nil
+}
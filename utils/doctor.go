@@ -0,0 +1,282 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DoctorPass = "pass"
+	DoctorWarn = "warn"
+	DoctorFail = "fail"
+
+	// DefaultMinFreeDiskGB is where the disk check fails, under twice that it warns
+	DefaultMinFreeDiskGB = 5
+	maxClockSkew         = 30 * time.Second
+	// past a few minutes certificates and signed requests to registries start failing
+	brokenClockSkew = 5 * time.Minute
+)
+
+// DoctorCheck is one line of sidekick doctor, Fix is only set when the check didn't pass
+type DoctorCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Fix    string `json:"fix,omitempty"`
+}
+
+func passCheck(name string, detail string) DoctorCheck {
+	return DoctorCheck{Name: name, Status: DoctorPass, Detail: detail}
+}
+
+func failCheck(name string, detail string, fix string) DoctorCheck {
+	return DoctorCheck{Name: name, Status: DoctorFail, Detail: detail, Fix: fix}
+}
+
+func warnCheck(name string, detail string, fix string) DoctorCheck {
+	return DoctorCheck{Name: name, Status: DoctorWarn, Detail: detail, Fix: fix}
+}
+
+// CheckLocalPrerequisites covers what launch and deploy run on this machine
+func CheckLocalPrerequisites() []DoctorCheck {
+	checks := []DoctorCheck{}
+	dockerCmd := exec.Command("docker", "info", "--format", "{{.ServerVersion}}")
+	TraceExec(dockerCmd)
+	if output, err := dockerCmd.Output(); err != nil {
+		checks = append(checks, failCheck("Local docker", "the docker daemon is not reachable", "Start Docker Desktop or the docker service"))
+	} else {
+		checks = append(checks, passCheck("Local docker", "daemon "+strings.TrimSpace(string(output))))
+	}
+	for _, binary := range []struct{ name, fix string }{
+		{"sops", "Install sops, for example with brew install sops"},
+		{"rsync", "Install rsync with your package manager"},
+		{"git", "Install git with your package manager"},
+	} {
+		if path, err := exec.LookPath(binary.name); err != nil {
+			checks = append(checks, failCheck(binary.name, "not found in PATH", binary.fix))
+		} else {
+			checks = append(checks, passCheck(binary.name, path))
+		}
+	}
+	return checks
+}
+
+// CheckServerConfig passes when the server in the sidekick config has everything launch and deploy read from it
+func CheckServerConfig(server SidekickServer) DoctorCheck {
+	name := "Sidekick config"
+	missing := []string{}
+	for _, field := range []struct{ key, value string }{
+		{"serveraddress", server.Address},
+		{"publickey", server.PublicKey},
+		{"secretkey", server.SecretKey},
+		{"platformid", server.PlatformId},
+	} {
+		if field.value == "" {
+			missing = append(missing, field.key)
+		}
+	}
+	if len(missing) > 0 {
+		return failCheck(name, fmt.Sprintf("server %s has no %s", server.Name, strings.Join(missing, ", ")), "Run sidekick init again for this server")
+	}
+	if server.CertEmail == "" {
+		return warnCheck(name, fmt.Sprintf("server %s has no certemail", server.Name), "Run sidekick init again before sidekick server upgrade")
+	}
+	return passCheck(name, "server "+server.Name+" is complete")
+}
+
+// CheckAppConfigFile validates sidekick.yml the way sidekick config validate does
+func CheckAppConfigFile(content []byte) DoctorCheck {
+	name := AppConfigFile
+	content, _, err := MigrateAppConfig(content)
+	if err != nil {
+		return failCheck(name, err.Error(), "Upgrade sidekick or fix the schema key")
+	}
+	problems, err := ValidateAppConfigFile(content, true)
+	if err != nil {
+		return failCheck(name, err.Error(), "Pass --app to pick an app from apps")
+	}
+	switch len(problems) {
+	case 0:
+		return passCheck(name, "valid")
+	case 1:
+		return failCheck(name, problems[0].String(), "Fix it and run sidekick config validate")
+	}
+	return failCheck(name, fmt.Sprintf("%s (+%d more)", problems[0], len(problems)-1), "Run sidekick config validate to see every problem")
+}
+
+// CheckRemotePrerequisites covers the server state sidekick init sets up, minFreeGB is the disk space the check wants free
+func CheckRemotePrerequisites(remote RemoteExecutor, runtime string, network string, minFreeGB int) []DoctorCheck {
+	checks := []DoctorCheck{}
+
+	if runtime == RuntimePodman {
+		// podman runs through sudo, the docker group means nothing to it
+		if _, err := remote.Output("sudo -n true"); err != nil {
+			checks = append(checks, failCheck("Podman", "the sidekick user can't use sudo without a password", "Run sidekick init again to set up the sidekick user"))
+		} else {
+			checks = append(checks, passCheck("Podman", "sidekick can run podman through sudo"))
+		}
+	} else if output, err := remote.Output("id -nG"); err != nil {
+		checks = append(checks, failCheck("Docker group", err.Error(), "Run sidekick init again to set up the sidekick user"))
+	} else if !containsField(output, "docker") {
+		checks = append(checks, failCheck("Docker group", "the sidekick user is not in the docker group", "Run sudo usermod -aG docker sidekick on the server and log in again"))
+	} else {
+		checks = append(checks, passCheck("Docker group", "sidekick can run docker"))
+	}
+
+	if _, err := remote.Output(fmt.Sprintf("docker network inspect %s --format '{{.Name}}'", network)); err != nil {
+		checks = append(checks, failCheck("Docker network", fmt.Sprintf("the %s network is missing", network), "Run docker network create "+network+" on the server"))
+	} else {
+		checks = append(checks, passCheck("Docker network", network+" network exists"))
+	}
+
+	output, err := remote.Output("docker ps -a --filter label=com.docker.compose.service=traefik-service --format '{{.State}}|{{.Status}}'")
+	state, status, _ := strings.Cut(strings.TrimSpace(output), "|")
+	switch {
+	case err != nil:
+		checks = append(checks, failCheck("Traefik", err.Error(), "Check docker is running on the server"))
+	case state == "":
+		checks = append(checks, failCheck("Traefik", "no traefik container", "Run sidekick init again to set up Traefik"))
+	case state != "running":
+		checks = append(checks, failCheck("Traefik", "container is "+state, "Run cd traefik && docker compose -p sidekick up -d on the server"))
+	case strings.Contains(status, "unhealthy"):
+		checks = append(checks, failCheck("Traefik", "container is unhealthy", "Check docker logs of the traefik container on the server"))
+	default:
+		checks = append(checks, passCheck("Traefik", status))
+	}
+
+	checks = append(checks, checkDiskSpace(remote, minFreeGB))
+	checks = append(checks, checkLogRotation(remote))
+	checks = append(checks, checkClockSkew(remote))
+	return checks
+}
+
+// checkLogRotation warns about running containers whose json-file logs grow until the disk is full
+func checkLogRotation(remote RemoteExecutor) DoctorCheck {
+	name := "Log rotation"
+	output, err := remote.Output(`docker ps -q | xargs -r docker inspect --format '{{.Name}} {{.HostConfig.LogConfig.Type}} {{index .HostConfig.LogConfig.Config "max-size"}}'`)
+	if err != nil {
+		return failCheck(name, err.Error(), "Check docker is running on the server")
+	}
+	unrotated := []string{}
+	for _, line := range outputLines(output) {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[1] != DefaultLogDriver {
+			continue
+		}
+		if len(fields) < 3 || fields[2] == "<no" {
+			unrotated = append(unrotated, strings.TrimPrefix(fields[0], "/"))
+		}
+	}
+	switch len(unrotated) {
+	case 0:
+		return passCheck(name, "every running container rotates its logs")
+	case 1:
+		return warnCheck(name, unrotated[0]+" keeps its logs forever", "Deploy the app again to pick up log rotation")
+	}
+	return warnCheck(name, fmt.Sprintf("%s and %d more containers keep their logs forever", unrotated[0], len(unrotated)-1), "Deploy their apps again to pick up log rotation, run sidekick server upgrade for Traefik")
+}
+
+func checkDiskSpace(remote RemoteExecutor, minFreeGB int) DoctorCheck {
+	name := "Disk space"
+	output, err := remote.Output(`df --output=avail -B1 "$(docker info -f '{{.DockerRootDir}}' 2>/dev/null || echo /)" | tail -n1`)
+	if err != nil {
+		return failCheck(name, err.Error(), "Check df works on the server")
+	}
+	free, err := strconv.ParseInt(strings.TrimSpace(output), 10, 64)
+	if err != nil {
+		return failCheck(name, "unable to read free disk space", "Check df works on the server")
+	}
+	detail := FormatBytes(free) + " free"
+	minFree := int64(minFreeGB) << 30
+	switch {
+	case free < minFree:
+		return failCheck(name, detail, "Free up space, docker system prune removes unused images and build cache")
+	case free < 2*minFree:
+		return warnCheck(name, detail, "Free up space soon, docker system prune removes unused images and build cache")
+	}
+	return passCheck(name, detail)
+}
+
+func checkClockSkew(remote RemoteExecutor) DoctorCheck {
+	name := "Clock skew"
+	before := time.Now()
+	output, err := remote.Output("date +%s")
+	if err != nil {
+		return failCheck(name, err.Error(), "Check date works on the server")
+	}
+	seconds, err := strconv.ParseInt(strings.TrimSpace(output), 10, 64)
+	if err != nil {
+		return failCheck(name, "unable to read the server time", "Check date works on the server")
+	}
+	// the round trip is part of the skew, so compare against the middle of it
+	local := before.Add(time.Since(before) / 2)
+	skew := time.Duration(math.Abs(float64(time.Unix(seconds, 0).Sub(local)))).Round(time.Second)
+	detail := fmt.Sprintf("%s apart", skew)
+	switch {
+	case skew > brokenClockSkew:
+		return failCheck(name, detail, "Turn on time sync on the server with sudo timedatectl set-ntp true")
+	case skew > maxClockSkew:
+		return warnCheck(name, detail, "Turn on time sync on the server with sudo timedatectl set-ntp true")
+	}
+	return passCheck(name, detail)
+}
+
+// CheckAppLayout reports missing app folders and folders or env files other users can read, deploy repairs them
+func CheckAppLayout(remote RemoteExecutor, appName string) DoctorCheck {
+	name := "App folders"
+	problems, err := CheckRemoteLayout(remote, appName)
+	switch {
+	case err != nil:
+		return failCheck(name, err.Error(), "Check ssh to the server works")
+	case len(problems) == 0:
+		return passCheck(name, fmt.Sprintf("%s and its folders are only readable by sidekick", appName))
+	case problems[0] == "missing "+appName:
+		return warnCheck(name, appName+" is not on the server yet", "Run sidekick launch")
+	case len(problems) == 1:
+		return failCheck(name, problems[0], "Run sidekick deploy to repair the app folders")
+	}
+	return failCheck(name, fmt.Sprintf("%s (+%d more)", problems[0], len(problems)-1), "Run sidekick deploy to repair the app folders")
+}
+
+// CheckDomainDNS passes when domain resolves to the same addresses as the server
+func CheckDomainDNS(domain string, serverAddress string) DoctorCheck {
+	name := "DNS " + domain
+	resolved, err := VerifyDomainDNS(domain, serverAddress)
+	var mismatch *DNSMismatchError
+	if errors.As(err, &mismatch) {
+		detail := "does not resolve"
+		if len(resolved) > 0 {
+			detail = "resolves to " + strings.Join(resolved, ", ")
+		}
+		return failCheck(name, detail, mismatch.Fix())
+	}
+	return passCheck(name, "resolves to "+strings.Join(resolved, ", "))
+}
+
+func containsField(output string, field string) bool {
+	for _, f := range strings.Fields(output) {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
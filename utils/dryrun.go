@@ -0,0 +1,116 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pterm/pterm"
+	"gopkg.in/yaml.v3"
+)
+
+type PlanStep struct {
+	Remote  bool
+	Command string
+}
+
+// DryRunPlan is what --dry-run prints instead of running a launch, deploy or preview
+type DryRunPlan struct {
+	Target      Target
+	Image       string
+	EnvFile     string
+	EnvChanged  bool
+	ComposeFile DockerComposeFile
+	Steps       []PlanStep
+}
+
+func (p *DryRunPlan) Local(command string) {
+	p.Steps = append(p.Steps, PlanStep{Command: command})
+}
+
+func (p *DryRunPlan) Remote(command string) {
+	p.Steps = append(p.Steps, PlanStep{Remote: true, Command: command})
+}
+
+func (p DryRunPlan) Print() error {
+	composeFile, err := yaml.Marshal(p.ComposeFile)
+	if err != nil {
+		return err
+	}
+
+	pterm.DefaultSection.Println("Dry run - nothing was built or changed on your VPS")
+	PrintTarget(p.Target)
+	pterm.Printfln("Image:     %s", p.Image)
+	switch {
+	case p.EnvFile == "":
+		pterm.Println("Env file:  none")
+	case p.EnvChanged:
+		pterm.Printfln("Env file:  %s changed - it would be encrypted and uploaded again", p.EnvFile)
+	default:
+		pterm.Printfln("Env file:  %s unchanged", p.EnvFile)
+	}
+
+	services := make([]string, 0, len(p.ComposeFile.Services))
+	for name := range p.ComposeFile.Services {
+		services = append(services, name)
+	}
+	sort.Strings(services)
+	for _, name := range services {
+		pterm.DefaultSection.WithLevel(2).Printfln("Traefik labels of %s", name)
+		for _, label := range p.ComposeFile.Services[name].Labels {
+			pterm.Println("  " + label)
+		}
+	}
+
+	pterm.DefaultSection.WithLevel(2).Println("docker-compose.yaml")
+	pterm.Println(string(composeFile))
+
+	pterm.DefaultSection.WithLevel(2).Println("Commands, in order")
+	for i, step := range p.Steps {
+		where := "local "
+		if step.Remote {
+			where = "remote"
+		}
+		lines := strings.Split(strings.TrimSpace(Redact(step.Command)), "\n")
+		pterm.Printfln("%2d. [%s] %s", i+1, where, lines[0])
+		for _, line := range lines[1:] {
+			pterm.Println("              " + line)
+		}
+	}
+	return nil
+}
+
+// RemoteLayoutStep sums up the layout bootstrap script, printing the whole script would drown the plan
+func RemoteLayoutStep(appName string) string {
+	dirs := []string{}
+	for _, dir := range GetRemoteLayout(appName) {
+		dirs = append(dirs, dir.Path)
+	}
+	return fmt.Sprintf("mkdir -p %s and repair their owner and mode", strings.Join(dirs, " "))
+}
+
+// EnvFileChanged compares the env file against the hash of the last deploy the same way deploy does, without encrypting anything
+func EnvFileChanged(appConfig SidekickAppConfig) (bool, error) {
+	if appConfig.Env.File == "" {
+		return false, nil
+	}
+	hash, err := EnvFileHash(appConfig.Env.File)
+	if err != nil {
+		return false, fmt.Errorf("failed to read environment file: %w", err)
+	}
+	return hash != appConfig.Env.Hash, nil
+}
@@ -0,0 +1,302 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+const (
+	EnvPrefix = "SIDEKICK"
+	// SSHKeyEnv holds a private key for runners that have no ssh-agent or key files
+	SSHKeyEnv = "SIDEKICK_SSH_KEY"
+)
+
+// EnvConfigValue is a value of the sidekick config that a SIDEKICK_* env var can set instead, the env var wins over the file
+type EnvConfigValue struct {
+	// Key is the viper key, the env var is SIDEKICK_ and the key in upper case
+	Key string
+	// FileKey is where the value lives in the file, as sidekick config get names it
+	FileKey  string
+	Required bool
+}
+
+func (v EnvConfigValue) EnvVar() string {
+	return EnvPrefix + "_" + strings.ToUpper(v.Key)
+}
+
+// envServerValues are the server values SIDEKICK_* env vars can set, SIDEKICK_SERVER_ADDRESS alone is enough to target a server
+var envServerValues = []EnvConfigValue{
+	{Key: "server_name", FileKey: "servers.<name>.name"},
+	{Key: "server_address", FileKey: "servers.<name>.serveraddress", Required: true},
+	{Key: "public_key", FileKey: "servers.<name>.publickey", Required: true},
+	{Key: "secret_key", FileKey: "servers.<name>.secretkey", Required: true},
+	{Key: "platform_id", FileKey: "servers.<name>.platformid"},
+	{Key: "distro", FileKey: "servers.<name>.distro"},
+	{Key: "cert_email", FileKey: "servers.<name>.certemail"},
+	{Key: "runtime", FileKey: "servers.<name>.runtime"},
+	{Key: "compose", FileKey: "servers.<name>.compose"},
+	{Key: "network", FileKey: "servers.<name>.network"},
+	{Key: "host_key", FileKey: "servers.<name>.hostkey"},
+}
+
+// envGlobalValues are the values of the sidekick config outside the servers
+var envGlobalValues = []EnvConfigValue{
+	{Key: "current_context", FileKey: "current-context"},
+	{Key: "confirm_contexts", FileKey: "deployPolicy.confirmContexts"},
+	{Key: "backup_dest", FileKey: "backup.dest"},
+	{Key: "backup_endpoint", FileKey: "backup.endpoint"},
+	{Key: "backup_keep", FileKey: "backup.keep"},
+}
+
+// SSHKeyPathEnv points at a private key file, for runners that mount one instead of putting it in SIDEKICK_SSH_KEY
+const SSHKeyPathEnv = "SIDEKICK_SSH_KEY_PATH"
+
+// ServerFromEnv is the server described by SIDEKICK_* env vars, ok is false when none of them is set.
+// Without SIDEKICK_SERVER_NAME it takes the name of the server sidekick.yml is pinned to, then the one of the current context,
+// so a single env var overrides one value of a server in the file.
+func ServerFromEnv(config SidekickConfig) (SidekickServer, bool) {
+	server := SidekickServer{
+		Name:       viper.GetString("server_name"),
+		Address:    viper.GetString("server_address"),
+		Distro:     viper.GetString("distro"),
+		PlatformId: viper.GetString("platform_id"),
+		CertEmail:  viper.GetString("cert_email"),
+		PublicKey:  viper.GetString("public_key"),
+		SecretKey:  viper.GetString("secret_key"),
+		Runtime:    viper.GetString("runtime"),
+		Compose:    viper.GetString("compose"),
+		Network:    viper.GetString("network"),
+		HostKey:    viper.GetString("host_key"),
+	}
+	if server == (SidekickServer{Name: server.Name}) {
+		return server, false
+	}
+	if server.Name == "" && FileExists(AppConfigFile) {
+		if appConfig, err := LoadAppConfig(); err == nil {
+			server.Name = appConfig.Server
+		}
+	}
+	if server.Name == "" {
+		if current, err := config.FindServerByContext(envOr("current_context", config.CurrentContext)); err == nil {
+			server.Name = current.Name
+		}
+	}
+	if server.Name == "" {
+		server.Name = "default"
+	}
+	return server, true
+}
+
+func envOr(key string, fallback string) string {
+	if value := viper.GetString(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// ApplyEnvServer puts the env server in the config, env values win over the ones of a server with the same name.
+// A context of the same name is added and made current when the config has none.
+func (c *SidekickConfig) ApplyEnvServer(envServer SidekickServer) {
+	server, err := c.FindServer(envServer.Name)
+	if err != nil {
+		server = SidekickServer{Name: envServer.Name, PlatformId: "linux/amd64"}
+	}
+	for _, field := range []struct{ value, target *string }{
+		{&envServer.Address, &server.Address},
+		{&envServer.Distro, &server.Distro},
+		{&envServer.PlatformId, &server.PlatformId},
+		{&envServer.CertEmail, &server.CertEmail},
+		{&envServer.PublicKey, &server.PublicKey},
+		{&envServer.SecretKey, &server.SecretKey},
+		{&envServer.Runtime, &server.Runtime},
+		{&envServer.Compose, &server.Compose},
+		{&envServer.Network, &server.Network},
+		{&envServer.HostKey, &server.HostKey},
+	} {
+		if *field.value != "" {
+			*field.target = *field.value
+		}
+	}
+	c.AddOrReplaceServer(server)
+	if _, err := c.FindContext(server.Name); err != nil {
+		c.AddOrReplaceContext(SidekickContext{Name: server.Name, Server: server.Name})
+	}
+	if c.CurrentContext == "" {
+		c.CurrentContext = server.Name
+	}
+}
+
+// ApplyEnvGlobals puts the env values outside the servers in the config, like SIDEKICK_CURRENT_CONTEXT
+func (c *SidekickConfig) ApplyEnvGlobals() error {
+	c.CurrentContext = envOr("current_context", c.CurrentContext)
+	if confirm := viper.GetString("confirm_contexts"); confirm != "" {
+		// like config set, "prod, staging" is two contexts and stray commas are left out
+		c.DeployPolicy.ConfirmContexts = []string{}
+		for _, name := range strings.Split(confirm, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				c.DeployPolicy.ConfirmContexts = append(c.DeployPolicy.ConfirmContexts, name)
+			}
+		}
+	}
+	c.Backup.Dest = envOr("backup_dest", c.Backup.Dest)
+	c.Backup.Endpoint = envOr("backup_endpoint", c.Backup.Endpoint)
+	if keep := viper.GetString("backup_keep"); keep != "" {
+		parsed, err := strconv.Atoi(keep)
+		if err != nil || parsed < 0 {
+			return fmt.Errorf("SIDEKICK_BACKUP_KEEP must be a number, not %q", keep)
+		}
+		c.Backup.Keep = parsed
+	}
+	return nil
+}
+
+// MissingConfigValues are the required values the server of the current context lacks, once the env vars are applied
+func MissingConfigValues(config SidekickConfig) []EnvConfigValue {
+	server, _ := config.FindServerByContext(config.CurrentContext)
+	values := map[string]string{"server_address": server.Address, "public_key": server.PublicKey, "secret_key": server.SecretKey}
+	missing := []EnvConfigValue{}
+	for _, value := range envServerValues {
+		if value.Required && values[value.Key] == "" {
+			missing = append(missing, value)
+		}
+	}
+	return missing
+}
+
+// MissingConfigError is returned when there is no sidekick config file and the env vars don't make up for it
+type MissingConfigError struct {
+	Path    string
+	Missing []EnvConfigValue
+}
+
+func (e *MissingConfigError) Error() string {
+	lines := []string{fmt.Sprintf("no sidekick config at %s, and the env vars don't give these values:", e.Path)}
+	for _, value := range e.Missing {
+		lines = append(lines, fmt.Sprintf("  - %s in the sidekick config, or %s", value.FileKey, value.EnvVar()))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// UseSSHKeyFile logs in with the private key at path, like it was in SIDEKICK_SSH_KEY, so scripts need no ssh-agent
+func UseSSHKeyFile(path string) error {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to read the SSH key: %w", err)
+	}
+	if _, err := ssh.ParseRawPrivateKey(key); err != nil {
+		var passphraseErr *ssh.PassphraseMissingError
+		if errors.As(err, &passphraseErr) {
+			return fmt.Errorf("the key %s has a passphrase, load it in ssh-agent instead", path)
+		}
+		return fmt.Errorf("unable to parse the key %s: %w", path, err)
+	}
+	return os.Setenv(SSHKeyEnv, string(key))
+}
+
+// parseEnvSSHKey takes the PEM itself or its base64, which is easier to paste into a CI secret
+func parseEnvSSHKey(value string) (interface{}, error) {
+	value = strings.TrimSpace(value)
+	if !strings.HasPrefix(value, "-----BEGIN") {
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s is neither a PEM private key nor base64 of one", SSHKeyEnv)
+		}
+		value = string(decoded)
+	}
+	key, err := ssh.ParseRawPrivateKey([]byte(value))
+	if err != nil {
+		var passphraseErr *ssh.PassphraseMissingError
+		if errors.As(err, &passphraseErr) {
+			return nil, fmt.Errorf("the key in %s has a passphrase, use a key without one", SSHKeyEnv)
+		}
+		return nil, fmt.Errorf("unable to parse the key in %s: %w", SSHKeyEnv, err)
+	}
+	return key, nil
+}
+
+var envSSHAgent struct {
+	once     sync.Once
+	err      error
+	listener net.Listener
+	dir      string
+}
+
+// StartEnvSSHAgent serves the key in SIDEKICK_SSH_KEY from an in process ssh-agent and points SSH_AUTH_SOCK at it.
+// That way the ssh, scp and rsync sidekick runs use the key too, not just its own ssh client.
+func StartEnvSSHAgent() error {
+	envSSHAgent.once.Do(func() {
+		value := os.Getenv(SSHKeyEnv)
+		if value == "" {
+			return
+		}
+		key, err := parseEnvSSHKey(value)
+		if err != nil {
+			envSSHAgent.err = err
+			return
+		}
+		keyring := agent.NewKeyring()
+		if err := keyring.Add(agent.AddedKey{PrivateKey: key, Comment: SSHKeyEnv}); err != nil {
+			envSSHAgent.err = err
+			return
+		}
+		dir, err := os.MkdirTemp("", "sidekick-agent-")
+		if err != nil {
+			envSSHAgent.err = err
+			return
+		}
+		socket := filepath.Join(dir, "agent.sock")
+		listener, err := net.Listen("unix", socket)
+		if err != nil {
+			os.RemoveAll(dir)
+			envSSHAgent.err = fmt.Errorf("unable to serve the key in %s: %w", SSHKeyEnv, err)
+			return
+		}
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					agent.ServeAgent(keyring, conn)
+				}()
+			}
+		}()
+		envSSHAgent.listener, envSSHAgent.dir = listener, dir
+		os.Setenv("SSH_AUTH_SOCK", socket)
+	})
+	return envSSHAgent.err
+}
+
+func StopEnvSSHAgent() {
+	if envSSHAgent.listener != nil {
+		envSSHAgent.listener.Close()
+		os.RemoveAll(envSSHAgent.dir)
+	}
+}
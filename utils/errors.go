@@ -0,0 +1,146 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/pterm/pterm"
+)
+
+// Exit codes sidekick uses so scripts can tell what kind of failure happened
+const (
+	ExitCodeError    = 1
+	ExitCodeConfig   = 2
+	ExitCodeBuild    = 3
+	ExitCodeRemote   = 4
+	ExitCodeTransfer = 5
+	ExitCodeTimeout  = 6
+	// ExitCodeCancelled is what a shell reports for a command stopped with Ctrl-C
+	ExitCodeCancelled = 130
+)
+
+// ErrSSHAuth means the server turned down every SSH key sidekick found
+var ErrSSHAuth = errors.New("none of your SSH keys were accepted")
+
+// RemoteCommandError is a command that ran on the server and failed, Stderr is what it printed
+type RemoteCommandError struct {
+	Cmd    string
+	Stderr string
+	Err    error
+}
+
+func (e *RemoteCommandError) Error() string {
+	cmd := e.Cmd
+	if len(cmd) > 80 {
+		cmd = cmd[:80] + "..."
+	}
+	if e.Stderr != "" {
+		return fmt.Sprintf("%q failed: %s: %s", cmd, e.Stderr, e.Err)
+	}
+	return fmt.Sprintf("%q failed: %s", cmd, e.Err)
+}
+
+func (e *RemoteCommandError) Unwrap() error {
+	return e.Err
+}
+
+// StageError is returned by commands when a step fails.
+// It carries which stage failed and a hint on what the user can do about it.
+type StageError struct {
+	Stage string
+	Hint  string
+	Code  int
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Stage, e.Err)
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+func NewStageError(stage string, code int, hint string, err error) *StageError {
+	return &StageError{
+		Stage: stage,
+		Hint:  hint,
+		Code:  code,
+		Err:   err,
+	}
+}
+
+// ExitStatusError passes the exit code of a remote command through as the exit code of sidekick
+type ExitStatusError struct {
+	Code int
+}
+
+func (e *ExitStatusError) Error() string {
+	return fmt.Sprintf("remote command exited with status %d", e.Code)
+}
+
+func ExitCode(err error) int {
+	var exitErr *ExitStatusError
+	if errors.As(err, &exitErr) {
+		return exitErr.Code
+	}
+	var stageErr *StageError
+	if errors.As(err, &stageErr) && stageErr.Code != 0 {
+		return stageErr.Code
+	}
+	return ExitCodeError
+}
+
+// ErrorHint is what the user can do about err, the hint of a stage wins over the one of the error type
+func ErrorHint(err error) string {
+	var stageErr *StageError
+	if errors.As(err, &stageErr) && stageErr.Hint != "" {
+		return stageErr.Hint
+	}
+	var remoteErr *RemoteCommandError
+	var configErr *ConfigProblemsError
+	var lockedErr *LockedError
+	var conflictErr *RouteConflictError
+	switch {
+	case errors.As(err, &configErr):
+		return "Fix " + AppConfigFile + ", sidekick config validate checks it again"
+	case errors.As(err, &lockedErr):
+		return "Wait for that run to finish, or pass --force-unlock to remove the lock of a run that crashed"
+	case errors.As(err, &conflictErr):
+		return "Pick another domain or app name, or remove the other app with sidekick destroy"
+	case errors.Is(err, ErrStateConflict):
+		return "Someone else changed this app at the same time, check sidekick status and run again"
+	case errors.Is(err, ErrSSHAuth):
+		return "Load the key of this server with ssh-add, or set " + SSHKeyEnv
+	case errors.As(err, &remoteErr):
+		return "Run again with --verbose to see every command sidekick runs on your VPS"
+	}
+	return ""
+}
+
+// PrintError prints an error returned by a command along with its hint
+func PrintError(err error) {
+	// the remote command already had its say on stderr
+	var exitErr *ExitStatusError
+	if errors.As(err, &exitErr) {
+		return
+	}
+	pterm.Error.Println(err)
+	if hint := ErrorHint(err); hint != "" {
+		pterm.Info.Println(hint)
+	}
+}
@@ -0,0 +1,38 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import "golang.org/x/crypto/ssh"
+
+// RemoteExecutor runs commands on the VPS. Code that takes one instead of an *ssh.Client
+// can be unit tested with remotetest.FakeExecutor, no server needed.
+type RemoteExecutor interface {
+	// Output runs cmd and returns its stdout, the error carries stderr
+	Output(cmd string) (string, error)
+	WriteFile(path string, content []byte) error
+}
+
+// SSHExecutor is the RemoteExecutor every command uses against a real VPS
+type SSHExecutor struct {
+	Client *ssh.Client
+}
+
+func (e SSHExecutor) Output(cmd string) (string, error) {
+	return RunCommandOutput(e.Client, cmd)
+}
+
+func (e SSHExecutor) WriteFile(path string, content []byte) error {
+	return WriteRemoteFile(e.Client, path, content)
+}
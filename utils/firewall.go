@@ -0,0 +1,91 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// SSHPort is the port sidekick logs in on, the firewall keeps it open
+	SSHPort                   = "22"
+	RemoteFirewallMarkerFile  = ".sidekick/firewall"
+	FirewallUfw               = "ufw"
+	firewallSkippedPrefix     = "skipped: "
+	firewallAlreadyConfigured = "already configured by sidekick"
+)
+
+// GetFirewallScript sets up ufw to only let in SSH, HTTP and HTTPS.
+// It leaves any firewall it didn't set up alone, and the SSH rule is in place before ufw is enabled so the session survives.
+func GetFirewallScript(sshPort string) string {
+	return fmt.Sprintf(`set -e
+marker=%[2]s
+if [ -f "$marker" ]; then echo "%[3]s"; exit 0; fi
+if systemctl is-active --quiet firewalld 2>/dev/null; then echo "%[4]sfirewalld is running"; exit 0; fi
+command -v ufw >/dev/null 2>&1
+if sudo ufw status | grep -q "Status: active"; then echo "%[4]sufw is already active with its own rules"; exit 0; fi
+if sudo ufw show added | grep -q "^ufw "; then echo "%[4]sufw already has rules that are not enabled"; exit 0; fi
+sudo ufw default deny incoming >/dev/null
+sudo ufw default allow outgoing >/dev/null
+sudo ufw allow %[1]s/tcp >/dev/null
+sudo ufw show added | grep -q "ufw allow %[1]s/tcp"
+sudo ufw allow 80/tcp >/dev/null
+sudo ufw allow 443/tcp >/dev/null
+sudo ufw --force enable >/dev/null
+mkdir -p "$(dirname "$marker")"
+date -u +%%Y-%%m-%%dT%%H:%%M:%%SZ > "$marker"
+echo "enabled"`, sshPort, RemoteFirewallMarkerFile, firewallAlreadyConfigured, firewallSkippedPrefix)
+}
+
+// GetUfwInstallCommand installs ufw unless the firewall script would leave the server alone anyway.
+// It runs before the script so a flaky apt can be retried without running the rules twice.
+func GetUfwInstallCommand() string {
+	return fmt.Sprintf("[ -f %s ] || systemctl is-active --quiet firewalld 2>/dev/null || command -v ufw >/dev/null 2>&1 || sudo DEBIAN_FRONTEND=noninteractive apt-get install -y ufw >/dev/null", RemoteFirewallMarkerFile)
+}
+
+// SetupFirewall installs ufw and runs GetFirewallScript. skipped says why an existing firewall was left untouched, it is empty when sidekick manages ufw.
+func SetupFirewall(remote RemoteExecutor, sshPort string, report *RetryReport) (skipped string, err error) {
+	attempts, err := DefaultRetryPolicy.Do(func() error {
+		_, err := remote.Output(GetUfwInstallCommand())
+		return err
+	}, nil)
+	report.Record("ufw install", attempts)
+	if err != nil {
+		return "", fmt.Errorf("failed to install ufw: %w", err)
+	}
+	output, err := remote.Output(GetFirewallScript(sshPort))
+	if err != nil {
+		return "", fmt.Errorf("failed to set up ufw: %w", err)
+	}
+	lines := outputLines(output)
+	if len(lines) == 0 {
+		return "", fmt.Errorf("no output from the firewall setup")
+	}
+	result := lines[len(lines)-1]
+	if strings.HasPrefix(result, firewallSkippedPrefix) {
+		return strings.TrimPrefix(result, firewallSkippedPrefix), nil
+	}
+	return "", nil
+}
+
+// GetFirewallStatus is the ufw status of the server with its rules
+func GetFirewallStatus(remote RemoteExecutor) (string, error) {
+	output, err := remote.Output("command -v ufw >/dev/null 2>&1 || { echo 'ufw is not installed'; exit 0; }; sudo ufw status verbose")
+	if err != nil {
+		return "", fmt.Errorf("failed to read the firewall status: %w", err)
+	}
+	return strings.TrimSpace(output), nil
+}
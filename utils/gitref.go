@@ -0,0 +1,161 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// GitRef is a commit picked by tag, branch or sha instead of the checked out tree
+type GitRef struct {
+	Name     string
+	Sha      string
+	ShortSha string
+	// Branch is only set when Name is a local branch
+	Branch string
+}
+
+func ResolveGitRef(name string) (GitRef, error) {
+	shaOutput, err := exec.Command("git", "rev-parse", "--verify", "--quiet", name+"^{commit}").Output()
+	if err != nil {
+		return GitRef{}, fmt.Errorf("git ref %s does not exist, fetch it first with git fetch --tags", name)
+	}
+	sha := strings.TrimSpace(string(shaOutput))
+	shortOutput, err := exec.Command("git", "rev-parse", "--short", sha).Output()
+	if err != nil {
+		return GitRef{}, err
+	}
+	ref := GitRef{Name: name, Sha: sha, ShortSha: strings.TrimSpace(string(shortOutput))}
+	if exec.Command("git", "show-ref", "--verify", "--quiet", "refs/heads/"+name).Run() == nil {
+		ref.Branch = name
+	}
+	return ref, nil
+}
+
+// CheckGitRefAncestry refuses a ref that does not contain the last deployed commit, deploying it would quietly roll back production.
+// A last commit that is unknown locally, like in a shallow CI clone, is not checked.
+func CheckGitRefAncestry(ref GitRef, lastDeployedCommit string) error {
+	if lastDeployedCommit == "" || exec.Command("git", "cat-file", "-e", lastDeployedCommit+"^{commit}").Run() != nil {
+		return nil
+	}
+	if exec.Command("git", "merge-base", "--is-ancestor", lastDeployedCommit, ref.Sha).Run() != nil {
+		return fmt.Errorf("%s (%s) does not contain the last deployed commit %s", ref.Name, ref.ShortSha, lastDeployedCommit)
+	}
+	return nil
+}
+
+// ExportGitRef writes the tree of ref to a temp folder to use as the build context.
+// git archive reads from the object store so the working tree and index are never touched.
+// Run from a sub folder it only exports that folder, the same context a build of the checked out tree gets.
+func ExportGitRef(ref GitRef) (string, func(), error) {
+	dir, err := os.MkdirTemp("", "sidekick-ref-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	archiveCmd := OperationCommand("git", "archive", "--format=tar", ref.Sha)
+	extractCmd := OperationCommand("tar", "-x", "-C", dir)
+	extractCmd.Stdin, err = archiveCmd.StdoutPipe()
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	TraceExec(archiveCmd)
+	if err := extractCmd.Start(); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	err = archiveCmd.Run()
+	if extractErr := extractCmd.Wait(); err == nil {
+		err = extractErr
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to export %s: %w", ref.Name, err)
+	}
+	return dir, cleanup, nil
+}
+
+// DirtyFiles lists the uncommitted changes of the whole repository as git status --short prints them, untracked files included
+func DirtyFiles() ([]string, error) {
+	output, err := exec.Command("git", "status", "--porcelain", "--untracked-files=all").Output()
+	if err != nil {
+		return nil, fmt.Errorf("unable to check the git tree: %w", err)
+	}
+	files := []string{}
+	for _, line := range strings.Split(string(output), "\n") {
+		if strings.TrimSpace(line) != "" {
+			files = append(files, strings.TrimSpace(line))
+		}
+	}
+	return files, nil
+}
+
+// DirtyTreeError lists the files that keep a preview from running on a clean tree
+type DirtyTreeError struct {
+	Files []string
+}
+
+func (e *DirtyTreeError) Error() string {
+	const shown = 10
+	files := e.Files
+	more := ""
+	if len(files) > shown {
+		files, more = files[:shown], fmt.Sprintf(" (+%d more)", len(e.Files)-shown)
+	}
+	return fmt.Sprintf("uncommitted changes in %s%s", strings.Join(files, ", "), more)
+}
+
+// DirtyDiffSum is a short sum of the uncommitted changes, the same changes always give the same sum
+func DirtyDiffSum() (string, error) {
+	topLevel, err := exec.Command("git", "rev-parse", "--show-toplevel").Output()
+	if err != nil {
+		return "", fmt.Errorf("unable to find the git repository: %w", err)
+	}
+	root := strings.TrimSpace(string(topLevel))
+	hash := sha256.New()
+	diff := exec.Command("git", "diff", "HEAD", "--binary")
+	diff.Dir = root
+	diffOutput, err := diff.Output()
+	if err != nil {
+		return "", fmt.Errorf("unable to diff the git tree: %w", err)
+	}
+	hash.Write(diffOutput)
+	// git diff leaves out untracked files, their content goes in by name
+	untracked := exec.Command("git", "ls-files", "--others", "--exclude-standard", "-z")
+	untracked.Dir = root
+	untrackedOutput, err := untracked.Output()
+	if err != nil {
+		return "", fmt.Errorf("unable to list untracked files: %w", err)
+	}
+	for _, name := range strings.Split(string(untrackedOutput), "\x00") {
+		if name == "" {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(root, name))
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(hash, "%s\x00%d\x00", name, len(content))
+		hash.Write(content)
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil))[:7], nil
+}
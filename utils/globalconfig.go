@@ -0,0 +1,336 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// maskedConfigValue stands in for a secret in sidekick config list
+const maskedConfigValue = "********"
+
+// ConfigEntry is one value of the sidekick config, Key is its dotted path like servers.prod.serveraddress
+type ConfigEntry struct {
+	Key   string
+	Value string
+}
+
+// configKeyAliases are the names the keys are also known by, the file itself has the old yaml names
+var configKeyAliases = map[string]string{
+	"servers.*.address": "servers.*.serveraddress",
+}
+
+// readOnlyConfigKeys are changed by the commands that own them, a new name would leave the contexts pointing nowhere
+var readOnlyConfigKeys = []string{"version", "servers.*.name", "contexts.*.name"}
+
+// sensitiveConfigKeys are masked by list, get still prints them for scripts
+var sensitiveConfigKeys = []string{
+	"servers.*.secretkey",
+	"servers.*.observability.logs.password",
+	"servers.*.observability.metrics.password",
+	"notifications.*.url",
+}
+
+// configValidators check a value before set writes it, they are looked up by the pattern of the key
+var configValidators = map[string]func(config *SidekickConfig, value string) error{
+	"current-context": func(config *SidekickConfig, value string) error {
+		_, err := config.FindContext(value)
+		return err
+	},
+	"contexts.*.server": func(config *SidekickConfig, value string) error {
+		_, err := config.FindServer(value)
+		return err
+	},
+	"servers.*.serveraddress": func(config *SidekickConfig, value string) error {
+		if net.ParseIP(value) == nil && ValidateDomain(value) != nil {
+			return fmt.Errorf("%q is not an IP address or a host name", value)
+		}
+		return nil
+	},
+	"servers.*.certemail": func(config *SidekickConfig, value string) error {
+		if _, err := mail.ParseAddress(value); err != nil {
+			return fmt.Errorf("%q is not an email address", value)
+		}
+		return nil
+	},
+	"servers.*.platformid": oneOf("linux/amd64", "linux/arm64"),
+	"servers.*.firewall":   oneOf("", FirewallUfw),
+	"servers.*.runtime": func(config *SidekickConfig, value string) error {
+		return ValidateRuntime(value)
+	},
+	"servers.*.network": func(config *SidekickConfig, value string) error {
+		// empty goes back to the default network
+		if value == "" {
+			return nil
+		}
+		return ValidateNetworkName(value)
+	},
+	"servers.*.publickey":                       prefixed("age1"),
+	"servers.*.secretkey":                       prefixed("AGE-SECRET-KEY-"),
+	"servers.*.observability.logs.domain":       validateOptionalDomain,
+	"servers.*.observability.metrics.domain":    validateOptionalDomain,
+	"servers.*.observability.logs.retention":    validateRetention,
+	"servers.*.observability.metrics.retention": validateRetention,
+	"servers.*.observability.metrics.interval": func(config *SidekickConfig, value string) error {
+		if interval, err := time.ParseDuration(value); err != nil || interval <= 0 {
+			return fmt.Errorf("%q is not a duration, use one like 15s", value)
+		}
+		return nil
+	},
+	"backup.endpoint": func(config *SidekickConfig, value string) error {
+		if endpoint, err := url.Parse(value); err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			return fmt.Errorf("%q is not a URL like https://s3.example.com", value)
+		}
+		return nil
+	},
+	"backup.keep": func(config *SidekickConfig, value string) error {
+		if keep, _ := strconv.Atoi(value); keep < 0 {
+			return errors.New("must not be negative")
+		}
+		return nil
+	},
+	"notifications.*.format": oneOf("", NotifyFormatSlack, NotifyFormatJSON),
+}
+
+func oneOf(values ...string) func(config *SidekickConfig, value string) error {
+	return func(config *SidekickConfig, value string) error {
+		if !slices.Contains(values, value) {
+			return fmt.Errorf("%q must be one of %s", value, strings.Join(values, ", "))
+		}
+		return nil
+	}
+}
+
+func prefixed(prefix string) func(config *SidekickConfig, value string) error {
+	return func(config *SidekickConfig, value string) error {
+		if !strings.HasPrefix(value, prefix) {
+			return fmt.Errorf("must start with %s", prefix)
+		}
+		return nil
+	}
+}
+
+func validateOptionalDomain(config *SidekickConfig, value string) error {
+	if value == "" {
+		return nil
+	}
+	return ValidateDomain(value)
+}
+
+func validateRetention(config *SidekickConfig, value string) error {
+	retention, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("%q is not a duration, use one like 168h", value)
+	}
+	return ValidateLogRetention(retention)
+}
+
+// GetConfigValue is the value at key, a section like servers.prod comes back as yaml
+func GetConfigValue(config *SidekickConfig, key string) (string, error) {
+	value, _, err := lookupConfigKey(config, key)
+	if err != nil {
+		return "", err
+	}
+	if text, ok := formatConfigLeaf(value); ok {
+		return text, nil
+	}
+	out, err := yaml.Marshal(value.Interface())
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+// SetConfigValue parses value for the type of key and checks it before it changes config, the file is left to the caller
+func SetConfigValue(config *SidekickConfig, key string, value string) error {
+	target, pattern, err := lookupConfigKey(config, key)
+	if err != nil {
+		return err
+	}
+	if slices.Contains(readOnlyConfigKeys, pattern) {
+		return fmt.Errorf("%s can't be set, it is managed by sidekick", key)
+	}
+	if !target.CanSet() {
+		return fmt.Errorf("%s can't be set", key)
+	}
+	if validate, ok := configValidators[pattern]; ok {
+		if err := validate(config, value); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	switch target.Kind() {
+	case reflect.String:
+		target.SetString(value)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s takes true or false, not %q", key, value)
+		}
+		target.SetBool(parsed)
+	case reflect.Int:
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s takes a number, not %q", key, value)
+		}
+		target.SetInt(int64(parsed))
+	case reflect.Slice:
+		if target.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("%s is a list, set the keys inside it one by one", key)
+		}
+		items := []string{}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		target.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("%s is a section, set one of the keys inside it", key)
+	}
+	return nil
+}
+
+// ListConfigValues flattens config into its keys, secrets are masked unless reveal is set and empty values are left out
+func ListConfigValues(config *SidekickConfig, reveal bool) []ConfigEntry {
+	entries := []ConfigEntry{}
+	walkConfig(reflect.ValueOf(config).Elem(), nil, nil, func(key []string, pattern []string, value reflect.Value) {
+		text, _ := formatConfigLeaf(value)
+		if text == "" || text == "false" || text == "0" {
+			return
+		}
+		if !reveal && slices.Contains(sensitiveConfigKeys, strings.Join(pattern, ".")) {
+			text = maskedConfigValue
+		}
+		entries = append(entries, ConfigEntry{Key: strings.Join(key, "."), Value: text})
+	})
+	return entries
+}
+
+func walkConfig(value reflect.Value, key []string, pattern []string, visit func(key []string, pattern []string, value reflect.Value)) {
+	switch {
+	case value.Kind() == reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			if name := yamlFieldName(value.Type().Field(i)); name != "" {
+				walkConfig(value.Field(i), append(slices.Clone(key), name), append(slices.Clone(pattern), name), visit)
+			}
+		}
+	case value.Kind() == reflect.Slice && value.Type().Elem().Kind() == reflect.Struct:
+		for i := 0; i < value.Len(); i++ {
+			walkConfig(value.Index(i), append(slices.Clone(key), configElementName(value.Index(i), i)), append(slices.Clone(pattern), "*"), visit)
+		}
+	default:
+		visit(key, pattern, value)
+	}
+}
+
+// lookupConfigKey finds key in config, pattern is key with * in place of the server, context or index
+func lookupConfigKey(config *SidekickConfig, key string) (reflect.Value, string, error) {
+	value := reflect.ValueOf(config).Elem()
+	pattern := []string{}
+	parts := strings.Split(key, ".")
+	for i, part := range parts {
+		switch {
+		case value.Kind() == reflect.Struct:
+			field, ok := findYamlField(value, part)
+			if !ok {
+				// the aliases only rename the last part of a key
+				if alias, found := configKeyAliases[strings.Join(append(slices.Clone(pattern), part), ".")]; found && i == len(parts)-1 {
+					aliased := alias[strings.LastIndex(alias, ".")+1:]
+					field, ok = findYamlField(value, aliased)
+					part = aliased
+				}
+			}
+			if !ok {
+				return reflect.Value{}, "", fmt.Errorf("%s is not a sidekick config key, run sidekick config list to see them", key)
+			}
+			value = field
+			pattern = append(pattern, part)
+		case value.Kind() == reflect.Slice && value.Type().Elem().Kind() == reflect.Struct:
+			found := false
+			for j := 0; j < value.Len(); j++ {
+				if configElementName(value.Index(j), j) == part {
+					value, found = value.Index(j), true
+					break
+				}
+			}
+			if !found {
+				return reflect.Value{}, "", fmt.Errorf("no %s named %s in the sidekick config", strings.TrimSuffix(parts[i-1], "s"), part)
+			}
+			pattern = append(pattern, "*")
+		default:
+			return reflect.Value{}, "", fmt.Errorf("%s is not a sidekick config key, %s has no keys inside it", key, strings.Join(parts[:i], "."))
+		}
+	}
+	return value, strings.Join(pattern, "."), nil
+}
+
+// configElementName is how a key names an element of a list, servers and contexts by name and the others by index
+func configElementName(element reflect.Value, index int) string {
+	if name := element.FieldByName("Name"); name.IsValid() && name.Kind() == reflect.String {
+		return name.String()
+	}
+	return strconv.Itoa(index)
+}
+
+func findYamlField(value reflect.Value, name string) (reflect.Value, bool) {
+	for i := 0; i < value.NumField(); i++ {
+		if yamlFieldName(value.Type().Field(i)) == name {
+			return value.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// yamlFieldName is the key of field in the file, empty for fields that are never written to it
+func yamlFieldName(field reflect.StructField) string {
+	if !field.IsExported() {
+		return ""
+	}
+	name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	if name == "-" {
+		return ""
+	}
+	if name == "" {
+		return strings.ToLower(field.Name)
+	}
+	return name
+}
+
+func formatConfigLeaf(value reflect.Value) (string, bool) {
+	switch value.Kind() {
+	case reflect.String:
+		return value.String(), true
+	case reflect.Bool:
+		return strconv.FormatBool(value.Bool()), true
+	case reflect.Int:
+		return strconv.FormatInt(value.Int(), 10), true
+	case reflect.Slice:
+		if value.Type().Elem().Kind() == reflect.String {
+			return strings.Join(value.Interface().([]string), ","), true
+		}
+	}
+	return "", false
+}
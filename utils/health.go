@@ -0,0 +1,262 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/mightymoud/sidekick/render"
+	"github.com/pterm/pterm"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	ServiceHealthy   = "healthy"
+	ServiceUnhealthy = "unhealthy"
+	ServiceTimeout   = "timeout"
+
+	DefaultHealthTimeout = 60
+	healthPollInterval   = 2 * time.Second
+)
+
+type ServiceHealth struct {
+	Service  string
+	Status   string
+	Optional bool
+	Detail   string
+	Logs     string
+}
+
+type HealthReport []ServiceHealth
+
+// Passed is true when every required service is healthy, optional ones only count as warnings
+func (r HealthReport) Passed() bool {
+	for _, service := range r {
+		if service.Status != ServiceHealthy && !service.Optional {
+			return false
+		}
+	}
+	return true
+}
+
+func (r HealthReport) String() string {
+	rows := pterm.TableData{{"Service", "Status", "Detail"}}
+	for _, service := range r {
+		status := service.Status
+		if service.Status != ServiceHealthy && service.Optional {
+			status += " (optional)"
+		}
+		rows = append(rows, []string{service.Service, status, service.Detail})
+	}
+	table, _ := pterm.DefaultTable.WithHasHeader().WithData(rows).Srender()
+
+	var out strings.Builder
+	out.WriteString(table)
+	for _, service := range r {
+		if service.Status != ServiceHealthy && service.Logs != "" {
+			fmt.Fprintf(&out, "\n\nLast logs of %s:\n%s", service.Service, service.Logs)
+		}
+	}
+	return out.String()
+}
+
+// GetHealthChecks returns the check for every service of the app, the main one included.
+// Services not listed in sidekick.yml only need to be running, or healthy when their image has a docker healthcheck.
+func GetHealthChecks(appConfig SidekickAppConfig, services []string) map[string]SidekickHealthCheckConfig {
+	checks := map[string]SidekickHealthCheckConfig{}
+	for _, service := range services {
+		check := appConfig.Services[service]
+		if service == appConfig.Name {
+			check = appConfig.HealthCheck
+			if check.Port == 0 {
+				check.Port = appConfig.Port
+			}
+		}
+		if check.Timeout == 0 {
+			check.Timeout = DefaultHealthTimeout
+		}
+		checks[service] = check
+	}
+	return checks
+}
+
+// serviceCommands look into the services of the app or preview in dir, swarm names the services of a stack after the stack
+// network is the one the app shares with Traefik, a health check path is curled on the IP the app has there
+type serviceCommands struct {
+	dir     string
+	project string
+	swarm   bool
+	network string
+}
+
+func newServiceCommands(dir string, appConfig SidekickAppConfig) serviceCommands {
+	return serviceCommands{dir: dir, project: ComposeProjectForDir(dir), swarm: IsSwarm(appConfig), network: AppNetwork(appConfig)}
+}
+
+func (c serviceCommands) list() string {
+	if c.swarm {
+		return fmt.Sprintf("docker stack services --format '{{.Name}}' %[1]s | sed 's/^%[1]s_//'", c.project)
+	}
+	return fmt.Sprintf("cd %s && docker compose -p %s config --services", c.dir, c.project)
+}
+
+// newestContainer prints the newest container of service, the old one may still be around during a swap
+func (c serviceCommands) newestContainer(service string) string {
+	if c.swarm {
+		return fmt.Sprintf("docker ps -a -q -f label=com.docker.swarm.service.name=%s_%s | head -n1", c.project, service)
+	}
+	return fmt.Sprintf("cd %s && docker compose -p %s ps -a -q %s | head -n1", c.dir, c.project, service)
+}
+
+func (c serviceCommands) logs(service string, lines int) string {
+	if c.swarm {
+		return fmt.Sprintf("docker service logs --tail %d --no-task-ids %s_%s 2>&1", lines, c.project, service)
+	}
+	return fmt.Sprintf("cd %s && docker compose -p %s logs --tail %d --no-log-prefix %s 2>&1", c.dir, c.project, lines, service)
+}
+
+// PollServicesHealth waits on all services of the compose file in dir at the same time
+func PollServicesHealth(client *ssh.Client, dir string, appConfig SidekickAppConfig) (HealthReport, error) {
+	commands := newServiceCommands(dir, appConfig)
+	output, err := RunCommandOutput(client, commands.list())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list services: %w", err)
+	}
+	services := outputLines(output)
+	checks := GetHealthChecks(appConfig, services)
+
+	report := make(HealthReport, len(services))
+	group, ctx := errgroup.WithContext(context.Background())
+	for i, service := range services {
+		group.Go(func() error {
+			health, err := pollServiceHealth(ctx, client, commands, service, checks[service])
+			if err != nil {
+				return err
+			}
+			report[i] = health
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(report, func(i, j int) bool {
+		return report[i].Service < report[j].Service
+	})
+	return report, nil
+}
+
+// pollServiceHealth only returns an error when the VPS can't be reached, a failing service is part of the report
+func pollServiceHealth(ctx context.Context, client *ssh.Client, commands serviceCommands, service string, check SidekickHealthCheckConfig) (ServiceHealth, error) {
+	health := ServiceHealth{Service: service, Optional: check.Optional}
+	deadline := time.Now().Add(time.Duration(check.Timeout) * time.Second)
+
+	probe := fmt.Sprintf(`id=$(%s) && [ -n "$id" ] && docker inspect -f '{{.State.Status}}|{{if .State.Health}}{{.State.Health.Status}}{{end}}|{{range $name, $network := .NetworkSettings.Networks}}{{$name}}={{$network.IPAddress}},{{end}}' "$id"`, commands.newestContainer(service))
+	for {
+		if ctx.Err() != nil {
+			return health, ctx.Err()
+		}
+		output, err := RunCommandOutput(client, probe)
+		var exitErr *ssh.ExitError
+		if err != nil && !errors.As(err, &exitErr) {
+			return health, err
+		}
+		if err != nil {
+			health.Status, health.Detail = ServiceUnhealthy, "no container found"
+		} else {
+			state, dockerHealth, ip := ParseServiceProbe(output, commands.network)
+			health.Status, health.Detail = checkServiceState(client, state, dockerHealth, ip, check)
+			if health.Status == ServiceHealthy {
+				return health, nil
+			}
+			// a dead container won't come back by waiting on it
+			if state == "exited" || state == "dead" {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			health.Status = ServiceTimeout
+			break
+		}
+		time.Sleep(healthPollInterval)
+	}
+
+	logs, _ := RunCommandOutput(client, commands.logs(service, 20))
+	health.Logs = strings.TrimSpace(logs)
+	return health, nil
+}
+
+// ParseServiceProbe reads the state, the docker health and the IP of a container from the health probe.
+// A container on more networks than the one it shares with Traefik, like addons, gets the IP it has on network,
+// and the first one when it isn't on network at all.
+func ParseServiceProbe(output string, network string) (state string, dockerHealth string, ip string) {
+	fields := strings.Split(strings.TrimSpace(output), "|")
+	if len(fields) != 3 {
+		return fields[0], "", ""
+	}
+	for _, entry := range strings.Split(fields[2], ",") {
+		name, address, ok := strings.Cut(entry, "=")
+		if !ok || address == "" {
+			continue
+		}
+		if name == network {
+			return fields[0], fields[1], address
+		}
+		if ip == "" {
+			ip = address
+		}
+	}
+	return fields[0], fields[1], ip
+}
+
+func checkServiceState(client *ssh.Client, state string, dockerHealth string, ip string, check SidekickHealthCheckConfig) (string, string) {
+	if state != "running" {
+		return ServiceUnhealthy, fmt.Sprintf("container is %s", state)
+	}
+	if dockerHealth != "" && dockerHealth != "healthy" {
+		return ServiceUnhealthy, fmt.Sprintf("docker healthcheck is %s", dockerHealth)
+	}
+	if check.Path == "" || check.Port == 0 {
+		return ServiceHealthy, "running"
+	}
+	url := fmt.Sprintf("http://%s:%d%s", ip, check.Port, check.Path)
+	if _, err := RunCommandOutput(client, fmt.Sprintf("curl --silent --fail --max-time 3 --output /dev/null %s", url)); err != nil {
+		return ServiceUnhealthy, fmt.Sprintf("%s is not answering", url)
+	}
+	return ServiceHealthy, fmt.Sprintf("%s answered", url)
+}
+
+// VerifyServicesHealthWithTUIHook polls every service of the app and logs the outcome table to the TUI
+func VerifyServicesHealthWithTUIHook(client *ssh.Client, dir string, appConfig SidekickAppConfig, p *tea.Program) error {
+	report, err := PollServicesHealth(client, dir, appConfig)
+	if err != nil {
+		return fmt.Errorf("failed to check the health of your services: %w", err)
+	}
+	for _, line := range strings.Split(report.String(), "\n") {
+		p.Send(render.LogMsg{LogLine: line + "\n"})
+	}
+	if !report.Passed() {
+		return errors.New("required services are not healthy")
+	}
+	return nil
+}
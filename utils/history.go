@@ -0,0 +1,128 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pterm/pterm"
+)
+
+const (
+	HistoryDeploy   = "deploy"
+	HistoryPreview  = "preview"
+	HistoryRollback = "rollback"
+
+	HistoryResultSuccess = "success"
+	HistoryResultFailed  = "failed"
+)
+
+// HistoryEntry is one deploy, preview or rollback in history.jsonl of the app folder on the VPS
+type HistoryEntry struct {
+	Time     string `json:"time"`
+	Action   string `json:"action"`
+	Hash     string `json:"hash,omitempty"`
+	Image    string `json:"image,omitempty"`
+	User     string `json:"user,omitempty"`
+	Host     string `json:"host,omitempty"`
+	Duration string `json:"duration"`
+	Result   string `json:"result"`
+	// Stage is where a failed run stopped
+	Stage string `json:"stage,omitempty"`
+}
+
+func RemoteHistoryFile(appName string) string {
+	return path.Join(appName, "history.jsonl")
+}
+
+// NewHistoryEntry records who ran action on this machine, err is what the run ended with
+func NewHistoryEntry(action string, hash string, image string, start time.Time, err error) HistoryEntry {
+	entry := HistoryEntry{
+		Time:     start.UTC().Format(time.RFC3339),
+		Action:   action,
+		Hash:     hash,
+		Image:    image,
+		Duration: time.Since(start).Round(time.Second).String(),
+		Result:   HistoryResultSuccess,
+	}
+	if u, err := user.Current(); err == nil {
+		entry.User = u.Username
+	}
+	entry.Host, _ = os.Hostname()
+	if err != nil {
+		entry.Result = HistoryResultFailed
+		var stageErr *StageError
+		if errors.As(err, &stageErr) {
+			entry.Stage = stageErr.Stage
+		}
+	}
+	return entry
+}
+
+// AppendHistory adds entry to the end of the history of the app
+func AppendHistory(remote RemoteExecutor, appName string, entry HistoryEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	encoded := base64.StdEncoding.EncodeToString(append(line, '\n'))
+	if _, err := remote.Output(fmt.Sprintf("echo %s | base64 -d >> %s", encoded, RemoteHistoryFile(appName))); err != nil {
+		return fmt.Errorf("failed to write the deploy history: %w", err)
+	}
+	return nil
+}
+
+// RecordHistory logs in again to append entry, so it also works once the connection of the run is gone.
+// The run is over by then, a history that can't be written is only worth a warning.
+func RecordHistory(address string, appName string, entry HistoryEntry) {
+	client, err := Login(address, "sidekick")
+	if err != nil {
+		pterm.Warning.Printfln("Could not record the deploy history: %s", err)
+		return
+	}
+	defer client.Close()
+	if err := AppendHistory(SSHExecutor{Client: client}, appName, entry); err != nil {
+		pterm.Warning.Printfln("Could not record the deploy history: %s", err)
+	}
+}
+
+// LoadHistory returns the last limit entries of the history of the app, oldest first
+func LoadHistory(remote RemoteExecutor, appName string, limit int) ([]HistoryEntry, error) {
+	output, err := remote.Output(fmt.Sprintf("tail -n %d %s 2>/dev/null || true", limit, RemoteHistoryFile(appName)))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the deploy history: %w", err)
+	}
+	entries := []HistoryEntry{}
+	for _, line := range strings.Split(output, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var entry HistoryEntry
+		// a line cut off by a full disk is skipped rather than hiding the rest of the history
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
@@ -0,0 +1,251 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/mightymoud/sidekick/render"
+	"github.com/skeema/knownhosts"
+	"golang.org/x/crypto/ssh"
+)
+
+// hostKeys is what GetSshClient checks host keys against, the root cmd points it at the loaded config.
+// savePath is empty when the config holds values from the environment and must not be written.
+var hostKeys = struct {
+	sync.Mutex
+	config    *SidekickConfig
+	savePath  string
+	acceptNew bool
+	insecure  bool
+	seen      map[string]string
+	skipped   map[string]bool
+}{seen: map[string]string{}, skipped: map[string]bool{}}
+
+func SetHostKeyConfig(config *SidekickConfig, savePath string, acceptNew bool) {
+	hostKeys.Lock()
+	defer hostKeys.Unlock()
+	hostKeys.config, hostKeys.savePath, hostKeys.acceptNew = config, savePath, acceptNew
+}
+
+// SetInsecureHostKey turns host key checks off for --insecure-host-key, nothing gets pinned or added to known_hosts then
+func SetInsecureHostKey(insecure bool) {
+	hostKeys.Lock()
+	defer hostKeys.Unlock()
+	hostKeys.insecure = insecure
+}
+
+// SeenHostKey is the host key the server at address presented this run, for init to pin
+func SeenHostKey(address string) string {
+	hostKeys.Lock()
+	defer hostKeys.Unlock()
+	return hostKeys.seen[address]
+}
+
+func MarshalHostKey(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+// VerifyPinnedHostKey fails with what to do about it when key is not the pinned one
+func VerifyPinnedHostKey(address string, pinned string, key ssh.PublicKey) error {
+	pinnedKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pinned))
+	if err != nil {
+		return fmt.Errorf("the pinned host key of %s is not valid: %w", address, err)
+	}
+	if bytes.Equal(pinnedKey.Marshal(), key.Marshal()) {
+		return nil
+	}
+	return fmt.Errorf("REMOTE HOST IDENTIFICATION HAS CHANGED for %s! Sidekick pinned %s but the server presented %s. "+
+		"Someone could be intercepting the connection, do not continue unless you know why. "+
+		"If you rebuilt or reinstalled this server, check its new key with sidekick server trust, or run the command again with --accept-new-hostkey",
+		address, ssh.FingerprintSHA256(pinnedKey), ssh.FingerprintSHA256(key))
+}
+
+// errHostKeyFetched stops the handshake of FetchHostKey once the key is in
+var errHostKeyFetched = errors.New("host key fetched")
+
+// FetchHostKey asks the server at address for its host key without logging in, the key is not checked against anything
+func FetchHostKey(address string) (ssh.PublicKey, net.Addr, error) {
+	var key ssh.PublicKey
+	var remote net.Addr
+	config := &ssh.ClientConfig{
+		User: "sidekick",
+		HostKeyCallback: func(hostname string, addr net.Addr, presented ssh.PublicKey) error {
+			key, remote = presented, addr
+			return errHostKeyFetched
+		},
+		Timeout: 5 * time.Second,
+	}
+	client, err := ssh.Dial("tcp", net.JoinHostPort(address, SSHPort), config)
+	if client != nil {
+		client.Close()
+	}
+	if key == nil {
+		return nil, nil, fmt.Errorf("unable to get the host key of %s: %w", address, err)
+	}
+	return key, remote, nil
+}
+
+// TrustKnownHost puts key in known_hosts for address in place of the one there, so rsync and scp agree with the new pin
+func TrustKnownHost(address string, remote net.Addr, key ssh.PublicKey) error {
+	hostKeys.Lock()
+	defer hostKeys.Unlock()
+	khPath, err := knownHostsPath()
+	if err != nil {
+		return fmt.Errorf("failed to open known_hosts: %w", err)
+	}
+	return replaceKnownHost(khPath, net.JoinHostPort(address, SSHPort), remote, key)
+}
+
+func knownHostsPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	khPath := filepath.Join(home, ".ssh", "known_hosts")
+	if err := os.MkdirAll(filepath.Dir(khPath), 0700); err != nil {
+		return "", err
+	}
+	f, err := os.OpenFile(khPath, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	return khPath, f.Close()
+}
+
+// replaceKnownHost swaps the known_hosts entry of a host, rsync and scp use the system ssh so it has to agree with the pin
+func replaceKnownHost(khPath string, hostname string, remote net.Addr, key ssh.PublicKey) error {
+	exec.Command("ssh-keygen", "-R", knownhosts.Normalize(hostname), "-f", khPath).Run()
+	f, err := os.OpenFile(khPath, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return knownhosts.WriteKnownHost(f, hostname, remote, key)
+}
+
+// pinHostKey stores the key on the server with that address in the config, if there is one
+func pinHostKey(address string, key ssh.PublicKey) error {
+	if hostKeys.config == nil || hostKeys.savePath == "" {
+		return nil
+	}
+	for i, server := range hostKeys.config.Servers {
+		if server.Address == address {
+			hostKeys.config.Servers[i].HostKey = MarshalHostKey(key)
+			return SaveServer(hostKeys.savePath, server.Name, func(saved *SidekickServer) {
+				saved.HostKey = MarshalHostKey(key)
+			})
+		}
+	}
+	return nil
+}
+
+func pinnedHostKey(address string) string {
+	if hostKeys.config == nil {
+		return ""
+	}
+	for _, server := range hostKeys.config.Servers {
+		if server.Address == address && server.HostKey != "" {
+			return server.HostKey
+		}
+	}
+	return ""
+}
+
+// checkHostKey verifies a server against its pinned key, or known_hosts for servers that have none yet.
+// A key seen for the first time is confirmed by the user, then pinned and added to known_hosts.
+func checkHostKey(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	hostKeys.Lock()
+	defer hostKeys.Unlock()
+	address, _, err := net.SplitHostPort(hostname)
+	if err != nil {
+		address = hostname
+	}
+	if hostKeys.insecure {
+		if !hostKeys.skipped[address] {
+			render.GetLogger(log.Options{Prefix: "Host Key"}).Warnf("Not checking the host key %s of %s, --insecure-host-key is set", ssh.FingerprintSHA256(key), address)
+			hostKeys.skipped[address] = true
+		}
+		return nil
+	}
+	khPath, err := knownHostsPath()
+	if err != nil {
+		return fmt.Errorf("failed to open known_hosts: %w", err)
+	}
+	kh, err := knownhosts.NewDB(khPath)
+	if err != nil {
+		return err
+	}
+	known := kh.HostKeyCallback()(hostname, remote, key)
+
+	if pinned := pinnedHostKey(address); pinned != "" {
+		if err := VerifyPinnedHostKey(address, pinned, key); err != nil {
+			if !hostKeys.acceptNew {
+				return err
+			}
+			render.GetLogger(log.Options{Prefix: "Host Key"}).Warnf("Accepting the new host key %s of %s", ssh.FingerprintSHA256(key), address)
+			if err := pinHostKey(address, key); err != nil {
+				return fmt.Errorf("failed to pin the new host key: %w", err)
+			}
+		}
+		hostKeys.seen[address] = MarshalHostKey(key)
+		if known != nil {
+			return replaceKnownHost(khPath, hostname, remote, key)
+		}
+		return nil
+	}
+
+	switch {
+	case known == nil:
+	case knownhosts.IsHostKeyChanged(known) && hostKeys.acceptNew:
+		render.GetLogger(log.Options{Prefix: "Host Key"}).Warnf("Accepting the new host key %s of %s", ssh.FingerprintSHA256(key), address)
+		if err := replaceKnownHost(khPath, hostname, remote, key); err != nil {
+			return fmt.Errorf("failed to update known_hosts: %w", err)
+		}
+	case knownhosts.IsHostKeyChanged(known):
+		return fmt.Errorf("REMOTE HOST IDENTIFICATION HAS CHANGED for %s! The key %s is not the one in known_hosts. "+
+			"Someone could be intercepting the connection, do not continue unless you know why. "+
+			"If you rebuilt or reinstalled this server, check its new key with sidekick server trust, or run the command again with --accept-new-hostkey", address, ssh.FingerprintSHA256(key))
+	case knownhosts.IsHostUnknown(known):
+		if !hostKeys.acceptNew {
+			if !render.IsInteractive() {
+				return fmt.Errorf("the host key of %s is not in known_hosts and can't be confirmed in CI mode - add it with ssh-keyscan -H %s >> ~/.ssh/known_hosts or pass --accept-new-hostkey", hostname, address)
+			}
+			if err := inspectServerPublicKey(key, hostname); err != nil {
+				return err
+			}
+		}
+		if err := replaceKnownHost(khPath, hostname, remote, key); err != nil {
+			return fmt.Errorf("failed to add %s to known_hosts: %w", address, err)
+		}
+	default:
+		return known
+	}
+	hostKeys.seen[address] = MarshalHostKey(key)
+	if err := pinHostKey(address, key); err != nil {
+		return fmt.Errorf("failed to pin the host key: %w", err)
+	}
+	return nil
+}
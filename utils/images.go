@@ -0,0 +1,282 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const DefaultKeepImages = 3
+
+var deployTagPattern = regexp.MustCompile(`^V(\d+)$`)
+
+// DeployImageTag is the tag each production deploy leaves on the server, previews are tagged with their hash instead
+func DeployImageTag(repository string, version string) string {
+	return fmt.Sprintf("%s:%s", repository, version)
+}
+
+// NextDeployVersion is the version the next production deploy gets
+func NextDeployVersion(version string) string {
+	latest, _ := strconv.Atoi(strings.TrimPrefix(version, "V"))
+	return fmt.Sprintf("V%d", latest+1)
+}
+
+// PreviewHistoryLimit is how many earlier images of a preview env are kept for rollback
+const PreviewHistoryLimit = 3
+
+// KeepPreviewImage adds the image a preview env runs now to its history before a deploy replaces it.
+// A redeploy of the same commit reuses the tag, so the old image gets a tag of its own first.
+// Images that fall off the history are removed from the server.
+func KeepPreviewImage(remote RemoteExecutor, preview SidekickPreview, newImage string, now time.Time) ([]string, error) {
+	history := slices.Clone(preview.History)
+	if preview.Image == "" {
+		return history, nil
+	}
+	kept := preview.Image
+	check := fmt.Sprintf("docker image inspect %s > /dev/null 2>&1", preview.Image)
+	if preview.Image == newImage {
+		kept = fmt.Sprintf("%s-%s", preview.Image, now.Format("20060102150405"))
+		check += fmt.Sprintf(" && docker tag %s %s", preview.Image, kept)
+	}
+	output, err := remote.Output(check + " && echo kept || true")
+	if err != nil {
+		return history, fmt.Errorf("failed to keep the current preview image: %w", err)
+	}
+	// an image removed by hand can't be rolled back to
+	if strings.TrimSpace(output) != "kept" {
+		return history, nil
+	}
+	history = append(history, kept)
+	if len(history) > PreviewHistoryLimit {
+		dropped := history[:len(history)-PreviewHistoryLimit]
+		history = history[len(history)-PreviewHistoryLimit:]
+		if _, err := remote.Output(fmt.Sprintf("docker image rm %s || true", strings.Join(dropped, " "))); err != nil {
+			return history, fmt.Errorf("failed to remove old preview images: %w", err)
+		}
+	}
+	return history, nil
+}
+
+// LiveImageTag is the versioned tag of the image production runs now, empty before the first deploy.
+// Deploys run the moving latest tag while a rollback runs the V tag it went back to.
+func LiveImageTag(appConfig SidekickAppConfig) string {
+	if _, tag, found := strings.Cut(strings.TrimPrefix(appConfig.Image, AppRepository(appConfig)), ":"); found && deployTagPattern.MatchString(tag) {
+		return appConfig.Image
+	}
+	if appConfig.Version == "" {
+		return ""
+	}
+	return DeployImageTag(AppRepository(appConfig), appConfig.Version)
+}
+
+// RecordRollbackImage adds the image that was live before a deploy to the rollback history of production.
+// Along with the new deploy the history holds keep images, the ones that fall off are left to the prune.
+func RecordRollbackImage(history []string, previous string, keep int) []string {
+	history = slices.DeleteFunc(slices.Clone(history), func(image string) bool { return image == previous })
+	if previous != "" {
+		history = append(history, previous)
+	}
+	if limit := max(keep-1, 0); len(history) > limit {
+		history = history[len(history)-limit:]
+	}
+	return history
+}
+
+// RollbackImage is the image sidekick rollback goes back to: the newest in the history, or the one to names.
+// to is a deploy tag like V3, a version or commit tag of a deploy, or a full image reference.
+func RollbackImage(appConfig SidekickAppConfig, to string) (string, error) {
+	if to == "" {
+		if len(appConfig.ImageHistory) == 0 {
+			return "", errors.New("no previous image recorded for production")
+		}
+		return appConfig.ImageHistory[len(appConfig.ImageHistory)-1], nil
+	}
+	if strings.ContainsAny(to, ":/@") {
+		return to, nil
+	}
+	return DeployImageTag(AppRepository(appConfig), to), nil
+}
+
+// SetComposeImage points service in the compose file content at image and leaves the rest as it is
+func SetComposeImage(content []byte, service string, image string) ([]byte, error) {
+	var composeFile DockerComposeFile
+	if err := yaml.Unmarshal(content, &composeFile); err != nil {
+		return nil, fmt.Errorf("failed to read the compose file: %w", err)
+	}
+	app, ok := composeFile.Services[service]
+	if !ok {
+		return nil, fmt.Errorf("the compose file has no service %s", service)
+	}
+	app.Image = image
+	composeFile.Services[service] = app
+	return yaml.Marshal(composeFile)
+}
+
+func GetKeepImages(appConfig SidekickAppConfig) int {
+	if appConfig.KeepImages > 0 {
+		return appConfig.KeepImages
+	}
+	return DefaultKeepImages
+}
+
+// PruneResult is what PruneAppImages removed
+type PruneResult struct {
+	Removed        []string
+	ReclaimedBytes int64
+}
+
+func (r PruneResult) String() string {
+	if len(r.Removed) == 0 && r.ReclaimedBytes == 0 {
+		return ""
+	}
+	return fmt.Sprintf("🧹 Removed %d old images, reclaimed %s", len(r.Removed), FormatBytes(r.ReclaimedBytes))
+}
+
+type deployImage struct {
+	tag     string
+	id      string
+	version int
+}
+
+// ProtectedImages are the images of the app that must survive a prune whatever their age:
+// the one production runs or can roll back to and every image a preview env runs or can roll back to
+func ProtectedImages(appConfig SidekickAppConfig) []string {
+	protected := []string{}
+	if appConfig.Image != "" {
+		protected = append(protected, appConfig.Image)
+	}
+	protected = append(protected, appConfig.ImageHistory...)
+	for _, preview := range appConfig.PreviewEnvs {
+		if preview.Image != "" {
+			protected = append(protected, preview.Image)
+		}
+		protected = append(protected, preview.History...)
+	}
+	return protected
+}
+
+// ImagesToPrune lists the deploy images in the app repository older than the newest keep.
+// Images a container still uses, like a running preview, and protected ones are left out.
+func ImagesToPrune(remote RemoteExecutor, repository string, keep int, protected ...string) ([]string, error) {
+	output, err := remote.Output(fmt.Sprintf("docker image ls %s --format '{{.Tag}} {{.ID}}'", repository))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list images: %w", err)
+	}
+	images := []deployImage{}
+	// the version and commit tags of a deploy go along with its V tag
+	releaseTags := map[string][]string{}
+	for _, line := range outputLines(output) {
+		tag, id, _ := strings.Cut(strings.TrimSpace(line), " ")
+		match := deployTagPattern.FindStringSubmatch(tag)
+		if match == nil {
+			if tag != "latest" && tag != "<none>" {
+				releaseTags[id] = append(releaseTags[id], DeployImageTag(repository, tag))
+			}
+			continue
+		}
+		version, _ := strconv.Atoi(match[1])
+		images = append(images, deployImage{tag: DeployImageTag(repository, tag), id: id, version: version})
+	}
+	if len(images) <= keep {
+		return nil, nil
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].version > images[j].version })
+
+	inUse, err := remote.Output("docker ps -aq | xargs -r docker inspect -f '{{.Image}}'")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the images in use: %w", err)
+	}
+	kept := map[string]bool{}
+	for _, image := range images[:keep] {
+		kept[image.id] = true
+	}
+	remove := []string{}
+	for _, image := range images[keep:] {
+		if strings.Contains(inUse, image.id) || slices.Contains(protected, image.tag) {
+			continue
+		}
+		remove = append(remove, image.tag)
+		if kept[image.id] {
+			continue
+		}
+		for _, tag := range releaseTags[image.id] {
+			if !slices.Contains(protected, tag) && !slices.Contains(remove, tag) {
+				remove = append(remove, tag)
+			}
+		}
+	}
+	return remove, nil
+}
+
+// CountDanglingImages is how many untagged images docker image prune would remove
+func CountDanglingImages(remote RemoteExecutor) (int, error) {
+	output, err := remote.Output("docker image ls -q --filter dangling=true | wc -l")
+	if err != nil {
+		return 0, fmt.Errorf("failed to list dangling images: %w", err)
+	}
+	return strconv.Atoi(strings.TrimSpace(output))
+}
+
+// PruneAppImages removes what ImagesToPrune lists along with dangling images
+func PruneAppImages(remote RemoteExecutor, repository string, keep int, protected ...string) (PruneResult, error) {
+	result := PruneResult{}
+	remove, err := ImagesToPrune(remote, repository, keep, protected...)
+	if err != nil || len(remove) == 0 {
+		return result, err
+	}
+
+	usedBefore, err := dockerDiskUsed(remote)
+	if err != nil {
+		return result, err
+	}
+	if _, err := remote.Output(fmt.Sprintf("docker rmi %s && docker image prune -f", strings.Join(remove, " "))); err != nil {
+		return result, fmt.Errorf("failed to remove old images: %w", err)
+	}
+	result.Removed = remove
+	if usedAfter, err := dockerDiskUsed(remote); err == nil && usedBefore > usedAfter {
+		result.ReclaimedBytes = usedBefore - usedAfter
+	}
+	return result, nil
+}
+
+func dockerDiskUsed(remote RemoteExecutor) (int64, error) {
+	output, err := remote.Output(`df --output=used -B1 "$(docker info -f '{{.DockerRootDir}}')" | tail -n1`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read docker disk usage: %w", err)
+	}
+	return strconv.ParseInt(strings.TrimSpace(output), 10, 64)
+}
+
+func FormatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
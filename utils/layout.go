@@ -0,0 +1,142 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// RemoteDir is one folder sidekick owns on the VPS, relative to the sidekick user home
+type RemoteDir struct {
+	Path string
+	Mode string
+}
+
+// GetRemoteLayout lists every folder sidekick creates on the VPS for an app.
+// They all end up holding env files or backups so only the sidekick user gets to read them.
+// Anything that creates, checks or deletes app folders goes through this list.
+func GetRemoteLayout(appName string) []RemoteDir {
+	return []RemoteDir{
+		{Path: appName, Mode: "700"},
+		{Path: RemotePreviewsDir(appName), Mode: "700"},
+		{Path: RemoteBackupsDir(appName), Mode: "700"},
+		{Path: RemoteSecretsDir(appName), Mode: "700"},
+		{Path: RemoteCronDir(appName), Mode: "700"},
+	}
+}
+
+func RemotePreviewsDir(appName string) string {
+	return path.Join(appName, "preview")
+}
+
+func RemotePreviewDir(appName string, hash string) string {
+	return path.Join(RemotePreviewsDir(appName), hash)
+}
+
+// ComposeProjectForDir is the compose project of the app or preview env whose folder is dir
+func ComposeProjectForDir(dir string) string {
+	appName, hash, _ := strings.Cut(path.Clean(dir), "/"+path.Base(RemotePreviewsDir(""))+"/")
+	return ComposeProject(appName, hash)
+}
+
+func RemoteBackupsDir(appName string) string {
+	return path.Join(appName, "backups")
+}
+
+func RemoteSecretsDir(appName string) string {
+	return path.Join(appName, "secrets")
+}
+
+// RemoteCronDir holds the scripts of the cron jobs of the app and their logs
+func RemoteCronDir(appName string) string {
+	return path.Join(appName, "cron")
+}
+
+// GetRemoteLayoutScript creates the app folders or, when repair is off, only reports what is wrong with them.
+// Running it again on a healthy layout changes nothing, so deploy runs it every time.
+func GetRemoteLayoutScript(appName string, repair bool) string {
+	var script strings.Builder
+	script.WriteString("set -e\nproblems=0\nuser=$(whoami)\n")
+	for _, dir := range GetRemoteLayout(appName) {
+		fmt.Fprintf(&script, "dir=%q; mode=%q\n", dir.Path, dir.Mode)
+		if repair {
+			script.WriteString(`if [ ! -d "$dir" ]; then mkdir -p "$dir"; echo "created $dir"; fi
+if [ "$(stat -c %U "$dir")" != "$user" ]; then sudo chown -R "$user:$user" "$dir"; echo "fixed owner of $dir"; fi
+if [ "$(stat -c %a "$dir")" != "$mode" ]; then chmod "$mode" "$dir"; echo "fixed mode of $dir to $mode"; fi
+`)
+		} else {
+			script.WriteString(`if [ ! -d "$dir" ]; then echo "missing $dir"; problems=$((problems+1))
+else
+  if [ "$(stat -c %U "$dir")" != "$user" ]; then echo "$dir is owned by $(stat -c %U "$dir") instead of $user"; problems=$((problems+1)); fi
+  if [ "$(stat -c %a "$dir")" != "$mode" ]; then echo "$dir has mode $(stat -c %a "$dir") instead of $mode"; problems=$((problems+1)); fi
+fi
+`)
+		}
+	}
+	// env files are copied around by rsync which keeps the local mode
+	fmt.Fprintf(&script, "envFiles=$(find %q -name encrypted.env ! -perm 600 2>/dev/null || true)\n", appName)
+	if repair {
+		script.WriteString(`for f in $envFiles; do chmod 600 "$f"; echo "fixed mode of $f to 600"; done
+`)
+	} else {
+		script.WriteString(`for f in $envFiles; do echo "$f is readable by other users"; problems=$((problems+1)); done
+[ "$problems" -eq 0 ]
+`)
+	}
+	return script.String()
+}
+
+// BootstrapRemoteLayout creates or repairs the app folders and returns what had to be fixed
+func BootstrapRemoteLayout(remote RemoteExecutor, appName string) ([]string, error) {
+	output, err := remote.Output(GetRemoteLayoutScript(appName, true))
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up app folders on the VPS: %w", err)
+	}
+	return outputLines(output), nil
+}
+
+// CheckRemoteLayout returns the problems with the app folders without touching them
+func CheckRemoteLayout(remote RemoteExecutor, appName string) ([]string, error) {
+	output, err := remote.Output(GetRemoteLayoutScript(appName, false))
+	problems := outputLines(output)
+	if err != nil && len(problems) == 0 {
+		return nil, err
+	}
+	return problems, nil
+}
+
+func outputLines(output string) []string {
+	lines := []string{}
+	for _, line := range strings.Split(output, "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// RemoteAppExists reports whether the VPS already has a folder or compose containers for an app with this name
+func RemoteAppExists(remote RemoteExecutor, appName string) (bool, error) {
+	output, err := remote.Output(fmt.Sprintf(
+		"if [ -e %[1]q ] || docker ps -aq --filter label=com.docker.compose.service=%[1]q | grep -q . || docker ps -aq --filter label=com.docker.compose.project=%[1]q | grep -q .; then echo exists; fi",
+		appName,
+	))
+	if err != nil {
+		return false, fmt.Errorf("failed to look for the app on the VPS: %w", err)
+	}
+	return strings.TrimSpace(output) == "exists", nil
+}
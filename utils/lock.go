@@ -0,0 +1,153 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pterm/pterm"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultLockTimeout is how old a deploy lock gets before the next deploy takes it over
+const DefaultLockTimeout = time.Hour
+
+// DeployLock is a lock file in the app folder on the VPS, held while a deploy or preview changes the app.
+// It is created with noclobber so only one of two runs starting together gets it.
+type DeployLock struct {
+	Path   string `yaml:"-"`
+	Holder string `yaml:"holder"`
+	PID    int    `yaml:"pid"`
+	Since  string `yaml:"since"`
+}
+
+// LockedError means someone else holds the lock and it is not stale yet
+type LockedError struct {
+	Lock DeployLock
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("%s is held by %s (pid %d) since %s", e.Lock.Path, e.Lock.Holder, e.Lock.PID, e.Lock.Since)
+}
+
+func DeployLockFile(appName string) string {
+	return path.Join(appName, "deploy.lock")
+}
+
+// PreviewLockFile is per preview so previews of different commits don't wait on each other
+func PreviewLockFile(appName string, hash string) string {
+	return path.Join(appName, fmt.Sprintf("preview-%s.lock", hash))
+}
+
+// GetLockTimeout is lockTimeout in sidekick.yml, DefaultLockTimeout when it is not set
+func GetLockTimeout(appConfig SidekickAppConfig) time.Duration {
+	if timeout, err := time.ParseDuration(appConfig.LockTimeout); err == nil && timeout > 0 {
+		return timeout
+	}
+	return DefaultLockTimeout
+}
+
+// NewDeployLock is a lock at lockPath held by the user of this machine
+func NewDeployLock(lockPath string) *DeployLock {
+	lock := &DeployLock{Path: lockPath, PID: os.Getpid(), Since: time.Now().UTC().Format(time.RFC3339)}
+	lock.Holder = "unknown"
+	if u, err := user.Current(); err == nil {
+		lock.Holder = u.Username
+	}
+	if host, err := os.Hostname(); err == nil {
+		lock.Holder += "@" + host
+	}
+	return lock
+}
+
+func (l *DeployLock) content() string {
+	content, _ := yaml.Marshal(l)
+	return base64.StdEncoding.EncodeToString(content)
+}
+
+// Acquire creates the lock file, a lock older than timeout is left over from a crashed run and taken over
+func (l *DeployLock) Acquire(remote RemoteExecutor, timeout time.Duration) error {
+	for attempt := 0; attempt < 2; attempt++ {
+		output, err := remote.Output(fmt.Sprintf("if (set -C; echo %s | base64 -d > %s) 2>/dev/null; then echo acquired; else base64 -w0 %s; fi", l.content(), l.Path, l.Path))
+		if err != nil {
+			return fmt.Errorf("unable to take the deploy lock: %w", err)
+		}
+		output = strings.TrimSpace(output)
+		if output == "acquired" {
+			return nil
+		}
+		held := DeployLock{Path: l.Path}
+		content, _ := base64.StdEncoding.DecodeString(output)
+		yaml.Unmarshal(content, &held)
+		since, err := time.Parse(time.RFC3339, held.Since)
+		if err != nil || time.Since(since) < timeout {
+			return &LockedError{Lock: held}
+		}
+		// only the stale lock that was read goes, not one another run took over meanwhile
+		if _, err := remote.Output(fmt.Sprintf(`[ "$(base64 -w0 %s)" = "%s" ] && rm -f %s || true`, l.Path, output, l.Path)); err != nil {
+			return fmt.Errorf("unable to remove the stale deploy lock: %w", err)
+		}
+	}
+	return fmt.Errorf("unable to take the deploy lock %s", l.Path)
+}
+
+// Release removes the lock file when it is still this one
+func (l *DeployLock) Release(remote RemoteExecutor) error {
+	if _, err := remote.Output(fmt.Sprintf(`[ "$(base64 -w0 %s 2>/dev/null)" = "%s" ] && rm -f %s || true`, l.Path, l.content(), l.Path)); err != nil {
+		return fmt.Errorf("unable to release the deploy lock: %w", err)
+	}
+	return nil
+}
+
+// ForceUnlock removes whatever lock is at lockPath, ok is false when there was none
+func ForceUnlock(remote RemoteExecutor, lockPath string) (DeployLock, bool, error) {
+	output, err := remote.Output(fmt.Sprintf("if [ -e %s ]; then base64 -w0 %s; rm -f %s; else echo none; fi", lockPath, lockPath, lockPath))
+	if err != nil {
+		return DeployLock{}, false, fmt.Errorf("unable to remove the deploy lock: %w", err)
+	}
+	output = strings.TrimSpace(output)
+	if output == "none" {
+		return DeployLock{}, false, nil
+	}
+	held := DeployLock{Path: lockPath}
+	content, _ := base64.StdEncoding.DecodeString(output)
+	yaml.Unmarshal(content, &held)
+	return held, true, nil
+}
+
+// RunForceUnlock is --force-unlock, it removes the lock at lockPath on the server at address and says whose it was
+func RunForceUnlock(address string, lockPath string) error {
+	client, err := Login(address, "sidekick")
+	if err != nil {
+		return NewStageError("Login", ExitCodeRemote, "Check that the VPS is up and your SSH key is loaded in ssh-agent", err)
+	}
+	defer client.Close()
+	held, ok, err := ForceUnlock(SSHExecutor{Client: client}, lockPath)
+	if err != nil {
+		return NewStageError("Deploy lock", ExitCodeRemote, "", err)
+	}
+	if !ok {
+		pterm.Info.Printfln("There is no lock at %s", lockPath)
+		return nil
+	}
+	pterm.Success.Printfln("Removed %s held by %s (pid %d) since %s", lockPath, held.Holder, held.PID, held.Since)
+	return nil
+}
@@ -0,0 +1,62 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"regexp"
+	"slices"
+	"strconv"
+)
+
+const (
+	DefaultLogDriver  = "json-file"
+	DefaultLogMaxSize = "10m"
+	DefaultLogMaxFile = 3
+)
+
+var logSizePattern = regexp.MustCompile(`^[1-9][0-9]*[kmg]$`)
+
+// rotatingLogDrivers keep their logs in files on the server, only they take max-size and max-file
+var rotatingLogDrivers = []string{"json-file", "local"}
+
+// GetServiceLogging is the logging of every service of the app, json-file logs rotated at 10m with 3 files unless sidekick.yml says otherwise
+func GetServiceLogging(config SidekickLoggingConfig) *DockerLogging {
+	logging := &DockerLogging{Driver: config.Driver}
+	if logging.Driver == "" {
+		logging.Driver = DefaultLogDriver
+	}
+	if !slices.Contains(rotatingLogDrivers, logging.Driver) {
+		return logging
+	}
+	maxSize, maxFile := config.MaxSize, config.MaxFile
+	if maxSize == "" {
+		maxSize = DefaultLogMaxSize
+	}
+	if maxFile == 0 {
+		maxFile = DefaultLogMaxFile
+	}
+	logging.Options = map[string]string{"max-size": maxSize, "max-file": strconv.Itoa(maxFile)}
+	return logging
+}
+
+// applyLogging gives every service of composeFile without logging of its own the logging of the app
+func applyLogging(composeFile *DockerComposeFile, appConfig SidekickAppConfig) {
+	for name, service := range composeFile.Services {
+		if service.Logging == nil {
+			service.Logging = GetServiceLogging(appConfig.Logging)
+			composeFile.Services[name] = service
+		}
+	}
+}
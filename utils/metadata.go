@@ -0,0 +1,92 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	MetadataEnvProduction = "production"
+	MetadataEnvPreview    = "preview"
+)
+
+// DeployMetadata is handed to every container as SIDEKICK_* env vars.
+// The names are a stable contract, apps can rely on them across sidekick versions.
+type DeployMetadata struct {
+	App         string
+	Environment string
+	GitSha      string
+	GitBranch   string
+	DeployedAt  string
+	PreviewHash string
+}
+
+// NewDeployMetadata leaves the git details empty, for builds that don't come from a git repo
+func NewDeployMetadata(appName string, environment string, previewHash string) DeployMetadata {
+	return DeployMetadata{
+		App:         appName,
+		Environment: environment,
+		DeployedAt:  time.Now().UTC().Format(time.RFC3339),
+		PreviewHash: previewHash,
+	}
+}
+
+// GetDeployMetadata reads the git details from the current folder, they stay empty outside a git repo
+func GetDeployMetadata(appName string, environment string, previewHash string) DeployMetadata {
+	metadata := NewDeployMetadata(appName, environment, previewHash)
+	metadata.GitSha, _ = GetGitShortHash()
+	metadata.GitBranch, _ = GetGitBranch()
+	return metadata
+}
+
+func (m DeployMetadata) EnvVars() []string {
+	vars := [][2]string{
+		{"SIDEKICK_APP", m.App},
+		{"SIDEKICK_ENV", m.Environment},
+		{"SIDEKICK_GIT_SHA", m.GitSha},
+		{"SIDEKICK_GIT_BRANCH", m.GitBranch},
+		{"SIDEKICK_DEPLOYED_AT", m.DeployedAt},
+	}
+	if m.PreviewHash != "" {
+		vars = append(vars, [2]string{"SIDEKICK_PREVIEW_HASH", m.PreviewHash})
+	}
+	env := []string{}
+	for _, v := range vars {
+		// compose interpolates $ in values, these are literal
+		env = append(env, fmt.Sprintf("%s=%s", v[0], strings.ReplaceAll(v[1], "$", "$$")))
+	}
+	return env
+}
+
+// WithMetadataEnv appends the metadata after the user env, keys the user already sets win.
+// The values go straight into the compose file so they never end up in encrypted.env.
+func WithMetadataEnv(environment []string, metadata DeployMetadata) []string {
+	userKeys := map[string]bool{}
+	for _, entry := range environment {
+		key, _, _ := strings.Cut(entry, "=")
+		userKeys[key] = true
+	}
+	merged := append([]string{}, environment...)
+	for _, entry := range metadata.EnvVars() {
+		key, _, _ := strings.Cut(entry, "=")
+		if !userKeys[key] {
+			merged = append(merged, entry)
+		}
+	}
+	return merged
+}
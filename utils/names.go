@@ -0,0 +1,154 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// MaxAppNameLength leaves room in a 63 character DNS label and container name for the suffix of a preview
+const MaxAppNameLength = 40
+
+var appNameInvalidChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// ValidateAppName checks name works as a docker image, a Traefik router, a compose project and a subdomain
+func ValidateAppName(name string) error {
+	if name == "" {
+		return fmt.Errorf("the app name can't be empty")
+	}
+	if len(name) > MaxAppNameLength {
+		return fmt.Errorf("%q is longer than %d characters", name, MaxAppNameLength)
+	}
+	if !appNamePattern.MatchString(name) {
+		return fmt.Errorf("%q must be lowercase letters, numbers and dashes, starting with a letter, so it works in urls and container names", name)
+	}
+	return nil
+}
+
+// NormalizeAppName turns name into the closest valid app name, like MyApp_API into myapp-api. It is empty when nothing is left.
+func NormalizeAppName(name string) string {
+	normalized := appNameInvalidChars.ReplaceAllString(strings.ToLower(name), "-")
+	normalized = strings.TrimLeft(normalized, "-0123456789")
+	if len(normalized) > MaxAppNameLength {
+		normalized = normalized[:MaxAppNameLength]
+	}
+	return strings.TrimRight(normalized, "-")
+}
+
+// NormalizeDomain lowercases domain and writes its international labels in punycode, which is what DNS and Traefik expect
+func NormalizeDomain(domain string) string {
+	labels := strings.Split(strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), "."), ".")
+	for i, label := range labels {
+		if !isASCII(label) {
+			labels[i] = "xn--" + punycodeEncode(label)
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// punycode parameters from RFC 3492
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+)
+
+// punycodeEncode is the RFC 3492 encoding of a single label, without the xn-- prefix
+func punycodeEncode(label string) string {
+	runes := []rune(label)
+	out := []byte{}
+	for _, r := range runes {
+		if r < 0x80 {
+			out = append(out, byte(r))
+		}
+	}
+	basic := len(out)
+	handled := basic
+	if basic > 0 {
+		out = append(out, '-')
+	}
+	n, delta, bias := punyInitialN, 0, punyInitialBias
+	for handled < len(runes) {
+		next := int(^uint32(0) >> 1)
+		for _, r := range runes {
+			if int(r) >= n && int(r) < next {
+				next = int(r)
+			}
+		}
+		delta += (next - n) * (handled + 1)
+		n = next
+		for _, r := range runes {
+			if int(r) < n {
+				delta++
+			}
+			if int(r) != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := min(max(k-bias, punyTMin), punyTMax)
+				if q < t {
+					break
+				}
+				out = append(out, punyDigit(t+(q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out = append(out, punyDigit(q))
+			bias = punyAdapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+	return string(out)
+}
+
+func punyAdapt(delta int, points int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / points
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
+
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
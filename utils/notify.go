@@ -0,0 +1,184 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/mightymoud/sidekick/render"
+)
+
+const (
+	NotifyFormatSlack = "slack"
+	NotifyFormatJSON  = "json"
+
+	DeployStarted   = "started"
+	DeploySucceeded = "succeeded"
+	DeployFailed    = "failed"
+
+	// notifyTimeout keeps a webhook that hangs from holding up the deploy
+	notifyTimeout = 10 * time.Second
+)
+
+// DeployEvent is what a notification says about a deploy or preview, the json format posts it as is
+type DeployEvent struct {
+	Status      string `json:"status"`
+	App         string `json:"app"`
+	Environment string `json:"environment"`
+	Hash        string `json:"hash,omitempty"`
+	Subject     string `json:"subject,omitempty"`
+	User        string `json:"user,omitempty"`
+	Duration    string `json:"duration,omitempty"`
+	URL         string `json:"url"`
+	// Stage and Error are only set for a failed deploy
+	Stage string `json:"stage,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// NewDeployEvent describes the deploy of hash that started at start, err is what it ended with once it is over
+func NewDeployEvent(status string, appName string, environment string, hash string, url string, start time.Time, err error) DeployEvent {
+	event := DeployEvent{Status: status, App: appName, Environment: environment, Hash: hash, URL: url}
+	if u, err := user.Current(); err == nil {
+		event.User = u.Username
+	}
+	// a hash of the folder content is not a commit, it has no subject
+	if hash != "" {
+		if output, err := exec.Command("git", "log", "-1", "--format=%s", hash, "--").Output(); err == nil {
+			event.Subject = strings.TrimSpace(string(output))
+		}
+	}
+	if status != DeployStarted {
+		event.Duration = time.Since(start).Round(time.Second).String()
+	}
+	if err != nil {
+		event.Error = err.Error()
+		var stageErr *StageError
+		if errors.As(err, &stageErr) {
+			event.Stage = stageErr.Stage
+		}
+	}
+	return event
+}
+
+// Text is the one line a chat gets, like "✅ myapp deployed to production (a1b2c3d Fix login) by sam in 1m2s - https://myapp.com"
+func (e DeployEvent) Text() string {
+	commit := e.Hash
+	if e.Subject != "" {
+		commit = fmt.Sprintf("%s %s", e.Hash, e.Subject)
+	}
+	var text string
+	switch e.Status {
+	case DeployStarted:
+		text = fmt.Sprintf("🚀 %s is deploying to %s (%s)", e.App, e.Environment, commit)
+	case DeploySucceeded:
+		text = fmt.Sprintf("✅ %s deployed to %s (%s)", e.App, e.Environment, commit)
+	default:
+		text = fmt.Sprintf("❌ %s failed to deploy to %s (%s)", e.App, e.Environment, commit)
+	}
+	if e.User != "" {
+		text += " by " + e.User
+	}
+	if e.Duration != "" {
+		text += " in " + e.Duration
+	}
+	if e.Stage != "" {
+		text += fmt.Sprintf(", it stopped at %s: %s", e.Stage, e.Error)
+	} else if e.Error != "" {
+		text += ": " + e.Error
+	}
+	return text + " - " + e.URL
+}
+
+// NotificationPayload is the body posted to notification, Slack and Discord through its /slack endpoint take the text only
+func NotificationPayload(notification SidekickNotification, event DeployEvent) ([]byte, error) {
+	if notification.Format == NotifyFormatJSON {
+		return json.Marshal(event)
+	}
+	return json.Marshal(map[string]string{"text": event.Text()})
+}
+
+// ValidateNotification checks the format is known and the URL is set, it may come from an env var
+func ValidateNotification(notification SidekickNotification) error {
+	if notification.URL == "" {
+		return errors.New("a notification needs a url")
+	}
+	if notification.Format != "" && notification.Format != NotifyFormatSlack && notification.Format != NotifyFormatJSON {
+		return fmt.Errorf("notification format %q is not slack or json", notification.Format)
+	}
+	return nil
+}
+
+// GetNotifications are the webhooks of the global config and of sidekick.yml, a URL in both only gets one message
+func GetNotifications(config *SidekickConfig, appConfig SidekickAppConfig) []SidekickNotification {
+	notifications := []SidekickNotification{}
+	seen := map[string]bool{}
+	all := appConfig.Notifications
+	if config != nil {
+		all = append(append([]SidekickNotification{}, config.Notifications...), appConfig.Notifications...)
+	}
+	for _, notification := range all {
+		notification.URL = os.ExpandEnv(notification.URL)
+		if notification.URL == "" || seen[notification.URL] {
+			continue
+		}
+		seen[notification.URL] = true
+		notifications = append(notifications, notification)
+	}
+	return notifications
+}
+
+// Notify posts event to every notification. A webhook that fails is only a warning, it never fails the deploy.
+func Notify(notifications []SidekickNotification, event DeployEvent) {
+	client := http.Client{Timeout: notifyTimeout}
+	for _, notification := range notifications {
+		if err := postNotification(client, notification, event); err != nil {
+			render.GetLogger(log.Options{Prefix: "Notify"}).Warnf("Could not send the deploy notification: %s", err)
+		}
+	}
+}
+
+func postNotification(client http.Client, notification SidekickNotification, event DeployEvent) error {
+	body, err := NotificationPayload(notification, event)
+	if err != nil {
+		return err
+	}
+	response, err := client.Post(notification.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// the URL holds the secret of the webhook, only its host goes in the warning
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return urlErr.Err
+		}
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("%s answered %s", response.Request.URL.Host, response.Status)
+	}
+	return nil
+}
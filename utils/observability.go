@@ -0,0 +1,427 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// LogsComposeProject runs Loki and Promtail, apart from Traefik so enabling it never touches the proxy
+	LogsComposeProject = "sidekick-logs"
+	LokiImage          = "grafana/loki:3.1.1"
+	PromtailImage      = "grafana/promtail:3.1.1"
+	DefaultLogsUser    = "sidekick"
+	// DefaultLogRetention is how long Loki keeps logs, it drops them a day at a time so retention is whole days
+	DefaultLogRetention = 7 * 24 * time.Hour
+	// AppLabel and PreviewLabel go on every container sidekick generates, Promtail only ships the logs of containers with AppLabel
+	AppLabel     = "sidekick.app"
+	PreviewLabel = "sidekick.preview"
+	logsNetwork  = "logs"
+	lokiRouter   = "sidekick-loki"
+)
+
+const (
+	// MetricsComposeProject runs Prometheus, its exporters and Grafana
+	MetricsComposeProject = "sidekick-metrics"
+	PrometheusImage       = "prom/prometheus:v2.54.1"
+	CAdvisorImage         = "gcr.io/cadvisor/cadvisor:v0.49.1"
+	NodeExporterImage     = "prom/node-exporter:v1.8.2"
+	GrafanaImage          = "grafana/grafana:11.2.0"
+	DefaultGrafanaUser    = "admin"
+	// DefaultMetricsRetention and DefaultScrapeInterval keep Prometheus small enough for a VPS with 1 GB of memory
+	DefaultMetricsRetention = 15 * 24 * time.Hour
+	DefaultScrapeInterval   = 30 * time.Second
+	// DefaultMetricsMaxSize caps the disk Prometheus takes, the oldest data goes first when retention hasn't dropped it yet
+	DefaultMetricsMaxSize = "1GB"
+	// TraefikMetricsAddress is the metrics entrypoint of Traefik, it is not published so only the sidekick network reaches it
+	TraefikMetricsAddress = "traefik-service:8082"
+	metricsNetwork        = "metrics"
+	grafanaRouter         = "sidekick-grafana"
+)
+
+// RemoteLogsDir holds the compose file and the configs of the logs stack, next to the traefik folder
+func RemoteLogsDir() string {
+	return path.Join("observability", "logs")
+}
+
+// FormatLogRetention is retention the way Loki and Prometheus read it, in hours
+func FormatLogRetention(retention time.Duration) string {
+	return fmt.Sprintf("%dh", int64(retention.Hours()))
+}
+
+// ValidateLogRetention checks Loki can keep logs for retention, it has to be whole days
+func ValidateLogRetention(retention time.Duration) error {
+	if retention < 24*time.Hour || retention%(24*time.Hour) != 0 {
+		return fmt.Errorf("log retention %s is not a whole number of days, like 168h", retention)
+	}
+	return nil
+}
+
+// GetLokiConfig keeps the logs on the disk of the server and deletes them once they are older than retention
+func GetLokiConfig(retention time.Duration) string {
+	return fmt.Sprintf(`auth_enabled: false
+server:
+  http_listen_port: 3100
+common:
+  path_prefix: /loki
+  storage:
+    filesystem:
+      chunks_directory: /loki/chunks
+      rules_directory: /loki/rules
+  replication_factor: 1
+  ring:
+    kvstore:
+      store: inmemory
+schema_config:
+  configs:
+    - from: 2024-01-01
+      store: tsdb
+      object_store: filesystem
+      schema: v13
+      index:
+        prefix: index_
+        period: 24h
+limits_config:
+  retention_period: %s
+compactor:
+  working_directory: /loki/compactor
+  retention_enabled: true
+  delete_request_store: filesystem
+`, FormatLogRetention(retention))
+}
+
+// GetPromtailConfig ships the logs of the containers with AppLabel to Loki, labelled with the app, preview, service and container they come from.
+// Swarm containers have no compose service label, their swarm service name stands in for it.
+func GetPromtailConfig() string {
+	return fmt.Sprintf(`server:
+  http_listen_port: 9080
+  grpc_listen_port: 0
+positions:
+  filename: /positions/positions.yaml
+clients:
+  - url: http://loki:3100/loki/api/v1/push
+scrape_configs:
+  - job_name: sidekick
+    docker_sd_configs:
+      - host: unix:///var/run/docker.sock
+        refresh_interval: 10s
+        filters:
+          - name: label
+            values: [%q]
+    relabel_configs:
+      - source_labels: [%q]
+        target_label: app
+      - source_labels: [%q]
+        target_label: preview
+      - source_labels: ['__meta_docker_container_label_com_docker_swarm_service_name']
+        regex: '(.+)'
+        target_label: service
+      - source_labels: ['__meta_docker_container_label_com_docker_compose_service']
+        regex: '(.+)'
+        target_label: service
+      - source_labels: ['__meta_docker_container_name']
+        regex: '/(.*)'
+        target_label: container
+`, AppLabel, promtailLabel(AppLabel), promtailLabel(PreviewLabel))
+}
+
+// promtailLabel is how docker service discovery names a container label
+func promtailLabel(label string) string {
+	return "__meta_docker_container_label_" + strings.NewReplacer(".", "_", "-", "_").Replace(label)
+}
+
+// GetBasicAuthUsers is a Traefik basicauth users entry, the bcrypt hash has its $ doubled so compose leaves them alone
+func GetBasicAuthUsers(user string, password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return strings.ReplaceAll(fmt.Sprintf("%s:%s", user, hash), "$", "$$"), nil
+}
+
+// GetLogsComposeFile runs Loki behind Traefik on the domain of stack with basic auth, Promtail reaches it on a network of their own.
+// Promtail reads the logs through the docker socket, so they only ship for the json-file, local and journald drivers.
+func GetLogsComposeFile(stack SidekickLogsStack, users string, network string) DockerComposeFile {
+	labels := GetTraefikLabels(SidekickAppConfig{Network: network}, lokiRouter, stack.Domain, "3100")
+	labels = append(labels,
+		fmt.Sprintf("traefik.http.routers.%s.middlewares=%s-auth", lokiRouter, lokiRouter),
+		fmt.Sprintf("traefik.http.middlewares.%s-auth.basicauth.users=%s", lokiRouter, users),
+	)
+	logging := GetServiceLogging(SidekickLoggingConfig{})
+	return DockerComposeFile{
+		Services: map[string]DockerService{
+			"loki": {
+				Image:    LokiImage,
+				Command:  "-config.file=/etc/loki/config.yaml",
+				Restart:  "unless-stopped",
+				Volumes:  []string{"./loki.yaml:/etc/loki/config.yaml:ro", "loki-data:/loki"},
+				Labels:   labels,
+				Networks: []string{network, logsNetwork},
+				Logging:  logging,
+			},
+			"promtail": {
+				Image:    PromtailImage,
+				Command:  "-config.file=/etc/promtail/config.yaml",
+				Restart:  "unless-stopped",
+				Volumes:  []string{"./promtail.yaml:/etc/promtail/config.yaml:ro", "/var/run/docker.sock:/var/run/docker.sock:ro", "promtail-positions:/positions"},
+				Networks: []string{logsNetwork},
+				Logging:  logging,
+			},
+		},
+		Networks: map[string]DockerNetwork{
+			network:     {External: true},
+			logsNetwork: {},
+		},
+		Volumes: map[string]DockerVolume{
+			"loki-data":          {},
+			"promtail-positions": {},
+		},
+	}
+}
+
+// GetLogsUpCommand brings the logs stack up from what was written to RemoteLogsDir
+func GetLogsUpCommand() string {
+	return fmt.Sprintf("cd %s && docker compose -p %s up -d", RemoteLogsDir(), LogsComposeProject)
+}
+
+// GetLogsDownCommand removes the logs stack, the logs themselves stay in their volume unless purge is set
+func GetLogsDownCommand(purge bool) string {
+	down := fmt.Sprintf("docker compose -p %s down", LogsComposeProject)
+	if purge {
+		down += " -v"
+	}
+	return fmt.Sprintf("cd %s && %s && cd && rm -rf %s", RemoteLogsDir(), down, RemoteLogsDir())
+}
+
+// RemoteMetricsDir holds the compose file and the configs of the metrics stack
+func RemoteMetricsDir() string {
+	return path.Join("observability", "metrics")
+}
+
+// GetPrometheusConfig scrapes Traefik, the containers, the host and Prometheus itself every interval
+func GetPrometheusConfig(interval time.Duration) string {
+	return fmt.Sprintf(`global:
+  scrape_interval: %[1]s
+  evaluation_interval: %[1]s
+scrape_configs:
+  - job_name: traefik
+    static_configs:
+      - targets: [%[2]q]
+  - job_name: cadvisor
+    static_configs:
+      - targets: ['cadvisor:8080']
+  - job_name: node
+    static_configs:
+      - targets: ['node-exporter:9100']
+  - job_name: prometheus
+    static_configs:
+      - targets: ['localhost:9090']
+`, interval, TraefikMetricsAddress)
+}
+
+// GetGrafanaDatasources points Grafana at the Prometheus of the stack
+func GetGrafanaDatasources() string {
+	return `apiVersion: 1
+datasources:
+  - name: Prometheus
+    type: prometheus
+    access: proxy
+    url: http://prometheus:9090
+    isDefault: true
+`
+}
+
+// GetMetricsComposeFile runs Prometheus with cAdvisor and node-exporter on a network of their own, Prometheus joins the network of Traefik to reach it.
+// Nothing is published on the host, only Grafana answers, behind Traefik on the domain of stack.
+func GetMetricsComposeFile(stack SidekickMetricsStack, retention time.Duration, interval time.Duration, network string) DockerComposeFile {
+	logging := GetServiceLogging(SidekickLoggingConfig{})
+	composeFile := DockerComposeFile{
+		Services: map[string]DockerService{
+			"prometheus": {
+				Image:    PrometheusImage,
+				Command:  fmt.Sprintf("--config.file=/etc/prometheus/prometheus.yml --storage.tsdb.path=/prometheus --storage.tsdb.retention.time=%s --storage.tsdb.retention.size=%s", FormatLogRetention(retention), DefaultMetricsMaxSize),
+				Restart:  "unless-stopped",
+				Volumes:  []string{"./prometheus.yml:/etc/prometheus/prometheus.yml:ro", "prometheus-data:/prometheus"},
+				Networks: []string{network, metricsNetwork},
+				Logging:  logging,
+			},
+			"cadvisor": {
+				Image:    CAdvisorImage,
+				Command:  fmt.Sprintf("--docker_only=true --housekeeping_interval=%s --store_container_labels=false --whitelisted_container_labels=%s,%s,com.docker.compose.service", interval, AppLabel, PreviewLabel),
+				Restart:  "unless-stopped",
+				Volumes:  []string{"/:/rootfs:ro", "/var/run:/var/run:ro", "/sys:/sys:ro", "/var/lib/docker/:/var/lib/docker:ro"},
+				Networks: []string{metricsNetwork},
+				Logging:  logging,
+			},
+			"node-exporter": {
+				Image:    NodeExporterImage,
+				Command:  "--path.rootfs=/host",
+				Restart:  "unless-stopped",
+				Volumes:  []string{"/:/host:ro,rslave"},
+				Networks: []string{metricsNetwork},
+				Logging:  logging,
+				Extra:    map[string]any{"pid": "host"},
+			},
+		},
+		Networks: map[string]DockerNetwork{
+			network:        {External: true},
+			metricsNetwork: {},
+		},
+		Volumes: map[string]DockerVolume{
+			"prometheus-data": {},
+		},
+	}
+	if stack.Domain == "" {
+		return composeFile
+	}
+	labels := GetTraefikLabels(SidekickAppConfig{Network: network}, grafanaRouter, stack.Domain, "3000")
+	composeFile.Services["grafana"] = DockerService{
+		Image:   GrafanaImage,
+		Restart: "unless-stopped",
+		Environment: []string{
+			"GF_SECURITY_ADMIN_USER=" + stack.User,
+			"GF_SECURITY_ADMIN_PASSWORD=" + stack.Password,
+			"GF_USERS_ALLOW_SIGN_UP=false",
+			"GF_SERVER_ROOT_URL=https://" + stack.Domain,
+		},
+		Volumes:  []string{"./grafana-datasources.yaml:/etc/grafana/provisioning/datasources/sidekick.yaml:ro", "grafana-data:/var/lib/grafana"},
+		Labels:   labels,
+		Networks: []string{network, metricsNetwork},
+		Logging:  logging,
+	}
+	composeFile.Volumes["grafana-data"] = DockerVolume{}
+	return composeFile
+}
+
+// GetMetricsUpCommand brings the metrics stack up from what was written to RemoteMetricsDir, Grafana goes when it is no longer in the compose file
+func GetMetricsUpCommand() string {
+	return fmt.Sprintf("cd %s && docker compose -p %s up -d --remove-orphans", RemoteMetricsDir(), MetricsComposeProject)
+}
+
+// GetMetricsDownCommand removes the metrics stack, its data stays in its volumes unless purge is set
+func GetMetricsDownCommand(purge bool) string {
+	down := fmt.Sprintf("docker compose -p %s down", MetricsComposeProject)
+	if purge {
+		down += " -v"
+	}
+	return fmt.Sprintf("cd %s && %s && cd && rm -rf %s", RemoteMetricsDir(), down, RemoteMetricsDir())
+}
+
+// applyLogLabels marks every service of composeFile with the app and, for a preview, its hash so Promtail ships their logs
+func applyLogLabels(composeFile *DockerComposeFile, appConfig SidekickAppConfig, serviceName string) {
+	labels := []string{fmt.Sprintf("%s=%s", AppLabel, appConfig.Name)}
+	if serviceName != appConfig.Name {
+		labels = append(labels, fmt.Sprintf("%s=%s", PreviewLabel, strings.TrimPrefix(serviceName, appConfig.Name+"-")))
+	}
+	for name, service := range composeFile.Services {
+		service.Labels = MergeLabels(labels, service.Labels)
+		composeFile.Services[name] = service
+	}
+}
+
+// LokiSelector picks the logs of the app in LogQL, production when preview is empty.
+// Production containers have no preview label, Loki matches a missing label against "".
+func LokiSelector(appName string, preview string, service string) string {
+	matchers := []string{"app=" + strconv.Quote(appName), "preview=" + strconv.Quote(preview)}
+	if service != "" {
+		matchers = append(matchers, "service="+strconv.Quote(service))
+	}
+	return "{" + strings.Join(matchers, ", ") + "}"
+}
+
+// LokiEntry is one log line from Loki with the labels of its stream
+type LokiEntry struct {
+	Time   time.Time
+	Labels map[string]string
+	Line   string
+}
+
+type lokiQueryResponse struct {
+	Status string `json:"status"`
+	Data   struct {
+		Result []struct {
+			Stream map[string]string `json:"stream"`
+			Values [][2]string       `json:"values"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+// ParseLokiResponse reads a query_range answer into its entries, oldest first
+func ParseLokiResponse(body []byte) ([]LokiEntry, error) {
+	var response lokiQueryResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("unable to read the answer of Loki: %w", err)
+	}
+	if response.Status != "success" {
+		return nil, fmt.Errorf("loki answered with status %q", response.Status)
+	}
+	entries := []LokiEntry{}
+	for _, stream := range response.Data.Result {
+		for _, value := range stream.Values {
+			nanos, err := strconv.ParseInt(value[0], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("loki sent a timestamp that isn't one: %q", value[0])
+			}
+			entries = append(entries, LokiEntry{Time: time.Unix(0, nanos), Labels: stream.Stream, Line: value[1]})
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+	return entries, nil
+}
+
+// QueryLoki gets the last limit lines of query since then from the Loki of stack
+func QueryLoki(stack SidekickLogsStack, query string, since time.Time, limit int) ([]LokiEntry, error) {
+	if stack.Domain == "" {
+		return nil, errors.New("the logs stack is not enabled on this server")
+	}
+	params := url.Values{}
+	params.Set("query", query)
+	params.Set("start", strconv.FormatInt(since.UnixNano(), 10))
+	params.Set("end", strconv.FormatInt(time.Now().UnixNano(), 10))
+	params.Set("limit", strconv.Itoa(limit))
+	params.Set("direction", "backward")
+	request, err := http.NewRequestWithContext(OperationContext(), http.MethodGet, fmt.Sprintf("https://%s/loki/api/v1/query_range?%s", stack.Domain, params.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+	request.SetBasicAuth(stack.User, stack.Password)
+	client := http.Client{Timeout: 30 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("loki answered %s: %s", response.Status, strings.TrimSpace(string(body)))
+	}
+	return ParseLokiResponse(body)
+}
@@ -0,0 +1,147 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ComposeOverrideFileName sits next to sidekick.yml, it is merged into every compose file sidekick generates for the app
+const ComposeOverrideFileName = "sidekick.override.yaml"
+
+func ComposeOverrideFile() string {
+	return filepath.Join(filepath.Dir(AppConfigFile), ComposeOverrideFileName)
+}
+
+// LoadComposeOverride reads sidekick.override.yaml, nil when there is none
+func LoadComposeOverride() (*DockerComposeFile, error) {
+	content, err := os.ReadFile(ComposeOverrideFile())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %w", ComposeOverrideFileName, err)
+	}
+	override := DockerComposeFile{}
+	if err := yaml.Unmarshal(content, &override); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", ComposeOverrideFileName, err)
+	}
+	return &override, nil
+}
+
+// MergeComposeFile merges override into base, the override wins wherever both set something.
+// The service of the override named appService goes onto serviceName, which is the app or one of its previews.
+// Labels and environment are merged by key, other lists keep the entries of both.
+func MergeComposeFile(base DockerComposeFile, override DockerComposeFile, appService string, serviceName string) DockerComposeFile {
+	for name, service := range override.Services {
+		if name == appService {
+			name = serviceName
+		}
+		if existing, ok := base.Services[name]; ok {
+			service = mergeService(existing, service)
+		}
+		if base.Services == nil {
+			base.Services = map[string]DockerService{}
+		}
+		base.Services[name] = service
+	}
+	for name, network := range override.Networks {
+		if base.Networks == nil {
+			base.Networks = map[string]DockerNetwork{}
+		}
+		base.Networks[name] = network
+	}
+	for name, volume := range override.Volumes {
+		if base.Volumes == nil {
+			base.Volumes = map[string]DockerVolume{}
+		}
+		base.Volumes[name] = volume
+	}
+	base.Extra = mergeExtra(base.Extra, override.Extra)
+	return base
+}
+
+func mergeService(base DockerService, override DockerService) DockerService {
+	if override.Image != "" {
+		base.Image = override.Image
+	}
+	if override.Command != "" {
+		base.Command = override.Command
+	}
+	if override.Restart != "" {
+		base.Restart = override.Restart
+	}
+	base.Ports = appendMissing(base.Ports, override.Ports)
+	base.Volumes = appendMissing(base.Volumes, override.Volumes)
+	base.Networks = appendMissing(base.Networks, override.Networks)
+	base.Labels = MergeLabels(base.Labels, override.Labels)
+	base.Environment = MergeLabels(base.Environment, override.Environment)
+	for name, dependsOn := range override.DependsOn {
+		if base.DependsOn == nil {
+			base.DependsOn = map[string]DependsOn{}
+		}
+		base.DependsOn[name] = dependsOn
+	}
+	if len(override.HealthCheck.Test) > 0 {
+		base.HealthCheck = override.HealthCheck
+	}
+	if len(override.EntryPoint) > 0 {
+		base.EntryPoint = override.EntryPoint
+	}
+	if override.Deploy != nil {
+		base.Deploy = override.Deploy
+	}
+	if override.Logging != nil {
+		base.Logging = override.Logging
+	}
+	base.Extra = mergeExtra(base.Extra, override.Extra)
+	return base
+}
+
+func appendMissing(base []string, extra []string) []string {
+	for _, entry := range extra {
+		if !slices.Contains(base, entry) {
+			base = append(base, entry)
+		}
+	}
+	return base
+}
+
+// mergeExtra merges nested maps key by key, anything else the override sets replaces what was there
+func mergeExtra(base map[string]any, override map[string]any) map[string]any {
+	if len(override) == 0 {
+		return base
+	}
+	merged := map[string]any{}
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range override {
+		baseMap, baseIsMap := merged[key].(map[string]any)
+		overrideMap, overrideIsMap := value.(map[string]any)
+		if baseIsMap && overrideIsMap {
+			merged[key] = mergeExtra(baseMap, overrideMap)
+			continue
+		}
+		merged[key] = value
+	}
+	return merged
+}
@@ -0,0 +1,113 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// the image is never exactly its reported size once saved or loaded, this much is kept free on top of it
+const preflightMarginPercent = 20
+
+// RequiredSpace is the free space an image of this size needs to be saved or loaded
+func RequiredSpace(imageSize int64) int64 {
+	return imageSize + imageSize*preflightMarginPercent/100
+}
+
+// LocalImageSize is the size docker reports for an image on this machine
+func LocalImageSize(image string) (int64, error) {
+	output, err := exec.Command("docker", "image", "inspect", "-f", "{{.Size}}", image).Output()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the size of %s: %w", image, err)
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(output)), 10, 64)
+}
+
+// RemoteImageSize is the size of an image on the server, 0 when it is not there like on a first deploy
+func RemoteImageSize(remote RemoteExecutor, image string) (int64, error) {
+	if image == "" {
+		return 0, nil
+	}
+	output, err := remote.Output(fmt.Sprintf("docker image inspect -f '{{.Size}}' %s 2>/dev/null || echo 0", image))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the size of %s: %w", image, err)
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(output), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unable to read the size of %s", image)
+	}
+	return size, nil
+}
+
+// CheckLocalDiskSpace makes sure the tar of an image fits in dir before docker save writes it
+func CheckLocalDiskSpace(dir string, imageSize int64) error {
+	free, err := localFreeSpace(dir)
+	if err != nil || free < 0 {
+		// not knowing is no reason to stop the deploy, docker save fails on its own
+		return nil
+	}
+	if need := RequiredSpace(imageSize); free < need {
+		return fmt.Errorf("saving the image needs about %s free in %s, only %s is left", FormatBytes(need), dir, FormatBytes(free))
+	}
+	return nil
+}
+
+// CheckRemoteDiskSpace makes sure the server has room for the image, the tar in the app folder
+// when it is copied over and the layers docker unpacks from it
+func CheckRemoteDiskSpace(remote RemoteExecutor, appName string, imageSize int64, shipsTar bool) error {
+	if imageSize <= 0 {
+		return nil
+	}
+	output, err := remote.Output(fmt.Sprintf(`df --output=source,avail -B1 ./%s "$(docker info -f '{{.DockerRootDir}}' 2>/dev/null || echo /)" | tail -n+2`, appName))
+	if err != nil {
+		return fmt.Errorf("failed to read free disk space on your VPS: %w", err)
+	}
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) != 2 {
+		return fmt.Errorf("unable to read free disk space on your VPS")
+	}
+	disks := map[string]int64{}
+	needs := map[string]int64{}
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("unable to read free disk space on your VPS")
+		}
+		free, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("unable to read free disk space on your VPS")
+		}
+		disks[fields[0]] = free
+		// the first line is the app folder, it only holds the tar when one is copied over
+		if i == 1 || shipsTar {
+			needs[fields[0]] += RequiredSpace(imageSize)
+		}
+	}
+	for _, line := range lines {
+		disk := strings.Fields(line)[0]
+		if need := needs[disk]; disks[disk] < need {
+			return fmt.Errorf("the image needs about %s free on %s of your VPS, only %s is left", FormatBytes(need), disk, FormatBytes(disks[disk]))
+		}
+	}
+	return nil
+}
+
+const (
+	PreflightRemoteHint = "Run sidekick images prune to free up space on your VPS, or pass --skip-preflight to go ahead anyway"
+	PreflightLocalHint  = "Free up space on this machine, docker system prune removes unused images and build cache"
+)
@@ -0,0 +1,104 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"fmt"
+
+	"github.com/charmbracelet/huh"
+	"github.com/mightymoud/sidekick/render"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// AssumeYesEnv answers every confirmation with yes like --yes, for automation that can't pass flags
+const AssumeYesEnv = "SIDEKICK_ASSUME_YES"
+
+// RequireInteractive fails when a prompt can't be shown, naming the flag that answers it instead
+func RequireInteractive(flag string, what string) error {
+	if render.IsInteractive() {
+		return nil
+	}
+	return NewStageError("Input", ExitCodeConfig, fmt.Sprintf("Pass --%s", flag), fmt.Errorf("%s is needed and sidekick can't ask for it in CI mode", what))
+}
+
+// AssumeYes is true when --yes is passed or SIDEKICK_ASSUME_YES is set to a true value
+func AssumeYes(cmd *cobra.Command) bool {
+	if yes, _ := cmd.Flags().GetBool("yes"); yes {
+		return true
+	}
+	return viper.GetBool("assume_yes")
+}
+
+// Confirm asks before a command changes what runs on a server, summary is one line like "deploy myapp abc1234 → myapp.com".
+// --yes skips it and in CI mode it fails without it. ok is false when the user said no, nothing should happen then.
+func Confirm(cmd *cobra.Command, summary string) (ok bool, err error) {
+	if AssumeYes(cmd) {
+		return true, nil
+	}
+	if !render.IsInteractive() {
+		return false, NewStageError("Input", ExitCodeConfig, fmt.Sprintf("Pass --yes or set %s=1 to go ahead without a prompt", AssumeYesEnv),
+			fmt.Errorf("%s needs a confirmation and sidekick can't ask for it in CI mode", summary))
+	}
+	err = huh.NewConfirm().
+		Title(summary + "?").
+		Affirmative("Yes!").
+		Negative("No.").
+		Value(&ok).
+		Run()
+	if err != nil {
+		return false, NewStageError("Input", ExitCodeError, "", err)
+	}
+	return ok, nil
+}
+
+// AskText takes the answer from the flag when it is set and asks otherwise
+func AskText(cmd *cobra.Command, flag string, question string, defaultAnswer string, placeholder string) (string, error) {
+	if cmd.Flags().Changed(flag) {
+		return cmd.Flags().GetString(flag)
+	}
+	if err := RequireInteractive(flag, "a value for --"+flag); err != nil {
+		return "", err
+	}
+	return render.GenerateTextQuestion(question, defaultAnswer, placeholder)
+}
+
+// ConfirmNormalized offers normalized in place of an invalid answer, --yes takes it without asking
+func ConfirmNormalized(cmd *cobra.Command, flag string, normalized string, invalid error) (string, error) {
+	hint := fmt.Sprintf("Pass --%s %s", flag, normalized)
+	if normalized == "" {
+		return "", NewStageError("Input", ExitCodeConfig, "", invalid)
+	}
+	if AssumeYes(cmd) {
+		return normalized, nil
+	}
+	if !render.IsInteractive() {
+		return "", NewStageError("Input", ExitCodeConfig, hint+", or add --yes to use it", invalid)
+	}
+	accept := true
+	err := huh.NewConfirm().
+		Title(fmt.Sprintf("%s. Use %s instead?", invalid, normalized)).
+		Affirmative("Yes").
+		Negative("No").
+		Value(&accept).
+		Run()
+	if err != nil {
+		return "", NewStageError("Input", ExitCodeError, "", err)
+	}
+	if !accept {
+		return "", NewStageError("Input", ExitCodeConfig, hint, invalid)
+	}
+	return normalized, nil
+}
@@ -0,0 +1,244 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	DefaultSSHRetries   = 3
+	keepAliveInterval   = 15 * time.Second
+	deployStateChecks   = 12
+	deployStateInterval = 5 * time.Second
+)
+
+// ConnectionRetryPolicy covers dialing the server and dialing it again after the connection dropped
+var ConnectionRetryPolicy = RetryPolicy{
+	Attempts:  DefaultSSHRetries + 1,
+	BaseDelay: 2 * time.Second,
+	MaxDelay:  20 * time.Second,
+}
+
+func SetSSHRetries(retries int) {
+	ConnectionRetryPolicy.Attempts = max(retries, 0) + 1
+}
+
+// ConnectionDroppedError is returned for a command that is not safe to run twice when the connection dropped while it ran.
+// The connection is back by then, the caller has to check what state the server is in before trying again.
+type ConnectionDroppedError struct {
+	Cmd string
+	Err error
+}
+
+func (e *ConnectionDroppedError) Error() string {
+	cmd := e.Cmd
+	if len(cmd) > 80 {
+		cmd = cmd[:80] + "..."
+	}
+	return fmt.Sprintf("the connection dropped while running %q, it may or may not have finished: %s", cmd, e.Err)
+}
+
+func (e *ConnectionDroppedError) Unwrap() error {
+	return e.Err
+}
+
+// IsConnectionError tells a connection that went away apart from a command that failed
+func IsConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return false
+	}
+	var missingErr *ssh.ExitMissingError
+	var netErr net.Error
+	if errors.As(err, &missingErr) || errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		return true
+	}
+	message := err.Error()
+	for _, dropped := range []string{"connection reset", "broken pipe", "connection refused", "no route to host", "i/o timeout", "use of closed network connection"} {
+		if strings.Contains(message, dropped) {
+			return true
+		}
+	}
+	return false
+}
+
+// idempotentCommands leave the server in the same state when they run twice, compose up without scaling converges too
+var idempotentCommands = regexp.MustCompile(`^(cd |export |mkdir -p |rm |test |cat |ls |command -v |echo '[A-Za-z0-9+/=]*' \| base64 -d > |docker (load|pull|tag|ps|inspect|image inspect|image ls|network inspect) |docker ps -aq .* \| xargs -r docker rm -f$|docker compose -p [a-z0-9-]+ up -d$)`)
+
+// IsIdempotentCommand is true when every step of an && chain is safe to run again
+func IsIdempotentCommand(cmd string) bool {
+	// removing containers converges too, so that pipe is allowed like the base64 one
+	if strings.ContainsAny(strings.NewReplacer("| base64 -d >", "", "| xargs -r docker rm -f", "").Replace(cmd), "\n;|") {
+		return false
+	}
+	for _, step := range strings.Split(cmd, "&&") {
+		if !idempotentCommands.MatchString(strings.TrimSpace(step)) {
+			return false
+		}
+	}
+	return true
+}
+
+type dialTarget struct {
+	server string
+	user   string
+}
+
+// connections lets commands keep using the client they were given, after a reconnect it maps to the new one
+var connections = struct {
+	sync.Mutex
+	targets    map[*ssh.Client]dialTarget
+	replaced   map[*ssh.Client]*ssh.Client
+	reconnects int
+}{targets: map[*ssh.Client]dialTarget{}, replaced: map[*ssh.Client]*ssh.Client{}}
+
+// reconnectMu makes commands that see the same drop reconnect once
+var reconnectMu sync.Mutex
+
+func trackConnection(client *ssh.Client, server string, user string) {
+	connections.Lock()
+	defer connections.Unlock()
+	connections.targets[client] = dialTarget{server: server, user: user}
+}
+
+func liveClient(client *ssh.Client) *ssh.Client {
+	connections.Lock()
+	defer connections.Unlock()
+	for {
+		next, ok := connections.replaced[client]
+		if !ok {
+			return client
+		}
+		client = next
+	}
+}
+
+// reconnect dials the server of client again unless someone already did since failed was handed out
+func reconnect(client *ssh.Client, failed *ssh.Client) error {
+	reconnectMu.Lock()
+	defer reconnectMu.Unlock()
+	if liveClient(client) != failed {
+		return nil
+	}
+	connections.Lock()
+	target, ok := connections.targets[failed]
+	connections.Unlock()
+	if !ok {
+		return errors.New("the connection dropped and sidekick does not know how to dial it again")
+	}
+	failed.Close()
+	fresh, err := Login(target.server, target.user)
+	if err != nil {
+		return fmt.Errorf("the connection dropped and could not be opened again: %w", err)
+	}
+	connections.Lock()
+	connections.replaced[failed] = fresh
+	connections.reconnects++
+	connections.Unlock()
+	return nil
+}
+
+// runWithReconnect runs a command on the live connection of client.
+// When the connection drops it is opened again and idempotent commands run again, others fail with a ConnectionDroppedError.
+func runWithReconnect(client *ssh.Client, cmd string, run func(*ssh.Client) error) error {
+	_, err := ConnectionRetryPolicy.Do(func() error {
+		conn := liveClient(client)
+		err := run(conn)
+		// a deadline closes the connection on purpose
+		if !IsConnectionError(err) || OperationContext().Err() != nil {
+			return StopRetrying(err)
+		}
+		TraceOutput("stderr", fmt.Sprintf("connection dropped: %s", err))
+		if reconnectErr := reconnect(client, conn); reconnectErr != nil {
+			return StopRetrying(reconnectErr)
+		}
+		if !IsIdempotentCommand(cmd) {
+			return StopRetrying(&ConnectionDroppedError{Cmd: cmd, Err: err})
+		}
+		return err
+	}, nil)
+	return err
+}
+
+// keepAlive closes a connection that stopped answering, so commands on it fail instead of hanging forever
+func keepAlive(client *ssh.Client) {
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		answered := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			answered <- err
+		}()
+		select {
+		case err := <-answered:
+			if err != nil {
+				return
+			}
+		case <-time.After(keepAliveInterval):
+			client.Close()
+			return
+		}
+	}
+}
+
+// RecordReconnects adds the reconnects of this run to the report
+func (r *RetryReport) RecordReconnects() {
+	connections.Lock()
+	reconnects := connections.reconnects
+	connections.Unlock()
+	r.Record("ssh connection", reconnects+1)
+}
+
+// WaitForDeployedImage finds out how a deploy cut off by a dropped connection ended.
+// The deploy script may still be swapping containers, so it waits for the same single container of service to show up twice in a row.
+func WaitForDeployedImage(remote RemoteExecutor, service string, image string) error {
+	script := fmt.Sprintf(`docker image inspect -f '{{.Id}}' %[2]s && for c in $(docker ps -q -f label=com.docker.compose.service=%[1]s); do docker inspect -f '{{.Image}}' $c; done`, service, image)
+	previous := ""
+	running := []string{}
+	for attempt := 1; attempt <= deployStateChecks; attempt++ {
+		if output, err := remote.Output(script); err == nil {
+			lines := outputLines(output)
+			if len(lines) > 0 {
+				want := lines[0]
+				running = lines[1:]
+				if len(running) == 1 && running[0] == previous {
+					if running[0] == want {
+						return nil
+					}
+					return errors.New("the deploy did not finish and the previous version is still live, run deploy again")
+				}
+				if len(running) == 1 {
+					previous = running[0]
+				}
+			}
+		}
+		time.Sleep(deployStateInterval)
+	}
+	return fmt.Errorf("the deploy was cut off and %d containers of %s are running, check them with docker ps on your VPS", len(running), service)
+}
@@ -0,0 +1,160 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/distribution/reference"
+	"github.com/joho/godotenv"
+	"github.com/mightymoud/sidekick/render"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	DockerHubRegistry = "docker.io"
+	GHCRRegistry      = "ghcr.io"
+	// RegistryPasswordVar is read when registry.password doesn't name another variable
+	RegistryPasswordVar = "SIDEKICK_REGISTRY_PASSWORD"
+)
+
+var envVarNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func HasRegistry(appConfig SidekickAppConfig) bool {
+	return appConfig.Registry.Url != ""
+}
+
+// ValidateRegistryConfig refuses anything in registry.password that is not a variable name so a token never lands in sidekick.yml
+func ValidateRegistryConfig(registry SidekickRegistryConfig) error {
+	if registry.Username == "" {
+		return fmt.Errorf("registry.username is required to log in to %s", registry.Url)
+	}
+	if registry.Password != "" && !envVarNamePattern.MatchString(registry.Password) {
+		return fmt.Errorf("registry.password must name the env var that holds the password, like GHCR_TOKEN, not the password itself")
+	}
+	return nil
+}
+
+// registryPasswordVars are tried in order, GITHUB_TOKEN is what an Actions runner has for GHCR
+func registryPasswordVars(registry SidekickRegistryConfig) []string {
+	if registry.Password != "" {
+		return []string{registry.Password}
+	}
+	if registry.Url == GHCRRegistry {
+		return []string{RegistryPasswordVar, "GITHUB_TOKEN"}
+	}
+	return []string{RegistryPasswordVar}
+}
+
+// ResolveRegistryPassword reads the password, or token, from the environment first and then from the app's env file
+func ResolveRegistryPassword(appConfig SidekickAppConfig) (string, error) {
+	names := registryPasswordVars(appConfig.Registry)
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value, nil
+		}
+	}
+	if appConfig.Env.File != "" && FileExists(appConfig.Env.File) {
+		envMap, err := godotenv.Read(appConfig.Env.File)
+		if err != nil {
+			return "", fmt.Errorf("unable to read %s: %w", appConfig.Env.File, err)
+		}
+		for _, name := range names {
+			if value := envMap[name]; value != "" {
+				return value, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no password for %s - set %s in your environment or your env file", appConfig.Registry.Url, strings.Join(names, " or "))
+}
+
+// AppRepository is where the images of the app live, a bare app name when no registry is configured.
+// A username without a url means Docker Hub. Registries only take lowercase names.
+func AppRepository(appConfig SidekickAppConfig) string {
+	registry := appConfig.Registry
+	repository := appConfig.Name
+	if registry.Username != "" {
+		repository = fmt.Sprintf("%s/%s", registry.Username, repository)
+	}
+	if registry.Url != "" && registry.Url != DockerHubRegistry {
+		repository = fmt.Sprintf("%s/%s", strings.TrimSuffix(registry.Url, "/"), repository)
+	}
+	return strings.ToLower(repository)
+}
+
+// AppImage is the image reference of the app at tag, launch, deploy and preview all name their images with it
+func AppImage(appConfig SidekickAppConfig, tag string) (string, error) {
+	image := fmt.Sprintf("%s:%s", AppRepository(appConfig), tag)
+	if _, err := reference.ParseNormalizedNamed(image); err != nil {
+		return "", fmt.Errorf("%s is not a valid image reference, check the app name and the registry in sidekick.yml: %w", image, err)
+	}
+	return image, nil
+}
+
+func getDockerLoginCommand(registry SidekickRegistryConfig) string {
+	return fmt.Sprintf("docker login %s --username %s --password-stdin", registry.Url, registry.Username)
+}
+
+// DockerLogin logs the local docker in, the password goes through stdin so it is never in a command line or a trace
+func DockerLogin(registry SidekickRegistryConfig, password string) error {
+	loginCmd := OperationCommand("sh", "-c", getDockerLoginCommand(registry))
+	loginCmd.Stdin = strings.NewReader(password)
+	TraceExec(loginCmd)
+	if output, err := loginCmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("docker login to %s failed: %s", registry.Url, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// RemoteDockerLogin logs the docker on the server in, the same way as DockerLogin
+func RemoteDockerLogin(client *ssh.Client, registry SidekickRegistryConfig, password string) error {
+	cmd := RuntimeCommand(client, getDockerLoginCommand(registry))
+	TraceCommand(cmd)
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to create session: %w", err)
+	}
+	defer session.Close()
+	var output bytes.Buffer
+	session.Stdin = strings.NewReader(password)
+	session.Stdout, session.Stderr = &output, &output
+	if err := session.Run(cmd); err != nil {
+		return fmt.Errorf("docker login to %s failed on the server: %s", registry.Url, strings.TrimSpace(output.String()))
+	}
+	return nil
+}
+
+// PushImageWithTUIHook tags the local image as ref and pushes it
+func PushImageWithTUIHook(image string, ref string, p *tea.Program) error {
+	tagCmd := OperationCommand("docker", "tag", image, ref)
+	TraceExec(tagCmd)
+	if output, err := tagCmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to tag %s as %s: %s", image, ref, strings.TrimSpace(string(output)))
+	}
+	pushCmd := OperationCommand("docker", "push", ref)
+	TraceExec(pushCmd)
+	pushCmdOutPipe, _ := pushCmd.StdoutPipe()
+	pushCmd.Stderr = pushCmd.Stdout
+	go render.SendLogsToTUI(pushCmdOutPipe, p)
+	if err := pushCmd.Run(); err != nil {
+		return fmt.Errorf("failed to push %s: %w", ref, err)
+	}
+	return nil
+}
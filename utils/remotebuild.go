@@ -0,0 +1,94 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"golang.org/x/crypto/ssh"
+)
+
+// DockerignoreRsyncFilters turns a .dockerignore into rsync filters.
+// The last matching .dockerignore line wins while rsync stops at the first match, so the order is reversed.
+func DockerignoreRsyncFilters(dockerignore string) []string {
+	filters := []string{}
+	for _, line := range strings.Split(dockerignore, "\n") {
+		pattern := strings.TrimSpace(line)
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+		rule := "--exclude"
+		if strings.HasPrefix(pattern, "!") {
+			rule, pattern = "--include", strings.TrimPrefix(pattern, "!")
+		}
+		// .dockerignore patterns are relative to the context root
+		pattern = "/" + strings.TrimPrefix(filepath.Clean(pattern), "/")
+		filters = append([]string{fmt.Sprintf("%s=%s", rule, pattern)}, filters...)
+	}
+	return filters
+}
+
+// GetSyncBuildContextArgs are the rsync args that copy the build context into remoteDir on the server
+func GetSyncBuildContextArgs(server SidekickServer, buildContext string, remoteDir string) ([]string, error) {
+	args := []string{"-az", "--delete"}
+	dockerignore, err := os.ReadFile(filepath.Join(buildContext, ".dockerignore"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	args = append(args, DockerignoreRsyncFilters(string(dockerignore))...)
+	return append(args, strings.TrimSuffix(buildContext, "/")+"/", fmt.Sprintf("%s@%s:%s/", "sidekick", server.Address, remoteDir)), nil
+}
+
+// GetRemoteBuildCommand builds on the server for its own platform, build logs go to stdout so they stream in order
+func GetRemoteBuildCommand(tag string, server SidekickServer, cache BuildCache, remoteDir string) string {
+	return "docker " + strings.Join(GetDockerBuildArgs(tag, server.PlatformId, cache, remoteDir), " ") + " 2>&1"
+}
+
+// RemoteBuildWithTUIHook syncs the build context to a temp dir on the server and builds the image there.
+// The context is removed afterwards whether the build worked or not.
+func RemoteBuildWithTUIHook(sshClient *ssh.Client, server SidekickServer, tag string, cache BuildCache, buildContext string, p *tea.Program) error {
+	return remoteBuildWithTUIHook(sshClient, server, buildContext, p, func(remoteDir string) string {
+		return GetRemoteBuildCommand(tag, server, cache, remoteDir)
+	})
+}
+
+// remoteBuildWithTUIHook runs the build command buildCmd makes for the temp dir the context was synced to
+func remoteBuildWithTUIHook(sshClient *ssh.Client, server SidekickServer, buildContext string, p *tea.Program, buildCmd func(remoteDir string) string) error {
+	remoteDir, err := RunCommandOutput(sshClient, "mktemp -d /tmp/sidekick-build-XXXXXX")
+	if err != nil {
+		return fmt.Errorf("failed to create the build dir on the server: %w", err)
+	}
+	remoteDir = strings.TrimSpace(remoteDir)
+	defer RunCommandOutput(sshClient, fmt.Sprintf("rm -rf %s", remoteDir))
+
+	rsyncArgs, err := GetSyncBuildContextArgs(server, buildContext, remoteDir)
+	if err != nil {
+		return fmt.Errorf("failed to read .dockerignore: %w", err)
+	}
+	rsyncCmd := OperationCommand("rsync", rsyncArgs...)
+	TraceExec(rsyncCmd)
+	if output, err := rsyncCmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to send the build context to the server: %s", strings.TrimSpace(string(output)))
+	}
+
+	if err := RunCommandWithTUIHook(sshClient, buildCmd(remoteDir), p); err != nil {
+		return fmt.Errorf("failed to build Docker image on the server: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RetryPolicy is only meant for idempotent steps - running them twice must leave the server in the same state.
+// Things like compose up or writing history are never retried.
+type RetryPolicy struct {
+	Attempts  int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:  3,
+	BaseDelay: time.Second,
+	MaxDelay:  10 * time.Second,
+}
+
+// backoff doubles the delay each attempt up to MaxDelay, then picks a random point in the upper half of it
+func (r RetryPolicy) backoff(attempt int) time.Duration {
+	delay := r.BaseDelay << (attempt - 1)
+	if delay > r.MaxDelay || delay <= 0 {
+		delay = r.MaxDelay
+	}
+	half := delay / 2
+	if half <= 0 {
+		return delay
+	}
+	return half + rand.N(half)
+}
+
+// stopRetrying marks an error another attempt can't fix
+type stopRetrying struct {
+	err error
+}
+
+func (e *stopRetrying) Error() string {
+	return e.err.Error()
+}
+
+// StopRetrying makes Do return err right away, it is nil for a nil err
+func StopRetrying(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &stopRetrying{err: err}
+}
+
+// Do runs fn until it succeeds or the attempts run out. onRetry is called before every extra attempt.
+func (r RetryPolicy) Do(fn func() error, onRetry func(attempt int, attempts int, err error)) (int, error) {
+	attempts := max(r.Attempts, 1)
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err = fn(); err == nil {
+			return attempt, nil
+		}
+		var stop *stopRetrying
+		if errors.As(err, &stop) {
+			return attempt, stop.err
+		}
+		if attempt == attempts {
+			break
+		}
+		if onRetry != nil {
+			onRetry(attempt+1, attempts, err)
+		}
+		time.Sleep(r.backoff(attempt))
+	}
+	return attempts, err
+}
+
+// RetryReport collects the steps that needed more than one attempt so flakiness shows up in the final output
+type RetryReport struct {
+	mu    sync.Mutex
+	steps map[string]int
+}
+
+func (r *RetryReport) Record(step string, attempts int) {
+	if r == nil || attempts <= 1 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.steps == nil {
+		r.steps = map[string]int{}
+	}
+	r.steps[step] += attempts - 1
+}
+
+func (r *RetryReport) String() string {
+	if r == nil {
+		return ""
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.steps) == 0 {
+		return ""
+	}
+	lines := []string{}
+	for step, retries := range r.steps {
+		lines = append(lines, fmt.Sprintf("  - %s: retried %d time(s)", step, retries))
+	}
+	sort.Strings(lines)
+	return "⚠️ Some steps were flaky and needed retries:\n" + strings.Join(lines, "\n")
+}
@@ -0,0 +1,81 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RunTask is a one-off command in a fresh container of the app service
+type RunTask struct {
+	Name    string
+	Image   string
+	Command string
+	Detach  bool
+}
+
+// RunContainerName names the container of a one-off task so it can be found and removed later
+func RunContainerName(appName string, at time.Time) string {
+	return fmt.Sprintf("%s-run-%d", appName, at.Unix())
+}
+
+// RunImage is the image a task runs with, a bare tag is taken from the app repository
+func RunImage(appConfig SidekickAppConfig, image string) (string, error) {
+	if image == "" || strings.ContainsAny(image, ":/@") {
+		return image, nil
+	}
+	return AppImage(appConfig, image)
+}
+
+func runOverrideFile(task RunTask) string {
+	return fmt.Sprintf(".%s.yaml", task.Name)
+}
+
+// GetRunTaskCommand starts task with docker compose run, with the env file decrypted like deploy does.
+// Attached tasks hold on to stdin of the SSH session, once it closes (Ctrl-C or a dropped connection) the container is removed.
+func GetRunTaskCommand(appConfig SidekickAppConfig, task RunTask, secretKey string) string {
+	var script strings.Builder
+	fmt.Fprintf(&script, "cd %s || exit 1\n", appConfig.Name)
+	files := ""
+	if task.Image != "" {
+		override := fmt.Sprintf("services:\n  %s:\n    image: %s\n", appConfig.Name, task.Image)
+		fmt.Fprintf(&script, "echo '%s' | base64 -d > %s\n", base64.StdEncoding.EncodeToString([]byte(override)), runOverrideFile(task))
+		files = fmt.Sprintf("-f docker-compose.yaml -f %s ", runOverrideFile(task))
+	}
+	runFlags := "--rm -T"
+	if task.Detach {
+		runFlags = "-d --rm"
+	}
+	run := fmt.Sprintf("docker compose -p %s %srun %s --name %s %s %s", ComposeProject(appConfig.Name, ""), files, runFlags, task.Name, appConfig.Name, task.Command)
+	if appConfig.Env.File != "" {
+		run = fmt.Sprintf("SOPS_AGE_KEY=%s sops exec-env encrypted.env %s", shellQuote(secretKey), shellQuote(run))
+	}
+	if task.Detach {
+		fmt.Fprintf(&script, "%s\ncode=$?\n", run)
+	} else {
+		// background jobs get /dev/null as stdin, keep the session one on fd 3 for the watcher
+		fmt.Fprintf(&script, "exec 3<&0\n%s &\njob=$!\n", run)
+		fmt.Fprintf(&script, "{ cat <&3; docker rm -f %s; } > /dev/null 2>&1 &\nwatcher=$!\n", task.Name)
+		script.WriteString("wait $job\ncode=$?\nkill $watcher 2> /dev/null\n")
+	}
+	if task.Image != "" {
+		fmt.Fprintf(&script, "rm -f %s\n", runOverrideFile(task))
+	}
+	script.WriteString("exit $code\n")
+	return script.String()
+}
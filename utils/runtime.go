@@ -0,0 +1,128 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	RuntimeDocker = "docker"
+	RuntimePodman = "podman"
+	// PodmanComposeCommand is used on servers whose podman has no compose subcommand
+	PodmanComposeCommand = "podman-compose"
+)
+
+// dockerCommandPattern matches docker and docker compose where they are run, not in names like docker-compose.yml or com.docker.compose.service
+var dockerCommandPattern = regexp.MustCompile("(^|[\\s;|&(`\"'])(sudo )?docker( compose)?(\\s)")
+
+// detectRuntimeScript prints the runtime of the server, and the compose command when podman only has podman-compose
+var detectRuntimeScript = `if command -v docker >/dev/null 2>&1 && docker compose version >/dev/null 2>&1; then echo docker
+elif command -v podman >/dev/null 2>&1; then
+  if podman compose version >/dev/null 2>&1; then echo podman
+  elif command -v podman-compose >/dev/null 2>&1; then echo podman podman-compose
+  else echo podman none; fi
+fi`
+
+// PodmanStage serves the podman API where Traefik and the docker tools look for the docker socket
+var PodmanStage = CommandsStage{
+	Name:                  "Podman setup",
+	Idempotent:            true,
+	SpinnerSuccessMessage: "Podman setup successfully",
+	SpinnerFailMessage:    "Error happened during setting up podman",
+	Commands: []string{
+		"sudo systemctl enable --now podman.socket",
+		"echo 'L+ /run/docker.sock - - - - /run/podman/podman.sock' | sudo tee /etc/tmpfiles.d/sidekick-podman.conf > /dev/null",
+		"sudo systemd-tmpfiles --create /etc/tmpfiles.d/sidekick-podman.conf",
+	},
+}
+
+func ValidateRuntime(runtime string) error {
+	switch runtime {
+	case "", RuntimeDocker, RuntimePodman:
+		return nil
+	}
+	return fmt.Errorf("runtime must be %s or %s, not %q", RuntimeDocker, RuntimePodman, runtime)
+}
+
+// DetectRuntime finds docker or podman on the server. runtime is empty when neither is installed,
+// compose is only set when podman needs podman-compose.
+func DetectRuntime(remote RemoteExecutor) (runtime string, compose string, err error) {
+	output, err := remote.Output(detectRuntimeScript)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to look for docker and podman: %w", err)
+	}
+	fields := strings.Fields(output)
+	if len(fields) == 0 {
+		return "", "", nil
+	}
+	if len(fields) > 1 && fields[1] == "none" {
+		return "", "", fmt.Errorf("podman is installed but has no compose, install podman-compose or docker-compose")
+	}
+	if len(fields) > 1 {
+		compose = fields[1]
+	}
+	return fields[0], compose, nil
+}
+
+// RewriteForRuntime swaps docker in cmd for the runtime of the server. Podman runs as root through sudo
+// so apps and Traefik share one set of containers and networks, like the docker group gives docker.
+func RewriteForRuntime(runtime string, compose string, cmd string) string {
+	if runtime != RuntimePodman {
+		return cmd
+	}
+	return dockerCommandPattern.ReplaceAllStringFunc(cmd, func(match string) string {
+		parts := dockerCommandPattern.FindStringSubmatch(match)
+		binary := "sudo -E podman"
+		if parts[3] != "" {
+			binary += " compose"
+			if compose == PodmanComposeCommand {
+				binary = "sudo -E " + PodmanComposeCommand
+			}
+		}
+		return parts[1] + binary + parts[4]
+	})
+}
+
+// serverRuntime is the runtime recorded for the server at address, docker when there is none
+func serverRuntime(address string) (string, string) {
+	hostKeys.Lock()
+	defer hostKeys.Unlock()
+	if hostKeys.config == nil {
+		return RuntimeDocker, ""
+	}
+	for _, server := range hostKeys.config.Servers {
+		if server.Address == address && server.Runtime != "" {
+			return server.Runtime, server.Compose
+		}
+	}
+	return RuntimeDocker, ""
+}
+
+// RuntimeCommand rewrites cmd for the runtime of the server client is connected to
+func RuntimeCommand(client *ssh.Client, cmd string) string {
+	connections.Lock()
+	target, ok := connections.targets[client]
+	connections.Unlock()
+	if !ok {
+		return cmd
+	}
+	runtime, compose := serverRuntime(target.server)
+	return RewriteForRuntime(runtime, compose, cmd)
+}
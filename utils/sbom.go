@@ -0,0 +1,72 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const (
+	SbomFormatCycloneDX = "cyclonedx"
+	SbomFormatSPDX      = "spdx"
+	SyftImage           = "anchore/syft:latest"
+)
+
+func ValidateSbomFormat(format string) error {
+	if format != SbomFormatCycloneDX && format != SbomFormatSPDX {
+		return fmt.Errorf("unknown sbom format %q, use %s or %s", format, SbomFormatCycloneDX, SbomFormatSPDX)
+	}
+	return nil
+}
+
+// SbomFileName is where the sbom of a deploy version is written, next to sidekick.yml
+func SbomFileName(version string, format string) string {
+	return fmt.Sprintf("sbom-%s.%s.json", version, format)
+}
+
+// RemoteSbomFile is the sbom of the live version, next to the compose file of the app
+func RemoteSbomFile(appName string, format string) string {
+	return fmt.Sprintf("%s/sbom.%s.json", appName, format)
+}
+
+// GetSyftCommand uses syft when it is installed and the syft image otherwise
+func GetSyftCommand(image string, format string) *exec.Cmd {
+	args := []string{image, "--quiet", "-o", format + "-json"}
+	if _, err := exec.LookPath("syft"); err == nil {
+		return OperationCommand("syft", args...)
+	}
+	return OperationCommand("docker", append([]string{"run", "--rm", "-v", "/var/run/docker.sock:/var/run/docker.sock", SyftImage}, args...)...)
+}
+
+// GenerateSbom writes the sbom of a local image to path and returns its sha256 digest
+func GenerateSbom(image string, format string, path string) (string, error) {
+	syftCmd := GetSyftCommand(image, format)
+	var stderr strings.Builder
+	syftCmd.Stderr = &stderr
+	output, err := syftCmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("syft failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if err := os.WriteFile(path, output, 0644); err != nil {
+		return "", fmt.Errorf("failed to write sbom: %w", err)
+	}
+	sum := sha256.Sum256(output)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,199 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/mightymoud/sidekick/render"
+	"github.com/pterm/pterm"
+	"github.com/spf13/viper"
+)
+
+const (
+	DefaultScanSeverity = "HIGH"
+	TrivyImage          = "aquasec/trivy:latest"
+	// ScanCacheDir sits next to the sidekick config, one report per image digest
+	ScanCacheDir = "scans"
+	// scanTableRows keeps the findings table readable, the counts cover the rest
+	scanTableRows = 20
+)
+
+// ScanSeverities are the trivy severities from lowest to highest
+var ScanSeverities = []string{"UNKNOWN", "LOW", "MEDIUM", "HIGH", "CRITICAL"}
+
+type Vulnerability struct {
+	ID           string `json:"VulnerabilityID"`
+	Package      string `json:"PkgName"`
+	Installed    string `json:"InstalledVersion"`
+	FixedVersion string `json:"FixedVersion"`
+	Severity     string `json:"Severity"`
+	Title        string `json:"Title"`
+}
+
+// ScanReport holds every finding whatever its severity, so a cached report works for any --scan-severity
+type ScanReport struct {
+	Image           string          `json:"image"`
+	Digest          string          `json:"digest"`
+	Vulnerabilities []Vulnerability `json:"vulnerabilities"`
+	Cached          bool            `json:"-"`
+}
+
+func ValidateScanSeverity(severity string) error {
+	if !slices.Contains(ScanSeverities, strings.ToUpper(severity)) {
+		return fmt.Errorf("unknown severity %q, use one of %s", severity, strings.Join(ScanSeverities, ", "))
+	}
+	return nil
+}
+
+// AtOrAbove are the findings with a severity of at least minSeverity, highest first
+func (r ScanReport) AtOrAbove(minSeverity string) []Vulnerability {
+	min := slices.Index(ScanSeverities, strings.ToUpper(minSeverity))
+	found := []Vulnerability{}
+	for _, vuln := range r.Vulnerabilities {
+		if slices.Index(ScanSeverities, vuln.Severity) >= min {
+			found = append(found, vuln)
+		}
+	}
+	slices.SortStableFunc(found, func(a, b Vulnerability) int {
+		return slices.Index(ScanSeverities, b.Severity) - slices.Index(ScanSeverities, a.Severity)
+	})
+	return found
+}
+
+// Summary is a table of the findings at or above minSeverity and a count per severity
+func (r ScanReport) Summary(minSeverity string) string {
+	counts := []string{}
+	for i := len(ScanSeverities) - 1; i >= 0; i-- {
+		count := 0
+		for _, vuln := range r.Vulnerabilities {
+			if vuln.Severity == ScanSeverities[i] {
+				count++
+			}
+		}
+		counts = append(counts, fmt.Sprintf("%s: %d", ScanSeverities[i], count))
+	}
+	summary := fmt.Sprintf("Scanned %s - %s", r.Image, strings.Join(counts, ", "))
+	if r.Cached {
+		summary += " (cached)"
+	}
+
+	found := r.AtOrAbove(minSeverity)
+	if len(found) == 0 {
+		return summary
+	}
+	rows := pterm.TableData{{"Severity", "ID", "Package", "Installed", "Fixed in"}}
+	for i, vuln := range found {
+		if i == scanTableRows {
+			rows = append(rows, []string{"", fmt.Sprintf("and %d more", len(found)-scanTableRows), "", "", ""})
+			break
+		}
+		rows = append(rows, []string{vuln.Severity, vuln.ID, vuln.Package, vuln.Installed, vuln.FixedVersion})
+	}
+	table, _ := pterm.DefaultTable.WithHasHeader().WithData(rows).Srender()
+	return summary + "\n" + table
+}
+
+// ParseTrivyReport reads the findings out of trivy image --format json
+func ParseTrivyReport(output []byte) ([]Vulnerability, error) {
+	var report struct {
+		Results []struct {
+			Vulnerabilities []Vulnerability `json:"Vulnerabilities"`
+		} `json:"Results"`
+	}
+	if err := json.Unmarshal(output, &report); err != nil {
+		return nil, fmt.Errorf("failed to read the trivy report: %w", err)
+	}
+	vulns := []Vulnerability{}
+	for _, result := range report.Results {
+		vulns = append(vulns, result.Vulnerabilities...)
+	}
+	return vulns, nil
+}
+
+// GetTrivyCommand uses trivy when it is installed and the trivy image otherwise
+func GetTrivyCommand(image string) *exec.Cmd {
+	args := []string{"image", "--quiet", "--format", "json", "--scanners", "vuln", image}
+	if _, err := exec.LookPath("trivy"); err == nil {
+		return OperationCommand("trivy", args...)
+	}
+	dockerArgs := []string{"run", "--rm", "-v", "/var/run/docker.sock:/var/run/docker.sock"}
+	if home, err := os.UserHomeDir(); err == nil {
+		dockerArgs = append(dockerArgs, "-v", filepath.Join(home, ".cache", "trivy")+":/root/.cache/trivy")
+	}
+	return OperationCommand("docker", append(append(dockerArgs, TrivyImage), args...)...)
+}
+
+func scanCachePath(digest string) string {
+	return filepath.Join(filepath.Dir(viper.GetString("config")), ScanCacheDir, strings.ReplaceAll(digest, ":", "-")+".json")
+}
+
+// ScanImage runs trivy against a local image, the report is reused as long as the image digest is the same
+func ScanImage(image string) (ScanReport, error) {
+	report := ScanReport{Image: image}
+	digest, err := OperationCommand("docker", "image", "inspect", "--format", "{{.Id}}", image).Output()
+	if err != nil {
+		return report, fmt.Errorf("failed to find image %s: %w", image, err)
+	}
+	report.Digest = strings.TrimSpace(string(digest))
+
+	cachePath := scanCachePath(report.Digest)
+	if content, err := os.ReadFile(cachePath); err == nil {
+		var cached ScanReport
+		if json.Unmarshal(content, &cached) == nil && cached.Digest == report.Digest {
+			cached.Image, cached.Cached = image, true
+			return cached, nil
+		}
+	}
+
+	trivyCmd := GetTrivyCommand(image)
+	var stderr strings.Builder
+	trivyCmd.Stderr = &stderr
+	output, err := trivyCmd.Output()
+	if err != nil {
+		return report, fmt.Errorf("trivy failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if report.Vulnerabilities, err = ParseTrivyReport(output); err != nil {
+		return report, err
+	}
+	if content, err := json.Marshal(report); err == nil {
+		if os.MkdirAll(filepath.Dir(cachePath), 0755) == nil {
+			os.WriteFile(cachePath, content, 0600)
+		}
+	}
+	return report, nil
+}
+
+// ScanImageWithTUIHook fails when the image has findings at or above minSeverity
+func ScanImageWithTUIHook(image string, minSeverity string, p *tea.Program) error {
+	report, err := ScanImage(image)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(report.Summary(minSeverity), "\n") {
+		p.Send(render.LogMsg{LogLine: line + "\n"})
+	}
+	if found := report.AtOrAbove(minSeverity); len(found) > 0 {
+		return fmt.Errorf("%d vulnerabilities at or above %s", len(found), strings.ToUpper(minSeverity))
+	}
+	return nil
+}
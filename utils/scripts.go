@@ -35,7 +35,7 @@ SERVICE="$service_name"
 APP_PORT="$app_port"
 SLEEP_AFTER_START=3
 HAS_ENV=$has_env
-COMPOSE_PROJECT="sidekick"
+COMPOSE_PROJECT="$compose_project"
 
 # helper for nicer logs
 log() { echo "[$(date +'%T')] $*"; }
@@ -50,8 +50,8 @@ fi
 cd "$SERVICE"
 
 
-# find the old container (oldest for this service)
-old_container_id=$(docker ps -f "name=${SERVICE}" -q | tail -n1 || true)
+# find the old container (oldest for this service, it may still be in the shared sidekick project)
+old_container_id=$(docker ps -f "label=com.docker.compose.service=${SERVICE}" -q | tail -n1 || true)
 if [[ -z "$old_container_id" ]]; then
   log "ERROR: no running containers found for service '${SERVICE}'."
   exit 3
@@ -61,7 +61,7 @@ echo $old_container_id
 
 # create a new instance by scaling up to 2 (no deps, don't recreate existing)
 if [ $HAS_ENV ]; then
-	sops exec-env encrypted.env "docker compose -p sidekick up -d --no-deps --scale ${SERVICE}=2 --no-recreate ${SERVICE}"
+	sops exec-env encrypted.env "docker compose -p ${COMPOSE_PROJECT} up -d --no-deps --scale ${SERVICE}=2 --no-recreate ${SERVICE}"
 else
 	docker compose -p "$COMPOSE_PROJECT" up -d --no-deps --scale "$SERVICE"=2 --no-recreate "$SERVICE"
 fi
@@ -73,7 +73,7 @@ if (( SLEEP_AFTER_START > 0 )); then
 fi
 
 # find newest container for this service
-new_container_id=$(docker ps -f "name=${SERVICE}" -q | head -n1 || true)
+new_container_id=$(docker ps -f "label=com.docker.compose.service=${SERVICE}" -q | head -n1 || true)
 if [[ -z "$new_container_id" ]]; then
   log "ERROR: failed to detect new container after scaling."
   exit 4
@@ -135,16 +135,6 @@ docker system prune -f
 exit 0
 	`
 
-var CheckGitTreeScript = `
-	if [[ -z $(git status -s) ]]
-	then
-	  echo "all good"
-	else
-	  echo "tree is dirty, please commit changes before running this"
-	  exit
-	fi
-	`
-
 var SetupStageScript = `
 #!/usr/bin/env bash
 set -e
@@ -190,12 +180,24 @@ services:
       - --entrypoints.web.address=:80
       - --entrypoints.web.http.redirections.entryPoint.to=websecure
       - --entrypoints.web.http.redirections.entryPoint.scheme=https
+      # apps with tls: false route on web, their routers have to win over the redirect
+      - --entrypoints.web.http.redirections.entryPoint.priority=1
       - --entrypoints.websecure.address=:443
       - --entrypoints.websecure.http.tls.certresolver=default
       - --providers.docker.exposedbydefault=false
+      - --providers.file.directory=/dynamic
+      - --providers.file.watch=true
+      # only reachable on the sidekick network, for the Prometheus of sidekick observability enable metrics
+      - --entrypoints.metrics.address=:8082
+      - --metrics.prometheus=true
+      - --metrics.prometheus.entrypoint=metrics
       - --certificatesresolvers.default.acme.email=$EMAIL
       - --certificatesresolvers.default.acme.storage=/ssl-certs/acme.json
       - --certificatesresolvers.default.acme.httpchallenge.entrypoint=web
+      - --certificatesresolvers.staging.acme.email=$EMAIL
+      - --certificatesresolvers.staging.acme.storage=/ssl-certs/acme-staging.json
+      - --certificatesresolvers.staging.acme.caserver=https://acme-staging-v02.api.letsencrypt.org/directory
+      - --certificatesresolvers.staging.acme.httpchallenge.entrypoint=web
     ports:
       - "80:80"
       - "443:443"
@@ -205,10 +207,18 @@ services:
       # So that Traefik can listen to the Docker events
       - /var/run/docker.sock:/var/run/docker.sock:ro
       - ./traefik/ssl/:/ssl-certs/
+      # Custom certs uploaded with sidekick launch --tls-cert
+      - ./certs/:/certs/:ro
+      - ./dynamic/:/dynamic/:ro
     networks:
-      - sidekick
+      - $NETWORK
+    logging:
+      driver: json-file
+      options:
+        max-size: "10m"
+        max-file: "3"
 
 networks:
-  sidekick:
+  $NETWORK:
     external: true
 `
@@ -15,13 +15,101 @@ limitations under the License.
 package utils
 
 import (
+	"time"
+
+	"github.com/mightymoud/sidekick/render"
 	"github.com/pterm/pterm"
 )
 
-var stagedSpinner = pterm.DefaultSpinner
+// plainUpdateInterval keeps a task that reports its progress often, like an upload, from flooding a log
+const plainUpdateInterval = 5 * time.Second
+
+// Task shows the progress of one step of a command. Every command goes through it instead of a pterm spinner,
+// so --plain, --quiet and --ci get lines without escape codes.
+type Task interface {
+	UpdateText(text string)
+	// Success and Fail end the task with message, or with its text when there is none
+	Success(message ...string)
+	Warning(message string)
+	Fail(message ...string)
+}
+
+// StartTask shows a spinner with text on a terminal and a line per change otherwise
+func StartTask(text string) Task {
+	if render.IsPlain() {
+		task := &plainTask{text: text, updated: time.Now()}
+		task.print("... " + text)
+		return task
+	}
+	spinner, _ := pterm.DefaultSpinner.Start(text)
+	return &fancyTask{spinner: spinner}
+}
+
+type fancyTask struct {
+	spinner *pterm.SpinnerPrinter
+}
+
+func (t *fancyTask) UpdateText(text string) {
+	t.spinner.UpdateText(text)
+}
+
+func (t *fancyTask) Success(message ...string) {
+	t.spinner.Success(anySlice(message)...)
+}
+
+func (t *fancyTask) Warning(message string) {
+	t.spinner.Warning(message)
+}
+
+func (t *fancyTask) Fail(message ...string) {
+	t.spinner.Fail(anySlice(message)...)
+}
+
+type plainTask struct {
+	text    string
+	updated time.Time
+}
+
+// print leaves out everything but warnings and failures with --quiet
+func (t *plainTask) print(line string) {
+	if !render.IsQuiet() {
+		render.PrintPlain(line)
+	}
+}
+
+func (t *plainTask) UpdateText(text string) {
+	changed := text != t.text
+	t.text = text
+	if !changed || time.Since(t.updated) < plainUpdateInterval {
+		return
+	}
+	t.updated = time.Now()
+	t.print("... " + text)
+}
+
+func (t *plainTask) Success(message ...string) {
+	t.print("✔ " + t.ending(message))
+}
+
+func (t *plainTask) Warning(message string) {
+	render.PrintPlain("! " + message)
+}
+
+func (t *plainTask) Fail(message ...string) {
+	render.PrintPlain("✖ " + t.ending(message))
+}
+
+func (t *plainTask) ending(message []string) string {
+	if len(message) == 0 {
+		return t.text
+	}
+	return message[0]
+}
 
-func GetSpinner() pterm.SpinnerPrinter {
-	stagedSpinner.Sequence = []string{"."}
-	stagedSpinner.ShowTimer = false
-	return stagedSpinner
+func anySlice(message []string) []interface{} {
+	values := make([]interface{}, len(message))
+	for i, m := range message {
+		values[i] = m
+	}
+	return values
 }
@@ -0,0 +1,178 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// StackVersion is the version of the Traefik stack this release of sidekick sets up
+	StackVersion           = 5
+	RemoteStackVersionFile = ".sidekick/sidekickVersion"
+)
+
+// StackMigration moves the server stack to Version. Scripts must be safe to run again,
+// a dropped connection leaves the marker at the previous version and the upgrade resumes from there.
+type StackMigration struct {
+	Version int
+	Name    string
+	Script  string
+}
+
+// GetStackMigrations lists every migration in order, servers from before the marker existed are on version 1
+func GetStackMigrations(server SidekickServer) []StackMigration {
+	compose := base64.StdEncoding.EncodeToString([]byte(GetTraefikComposeFile(server)))
+	return []StackMigration{
+		{
+			Version: 2,
+			Name:    "Update Traefik to v3.6.1 with the file provider for custom certs",
+			// the image is pulled before the container is recreated so Traefik is only down for the restart
+			Script: fmt.Sprintf(`set -e
+mkdir -p %s %s
+echo '%s' | base64 -d > traefik/docker-compose.yml.new
+mv traefik/docker-compose.yml.new traefik/docker-compose.yml
+cd traefik
+docker compose -p sidekick pull traefik-service
+docker compose -p sidekick up -d traefik-service`, RemoteCertsDir, RemoteDynamicDir, compose),
+		},
+		{
+			Version: 3,
+			Name:    "Let apps with tls: false answer plain HTTP instead of redirecting them to HTTPS",
+			Script: fmt.Sprintf(`set -e
+echo '%s' | base64 -d > traefik/docker-compose.yml.new
+mv traefik/docker-compose.yml.new traefik/docker-compose.yml
+cd traefik
+docker compose -p sidekick up -d traefik-service`, compose),
+		},
+		{
+			Version: 4,
+			Name:    "Rotate the logs of Traefik so they can't fill the disk",
+			Script: fmt.Sprintf(`set -e
+echo '%s' | base64 -d > traefik/docker-compose.yml.new
+mv traefik/docker-compose.yml.new traefik/docker-compose.yml
+cd traefik
+docker compose -p sidekick up -d traefik-service`, compose),
+		},
+		{
+			Version: 5,
+			Name:    "Serve Traefik metrics on the sidekick network for Prometheus",
+			Script: fmt.Sprintf(`set -e
+echo '%s' | base64 -d > traefik/docker-compose.yml.new
+mv traefik/docker-compose.yml.new traefik/docker-compose.yml
+cd traefik
+docker compose -p sidekick up -d traefik-service`, compose),
+		},
+	}
+}
+
+// PendingStackMigrations are the migrations after version, in order
+func PendingStackMigrations(version int, migrations []StackMigration) []StackMigration {
+	pending := []StackMigration{}
+	for _, migration := range migrations {
+		if migration.Version > version {
+			pending = append(pending, migration)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Version < pending[j].Version })
+	return pending
+}
+
+// GetRemoteStackVersion reads the marker, a server sidekick init set up before the marker existed is on version 1
+func GetRemoteStackVersion(remote RemoteExecutor) (int, error) {
+	output, err := remote.Output(fmt.Sprintf(`if [ -f %[1]s ]; then cat %[1]s; elif [ -d traefik ]; then echo 1; else echo 0; fi`, RemoteStackVersionFile))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the stack version: %w", err)
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(output))
+	if err != nil {
+		return 0, fmt.Errorf("%s is corrupted: %q", RemoteStackVersionFile, strings.TrimSpace(output))
+	}
+	return version, nil
+}
+
+// SetRemoteStackVersion replaces the marker in one rename so it is never half written
+func SetRemoteStackVersion(remote RemoteExecutor, version int) error {
+	_, err := remote.Output(GetStackVersionCommand(version))
+	return err
+}
+
+func GetStackVersionCommand(version int) string {
+	return fmt.Sprintf("mkdir -p $(dirname %[1]s) && echo %[2]d > %[1]s.new && mv %[1]s.new %[1]s", RemoteStackVersionFile, version)
+}
+
+var routerHostPattern = regexp.MustCompile("Host\\(`([^`]+)`\\)")
+
+// GetRouterHosts lists the hosts of every Traefik router on the server, from the labels of the running containers
+func GetRouterHosts(remote RemoteExecutor) ([]string, error) {
+	output, err := remote.Output(`docker ps -q --filter label=traefik.enable=true | xargs -r docker inspect -f '{{range $k, $v := .Config.Labels}}{{$k}}={{$v}}{{"\n"}}{{end}}'`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the app routers: %w", err)
+	}
+	seen := map[string]bool{}
+	hosts := []string{}
+	for _, line := range outputLines(output) {
+		if !strings.Contains(line, ".rule=") {
+			continue
+		}
+		for _, match := range routerHostPattern.FindAllStringSubmatch(line, -1) {
+			if !seen[match[1]] {
+				seen[match[1]] = true
+				hosts = append(hosts, match[1])
+			}
+		}
+	}
+	sort.Strings(hosts)
+	return hosts, nil
+}
+
+// ProbeRouterHosts asks the Traefik on the server for every host and returns the HTTP status, 000 when nothing answered
+func ProbeRouterHosts(remote RemoteExecutor, hosts []string) map[string]string {
+	statuses := map[string]string{}
+	for _, host := range hosts {
+		output, _ := remote.Output(fmt.Sprintf("curl -sk -o /dev/null -w '%%{http_code}' --max-time 10 --resolve %[1]s:443:127.0.0.1 https://%[1]s/", host))
+		status := strings.TrimSpace(output)
+		if status == "" {
+			status = "000"
+		}
+		statuses[host] = status
+	}
+	return statuses
+}
+
+// BrokenRouters are the hosts that answered before the upgrade and don't anymore, or that started failing
+func BrokenRouters(before map[string]string, after map[string]string) []string {
+	broken := []string{}
+	for host, was := range before {
+		now := after[host]
+		switch {
+		case was == "000":
+			continue
+		case now == "" || now == "000":
+			broken = append(broken, host)
+		case now >= "500" && was < "500":
+			broken = append(broken, host)
+		case now == "404" && was != "404":
+			broken = append(broken, host)
+		}
+	}
+	sort.Strings(broken)
+	return broken
+}
@@ -18,22 +18,30 @@ import (
 	"encoding/base64"
 	"fmt"
 	"strings"
+	"sync"
 )
 
+// UsersetupStage can run again on a server that has the user, it only adds what is missing
 var UsersetupStage = CommandsStage{
+	Name:                  "User setup",
+	Idempotent:            true,
 	SpinnerSuccessMessage: "New user created successfully",
 	SpinnerFailMessage:    "Error creating a new user for the machine",
 	Commands: []string{
-		"sudo useradd -m -s /bin/bash -G sudo sidekick",
-		`echo "sidekick ALL=(ALL) NOPASSWD: ALL" >> /etc/sudoers.d/sidekick`,
+		"id -u sidekick > /dev/null 2>&1 || sudo useradd -m -s /bin/bash -G sudo sidekick",
+		`echo "sidekick ALL=(ALL) NOPASSWD: ALL" > /etc/sudoers.d/sidekick`,
 		"mkdir -p /home/sidekick/.ssh/",
-		"sudo cat /root/.ssh/authorized_keys | sudo tee -a /home/sidekick/.ssh/authorized_keys",
+		"sudo touch /home/sidekick/.ssh/authorized_keys",
+		// merging keeps the keys added by hand and never lists one twice
+		"sudo sort -u /root/.ssh/authorized_keys /home/sidekick/.ssh/authorized_keys -o /home/sidekick/.ssh/authorized_keys",
 		"sudo chown sidekick:sidekick /home/sidekick/.ssh/authorized_keys",
 		"sudo chmod 600 /home/sidekick/.ssh/authorized_keys",
 	},
 }
 
 var SetupStage = CommandsStage{
+	Name:                  "VPS setup",
+	Idempotent:            true,
 	SpinnerSuccessMessage: "VPS updated and setup successfully",
 	SpinnerFailMessage:    "Error happened running basic setup commands",
 	Commands: []string{
@@ -45,6 +53,8 @@ var SetupStage = CommandsStage{
 }
 
 var DockerStage = CommandsStage{
+	Name:                  "Docker setup",
+	Idempotent:            true,
 	SpinnerSuccessMessage: "Docker setup successfully",
 	SpinnerFailMessage:    "Error happened during setting up docker",
 	Commands: []string{
@@ -62,18 +72,79 @@ var DockerStage = CommandsStage{
 	},
 }
 
-func GetTraefikStage(email string) CommandsStage {
+// GetTraefikStage sets up Traefik from scratch, init creates the network of the server before it runs
+func GetTraefikStage(server SidekickServer) CommandsStage {
 	return CommandsStage{
+		Name:                  "Traefik setup",
 		SpinnerSuccessMessage: "Successfully setup Traefik",
 		SpinnerFailMessage:    "Something went wrong setting up Traefik on your VPS",
 		Commands: []string{
-			"mkdir traefik",
-			fmt.Sprintf("echo '%s' > ./traefik/docker-compose.yml", strings.Replace(TraefikDockerComposeFile, "$EMAIL", email, 1)),
+			"mkdir -p traefik",
+			fmt.Sprintf("echo '%s' > ./traefik/docker-compose.yml", GetTraefikComposeFile(server)),
 			"mkdir -p ./traefik/ssl-certs/",
+			fmt.Sprintf("mkdir -p %s %s", RemoteCertsDir, RemoteDynamicDir),
 			"touch ./traefik/ssl-certs/acme.json",
 			"chmod 600 ./traefik/ssl-certs/acme.json",
-			"sudo docker network create sidekick",
+			// pulling on its own is retried, up then only starts what is there
+			"cd traefik && sudo docker compose -p sidekick pull",
 			"cd traefik && sudo docker compose -p sidekick up -d",
+			// a fresh stack needs none of the migrations of sidekick server upgrade
+			GetStackVersionCommand(StackVersion),
 		},
 	}
 }
+
+// EnsureNetwork creates the docker network unless the server has it already, created tells which it was
+func EnsureNetwork(remote RemoteExecutor, network string) (created bool, err error) {
+	if _, err := remote.Output(fmt.Sprintf("sudo docker network inspect %s --format '{{.Name}}'", network)); err == nil {
+		return false, nil
+	}
+	if _, err := remote.Output("sudo docker network create " + network); err != nil {
+		return false, fmt.Errorf("failed to create the %s network: %w", network, err)
+	}
+	return true, nil
+}
+
+// TraefikState is the state of the Traefik container, like running or exited, and empty when there is none
+func TraefikState(remote RemoteExecutor) (string, error) {
+	output, err := remote.Output("sudo docker ps -a --filter label=com.docker.compose.service=traefik-service --format '{{.State}}'")
+	if err != nil {
+		return "", err
+	}
+	state, _, _ := strings.Cut(strings.TrimSpace(output), "\n")
+	return state, nil
+}
+
+// ConvergeReport tells what a run of init changed on the server apart from what was already in place
+type ConvergeReport struct {
+	mu      sync.Mutex
+	changed []string
+	inPlace []string
+}
+
+func (r *ConvergeReport) Changed(what string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.changed = append(r.changed, what)
+}
+
+func (r *ConvergeReport) InPlace(what string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.inPlace = append(r.inPlace, what)
+}
+
+func (r *ConvergeReport) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	lines := []string{}
+	if len(r.changed) > 0 {
+		lines = append(lines, "Changed: "+strings.Join(r.changed, ", "))
+	} else {
+		lines = append(lines, "Changed: nothing, the server was already set up")
+	}
+	if len(r.inPlace) > 0 {
+		lines = append(lines, "Already in place: "+strings.Join(r.inPlace, ", "))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,84 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// StaticPort is where nginx serves a static site inside its container
+	StaticPort = 80
+	// StaticDockerfile builds the image of a static site, the folder is the build context
+	StaticDockerfile = "FROM nginx:alpine\nCOPY . /usr/share/nginx/html\n"
+)
+
+// IsStatic is true when the app is a folder of files served by nginx instead of a Dockerfile build
+func IsStatic(appConfig SidekickAppConfig) bool {
+	return appConfig.Static != ""
+}
+
+// ValidateStaticDir checks the folder of a static site is there, the build would fail with a worse error
+func ValidateStaticDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("static site folder %s does not exist", dir)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("static site %s is not a folder", dir)
+	}
+	return nil
+}
+
+// StaticBuildContext is the folder of a static site inside buildContext, which is the app folder or an exported ref
+func StaticBuildContext(appConfig SidekickAppConfig, buildContext string) string {
+	if filepath.IsAbs(appConfig.Static) {
+		return appConfig.Static
+	}
+	return filepath.Join(buildContext, appConfig.Static)
+}
+
+// getStaticBuildArgs are the docker build args that read StaticDockerfile from stdin
+func getStaticBuildArgs(tag string, platform string, cache BuildCache, dir string) []string {
+	args := GetDockerBuildArgs(tag, platform, cache, dir)
+	return append(args[:len(args)-1:len(args)-1], "--file", "-", dir)
+}
+
+// GetStaticBuildCommand builds the image of a static site on this machine
+func GetStaticBuildCommand(tag string, platform string, cache BuildCache, dir string) *exec.Cmd {
+	buildCmd := OperationCommand("docker", getStaticBuildArgs(tag, platform, cache, dir)...)
+	buildCmd.Stdin = strings.NewReader(StaticDockerfile)
+	return buildCmd
+}
+
+// GetStaticRemoteBuildCommand builds the image of a static site synced to remoteDir on the server
+func GetStaticRemoteBuildCommand(tag string, server SidekickServer, remoteDir string) string {
+	return fmt.Sprintf("echo '%s' | base64 -d | docker %s 2>&1", base64.StdEncoding.EncodeToString([]byte(StaticDockerfile)), strings.Join(getStaticBuildArgs(tag, server.PlatformId, BuildCache{}, remoteDir), " "))
+}
+
+// StaticBuildWithTUIHook rsyncs the folder of a static site to the server and builds its nginx image there
+func StaticBuildWithTUIHook(sshClient *ssh.Client, server SidekickServer, tag string, dir string, p *tea.Program) error {
+	return remoteBuildWithTUIHook(sshClient, server, dir, p, func(remoteDir string) string {
+		return GetStaticRemoteBuildCommand(tag, server, remoteDir)
+	})
+}
@@ -0,0 +1,194 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/huh"
+	"github.com/mightymoud/sidekick/render"
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// how the context of a command was picked, only a flag counts as explicit
+const (
+	TargetSelectedByFlag    = "flag"
+	TargetSelectedByApp     = "app pin"
+	TargetSelectedByPrompt  = "prompt"
+	TargetSelectedByDefault = "default"
+)
+
+const AuditLogFile = "audit.log"
+
+type Target struct {
+	Context     string
+	Server      SidekickServer
+	Environment string
+	SelectedBy  string
+}
+
+type AuditEntry struct {
+	Time        string `json:"time"`
+	Command     string `json:"command"`
+	App         string `json:"app"`
+	Environment string `json:"environment"`
+	Context     string `json:"context"`
+	SelectedBy  string `json:"selectedBy"`
+	Server      string `json:"server"`
+	User        string `json:"user,omitempty"`
+}
+
+func (t Target) String() string {
+	return fmt.Sprintf("context %s → server %s (%s), environment %s, selected by %s", t.Context, t.Server.Name, t.Server.Address, t.Environment, t.SelectedBy)
+}
+
+// ResolveTarget picks the context from --context, then the server pinned in sidekick.yml, then the current context.
+// A --context that points at another server than the pinned one is refused, moving an app is a job for launch.
+func ResolveTarget(cmd *cobra.Command, config *SidekickConfig, pinnedServer string, environment string) (Target, error) {
+	target := Target{Environment: environment}
+	flagContext, _ := cmd.Flags().GetString("context")
+	switch {
+	case flagContext != "":
+		server, err := config.FindServerByContext(flagContext)
+		if err != nil {
+			return target, err
+		}
+		if pinnedServer != "" && server.Name != pinnedServer {
+			return target, fmt.Errorf("context %s points at server %s but this app is deployed to %s", flagContext, server.Name, pinnedServer)
+		}
+		target.Context, target.Server, target.SelectedBy = flagContext, server, TargetSelectedByFlag
+	case pinnedServer != "":
+		server, err := config.FindServer(pinnedServer)
+		if err != nil {
+			return target, err
+		}
+		target.Context, target.Server, target.SelectedBy = pinnedServer, server, TargetSelectedByApp
+		for _, ctx := range config.Contexts {
+			if ctx.Server == pinnedServer {
+				target.Context = ctx.Name
+				break
+			}
+		}
+	default:
+		server, err := config.FindServerByContext(config.CurrentContext)
+		if err != nil {
+			return target, err
+		}
+		target.Context, target.Server, target.SelectedBy = config.CurrentContext, server, TargetSelectedByDefault
+	}
+	return target, nil
+}
+
+func PrintTarget(target Target) {
+	if render.IsPlain() {
+		pterm.Println("Target: " + target.String())
+		return
+	}
+	lines := []string{
+		fmt.Sprintf("Context:      %s (%s)", pterm.Bold.Sprint(target.Context), target.SelectedBy),
+		fmt.Sprintf("Server:       %s (%s)", target.Server.Name, target.Server.Address),
+		fmt.Sprintf("Environment:  %s", target.Environment),
+	}
+	pterm.DefaultBox.WithTitle("Target").Println(strings.Join(lines, "\n"))
+}
+
+// ConfirmTarget asks to type the app name when the context is listed in deployPolicy.confirmContexts.
+// Only --yes together with an explicit --context skips it, an ambient default context or SIDEKICK_ASSUME_YES never does.
+func ConfirmTarget(cmd *cobra.Command, config *SidekickConfig, target Target, appName string) error {
+	if !slices.Contains(config.DeployPolicy.ConfirmContexts, target.Context) {
+		return nil
+	}
+	if yes, _ := cmd.Flags().GetBool("yes"); yes && cmd.Flags().Changed("yes") && target.SelectedBy == TargetSelectedByFlag {
+		return nil
+	}
+	hint := fmt.Sprintf("Pass --yes --context %s to confirm without a prompt", target.Context)
+	if !render.IsInteractive() {
+		return NewStageError("Deploy Policy", ExitCodeConfig, hint, fmt.Errorf("context %s requires confirmation", target.Context))
+	}
+
+	typed := ""
+	err := huh.NewInput().
+		Title(fmt.Sprintf("Context %s is protected. Type the app name to continue", target.Context)).
+		Placeholder(appName).
+		Value(&typed).
+		Run()
+	if err != nil {
+		return NewStageError("Deploy Policy", ExitCodeError, "", err)
+	}
+	if strings.TrimSpace(typed) != appName {
+		return NewStageError("Deploy Policy", ExitCodeConfig, hint, errors.New("the app name did not match, nothing was changed"))
+	}
+	return nil
+}
+
+// ConfirmProduction asks before a command changes the production env of an app.
+// A protected context asked to type the app name already, it isn't asked twice.
+func ConfirmProduction(cmd *cobra.Command, config *SidekickConfig, target Target, summary string) (bool, error) {
+	if target.Environment != MetadataEnvProduction || slices.Contains(config.DeployPolicy.ConfirmContexts, target.Context) {
+		return true, nil
+	}
+	return Confirm(cmd, summary)
+}
+
+// RecordAudit appends the target of a mutating command to audit.log next to the sidekick config
+func RecordAudit(cmd *cobra.Command, target Target, appName string) error {
+	entry := AuditEntry{
+		Time:        time.Now().UTC().Format(time.RFC3339),
+		Command:     cmd.CommandPath(),
+		App:         appName,
+		Environment: target.Environment,
+		Context:     target.Context,
+		SelectedBy:  target.SelectedBy,
+		Server:      target.Server.Name,
+	}
+	if u, err := user.Current(); err == nil {
+		entry.User = u.Username
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(filepath.Dir(viper.GetString("config")), AuditLogFile)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// GuardTarget prints the target, applies the deploy policy and records the command in the audit log
+func GuardTarget(cmd *cobra.Command, config *SidekickConfig, target Target, appName string) error {
+	PrintTarget(target)
+	if err := ConfirmTarget(cmd, config, target, appName); err != nil {
+		return err
+	}
+	if err := RecordAudit(cmd, target, appName); err != nil {
+		pterm.Warning.Printfln("Unable to write the audit log: %s", err)
+	}
+	return nil
+}
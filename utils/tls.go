@@ -0,0 +1,138 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"fmt"
+	"slices"
+
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v3"
+)
+
+// Traefik mounts these folders from ~/traefik on the VPS
+const (
+	RemoteCertsDir   = "traefik/certs"
+	RemoteDynamicDir = "traefik/dynamic"
+)
+
+const (
+	DefaultWebEntrypoint       = "web"
+	DefaultWebsecureEntrypoint = "websecure"
+)
+
+var tlsConfigFields = []string{"cert", "key"}
+
+// UnmarshalYAML also takes tls: true or false, false serves the app over plain HTTP.
+// Unknown keys are reported like the strict decoder of sidekick.yml does for every other field.
+func (c *SidekickAppTLSConfig) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		var enabled bool
+		if err := node.Decode(&enabled); err != nil {
+			return err
+		}
+		*c = SidekickAppTLSConfig{Disabled: !enabled}
+		return nil
+	}
+	unknown := []string{}
+	for i := 0; i+1 < len(node.Content) && node.Kind == yaml.MappingNode; i += 2 {
+		if key := node.Content[i]; !slices.Contains(tlsConfigFields, key.Value) {
+			unknown = append(unknown, fmt.Sprintf("line %d: field %s not found in type utils.SidekickAppTLSConfig", key.Line, key.Value))
+		}
+	}
+	type fields SidekickAppTLSConfig
+	if err := node.Decode((*fields)(c)); err != nil {
+		return err
+	}
+	if len(unknown) > 0 {
+		return &yaml.TypeError{Errors: unknown}
+	}
+	return nil
+}
+
+// MarshalYAML writes tls: false back the way it was written
+func (c SidekickAppTLSConfig) MarshalYAML() (interface{}, error) {
+	if c.Disabled && c.Cert == "" && c.Key == "" {
+		return false, nil
+	}
+	type fields SidekickAppTLSConfig
+	return fields(c), nil
+}
+
+func HasCustomCert(appConfig SidekickAppConfig) bool {
+	return appConfig.TLS.Cert != "" && appConfig.TLS.Key != ""
+}
+
+// TLSEnabled is false for apps served over plain HTTP, like behind a proxy that terminates TLS
+func TLSEnabled(appConfig SidekickAppConfig) bool {
+	return !appConfig.TLS.Disabled
+}
+
+// URLScheme is how the app is reached from a browser
+func URLScheme(appConfig SidekickAppConfig) string {
+	if TLSEnabled(appConfig) {
+		return "https"
+	}
+	return "http"
+}
+
+// GetEntrypoint is the Traefik entrypoint the routers of the app listen on
+func GetEntrypoint(appConfig SidekickAppConfig) string {
+	if !TLSEnabled(appConfig) {
+		if appConfig.Entrypoints.Web != "" {
+			return appConfig.Entrypoints.Web
+		}
+		return DefaultWebEntrypoint
+	}
+	if appConfig.Entrypoints.Websecure != "" {
+		return appConfig.Entrypoints.Websecure
+	}
+	return DefaultWebsecureEntrypoint
+}
+
+// GetCustomCertDynamicConfig is the Traefik file provider config adding the app cert to the default store.
+// Traefik then serves it for any router whose host matches the cert and skips ACME for it.
+func GetCustomCertDynamicConfig(appName string) string {
+	return fmt.Sprintf(`tls:
+  certificates:
+    - certFile: /certs/%s.crt
+      keyFile: /certs/%s.key
+`, appName, appName)
+}
+
+// UploadCustomCert copies the app cert and key to the VPS and registers them with Traefik
+func UploadCustomCert(client *ssh.Client, server SidekickServer, appConfig SidekickAppConfig) error {
+	if _, _, err := RunCommand(client, fmt.Sprintf("mkdir -p %s %s", RemoteCertsDir, RemoteDynamicDir)); err != nil {
+		return err
+	}
+
+	files := map[string]string{
+		appConfig.TLS.Cert: fmt.Sprintf("%s/%s.crt", RemoteCertsDir, appConfig.Name),
+		appConfig.TLS.Key:  fmt.Sprintf("%s/%s.key", RemoteCertsDir, appConfig.Name),
+	}
+	for local, remote := range files {
+		rsyncCmd := OperationCommand("rsync", "--chmod=F600", local, fmt.Sprintf("%s@%s:%s", "sidekick", server.Address, remote))
+		TraceExec(rsyncCmd)
+		if output, err := rsyncCmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to upload %s: %s %w", local, output, err)
+		}
+	}
+	// rsync may keep the mode of an existing file, so make sure the key is locked down
+	if _, _, err := RunCommand(client, fmt.Sprintf("chmod 600 %s/%s.key", RemoteCertsDir, appConfig.Name)); err != nil {
+		return err
+	}
+
+	return WriteRemoteFile(client, fmt.Sprintf("%s/%s.yml", RemoteDynamicDir, appConfig.Name), []byte(GetCustomCertDynamicConfig(appConfig.Name)))
+}
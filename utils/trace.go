@@ -0,0 +1,86 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// tracer logs what sidekick runs for --verbose and --debug, normal runs stay quiet
+var tracer = log.NewWithOptions(os.Stderr, log.Options{
+	Prefix:          "trace",
+	ReportTimestamp: true,
+	TimeFormat:      time.StampMilli,
+	Level:           log.WarnLevel,
+})
+
+var redactions = []struct {
+	pattern *regexp.Regexp
+	replace string
+}{
+	{regexp.MustCompile(`(SOPS_AGE_KEY=)\S+`), "${1}<redacted>"},
+	{regexp.MustCompile(`AGE-SECRET-KEY-[0-9A-Z]+`), "<redacted>"},
+	{regexp.MustCompile(`echo '[A-Za-z0-9+/=]{64,}' \| base64 -d`), "echo '<base64 payload>' | base64 -d"},
+}
+
+// SetTraceLevel turns on command tracing, debug also echoes the output of remote commands
+func SetTraceLevel(verbose bool, debug bool) {
+	switch {
+	case debug:
+		tracer.SetLevel(log.DebugLevel)
+	case verbose:
+		tracer.SetLevel(log.InfoLevel)
+	default:
+		tracer.SetLevel(log.WarnLevel)
+	}
+}
+
+// TraceVerbose reports whether --verbose or --debug is on
+func TraceVerbose() bool {
+	return tracer.GetLevel() <= log.InfoLevel
+}
+
+// Redact hides secret keys and encoded payloads from traced commands and their output
+func Redact(text string) string {
+	for _, redaction := range redactions {
+		text = redaction.pattern.ReplaceAllString(text, redaction.replace)
+	}
+	return text
+}
+
+func TraceCommand(cmd string) {
+	tracer.Info("ssh", "cmd", Redact(cmd))
+}
+
+func TraceExec(cmd *exec.Cmd) {
+	tracer.Info("exec", "cmd", Redact(strings.Join(cmd.Args, " ")))
+}
+
+func TraceScript(script string, args ...string) {
+	tracer.Info("sh", "args", Redact(strings.Join(args, " ")), "script", Redact(script))
+}
+
+func TraceOutput(stream string, line string) {
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	tracer.Debug(stream, "line", Redact(line))
+}
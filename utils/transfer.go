@@ -0,0 +1,280 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/mightymoud/sidekick/render"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// ImageChunkSize is how much of the image tar one stream sends, a dropped transfer resumes from the chunks on the server
+	ImageChunkSize = 64 << 20
+	// imageTransferStreams chunks go at once, a single SSH stream rarely fills the link on its own
+	imageTransferStreams = 4
+	// transferProgressInterval keeps progress updates from flooding the TUI and the logs
+	transferProgressInterval = time.Second
+)
+
+// TransferResult is what MoveImageTar sent, Sent is less than Size when part of it was on the server from an earlier try
+type TransferResult struct {
+	Size     int64
+	Sent     int64
+	Duration time.Duration
+}
+
+// Throughput is the rate of what was sent, in the units of FormatBytes
+func (r TransferResult) Throughput() string {
+	seconds := r.Duration.Seconds()
+	if seconds <= 0 {
+		return FormatBytes(r.Sent) + "/s"
+	}
+	return FormatBytes(int64(float64(r.Sent)/seconds)) + "/s"
+}
+
+func (r TransferResult) String() string {
+	summary := fmt.Sprintf("Moved %s in %s (%s)", FormatBytes(r.Size), r.Duration.Round(time.Second), r.Throughput())
+	if resumed := r.Size - r.Sent; resumed > 0 {
+		summary += fmt.Sprintf(", %s was already on the server", FormatBytes(resumed))
+	}
+	return summary
+}
+
+// ImageChunk is one piece of the image tar, Part is where it collects on the server
+type ImageChunk struct {
+	Offset int64
+	Length int64
+	Part   string
+}
+
+// GetImageChunks splits a tar of size bytes into chunks, the parts are named after sum so leftovers of another tar never mix in
+func GetImageChunks(remoteFile string, size int64, sum string) []ImageChunk {
+	chunks := []ImageChunk{}
+	for i, offset := 0, int64(0); offset < size || i == 0; i, offset = i+1, offset+ImageChunkSize {
+		chunks = append(chunks, ImageChunk{
+			Offset: offset,
+			Length: min(ImageChunkSize, size-offset),
+			Part:   fmt.Sprintf("%s.%s.part%03d", remoteFile, sum[:12], i),
+		})
+	}
+	return chunks
+}
+
+// GetImagePartsSizeCommand lists the chunks of remoteFile already on the server with their size
+func GetImagePartsSizeCommand(remoteFile string) string {
+	return fmt.Sprintf("stat -c '%%n %%s' %s.*.part* 2>/dev/null || true", remoteFile)
+}
+
+// ParseImagePartSizes reads the output of GetImagePartsSizeCommand
+func ParseImagePartSizes(output string) map[string]int64 {
+	sizes := map[string]int64{}
+	for _, line := range outputLines(output) {
+		name, size, ok := strings.Cut(line, " ")
+		if !ok {
+			continue
+		}
+		if n, err := strconv.ParseInt(strings.TrimSpace(size), 10, 64); err == nil {
+			sizes[name] = n
+		}
+	}
+	return sizes
+}
+
+// GetAssembleImageCommand joins the chunks into remoteFile and checks it is the tar that was sent, every leftover chunk goes either way
+func GetAssembleImageCommand(remoteFile string, chunks []ImageChunk, sum string) string {
+	parts := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		parts[i] = chunk.Part
+	}
+	return fmt.Sprintf("cat %s > %s; rm -f %s.*.part*; %s || { rm -f %s; exit 1; }", strings.Join(parts, " "), remoteFile, remoteFile, GetVerifyRemoteArchiveCommand(remoteFile, sum), remoteFile)
+}
+
+// transferProgress adds up what every stream sent and reports it now and then.
+// What the server already had from an earlier try counts as done, so a resumed transfer doesn't start over at 0%.
+type transferProgress struct {
+	sync.Mutex
+	sent     int64
+	resumed  int64
+	started  bool
+	total    int64
+	reported time.Time
+	report   func(done int64, total int64)
+}
+
+func (p *transferProgress) Write(b []byte) (int, error) {
+	p.Lock()
+	defer p.Unlock()
+	p.sent += int64(len(b))
+	if p.report != nil && time.Since(p.reported) >= transferProgressInterval {
+		p.reported = time.Now()
+		p.report(min(p.resumed+p.sent, p.total), p.total)
+	}
+	return len(b), nil
+}
+
+// resume counts the chunks the server had when the transfer started, later tries already count what they sent
+func (p *transferProgress) resume(chunks []ImageChunk, have map[string]int64) {
+	p.Lock()
+	defer p.Unlock()
+	if p.started {
+		return
+	}
+	p.started = true
+	for _, chunk := range chunks {
+		if n := have[chunk.Part]; n <= chunk.Length {
+			p.resumed += n
+		}
+	}
+}
+
+// TransferTimeLeft guesses how long the rest takes at the rate since the transfer started, base is what was done then.
+// It is 0 until something was sent.
+func TransferTimeLeft(done int64, base int64, total int64, elapsed time.Duration) time.Duration {
+	if done <= base || done >= total {
+		return 0
+	}
+	return time.Duration(float64(elapsed) * float64(total-done) / float64(done-base)).Round(time.Second)
+}
+
+// FormatTransferProgress is the text next to the progress bar, like "42% - 1.2 GB of 2.9 GB, about 1m10s left"
+func FormatTransferProgress(done int64, total int64, left time.Duration) string {
+	text := fmt.Sprintf("%d%% - %s of %s", render.ProgressMsg{Done: done, Total: total}.Percent(), FormatBytes(done), FormatBytes(total))
+	if left > 0 {
+		text += fmt.Sprintf(", about %s left", left)
+	}
+	return text
+}
+
+// TransferProgressToTUI turns the progress of MoveImageTar into a progress bar on the active stage of p.
+// The stage keeps its spinner when the size is not known.
+func TransferProgressToTUI(p *tea.Program) func(done int64, total int64) {
+	start, base := time.Now(), int64(-1)
+	return func(done int64, total int64) {
+		if total <= 0 {
+			return
+		}
+		if base < 0 {
+			// the first report already holds a second of sending, the rate is measured from there
+			start, base = time.Now(), done
+		}
+		left := TransferTimeLeft(done, base, total, time.Since(start))
+		p.Send(render.ProgressMsg{Done: done, Total: total, Text: FormatTransferProgress(done, total, left)})
+	}
+}
+
+// sendChunk appends what the server doesn't have of chunk to its part, gzipped on the way
+func sendChunk(client *ssh.Client, file *os.File, chunk ImageChunk, have int64, progress io.Writer) error {
+	redirect := ">>"
+	if have == 0 || have > chunk.Length {
+		redirect, have = ">", 0
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to create session: %w", err)
+	}
+	defer session.Close()
+
+	reader, writer := io.Pipe()
+	go func() {
+		gz := gzip.NewWriter(writer)
+		_, err := io.Copy(gz, io.TeeReader(io.NewSectionReader(file, chunk.Offset+have, chunk.Length-have), progress))
+		if err == nil {
+			err = gz.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+	var stderr strings.Builder
+	session.Stdin, session.Stderr = reader, &stderr
+	cmd := fmt.Sprintf("gunzip %s %s", redirect, chunk.Part)
+	TraceCommand(cmd)
+	err = session.Run(cmd)
+	// the gzip side may still be waiting on a session that went away
+	reader.CloseWithError(io.ErrClosedPipe)
+	if err != nil {
+		return &RemoteCommandError{Cmd: cmd, Stderr: strings.TrimSpace(stderr.String()), Err: err}
+	}
+	return nil
+}
+
+// MoveImageTar sends the image tar in file to remoteFile on the server in gzipped chunks, several at once.
+// When the connection drops it is opened again and only what the server is missing is sent, progress gets how much of
+// the tar is on the server so far.
+func MoveImageTar(client *ssh.Client, file string, remoteFile string, progress func(done int64, total int64)) (TransferResult, error) {
+	start := time.Now()
+	f, err := os.Open(file)
+	if err != nil {
+		return TransferResult{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return TransferResult{}, err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return TransferResult{}, err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	chunks := GetImageChunks(remoteFile, info.Size(), sum)
+	counter := &transferProgress{total: info.Size(), reported: time.Now(), report: progress}
+
+	_, err = ConnectionRetryPolicy.Do(func() error {
+		conn := liveClient(client)
+		output, err := runCommandOutputOnce(conn, GetImagePartsSizeCommand(remoteFile))
+		if err == nil {
+			have := ParseImagePartSizes(output)
+			counter.resume(chunks, have)
+			group := errgroup.Group{}
+			group.SetLimit(imageTransferStreams)
+			for _, chunk := range chunks {
+				if have[chunk.Part] == chunk.Length {
+					continue
+				}
+				group.Go(func() error {
+					return sendChunk(conn, f, chunk, have[chunk.Part], counter)
+				})
+			}
+			err = group.Wait()
+		}
+		if !IsConnectionError(err) || OperationContext().Err() != nil {
+			return StopRetrying(err)
+		}
+		TraceOutput("stderr", fmt.Sprintf("connection dropped: %s", err))
+		if reconnectErr := reconnect(client, conn); reconnectErr != nil {
+			return StopRetrying(reconnectErr)
+		}
+		return err
+	}, nil)
+	if err != nil {
+		return TransferResult{}, err
+	}
+	if _, err := RunCommandOutput(client, GetAssembleImageCommand(remoteFile, chunks, sum)); err != nil {
+		return TransferResult{}, fmt.Errorf("the image was damaged on its way to the server: %w", err)
+	}
+	return TransferResult{Size: info.Size(), Sent: counter.sent, Duration: time.Since(start)}, nil
+}
@@ -37,30 +37,67 @@ type DockerService struct {
 	DependsOn   map[string]DependsOn `yaml:"depends_on,omitempty"`
 	HealthCheck Healthcheck          `yaml:"healthcheck,omitempty"`
 	EntryPoint  []string             `yaml:"entrypoint,omitempty"`
+	Deploy      *DockerDeploy        `yaml:"deploy,omitempty"`
+	Logging     *DockerLogging       `yaml:"logging,omitempty"`
+	// Extra holds the compose keys sidekick doesn't generate, like extra_hosts from sidekick.override.yaml
+	Extra map[string]any `yaml:",inline"`
+}
+
+// DockerDeploy is read by docker stack deploy only, swarm takes the labels of a service from here
+type DockerDeploy struct {
+	Replicas      int                 `yaml:"replicas,omitempty"`
+	Labels        []string            `yaml:"labels,omitempty"`
+	UpdateConfig  DockerUpdateConfig  `yaml:"update_config,omitempty"`
+	RestartPolicy DockerRestartPolicy `yaml:"restart_policy,omitempty"`
+}
+
+// DockerLogging is the log driver of a service, Options like max-size only apply to drivers that write files
+type DockerLogging struct {
+	Driver  string            `yaml:"driver"`
+	Options map[string]string `yaml:"options,omitempty"`
+}
+
+type DockerUpdateConfig struct {
+	Order         string `yaml:"order,omitempty"`
+	FailureAction string `yaml:"failure_action,omitempty"`
+}
+
+type DockerRestartPolicy struct {
+	Condition string `yaml:"condition,omitempty"`
 }
 
 type DockerNetwork struct {
-	External bool `yaml:"external"`
+	External bool           `yaml:"external"`
+	Extra    map[string]any `yaml:",inline"`
 }
 
 type DockerComposeFile struct {
+	// Version is only set for docker stack deploy, which still wants one
+	Version  string                   `yaml:"version,omitempty"`
 	Services map[string]DockerService `yaml:"services"`
 	Networks map[string]DockerNetwork `yaml:"networks,omitempty"`
 	Volumes  map[string]DockerVolume  `yaml:"volumes,omitempty"`
+	Extra    map[string]any           `yaml:",inline"`
 }
 
 type DockerVolume struct {
-	Driver string `yaml:"driver,omitempty"`
+	Driver string         `yaml:"driver,omitempty"`
+	Extra  map[string]any `yaml:",inline"`
 }
 type SidekickAppEnvConfig struct {
 	File string `yaml:"file"`
-	Hash string `yaml:"hash"`
+	Hash string `yaml:"hash,omitempty"`
 }
 
 type SidekickPreview struct {
-	Url       string `yaml:"url"`
-	Image     string `yaml:"image"`
-	CreatedAt string `yaml:"createdAt"`
+	Url          string   `yaml:"url"`
+	Image        string   `yaml:"image"`
+	CreatedAt    string   `yaml:"createdAt"`
+	EnvOverrides []string `yaml:"envOverrides,omitempty"`
+	// Dirty is set when the preview was built with uncommitted changes, its image tag ends in -dirty-<sum of the changes>
+	Dirty bool `yaml:"dirty,omitempty"`
+	// History holds the earlier images of the preview, newest last, for preview rollback
+	History []string `yaml:"history,omitempty"`
 }
 
 type SidekickAppDatabaseBackupConfig struct {
@@ -77,17 +114,117 @@ type SidekickAppDatabaseConfig struct {
 	Backup SidekickAppDatabaseBackupConfig `yaml:"backup,omitempty"`
 }
 
+type SidekickAppBadgeConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Path    string `yaml:"path,omitempty"`
+}
+
+type SidekickHealthCheckConfig struct {
+	Path     string `yaml:"path,omitempty"`
+	Port     uint64 `yaml:"port,omitempty"`
+	Timeout  int    `yaml:"timeout,omitempty"`
+	Optional bool   `yaml:"optional,omitempty"`
+}
+
+// SidekickLoggingConfig rotates the logs of every service of the app, empty fields get the defaults of DefaultLogging
+type SidekickLoggingConfig struct {
+	Driver  string `yaml:"driver,omitempty"`
+	MaxSize string `yaml:"maxSize,omitempty"`
+	MaxFile int    `yaml:"maxFile,omitempty"`
+}
+
+// SidekickCronJob runs Command in a one-off container of the app on Schedule, a crontab schedule like 0 3 * * *
+type SidekickCronJob struct {
+	Name     string `yaml:"name"`
+	Schedule string `yaml:"schedule"`
+	Command  string `yaml:"command"`
+}
+
+// SidekickAddon is a service sidekick runs next to the app, like its database, at a pinned Version.
+// Persist keeps the data of redis in a volume, Shared has previews use the redis of production instead of their own.
+type SidekickAddon struct {
+	Type    string `yaml:"type"`
+	Version string `yaml:"version"`
+	Persist bool   `yaml:"persist,omitempty"`
+	Shared  bool   `yaml:"shared,omitempty"`
+}
+
+// SidekickRegistryConfig is where images are pushed and pulled, Password names a variable and never holds the secret
+type SidekickRegistryConfig struct {
+	Url      string `yaml:"url"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password,omitempty"`
+}
+
+type SidekickAppTLSConfig struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// Disabled is tls: false in sidekick.yml, the app is served over plain HTTP
+	Disabled bool `yaml:"-"`
+}
+
+// SidekickEntrypointsConfig names the Traefik entrypoints for HTTP and HTTPS, when the server uses other ones than sidekick init sets up
+type SidekickEntrypointsConfig struct {
+	Web       string `yaml:"web,omitempty"`
+	Websecure string `yaml:"websecure,omitempty"`
+}
+
 type SidekickAppConfig struct {
-	Name           string                     `yaml:"name"`
-	Version        string                     `yaml:"version"`
-	Image          string                     `yaml:"image"`
-	Url            string                     `yaml:"url"`
-	Port           uint64                     `yaml:"port"`
-	CreatedAt      string                     `yaml:"createdAt"`
-	Env            SidekickAppEnvConfig       `yaml:"env,omitempty"`
-	DatabaseConfig SidekickAppDatabaseConfig  `yaml:"database,omitempty"`
-	PreviewEnvs    map[string]SidekickPreview `yaml:"previewEnvs,omitempty"`
-	Server         string                     `yaml:"server"`
+	// Schema is the format of sidekick.yml, Version is the deployed version of the app
+	Schema             int                                  `yaml:"schema,omitempty"`
+	Name               string                               `yaml:"name"`
+	Version            string                               `yaml:"version,omitempty"`
+	Image              string                               `yaml:"image,omitempty"`
+	Url                string                               `yaml:"url"`
+	Port               uint64                               `yaml:"port"`
+	CreatedAt          string                               `yaml:"createdAt"`
+	LastDeployedAt     string                               `yaml:"lastDeployedAt,omitempty"`
+	LastDeployedCommit string                               `yaml:"lastDeployedCommit,omitempty"`
+	BuildHash          string                               `yaml:"buildHash,omitempty"`
+	BuildDuration      string                               `yaml:"buildDuration,omitempty"`
+	DeployedVersion    string                               `yaml:"deployedVersion,omitempty"`
+	ImageHistory       []string                             `yaml:"imageHistory,omitempty"`
+	Env                SidekickAppEnvConfig                 `yaml:"env,omitempty"`
+	DatabaseConfig     SidekickAppDatabaseConfig            `yaml:"database,omitempty"`
+	PreviewEnvs        map[string]SidekickPreview           `yaml:"previewEnvs,omitempty"`
+	Server             string                               `yaml:"server"`
+	Badge              SidekickAppBadgeConfig               `yaml:"badge,omitempty"`
+	StagingTLS         bool                                 `yaml:"stagingTls,omitempty"`
+	TLS                SidekickAppTLSConfig                 `yaml:"tls,omitempty"`
+	Entrypoints        SidekickEntrypointsConfig            `yaml:"entrypoints,omitempty"`
+	Labels             []string                             `yaml:"labels,omitempty"`
+	HealthCheck        SidekickHealthCheckConfig            `yaml:"healthCheck,omitempty"`
+	Services           map[string]SidekickHealthCheckConfig `yaml:"services,omitempty"`
+	KeepImages         int                                  `yaml:"keepImages,omitempty"`
+	Registry           SidekickRegistryConfig               `yaml:"registry,omitempty"`
+	Sbom               SidekickSbom                         `yaml:"sbom,omitempty"`
+	Timeout            string                               `yaml:"timeout,omitempty"`
+	LockTimeout        string                               `yaml:"lockTimeout,omitempty"`
+	VerifyTimeout      string                               `yaml:"verifyTimeout,omitempty"`
+	Cron               []SidekickCronJob                    `yaml:"cron,omitempty"`
+	Addons             []SidekickAddon                      `yaml:"addons,omitempty"`
+	Orchestrator       string                               `yaml:"orchestrator,omitempty"`
+	Static             string                               `yaml:"static,omitempty"`
+	PreviewDomain      string                               `yaml:"previewDomain,omitempty"`
+	Logging            SidekickLoggingConfig                `yaml:"logging,omitempty"`
+	Notifications      []SidekickNotification               `yaml:"notifications,omitempty"`
+	// Networks are docker networks on the server the app joins on top of the one it shares with Traefik
+	Networks []string `yaml:"networks,omitempty"`
+	// ComposeOverride is sidekick.override.yaml, nil when there is none
+	ComposeOverride *DockerComposeFile `yaml:"-"`
+	// StateRevision is the revision of state.yml on the server the state fields were loaded from
+	StateRevision int `yaml:"-"`
+	// Network is the docker network of the server the app runs on, commands set it from the server they target
+	Network string `yaml:"-"`
+}
+
+// SidekickSbom is the sbom of the deployed version, Remote is empty unless it was uploaded
+type SidekickSbom struct {
+	Version string `yaml:"version,omitempty"`
+	Format  string `yaml:"format,omitempty"`
+	Path    string `yaml:"path,omitempty"`
+	Digest  string `yaml:"digest,omitempty"`
+	Remote  string `yaml:"remote,omitempty"`
 }
 type EnvVar map[string]string
 
@@ -96,6 +233,30 @@ type SidekickConfig struct {
 	Servers        []SidekickServer  `yaml:"servers"`
 	Contexts       []SidekickContext `yaml:"contexts"`
 	CurrentContext string            `yaml:"current-context"`
+	DeployPolicy   DeployPolicy      `yaml:"deployPolicy,omitempty"`
+	Backup         BackupConfig      `yaml:"backup,omitempty"`
+	// Notifications get a message about every deploy and preview of every app, on top of those in sidekick.yml
+	Notifications []SidekickNotification `yaml:"notifications,omitempty"`
+}
+
+// SidekickNotification is a webhook told when a deploy starts, succeeds or fails.
+// The URL may name an env var like $SLACK_WEBHOOK_URL so the secret stays out of the file.
+type SidekickNotification struct {
+	URL string `yaml:"url"`
+	// Format is slack, the default, for Slack and Discord or json for the whole event
+	Format string `yaml:"format,omitempty"`
+}
+
+// BackupConfig is where sidekick backup writes when --dest is not passed and how many backups it keeps there.
+// Endpoint points the aws cli at an S3 compatible store other than AWS.
+type BackupConfig struct {
+	Dest     string `yaml:"dest,omitempty"`
+	Endpoint string `yaml:"endpoint,omitempty"`
+	Keep     int    `yaml:"keep,omitempty"`
+}
+
+type DeployPolicy struct {
+	ConfirmContexts []string `yaml:"confirmContexts,omitempty"`
 }
 
 type SidekickServer struct {
@@ -106,6 +267,46 @@ type SidekickServer struct {
 	CertEmail  string `yaml:"certemail"`
 	PublicKey  string `yaml:"publickey"`
 	SecretKey  string `yaml:"secretkey"`
+	Firewall   string `yaml:"firewall,omitempty"`
+	// Runtime is docker or podman, Compose is only set when podman needs podman-compose
+	Runtime string `yaml:"runtime,omitempty"`
+	Compose string `yaml:"compose,omitempty"`
+	// HostKey is pinned on the first connection, every later one has to present it
+	HostKey string `yaml:"hostkey,omitempty"`
+	// DNSChallenge adds a Traefik resolver for wildcard certs, its credentials stay on the server
+	DNSChallenge SidekickDNSChallenge `yaml:"dnschallenge,omitempty"`
+	// Observability is what sidekick observability runs on the server next to the apps
+	Observability SidekickObservability `yaml:"observability,omitempty"`
+	// Network is the docker network Traefik reaches the apps on, sidekick unless init was given another one
+	Network string `yaml:"network,omitempty"`
+}
+
+type SidekickObservability struct {
+	Logs    SidekickLogsStack    `yaml:"logs,omitempty"`
+	Metrics SidekickMetricsStack `yaml:"metrics,omitempty"`
+}
+
+// SidekickLogsStack is where Loki answers behind Traefik and the basic auth in front of it
+type SidekickLogsStack struct {
+	Domain    string `yaml:"domain,omitempty"`
+	User      string `yaml:"user,omitempty"`
+	Password  string `yaml:"password,omitempty"`
+	Retention string `yaml:"retention,omitempty"`
+}
+
+// SidekickMetricsStack is how long Prometheus keeps what it scrapes and how often, Grafana only runs when Domain is set
+type SidekickMetricsStack struct {
+	Enabled   bool   `yaml:"enabled,omitempty"`
+	Retention string `yaml:"retention,omitempty"`
+	Interval  string `yaml:"interval,omitempty"`
+	Domain    string `yaml:"domain,omitempty"`
+	User      string `yaml:"user,omitempty"`
+	Password  string `yaml:"password,omitempty"`
+}
+
+// SidekickDNSChallenge names the lego DNS provider Traefik proves domain ownership with, like cloudflare
+type SidekickDNSChallenge struct {
+	Provider string `yaml:"provider,omitempty"`
 }
 
 type SidekickContext struct {
@@ -16,7 +16,9 @@ package utils
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/md5"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"os"
@@ -26,29 +28,42 @@ import (
 	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
-	"github.com/charmbracelet/log"
 	"github.com/joho/godotenv"
 	"github.com/mightymoud/sidekick/render"
-	"github.com/pterm/pterm"
-	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"golang.org/x/crypto/ssh"
-	"gopkg.in/yaml.v3"
 )
 
 type CommandsStage struct {
+	Name                  string
+	Idempotent            bool
 	Commands              []string
 	SpinnerSuccessMessage string
 	SpinnerFailMessage    string
 }
 
 func RunCommand(client *ssh.Client, cmd string) (chan string, chan string, error) {
+	TraceCommand(cmd)
+	var stdOutChannel, errChannel chan string
+	err := runWithReconnect(client, cmd, func(conn *ssh.Client) error {
+		var err error
+		stdOutChannel, errChannel, err = runCommandOnce(conn, cmd)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return stdOutChannel, errChannel, nil
+}
+
+func runCommandOnce(client *ssh.Client, cmd string) (chan string, chan string, error) {
+	cmd = RuntimeCommand(client, cmd)
 	session, err := client.NewSession()
-	errChannel := make(chan string)
-	stdOutChannel := make(chan string)
 	if err != nil {
-		log.Fatalf("Failed to create session: %s", err)
+		return nil, nil, fmt.Errorf("failed to create session: %w", err)
 	}
+	errChannel := make(chan string)
+	stdOutChannel := make(chan string)
 	defer session.Close()
 	// Need to hook into the pipe of output coming from that session
 	stdoutReader, err := session.StdoutPipe()
@@ -67,6 +82,7 @@ func RunCommand(client *ssh.Client, cmd string) (chan string, chan string, error
 	// start separate go routines to read from the pipes and print out
 	go func() {
 		for stdoutScanner.Scan() {
+			TraceOutput("stdout", stdoutScanner.Text())
 			stdOutChannel <- stdoutScanner.Text()
 			// fmt.Printf("\033[34m[STDOUT]\033[0m %s\n", stdoutScanner.Text())
 		}
@@ -74,71 +90,115 @@ func RunCommand(client *ssh.Client, cmd string) (chan string, chan string, error
 
 	go func() {
 		for stderrScanner.Scan() {
+			TraceOutput("stderr", stderrScanner.Text())
 			errChannel <- stderrScanner.Text()
 			// fmt.Printf("\n\033[31m[STDERR]\033[0m %s\n", stderrScanner.Text())
 		}
 	}()
 
 	if err := session.Run(cmd); err != nil {
-		defer session.Close()
-		errString := <-errChannel
-		return nil, nil, fmt.Errorf("error running command - %s: - %s", cmd, errString)
+		if IsConnectionError(err) {
+			return nil, nil, err
+		}
+		errString := ""
+		select {
+		case errString = <-errChannel:
+		case <-time.After(time.Second):
+		}
+		return nil, nil, &RemoteCommandError{Cmd: cmd, Stderr: strings.TrimSpace(errString), Err: err}
 	}
 
 	time.Sleep(time.Millisecond * 500)
 	return stdOutChannel, errChannel, nil
 }
 
-func RunCommandWithTUIHook(client *ssh.Client, cmd string, p *tea.Program, envVars ...EnvVar) {
+// RunCommandOutput runs cmd and returns all of its stdout, for commands whose output gets parsed instead of streamed
+func RunCommandOutput(client *ssh.Client, cmd string) (string, error) {
+	TraceCommand(cmd)
+	var output string
+	err := runWithReconnect(client, cmd, func(conn *ssh.Client) error {
+		var err error
+		output, err = runCommandOutputOnce(conn, cmd)
+		return err
+	})
+	return output, err
+}
+
+func runCommandOutputOnce(client *ssh.Client, cmd string) (string, error) {
+	cmd = RuntimeCommand(client, cmd)
+	session, err := client.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("failed to create session: %w", err)
+	}
+	defer session.Close()
+
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	output, err := session.Output(cmd)
+	TraceOutput("stdout", string(output))
+	TraceOutput("stderr", stderr.String())
+	if err != nil {
+		return string(output), &RemoteCommandError{Cmd: cmd, Stderr: strings.TrimSpace(stderr.String()), Err: err}
+	}
+	return string(output), nil
+}
+
+// RunCommandWithTUIHook streams the output of cmd to the TUI, an idempotent cmd runs again from the start when the connection drops
+func RunCommandWithTUIHook(client *ssh.Client, cmd string, p *tea.Program, envVars ...EnvVar) error {
+	TraceCommand(cmd)
+	return runWithReconnect(client, cmd, func(conn *ssh.Client) error {
+		return runCommandWithTUIHookOnce(conn, cmd, p, envVars...)
+	})
+}
+
+func runCommandWithTUIHookOnce(client *ssh.Client, cmd string, p *tea.Program, envVars ...EnvVar) error {
+	cmd = RuntimeCommand(client, cmd)
 	session, err := client.NewSession()
 	if err != nil {
-		log.Fatalf("Failed to create session: %s", err)
+		return fmt.Errorf("failed to create session: %w", err)
 	}
 	defer session.Close()
 
 	for _, env := range envVars {
 		for key, value := range env {
-			err := session.Setenv(key, value)
-			if err != nil {
-				p.Send(render.ErrorMsg{ErrorStr: fmt.Sprintf("error is:%s", err)})
+			if err := session.Setenv(key, value); err != nil {
+				return fmt.Errorf("failed to set env on session: %w", err)
 			}
 		}
 	}
 
 	stdoutReader, err := session.StdoutPipe()
 	if err != nil {
-		p.Send(render.ErrorMsg{ErrorStr: fmt.Sprintf("error running command - %s: - %s", cmd, err) + err.Error()})
+		return fmt.Errorf("error running command - %s: - %s", cmd, err)
 	}
 	stderrReader, err := session.StderrPipe()
 	if err != nil {
-		p.Send(render.ErrorMsg{ErrorStr: fmt.Sprintf("error running command - %s: - %s", cmd, err) + err.Error()})
+		return fmt.Errorf("error running command - %s: - %s", cmd, err)
 	}
 
 	stdoutScanner := bufio.NewScanner(stdoutReader)
 	stderrScanner := bufio.NewScanner(stderrReader)
 
 	if err := session.Start(cmd); err != nil {
-		time.Sleep(time.Millisecond * 100)
-		p.Send(render.ErrorMsg{ErrorStr: fmt.Sprintf("error running command - %s: - %s", cmd, err) + err.Error()})
+		return &RemoteCommandError{Cmd: cmd, Err: err}
 	}
 
 	for stdoutScanner.Scan() {
+		TraceOutput("stdout", stdoutScanner.Text())
 		p.Send(render.LogMsg{LogLine: stdoutScanner.Text() + "\n"})
 		time.Sleep(time.Millisecond * 50)
 	}
 
 	for stderrScanner.Scan() {
+		TraceOutput("stderr", stderrScanner.Text())
 		p.Send(render.LogMsg{LogLine: stderrScanner.Text() + "\n"})
 		time.Sleep(time.Millisecond * 50)
 	}
 
 	if err := session.Wait(); err != nil {
-		if len(cmd) >= 80 {
-			p.Send(render.ErrorMsg{ErrorStr: fmt.Sprintf("Failed with following error - %s", err) + err.Error()})
-		} else {
-			p.Send(render.ErrorMsg{ErrorStr: fmt.Sprintf("error running command - %s: - %s", cmd, err) + err.Error()})
-		}
+		return &RemoteCommandError{Cmd: cmd, Err: err}
 	}
+	return nil
 }
 
 func RunCommands(client *ssh.Client, commands []string) error {
@@ -154,11 +214,67 @@ func RunCommands(client *ssh.Client, commands []string) error {
 
 func RunCommandsWithTUIHook(client *ssh.Client, commands []string, p *tea.Program) error {
 	for _, cmd := range commands {
-		RunCommandWithTUIHook(client, cmd, p)
+		if err := RunCommandWithTUIHook(client, cmd, p); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// pullCommand matches image pulls, they are safe to retry even in a stage that isn't
+var pullCommand = regexp.MustCompile(`^(cd [^&]+ && )?(sudo )?docker (compose -p [a-z0-9-]+ )?pull\b`)
+
+// RunStageWithTUIHook runs the stage commands in order, retrying each one when the stage is marked idempotent and the pulls in any stage
+func RunStageWithTUIHook(client *ssh.Client, stage CommandsStage, p *tea.Program, report *RetryReport) error {
+	for _, cmd := range stage.Commands {
+		if !stage.Idempotent && !pullCommand.MatchString(cmd) {
+			if err := RunCommandWithTUIHook(client, cmd, p); err != nil {
+				return err
+			}
+			continue
+		}
+		attempts, err := DefaultRetryPolicy.Do(func() error {
+			return RunCommandWithTUIHook(client, cmd, p)
+		}, func(attempt int, attempts int, err error) {
+			p.Send(render.LogMsg{LogLine: fmt.Sprintf("%s - attempt %d/%d\n", err, attempt, attempts)})
+		})
+		report.Record(stage.Name, attempts)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteRemoteFile writes content to path on the server, going through base64 so quotes in the content survive the shell
+func WriteRemoteFile(client *ssh.Client, path string, content []byte) error {
+	_, _, err := RunCommand(client, fmt.Sprintf("echo '%s' | base64 -d > %s", base64.StdEncoding.EncodeToString(content), path))
+	return err
+}
+
+func GetGitShortHash() (string, error) {
+	gitShortHashCmd := exec.Command("git", "rev-parse", "--short", "HEAD")
+	hashOutput, err := gitShortHashCmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(hashOutput), "\n"), nil
+}
+
+// GetGitBranch returns an empty branch for a detached HEAD
+func GetGitBranch() (string, error) {
+	gitBranchCmd := exec.Command("git", "rev-parse", "--abbrev-ref", "HEAD")
+	branchOutput, err := gitBranchCmd.Output()
+	if err != nil {
+		return "", err
+	}
+	branch := strings.TrimSuffix(string(branchOutput), "\n")
+	if branch == "HEAD" {
+		return "", nil
+	}
+	return branch, nil
+}
+
 func RunStage(client *ssh.Client, stage CommandsStage) error {
 	if err := RunCommands(client, stage.Commands); err != nil {
 		return err
@@ -185,64 +301,115 @@ func FileExists(filename string) bool {
 	return false
 }
 
+// ViperInit binds the SIDEKICK_* env vars so a runner can work without a config file.
+// SIDEKICK_CONFIG points at another config file, the server keys describe a server on their own.
 func ViperInit() error {
-	home, err := os.UserHomeDir()
-	cobra.CheckErr(err)
-
-	configPath := fmt.Sprintf("%s/.config/sidekick", home)
-
-	viper.AddConfigPath(configPath)
-	viper.SetConfigType("yaml")
-	viper.SetConfigName("default")
-	err = viper.ReadInConfig()
-	if err != nil {
+	viper.SetEnvPrefix(EnvPrefix)
+	if err := viper.BindEnv("config", "SIDEKICK_CONFIG"); err != nil {
+		return err
+	}
+	if err := viper.BindEnv("assume_yes", AssumeYesEnv); err != nil {
+		return err
+	}
+	for _, value := range append(append([]EnvConfigValue{}, envServerValues...), envGlobalValues...) {
+		if err := viper.BindEnv(value.Key); err != nil {
+			return err
+		}
+	}
+	if err := viper.BindEnv("ssh_key_path", SSHKeyPathEnv); err != nil {
 		return err
 	}
 	return nil
 }
 
 func LoadAppConfig() (SidekickAppConfig, error) {
-	if !FileExists("./sidekick.yml") {
+	if !FileExists(AppConfigFile) {
 		return SidekickAppConfig{}, errors.New("Sidekick app config not found. Please run sidekick launch first")
 	}
-	appConfigFile := SidekickAppConfig{}
-	content, err := os.ReadFile("./sidekick.yml")
+	content, err := os.ReadFile(AppConfigFile)
 	if err != nil {
-		pterm.Error.Println("Unable to process your project config")
-		os.Exit(1)
+		return SidekickAppConfig{}, fmt.Errorf("unable to read %s: %w", AppConfigFile, err)
 	}
-	if err := yaml.Unmarshal(content, &appConfigFile); err != nil {
-		panic(err)
+	// the migrated file is only written back when a command saves sidekick.yml
+	content, _, err = MigrateAppConfig(content)
+	if err != nil {
+		return SidekickAppConfig{}, err
+	}
+	// files that are gitignored, like the env file, are only required by the commands using them
+	appConfigFile, problems, err := parseSelectedAppConfig(content, false)
+	if err != nil {
+		return SidekickAppConfig{}, err
+	}
+	if len(problems) > 0 {
+		return appConfigFile, &ConfigProblemsError{Problems: problems}
+	}
+	if appConfigFile.ComposeOverride, err = LoadComposeOverride(); err != nil {
+		return appConfigFile, err
 	}
-
 	return appConfigFile, nil
 }
 
-func HandleEnvFile(envFileName string, dockerEnvProperty *[]string, envFileChecksum *string, publicKey string) error {
+// GetDockerEnvProperty maps every key of the env file to a compose environment entry that sops fills in at runtime
+func GetDockerEnvProperty(envFileName string) ([]string, error) {
 	envFile, envFileErr := os.Open(fmt.Sprintf("./%s", envFileName))
 	if envFileErr != nil {
-		return envFileErr
+		return nil, envFileErr
 	}
+	defer envFile.Close()
 	envMap, envParseErr := godotenv.Parse(envFile)
 	if envParseErr != nil {
-		return envParseErr
+		return nil, envParseErr
 	}
 
+	dockerEnvProperty := []string{}
 	for key := range envMap {
 		if strings.HasPrefix(key, "_") {
 			continue
 		}
-		*dockerEnvProperty = append(*dockerEnvProperty, fmt.Sprintf("%s=${%s}", key, key))
+		dockerEnvProperty = append(dockerEnvProperty, fmt.Sprintf("%s=${%s}", key, key))
+	}
+	return dockerEnvProperty, nil
+}
+
+// EnvFileHash is the hash stored in sidekick.yml to tell whether the env file changed since it was last encrypted.
+// It hashes the parsed variables, so launch, deploy, the dry run and status agree whatever the comments or order in the file.
+func EnvFileHash(envFileName string) (string, error) {
+	envFile, err := os.Open(fmt.Sprintf("./%s", envFileName))
+	if err != nil {
+		return "", err
+	}
+	defer envFile.Close()
+	envMap, err := godotenv.Parse(envFile)
+	if err != nil {
+		return "", err
+	}
+	envFileContent, err := godotenv.Marshal(envMap)
+	if err != nil {
+		return "", err
 	}
+	return fmt.Sprintf("%x", md5.Sum([]byte(envFileContent))), nil
+}
+
+func HandleEnvFile(envFileName string, dockerEnvProperty *[]string, envFileChecksum *string, publicKey string) error {
 	// calculate and store the hash of env file to re-encrypt later on when changed
-	envFileContent, _ := godotenv.Marshal(envMap)
-	*envFileChecksum = fmt.Sprintf("%x", md5.Sum([]byte(envFileContent)))
-	envCmd := exec.Command("sops",
+	checksum, err := EnvFileHash(envFileName)
+	if err != nil {
+		return err
+	}
+	*envFileChecksum = checksum
+
+	envProperty, err := GetDockerEnvProperty(envFileName)
+	if err != nil {
+		return err
+	}
+	*dockerEnvProperty = append(*dockerEnvProperty, envProperty...)
+	envCmd := OperationCommand("sops",
 		"encrypt",
 		"--output-type", "dotenv",
 		"--age", publicKey,
 		fmt.Sprintf("./%s", envFileName),
 	)
+	TraceExec(envCmd)
 	outfile, err := os.Create("encrypted.env")
 	if err != nil {
 		return err
@@ -256,7 +423,7 @@ func HandleEnvFile(envFileName string, dockerEnvProperty *[]string, envFileCheck
 }
 
 func WriteEnvFile(filename string, env map[string]string) error {
-	f, err := os.Open(filename)
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
 	if err != nil {
 		return fmt.Errorf("error openign file: %w", err)
 	}
@@ -274,3 +441,37 @@ func WriteEnvFile(filename string, env map[string]string) error {
 	}
 	return nil
 }
+
+// ParseEnvOverrides turns KEY=VALUE pairs passed on the command line into a map
+func ParseEnvOverrides(pairs []string) (map[string]string, error) {
+	overrides := map[string]string{}
+	for _, pair := range pairs {
+		key, value, found := strings.Cut(pair, "=")
+		if !found || key == "" {
+			return nil, fmt.Errorf("invalid env override %q - expected KEY=VALUE", pair)
+		}
+		overrides[key] = value
+	}
+	return overrides, nil
+}
+
+// MergeEnvFile writes envFileName with the overrides applied on top into outFileName.
+// The original env file is never touched so overrides don't leak into it.
+func MergeEnvFile(envFileName string, overrides map[string]string, outFileName string) error {
+	envMap := map[string]string{}
+	if envFileName != "" {
+		envFile, err := os.Open(fmt.Sprintf("./%s", envFileName))
+		if err != nil {
+			return err
+		}
+		defer envFile.Close()
+		envMap, err = godotenv.Parse(envFile)
+		if err != nil {
+			return err
+		}
+	}
+	for key, value := range overrides {
+		envMap[key] = value
+	}
+	return WriteEnvFile(outFileName, envMap)
+}
@@ -1,14 +1,37 @@
 package utils_test
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
 	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/joho/godotenv"
+	"github.com/mightymoud/sidekick/internal/remotetest"
+	"github.com/mightymoud/sidekick/render"
 	"github.com/mightymoud/sidekick/utils"
+	"github.com/spf13/cobra"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v3"
 )
 
 func TestHandleEnvFile(t *testing.T) {
@@ -40,12 +63,36 @@ func TestHandleEnvFile(t *testing.T) {
 	expectedChecksum := fmt.Sprintf("%x", md5.Sum([]byte(envFileContent)))
 	assert.Equal(t, expectedChecksum, envFileChecksum)
 }
+
+func TestEnvFileHash(t *testing.T) {
+	cwd, _ := os.Getwd()
+	dir := t.TempDir()
+	assert.NoError(t, os.Chdir(dir))
+	defer os.Chdir(cwd)
+
+	assert.NoError(t, os.WriteFile(".env", []byte("# launch\nKEY2=value2\nKEY1=value1\n"), 0600))
+	hash, err := utils.EnvFileHash(".env")
+	assert.NoError(t, err)
+	envFileContent, _ := godotenv.Marshal(map[string]string{"KEY1": "value1", "KEY2": "value2"})
+	assert.Equal(t, fmt.Sprintf("%x", md5.Sum([]byte(envFileContent))), hash, "launch and deploy store the same hash")
+
+	appConfig := utils.SidekickAppConfig{Env: utils.SidekickAppEnvConfig{File: ".env", Hash: hash}}
+	changed, err := utils.EnvFileChanged(appConfig)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	assert.NoError(t, os.WriteFile(".env", []byte("KEY1=value1\nKEY2=other\n"), 0600))
+	changed, _ = utils.EnvFileChanged(appConfig)
+	assert.True(t, changed)
+
+	_, err = utils.EnvFileHash("missing.env")
+	assert.Error(t, err)
+}
 func TestLoadAppConfig(t *testing.T) {
 	configContent := `
 name: test
 version: V1
 image: ""
-url: MOCK_URL
+url: mock.example.com
 port: 3000
 createdAt: Mon Nov 11 21:42:50 KST 2024
 `
@@ -58,7 +105,7 @@ createdAt: Mon Nov 11 21:42:50 KST 2024
 
 	assert.Equal(t, "test", appConfig.Name)
 	assert.Equal(t, "V1", appConfig.Version)
-	assert.Equal(t, "MOCK_URL", appConfig.Url)
+	assert.Equal(t, "mock.example.com", appConfig.Url)
 }
 
 func TestLoadAppConfig_FileNotFound(t *testing.T) {
@@ -68,3 +115,2123 @@ func TestLoadAppConfig_FileNotFound(t *testing.T) {
 	assert.Error(t, err)
 	assert.Equal(t, "Sidekick app config not found. Please run sidekick launch first", err.Error())
 }
+
+func TestSaveAppConfig_KeepsExistingConfig(t *testing.T) {
+	configContent := `# deployed by the platform team
+name: test
+version: V1
+image: test
+url: test.example.com
+port: 3000
+createdAt: Mon Nov 11 21:42:50 KST 2024
+env:
+    file: .env.production
+    hash: abc123
+badge:
+    enabled: true
+    path: /status.json
+previewEnvs:
+    a1b2c3d:
+        url: a1b2c3d.test.example.com
+        image: test:a1b2c3d
+        createdAt: Tue Nov 12 10:00:00 KST 2024
+x-team: platform # not a sidekick key
+`
+	err := os.WriteFile("sidekick.yml", []byte(configContent), 0644)
+	assert.NoError(t, err)
+	defer os.Remove("sidekick.yml")
+	defer os.Remove("sidekick.yml.bak")
+
+	appConfig, err := utils.LoadAppConfig()
+	assert.NoError(t, err)
+
+	// what launch does when reconfiguring: only answered fields change
+	appConfig.Port = 8080
+	appConfig.Url = "new.example.com"
+	err = utils.SaveAppConfig(appConfig)
+	assert.NoError(t, err)
+
+	saved, err := utils.LoadAppConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(8080), saved.Port)
+	assert.Equal(t, "new.example.com", saved.Url)
+	assert.Equal(t, "Mon Nov 11 21:42:50 KST 2024", saved.CreatedAt)
+	assert.Equal(t, ".env.production", saved.Env.File)
+	assert.True(t, saved.Badge.Enabled)
+	assert.Equal(t, "/status.json", saved.Badge.Path)
+	// the state of the app moved to state.yml on the server
+	assert.Empty(t, saved.Env.Hash)
+	assert.Empty(t, saved.Version)
+	assert.Empty(t, saved.PreviewEnvs)
+
+	content, err := os.ReadFile("sidekick.yml")
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "# deployed by the platform team")
+	assert.Contains(t, string(content), "x-team: platform # not a sidekick key")
+}
+
+func TestRedact(t *testing.T) {
+	cmd := `cd app && export SOPS_AGE_KEY=AGE-SECRET-KEY-1QQQQQQQQQQQQ && sops exec-env encrypted.env 'docker compose up -d'`
+	redacted := utils.Redact(cmd)
+	assert.NotContains(t, redacted, "AGE-SECRET-KEY-1QQQQQQQQQQQQ")
+	assert.Contains(t, redacted, "SOPS_AGE_KEY=<redacted>")
+	assert.Contains(t, redacted, "docker compose up -d")
+
+	assert.Equal(t, "key is <redacted>", utils.Redact("key is AGE-SECRET-KEY-1ABC234"))
+}
+
+func TestResolveTarget(t *testing.T) {
+	config := &utils.SidekickConfig{
+		Servers: []utils.SidekickServer{
+			{Name: "prod", Address: "10.0.0.1"},
+			{Name: "staging", Address: "10.0.0.2"},
+		},
+		Contexts: []utils.SidekickContext{
+			{Name: "production", Server: "prod"},
+			{Name: "staging", Server: "staging"},
+		},
+		CurrentContext: "staging",
+	}
+	newCmd := func(context string) *cobra.Command {
+		cmd := &cobra.Command{}
+		cmd.Flags().String("context", "", "")
+		if context != "" {
+			cmd.Flags().Set("context", context)
+		}
+		return cmd
+	}
+
+	target, err := utils.ResolveTarget(newCmd(""), config, "", "production")
+	assert.NoError(t, err)
+	assert.Equal(t, "staging", target.Context)
+	assert.Equal(t, utils.TargetSelectedByDefault, target.SelectedBy)
+
+	target, err = utils.ResolveTarget(newCmd(""), config, "prod", "production")
+	assert.NoError(t, err)
+	assert.Equal(t, "production", target.Context)
+	assert.Equal(t, "10.0.0.1", target.Server.Address)
+	assert.Equal(t, utils.TargetSelectedByApp, target.SelectedBy)
+
+	target, err = utils.ResolveTarget(newCmd("production"), config, "prod", "production")
+	assert.NoError(t, err)
+	assert.Equal(t, utils.TargetSelectedByFlag, target.SelectedBy)
+
+	_, err = utils.ResolveTarget(newCmd("staging"), config, "prod", "production")
+	assert.Error(t, err)
+}
+
+func TestResolveGitRef(t *testing.T) {
+	head, err := utils.ResolveGitRef("HEAD")
+	assert.NoError(t, err)
+	shortHash, _ := utils.GetGitShortHash()
+	assert.Equal(t, shortHash, head.ShortSha)
+	assert.NoError(t, utils.CheckGitRefAncestry(head, head.ShortSha))
+
+	_, err = utils.ResolveGitRef("sidekick-no-such-ref")
+	assert.Error(t, err)
+
+	dir, cleanup, err := utils.ExportGitRef(head)
+	assert.NoError(t, err)
+	assert.FileExists(t, dir+"/utils.go")
+	cleanup()
+	assert.NoDirExists(t, dir)
+}
+
+func TestRemoteLayoutWithFakeExecutor(t *testing.T) {
+	remote := remotetest.NewFakeExecutor().On("mkdir -p", "created myapp\n\nfixed mode of myapp/backups to 700\n", nil)
+	repairs, err := utils.BootstrapRemoteLayout(remote, "myapp")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"created myapp", "fixed mode of myapp/backups to 700"}, repairs)
+
+	remote = remotetest.NewFakeExecutor().On("problems=0", "missing myapp/secrets\n", fmt.Errorf("exit status 1"))
+	problems, err := utils.CheckRemoteLayout(remote, "myapp")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"missing myapp/secrets"}, problems)
+	assert.False(t, remote.Ran("mkdir"))
+
+	remote = remotetest.NewFakeExecutor().On("problems=0", "", fmt.Errorf("connection lost"))
+	_, err = utils.CheckRemoteLayout(remote, "myapp")
+	assert.Error(t, err)
+
+	remote = remotetest.NewFakeExecutor().On("problems=0", "myapp/secrets has mode 755 instead of 700\nmyapp/encrypted.env is readable by other users\n", fmt.Errorf("exit status 1"))
+	check := utils.CheckAppLayout(remote, "myapp")
+	assert.Equal(t, utils.DoctorFail, check.Status)
+	assert.Equal(t, "myapp/secrets has mode 755 instead of 700 (+1 more)", check.Detail)
+	remote = remotetest.NewFakeExecutor().On("problems=0", "missing myapp\nmissing myapp/preview\n", fmt.Errorf("exit status 1"))
+	assert.Equal(t, utils.DoctorWarn, utils.CheckAppLayout(remote, "myapp").Status, "an app that was never launched is not broken")
+	assert.Equal(t, utils.DoctorPass, utils.CheckAppLayout(remotetest.NewFakeExecutor(), "myapp").Status)
+}
+
+func TestIsNewerVersion(t *testing.T) {
+	assert.True(t, utils.IsNewerVersion("v0.7.0", "v0.6.9"))
+	assert.True(t, utils.IsNewerVersion("v1.0.0", "0.9.12"))
+	assert.False(t, utils.IsNewerVersion("v0.6.9", "v0.6.9"))
+	assert.False(t, utils.IsNewerVersion("v0.6.1", "v0.6.10"))
+	assert.False(t, utils.IsNewerVersion("v0.7.0", "dev"))
+	assert.False(t, utils.IsNewerVersion("", "v0.6.9"))
+}
+
+func TestPruneAppImages(t *testing.T) {
+	images := "V9 aaa\nV10 bbb\nV8 ccc\nV7 ddd\n3f2a1c eee\nV6 fff\n"
+	remote := remotetest.NewFakeExecutor().
+		On("docker image ls myapp", images, nil).
+		On("docker ps -aq", "sha256:ddd\nsha256:eee\n", nil).
+		On("df --output", "1000\n", nil)
+	result, err := utils.PruneAppImages(remote, "myapp", 3)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"myapp:V6"}, result.Removed)
+	assert.True(t, remote.Ran("docker rmi myapp:V6 && docker image prune -f"))
+
+	remote = remotetest.NewFakeExecutor().
+		On("docker image ls myapp", images, nil).
+		On("docker ps -aq", "", nil)
+	remove, err := utils.ImagesToPrune(remote, "myapp", 2, utils.ProtectedImages(utils.SidekickAppConfig{Image: "myapp:V7", PreviewEnvs: map[string]utils.SidekickPreview{"abc": {Image: "myapp:abc", History: []string{"myapp:V6"}}}})...)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"myapp:V8"}, remove)
+	assert.False(t, remote.Ran("docker rmi"))
+
+	remote = remotetest.NewFakeExecutor().On("docker image ls myapp", "V2 aaa\nV1 bbb\n", nil)
+	result, err = utils.PruneAppImages(remote, "myapp", 3)
+	assert.NoError(t, err)
+	assert.Empty(t, result.Removed)
+	assert.False(t, remote.Ran("docker rmi"))
+}
+
+func TestDockerignoreRsyncFilters(t *testing.T) {
+	dockerignore := "# deps\nnode_modules/\n*.log\n\n!keep.log\n/dist\n"
+	assert.Equal(t, []string{"--exclude=/dist", "--include=/keep.log", "--exclude=/*.log", "--exclude=/node_modules"}, utils.DockerignoreRsyncFilters(dockerignore))
+	assert.Empty(t, utils.DockerignoreRsyncFilters(""))
+}
+
+func TestApplyEnvServer(t *testing.T) {
+	config := utils.SidekickConfig{Version: "1"}
+	config.ApplyEnvServer(utils.SidekickServer{Name: "prod", Address: "1.2.3.4", SecretKey: "secret"})
+	server, err := config.FindServerByContext(config.CurrentContext)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.2.3.4", server.Address)
+	assert.Equal(t, "linux/amd64", server.PlatformId)
+
+	config = utils.SidekickConfig{
+		Version:        "1",
+		Servers:        []utils.SidekickServer{{Name: "prod", Address: "1.2.3.4", PlatformId: "linux/arm64", PublicKey: "age1"}},
+		Contexts:       []utils.SidekickContext{{Name: "prod", Server: "prod"}},
+		CurrentContext: "staging",
+	}
+	config.ApplyEnvServer(utils.SidekickServer{Name: "prod", Address: "5.6.7.8"})
+	server, err = config.FindServer("prod")
+	assert.NoError(t, err)
+	assert.Equal(t, utils.SidekickServer{Name: "prod", Address: "5.6.7.8", PlatformId: "linux/arm64", PublicKey: "age1"}, server)
+	assert.Equal(t, "staging", config.CurrentContext)
+	assert.Len(t, config.Contexts, 1)
+}
+
+func TestEnvConfigOverrides(t *testing.T) {
+	assert.NoError(t, utils.ViperInit())
+	file := utils.SidekickConfig{
+		Version:        "1",
+		Servers:        []utils.SidekickServer{{Name: "prod", Address: "1.2.3.4", PublicKey: "age1file", SecretKey: "AGE-SECRET-KEY-FILE", CertEmail: "file@example.com"}},
+		Contexts:       []utils.SidekickContext{{Name: "prod", Server: "prod"}},
+		CurrentContext: "prod",
+		Backup:         utils.BackupConfig{Dest: "s3://file", Keep: 3},
+	}
+
+	// no env var leaves the file as it is
+	_, ok := utils.ServerFromEnv(file)
+	assert.False(t, ok)
+
+	// one env var overrides that value of the server of the current context, the rest comes from the file
+	t.Setenv("SIDEKICK_CERT_EMAIL", "env@example.com")
+	t.Setenv("SIDEKICK_BACKUP_KEEP", "9")
+	config := file
+	config.Servers = append([]utils.SidekickServer{}, file.Servers...)
+	envServer, ok := utils.ServerFromEnv(config)
+	assert.True(t, ok)
+	assert.Equal(t, "prod", envServer.Name)
+	config.ApplyEnvServer(envServer)
+	assert.NoError(t, config.ApplyEnvGlobals())
+	server, err := config.FindServer("prod")
+	assert.NoError(t, err)
+	assert.Equal(t, "env@example.com", server.CertEmail)
+	assert.Equal(t, "1.2.3.4", server.Address)
+	assert.Equal(t, "age1file", server.PublicKey)
+	assert.Equal(t, utils.BackupConfig{Dest: "s3://file", Keep: 9}, config.Backup)
+	assert.Empty(t, utils.MissingConfigValues(config))
+
+	t.Setenv("SIDEKICK_CONFIRM_CONTEXTS", " prod, staging,,")
+	assert.NoError(t, config.ApplyEnvGlobals())
+	assert.Equal(t, []string{"prod", "staging"}, config.DeployPolicy.ConfirmContexts)
+
+	// env wins over the file for a value both set
+	t.Setenv("SIDEKICK_SERVER_ADDRESS", "5.6.7.8")
+	envServer, _ = utils.ServerFromEnv(config)
+	config.ApplyEnvServer(envServer)
+	server, _ = config.FindServer("prod")
+	assert.Equal(t, "5.6.7.8", server.Address)
+
+	// without a file the env vars must give every required value, the rest is named with both ways to set it
+	config = utils.SidekickConfig{Version: "1"}
+	envServer, _ = utils.ServerFromEnv(config)
+	config.ApplyEnvServer(envServer)
+	missing := utils.MissingConfigValues(config)
+	assert.Equal(t, []string{"SIDEKICK_PUBLIC_KEY", "SIDEKICK_SECRET_KEY"}, []string{missing[0].EnvVar(), missing[1].EnvVar()})
+	err = &utils.MissingConfigError{Path: "/home/ci/.config/sidekick/default.yaml", Missing: missing}
+	assert.Contains(t, err.Error(), "servers.<name>.publickey in the sidekick config, or SIDEKICK_PUBLIC_KEY")
+	assert.Contains(t, err.Error(), "servers.<name>.secretkey in the sidekick config, or SIDEKICK_SECRET_KEY")
+	assert.NotContains(t, err.Error(), "SIDEKICK_SERVER_ADDRESS")
+
+	t.Setenv("SIDEKICK_PUBLIC_KEY", "age1env")
+	t.Setenv("SIDEKICK_SECRET_KEY", "AGE-SECRET-KEY-ENV")
+	config = utils.SidekickConfig{Version: "1"}
+	envServer, _ = utils.ServerFromEnv(config)
+	config.ApplyEnvServer(envServer)
+	assert.Empty(t, utils.MissingConfigValues(config))
+
+	t.Setenv("SIDEKICK_BACKUP_KEEP", "many")
+	assert.Error(t, config.ApplyEnvGlobals())
+}
+
+func TestSaveServerKeepsEnvOut(t *testing.T) {
+	assert.NoError(t, utils.ViperInit())
+	path := filepath.Join(t.TempDir(), "default.yaml")
+	file := utils.SidekickConfig{
+		Version:        "1",
+		Servers:        []utils.SidekickServer{{Name: "prod", Address: "1.2.3.4", PublicKey: "age1file", SecretKey: "AGE-SECRET-KEY-FILE"}},
+		Contexts:       []utils.SidekickContext{{Name: "prod", Server: "prod"}, {Name: "staging", Server: "prod"}},
+		CurrentContext: "prod",
+	}
+	assert.NoError(t, file.Save(path))
+
+	// what server trust, server dns-challenge and observability see once the env vars are applied
+	t.Setenv("SIDEKICK_SECRET_KEY", "AGE-SECRET-KEY-ENV")
+	t.Setenv("SIDEKICK_CURRENT_CONTEXT", "staging")
+	t.Setenv("SIDEKICK_CONFIRM_CONTEXTS", "prod")
+	readConfig := func() utils.SidekickConfig {
+		var config utils.SidekickConfig
+		content, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		assert.NoError(t, yaml.Unmarshal(content, &config))
+		return config
+	}
+	config := readConfig()
+	envServer, _ := utils.ServerFromEnv(config)
+	config.ApplyEnvServer(envServer)
+	assert.NoError(t, config.ApplyEnvGlobals())
+	server, _ := config.FindServer("prod")
+	assert.Equal(t, "AGE-SECRET-KEY-ENV", server.SecretKey)
+
+	assert.NoError(t, utils.SaveServer(path, server.Name, func(saved *utils.SidekickServer) {
+		saved.HostKey = "ssh-ed25519 AAAA"
+	}))
+	saved := readConfig()
+	savedServer, _ := saved.FindServer("prod")
+	assert.Equal(t, "ssh-ed25519 AAAA", savedServer.HostKey)
+	assert.Equal(t, "AGE-SECRET-KEY-FILE", savedServer.SecretKey)
+	assert.Equal(t, "prod", saved.CurrentContext)
+	assert.Empty(t, saved.DeployPolicy.ConfirmContexts)
+
+	// a server only the env vars know about is not written to the file at all
+	before, _ := os.ReadFile(path)
+	assert.NoError(t, utils.SaveServer(path, "ci", func(saved *utils.SidekickServer) {
+		saved.HostKey = "ssh-ed25519 BBBB"
+	}))
+	after, _ := os.ReadFile(path)
+	assert.Equal(t, string(before), string(after))
+}
+
+func TestGetGitHubWorkflow(t *testing.T) {
+	workflow := utils.GetGitHubWorkflow("main", "dev")
+	assert.Contains(t, workflow, "branches: [main]")
+	assert.Contains(t, workflow, "go install github.com/mightymoud/sidekick@latest")
+	assert.Contains(t, workflow, "SIDEKICK_SSH_KEY: ${{ secrets.SIDEKICK_SSH_KEY }}")
+	assert.Contains(t, utils.GetGitHubWorkflow("release", "v0.7.0"), "sidekick@v0.7.0")
+}
+
+func TestRegistryConfig(t *testing.T) {
+	ghcr := utils.SidekickRegistryConfig{Url: "ghcr.io", Username: "MightyMoud"}
+	assert.NoError(t, utils.ValidateRegistryConfig(ghcr))
+	assert.Error(t, utils.ValidateRegistryConfig(utils.SidekickRegistryConfig{Url: "ghcr.io", Username: "me", Password: "ghp_abc-123"}))
+	assert.Error(t, utils.ValidateRegistryConfig(utils.SidekickRegistryConfig{Url: "ghcr.io"}))
+
+	t.Setenv("GITHUB_TOKEN", "from-actions")
+	password, err := utils.ResolveRegistryPassword(utils.SidekickAppConfig{Registry: ghcr})
+	assert.NoError(t, err)
+	assert.Equal(t, "from-actions", password)
+
+	envFile := filepath.Join(t.TempDir(), ".env")
+	assert.NoError(t, os.WriteFile(envFile, []byte("HUB_TOKEN=from-env-file\n"), 0600))
+	hub := utils.SidekickRegistryConfig{Url: utils.DockerHubRegistry, Username: "me", Password: "HUB_TOKEN"}
+	password, err = utils.ResolveRegistryPassword(utils.SidekickAppConfig{Registry: hub, Env: utils.SidekickAppEnvConfig{File: envFile}})
+	assert.NoError(t, err)
+	assert.Equal(t, "from-env-file", password)
+
+	_, err = utils.ResolveRegistryPassword(utils.SidekickAppConfig{Registry: hub})
+	assert.Error(t, err)
+}
+
+func TestCheckRemotePrerequisites(t *testing.T) {
+	remote := remotetest.NewFakeExecutor().
+		On("id -nG", "sidekick sudo docker\n", nil).
+		On("docker ps -a --filter label=com.docker.compose.service=traefik-service", "running|Up 3 days\n", nil).
+		On("df --output=avail", fmt.Sprintf("%d\n", int64(20)<<30), nil).
+		On("date +%s", fmt.Sprintf("%d\n", time.Now().Unix()), nil)
+	for _, check := range utils.CheckRemotePrerequisites(remote, utils.RuntimeDocker, utils.DefaultNetwork, 5) {
+		assert.Equal(t, utils.DoctorPass, check.Status, check.Name)
+	}
+
+	remote = remotetest.NewFakeExecutor().
+		On("id -nG", "sidekick sudo\n", nil).
+		On("docker network inspect", "", fmt.Errorf("network sidekick not found")).
+		On("docker ps -a --filter label=com.docker.compose.service=traefik-service", "running|Up 3 days (unhealthy)\n", nil).
+		On("df --output=avail", fmt.Sprintf("%d\n", int64(7)<<30), nil).
+		On("date +%s", fmt.Sprintf("%d\n", time.Now().Add(-time.Hour).Unix()), nil).
+		On("xargs -r docker inspect", "/blog json-file 10m\n/traefik-service json-file <no value>\n/cache journald <no value>\n", nil)
+	statuses := map[string]string{}
+	for _, check := range utils.CheckRemotePrerequisites(remote, utils.RuntimeDocker, utils.DefaultNetwork, 5) {
+		statuses[check.Name] = check.Status
+		if check.Status != utils.DoctorPass {
+			assert.NotEmpty(t, check.Fix, check.Name)
+		}
+	}
+	assert.Equal(t, map[string]string{
+		"Docker group":   utils.DoctorFail,
+		"Docker network": utils.DoctorFail,
+		"Traefik":        utils.DoctorFail,
+		"Disk space":     utils.DoctorWarn,
+		"Log rotation":   utils.DoctorWarn,
+		"Clock skew":     utils.DoctorFail,
+	}, statuses)
+}
+
+func TestAppImage(t *testing.T) {
+	image, err := utils.AppImage(utils.SidekickAppConfig{Name: "myapp"}, "latest")
+	assert.NoError(t, err)
+	assert.Equal(t, "myapp:latest", image)
+
+	image, err = utils.AppImage(utils.SidekickAppConfig{Name: "myapp", Registry: utils.SidekickRegistryConfig{Username: "me"}}, "abc123")
+	assert.NoError(t, err)
+	assert.Equal(t, "me/myapp:abc123", image)
+
+	ghcr := utils.SidekickRegistryConfig{Url: utils.GHCRRegistry, Username: "MightyMoud"}
+	image, err = utils.AppImage(utils.SidekickAppConfig{Name: "myapp", Registry: ghcr}, "abc123")
+	assert.NoError(t, err)
+	assert.Equal(t, "ghcr.io/mightymoud/myapp:abc123", image)
+	assert.Equal(t, "ghcr.io/mightymoud/myapp", utils.AppRepository(utils.SidekickAppConfig{Name: "myapp", Registry: ghcr}))
+
+	_, err = utils.AppImage(utils.SidekickAppConfig{Name: "my app"}, "latest")
+	assert.Error(t, err)
+}
+
+func TestStackMigrations(t *testing.T) {
+	migrations := []utils.StackMigration{{Version: 3, Name: "c"}, {Version: 2, Name: "b"}}
+	pending := utils.PendingStackMigrations(1, migrations)
+	assert.Equal(t, []int{2, 3}, []int{pending[0].Version, pending[1].Version})
+	assert.Empty(t, utils.PendingStackMigrations(3, migrations))
+
+	remote := remotetest.NewFakeExecutor().On("sidekickVersion", "1\n", nil)
+	version, err := utils.GetRemoteStackVersion(remote)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, version)
+
+	remote = remotetest.NewFakeExecutor().On("docker ps -q --filter label=traefik.enable=true",
+		"traefik.enable=true\ntraefik.http.routers.myapp.rule=Host(`myapp.com`)\ntraefik.http.routers.badge.rule=Host(`myapp.com`) && Path(`/badge`)\ntraefik.http.routers.abc.rule=Host(`abc.myapp.com`)\n", nil)
+	hosts, err := utils.GetRouterHosts(remote)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"abc.myapp.com", "myapp.com"}, hosts)
+
+	before := map[string]string{"a.com": "200", "b.com": "404", "c.com": "000", "d.com": "200", "e.com": "302"}
+	after := map[string]string{"a.com": "200", "b.com": "404", "c.com": "000", "d.com": "502", "e.com": "000"}
+	assert.Equal(t, []string{"d.com", "e.com"}, utils.BrokenRouters(before, after))
+}
+
+func TestSetupFirewall(t *testing.T) {
+	script := utils.GetFirewallScript("2222")
+	assert.Less(t, strings.Index(script, "ufw allow 2222/tcp"), strings.Index(script, "ufw --force enable"))
+	assert.Less(t, strings.Index(script, "Status: active"), strings.Index(script, "ufw default deny incoming"))
+
+	remote := remotetest.NewFakeExecutor().On("ufw", "enabled\n", nil)
+	skipped, err := utils.SetupFirewall(remote, utils.SSHPort, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, skipped)
+
+	remote = remotetest.NewFakeExecutor().On("ufw", "skipped: ufw is already active with its own rules\n", nil)
+	skipped, err = utils.SetupFirewall(remote, utils.SSHPort, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "ufw is already active with its own rules", skipped)
+}
+
+func TestScanReport(t *testing.T) {
+	vulns, err := utils.ParseTrivyReport([]byte(`{"Results":[{"Vulnerabilities":[
+		{"VulnerabilityID":"CVE-1","PkgName":"openssl","InstalledVersion":"3.0.1","FixedVersion":"3.0.2","Severity":"MEDIUM"},
+		{"VulnerabilityID":"CVE-2","PkgName":"zlib","InstalledVersion":"1.2","Severity":"CRITICAL"}]},{"Target":"app"}]}`))
+	assert.NoError(t, err)
+	assert.Len(t, vulns, 2)
+
+	report := utils.ScanReport{Image: "myapp:latest", Vulnerabilities: vulns}
+	assert.Equal(t, "CVE-2", report.AtOrAbove("HIGH")[0].ID)
+	assert.Len(t, report.AtOrAbove("high"), 1)
+	assert.Equal(t, []string{"CVE-2", "CVE-1"}, []string{report.AtOrAbove("LOW")[0].ID, report.AtOrAbove("LOW")[1].ID})
+	assert.Contains(t, report.Summary("HIGH"), "CRITICAL: 1, HIGH: 0, MEDIUM: 1")
+
+	assert.NoError(t, utils.ValidateScanSeverity("critical"))
+	assert.Error(t, utils.ValidateScanSeverity("severe"))
+}
+
+func TestSbomNaming(t *testing.T) {
+	assert.Equal(t, "V1", utils.NextDeployVersion(""))
+	assert.Equal(t, "V13", utils.NextDeployVersion("V12"))
+	assert.Equal(t, "sbom-V13.spdx.json", utils.SbomFileName("V13", utils.SbomFormatSPDX))
+	assert.Equal(t, "myapp/sbom.cyclonedx.json", utils.RemoteSbomFile("myapp", utils.SbomFormatCycloneDX))
+	assert.NoError(t, utils.ValidateSbomFormat("spdx"))
+	assert.Error(t, utils.ValidateSbomFormat("cyclonedx-xml"))
+}
+
+func TestVerifyPinnedHostKey(t *testing.T) {
+	newKey := func() ssh.PublicKey {
+		public, _, err := ed25519.GenerateKey(nil)
+		assert.NoError(t, err)
+		key, err := ssh.NewPublicKey(public)
+		assert.NoError(t, err)
+		return key
+	}
+	pinned, rebuilt := newKey(), newKey()
+
+	assert.NoError(t, utils.VerifyPinnedHostKey("1.2.3.4", utils.MarshalHostKey(pinned), pinned))
+	err := utils.VerifyPinnedHostKey("1.2.3.4", utils.MarshalHostKey(pinned), rebuilt)
+	assert.ErrorContains(t, err, ssh.FingerprintSHA256(rebuilt))
+	assert.ErrorContains(t, err, "--accept-new-hostkey")
+	assert.ErrorContains(t, err, "sidekick server trust")
+	assert.Error(t, utils.VerifyPinnedHostKey("1.2.3.4", "not a key", pinned))
+}
+
+func TestConfirm(t *testing.T) {
+	defer render.SetPlain(false)
+	defer render.SetCI(false)
+	render.SetCI(true)
+	cmd := &cobra.Command{}
+	cmd.Flags().BoolP("yes", "y", false, "")
+
+	ok, err := utils.Confirm(cmd, "Deploy blog a1b2c3d → blog.example.com")
+	assert.False(t, ok)
+	assert.ErrorContains(t, err, "Deploy blog a1b2c3d → blog.example.com needs a confirmation")
+	assert.Equal(t, utils.ExitCodeConfig, utils.ExitCode(err))
+	// previews are not production, they go ahead without asking
+	ok, err = utils.ConfirmProduction(cmd, &utils.SidekickConfig{}, utils.Target{Environment: utils.MetadataEnvPreview}, "Deploy blog")
+	assert.True(t, ok)
+	assert.NoError(t, err)
+
+	assert.NoError(t, utils.ViperInit())
+	t.Setenv(utils.AssumeYesEnv, "1")
+	ok, err = utils.ConfirmProduction(cmd, &utils.SidekickConfig{}, utils.Target{Environment: utils.MetadataEnvProduction}, "Deploy blog")
+	assert.True(t, ok)
+	assert.NoError(t, err)
+	// a protected context needs --yes on the command line, the env var is not enough
+	protected := &utils.SidekickConfig{DeployPolicy: utils.DeployPolicy{ConfirmContexts: []string{"prod"}}}
+	prod := utils.Target{Context: "prod", Environment: utils.MetadataEnvProduction, SelectedBy: utils.TargetSelectedByFlag}
+	assert.ErrorContains(t, utils.ConfirmTarget(cmd, protected, prod, "blog"), "context prod requires confirmation")
+	t.Setenv(utils.AssumeYesEnv, "")
+	cmd.Flags().Set("yes", "true")
+	ok, err = utils.Confirm(cmd, "Roll back blog")
+	assert.True(t, ok)
+	assert.NoError(t, err)
+	assert.NoError(t, utils.ConfirmTarget(cmd, protected, prod, "blog"))
+	prod.SelectedBy = utils.TargetSelectedByDefault
+	assert.Error(t, utils.ConfirmTarget(cmd, protected, prod, "blog"))
+}
+
+func TestOperationDeadline(t *testing.T) {
+	cmd := &cobra.Command{}
+	cmd.Flags().String("timeout", "", "")
+	timeout, err := utils.GetOperationTimeout(cmd, utils.SidekickAppConfig{Timeout: "10m"})
+	assert.NoError(t, err)
+	assert.Equal(t, 10*time.Minute, timeout)
+	cmd.Flags().Set("timeout", "soon")
+	_, err = utils.GetOperationTimeout(cmd, utils.SidekickAppConfig{})
+	assert.Error(t, err)
+
+	expired := make(chan *utils.StageError, 1)
+	deadline := utils.StartOperationDeadline("deploy", 50*time.Millisecond, func(err *utils.StageError) { expired <- err })
+	defer deadline.Stop()
+	cleanedUp := false
+	deadline.OnExpire(func() { cleanedUp = true })
+
+	assert.Error(t, utils.OperationCommand("sleep", "5").Run())
+	assert.Equal(t, utils.ExitCodeTimeout, (<-expired).Code)
+	assert.True(t, deadline.Expired())
+	deadline.Cleanup()
+	assert.True(t, cleanedUp)
+
+	// SIGTERM cancels an operation without a timeout the same way
+	cancelled := utils.StartOperationDeadline("deploy", 0, func(err *utils.StageError) { expired <- err })
+	defer cancelled.Stop()
+	assert.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGTERM))
+	err = <-expired
+	assert.Equal(t, utils.ExitCodeCancelled, utils.ExitCode(err))
+	assert.ErrorContains(t, err, "deploy cancelled")
+	assert.True(t, cancelled.Expired())
+	assert.Error(t, utils.OperationContext().Err())
+}
+
+func TestConnectionRetries(t *testing.T) {
+	assert.True(t, utils.IsIdempotentCommand("cd myapp && docker load -i myapp-latest.tar"))
+	assert.True(t, utils.IsIdempotentCommand("mkdir -p myapp/previews"))
+	assert.True(t, utils.IsIdempotentCommand("echo 'c2VydmljZXM6Cg==' | base64 -d > myapp/docker-compose.yaml"))
+	assert.False(t, utils.IsIdempotentCommand("cd myapp && docker compose -p sidekick up -d --scale myapp=2"))
+	assert.False(t, utils.IsIdempotentCommand(utils.GetDeployAppScript(utils.SidekickAppConfig{Name: "myapp"})))
+
+	assert.True(t, utils.IsConnectionError(&ssh.ExitMissingError{}))
+	assert.True(t, utils.IsConnectionError(fmt.Errorf("failed to create session: %w", io.EOF)))
+	assert.False(t, utils.IsConnectionError(fmt.Errorf("docker: not found")))
+	assert.ErrorContains(t, &utils.ConnectionDroppedError{Cmd: "docker compose up", Err: io.EOF}, "may or may not have finished")
+
+	calls := 0
+	attempts, err := utils.RetryPolicy{Attempts: 3}.Do(func() error {
+		calls++
+		return utils.StopRetrying(fmt.Errorf("permission denied"))
+	}, nil)
+	assert.EqualError(t, err, "permission denied")
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestErrorHint(t *testing.T) {
+	authErr := fmt.Errorf("logging in to 1.2.3.4 as sidekick: %w", utils.ErrSSHAuth)
+	assert.Contains(t, utils.ErrorHint(authErr), "ssh-add")
+	assert.Equal(t, "Run sidekick init", utils.ErrorHint(utils.NewStageError("Login", utils.ExitCodeRemote, "Run sidekick init", authErr)))
+
+	remoteErr := &utils.RemoteCommandError{Cmd: "docker compose up -d", Stderr: "no such service", Err: io.EOF}
+	assert.ErrorIs(t, utils.NewStageError("Deploy", utils.ExitCodeRemote, "", remoteErr), io.EOF)
+	assert.EqualError(t, remoteErr, `"docker compose up -d" failed: no such service: EOF`)
+	assert.Contains(t, utils.ErrorHint(remoteErr), "--verbose")
+	assert.Equal(t, utils.ExitCodeRemote, utils.ExitCode(utils.NewStageError("Deploy", utils.ExitCodeRemote, "", remoteErr)))
+	assert.Empty(t, utils.ErrorHint(fmt.Errorf("plain")))
+}
+
+func TestAppURL(t *testing.T) {
+	appConfig := utils.SidekickAppConfig{
+		Url:         "myapp.example.com",
+		PreviewEnvs: map[string]utils.SidekickPreview{"abc123": {Url: "https://abc123.myapp.example.com"}},
+	}
+	url, err := utils.AppURL(appConfig, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://myapp.example.com", url)
+
+	url, err = utils.AppURL(appConfig, "abc123")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://abc123.myapp.example.com", url)
+
+	_, err = utils.AppURL(appConfig, "def456")
+	assert.Error(t, err)
+	_, err = utils.AppURL(utils.SidekickAppConfig{}, "")
+	assert.Error(t, err)
+}
+
+func TestRemoteAppExists(t *testing.T) {
+	remote := remotetest.NewFakeExecutor().On(`"myapp"`, "exists\n", nil)
+	exists, err := utils.RemoteAppExists(remote, "myapp")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.True(t, remote.Ran("com.docker.compose.service=\"myapp\""))
+
+	exists, err = utils.RemoteAppExists(remote, "otherapp")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestParseAppConfig(t *testing.T) {
+	valid := "name: myapp\nport: 3000\nurl: myapp.example.com\nserver: default\nx-owner: platform\n"
+	appConfig, problems := utils.ParseAppConfig([]byte(valid), false)
+	assert.Empty(t, problems)
+	assert.Equal(t, uint64(3000), appConfig.Port)
+
+	invalid := "name: My_App\nprot: 3000\nport: 70000\nurl: https://myapp.example.com\nhealthCheck:\n  pth: /health\nkeepImages: many\n"
+	_, problems = utils.ParseAppConfig([]byte(invalid), false)
+	messages := []string{}
+	for _, problem := range problems {
+		messages = append(messages, problem.String())
+	}
+	assert.Contains(t, messages, "line 2 prot: unknown field, did you mean port?")
+	assert.Contains(t, messages, "line 6 pth: unknown field, did you mean path?")
+	assert.Contains(t, strings.Join(messages, "\n"), "line 7: cannot unmarshal")
+	assert.Contains(t, strings.Join(messages, "\n"), `line 1 name: "My_App" must be lowercase`)
+	assert.Contains(t, strings.Join(messages, "\n"), "line 3 port: 70000 is not a port")
+	assert.Contains(t, strings.Join(messages, "\n"), "line 4 url:")
+
+	assert.NoError(t, utils.ValidateDomain("myapp.1.2.3.4.sslip.io"))
+	assert.Error(t, utils.ValidateDomain("my_app..example.com"))
+}
+
+func TestKeepPreviewImage(t *testing.T) {
+	now := time.Date(2024, 11, 12, 10, 0, 0, 0, time.UTC)
+	preview := utils.SidekickPreview{Image: "myapp:abc123", History: []string{"myapp:abc123-1", "myapp:abc123-2", "myapp:abc123-3"}}
+
+	remote := remotetest.NewFakeExecutor().On("docker image inspect", "kept\n", nil)
+	history, err := utils.KeepPreviewImage(remote, preview, "myapp:abc123", now)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"myapp:abc123-2", "myapp:abc123-3", "myapp:abc123-20241112100000"}, history)
+	assert.True(t, remote.Ran("docker tag myapp:abc123 myapp:abc123-20241112100000"))
+	assert.True(t, remote.Ran("docker image rm myapp:abc123-1"))
+
+	// the image is already gone from the server
+	remote = remotetest.NewFakeExecutor()
+	history, err = utils.KeepPreviewImage(remote, utils.SidekickPreview{Image: "myapp:abc123"}, "myapp:abc123", now)
+	assert.NoError(t, err)
+	assert.Empty(t, history)
+}
+
+func TestAppConfigSchema(t *testing.T) {
+	defer os.Remove("sidekick.yml")
+	defer os.Remove("sidekick.yml.bak")
+
+	unversioned := "name: myapp\nversion: V3\nport: 3000\nurl: myapp.example.com\npreviewEnvs:\n    abc123:\n        url: https://abc123.myapp.example.com\n"
+	assert.NoError(t, os.WriteFile("sidekick.yml", []byte(unversioned), 0644))
+	appConfig, err := utils.LoadAppConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, "myapp:abc123", appConfig.PreviewEnvs["abc123"].Image)
+	assert.Equal(t, "V3", appConfig.Version)
+
+	// loading alone leaves the file untouched
+	assert.NoFileExists(t, "sidekick.yml.bak")
+	assert.NoError(t, utils.SaveAppConfig(appConfig))
+	backup, err := os.ReadFile("sidekick.yml.bak")
+	assert.NoError(t, err)
+	assert.Equal(t, unversioned, string(backup))
+	saved, err := os.ReadFile("sidekick.yml")
+	assert.NoError(t, err)
+	assert.Contains(t, string(saved), fmt.Sprintf("schema: %d", utils.AppConfigSchema))
+
+	newer := fmt.Sprintf("schema: %d\nname: myapp\nport: 3000\nurl: myapp.example.com\n", utils.AppConfigSchema+1)
+	assert.NoError(t, os.WriteFile("sidekick.yml", []byte(newer), 0644))
+	_, err = utils.LoadAppConfig()
+	assert.ErrorContains(t, err, "please upgrade sidekick")
+}
+
+func TestComposeProject(t *testing.T) {
+	assert.Equal(t, "myapp", utils.ComposeProject("myapp", ""))
+	assert.Equal(t, "myapp-abc123", utils.ComposeProject("myapp", "abc123"))
+	assert.Equal(t, "myapp", utils.ComposeProjectForDir("myapp"))
+	assert.Equal(t, "myapp-abc123", utils.ComposeProjectForDir("./myapp/preview/abc123"))
+
+	up := utils.GetComposeUpCommand("./myapp/preview/abc123", false, "")
+	assert.Contains(t, up, "docker compose -p myapp-abc123 up -d")
+	assert.Contains(t, up, "label=com.docker.compose.project=sidekick --filter label=com.docker.compose.service=myapp-abc123")
+	assert.True(t, utils.IsIdempotentCommand(up))
+}
+
+func TestAppsMap(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	defer utils.UseAppConfig("", "")
+	defer func(file string) { utils.AppConfigFile = file }(utils.AppConfigFile)
+
+	dir := filepath.Join(t.TempDir(), "services")
+	assert.NoError(t, os.Mkdir(dir, 0755))
+	content := "schema: 1\napps:\n    api:\n        name: api\n        port: 3000\n        url: api.example.com\n    web:\n        name: web\n        port: 0\n        url: web.example.com\n"
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "deploy.yml"), []byte(content), 0644))
+
+	assert.NoError(t, utils.UseAppConfig(filepath.Join(dir, "deploy.yml"), ""))
+	_, err := utils.LoadAppConfig()
+	assert.ErrorContains(t, err, "pick one with --app")
+	problems, err := utils.ValidateAppConfigFile([]byte(content), false)
+	assert.NoError(t, err)
+	assert.Equal(t, []utils.ConfigProblem{{Line: 9, Field: "apps.web.port", Message: "0 is not a port, it must be between 1 and 65535"}}, problems)
+
+	assert.NoError(t, utils.UseAppConfig("", "worker"))
+	_, err = utils.LoadAppConfig()
+	assert.ErrorIs(t, err, utils.ErrAppNotInConfig)
+
+	assert.NoError(t, utils.UseAppConfig("", "api"))
+	appConfig, err := utils.LoadAppConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3000), appConfig.Port)
+	appConfig.Port = 4000
+	assert.NoError(t, utils.SaveAppConfig(appConfig))
+	saved, err := os.ReadFile("deploy.yml")
+	assert.NoError(t, err)
+	assert.Contains(t, string(saved), "    api:\n        name: api\n        port: 4000\n")
+	assert.Contains(t, string(saved), "    web:\n        name: web\n        port: 0\n        url: web.example.com\n")
+	assert.NotContains(t, string(saved), "        schema:")
+}
+
+func TestSwarmComposeFile(t *testing.T) {
+	appConfig := utils.SidekickAppConfig{Name: "myapp", Port: 3000, Url: "myapp.example.com"}
+	composeFile := utils.GetAppComposeFile(appConfig, "myapp", "myapp:latest", appConfig.Url, nil)
+	assert.Nil(t, composeFile.Services["myapp"].Deploy)
+	assert.Contains(t, utils.GetUpCommand(appConfig, "myapp", false, ""), "docker compose -p myapp up -d")
+
+	appConfig.Orchestrator = utils.OrchestratorSwarm
+	composeFile = utils.GetAppComposeFile(appConfig, "myapp", "myapp:latest", appConfig.Url, nil)
+	service := composeFile.Services["myapp"]
+	assert.Equal(t, utils.StackComposeVersion, composeFile.Version)
+	assert.Equal(t, []string{"sidekick.app=myapp"}, service.Labels)
+	assert.Empty(t, service.Restart)
+	assert.Equal(t, append([]string{"sidekick.app=myapp"}, utils.GetTraefikLabels(appConfig, "myapp", appConfig.Url, "3000")...), service.Deploy.Labels)
+	assert.Equal(t, "start-first", service.Deploy.UpdateConfig.Order)
+	assert.Equal(t, "cd myapp/preview/abc123 && docker stack deploy --with-registry-auth -c docker-compose.yaml myapp-abc123", utils.GetUpCommand(appConfig, "myapp/preview/abc123", false, ""))
+
+	appConfig.Orchestrator = "nomad"
+	assert.Equal(t, "orchestrator", utils.ValidateAppConfig(appConfig, false)[0].Field)
+}
+
+func TestImageTransfer(t *testing.T) {
+	sum := "0123456789abcdef0123456789abcdef"
+	chunks := utils.GetImageChunks("blog/blog-latest.tar", 2*utils.ImageChunkSize+5, sum)
+	assert.Len(t, chunks, 3)
+	assert.Equal(t, utils.ImageChunk{Offset: 2 * utils.ImageChunkSize, Length: 5, Part: "blog/blog-latest.tar.0123456789ab.part002"}, chunks[2])
+	assert.Len(t, utils.GetImageChunks("blog/blog-latest.tar", 10, sum), 1)
+
+	sizes := utils.ParseImagePartSizes("blog/blog-latest.tar.0123456789ab.part000 67108864\nblog/blog-latest.tar.0123456789ab.part001 1024\n")
+	assert.Equal(t, int64(utils.ImageChunkSize), sizes[chunks[0].Part])
+	assert.Equal(t, int64(1024), sizes[chunks[1].Part])
+	assert.Contains(t, utils.GetImagePartsSizeCommand("blog/blog-latest.tar"), "stat -c '%n %s' blog/blog-latest.tar.*.part*")
+
+	assemble := utils.GetAssembleImageCommand("blog/blog-latest.tar", chunks, sum)
+	assert.True(t, strings.HasPrefix(assemble, "cat blog/blog-latest.tar.0123456789ab.part000 blog/blog-latest.tar.0123456789ab.part001 blog/blog-latest.tar.0123456789ab.part002 > blog/blog-latest.tar;"))
+	assert.Contains(t, assemble, utils.GetVerifyRemoteArchiveCommand("blog/blog-latest.tar", sum))
+
+	result := utils.TransferResult{Size: 100 << 20, Sent: 60 << 20, Duration: 6 * time.Second}
+	assert.Equal(t, "10.0 MiB/s", result.Throughput())
+	assert.Equal(t, "Moved 100.0 MiB in 6s (10.0 MiB/s), 40.0 MiB was already on the server", result.String())
+
+	// 20 MiB past the 40 resumed ones took 10s, the 40 left take 20s
+	left := utils.TransferTimeLeft(60<<20, 40<<20, 100<<20, 10*time.Second)
+	assert.Equal(t, 20*time.Second, left)
+	assert.Zero(t, utils.TransferTimeLeft(40<<20, 40<<20, 100<<20, time.Second))
+	assert.Equal(t, "60% - 60.0 MiB of 100.0 MiB, about 20s left", utils.FormatTransferProgress(60<<20, 100<<20, left))
+	assert.Equal(t, "100% - 100.0 MiB of 100.0 MiB", utils.FormatTransferProgress(100<<20, 100<<20, 0))
+	assert.Zero(t, render.ProgressMsg{Done: 5}.Percent())
+}
+
+func TestNetworkName(t *testing.T) {
+	server := utils.SidekickServer{CertEmail: "me@example.com", Network: "apps"}
+	appConfig := utils.SidekickAppConfig{Name: "blog", Url: "blog.example.com", Port: 3000, Network: server.NetworkName(), Addons: []utils.SidekickAddon{utils.NewAddon(utils.AddonPostgres)}}
+	for _, composeFile := range []utils.DockerComposeFile{
+		utils.GetAppComposeFile(appConfig, "blog", "blog:V1", "blog.example.com", nil),
+		utils.GetPreviewComposeFile(utils.SidekickAppConfig{Name: "blog", Url: "blog.example.com", Port: 3000}, server, "abc123", "blog:abc123", nil),
+	} {
+		assert.Equal(t, map[string]utils.DockerNetwork{"apps": {External: true}}, composeFile.Networks)
+		for name, service := range composeFile.Services {
+			assert.Contains(t, service.Networks, "apps", name)
+			assert.NotContains(t, service.Networks, utils.DefaultNetwork, name)
+		}
+	}
+	composeFile := utils.GetAppComposeFile(appConfig, "blog", "blog:V1", "blog.example.com", nil)
+	assert.Contains(t, composeFile.Services["blog"].Labels, "traefik.docker.network=apps")
+	assert.Contains(t, utils.GetBadgeComposeFile(appConfig).Services["blog-badge"].Labels, "traefik.docker.network=apps")
+
+	traefik := utils.GetTraefikComposeFile(server)
+	assert.Contains(t, traefik, "      - apps\n")
+	assert.Contains(t, traefik, "\n  apps:\n    external: true")
+	assert.NotContains(t, traefik, "$NETWORK")
+
+	assert.Equal(t, utils.DefaultNetwork, utils.SidekickServer{}.NetworkName())
+	assert.Contains(t, utils.GetAppComposeFile(utils.SidekickAppConfig{Name: "blog", Port: 3000}, "blog", "blog:V1", "blog.example.com", nil).Networks, utils.DefaultNetwork)
+	assert.NoError(t, utils.ValidateNetworkName("my_net.1"))
+	assert.Error(t, utils.ValidateNetworkName("apps; rm -rf /"))
+}
+
+func TestAppNetworks(t *testing.T) {
+	appConfig := utils.SidekickAppConfig{Name: "blog", Url: "blog.example.com", Port: 3000, Network: "apps", Networks: []string{"internal", "apps", "queue"}}
+	assert.Equal(t, []string{"apps", "internal", "queue"}, utils.AppNetworks(appConfig))
+	composeFile := utils.GetAppComposeFile(appConfig, "blog", "blog:V1", "blog.example.com", nil)
+	assert.Equal(t, []string{"apps", "internal", "queue"}, composeFile.Services["blog"].Networks)
+	assert.Len(t, composeFile.Networks, 3)
+	for _, network := range composeFile.Networks {
+		assert.True(t, network.External)
+	}
+	labels := composeFile.Services["blog"].Labels
+	assert.Contains(t, labels, "traefik.docker.network=apps")
+	assert.NotContains(t, labels, "traefik.docker.network=internal")
+
+	remote := remotetest.NewFakeExecutor().On("docker network ls", "bridge\nhost\napps\ninternal\n", nil)
+	missing, err := utils.MissingNetworks(remote, appConfig)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"queue"}, missing)
+	stageErr := utils.CheckNetworksStage(remote, appConfig)
+	assert.Equal(t, utils.ExitCodeConfig, stageErr.Code)
+	assert.Contains(t, stageErr.Error(), "queue")
+	assert.Nil(t, utils.CheckNetworksStage(remote, utils.SidekickAppConfig{Network: "apps", Networks: []string{"internal"}}))
+
+	appConfig.HealthCheck.Path = "/health"
+	_, _, ip := utils.ParseServiceProbe("running||internal=10.0.2.4,apps=10.0.1.4,queue=10.0.3.4,", utils.AppNetwork(appConfig))
+	assert.Equal(t, "10.0.1.4", ip, "the health check path is curled on the network traefik uses")
+
+	appConfig.Networks = []string{"bad network"}
+	assert.Equal(t, "networks[0]", utils.ValidateAppConfig(appConfig, false)[0].Field)
+}
+
+func TestGlobalConfigKeys(t *testing.T) {
+	config := &utils.SidekickConfig{
+		Version:        "1",
+		Servers:        []utils.SidekickServer{{Name: "prod", Address: "203.0.113.10", SecretKey: "AGE-SECRET-KEY-1ABC"}, {Name: "staging", Address: "203.0.113.20"}},
+		Contexts:       []utils.SidekickContext{{Name: "prod", Server: "prod"}, {Name: "staging", Server: "staging"}},
+		CurrentContext: "prod",
+	}
+
+	value, err := utils.GetConfigValue(config, "servers.prod.serveraddress")
+	assert.NoError(t, err)
+	assert.Equal(t, "203.0.113.10", value)
+	value, err = utils.GetConfigValue(config, "servers.staging.address")
+	assert.NoError(t, err)
+	assert.Equal(t, "203.0.113.20", value)
+	value, err = utils.GetConfigValue(config, "servers.prod")
+	assert.NoError(t, err)
+	assert.Contains(t, value, "serveraddress: 203.0.113.10")
+	_, err = utils.GetConfigValue(config, "servers.dev.serveraddress")
+	assert.ErrorContains(t, err, "no server named dev")
+	_, err = utils.GetConfigValue(config, "servers.prod.port")
+	assert.ErrorContains(t, err, "not a sidekick config key")
+
+	assert.NoError(t, utils.SetConfigValue(config, "servers.prod.address", "198.51.100.7"))
+	assert.Equal(t, "198.51.100.7", config.Servers[0].Address)
+	assert.NoError(t, utils.SetConfigValue(config, "current-context", "staging"))
+	assert.NoError(t, utils.SetConfigValue(config, "backup.keep", "7"))
+	assert.Equal(t, 7, config.Backup.Keep)
+	assert.NoError(t, utils.SetConfigValue(config, "servers.prod.observability.metrics.enabled", "true"))
+	assert.True(t, config.Servers[0].Observability.Metrics.Enabled)
+	assert.NoError(t, utils.SetConfigValue(config, "deployPolicy.confirmContexts", "prod, staging"))
+	assert.Equal(t, []string{"prod", "staging"}, config.DeployPolicy.ConfirmContexts)
+
+	assert.ErrorContains(t, utils.SetConfigValue(config, "servers.prod.address", "not an address!"), "not an IP address")
+	assert.Equal(t, "198.51.100.7", config.Servers[0].Address, "a rejected value leaves the config as it was")
+	assert.ErrorContains(t, utils.SetConfigValue(config, "backup.keep", "seven"), "takes a number")
+	assert.Error(t, utils.SetConfigValue(config, "current-context", "dev"))
+	assert.Error(t, utils.SetConfigValue(config, "servers.prod.certemail", "nope"))
+	assert.ErrorContains(t, utils.SetConfigValue(config, "servers.prod.name", "live"), "can't be set")
+	assert.ErrorContains(t, utils.SetConfigValue(config, "servers.prod", "x"), "section")
+
+	entries := map[string]string{}
+	for _, entry := range utils.ListConfigValues(config, false) {
+		entries[entry.Key] = entry.Value
+	}
+	assert.Equal(t, "198.51.100.7", entries["servers.prod.serveraddress"])
+	assert.Equal(t, "********", entries["servers.prod.secretkey"])
+	assert.Equal(t, "staging", entries["current-context"])
+	assert.NotContains(t, entries, "servers.staging.secretkey", "empty values are left out")
+	for _, entry := range utils.ListConfigValues(config, true) {
+		if entry.Key == "servers.prod.secretkey" {
+			assert.Equal(t, "AGE-SECRET-KEY-1ABC", entry.Value)
+		}
+	}
+}
+
+func TestInitConverge(t *testing.T) {
+	remote := remotetest.NewFakeExecutor().On("docker network inspect apps", "", errors.New("no such network"))
+	created, err := utils.EnsureNetwork(remote, "apps")
+	assert.NoError(t, err)
+	assert.True(t, created)
+	assert.True(t, remote.Ran("sudo docker network create apps"))
+
+	remote = remotetest.NewFakeExecutor().On("docker network inspect apps", "apps\n", nil).On("traefik-service", "exited\n", nil)
+	created, err = utils.EnsureNetwork(remote, "apps")
+	assert.NoError(t, err)
+	assert.False(t, created)
+	assert.False(t, remote.Ran("docker network create"))
+	state, err := utils.TraefikState(remote)
+	assert.NoError(t, err)
+	assert.Equal(t, "exited", state)
+	state, err = utils.TraefikState(remotetest.NewFakeExecutor())
+	assert.NoError(t, err)
+	assert.Empty(t, state)
+
+	converge := &utils.ConvergeReport{}
+	assert.Equal(t, "Changed: nothing, the server was already set up", converge.String())
+	converge.InPlace("sidekick user")
+	converge.Changed("Traefik set up")
+	converge.InPlace("Docker")
+	assert.Equal(t, "Changed: Traefik set up\nAlready in place: sidekick user, Docker", converge.String())
+
+	for _, cmd := range utils.UsersetupStage.Commands {
+		assert.NotContains(t, cmd, ">>", "running init twice must not add lines twice")
+		assert.NotContains(t, cmd, "tee -a")
+	}
+	assert.Contains(t, utils.GetTraefikStage(utils.SidekickServer{}).Commands, "mkdir -p traefik")
+
+	path := filepath.Join(t.TempDir(), "default.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("old"), 0600))
+	config := &utils.SidekickConfig{CurrentContext: "prod"}
+	assert.NoError(t, config.Save(path))
+	saved, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Contains(t, string(saved), "prod")
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	leftovers, _ := filepath.Glob(path + ".*")
+	assert.Empty(t, leftovers)
+}
+
+func TestLogRotation(t *testing.T) {
+	appConfig := utils.SidekickAppConfig{Name: "blog", Url: "blog.example.com", Port: 3000, Addons: []utils.SidekickAddon{utils.NewAddon(utils.AddonPostgres)}}
+	composeFile := utils.GetAppComposeFile(appConfig, "blog", "blog:V1", "blog.example.com", nil)
+	for _, name := range []string{"blog", "blog-postgres"} {
+		assert.Equal(t, &utils.DockerLogging{Driver: "json-file", Options: map[string]string{"max-size": "10m", "max-file": "3"}}, composeFile.Services[name].Logging, name)
+	}
+
+	appConfig.Logging = utils.SidekickLoggingConfig{MaxSize: "50m"}
+	preview := utils.GetPreviewComposeFile(appConfig, utils.SidekickServer{}, "abc123", "blog:abc123", nil)
+	assert.Equal(t, map[string]string{"max-size": "50m", "max-file": "3"}, preview.Services["blog-abc123"].Logging.Options)
+	assert.Equal(t, &utils.DockerLogging{Driver: "journald"}, utils.GetServiceLogging(utils.SidekickLoggingConfig{Driver: "journald"}))
+
+	var override utils.DockerComposeFile
+	assert.NoError(t, yaml.Unmarshal([]byte("services:\n  blog:\n    logging:\n      driver: local\n"), &override))
+	appConfig.ComposeOverride = &override
+	composeFile = utils.GetAppComposeFile(appConfig, "blog", "blog:V1", "blog.example.com", nil)
+	assert.Equal(t, &utils.DockerLogging{Driver: "local"}, composeFile.Services["blog"].Logging)
+	assert.Equal(t, "50m", composeFile.Services["blog-postgres"].Logging.Options["max-size"])
+
+	appConfig.ComposeOverride = nil
+	assert.Empty(t, utils.ValidateAppConfig(appConfig, false))
+	appConfig.Logging = utils.SidekickLoggingConfig{Driver: "journald", MaxSize: "10 MB", MaxFile: -1}
+	assert.Len(t, utils.ValidateAppConfig(appConfig, false), 3)
+}
+
+func TestLogsStack(t *testing.T) {
+	appConfig := utils.SidekickAppConfig{Name: "blog", Url: "blog.example.com", Port: 3000, Addons: []utils.SidekickAddon{utils.NewAddon(utils.AddonPostgres)}}
+	composeFile := utils.GetAppComposeFile(appConfig, "blog", "blog:V1", "blog.example.com", nil)
+	assert.Contains(t, composeFile.Services["blog"].Labels, "sidekick.app=blog")
+	assert.Contains(t, composeFile.Services["blog-postgres"].Labels, "sidekick.app=blog")
+	preview := utils.GetPreviewComposeFile(appConfig, utils.SidekickServer{}, "abc123", "blog:abc123", nil)
+	assert.Contains(t, preview.Services["blog-abc123"].Labels, "sidekick.preview=abc123")
+
+	assert.Equal(t, `{app="blog", preview=""}`, utils.LokiSelector("blog", "", ""))
+	assert.Equal(t, `{app="blog", preview="abc123", service="blog-postgres"}`, utils.LokiSelector("blog", "abc123", "blog-postgres"))
+	assert.Contains(t, utils.GetPromtailConfig(), "__meta_docker_container_label_sidekick_preview")
+	assert.Contains(t, utils.GetLokiConfig(utils.DefaultLogRetention), "retention_period: 168h")
+	assert.NoError(t, utils.ValidateLogRetention(utils.DefaultLogRetention))
+	assert.Error(t, utils.ValidateLogRetention(36*time.Hour))
+
+	users, err := utils.GetBasicAuthUsers("sidekick", "secret")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(users, "sidekick:$$2a$$"))
+	loki := utils.GetLogsComposeFile(utils.SidekickLogsStack{Domain: "logs.example.com"}, users, utils.DefaultNetwork)
+	assert.Contains(t, loki.Services["loki"].Labels, "traefik.http.routers.sidekick-loki.rule=Host(`logs.example.com`)")
+	assert.Contains(t, loki.Services["loki"].Labels, "traefik.http.middlewares.sidekick-loki-auth.basicauth.users="+users)
+	assert.Empty(t, loki.Services["promtail"].Labels)
+
+	entries, err := utils.ParseLokiResponse([]byte(`{"status":"success","data":{"result":[
+		{"stream":{"app":"blog","container":"blog-1"},"values":[["1700000002000000000","second"]]},
+		{"stream":{"app":"blog","container":"blog-postgres-1"},"values":[["1700000001000000000","first"]]}]}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"first", "second"}, []string{entries[0].Line, entries[1].Line})
+	assert.Equal(t, "blog-postgres-1", entries[0].Labels["container"])
+	_, err = utils.ParseLokiResponse([]byte(`{"status":"error"}`))
+	assert.Error(t, err)
+}
+
+func TestNotifications(t *testing.T) {
+	t.Setenv("TEST_WEBHOOK_URL", "https://hooks.example.com/abc")
+	config := &utils.SidekickConfig{Notifications: []utils.SidekickNotification{{URL: "$TEST_WEBHOOK_URL"}}}
+	appConfig := utils.SidekickAppConfig{Name: "blog", Url: "blog.example.com", Port: 3000, Notifications: []utils.SidekickNotification{
+		{URL: "https://hooks.example.com/abc"},
+		{URL: "https://ops.example.com/deploys", Format: utils.NotifyFormatJSON},
+	}}
+	notifications := utils.GetNotifications(config, appConfig)
+	assert.Equal(t, []string{"https://hooks.example.com/abc", "https://ops.example.com/deploys"}, []string{notifications[0].URL, notifications[1].URL})
+	assert.Empty(t, utils.ValidateAppConfig(appConfig, false))
+	appConfig.Notifications = append(appConfig.Notifications, utils.SidekickNotification{URL: "https://x.example.com", Format: "teams"})
+	assert.Equal(t, "notifications[2]", utils.ValidateAppConfig(appConfig, false)[0].Field)
+
+	err := utils.NewStageError("Building docker image", utils.ExitCodeBuild, "", errors.New("exit status 1"))
+	event := utils.NewDeployEvent(utils.DeployFailed, "blog", utils.MetadataEnvProduction, "", "https://blog.example.com", time.Now().Add(-time.Minute), err)
+	assert.Equal(t, "Building docker image", event.Stage)
+	assert.Equal(t, "1m0s", event.Duration)
+	assert.Contains(t, event.Text(), "❌ blog failed to deploy to production")
+	assert.Contains(t, event.Text(), "it stopped at Building docker image")
+	assert.True(t, strings.HasSuffix(event.Text(), " - https://blog.example.com"))
+
+	received := make(chan string, 2)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- string(body)
+	}))
+	defer webhook.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+	started := utils.NewDeployEvent(utils.DeployStarted, "blog", utils.MetadataEnvPreview, "", "https://abc.blog.example.com", time.Now(), nil)
+	utils.Notify([]utils.SidekickNotification{{URL: broken.URL}, {URL: webhook.URL}, {URL: webhook.URL, Format: utils.NotifyFormatJSON}}, started)
+	assert.Contains(t, <-received, `"text":"🚀 blog is deploying to preview`)
+	assert.Contains(t, <-received, `"status":"started"`)
+}
+
+func TestMetricsStack(t *testing.T) {
+	assert.Contains(t, utils.GetTraefikComposeFile(utils.SidekickServer{}), "--metrics.prometheus.entrypoint=metrics")
+	migrations := utils.GetStackMigrations(utils.SidekickServer{})
+	assert.Equal(t, utils.StackVersion, migrations[len(migrations)-1].Version)
+
+	prometheus := utils.GetPrometheusConfig(time.Minute)
+	assert.Contains(t, prometheus, "scrape_interval: 1m0s")
+	assert.Contains(t, prometheus, `"traefik-service:8082"`)
+
+	composeFile := utils.GetMetricsComposeFile(utils.SidekickMetricsStack{}, utils.DefaultMetricsRetention, utils.DefaultScrapeInterval, utils.DefaultNetwork)
+	assert.NotContains(t, composeFile.Services, "grafana")
+	assert.Contains(t, composeFile.Services["prometheus"].Command, "--storage.tsdb.retention.time=360h")
+	assert.Equal(t, []string{"sidekick", "metrics"}, composeFile.Services["prometheus"].Networks)
+	for name, service := range composeFile.Services {
+		assert.Empty(t, service.Ports, name)
+	}
+
+	stack := utils.SidekickMetricsStack{Domain: "grafana.example.com", User: "admin", Password: "secret"}
+	grafana := utils.GetMetricsComposeFile(stack, utils.DefaultMetricsRetention, utils.DefaultScrapeInterval, utils.DefaultNetwork).Services["grafana"]
+	assert.Contains(t, grafana.Environment, "GF_SECURITY_ADMIN_PASSWORD=secret")
+	assert.Contains(t, grafana.Labels, "traefik.http.routers.sidekick-grafana.rule=Host(`grafana.example.com`)")
+	assert.Contains(t, utils.GetMetricsDownCommand(true), "docker compose -p sidekick-metrics down -v")
+}
+
+func TestAppState(t *testing.T) {
+	appConfig := utils.SidekickAppConfig{Name: "myapp", Version: "V3", PreviewEnvs: map[string]utils.SidekickPreview{"abc123": {Image: "myapp:abc123"}}}
+
+	// state that only sidekick.yml has is copied to the server
+	remote := remotetest.NewFakeExecutor()
+	remote.On("cat myapp/state.yml", "", nil)
+	remote.On("flock myapp/state.yml.lock", "", nil)
+	loaded, err := utils.LoadAppState(remote, appConfig)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, loaded.StateRevision)
+	assert.True(t, remote.Ran(`"${current:-0}" = "0"`))
+
+	remote = remotetest.NewFakeExecutor()
+	remote.On("cat myapp/state.yml", "revision: 4\nversion: V7\nenvHash: abc\n", nil)
+	loaded, err = utils.LoadAppState(remote, appConfig)
+	assert.NoError(t, err)
+	assert.Equal(t, "V7", loaded.Version)
+	assert.Equal(t, "abc", loaded.Env.Hash)
+	assert.Empty(t, loaded.PreviewEnvs)
+
+	remote.On("flock myapp/state.yml.lock", "conflict\n", nil)
+	assert.ErrorIs(t, utils.SaveAppState(remote, &loaded), utils.ErrStateConflict)
+	assert.Equal(t, 4, loaded.StateRevision)
+}
+
+func TestRewriteForRuntime(t *testing.T) {
+	cmd := `cd traefik && sudo docker compose -p sidekick up -d
+old=$(docker ps -f "label=com.docker.compose.service=myapp" -q | xargs -r docker rm -f)
+sops exec-env encrypted.env "docker compose -p myapp up -d" -f docker-compose.yaml`
+	assert.Equal(t, cmd, utils.RewriteForRuntime(utils.RuntimeDocker, "", cmd))
+	assert.Equal(t, `cd traefik && sudo -E podman compose -p sidekick up -d
+old=$(sudo -E podman ps -f "label=com.docker.compose.service=myapp" -q | xargs -r sudo -E podman rm -f)
+sops exec-env encrypted.env "sudo -E podman compose -p myapp up -d" -f docker-compose.yaml`, utils.RewriteForRuntime(utils.RuntimePodman, "", cmd))
+	assert.Equal(t, "cd myapp && sudo -E podman-compose -p myapp up -d", utils.RewriteForRuntime(utils.RuntimePodman, utils.PodmanComposeCommand, "cd myapp && docker compose -p myapp up -d"))
+
+	runtime, compose, err := utils.DetectRuntime(remotetest.NewFakeExecutor().On("podman compose version", "podman podman-compose\n", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, utils.RuntimePodman, runtime)
+	assert.Equal(t, utils.PodmanComposeCommand, compose)
+	_, _, err = utils.DetectRuntime(remotetest.NewFakeExecutor().On("podman compose version", "podman none\n", nil))
+	assert.Error(t, err)
+}
+
+func TestListRemoteApps(t *testing.T) {
+	info := base64.StdEncoding.EncodeToString([]byte("name: api\nurl: api.example.com\nport: 3000\n"))
+	state := base64.StdEncoding.EncodeToString([]byte("revision: 2\nimage: api:V4\nlastDeployedAt: Mon Jan 1\n"))
+	remote := remotetest.NewFakeExecutor().On("for dir in", strings.Join([]string{
+		"app api 2",
+		"info api " + info,
+		"state api " + state,
+		"app legacy 0",
+		"container api/api running api:V4",
+		"container api-abc123/api running api:abc123",
+		"container sidekick/legacy exited legacy:latest",
+		"container sidekick/traefik-service running traefik:v3.6.1",
+		"router sidekick/legacy traefik.http.routers.legacy.rule=Host(`legacy.example.com`),traefik.enable=true",
+	}, "\n"), nil)
+
+	apps, err := utils.ListRemoteApps(remote)
+	assert.NoError(t, err)
+	assert.Equal(t, []utils.AppSummary{
+		{Name: "api", Domain: "api.example.com", Image: "api:V4", Status: "running", LastDeployedAt: "Mon Jan 1", Previews: 2},
+		{Name: "legacy", Domain: "legacy.example.com", Status: "stopped"},
+	}, apps)
+}
+
+func TestCheckConfigs(t *testing.T) {
+	server := utils.SidekickServer{Name: "vps", Address: "1.2.3.4", PublicKey: "age1", SecretKey: "AGE-SECRET", PlatformId: "linux/amd64", CertEmail: "me@example.com"}
+	assert.Equal(t, utils.DoctorPass, utils.CheckServerConfig(server).Status)
+	server.SecretKey, server.PlatformId = "", ""
+	check := utils.CheckServerConfig(server)
+	assert.Equal(t, utils.DoctorFail, check.Status)
+	assert.Contains(t, check.Detail, "secretkey, platformid")
+
+	assert.Equal(t, utils.DoctorPass, utils.CheckAppConfigFile([]byte("name: myapp\nurl: myapp.example.com\nport: 3000\n")).Status)
+	check = utils.CheckAppConfigFile([]byte("name: myapp\nurl: myapp.example.com\nport: 70000\nprot: 1\n"))
+	assert.Equal(t, utils.DoctorFail, check.Status)
+	assert.Contains(t, check.Detail, "(+1 more)")
+}
+
+func TestTLSDisabled(t *testing.T) {
+	appConfig, problems := utils.ParseAppConfig([]byte("name: myapp\nurl: myapp.example.com\nport: 3000\ntls: false\nentrypoints:\n  web: http\n"), false)
+	assert.Empty(t, problems)
+	assert.False(t, utils.TLSEnabled(appConfig))
+	labels := utils.GetTraefikLabels(appConfig, "myapp", appConfig.Url, "3000")
+	assert.Contains(t, labels, "traefik.http.routers.myapp.entrypoints=http")
+	for _, label := range labels {
+		assert.NotContains(t, label, ".tls")
+	}
+	url, err := utils.AppURL(appConfig, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://myapp.example.com", url)
+	content, err := yaml.Marshal(appConfig)
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "tls: false")
+
+	appConfig.TLS.Disabled = false
+	assert.Contains(t, utils.GetTraefikLabels(appConfig, "myapp", appConfig.Url, "3000"), "traefik.http.routers.myapp.tls.certresolver=default")
+
+	_, problems = utils.ParseAppConfig([]byte("name: myapp\nurl: myapp.example.com\nport: 3000\ntls:\n  cert: a.crt\n  kee: a.key\n"), false)
+	assert.Len(t, problems, 2)
+	assert.Equal(t, "kee", problems[0].Field)
+	assert.Equal(t, 6, problems[0].Line)
+	assert.Contains(t, problems[0].Message, "did you mean key")
+}
+
+func TestCheckRemoteDiskSpace(t *testing.T) {
+	gb := int64(1) << 30
+	remote := remotetest.NewFakeExecutor().On("docker image inspect", "1073741824\n", nil)
+	size, err := utils.RemoteImageSize(remote, "myapp:V3")
+	assert.NoError(t, err)
+	assert.Equal(t, gb, size)
+
+	// the tar and the loaded layers land on the same disk, so it needs room for both
+	remote.On("df --output=source,avail", "/dev/sda1 3221225472\n/dev/sda1 3221225472\n", nil)
+	assert.NoError(t, utils.CheckRemoteDiskSpace(remote, "myapp", gb, true))
+	err = utils.CheckRemoteDiskSpace(remote, "myapp", 2*gb, true)
+	assert.ErrorContains(t, err, "/dev/sda1")
+	assert.NoError(t, utils.CheckRemoteDiskSpace(remote, "myapp", 2*gb, false))
+
+	remote = remotetest.NewFakeExecutor().On("df --output=source,avail", "/dev/sda1 3221225472\n/dev/sdb1 1073741824\n", nil)
+	assert.Error(t, utils.CheckRemoteDiskSpace(remote, "myapp", gb, false))
+	assert.NoError(t, utils.CheckRemoteDiskSpace(remote, "myapp", 0, true))
+}
+
+func TestHistory(t *testing.T) {
+	start := time.Now().Add(-time.Minute)
+	entry := utils.NewHistoryEntry(utils.HistoryDeploy, "abc123", "myapp:latest", start, utils.NewStageError("Building docker image", utils.ExitCodeBuild, "", errors.New("boom")))
+	assert.Equal(t, utils.HistoryResultFailed, entry.Result)
+	assert.Equal(t, "Building docker image", entry.Stage)
+	assert.Equal(t, "1m0s", entry.Duration)
+
+	remote := remotetest.NewFakeExecutor()
+	assert.NoError(t, utils.AppendHistory(remote, "myapp", entry))
+	assert.True(t, remote.Ran(">> myapp/history.jsonl"))
+
+	remote.On("tail -n 2 myapp/history.jsonl", `{"time":"t1","action":"deploy","duration":"5s","result":"success"}
+{"time":"t2","action":"rollback","hash":"abc123","duration":"1s","result":"failed","stage":"Rollback"}
+`, nil)
+	entries, err := utils.LoadHistory(remote, "myapp", 2)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, utils.HistoryRollback, entries[1].Action)
+	assert.Equal(t, "Rollback", entries[1].Stage)
+}
+
+func TestCustomLabels(t *testing.T) {
+	appConfig := utils.SidekickAppConfig{Name: "myapp", Url: "myapp.example.com", Port: 3000, Labels: []string{
+		"traefik.http.routers.myapp.middlewares=auth",
+		"traefik.docker.network=edge",
+	}}
+	labels := utils.GetAppComposeFile(appConfig, "myapp", "myapp:latest", appConfig.Url, nil).Services["myapp"].Labels
+	assert.Contains(t, labels, "traefik.http.routers.myapp.middlewares=auth")
+	assert.Contains(t, labels, "traefik.docker.network=edge")
+	assert.NotContains(t, labels, "traefik.docker.network=sidekick")
+	assert.Contains(t, labels, "traefik.enable=true")
+
+	assert.NoError(t, utils.ValidateLabel("com.example.empty="))
+	assert.Error(t, utils.ValidateLabel("no-value"))
+	assert.Error(t, utils.ValidateLabel("=value"))
+	appConfig.Labels = append(appConfig.Labels, "bad label=1")
+	assert.Len(t, utils.ValidateAppConfig(appConfig, false), 1)
+}
+
+func TestDeployLock(t *testing.T) {
+	lock := utils.NewDeployLock(utils.DeployLockFile("myapp"))
+	remote := remotetest.NewFakeExecutor().On("set -C", "acquired\n", nil)
+	assert.NoError(t, lock.Acquire(remote, time.Hour))
+	assert.True(t, remote.Ran("> myapp/deploy.lock"))
+
+	held := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("holder: alice@laptop\npid: 42\nsince: %s\n", time.Now().UTC().Format(time.RFC3339))))
+	remote = remotetest.NewFakeExecutor().On("set -C", held+"\n", nil)
+	err := lock.Acquire(remote, time.Hour)
+	var lockedErr *utils.LockedError
+	assert.ErrorAs(t, err, &lockedErr)
+	assert.Equal(t, "alice@laptop", lockedErr.Lock.Holder)
+	assert.Contains(t, utils.ErrorHint(err), "--force-unlock")
+
+	// a lock older than the timeout is from a crashed run and gets removed
+	assert.Error(t, lock.Acquire(remote, time.Nanosecond))
+	assert.True(t, remote.Ran("rm -f myapp/deploy.lock"))
+
+	assert.NoError(t, lock.Release(remote))
+	assert.Equal(t, "preview-abc123.lock", filepath.Base(utils.PreviewLockFile("myapp", "abc123")))
+}
+
+func TestComposeOverride(t *testing.T) {
+	override := utils.DockerComposeFile{}
+	assert.NoError(t, yaml.Unmarshal([]byte(`services:
+  myapp:
+    volumes:
+      - uploads:/app/uploads
+    healthcheck:
+      test: ["CMD", "curl", "-f", "http://localhost:3000"]
+      interval: 10s
+      timeout: 5s
+      retries: 3
+    labels:
+      - traefik.docker.network=edge
+    extra_hosts:
+      - db.internal:10.0.0.5
+volumes:
+  uploads: {}
+`), &override))
+	appConfig := utils.SidekickAppConfig{Name: "myapp", Url: "myapp.example.com", Port: 3000, ComposeOverride: &override}
+
+	composeFile := utils.GetPreviewComposeFile(appConfig, utils.SidekickServer{}, "abc123", "myapp:abc123", nil)
+	service := composeFile.Services["myapp-abc123"]
+	assert.Equal(t, []string{"uploads:/app/uploads"}, service.Volumes)
+	assert.Equal(t, "10s", service.HealthCheck.Interval)
+	assert.Contains(t, service.Labels, "traefik.docker.network=edge")
+	assert.NotContains(t, service.Labels, "traefik.docker.network=sidekick")
+	assert.Contains(t, service.Labels, "traefik.enable=true")
+	assert.Contains(t, composeFile.Volumes, "uploads")
+	assert.NotContains(t, composeFile.Services, "myapp")
+
+	content, err := yaml.Marshal(composeFile)
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "extra_hosts:")
+	assert.Contains(t, string(content), "- db.internal:10.0.0.5")
+}
+
+func TestUseAppPath(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	defer func(file string) { utils.AppConfigFile = file }(utils.AppConfigFile)
+
+	dir := filepath.Join(t.TempDir(), "services", "api")
+	assert.NoError(t, os.MkdirAll(dir, 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "sidekick.yml"), []byte("schema: 1\nname: api\nport: 3000\nurl: api.example.com\n"), 0644))
+	assert.Error(t, utils.UseAppPath(filepath.Join(dir, "sidekick.yml")))
+
+	assert.NoError(t, utils.UseAppPath(dir))
+	appConfig, err := utils.LoadAppConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, "api", appConfig.Name)
+}
+
+func TestDirtyTree(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	dir := t.TempDir()
+	assert.NoError(t, os.Chdir(dir))
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		assert.NoError(t, err, string(out))
+	}
+	git("init", "-q")
+	assert.NoError(t, os.WriteFile("app.go", []byte("package main\n"), 0644))
+	git("add", ".")
+	git("commit", "-q", "-m", "init")
+
+	files, err := utils.DirtyFiles()
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+
+	assert.NoError(t, os.WriteFile("app.go", []byte("package main\n\nfunc main() {}\n"), 0644))
+	assert.NoError(t, os.WriteFile("notes.txt", []byte("todo\n"), 0644))
+	files, err = utils.DirtyFiles()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"M app.go", "?? notes.txt"}, files)
+	assert.EqualError(t, &utils.DirtyTreeError{Files: files}, "uncommitted changes in M app.go, ?? notes.txt")
+
+	sum, err := utils.DirtyDiffSum()
+	assert.NoError(t, err)
+	assert.Len(t, sum, 7)
+	again, _ := utils.DirtyDiffSum()
+	assert.Equal(t, sum, again)
+	assert.NoError(t, os.WriteFile("notes.txt", []byte("done\n"), 0644))
+	changed, _ := utils.DirtyDiffSum()
+	assert.NotEqual(t, sum, changed)
+}
+
+func TestContentHash(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, content string) {
+		assert.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+	write("index.html", "<h1>hi</h1>\n")
+	write("assets/site.css", "body {}\n")
+	write(".dockerignore", "*.log\nnode_modules\n")
+
+	hash, err := utils.ContentHash(dir)
+	assert.NoError(t, err)
+	assert.Regexp(t, `^[0-9a-f]{7}$`, hash)
+	again, _ := utils.ContentHash(dir)
+	assert.Equal(t, hash, again)
+
+	// what docker never sees doesn't change the id
+	write("debug.log", "noise\n")
+	write("node_modules/dep/index.js", "module.exports = 1\n")
+	ignored, _ := utils.ContentHash(dir)
+	assert.Equal(t, hash, ignored)
+
+	// an exception brings a file of an ignored folder back
+	write(".dockerignore", "*.log\nnode_modules\n!node_modules/keep.js\n")
+	exceptions, _ := utils.ContentHash(dir)
+	write("node_modules/keep.js", "kept\n")
+	kept, _ := utils.ContentHash(dir)
+	assert.NotEqual(t, exceptions, kept)
+
+	// the same files in another folder, written later, give the same id
+	copied := t.TempDir()
+	assert.NoError(t, os.CopyFS(copied, os.DirFS(dir)))
+	assert.NoError(t, os.Chtimes(filepath.Join(copied, "index.html"), time.Now(), time.Now().Add(time.Hour)))
+	moved, _ := utils.ContentHash(copied)
+	assert.Equal(t, kept, moved)
+
+	write("assets/site.css", "body { margin: 0 }\n")
+	changed, _ := utils.ContentHash(dir)
+	assert.NotEqual(t, kept, changed)
+
+	metadata := utils.NewDeployMetadata("blog", utils.MetadataEnvProduction, "")
+	assert.Empty(t, metadata.GitSha)
+	assert.Empty(t, metadata.GitBranch)
+	assert.NotEmpty(t, metadata.DeployedAt)
+}
+
+func TestBuildUnchanged(t *testing.T) {
+	appConfig := utils.SidekickAppConfig{Name: "myapp", BuildHash: "a1b2c3d"}
+
+	remote := remotetest.NewFakeExecutor()
+	assert.True(t, utils.BuildUnchanged(remote, appConfig, "a1b2c3d", "myapp:latest"))
+	assert.Equal(t, []string{"docker image inspect --format '{{.Id}}' myapp:latest"}, remote.Commands)
+
+	// new content or a first deploy always builds, without asking the server
+	remote = remotetest.NewFakeExecutor()
+	assert.False(t, utils.BuildUnchanged(remote, appConfig, "e4f5a6b", "myapp:latest"))
+	assert.False(t, utils.BuildUnchanged(remote, utils.SidekickAppConfig{Name: "myapp"}, "", "myapp:latest"))
+	assert.Empty(t, remote.Commands)
+
+	// an image pruned from the server has to be built again
+	remote.On("docker image inspect", "", errors.New("No such image: myapp:latest"))
+	assert.False(t, utils.BuildUnchanged(remote, appConfig, "a1b2c3d", "myapp:latest"))
+}
+
+func TestStaticSite(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, utils.ValidateStaticDir(dir))
+	assert.Error(t, utils.ValidateStaticDir(filepath.Join(dir, "missing")))
+
+	appConfig := utils.SidekickAppConfig{Name: "site", Url: "site.example.com", Port: 80, Static: "dist"}
+	assert.True(t, utils.IsStatic(appConfig))
+	assert.Equal(t, filepath.Join("/tmp/ref", "dist"), utils.StaticBuildContext(appConfig, "/tmp/ref"))
+	assert.Empty(t, utils.ValidateAppConfig(appConfig, false))
+	appConfig.Port = 3000
+	assert.NotEmpty(t, utils.ValidateAppConfig(appConfig, false))
+
+	// the Dockerfile goes in on stdin so it never lands in the site folder
+	buildCmd := utils.GetStaticBuildCommand("site:latest", "linux/amd64", utils.BuildCache{}, dir)
+	assert.Equal(t, []string{"--file", "-", dir}, buildCmd.Args[len(buildCmd.Args)-3:])
+	remoteCmd := utils.GetStaticRemoteBuildCommand("site:latest", utils.SidekickServer{PlatformId: "linux/amd64"}, "/tmp/sidekick-build-1")
+	assert.Contains(t, remoteCmd, "| base64 -d | docker build --tag site:latest")
+	assert.Contains(t, remoteCmd, "--file - /tmp/sidekick-build-1")
+}
+
+func TestRouteConflicts(t *testing.T) {
+	labels := strings.Join([]string{
+		"/blog-blog-1 com.docker.compose.project=blog",
+		"/blog-blog-1 com.docker.compose.service=blog",
+		"/blog-blog-1 com.docker.compose.project.working_dir=/home/sidekick/blog",
+		"/blog-blog-1 traefik.http.routers.blog.rule=Host(`blog.com`)",
+		"/shop-shop-1 com.docker.compose.project=shop",
+		"/shop-shop-1 com.docker.compose.service=shop",
+		"/shop-shop-1 com.docker.compose.project.working_dir=/home/sidekick/shop",
+		"/shop-shop-1 traefik.http.routers.shop.rule=Host(`shop.com`) || Host(`www.shop.com`)",
+		"/blog-abc1234-blog-abc1234-1 com.docker.compose.project=blog-abc1234",
+		"/blog-abc1234-blog-abc1234-1 com.docker.compose.service=blog-abc1234",
+		"/blog-abc1234-blog-abc1234-1 com.docker.compose.project.working_dir=/home/sidekick/blog/preview/abc1234",
+		"/blog-abc1234-blog-abc1234-1 traefik.http.routers.blog-abc1234.rule=Host(`abc1234.blog.com`)",
+	}, "\n")
+	remote := remotetest.NewFakeExecutor().On("docker inspect", labels, nil)
+
+	// redeploying an app or a preview finds only its own containers
+	assert.NoError(t, utils.CheckRouteConflicts(remote, "blog", "blog", "blog.com"))
+	assert.NoError(t, utils.CheckRouteConflicts(remote, "blog/preview/abc1234", "blog-abc1234", "abc1234.blog.com"))
+
+	err := utils.CheckRouteConflicts(remote, "landing", "landing", "www.shop.com")
+	var conflictErr *utils.RouteConflictError
+	assert.ErrorAs(t, err, &conflictErr)
+	assert.Equal(t, []utils.RouteConflict{{Owner: "app shop", Reason: "already serves www.shop.com"}}, conflictErr.Conflicts)
+
+	// an app named like a preview service would replace the preview container
+	err = utils.CheckRouteConflicts(remote, "blog-abc1234", "blog-abc1234", "other.com")
+	assert.ErrorAs(t, err, &conflictErr)
+	assert.Equal(t, "preview abc1234 of app blog", conflictErr.Conflicts[0].Owner)
+
+	stageErr := utils.CheckRouteConflictsStage(remote, "landing", "landing", "shop.com")
+	assert.Equal(t, utils.ExitCodeConfig, stageErr.Code)
+}
+
+func TestAppContainers(t *testing.T) {
+	labels := strings.Join([]string{
+		"/blog-blog-1 com.docker.compose.project.working_dir=/home/sidekick/blog",
+		"/blog-blog-2 com.docker.compose.project.working_dir=/home/sidekick/blog",
+		"/blog-abc1234-blog-abc1234-1 com.docker.compose.project.working_dir=/home/sidekick/blog/preview/abc1234",
+		"/blog-admin-blog-admin-1 com.docker.compose.project.working_dir=/home/sidekick/blog-admin",
+		"/traefik com.docker.compose.project.working_dir=/home/sidekick/traefik",
+	}, "\n")
+	remote := remotetest.NewFakeExecutor().On("docker inspect", labels, nil)
+
+	containers, err := utils.AppContainers(remote, "blog", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"blog-blog-1", "blog-blog-2"}, containers)
+	containers, err = utils.AppContainers(remote, "blog", true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"blog-abc1234-blog-abc1234-1", "blog-blog-1", "blog-blog-2"}, containers)
+}
+
+func TestNormalizeNames(t *testing.T) {
+	assert.NoError(t, utils.ValidateAppName("myapp-api2"))
+	for _, name := range []string{"MyApp", "my_app", "2fast", "app-", strings.Repeat("a", utils.MaxAppNameLength+1)} {
+		assert.Error(t, utils.ValidateAppName(name), name)
+	}
+	assert.Equal(t, "myapp-api", utils.NormalizeAppName("MyApp_API"))
+	assert.Equal(t, "fast-app", utils.NormalizeAppName("2 Fast  App!"))
+	assert.Equal(t, "", utils.NormalizeAppName("123"))
+	assert.NoError(t, utils.ValidateAppName(utils.NormalizeAppName(strings.Repeat("ab_", 30))))
+
+	assert.Equal(t, "xn--bcher-kva.example.com", utils.NormalizeDomain("Bücher.Example.com."))
+	assert.Equal(t, "xn--mnchen-3ya.de", utils.NormalizeDomain("münchen.de"))
+	assert.Equal(t, "app.example.com", utils.NormalizeDomain("app.example.com"))
+	assert.ErrorContains(t, utils.ValidateDomain("bücher.example.com"), "xn--bcher-kva.example.com")
+}
+
+func TestWildcardPreviews(t *testing.T) {
+	appConfig := utils.SidekickAppConfig{Name: "myapp", Url: "myapp.com", Port: 3000}
+	server := utils.SidekickServer{CertEmail: "me@myapp.com"}
+	assert.Equal(t, "abc1234.myapp.com", utils.PreviewHost(appConfig, "abc1234"))
+	assert.NotContains(t, utils.GetTraefikComposeFile(server), "dnschallenge")
+
+	// a preview domain alone still gets a cert per host
+	appConfig.PreviewDomain = "preview.myapp.com"
+	assert.Equal(t, "abc1234.preview.myapp.com", utils.PreviewHost(appConfig, "abc1234"))
+	labels := utils.GetPreviewComposeFile(appConfig, server, "abc1234", "myapp:abc1234", nil).Services["myapp-abc1234"].Labels
+	assert.Contains(t, labels, "traefik.http.routers.myapp-abc1234.rule=Host(`abc1234.preview.myapp.com`)")
+	assert.Contains(t, labels, "traefik.http.routers.myapp-abc1234.tls.certresolver=default")
+
+	server.DNSChallenge.Provider = "cloudflare"
+	compose := utils.GetTraefikComposeFile(server)
+	assert.Contains(t, compose, "--certificatesresolvers.wildcard.acme.dnschallenge.provider=cloudflare")
+	assert.Contains(t, compose, "env_file:\n      - dns.env\n    ports:")
+	var parsed map[string]any
+	assert.NoError(t, yaml.Unmarshal([]byte(compose), &parsed))
+
+	labels = utils.GetPreviewComposeFile(appConfig, server, "abc1234", "myapp:abc1234", nil).Services["myapp-abc1234"].Labels
+	assert.Contains(t, labels, "traefik.http.routers.myapp-abc1234.tls.certresolver=wildcard")
+	assert.Contains(t, labels, "traefik.http.routers.myapp-abc1234.tls.domains[0].sans=*.preview.myapp.com")
+	assert.NotContains(t, labels, "traefik.http.routers.myapp-abc1234.tls.certresolver=default")
+}
+
+func TestBackup(t *testing.T) {
+	remote := remotetest.NewFakeExecutor().On("docker volume ls", strings.Join([]string{
+		"blog_pgdata blog pgdata",
+		"blog-admin_data blog-admin data",
+		"traefik_letsencrypt traefik letsencrypt",
+	}, "\n"), nil)
+
+	volumes, err := utils.ListAppVolumes(remote, "blog")
+	assert.NoError(t, err)
+	assert.Equal(t, []utils.AppVolume{{Name: "pgdata", Volume: "blog_pgdata"}}, volumes)
+	volume, err := utils.FindAppVolume(volumes, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "blog_pgdata", volume.Volume)
+	_, err = utils.FindAppVolume(volumes, "cache")
+	assert.Error(t, err)
+	_, err = utils.FindAppVolume(nil, "")
+	assert.Error(t, err)
+
+	name := utils.BackupFileName(volume, time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC))
+	assert.Equal(t, "pgdata-20240501T123000Z.tar.gz", name)
+	assert.Equal(t, "s3://bucket/blog/"+name, utils.BackupDest("s3://bucket/blog/", name))
+	assert.Equal(t, filepath.Join("backups", name), utils.BackupDest("backups", name))
+	assert.Contains(t, utils.GetVolumeBackupCommand("blog_pgdata"), "-v blog_pgdata:/volume:ro")
+
+	remote = remotetest.NewFakeExecutor().On("index.jsonl", `{"time":"2024-05-01T12:30:00Z","volume":"pgdata","dest":"backups/a.tar.gz","size":42,"sha256":"ab"}`+"\nnot json\n", nil)
+	entries, err := utils.LoadBackups(remote, "blog")
+	assert.NoError(t, err)
+	assert.Equal(t, []utils.BackupEntry{{Time: "2024-05-01T12:30:00Z", Volume: "pgdata", Dest: "backups/a.tar.gz", Size: 42, Sha256: "ab"}}, entries)
+
+	assert.Equal(t, "postgres-20240501T123000Z.sql.gz", utils.DatabaseBackupFileName(time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)))
+	assert.True(t, utils.IsDatabaseBackup("s3://bucket/blog/postgres-20240501T123000Z.sql.gz"))
+	assert.Contains(t, utils.GetDatabaseBackupCommand("blog"), "pg_dump -U blog -d blog --clean --if-exists -Z 6")
+	assert.Contains(t, utils.GetDatabaseBackupCommand("blog"), "label=com.docker.compose.service=blog-postgres")
+
+	entries = []utils.BackupEntry{
+		{Time: "1", Volume: "pgdata", Dest: "s3://bucket/blog/pgdata-1.tar.gz"},
+		{Time: "2", Addon: "postgres", Dest: "s3://bucket/blog/postgres-2.sql.gz"},
+		{Time: "3", Volume: "pgdata", Dest: filepath.Join("backups", "pgdata-3.tar.gz")},
+		{Time: "4", Volume: "pgdata", Dest: "s3://bucket/blog/pgdata-4.tar.gz"},
+		{Time: "5", Volume: "pgdata", Dest: "s3://bucket/blog/pgdata-5.tar.gz"},
+	}
+	kept, pruned := utils.PruneBackups(entries, "pgdata", "s3://bucket/blog/", 2)
+	assert.Equal(t, []utils.BackupEntry{entries[0]}, pruned)
+	assert.Equal(t, []utils.BackupEntry{entries[1], entries[2], entries[3], entries[4]}, kept)
+	_, pruned = utils.PruneBackups(entries, "postgres", "s3://bucket/blog", 1)
+	assert.Empty(t, pruned)
+	_, pruned = utils.PruneBackups(entries, "pgdata", "backups", 0)
+	assert.Equal(t, []utils.BackupEntry{entries[2]}, pruned)
+}
+
+func TestDomainDNS(t *testing.T) {
+	resolved, err := utils.VerifyDomainDNS("localhost", "127.0.0.1")
+	assert.NoError(t, err)
+	assert.Contains(t, resolved, "127.0.0.1")
+
+	_, err = utils.VerifyDomainDNS("localhost", "203.0.113.7")
+	var mismatch *utils.DNSMismatchError
+	assert.ErrorAs(t, err, &mismatch)
+	assert.Equal(t, "Point the A record of localhost to 203.0.113.7", mismatch.Fix())
+
+	_, err = utils.VerifyDomainDNS("app.invalid", "203.0.113.7")
+	assert.ErrorAs(t, err, &mismatch)
+	assert.Empty(t, mismatch.Resolved)
+	assert.Equal(t, "app.invalid does not resolve", mismatch.Error())
+
+	assert.True(t, utils.IsSslipDomain("blog.203.0.113.7.sslip.io"))
+	assert.False(t, utils.IsSslipDomain("sslip.io.example.com"))
+
+	cmd := &cobra.Command{}
+	cmd.Flags().Bool("skip-dns-check", false, "")
+	assert.NoError(t, utils.CheckDomainDNSStage(cmd, "blog.203.0.113.7.sslip.io", "203.0.113.7"))
+	assert.Error(t, utils.CheckDomainDNSStage(cmd, "localhost", "203.0.113.7"))
+	assert.NoError(t, cmd.Flags().Set("skip-dns-check", "true"))
+	assert.NoError(t, utils.CheckDomainDNSStage(cmd, "localhost", "203.0.113.7"))
+}
+
+func TestVerifyDeploy(t *testing.T) {
+	appConfig := utils.SidekickAppConfig{Name: "blog", Url: "blog.example.com"}
+	assert.Equal(t, "https://blog.example.com/", utils.VerifyURL(appConfig, appConfig.Url))
+	appConfig.HealthCheck.Path = "/healthz"
+	appConfig.TLS.Disabled = true
+	assert.Equal(t, "http://blog.example.com/healthz", utils.VerifyURL(appConfig, appConfig.Url))
+
+	cmd := &cobra.Command{}
+	cmd.Flags().String("verify-timeout", "", "")
+	timeout, err := utils.GetVerifyTimeout(cmd, appConfig)
+	assert.NoError(t, err)
+	assert.Equal(t, utils.DefaultVerifyTimeout, timeout)
+	appConfig.VerifyTimeout = "5m"
+	timeout, _ = utils.GetVerifyTimeout(cmd, appConfig)
+	assert.Equal(t, 5*time.Minute, timeout)
+	assert.NoError(t, cmd.Flags().Set("verify-timeout", "0"))
+	timeout, _ = utils.GetVerifyTimeout(cmd, appConfig)
+	assert.Zero(t, timeout)
+	assert.NoError(t, cmd.Flags().Set("verify-timeout", "soon"))
+	_, err = utils.GetVerifyTimeout(cmd, appConfig)
+	assert.Error(t, err)
+
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	assert.NoError(t, utils.ProbeURL(server.Client(), server.URL))
+	status = http.StatusNotFound
+	assert.NoError(t, utils.ProbeURL(server.Client(), server.URL))
+	status = http.StatusBadGateway
+	assert.ErrorContains(t, utils.ProbeURL(server.Client(), server.URL), "502")
+
+	tlsServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tlsServer.Config.ErrorLog = log.New(io.Discard, "", 0)
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+	assert.Error(t, utils.ProbeURL(http.DefaultClient, tlsServer.URL), "an untrusted certificate fails the check")
+	assert.NoError(t, utils.ProbeURL(tlsServer.Client(), tlsServer.URL))
+}
+
+func TestParseServiceProbe(t *testing.T) {
+	state, dockerHealth, ip := utils.ParseServiceProbe("running|healthy|addons=172.20.0.3,sidekick=172.18.0.5,\n", utils.DefaultNetwork)
+	assert.Equal(t, "running", state)
+	assert.Equal(t, "healthy", dockerHealth)
+	assert.Equal(t, "172.18.0.5", ip, "a container on the addons network is curled on the network it shares with traefik")
+
+	_, _, ip = utils.ParseServiceProbe("running||addons=172.20.0.3,", utils.DefaultNetwork)
+	assert.Equal(t, "172.20.0.3", ip)
+	state, _, ip = utils.ParseServiceProbe("exited", utils.DefaultNetwork)
+	assert.Equal(t, "exited", state)
+	assert.Empty(t, ip)
+}
+
+func TestRestoreBackup(t *testing.T) {
+	entries := []utils.BackupEntry{
+		{Volume: "pgdata", Dest: "backups/pgdata-1.tar.gz", Sha256: "old"},
+		{Volume: "pgdata", Dest: "s3://bucket/blog/pgdata-2.tar.gz", Sha256: "new"},
+	}
+	entry, found := utils.FindBackup(entries, "s3://bucket/blog/pgdata-2.tar.gz")
+	assert.True(t, found)
+	assert.Equal(t, "new", entry.Sha256)
+	entry, found = utils.FindBackup(entries, filepath.Join("elsewhere", "pgdata-1.tar.gz"))
+	assert.True(t, found)
+	assert.Equal(t, "old", entry.Sha256)
+	_, found = utils.FindBackup(entries, "pgdata-3.tar.gz")
+	assert.False(t, found)
+
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "pgdata.tar.gz")
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	assert.NoError(t, tw.WriteHeader(&tar.Header{Name: "PG_VERSION", Mode: 0600, Size: 3}))
+	_, err := tw.Write([]byte("16\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, tw.Close())
+	assert.NoError(t, gz.Close())
+	assert.NoError(t, os.WriteFile(archive, buf.Bytes(), 0600))
+	expected := sha256.Sum256(buf.Bytes())
+
+	sum, err := utils.VerifyBackupArchive(archive, "")
+	assert.NoError(t, err)
+	assert.Equal(t, hex.EncodeToString(expected[:]), sum)
+	_, err = utils.VerifyBackupArchive(archive, sum)
+	assert.NoError(t, err)
+	_, err = utils.VerifyBackupArchive(archive, "deadbeef")
+	assert.ErrorContains(t, err, "checksum")
+
+	truncated := filepath.Join(dir, "truncated.tar.gz")
+	assert.NoError(t, os.WriteFile(truncated, buf.Bytes()[:buf.Len()-10], 0600))
+	_, err = utils.VerifyBackupArchive(truncated, "")
+	assert.Error(t, err)
+
+	dump := filepath.Join(dir, "postgres.sql.gz")
+	buf.Reset()
+	gz = gzip.NewWriter(&buf)
+	_, err = gz.Write([]byte("DROP TABLE IF EXISTS posts;\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, gz.Close())
+	assert.NoError(t, os.WriteFile(dump, buf.Bytes(), 0600))
+	_, err = utils.VerifyBackupArchive(dump, "")
+	assert.NoError(t, err, "a database dump is gzipped SQL, not a tar")
+	assert.Contains(t, utils.GetRestoreDatabaseCommand("blog", utils.RemoteRestoreFile("blog")), `gunzip -c "$HOME/blog/backups/restore.tar.gz" | docker exec -i`)
+
+	assert.Equal(t, `docker run --rm -v blog_pgdata:/volume -v "$HOME/blog/backups/restore.tar.gz":/backup.tar.gz:ro alpine:3.20 sh -c 'find /volume -mindepth 1 -delete && tar -xzf /backup.tar.gz -C /volume'`,
+		utils.GetRestoreVolumeCommand("blog_pgdata", utils.RemoteRestoreFile("blog")))
+}
+
+func TestCronJobs(t *testing.T) {
+	for _, schedule := range []string{"0 3 * * *", "*/15 9-17 * * 1-5", "0 0 1,15 * *", "@daily"} {
+		assert.NoError(t, utils.ValidateCronSchedule(schedule), schedule)
+	}
+	for _, schedule := range []string{"", "0 3 * *", "60 * * * *", "* * * * 8", "*/0 * * * *", "@sometimes", "5-1 * * * *"} {
+		assert.Error(t, utils.ValidateCronSchedule(schedule), schedule)
+	}
+
+	appConfig := utils.SidekickAppConfig{Name: "blog", Url: "blog.example.com", Port: 3000, Env: utils.SidekickAppEnvConfig{File: ".env"}, Cron: []utils.SidekickCronJob{
+		{Name: "cleanup", Schedule: "0 3 * * *", Command: "sh -c 'rm -rf /tmp/*'"},
+	}}
+	assert.Empty(t, utils.ValidateAppConfig(appConfig, false))
+	invalid := appConfig
+	invalid.Cron = append(slices.Clone(appConfig.Cron), utils.SidekickCronJob{Name: "cleanup", Schedule: "daily", Command: ""})
+	assert.Len(t, utils.ValidateAppConfig(invalid, false), 3)
+
+	script := utils.GetCronScript(appConfig, utils.SidekickServer{}, appConfig.Cron[0])
+	assert.Contains(t, script, `cd "$HOME/blog" || exit 1`)
+	assert.Contains(t, script, `sops exec-env encrypted.env 'docker compose -p blog run --rm -T blog sh -c '\''rm -rf /tmp/*'\'''`)
+
+	podman := utils.SidekickServer{Runtime: utils.RuntimePodman, Compose: utils.PodmanComposeCommand, SecretKey: "AGE-SECRET-KEY-1"}
+	script = utils.GetCronScript(appConfig, podman, appConfig.Cron[0])
+	assert.Contains(t, script, `sops exec-env encrypted.env 'sudo -E podman-compose -p blog run --rm -T blog sh -c '\''rm -rf /tmp/*'\'''`)
+	assert.Contains(t, utils.GetInstallCronCommand(appConfig, podman), base64.StdEncoding.EncodeToString([]byte(script)), "the script is rewritten before it is encoded")
+
+	assert.Equal(t, "# begin sidekick blog\n"+`0 3 * * * sh "$HOME/blog/cron/cleanup.sh" >> "$HOME/blog/cron/cleanup.log" 2>&1`+"\n# end sidekick blog\n", utils.GetCrontabBlock(appConfig))
+	install := utils.GetInstallCronCommand(appConfig, utils.SidekickServer{SecretKey: "AGE-SECRET-KEY-1"})
+	assert.Contains(t, install, utils.RemoteAgeKeyFile)
+	assert.Contains(t, install, "crontab -")
+
+	removed := appConfig
+	removed.Cron = nil
+	install = utils.GetInstallCronCommand(removed, utils.SidekickServer{SecretKey: "AGE-SECRET-KEY-1"})
+	assert.True(t, strings.HasPrefix(install, "command -v crontab >/dev/null || exit 0"))
+	assert.NotContains(t, install, utils.RemoteAgeKeyFile)
+	assert.Contains(t, install, `sed '\|^# begin sidekick blog$|,\|^# end sidekick blog$|d'`)
+
+	_, err := utils.FindCronJob(appConfig, "backup")
+	assert.ErrorContains(t, err, "it has cleanup")
+
+	remote := remotetest.NewFakeExecutor().On("blog/cron", "cleanup 1714566600\nold 0\n", nil)
+	status, err := utils.LoadCronStatus(remote, "blog")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1714566600), status["cleanup"].Unix())
+	assert.True(t, status["old"].IsZero())
+}
+
+func TestReleaseVersions(t *testing.T) {
+	for version, tag := range map[string]string{"": "", "1.4.0": "1.4.0", "v2.0.0-rc.1": "v2.0.0-rc.1", "1.4.0+42": "1.4.0-42"} {
+		got, err := utils.ValidateAppVersion(version)
+		assert.NoError(t, err, version)
+		assert.Equal(t, tag, got)
+	}
+	for _, version := range []string{"V3", "latest", "1.0 beta", ".hidden"} {
+		_, err := utils.ValidateAppVersion(version)
+		assert.Error(t, err, version)
+	}
+
+	cwd, _ := os.Getwd()
+	dir := t.TempDir()
+	assert.NoError(t, os.Chdir(dir))
+	defer os.Chdir(cwd)
+	version, err := utils.ResolveAppVersion(nil)
+	assert.NoError(t, err)
+	assert.Empty(t, version)
+	version, err = utils.ReadVersionFile()
+	assert.NoError(t, err)
+	assert.Empty(t, version)
+	assert.NoError(t, os.WriteFile(utils.VersionFile, []byte("1.4.0\n"), 0644))
+	version, err = utils.ResolveAppVersion(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.4.0", version)
+	version, _ = utils.ReadVersionFile()
+	assert.Equal(t, "1.4.0", version)
+
+	appConfig := utils.SidekickAppConfig{Name: "myapp"}
+	tags := utils.ReleaseImageTags(appConfig, "1.4.0", "3f2c1ab")
+	assert.Equal(t, []string{"myapp:1.4.0", "myapp:3f2c1ab"}, tags)
+	assert.Equal(t, "docker tag myapp:latest myapp:V3 && docker tag myapp:latest myapp:1.4.0 && docker tag myapp:latest myapp:3f2c1ab",
+		utils.GetTagImageCommand("myapp:latest", append([]string{"myapp:V3"}, tags...)))
+
+	// the release tags of a pruned image go with it, unless a kept or protected image needs them
+	images := "V9 aaa\n1.2.0 aaa\nV8 bbb\n1.1.0 bbb\n3f2a1c bbb\nV7 ccc\n1.0.0 ccc\nV6 ccc\nlatest aaa\n"
+	remote := remotetest.NewFakeExecutor().
+		On("docker image ls myapp", images, nil).
+		On("docker ps -aq", "", nil)
+	remove, err := utils.ImagesToPrune(remote, "myapp", 2, "myapp:3f2a1c")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"myapp:V7", "myapp:1.0.0", "myapp:V6"}, remove)
+}
+
+func TestRunTask(t *testing.T) {
+	appConfig := utils.SidekickAppConfig{Name: "blog", Url: "blog.example.com", Port: 3000, Registry: utils.SidekickRegistryConfig{Url: "ghcr.io", Username: "me"}}
+	image, err := utils.RunImage(appConfig, "V3")
+	assert.NoError(t, err)
+	assert.Equal(t, "ghcr.io/me/blog:V3", image)
+	image, err = utils.RunImage(appConfig, "postgres:16")
+	assert.NoError(t, err)
+	assert.Equal(t, "postgres:16", image)
+	assert.Equal(t, "blog-run-1714566600", utils.RunContainerName("blog", time.Unix(1714566600, 0)))
+
+	task := utils.RunTask{Name: "blog-run-1", Command: "'sh' '-c' 'exit 3'"}
+	withEnv := appConfig
+	withEnv.Env.File = ".env"
+	assert.Contains(t, utils.GetRunTaskCommand(withEnv, task, "AGE-SECRET-KEY-1"), `SOPS_AGE_KEY='AGE-SECRET-KEY-1' sops exec-env encrypted.env 'docker compose -p blog run --rm -T --name blog-run-1 blog '\''sh'\'' '\''-c'\'' '\''exit 3'\'''`)
+	task.Image = "ghcr.io/me/blog:V3"
+	task.Detach = true
+	detached := utils.GetRunTaskCommand(appConfig, task, "")
+	assert.Contains(t, detached, "docker compose -p blog -f docker-compose.yaml -f .blog-run-1.yaml run -d --rm --name blog-run-1 blog")
+	assert.Contains(t, detached, "rm -f .blog-run-1.yaml")
+
+	// a fake docker runs the command itself, the exit code has to make it through the wrapper
+	home := t.TempDir()
+	assert.NoError(t, os.Mkdir(filepath.Join(home, "blog"), 0o755))
+	bin := t.TempDir()
+	fakeDocker := "#!/bin/sh\ncase \"$*\" in\n  *' run '*) shift 9; \"$@\" ;;\n  *) echo \"$*\" >> \"$HOME/removed\" ;;\nesac\n"
+	assert.NoError(t, os.WriteFile(filepath.Join(bin, "docker"), []byte(fakeDocker), 0o755))
+	run := exec.Command("sh", "-c", utils.GetRunTaskCommand(appConfig, utils.RunTask{Name: "blog-run-1", Command: "sh -c 'echo migrated; exit 3'"}, ""))
+	run.Dir = home
+	run.Env = append(os.Environ(), "HOME="+home, "PATH="+bin+":"+os.Getenv("PATH"))
+	// the session stays open while the task runs, closing it early would remove the container
+	stdin, session, err := os.Pipe()
+	assert.NoError(t, err)
+	defer session.Close()
+	run.Stdin = stdin
+	output, err := run.Output()
+	stdin.Close()
+	var exitErr *exec.ExitError
+	assert.ErrorAs(t, err, &exitErr)
+	assert.Equal(t, 3, exitErr.ExitCode())
+	assert.Equal(t, "migrated\n", string(output))
+	assert.NoFileExists(t, filepath.Join(home, "removed"))
+}
+
+func TestPostgresAddon(t *testing.T) {
+	appConfig := utils.SidekickAppConfig{Name: "blog", Url: "blog.example.com", Port: 3000, Addons: []utils.SidekickAddon{utils.NewAddon(utils.AddonPostgres)}}
+	assert.Empty(t, utils.ValidateAppConfig(appConfig, false))
+	invalid := appConfig
+	invalid.Addons = append(slices.Clone(appConfig.Addons), utils.SidekickAddon{Type: "postgres", Version: ""}, utils.SidekickAddon{Type: "mysql", Version: "8"})
+	assert.Len(t, utils.ValidateAppConfig(invalid, false), 3)
+
+	composeFile := utils.GetAppComposeFile(appConfig, "blog", "blog:V1", "blog.example.com", nil)
+	postgres := composeFile.Services["blog-postgres"]
+	assert.Equal(t, "postgres:16.4-alpine", postgres.Image)
+	assert.Empty(t, postgres.Ports)
+	assert.Equal(t, []string{"sidekick"}, postgres.Networks)
+	assert.Contains(t, postgres.Environment, "POSTGRES_PASSWORD=${_POSTGRES_PASSWORD}")
+	assert.Equal(t, []string{"postgres-data:/var/lib/postgresql/data"}, postgres.Volumes)
+	assert.Contains(t, composeFile.Volumes, "postgres-data")
+	assert.Equal(t, "service_healthy", composeFile.Services["blog"].DependsOn["blog-postgres"].Condition)
+	preview := utils.GetAppComposeFile(appConfig, "blog-abc", "blog:abc", "abc.blog.example.com", nil)
+	assert.NotContains(t, preview.Services, "blog-postgres")
+
+	envFile := filepath.Join(t.TempDir(), ".env")
+	assert.NoError(t, os.WriteFile(envFile, []byte("# app\nSECRET=1\nDATABASE_URL=sqlite://db\n"), 0o600))
+	assert.Empty(t, utils.ExistingAddonPassword(envFile, utils.AddonPostgres))
+	password, err := utils.GenerateAddonPassword()
+	assert.NoError(t, err)
+	assert.NoError(t, utils.SetEnvVars(envFile, utils.GetAddonEnv("blog", appConfig.Addons[0], password)))
+	env, err := godotenv.Read(envFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "1", env["SECRET"])
+	assert.Equal(t, fmt.Sprintf("postgres://blog:%s@blog-postgres:5432/blog", password), env["DATABASE_URL"])
+	assert.Equal(t, password, utils.ExistingAddonPassword(envFile, utils.AddonPostgres))
+
+	assert.NoError(t, utils.RemoveEnvVars(envFile, utils.AddonEnvKeys(utils.AddonPostgres)))
+	content, err := os.ReadFile(envFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "# app\nSECRET=1\n", string(content))
+
+	assert.Equal(t, "cd blog && docker compose -p blog up -d --wait --no-deps blog-postgres", utils.GetStartAddonsCommand(appConfig, ""))
+	assert.NotContains(t, utils.GetRemoveAddonCommand("blog", utils.AddonPostgres, false), "docker volume rm")
+	assert.Contains(t, utils.GetRemoveAddonCommand("blog", utils.AddonPostgres, true), "name=^blog_postgres-data$")
+}
+
+func TestRollbackHistory(t *testing.T) {
+	appConfig := utils.SidekickAppConfig{Name: "myapp", Version: "V4", Image: "myapp:latest"}
+	assert.Equal(t, "myapp:V4", utils.LiveImageTag(appConfig))
+	appConfig.Image = "myapp:V2"
+	assert.Equal(t, "myapp:V2", utils.LiveImageTag(appConfig))
+	assert.Empty(t, utils.LiveImageTag(utils.SidekickAppConfig{Name: "myapp"}))
+
+	history := utils.RecordRollbackImage(nil, "myapp:V1", 3)
+	history = utils.RecordRollbackImage(history, "myapp:V2", 3)
+	history = utils.RecordRollbackImage(history, "myapp:V3", 3)
+	assert.Equal(t, []string{"myapp:V2", "myapp:V3"}, history)
+	assert.Equal(t, []string{"myapp:V3", "myapp:V2"}, utils.RecordRollbackImage(history, "myapp:V2", 3))
+	assert.Empty(t, utils.RecordRollbackImage(history, "myapp:V4", 1))
+
+	_, err := utils.RollbackImage(appConfig, "")
+	assert.Error(t, err)
+	appConfig.ImageHistory = history
+	image, err := utils.RollbackImage(appConfig, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "myapp:V3", image)
+	image, _ = utils.RollbackImage(appConfig, "3f2a1c")
+	assert.Equal(t, "myapp:3f2a1c", image)
+	assert.Contains(t, utils.ProtectedImages(appConfig), "myapp:V2")
+
+	content, err := utils.SetComposeImage([]byte("services:\n  myapp:\n    image: myapp:latest\n    extra_hosts:\n      - db:10.0.0.2\nnetworks:\n  sidekick:\n    external: true\n"), "myapp", "myapp:V3")
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "image: myapp:V3")
+	assert.Contains(t, string(content), "db:10.0.0.2")
+	_, err = utils.SetComposeImage(content, "other", "myapp:V3")
+	assert.Error(t, err)
+}
+
+func TestRedisAddon(t *testing.T) {
+	redis := utils.NewAddon(utils.AddonRedis)
+	redis.Persist = true
+	appConfig := utils.SidekickAppConfig{Name: "blog", Url: "blog.example.com", Port: 3000, Addons: []utils.SidekickAddon{redis}}
+	assert.Empty(t, utils.ValidateAppConfig(appConfig, false))
+	invalid := appConfig
+	invalid.Addons = []utils.SidekickAddon{{Type: utils.AddonPostgres, Version: utils.DefaultPostgresVersion, Shared: true}}
+	assert.Len(t, utils.ValidateAppConfig(invalid, false), 1)
+
+	composeFile := utils.GetAppComposeFile(appConfig, "blog", "blog:V1", "blog.example.com", nil)
+	service := composeFile.Services["blog-redis"]
+	assert.Equal(t, "redis:7.2-alpine", service.Image)
+	assert.Equal(t, "redis-server --requirepass ${_REDIS_PASSWORD} --appendonly yes", service.Command)
+	assert.Equal(t, []string{utils.AddonsNetwork}, service.Networks)
+	assert.Equal(t, []string{"redis-data:/data"}, service.Volumes)
+	assert.Equal(t, []string{"sidekick", utils.AddonsNetwork}, composeFile.Services["blog"].Networks)
+	assert.False(t, composeFile.Networks[utils.AddonsNetwork].External)
+
+	// previews run an empty redis of their own on their own network
+	preview := utils.GetAppComposeFile(appConfig, "blog-abc", "blog:abc", "abc.blog.example.com", nil)
+	assert.Empty(t, preview.Services["blog-redis"].Volumes)
+	assert.NotContains(t, preview.Volumes, "redis-data")
+	assert.Equal(t, "service_healthy", preview.Services["blog-abc"].DependsOn["blog-redis"].Condition)
+	assert.Contains(t, utils.GetRemovePreviewAddonsCommand(appConfig, "abc"), "label=com.docker.compose.project=blog-abc")
+
+	appConfig.Addons[0].Shared = true
+	preview = utils.GetAppComposeFile(appConfig, "blog-abc", "blog:abc", "abc.blog.example.com", nil)
+	assert.NotContains(t, preview.Services, "blog-redis")
+	assert.True(t, preview.Networks[utils.AddonsNetwork].External)
+	assert.Equal(t, "blog_addons", preview.Networks[utils.AddonsNetwork].Extra["name"])
+	assert.Contains(t, preview.Services["blog-abc"].Networks, utils.AddonsNetwork)
+	assert.Empty(t, utils.GetRemovePreviewAddonsCommand(appConfig, "abc"))
+
+	env := utils.GetAddonEnv("blog", redis, "secret")
+	assert.Equal(t, [][2]string{{"REDIS_URL", "redis://:secret@blog-redis:6379"}, {"_REDIS_PASSWORD", "secret"}}, env)
+	assert.True(t, utils.AddonKeepsData(redis))
+	assert.False(t, utils.AddonKeepsData(utils.NewAddon(utils.AddonRedis)))
+}
+
+func TestPlainTask(t *testing.T) {
+	capture := func(run func()) string {
+		reader, writer, err := os.Pipe()
+		assert.NoError(t, err)
+		stdout := os.Stdout
+		os.Stdout = writer
+		run()
+		os.Stdout = stdout
+		writer.Close()
+		output, _ := io.ReadAll(reader)
+		return string(output)
+	}
+	defer render.SetPlain(false)
+	render.SetPlain(true)
+
+	output := capture(func() {
+		task := utils.StartTask("Uploading backup.tar.gz")
+		// progress right after the start is not worth a line of its own
+		task.UpdateText("Uploading backup.tar.gz, 1 MB of 4 MB")
+		task.Success()
+	})
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	assert.Len(t, lines, 2)
+	assert.Regexp(t, `^\d{4}-\d\d-\d\dT\S+ \.\.\. Uploading backup.tar.gz$`, lines[0])
+	assert.True(t, strings.HasSuffix(lines[1], "✔ Uploading backup.tar.gz, 1 MB of 4 MB"))
+	assert.NotContains(t, output, "\x1b[")
+
+	defer render.SetQuiet(false)
+	render.SetQuiet(true)
+	output = capture(func() {
+		task := utils.StartTask("Pulling myapp:latest")
+		task.Warning("manifest unknown")
+		task.Success("Build cache seeded")
+	})
+	assert.NotContains(t, output, "Pulling")
+	assert.NotContains(t, output, "Build cache seeded")
+	assert.Contains(t, output, "! manifest unknown")
+}
+
+func TestBuildCacheArgs(t *testing.T) {
+	appConfig := utils.SidekickAppConfig{Name: "myapp", Registry: utils.SidekickRegistryConfig{Url: "ghcr.io", Username: "me"}}
+
+	// the last build of the app is always a cache source, --push adds the cache image it sends along
+	cache, err := utils.GetBuildCache(appConfig, "", false, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ghcr.io/me/myapp:latest"}, cache.From)
+	cache, _ = utils.GetBuildCache(appConfig, "ghcr.io/me/myapp:ci", true, false)
+	assert.Equal(t, []string{"ghcr.io/me/myapp:ci", "ghcr.io/me/myapp:latest", "ghcr.io/me/myapp:buildcache"}, cache.From)
+
+	remoteCmd := utils.GetRemoteBuildCommand("myapp:latest", utils.SidekickServer{PlatformId: "linux/amd64"}, cache, "/tmp/sidekick-build-1")
+	assert.Contains(t, remoteCmd, "--cache-from ghcr.io/me/myapp:ci --cache-from ghcr.io/me/myapp:latest --cache-from ghcr.io/me/myapp:buildcache /tmp/sidekick-build-1")
+	assert.Contains(t, remoteCmd, "BUILDKIT_INLINE_CACHE=1")
+
+	cache, _ = utils.GetBuildCache(appConfig, "ghcr.io/me/myapp:ci", true, true)
+	args := utils.GetDockerBuildArgs("myapp:latest", "linux/amd64", cache, ".")
+	assert.Contains(t, args, "--no-cache")
+	assert.NotContains(t, args, "--cache-from")
+
+	assert.Equal(t, "Build took 42s", utils.BuildTimeReport(42*time.Second, ""))
+	assert.Equal(t, "Build took 30s, 1m30s faster than the last build (75%)", utils.BuildTimeReport(30*time.Second, "2m0s"))
+	assert.Equal(t, "Build took 1m0s, 20s slower than the last build", utils.BuildTimeReport(time.Minute, "40s"))
+}
+
+func TestCompletion(t *testing.T) {
+	defer func(file string) { utils.AppConfigFile = file }(utils.AppConfigFile)
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "sidekick.yaml")
+	config := "version: 1\nservers:\n  - name: prod\n    serveraddress: 203.0.113.10\n  - name: staging\n    serveraddress: 203.0.113.20\ncontexts:\n  - name: production\n    server: prod\n"
+	assert.NoError(t, os.WriteFile(configFile, []byte(config), 0644))
+	app := "schema: 1\nname: web\nport: 3000\nurl: web.example.com\nserver: prod\npreviewEnvs:\n    b2c3d4e:\n        url: b2c3d4e.web.example.com\n    a1b2c3d:\n        url: a1b2c3d.web.example.com\n"
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "sidekick.yml"), []byte(app), 0644))
+	apps := "schema: 1\napps:\n    api:\n        name: api\n    web:\n        name: web\n"
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "services"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "services", "sidekick.yml"), []byte(apps), 0644))
+
+	cmd := &cobra.Command{Use: "test"}
+	cmd.Flags().String("config", configFile, "")
+	cmd.Flags().String("app-config", "", "")
+	cmd.Flags().String("path", "", "")
+
+	// everything comes from the local files, no server is asked
+	contexts, directive := utils.CompleteContexts(cmd, nil, "")
+	assert.Equal(t, []string{"production\tserver prod"}, contexts)
+	assert.Equal(t, cobra.ShellCompDirectiveNoFileComp, directive)
+	servers, _ := utils.CompleteServers(cmd, nil, "")
+	assert.Equal(t, []string{"prod\t203.0.113.10", "staging\t203.0.113.20"}, servers)
+	addresses, _ := utils.CompleteServerAddresses(cmd, nil, "")
+	assert.Equal(t, []string{"203.0.113.10\tprod", "203.0.113.20\tstaging"}, addresses)
+
+	utils.AppConfigFile = filepath.Join(dir, "sidekick.yml")
+	hashes, _ := utils.CompletePreviewHashes(cmd, nil, "")
+	assert.Equal(t, []string{"a1b2c3d\ta1b2c3d.web.example.com", "b2c3d4e\tb2c3d4e.web.example.com"}, hashes)
+	hashes, _ = utils.CompletePreviewHashes(cmd, []string{"a1b2c3d"}, "")
+	assert.Empty(t, hashes)
+
+	// a single app has no apps to pick from
+	names, _ := utils.CompleteApps(cmd, nil, "")
+	assert.Empty(t, names)
+	assert.NoError(t, cmd.Flags().Set("path", filepath.Join(dir, "services")))
+	names, _ = utils.CompleteApps(cmd, nil, "")
+	assert.Equal(t, []string{"api", "web"}, names)
+
+	assert.NoError(t, cmd.Flags().Set("config", filepath.Join(dir, "missing.yaml")))
+	servers, _ = utils.CompleteServers(cmd, nil, "")
+	assert.Empty(t, servers)
+}
+
+func TestFormatDeployAge(t *testing.T) {
+	deployedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	assert.Equal(t, "just now", utils.FormatDeployAge(deployedAt, deployedAt.Add(59*time.Second)))
+	assert.Equal(t, "just now", utils.FormatDeployAge(deployedAt, deployedAt.Add(-time.Minute)))
+	assert.Equal(t, "5m ago", utils.FormatDeployAge(deployedAt, deployedAt.Add(5*time.Minute+30*time.Second)))
+	assert.Equal(t, "3h ago", utils.FormatDeployAge(deployedAt, deployedAt.Add(3*time.Hour+59*time.Minute)))
+	assert.Equal(t, "2d ago", utils.FormatDeployAge(deployedAt, deployedAt.Add(50*time.Hour)))
+
+	badgeJSON, err := utils.GetBadgeJSON("V4", "3f2c1ab", deployedAt, deployedAt.Add(3*time.Hour))
+	assert.NoError(t, err)
+	assert.Contains(t, string(badgeJSON), `"message":"V4 · 3f2c1ab · 3h ago"`)
+	assert.Equal(t, "MESSAGE='V4 · 3f2c1ab'\nDEPLOYED_AT=1714564800\n", utils.GetBadgeDeployedFile("V4", "3f2c1ab", deployedAt))
+
+	composeFile := utils.GetBadgeComposeFile(utils.SidekickAppConfig{Name: "blog", Url: "blog.example.com"})
+	assert.Equal(t, "sh /badge/refresh.sh", composeFile.Services["blog-badge-refresh"].Command)
+	assert.Empty(t, composeFile.Services["blog-badge-refresh"].Labels)
+}
+
+func TestRetryPolicy(t *testing.T) {
+	flaky := errors.New("connection reset")
+	for _, test := range []struct {
+		name         string
+		policy       utils.RetryPolicy
+		failures     int
+		wantAttempts int
+		wantErr      error
+		wantRetries  []string
+	}{
+		{name: "first attempt", policy: utils.RetryPolicy{Attempts: 3}, failures: 0, wantAttempts: 1},
+		{name: "success after two failures", policy: utils.RetryPolicy{Attempts: 3}, failures: 2, wantAttempts: 3, wantRetries: []string{"2/3", "3/3"}},
+		{name: "gives up", policy: utils.RetryPolicy{Attempts: 3}, failures: 5, wantAttempts: 3, wantErr: flaky, wantRetries: []string{"2/3", "3/3"}},
+		{name: "no attempts still runs once", policy: utils.RetryPolicy{}, failures: 1, wantAttempts: 1, wantErr: flaky},
+		// an hour would time the test out if MaxDelay didn't cap it
+		{name: "max delay caps the backoff", policy: utils.RetryPolicy{Attempts: 3, BaseDelay: time.Hour, MaxDelay: 2 * time.Millisecond}, failures: 2, wantAttempts: 3, wantRetries: []string{"2/3", "3/3"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			calls := 0
+			var retries []string
+			start := time.Now()
+			attempts, err := test.policy.Do(func() error {
+				calls++
+				if calls <= test.failures {
+					return flaky
+				}
+				return nil
+			}, func(attempt int, attempts int, err error) {
+				retries = append(retries, fmt.Sprintf("%d/%d", attempt, attempts))
+			})
+			assert.Less(t, time.Since(start), time.Second)
+			assert.Equal(t, test.wantAttempts, attempts)
+			assert.Equal(t, test.wantAttempts, calls)
+			assert.Equal(t, test.wantErr, err)
+			assert.Equal(t, test.wantRetries, retries)
+		})
+	}
+
+	report := &utils.RetryReport{}
+	report.Record("image pull", 3)
+	report.Record("ufw install", 1)
+	assert.Contains(t, report.String(), "image pull: retried 2 time(s)")
+	assert.NotContains(t, report.String(), "ufw install")
+
+	assert.Contains(t, utils.GetTraefikStage(utils.SidekickServer{}).Commands, "cd traefik && sudo docker compose -p sidekick pull")
+	assert.Contains(t, utils.GetUfwInstallCommand(), "apt-get install -y ufw")
+}
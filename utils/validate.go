@@ -0,0 +1,383 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	appNamePattern     = regexp.MustCompile(`^[a-z]([a-z0-9-]*[a-z0-9])?$`)
+	domainLabelPattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?$`)
+	yamlLinePattern    = regexp.MustCompile(`^line (\d+): (.*)$`)
+	unknownFieldError  = regexp.MustCompile(`^field (\S+) not found in type (\S+)$`)
+	entrypointPattern  = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+// ConfigProblem is one thing wrong with sidekick.yml, Line is 0 when it can't be pinned to a line
+type ConfigProblem struct {
+	Line    int    `json:"line,omitempty"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+func (p ConfigProblem) String() string {
+	location := p.Field
+	if p.Line > 0 {
+		location = fmt.Sprintf("line %d", p.Line)
+		if p.Field != "" {
+			location += " " + p.Field
+		}
+	}
+	if location == "" {
+		return p.Message
+	}
+	return fmt.Sprintf("%s: %s", location, p.Message)
+}
+
+// ConfigProblemsError carries every problem found so they can all be fixed in one go
+type ConfigProblemsError struct {
+	Problems []ConfigProblem
+}
+
+func (e *ConfigProblemsError) Error() string {
+	lines := make([]string, len(e.Problems))
+	for i, problem := range e.Problems {
+		lines[i] = problem.String()
+	}
+	return fmt.Sprintf("%s has %d problem(s):\n  %s", AppConfigFile, len(e.Problems), strings.Join(lines, "\n  "))
+}
+
+// ParseAppConfig decodes sidekick.yml strictly. Unknown fields and values of the wrong type are problems, and so is
+// anything ValidateAppConfig finds. checkFiles also requires the env file and the TLS files to exist.
+func ParseAppConfig(content []byte, checkFiles bool) (SidekickAppConfig, []ConfigProblem) {
+	appConfig := SidekickAppConfig{}
+	problems := []ConfigProblem{}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	err := decoder.Decode(&appConfig)
+	var typeErr *yaml.TypeError
+	switch {
+	case err == nil:
+	case errors.As(err, &typeErr):
+		// the decoder keeps going after a bad field so every one of them is reported
+		for _, message := range typeErr.Errors {
+			problem := yamlProblem(message)
+			// x- keys are left for your own notes and tools, like in compose files
+			if strings.HasPrefix(problem.Field, "x-") {
+				continue
+			}
+			problems = append(problems, problem)
+		}
+	default:
+		return appConfig, append(problems, yamlProblem(err.Error()))
+	}
+
+	var root yaml.Node
+	yaml.Unmarshal(content, &root)
+	for _, problem := range ValidateAppConfig(appConfig, checkFiles) {
+		problem.Line = nodeLine(&root, strings.Split(problem.Field, ".")...)
+		problems = append(problems, problem)
+	}
+	return appConfig, problems
+}
+
+// ValidateAppConfig checks the values of an app config, Field is the yaml path of the bad value
+func ValidateAppConfig(appConfig SidekickAppConfig, checkFiles bool) []ConfigProblem {
+	problems := []ConfigProblem{}
+	add := func(field string, format string, args ...any) {
+		problems = append(problems, ConfigProblem{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if err := ValidateAppName(appConfig.Name); err != nil {
+		add("name", "%s", err)
+	}
+	if appConfig.Port < 1 || appConfig.Port > 65535 {
+		add("port", "%d is not a port, it must be between 1 and 65535", appConfig.Port)
+	}
+	if err := ValidateDomain(appConfig.Url); err != nil {
+		add("url", "%s", err)
+	}
+	if appConfig.PreviewDomain != "" {
+		if err := ValidateDomain(appConfig.PreviewDomain); err != nil {
+			add("previewDomain", "%s", err)
+		}
+	}
+	if checkFiles && appConfig.Env.File != "" && !FileExists(appConfig.Env.File) {
+		add("env.file", "%s does not exist", appConfig.Env.File)
+	}
+	if (appConfig.TLS.Cert == "") != (appConfig.TLS.Key == "") {
+		add("tls", "cert and key must be set together")
+	}
+	if appConfig.TLS.Disabled && (appConfig.TLS.Cert != "" || appConfig.TLS.Key != "") {
+		add("tls", "a custom cert needs TLS, remove it to serve the app over plain HTTP")
+	}
+	for field, name := range map[string]string{"entrypoints.web": appConfig.Entrypoints.Web, "entrypoints.websecure": appConfig.Entrypoints.Websecure} {
+		if name != "" && !entrypointPattern.MatchString(name) {
+			add(field, "%q is not a Traefik entrypoint name, use letters, numbers, dashes and underscores", name)
+		}
+	}
+	for i, network := range appConfig.Networks {
+		if err := ValidateNetworkName(network); err != nil {
+			add(fmt.Sprintf("networks[%d]", i), "%s", err)
+		}
+	}
+	for _, label := range appConfig.Labels {
+		if err := ValidateLabel(label); err != nil {
+			add("labels", "%s", err)
+		}
+	}
+	if IsStatic(appConfig) && appConfig.Port != StaticPort {
+		add("port", "a static site is served by nginx on port %d, not %d", StaticPort, appConfig.Port)
+	}
+	if checkFiles && IsStatic(appConfig) {
+		if err := ValidateStaticDir(appConfig.Static); err != nil {
+			add("static", "%s", err)
+		}
+	}
+	if checkFiles {
+		for field, path := range map[string]string{"tls.cert": appConfig.TLS.Cert, "tls.key": appConfig.TLS.Key} {
+			if path != "" && !FileExists(path) {
+				add(field, "%s does not exist", path)
+			}
+		}
+	}
+	if appConfig.HealthCheck.Port > 65535 {
+		add("healthCheck.port", "%d is not a port, it must be between 1 and 65535", appConfig.HealthCheck.Port)
+	}
+	if appConfig.HealthCheck.Timeout < 0 {
+		add("healthCheck.timeout", "must not be negative")
+	}
+	for service, check := range appConfig.Services {
+		if check.Port > 65535 {
+			add("services."+service+".port", "%d is not a port, it must be between 1 and 65535", check.Port)
+		}
+		if check.Timeout < 0 {
+			add("services."+service+".timeout", "must not be negative")
+		}
+	}
+	if appConfig.KeepImages < 0 {
+		add("keepImages", "must not be negative")
+	}
+	if appConfig.Timeout != "" {
+		if timeout, err := time.ParseDuration(appConfig.Timeout); err != nil || timeout < 0 {
+			add("timeout", "%q is not a duration, use one like 15m", appConfig.Timeout)
+		}
+	}
+	if appConfig.VerifyTimeout != "" {
+		if timeout, err := time.ParseDuration(appConfig.VerifyTimeout); err != nil || timeout < 0 {
+			add("verifyTimeout", "%q is not a duration, use one like 2m or 0 to skip the check", appConfig.VerifyTimeout)
+		}
+	}
+	if appConfig.LockTimeout != "" {
+		if timeout, err := time.ParseDuration(appConfig.LockTimeout); err != nil || timeout <= 0 {
+			add("lockTimeout", "%q is not a duration, use one like 1h", appConfig.LockTimeout)
+		}
+	}
+	if HasRegistry(appConfig) {
+		if err := ValidateRegistryConfig(appConfig.Registry); err != nil {
+			add("registry", "%s", err)
+		}
+	}
+	if appConfig.Orchestrator != "" && appConfig.Orchestrator != OrchestratorCompose && appConfig.Orchestrator != OrchestratorSwarm {
+		add("orchestrator", "%q must be %s or %s", appConfig.Orchestrator, OrchestratorCompose, OrchestratorSwarm)
+	}
+	if appConfig.Logging.MaxSize != "" && !logSizePattern.MatchString(appConfig.Logging.MaxSize) {
+		add("logging.maxSize", "%q is not a size, use one like %s", appConfig.Logging.MaxSize, DefaultLogMaxSize)
+	}
+	if appConfig.Logging.MaxFile < 0 {
+		add("logging.maxFile", "must not be negative")
+	}
+	if appConfig.Logging.Driver != "" && !slices.Contains(rotatingLogDrivers, appConfig.Logging.Driver) && (appConfig.Logging.MaxSize != "" || appConfig.Logging.MaxFile != 0) {
+		add("logging", "maxSize and maxFile only apply to the %s drivers", strings.Join(rotatingLogDrivers, " and "))
+	}
+	for i, notification := range appConfig.Notifications {
+		if err := ValidateNotification(notification); err != nil {
+			add(fmt.Sprintf("notifications[%d]", i), "%s", err)
+		}
+	}
+	if len(appConfig.Cron) > 0 && IsSwarm(appConfig) {
+		add("cron", "cron jobs need the compose orchestrator")
+	}
+	seenJobs := map[string]bool{}
+	for i, job := range appConfig.Cron {
+		field := fmt.Sprintf("cron[%d]", i)
+		if !appNamePattern.MatchString(job.Name) {
+			add(field+".name", "%q must be lowercase letters, numbers and dashes, starting with a letter", job.Name)
+		} else if seenJobs[job.Name] {
+			add(field+".name", "%q is used by another cron job", job.Name)
+		}
+		seenJobs[job.Name] = true
+		if err := ValidateCronSchedule(job.Schedule); err != nil {
+			add(field+".schedule", "%s", err)
+		}
+		if strings.TrimSpace(job.Command) == "" {
+			add(field+".command", "a command is required")
+		}
+	}
+	if len(appConfig.Addons) > 0 && IsSwarm(appConfig) {
+		add("addons", "addons need the compose orchestrator")
+	}
+	seenAddons := map[string]bool{}
+	for i, addon := range appConfig.Addons {
+		field := fmt.Sprintf("addons[%d]", i)
+		if err := ValidateAddonType(addon.Type); err != nil {
+			add(field+".type", "%s", err)
+		} else if seenAddons[addon.Type] {
+			add(field+".type", "the app has %s already", addon.Type)
+		}
+		seenAddons[addon.Type] = true
+		if !imageTagPattern.MatchString(addon.Version) {
+			add(field+".version", "%q is not a version like %s", addon.Version, NewAddon(addon.Type).Version)
+		}
+		if addon.Type != AddonRedis && (addon.Persist || addon.Shared) {
+			add(field, "persist and shared are only for redis, %s always keeps its data and is shared with previews", addon.Type)
+		}
+	}
+	return problems
+}
+
+// ValidateDomain checks the syntax of a domain, it does not look it up
+func ValidateDomain(domain string) error {
+	if domain == "" {
+		return errors.New("a domain is required")
+	}
+	if strings.Contains(domain, "://") || strings.ContainsAny(domain, "/:") {
+		return fmt.Errorf("%q must be a bare domain like app.example.com, without a scheme, port or path", domain)
+	}
+	if !isASCII(domain) {
+		return fmt.Errorf("%q must be written in punycode, use %s", domain, NormalizeDomain(domain))
+	}
+	if len(domain) > 253 {
+		return fmt.Errorf("%q is longer than 253 characters", domain)
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if len(label) > 63 || !domainLabelPattern.MatchString(label) {
+			return fmt.Errorf("%q is not a valid domain", domain)
+		}
+	}
+	return nil
+}
+
+func yamlProblem(message string) ConfigProblem {
+	message = strings.TrimPrefix(message, "yaml: ")
+	problem := ConfigProblem{Message: message}
+	if match := yamlLinePattern.FindStringSubmatch(message); match != nil {
+		problem.Line, _ = strconv.Atoi(match[1])
+		problem.Message = match[2]
+	}
+	if match := unknownFieldError.FindStringSubmatch(problem.Message); match != nil {
+		problem.Field = match[1]
+		problem.Message = "unknown field"
+		if suggestion := suggestField(match[1], match[2]); suggestion != "" {
+			problem.Message = fmt.Sprintf("unknown field, did you mean %s?", suggestion)
+		}
+	}
+	return problem
+}
+
+// suggestField finds the closest yaml key of the named config type
+func suggestField(field string, typeName string) string {
+	keys := yamlKeys(reflect.TypeOf(SidekickAppConfig{}), strings.TrimPrefix(typeName, "utils."), map[reflect.Type]bool{})
+	best, bestDistance := "", len(field)/2+1
+	for _, key := range keys {
+		if distance := editDistance(strings.ToLower(field), strings.ToLower(key)); distance < bestDistance {
+			best, bestDistance = key, distance
+		}
+	}
+	return best
+}
+
+func yamlKeys(t reflect.Type, typeName string, seen map[reflect.Type]bool) []string {
+	for t.Kind() == reflect.Map || t.Kind() == reflect.Slice || t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || seen[t] {
+		return nil
+	}
+	seen[t] = true
+	if t.Name() == typeName {
+		keys := []string{}
+		for i := 0; i < t.NumField(); i++ {
+			if key := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]; key != "" && key != "-" {
+				keys = append(keys, key)
+			}
+		}
+		return keys
+	}
+	for i := 0; i < t.NumField(); i++ {
+		if keys := yamlKeys(t.Field(i).Type, typeName, seen); keys != nil {
+			return keys
+		}
+	}
+	return nil
+}
+
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
+
+// nodeLine is the line of the value at path, or of the deepest key found on the way
+func nodeLine(node *yaml.Node, path ...string) int {
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	line := 0
+	for _, key := range path {
+		if node.Kind != yaml.MappingNode {
+			return line
+		}
+		found := false
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				line = node.Content[i].Line
+				node = node.Content[i+1]
+				found = true
+				break
+			}
+		}
+		if !found {
+			return line
+		}
+	}
+	return line
+}
@@ -0,0 +1,132 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/mightymoud/sidekick/render"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// DefaultVerifyTimeout leaves Let's Encrypt time to issue the certificate of a new domain
+	DefaultVerifyTimeout = 2 * time.Minute
+	verifyPollInterval   = 3 * time.Second
+	verifyLogLines       = 50
+
+	VerifyHint = "It is running but not reachable. Check the logs above, that the domain points at your VPS and that ports 80 and 443 are open"
+)
+
+// GetVerifyTimeout is how long to wait for the app to answer on its URL after a deploy, 0 skips the check
+func GetVerifyTimeout(cmd *cobra.Command, appConfig SidekickAppConfig) (time.Duration, error) {
+	value := appConfig.VerifyTimeout
+	if cmd.Flags().Changed("verify-timeout") {
+		value, _ = cmd.Flags().GetString("verify-timeout")
+	}
+	if value == "" {
+		return DefaultVerifyTimeout, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout < 0 {
+		return 0, fmt.Errorf("invalid verify timeout %q, use a duration like 2m or 0 to skip the check", value)
+	}
+	return timeout, nil
+}
+
+// VerifyURL is where the app is checked from outside, on its health check path when it has one
+func VerifyURL(appConfig SidekickAppConfig, host string) string {
+	path := appConfig.HealthCheck.Path
+	if path == "" {
+		path = "/"
+	}
+	return fmt.Sprintf("%s://%s%s", URLScheme(appConfig), host, path)
+}
+
+// VerifyStep is the line of a dry run plan for the check
+func VerifyStep(url string, timeout time.Duration) string {
+	return fmt.Sprintf("wait up to %s for %s to answer", timeout, url)
+}
+
+// newVerifyClient trusts the certificate like a browser would, except for staging ones which no browser trusts
+func newVerifyClient(appConfig SidekickAppConfig) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if appConfig.StagingTLS && GetCertResolver(appConfig) != "" {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &http.Client{Transport: transport, Timeout: 10 * time.Second}
+}
+
+// ProbeURL fails on anything but a response under 500 with a valid certificate
+func ProbeURL(client *http.Client, url string) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+	return nil
+}
+
+// WaitForURL polls url until it answers, timeout passes or the operation is cancelled, the error is the last one seen
+func WaitForURL(client *http.Client, url string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := ProbeURL(client, url)
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(verifyPollInterval).After(deadline) {
+			return fmt.Errorf("%s did not answer within %s: %w", url, timeout, err)
+		}
+		// Ctrl-C or the timeout of the deploy stops the wait too
+		select {
+		case <-OperationContext().Done():
+			return fmt.Errorf("stopped waiting for %s to answer: %w", url, OperationContext().Err())
+		case <-time.After(verifyPollInterval):
+		}
+	}
+}
+
+// VerifyDeployWithTUIHook waits for the service deployed in dir to answer on host.
+// When it doesn't, the last lines of its logs go to the TUI so the reason is right there.
+func VerifyDeployWithTUIHook(sshClient *ssh.Client, dir string, service string, host string, appConfig SidekickAppConfig, timeout time.Duration, p *tea.Program) error {
+	url := VerifyURL(appConfig, host)
+	p.Send(render.LogMsg{LogLine: fmt.Sprintf("Waiting up to %s for %s to answer\n", timeout, url)})
+	err := WaitForURL(newVerifyClient(appConfig), url, timeout)
+	if err == nil {
+		p.Send(render.LogMsg{LogLine: url + " answered\n"})
+		return nil
+	}
+	logs, logsErr := RunCommandOutput(sshClient, newServiceCommands(dir, appConfig).logs(service, verifyLogLines))
+	var exitErr *ssh.ExitError
+	if logsErr != nil && !errors.As(logsErr, &exitErr) {
+		return err
+	}
+	p.Send(render.LogMsg{LogLine: fmt.Sprintf("Last %d log lines of %s:\n", verifyLogLines, service)})
+	for _, line := range strings.Split(strings.TrimSpace(logs), "\n") {
+		p.Send(render.LogMsg{LogLine: line + "\n"})
+	}
+	return err
+}
@@ -0,0 +1,135 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Set at build time with -ldflags "-X github.com/mightymoud/sidekick/utils.Version=..."
+var (
+	Version   = "dev"
+	Commit    = "none"
+	BuildDate = "unknown"
+)
+
+const (
+	UpdateCheckFile     = "update-check.json"
+	UpdateCheckOptOut   = "SIDEKICK_NO_UPDATE_CHECK"
+	updateCheckInterval = 24 * time.Hour
+	latestReleaseURL    = "https://api.github.com/repos/mightymoud/sidekick/releases/latest"
+)
+
+type updateCheck struct {
+	CheckedAt     time.Time `json:"checkedAt"`
+	LatestVersion string    `json:"latestVersion"`
+}
+
+// IsNewerVersion compares vX.Y.Z versions, anything that does not parse is never newer
+func IsNewerVersion(latest string, current string) bool {
+	latestParts, ok := parseVersion(latest)
+	if !ok {
+		return false
+	}
+	currentParts, ok := parseVersion(current)
+	if !ok {
+		return false
+	}
+	for i := range latestParts {
+		if latestParts[i] != currentParts[i] {
+			return latestParts[i] > currentParts[i]
+		}
+	}
+	return false
+}
+
+func parseVersion(version string) ([3]int, bool) {
+	var parts [3]int
+	version, _, _ = strings.Cut(strings.TrimPrefix(strings.TrimSpace(version), "v"), "-")
+	fields := strings.Split(version, ".")
+	if len(fields) != 3 {
+		return parts, false
+	}
+	for i, field := range fields {
+		n, err := strconv.Atoi(field)
+		if err != nil {
+			return parts, false
+		}
+		parts[i] = n
+	}
+	return parts, true
+}
+
+// UpdateCheckEnabled is off for dev builds and when SIDEKICK_NO_UPDATE_CHECK is set
+func UpdateCheckEnabled() bool {
+	if os.Getenv(UpdateCheckOptOut) != "" {
+		return false
+	}
+	_, ok := parseVersion(Version)
+	return ok
+}
+
+// CheckForUpdate returns the latest release when it is newer than this build, or "".
+// GitHub is asked at most once a day, the answer is cached next to the sidekick config.
+// Any failure just means no notice, it must never get in the way of the command.
+func CheckForUpdate() string {
+	path := filepath.Join(filepath.Dir(viper.GetString("config")), UpdateCheckFile)
+	var cached updateCheck
+	if content, err := os.ReadFile(path); err == nil {
+		json.Unmarshal(content, &cached)
+	}
+	if time.Since(cached.CheckedAt) > updateCheckInterval {
+		latest, err := fetchLatestVersion()
+		if err != nil {
+			return ""
+		}
+		cached = updateCheck{CheckedAt: time.Now(), LatestVersion: latest}
+		if content, err := json.Marshal(cached); err == nil {
+			os.WriteFile(path, content, 0600)
+		}
+	}
+	if IsNewerVersion(cached.LatestVersion, Version) {
+		return cached.LatestVersion
+	}
+	return ""
+}
+
+func fetchLatestVersion() (string, error) {
+	client := http.Client{Timeout: 3 * time.Second}
+	res, err := client.Get(latestReleaseURL)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("github returned %s", res.Status)
+	}
+	var release struct {
+		TagName string `json:"tag_name"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&release); err != nil {
+		return "", err
+	}
+	return release.TagName, nil
+}
@@ -0,0 +1,86 @@
+/*
+Copyright © 2024 Mahmoud Mousa <m.mousa@hey.com>
+
+Licensed under the GNU GPL License, Version 3.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+https://www.gnu.org/licenses/gpl-3.0.en.html
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+const (
+	// WildcardCertResolver gets certs with a DNS-01 challenge, the only one Let's Encrypt issues wildcard certs for
+	WildcardCertResolver = "wildcard"
+	// RemoteDNSChallengeEnvFile holds the DNS provider credentials, Traefik reads it as its env file
+	RemoteDNSChallengeEnvFile = "traefik/dns.env"
+)
+
+// HasDNSChallenge is true when the Traefik on server has the wildcard resolver
+func HasDNSChallenge(server SidekickServer) bool {
+	return server.DNSChallenge.Provider != ""
+}
+
+// GetTraefikComposeFile is the compose file of the Traefik stack on server, the wildcard resolver is only there once a DNS provider is set
+func GetTraefikComposeFile(server SidekickServer) string {
+	compose := strings.NewReplacer("$EMAIL", server.CertEmail, "$NETWORK", server.NetworkName()).Replace(TraefikDockerComposeFile)
+	if !HasDNSChallenge(server) {
+		return compose
+	}
+	resolver := fmt.Sprintf(`      - --certificatesresolvers.%[1]s.acme.email=%[2]s
+      - --certificatesresolvers.%[1]s.acme.storage=/ssl-certs/acme-%[1]s.json
+      - --certificatesresolvers.%[1]s.acme.dnschallenge.provider=%[3]s
+    env_file:
+      - dns.env
+    ports:
+`, WildcardCertResolver, server.CertEmail, server.DNSChallenge.Provider)
+	return strings.Replace(compose, "    ports:\n", resolver, 1)
+}
+
+// PreviewHost is where the preview env of hash is served, under previewDomain when sidekick.yml sets one
+func PreviewHost(appConfig SidekickAppConfig, hash string) string {
+	if appConfig.PreviewDomain != "" {
+		return fmt.Sprintf("%s.%s", hash, appConfig.PreviewDomain)
+	}
+	return fmt.Sprintf("%s.%s", hash, appConfig.Url)
+}
+
+// GetWildcardLabels put the router of a preview on the shared wildcard cert of previewDomain.
+// Traefik asks for the cert once and every router naming the same domains reuses it.
+func GetWildcardLabels(appConfig SidekickAppConfig, routerName string) []string {
+	return []string{
+		fmt.Sprintf("traefik.http.routers.%s.tls.certresolver=%s", routerName, WildcardCertResolver),
+		fmt.Sprintf("traefik.http.routers.%s.tls.domains[0].main=%s", routerName, appConfig.PreviewDomain),
+		fmt.Sprintf("traefik.http.routers.%s.tls.domains[0].sans=*.%s", routerName, appConfig.PreviewDomain),
+	}
+}
+
+// UsesWildcardCert is true when the previews of the app share a wildcard cert on server, they get a cert each otherwise
+func UsesWildcardCert(appConfig SidekickAppConfig, server SidekickServer) bool {
+	return appConfig.PreviewDomain != "" && HasDNSChallenge(server) && TLSEnabled(appConfig)
+}
+
+// GetDNSChallengeEnvCommand writes the DNS provider credentials readable by the sidekick user only
+func GetDNSChallengeEnvCommand(content []byte) string {
+	return fmt.Sprintf("umask 077 && echo '%s' | base64 -d > %s", base64.StdEncoding.EncodeToString(content), RemoteDNSChallengeEnvFile)
+}
+
+// GetTraefikRestartCommand swaps in the compose file of server and recreates Traefik with it
+func GetTraefikRestartCommand(server SidekickServer) string {
+	return fmt.Sprintf(`set -e
+echo '%s' | base64 -d > traefik/docker-compose.yml.new
+mv traefik/docker-compose.yml.new traefik/docker-compose.yml
+cd traefik
+docker compose -p sidekick up -d traefik-service`, base64.StdEncoding.EncodeToString([]byte(GetTraefikComposeFile(server))))
+}